@@ -0,0 +1,281 @@
+package api
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/weaveworks/weave/router"
+)
+
+const (
+	defaultCaptureDuration = 10 * time.Second
+	maxCaptureDuration     = time.Hour
+	captureSnapLen         = 65535
+	linkTypeEthernet       = 1
+	linkTypeRaw            = 101 // IPv4 packets with no link layer
+)
+
+// capture streams copies of the frames passing through the router, in
+// pcap format, for the duration asked for, or until the client goes
+// away. Frames are those we capture and inject, unless encapsulated
+// is true, when they are the UDP packets we exchange with peers.
+func (s *Sources) capture(w http.ResponseWriter, r *http.Request) {
+	duration := defaultCaptureDuration
+	if d := r.FormValue("duration"); d != "" {
+		var err error
+		if duration, err = time.ParseDuration(d); err != nil || duration <= 0 {
+			replyError(w, http.StatusBadRequest, fmt.Errorf("Invalid duration %q", d))
+			return
+		}
+		if duration > maxCaptureDuration {
+			duration = maxCaptureDuration
+		}
+	}
+	peer := router.UnknownPeerName
+	if p := r.FormValue("peer"); p != "" {
+		var found bool
+		if peer, found = s.findPeer(p); !found {
+			replyError(w, http.StatusNotFound, fmt.Errorf("Unknown peer %q", p))
+			return
+		}
+	}
+	encapsulated := r.FormValue("encapsulated") == "true"
+	match, err := parseCaptureFilter(r.FormValue("filter"))
+	if err != nil {
+		replyError(w, http.StatusBadRequest, err)
+		return
+	}
+	if encapsulated && match != nil {
+		replyError(w, http.StatusBadRequest, fmt.Errorf("Filters only apply to frames that aren't encapsulated"))
+		return
+	}
+
+	c := s.Router.StartCapture(encapsulated, peer, match)
+	defer s.Router.StopCapture(c)
+	linkType := uint32(linkTypeEthernet)
+	if encapsulated {
+		linkType = linkTypeRaw
+	}
+	w.Header().Set("Content-Type", "application/vnd.tcpdump.pcap")
+	w.Header().Set("Content-Disposition", `attachment; filename="weave.pcap"`)
+	if err := writePcapHeader(w, linkType); err != nil {
+		return
+	}
+	flusher, _ := w.(http.Flusher)
+	flush := func() {
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+	flush()
+	var closed <-chan bool
+	if notifier, ok := w.(http.CloseNotifier); ok {
+		closed = notifier.CloseNotify()
+	}
+	timeout := time.After(duration)
+	for {
+		select {
+		case frame := <-c.Frames:
+			if err := writePcapRecord(w, frame.Time, frame.Data); err != nil {
+				return
+			}
+			flush()
+		case <-timeout:
+			return
+		case <-closed:
+			return
+		}
+	}
+}
+
+// The peer with the name or nickname given
+func (s *Sources) findPeer(nameOrNick string) (router.PeerName, bool) {
+	if name, err := router.PeerNameFromUserInput(nameOrNick); err == nil {
+		if _, found := s.Router.Peers.Fetch(name); found {
+			return name, true
+		}
+	}
+	peer, found := router.UnknownPeerName, false
+	s.Router.Peers.ForEach(func(p *router.Peer) {
+		if p.NickName == nameOrNick {
+			peer, found = p.Name, true
+		}
+	})
+	return peer, found
+}
+
+func writePcapHeader(w io.Writer, linkType uint32) error {
+	header := make([]byte, 24)
+	binary.LittleEndian.PutUint32(header[0:], 0xa1b2c3d4) // magic, with microseconds
+	binary.LittleEndian.PutUint16(header[4:], 2)          // version 2.4
+	binary.LittleEndian.PutUint16(header[6:], 4)
+	binary.LittleEndian.PutUint32(header[16:], captureSnapLen)
+	binary.LittleEndian.PutUint32(header[20:], linkType)
+	_, err := w.Write(header)
+	return err
+}
+
+func writePcapRecord(w io.Writer, t time.Time, data []byte) error {
+	captured := data
+	if len(captured) > captureSnapLen {
+		captured = captured[:captureSnapLen]
+	}
+	header := make([]byte, 16)
+	binary.LittleEndian.PutUint32(header[0:], uint32(t.Unix()))
+	binary.LittleEndian.PutUint32(header[4:], uint32(t.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(header[8:], uint32(len(captured)))
+	binary.LittleEndian.PutUint32(header[12:], uint32(len(data)))
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err := w.Write(captured)
+	return err
+}
+
+// parseCaptureFilter makes a predicate on Ethernet frames from a
+// filter of space-separated terms, all of which must match, as in
+// tcpdump: arp, ip, tcp, udp, icmp, "host <ip>", "net <cidr>", "port
+// <port>" and "ether host <mac>". An empty filter matches everything, and gives a
+// nil predicate.
+func parseCaptureFilter(filter string) (func([]byte) bool, error) {
+	var terms []func(*frameSummary) bool
+	words := strings.Fields(filter)
+	for i := 0; i < len(words); i++ {
+		arg := func() (string, error) {
+			if i+1 >= len(words) {
+				return "", fmt.Errorf("Invalid filter %q: %s needs an argument", filter, words[i])
+			}
+			i++
+			return words[i], nil
+		}
+		switch words[i] {
+		case "arp":
+			terms = append(terms, func(f *frameSummary) bool { return f.etherType == etherTypeARP })
+		case "ip":
+			terms = append(terms, func(f *frameSummary) bool { return f.etherType == etherTypeIPv4 })
+		case "tcp", "udp", "icmp":
+			protocol := ipProtocols[words[i]]
+			terms = append(terms, func(f *frameSummary) bool { return f.etherType == etherTypeIPv4 && f.protocol == protocol })
+		case "host":
+			a, err := arg()
+			if err != nil {
+				return nil, err
+			}
+			ip := net.ParseIP(a).To4()
+			if ip == nil {
+				return nil, fmt.Errorf("Invalid filter %q: %q is not an IPv4 address", filter, a)
+			}
+			terms = append(terms, func(f *frameSummary) bool { return ip.Equal(f.srcIP) || ip.Equal(f.dstIP) })
+		case "net":
+			a, err := arg()
+			if err != nil {
+				return nil, err
+			}
+			_, subnet, err := net.ParseCIDR(a)
+			if err != nil || subnet.IP.To4() == nil {
+				return nil, fmt.Errorf("Invalid filter %q: %q is not an IPv4 subnet", filter, a)
+			}
+			terms = append(terms, func(f *frameSummary) bool {
+				return f.srcIP != nil && subnet.Contains(f.srcIP) || f.dstIP != nil && subnet.Contains(f.dstIP)
+			})
+		case "port":
+			a, err := arg()
+			if err != nil {
+				return nil, err
+			}
+			port, err := strconv.ParseUint(a, 10, 16)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid filter %q: %q is not a port", filter, a)
+			}
+			terms = append(terms, func(f *frameSummary) bool {
+				return f.hasPorts && (f.srcPort == uint16(port) || f.dstPort == uint16(port))
+			})
+		case "ether":
+			if a, err := arg(); err != nil || a != "host" {
+				return nil, fmt.Errorf("Invalid filter %q: expected ether host <mac>", filter)
+			}
+			a, err := arg()
+			if err != nil {
+				return nil, err
+			}
+			mac, err := net.ParseMAC(a)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid filter %q: %q is not a MAC address", filter, a)
+			}
+			terms = append(terms, func(f *frameSummary) bool {
+				return string(mac) == string(f.srcMAC) || string(mac) == string(f.dstMAC)
+			})
+		default:
+			return nil, fmt.Errorf("Invalid filter %q: unknown term %q", filter, words[i])
+		}
+	}
+	if len(terms) == 0 {
+		return nil, nil
+	}
+	return func(frame []byte) bool {
+		f := summariseFrame(frame)
+		if f == nil {
+			return false
+		}
+		for _, term := range terms {
+			if !term(f) {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+const (
+	etherTypeIPv4 = 0x0800
+	etherTypeARP  = 0x0806
+)
+
+var ipProtocols = map[string]byte{"icmp": 1, "tcp": 6, "udp": 17}
+
+// What filters look at in a frame
+type frameSummary struct {
+	srcMAC, dstMAC   net.HardwareAddr
+	etherType        uint16
+	protocol         byte
+	srcIP, dstIP     net.IP
+	hasPorts         bool
+	srcPort, dstPort uint16
+}
+
+// summariseFrame picks out the fields of an Ethernet frame that
+// filters look at, without decoding the whole thing, since it is
+// called for every frame while capturing
+func summariseFrame(frame []byte) *frameSummary {
+	if len(frame) < 14 {
+		return nil
+	}
+	f := &frameSummary{dstMAC: frame[0:6], srcMAC: frame[6:12], etherType: binary.BigEndian.Uint16(frame[12:14])}
+	payload := frame[14:]
+	switch f.etherType {
+	case etherTypeARP:
+		if len(payload) >= 28 {
+			f.srcIP, f.dstIP = payload[14:18], payload[24:28]
+		}
+	case etherTypeIPv4:
+		if len(payload) < 20 {
+			return f
+		}
+		headerLen := int(payload[0]&0x0f) * 4
+		f.protocol = payload[9]
+		f.srcIP, f.dstIP = payload[12:16], payload[16:20]
+		fragmentOffset := binary.BigEndian.Uint16(payload[6:8]) & 0x1fff
+		if (f.protocol == 6 || f.protocol == 17) && fragmentOffset == 0 && len(payload) >= headerLen+4 {
+			f.hasPorts = true
+			f.srcPort = binary.BigEndian.Uint16(payload[headerLen:])
+			f.dstPort = binary.BigEndian.Uint16(payload[headerLen+2:])
+		}
+	}
+	return f
+}
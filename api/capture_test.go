@@ -0,0 +1,68 @@
+package api
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	wt "github.com/weaveworks/weave/testing"
+)
+
+// An Ethernet frame carrying a UDP packet from 10.0.0.1:1234 to
+// 10.0.0.2:53
+func udpFrame() []byte {
+	frame := make([]byte, 14+20+8)
+	copy(frame[0:6], []byte{0x02, 0, 0, 0, 0, 0x02})
+	copy(frame[6:12], []byte{0x02, 0, 0, 0, 0, 0x01})
+	binary.BigEndian.PutUint16(frame[12:], etherTypeIPv4)
+	ip := frame[14:]
+	ip[0] = 0x45
+	ip[9] = 17
+	copy(ip[12:16], []byte{10, 0, 0, 1})
+	copy(ip[16:20], []byte{10, 0, 0, 2})
+	binary.BigEndian.PutUint16(ip[20:], 1234)
+	binary.BigEndian.PutUint16(ip[22:], 53)
+	return frame
+}
+
+func TestCaptureFilter(t *testing.T) {
+	frame := udpFrame()
+	for filter, matches := range map[string]bool{
+		"udp":                          true,
+		"tcp":                          false,
+		"arp":                          false,
+		"ip udp port 53":               true,
+		"udp port 80":                  false,
+		"host 10.0.0.2":                true,
+		"host 10.0.0.3":                false,
+		"net 10.0.0.0/30":              true,
+		"net 10.0.1.0/24":              false,
+		"ether host 02:00:00:00:00:01": true,
+		"ether host 02:00:00:00:00:03": false,
+	} {
+		match, err := parseCaptureFilter(filter)
+		wt.AssertNoErr(t, err)
+		wt.AssertTrue(t, match(frame) == matches, filter)
+	}
+	match, err := parseCaptureFilter("")
+	wt.AssertNoErr(t, err)
+	wt.AssertTrue(t, match == nil, "empty filter")
+	for _, filter := range []string{"port", "host foo", "port 70000", "net 10.0.0.1", "ether 02:00:00:00:00:01", "vlan"} {
+		_, err := parseCaptureFilter(filter)
+		wt.AssertTrue(t, err != nil, filter)
+	}
+}
+
+func TestPcap(t *testing.T) {
+	var buf bytes.Buffer
+	wt.AssertNoErr(t, writePcapHeader(&buf, linkTypeEthernet))
+	wt.AssertNoErr(t, writePcapRecord(&buf, time.Unix(1433160000, 5000), udpFrame()))
+	b := buf.Bytes()
+	wt.AssertEqualInt(t, len(b), 24+16+42, "length")
+	wt.AssertEqualuint64(t, uint64(binary.LittleEndian.Uint32(b[0:])), 0xa1b2c3d4, "magic")
+	wt.AssertEqualuint64(t, uint64(binary.LittleEndian.Uint32(b[20:])), linkTypeEthernet, "link type")
+	wt.AssertEqualuint64(t, uint64(binary.LittleEndian.Uint32(b[24:])), 1433160000, "seconds")
+	wt.AssertEqualuint64(t, uint64(binary.LittleEndian.Uint32(b[28:])), 5, "microseconds")
+	wt.AssertEqualuint64(t, uint64(binary.LittleEndian.Uint32(b[32:])), 42, "captured length")
+}
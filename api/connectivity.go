@@ -0,0 +1,52 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/weaveworks/weave/router"
+)
+
+// connectivity asks every peer to probe every other over the overlay,
+// and reports what they found, as a matrix
+func (s *Sources) connectivity(w http.ResponseWriter, r *http.Request) {
+	probes := router.DefaultConnectivityProbes
+	if p := r.FormValue("probes"); p != "" {
+		var err error
+		if probes, err = strconv.Atoi(p); err != nil || probes <= 0 || probes > router.MaxDiagProbes {
+			replyError(w, http.StatusBadRequest, fmt.Errorf("Invalid probes %q: expected up to %d", p, router.MaxDiagProbes))
+			return
+		}
+	}
+	matrix, err := s.Router.CheckConnectivity(probes)
+	if err != nil {
+		replyError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	index := make(map[router.PeerName]int, len(matrix.Peers))
+	c := Connectivity{Peers: make([]ConnectivityPeer, len(matrix.Peers)), Matrix: make([][]*ConnectivityCell, len(matrix.Peers))}
+	for i, name := range matrix.Peers {
+		index[name] = i
+		c.Peers[i].Name = name.String()
+		if peer, found := s.Router.Peers.Fetch(name); found {
+			c.Peers[i].NickName = peer.NickName
+		}
+		c.Matrix[i] = make([]*ConnectivityCell, len(matrix.Peers))
+	}
+	for name, cells := range matrix.Rows {
+		i := index[name]
+		c.Peers[i].Answered = true
+		for _, cell := range cells {
+			j, found := index[cell.To]
+			if !found {
+				continue // a peer we don't know of
+			}
+			c.Matrix[i][j] = &ConnectivityCell{Sent: cell.Sent, Received: cell.Received, RTTMillis: millis(cell.RTT), Error: cell.Error}
+			if cell.Sent > 0 {
+				c.Matrix[i][j].LossPercent = 100 * float64(cell.Sent-cell.Received) / float64(cell.Sent)
+			}
+		}
+	}
+	reply(w, c)
+}
@@ -0,0 +1,11 @@
+/*
+Package control has the messages and service of control.proto, the
+router's control API over gRPC, for its server and for Go clients.
+
+control.pb.go is generated from control.proto by protoc with the
+protoc-gen-go of github.com/golang/protobuf; run "go generate" here
+after changing control.proto.
+*/
+package control
+
+//go:generate protoc --go_out=plugins=grpc,paths=source_relative:. control.proto
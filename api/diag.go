@@ -0,0 +1,109 @@
+package api
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/weaveworks/weave/router"
+)
+
+// diagPing sends probes over the overlay to the target asked for, a
+// peer's name or nickname, or a container's address, and reports
+// their round trip times
+func (s *Sources) diagPing(w http.ResponseWriter, r *http.Request) {
+	count := router.DefaultDiagProbes
+	if c := r.FormValue("count"); c != "" {
+		var err error
+		if count, err = strconv.Atoi(c); err != nil || count <= 0 || count > router.MaxDiagProbes {
+			replyError(w, http.StatusBadRequest, fmt.Errorf("Invalid count %q: expected up to %d", c, router.MaxDiagProbes))
+			return
+		}
+	}
+	s.diag(w, r, func(peer router.PeerName) ([]router.DiagProbe, error) {
+		return s.Router.DiagPing(peer, count)
+	}, func(ip net.IP) ([]router.DiagProbe, error) {
+		return s.Router.DiagPingIP(ip, count)
+	}, func(target string, _ router.PeerName, probes []router.DiagProbe) interface{} {
+		ping := DiagPing{Target: target, Sent: len(probes)}
+		var total float64
+		for _, probe := range probes {
+			if probe.Lost() {
+				continue
+			}
+			rtt := millis(probe.RTT)
+			if ping.Received == 0 {
+				ping.Peer, ping.NickName = probe.Peer.Name.String(), probe.Peer.NickName
+				ping.RTTMinMillis = rtt
+			}
+			ping.Received++
+			total += rtt
+			if rtt < ping.RTTMinMillis {
+				ping.RTTMinMillis = rtt
+			}
+			if rtt > ping.RTTMaxMillis {
+				ping.RTTMaxMillis = rtt
+			}
+		}
+		if ping.Received > 0 {
+			ping.RTTAvgMillis = total / float64(ping.Received)
+		}
+		ping.LossPercent = 100 * float64(ping.Sent-ping.Received) / float64(ping.Sent)
+		return ping
+	})
+}
+
+// diagTraceroute sends probes over the overlay to the target asked
+// for, as for diagPing, with hop limits of 1 and up, and reports the
+// peer that answered each, and how soon
+func (s *Sources) diagTraceroute(w http.ResponseWriter, r *http.Request) {
+	s.diag(w, r, s.Router.DiagTraceroute, s.Router.DiagTracerouteIP, func(target string, peer router.PeerName, probes []router.DiagProbe) interface{} {
+		trace := DiagTraceroute{Target: target, Hops: []DiagHop{}}
+		for _, probe := range probes {
+			hop := DiagHop{Lost: probe.Lost()}
+			if !hop.Lost {
+				hop.Peer, hop.NickName, hop.RTTMillis = probe.Peer.Name.String(), probe.Peer.NickName, millis(probe.RTT)
+				if probe.Address != nil {
+					hop.Address = probe.Address.String()
+				}
+			}
+			trace.Hops = append(trace.Hops, hop)
+		}
+		if len(probes) > 0 {
+			last := probes[len(probes)-1]
+			trace.Reached = !last.Lost() && (last.Address != nil || last.Peer.Name == peer)
+		}
+		return trace
+	})
+}
+
+// Probe the target asked for, a container's address, or a peer, and
+// reply with the report of the probes, given the peer, unless the
+// target is an address
+func (s *Sources) diag(w http.ResponseWriter, r *http.Request,
+	toPeer func(router.PeerName) ([]router.DiagProbe, error),
+	toIP func(net.IP) ([]router.DiagProbe, error),
+	report func(string, router.PeerName, []router.DiagProbe) interface{}) {
+	target := r.FormValue("target")
+	if target == "" {
+		replyError(w, http.StatusBadRequest, fmt.Errorf("No target given"))
+		return
+	}
+	var probes []router.DiagProbe
+	var err error
+	peer, found := router.UnknownPeerName, false
+	if ip := net.ParseIP(target); ip != nil {
+		probes, err = toIP(ip)
+	} else if peer, found = s.findPeer(target); found {
+		probes, err = toPeer(peer)
+	} else {
+		replyError(w, http.StatusNotFound, fmt.Errorf("Unknown peer %q", target))
+		return
+	}
+	if err != nil {
+		replyError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	reply(w, report(target, peer, probes))
+}
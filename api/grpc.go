@@ -0,0 +1,217 @@
+package api
+
+import (
+	"context"
+	"net"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/weaveworks/weave/api/control"
+	"github.com/weaveworks/weave/common/events"
+	"github.com/weaveworks/weave/ipam/address"
+	"github.com/weaveworks/weave/nameserver"
+)
+
+// ServeGRPC serves the control API of control.proto on l, as version
+// 1 of the HTTP API does, until l fails
+func ServeGRPC(l net.Listener, s *Sources) error {
+	server := grpc.NewServer()
+	control.RegisterControlServer(server, &controlServer{s})
+	return server.Serve(l)
+}
+
+type controlServer struct {
+	s *Sources
+}
+
+func (c *controlServer) Status(ctx context.Context, in *control.Empty) (*control.StatusReply, error) {
+	status := c.s.describe()
+	return &control.StatusReply{Version: status.Version, Encryption: status.Encryption, Name: status.Name,
+		NickName: status.NickName, Labels: status.Labels, Port: int32(status.Port), Interface: status.Interface,
+		Ipam: status.IPAM, Dns: status.DNS}, nil
+}
+
+func (c *controlServer) Peers(ctx context.Context, in *control.PeersRequest) (*control.PeersReply, error) {
+	reply := &control.PeersReply{}
+	for _, peer := range c.s.peerList() {
+		if !hasLabels(peer, in.Labels) {
+			continue
+		}
+		p := &control.Peer{Name: peer.Name, NickName: peer.NickName, Uid: peer.UID, Labels: peer.Labels, Version: peer.Version}
+		for _, conn := range peer.Connections {
+			p.Connections = append(p.Connections, &control.PeerConnection{Name: conn.Name, NickName: conn.NickName,
+				Address: conn.Address, Outbound: conn.Outbound, Established: conn.Established})
+		}
+		reply.Peers = append(reply.Peers, p)
+	}
+	return reply, nil
+}
+
+func (c *controlServer) Connections(ctx context.Context, in *control.Empty) (*control.ConnectionsReply, error) {
+	reply := &control.ConnectionsReply{}
+	for _, conn := range append(c.s.ourConnections(), c.s.targets()...) {
+		rc := &control.Connection{Address: conn.Address, State: conn.State, Outbound: conn.Outbound,
+			Name: conn.Name, NickName: conn.NickName, Error: conn.Error}
+		if conn.TryAfter != nil {
+			rc.TryAfter = conn.TryAfter.UnixNano()
+		}
+		reply.Connections = append(reply.Connections, rc)
+	}
+	return reply, nil
+}
+
+func (c *controlServer) Connect(ctx context.Context, in *control.ConnectRequest) (*control.Empty, error) {
+	if err := c.s.Router.ConnectionMaker.InitiateConnection(in.Peer); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid peer address: %s", err)
+	}
+	return &control.Empty{}, nil
+}
+
+func (c *controlServer) Forget(ctx context.Context, in *control.ForgetRequest) (*control.Empty, error) {
+	c.s.Router.ConnectionMaker.ForgetConnection(in.Peer)
+	return &control.Empty{}, nil
+}
+
+func (c *controlServer) checkIPAM() error {
+	if c.s.Allocator == nil {
+		return status.Errorf(codes.NotFound, "IP address allocation is not enabled")
+	}
+	return nil
+}
+
+func (c *controlServer) IPAM(ctx context.Context, in *control.Empty) (*control.IPAMReply, error) {
+	if err := c.checkIPAM(); err != nil {
+		return nil, err
+	}
+	ipam := c.s.ipamStatus()
+	reply := &control.IPAMReply{Range: ipam.Range, Ready: ipam.Ready}
+	for _, a := range ipam.Allocations {
+		reply.Allocations = append(reply.Allocations, &control.Allocation{Ident: a.Ident, Address: a.Address})
+	}
+	return reply, nil
+}
+
+// The allocator gives up waiting for an address when told to on a
+// channel, as the HTTP API does when the client goes away
+func cancelChan(ctx context.Context) <-chan bool {
+	cancel := make(chan bool, 1)
+	go func() {
+		<-ctx.Done()
+		cancel <- true
+	}()
+	return cancel
+}
+
+func (c *controlServer) Allocate(ctx context.Context, in *control.AllocateRequest) (*control.Allocation, error) {
+	if err := c.checkIPAM(); err != nil {
+		return nil, err
+	}
+	addr, err := c.s.Allocator.Allocate(in.Ident, cancelChan(ctx))
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "%s", err)
+	}
+	a := c.s.allocation(in.Ident, addr)
+	return &control.Allocation{Ident: a.Ident, Address: a.Address}, nil
+}
+
+func (c *controlServer) Claim(ctx context.Context, in *control.ClaimRequest) (*control.Allocation, error) {
+	if err := c.checkIPAM(); err != nil {
+		return nil, err
+	}
+	addr, err := address.ParseIP(in.Address)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "%s", err)
+	}
+	if err := c.s.Allocator.Claim(in.Ident, addr, cancelChan(ctx)); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Unable to claim: %s", err)
+	}
+	a := c.s.allocation(in.Ident, addr)
+	return &control.Allocation{Ident: a.Ident, Address: a.Address}, nil
+}
+
+func (c *controlServer) Free(ctx context.Context, in *control.FreeRequest) (*control.Empty, error) {
+	if err := c.checkIPAM(); err != nil {
+		return nil, err
+	}
+	if err := c.s.Allocator.Free(in.Ident); err != nil {
+		return nil, status.Errorf(codes.NotFound, "%s", err)
+	}
+	return &control.Empty{}, nil
+}
+
+func (c *controlServer) checkDNS() error {
+	if c.s.Zone == nil {
+		return status.Errorf(codes.NotFound, "DNS is not enabled")
+	}
+	return nil
+}
+
+func (c *controlServer) DNS(ctx context.Context, in *control.Empty) (*control.DNSReply, error) {
+	if err := c.checkDNS(); err != nil {
+		return nil, err
+	}
+	reply := &control.DNSReply{}
+	for _, r := range c.s.dnsRecords() {
+		reply.Records = append(reply.Records, &control.DNSRecord{Ident: r.Ident, Name: r.Name, Address: r.Address, Origin: r.Origin, Local: r.Local})
+	}
+	return reply, nil
+}
+
+func (c *controlServer) AddName(ctx context.Context, in *control.AddNameRequest) (*control.Empty, error) {
+	if err := c.checkDNS(); err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(in.Address)
+	if ip == nil || ip.To4() == nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid IP %q", in.Address)
+	}
+	if in.Name == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "No name given")
+	}
+	err := c.s.Zone.AddRecord(in.Ident, in.Name, ip)
+	if _, dup := err.(nameserver.DuplicateError); err != nil && !dup {
+		return nil, status.Errorf(codes.InvalidArgument, "%s", err)
+	}
+	return &control.Empty{}, nil
+}
+
+func (c *controlServer) DeleteNames(ctx context.Context, in *control.DeleteNamesRequest) (*control.Empty, error) {
+	if err := c.checkDNS(); err != nil {
+		return nil, err
+	}
+	var err error
+	if in.Address != "" {
+		ip := net.ParseIP(in.Address)
+		if ip == nil {
+			return nil, status.Errorf(codes.InvalidArgument, "Invalid IP %q", in.Address)
+		}
+		err = c.s.Zone.DeleteRecord(in.Ident, ip)
+	} else {
+		err = c.s.Zone.DeleteRecordsFor(in.Ident)
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.NotFound, "%s", err)
+	}
+	return &control.Empty{}, nil
+}
+
+func (c *controlServer) Watch(in *control.WatchRequest, stream control.Control_WatchServer) error {
+	ch := events.Subscribe()
+	defer events.Unsubscribe(ch)
+	for {
+		select {
+		case event := <-ch:
+			if !strings.HasPrefix(event.Type, in.Type) {
+				continue
+			}
+			if err := stream.Send(&control.Event{Time: event.Time.UnixNano(), Type: event.Type, Fields: event.Fields}); err != nil {
+				return err
+			}
+		case <-stream.Context().Done():
+			return nil
+		}
+	}
+}
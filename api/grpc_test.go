@@ -0,0 +1,70 @@
+package api
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/weaveworks/weave/api/control"
+	"github.com/weaveworks/weave/common/events"
+	"github.com/weaveworks/weave/router"
+	wt "github.com/weaveworks/weave/testing"
+)
+
+func TestGRPC(t *testing.T) {
+	name, _ := router.PeerNameFromString("01:00:00:01:00:00")
+	r := router.NewRouter(router.RouterConfig{Labels: map[string]string{"dc": "eu-west"}}, name, "nick")
+	s := &Sources{Version: "test", Router: r}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	wt.AssertNoErr(t, err)
+	defer l.Close()
+	go ServeGRPC(l, s)
+
+	conn, err := grpc.Dial(l.Addr().String(), grpc.WithInsecure())
+	wt.AssertNoErr(t, err)
+	defer conn.Close()
+	client := control.NewControlClient(conn)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	reply, err := client.Status(ctx, &control.Empty{})
+	wt.AssertNoErr(t, err)
+	wt.AssertEqualString(t, reply.Name, name.String(), "name")
+	wt.AssertEqualString(t, reply.Labels["dc"], "eu-west", "label")
+
+	peers, err := client.Peers(ctx, &control.PeersRequest{Labels: []string{"dc=eu-west"}})
+	wt.AssertNoErr(t, err)
+	wt.AssertEqualInt(t, len(peers.Peers), 1, "peers with label")
+	peers, err = client.Peers(ctx, &control.PeersRequest{Labels: []string{"dc=us-east"}})
+	wt.AssertNoErr(t, err)
+	wt.AssertEqualInt(t, len(peers.Peers), 0, "peers with other label")
+
+	_, err = client.IPAM(ctx, &control.Empty{})
+	wt.AssertTrue(t, status.Code(err) == codes.NotFound, "IPAM not enabled")
+
+	watch, err := client.Watch(ctx, &control.WatchRequest{Type: "peer."})
+	wt.AssertNoErr(t, err)
+	// Keep publishing until the server has subscribed
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(10 * time.Millisecond):
+				events.Publish(events.AddressFreed, nil)
+				events.Publish(events.PeerJoined, map[string]string{"name": "02:00:00:02:00:00"})
+			}
+		}
+	}()
+	event, err := watch.Recv()
+	wt.AssertNoErr(t, err)
+	wt.AssertEqualString(t, event.Type, events.PeerJoined, "event type")
+	wt.AssertEqualString(t, event.Fields["name"], "02:00:00:02:00:00", "event field")
+}
@@ -0,0 +1,102 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// A check of some part of the router, returning what is wrong, if
+// anything
+type check struct {
+	name  string
+	check func() error
+}
+
+// What must be working for the router to be any use; if not, it
+// should be restarted
+func (s *Sources) healthChecks() []check {
+	checks := []check{}
+	if s.Router.Iface != nil {
+		checks = append(checks, check{"capture", func() error {
+			if s.Router.Started() && !s.Router.Capturing() {
+				return fmt.Errorf("not capturing on %s", s.Router.Iface.Name)
+			}
+			return nil
+		}})
+	}
+	if s.Router.Watchdog != nil {
+		checks = append(checks, check{"watchdog", func() error {
+			if stalled := s.Router.Watchdog.Stalled(); len(stalled) > 0 {
+				return fmt.Errorf("no progress in %s", strings.Join(stalled, ", "))
+			}
+			return nil
+		}})
+	}
+	if s.Updater != nil {
+		checks = append(checks, check{"watcher", func() error {
+			if !s.Updater.Connected() {
+				return fmt.Errorf("not connected to the container runtime")
+			}
+			return nil
+		}})
+	}
+	return checks
+}
+
+// What must have happened for the router to be ready to carry
+// traffic and allocate addresses
+func (s *Sources) readinessChecks() []check {
+	checks := []check{{"router", func() error {
+		if !s.Router.Started() {
+			return fmt.Errorf("not started")
+		}
+		return nil
+	}}}
+	if len(s.Peers) > 0 {
+		checks = append(checks, check{"connections", func() error {
+			for conn := range s.Router.Ourself.Connections() {
+				if conn.Established() {
+					return nil
+				}
+			}
+			return fmt.Errorf("no connections established to any of %d peers", len(s.Peers))
+		}})
+	}
+	if s.Allocator != nil {
+		checks = append(checks, check{"ipam", func() error {
+			select {
+			case <-s.Allocator.Ready():
+				return nil
+			default:
+				return fmt.Errorf("awaiting consensus")
+			}
+		}})
+	}
+	return checks
+}
+
+// Reply to a check with 200 OK if all is well, or 503 Service
+// Unavailable if not, listing the results
+func serveChecks(w http.ResponseWriter, checks []check) {
+	status, results := http.StatusOK, ""
+	for _, c := range checks {
+		if err := c.check(); err != nil {
+			status = http.StatusServiceUnavailable
+			results += fmt.Sprintf("%s: %s\n", c.name, err)
+		} else {
+			results += fmt.Sprintf("%s: ok\n", c.name)
+		}
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(status)
+	fmt.Fprint(w, results)
+}
+
+func (s *Sources) healthz(w http.ResponseWriter, r *http.Request) {
+	serveChecks(w, s.healthChecks())
+}
+
+func (s *Sources) readyz(w http.ResponseWriter, r *http.Request) {
+	serveChecks(w, s.readinessChecks())
+}
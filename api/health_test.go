@@ -0,0 +1,32 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+
+	"github.com/weaveworks/weave/router"
+	wt "github.com/weaveworks/weave/testing"
+)
+
+func TestHealthAndReadiness(t *testing.T) {
+	name, _ := router.PeerNameFromString("01:00:00:01:00:00")
+	s := &Sources{Router: router.NewRouter(router.RouterConfig{}, name, "nick"), Peers: []string{"10.0.0.1"}}
+	muxRouter := mux.NewRouter()
+	HandleHTTP(muxRouter, s)
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("GET", "http://localhost"+path, nil)
+		muxRouter.ServeHTTP(w, r)
+		return w
+	}
+
+	wt.AssertStatus(t, get("/healthz").Code, http.StatusOK, "healthz")
+	w := get("/readyz")
+	wt.AssertStatus(t, w.Code, http.StatusServiceUnavailable, "readyz")
+	wt.AssertTrue(t, strings.Contains(w.Body.String(), "router: not started"), "router check")
+	wt.AssertTrue(t, strings.Contains(w.Body.String(), "connections: no connections"), "connections check")
+}
@@ -0,0 +1,516 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	. "github.com/weaveworks/weave/common"
+	"github.com/weaveworks/weave/common/updater"
+	"github.com/weaveworks/weave/ipam"
+	"github.com/weaveworks/weave/ipam/address"
+	"github.com/weaveworks/weave/nameserver"
+	"github.com/weaveworks/weave/networks"
+	"github.com/weaveworks/weave/router"
+)
+
+// Prefix is where version 1 of the API lives
+const Prefix = "/api/v1"
+
+// Sources is where the API finds what it describes and changes. The
+// allocator and the zone are nil when not enabled.
+type Sources struct {
+	Version   string
+	Router    *router.Router
+	Allocator *ipam.Allocator
+	Zone      nameserver.Zone    // for changes, through any registrar
+	ZoneDb    *nameserver.ZoneDb // for listing
+	Options   map[string]string  // the command line, for reports
+	Updater   *updater.Updater   // watching containers, if anything is
+	Peers     []string           // the peers we were asked to connect to
+	Networks  *networks.Registry // virtual networks, gossiped
+}
+
+// HandleHTTP wires up version 1 of the API to the provided mux.
+func HandleHTTP(muxRouter *mux.Router, s *Sources) {
+	r := muxRouter.PathPrefix(Prefix).Subrouter()
+	for _, route := range routes {
+		handle := route.handle
+		handler := func(w http.ResponseWriter, r *http.Request) { handle(s, w, r) }
+		switch route.needs {
+		case "ipam":
+			handler = s.withIPAM(handler)
+		case "dns":
+			handler = s.withDNS(handler)
+		case "networks":
+			handler = s.withNetworks(handler)
+		}
+		r.Methods(route.method).Path(route.path).HandlerFunc(handler)
+	}
+	r.Methods("GET").Path("/spec").HandlerFunc(serveSpec)
+
+	// The parts of the router's status, each on its own
+	muxRouter.Methods("GET").Path("/status/peers").HandlerFunc(s.peers)
+	muxRouter.Methods("GET").Path("/status/connections").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reply(w, s.ourConnections())
+	})
+	muxRouter.Methods("GET").Path("/status/targets").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reply(w, s.targets())
+	})
+	muxRouter.Methods("GET").Path("/status/gossip").HandlerFunc(s.gossip)
+	muxRouter.Methods("GET").Path("/connections/history").HandlerFunc(s.connectionHistory)
+	muxRouter.Methods("GET").Path("/connections/targets").HandlerFunc(s.connectionTargets)
+	muxRouter.Methods("GET").Path("/connections/annotations").HandlerFunc(s.annotations)
+	muxRouter.Methods("PUT").Path("/connections/annotations/{peer}").HandlerFunc(s.annotate)
+	muxRouter.Methods("DELETE").Path("/connections/annotations/{peer}").HandlerFunc(s.deleteAnnotation)
+	muxRouter.Methods("GET").Path("/duplicates").HandlerFunc(s.duplicates)
+	muxRouter.Methods("GET").Path("/flows/top").HandlerFunc(s.topFlows)
+	muxRouter.Methods("GET").Path("/report").HandlerFunc(s.report)
+	muxRouter.Methods("GET").Path("/debug/goroutines").HandlerFunc(s.goroutines)
+	muxRouter.Methods("GET").Path("/healthz").HandlerFunc(s.healthz)
+	muxRouter.Methods("GET").Path("/readyz").HandlerFunc(s.readyz)
+	muxRouter.Methods("GET").Path("/capture").HandlerFunc(s.capture)
+	muxRouter.Methods("POST").Path("/selftest").HandlerFunc(s.selfTest)
+	muxRouter.Methods("POST").Path("/diag/ping").HandlerFunc(s.diagPing)
+	muxRouter.Methods("POST").Path("/diag/traceroute").HandlerFunc(s.diagTraceroute)
+	muxRouter.Methods("POST").Path("/diag/connectivity").HandlerFunc(s.connectivity)
+	muxRouter.Methods("GET").Path("/mirrors").HandlerFunc(s.mirrors)
+	muxRouter.Methods("POST").Path("/mirrors").HandlerFunc(s.startMirror)
+	muxRouter.Methods("DELETE").Path("/mirrors/{id}").HandlerFunc(s.stopMirror)
+	muxRouter.Methods("GET").Path("/networks").HandlerFunc(s.withNetworks(s.networkList))
+	muxRouter.Methods("POST").Path("/networks").HandlerFunc(s.withNetworks(s.createNetwork))
+	muxRouter.Methods("GET").Path("/networks/{name}").HandlerFunc(s.withNetworks(s.network))
+	muxRouter.Methods("DELETE").Path("/networks/{name}").HandlerFunc(s.withNetworks(s.deleteNetwork))
+	muxRouter.Methods("PUT").Path("/networks/{name}/members/{container}").HandlerFunc(s.withNetworks(s.joinNetwork))
+	muxRouter.Methods("DELETE").Path("/networks/{name}/members/{container}").HandlerFunc(s.withNetworks(s.leaveNetwork))
+	muxRouter.Methods("GET").Path("/status/ipam").HandlerFunc(s.withIPAM(s.ipam))
+	muxRouter.Methods("GET").Path("/status/dns").HandlerFunc(s.withDNS(s.dns))
+}
+
+func reply(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		Warning.Printf("[api] Unable to encode reply: %s", err)
+	}
+}
+
+func replyError(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(ErrorReply{err.Error()})
+	Warning.Printf("[api] %s", err)
+}
+
+func decode(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		replyError(w, http.StatusBadRequest, fmt.Errorf("Invalid request body: %s", err))
+		return false
+	}
+	return true
+}
+
+func (s *Sources) status(w http.ResponseWriter, r *http.Request) {
+	reply(w, s.describe())
+}
+
+func (s *Sources) describe() Status {
+	status := Status{
+		Version:    s.Version,
+		Encryption: s.Router.UsingPassword(),
+		Name:       s.Router.Ourself.Name.String(),
+		NickName:   s.Router.Ourself.NickName,
+		Labels:     s.Router.Ourself.Labels,
+		Port:       s.Router.Port,
+		IPAM:       s.Allocator != nil,
+		DNS:        s.Zone != nil,
+	}
+	if s.Router.Iface != nil {
+		status.Interface = s.Router.Iface.Name
+	}
+	return status
+}
+
+func (s *Sources) peers(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	peers := []Peer{}
+	for _, peer := range s.peerList() {
+		if hasLabels(peer, r.Form["label"]) {
+			peers = append(peers, peer)
+		}
+	}
+	reply(w, peers)
+}
+
+// Whether the peer has all the labels, given as <key>[=<value>]
+func hasLabels(peer Peer, labels []string) bool {
+	for _, label := range labels {
+		kv := strings.SplitN(label, "=", 2)
+		value, found := peer.Labels[kv[0]]
+		if !found || (len(kv) == 2 && value != kv[1]) {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *Sources) peerList() []Peer {
+	peers := []Peer{}
+	for _, status := range s.Router.Peers.Status() {
+		peer := Peer{status.Name, status.NickName, uint64(status.UID), status.Labels, status.Version, status.WeaveVersion, status.Features, []PeerConnection{}}
+		for _, conn := range status.Connections {
+			peer.Connections = append(peer.Connections, PeerConnection{conn.Name, conn.NickName, conn.TCPAddr, conn.Outbound, conn.Established})
+		}
+		peers = append(peers, peer)
+	}
+	return peers
+}
+
+func (s *Sources) connections(w http.ResponseWriter, r *http.Request) {
+	reply(w, append(s.ourConnections(), s.targets()...))
+}
+
+func (s *Sources) ourConnections() []Connection {
+	connections := []Connection{}
+	for conn := range s.Router.Ourself.Connections() {
+		c := Connection{Address: conn.RemoteTCPAddr(), State: ConnectionPending, Outbound: conn.Outbound(), Name: conn.Remote().Name.String(), NickName: conn.Remote().NickName}
+		if conn.Established() {
+			c.State = ConnectionEstablished
+		}
+		c.Annotation = s.annotation(c.Name, c.NickName, c.Address)
+		connections = append(connections, c)
+	}
+	return connections
+}
+
+// The addresses we are trying to connect to
+func (s *Sources) targets() []Connection {
+	targets := []Connection{}
+	for _, target := range s.Router.ConnectionMaker.Targets() {
+		c := Connection{Address: target.Address, State: ConnectionConnecting, Outbound: true, Error: target.LastError}
+		if !target.Attempting {
+			tryAfter := target.TryAfter
+			c.State, c.TryAfter = ConnectionRetrying, &tryAfter
+		}
+		c.Annotation = s.annotation(c.Address)
+		targets = append(targets, c)
+	}
+	return targets
+}
+
+// The annotation of a connection, by the first of keys that has one
+func (s *Sources) annotation(keys ...string) *Annotation {
+	a, found := s.Router.Annotations.Lookup(keys...)
+	if !found {
+		return nil
+	}
+	return &Annotation{a.Labels, a.Note, a.Time}
+}
+
+func (s *Sources) annotations(w http.ResponseWriter, r *http.Request) {
+	annotations := map[string]Annotation{}
+	for key, a := range s.Router.Annotations.All() {
+		annotations[key] = Annotation{a.Labels, a.Note, a.Time}
+	}
+	reply(w, annotations)
+}
+
+func (s *Sources) annotate(w http.ResponseWriter, r *http.Request) {
+	var req Annotation
+	if !decode(w, r, &req) {
+		return
+	}
+	if err := s.Router.Annotations.Set(mux.Vars(r)["peer"], req.Labels, req.Note); err != nil {
+		replyError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Sources) deleteAnnotation(w http.ResponseWriter, r *http.Request) {
+	if err := s.Router.Annotations.Delete(mux.Vars(r)["peer"]); err != nil {
+		replyError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Sources) connectionTargets(w http.ResponseWriter, r *http.Request) {
+	reply(w, s.allTargets())
+}
+
+func (s *Sources) allTargets() []ConnectionTarget {
+	targets := []ConnectionTarget{}
+	for _, target := range s.Router.ConnectionMaker.AllTargets() {
+		t := ConnectionTarget{Address: target.Address, State: target.State, Error: target.LastError, Failures: target.Failures, Name: target.Name}
+		t.Annotation = s.annotation(target.Name, target.Address)
+		if !target.LastAttempt.IsZero() {
+			lastAttempt := target.LastAttempt
+			t.LastAttempt = &lastAttempt
+		}
+		if target.State == router.TargetRetrying || target.State == router.TargetFailed {
+			tryAfter := target.TryAfter
+			t.TryAfter = &tryAfter
+		}
+		targets = append(targets, t)
+	}
+	return targets
+}
+
+func (s *Sources) connectionHistory(w http.ResponseWriter, r *http.Request) {
+	reply(w, s.history())
+}
+
+func (s *Sources) history() map[string][]ConnectionEvent {
+	history := map[string][]ConnectionEvent{}
+	for key, events := range s.Router.ConnectionHistory.Events() {
+		for _, event := range events {
+			history[key] = append(history[key], ConnectionEvent{event.Time, event.Type, event.Address, event.Outbound, event.Reason})
+		}
+	}
+	return history
+}
+
+func (s *Sources) duplicates(w http.ResponseWriter, r *http.Request) {
+	reply(w, s.duplicateAddresses())
+}
+
+func (s *Sources) duplicateAddresses() []DuplicateAddress {
+	duplicates := []DuplicateAddress{}
+	if s.Router.Bindings == nil {
+		return duplicates
+	}
+	for _, d := range s.Router.Bindings.Duplicates() {
+		duplicates = append(duplicates, DuplicateAddress{d.Time, d.Address, d.MAC, d.Peer.String(), d.OtherMAC, d.OtherPeer.String()})
+	}
+	return duplicates
+}
+
+func (s *Sources) gossip(w http.ResponseWriter, r *http.Request) {
+	reply(w, s.gossipStats())
+}
+
+func (s *Sources) gossipStats() map[string]GossipChannel {
+	channels := map[string]GossipChannel{}
+	for name, stats := range s.Router.GossipStats() {
+		channel := GossipChannel{GossipCounts(stats.Totals), map[string]GossipCounts{}}
+		for peer, counts := range stats.Peers {
+			channel.Peers[peer.String()] = GossipCounts(counts)
+		}
+		channels[name] = channel
+	}
+	return channels
+}
+
+// How many flows /flows/top lists, unless asked for another number
+const defaultTopFlows = 20
+
+func (s *Sources) topFlows(w http.ResponseWriter, r *http.Request) {
+	n := defaultTopFlows
+	if nStr := r.FormValue("n"); nStr != "" {
+		var err error
+		if n, err = strconv.Atoi(nStr); err != nil || n < 0 {
+			replyError(w, http.StatusBadRequest, fmt.Errorf("Invalid number of flows %q", nStr))
+			return
+		}
+	}
+	flows, untracked := s.Router.Flows.Top(n)
+	top := TopFlows{Flows: []Flow{}, Untracked: untracked}
+	for _, flow := range flows {
+		f := Flow{Source: flow.Src, Destination: flow.Dst, Outbound: flow.Outbound,
+			Packets: flow.Packets, Bytes: flow.Bytes, FirstSeen: flow.FirstSeen, LastSeen: flow.LastSeen}
+		if flow.Peer != router.UnknownPeerName {
+			f.Peer = flow.Peer.String()
+			if peer, found := s.Router.Peers.Fetch(flow.Peer); found {
+				f.NickName = peer.NickName
+			}
+		}
+		top.Flows = append(top.Flows, f)
+	}
+	reply(w, top)
+}
+
+func (s *Sources) connect(w http.ResponseWriter, r *http.Request) {
+	var req ConnectRequest
+	if !decode(w, r, &req) {
+		return
+	}
+	if err := s.Router.ConnectionMaker.InitiateConnection(req.Peer); err != nil {
+		replyError(w, http.StatusBadRequest, fmt.Errorf("Invalid peer address: %s", err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Sources) forget(w http.ResponseWriter, r *http.Request) {
+	s.Router.ConnectionMaker.ForgetConnection(mux.Vars(r)["peer"])
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Sources) withIPAM(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.Allocator == nil {
+			replyError(w, http.StatusNotFound, fmt.Errorf("IP address allocation is not enabled"))
+			return
+		}
+		h(w, r)
+	}
+}
+
+func (s *Sources) allocation(ident string, addr address.Address) Allocation {
+	subnet, _ := s.Allocator.Range()
+	ones, _ := subnet.Mask.Size()
+	return Allocation{ident, fmt.Sprintf("%s/%d", addr, ones)}
+}
+
+func (s *Sources) ipam(w http.ResponseWriter, r *http.Request) {
+	reply(w, s.ipamStatus())
+}
+
+func (s *Sources) ipamStatus() IPAM {
+	subnet, pickedBy := s.Allocator.Range()
+	status := IPAM{Range: subnet.String(), Allocations: []Allocation{}}
+	if pickedBy != router.UnknownPeerName {
+		status.PickedBy = pickedBy.String()
+	}
+	select {
+	case <-s.Allocator.Ready():
+		status.Ready = true
+	default:
+	}
+	for ident, addr := range s.Allocator.Owned() {
+		status.Allocations = append(status.Allocations, s.allocation(ident, addr))
+	}
+	return status
+}
+
+func (s *Sources) allocate(w http.ResponseWriter, r *http.Request) {
+	closedChan := w.(http.CloseNotifier).CloseNotify()
+	ident := mux.Vars(r)["ident"]
+	addr, err := s.Allocator.Allocate(ident, closedChan)
+	if err != nil {
+		replyError(w, http.StatusBadRequest, err)
+		return
+	}
+	reply(w, s.allocation(ident, addr))
+}
+
+func (s *Sources) claim(w http.ResponseWriter, r *http.Request) {
+	closedChan := w.(http.CloseNotifier).CloseNotify()
+	vars := mux.Vars(r)
+	addr, err := address.ParseIP(vars["address"])
+	if err != nil {
+		replyError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := s.Allocator.Claim(vars["ident"], addr, closedChan); err != nil {
+		replyError(w, http.StatusBadRequest, fmt.Errorf("Unable to claim: %s", err))
+		return
+	}
+	reply(w, s.allocation(vars["ident"], addr))
+}
+
+func (s *Sources) free(w http.ResponseWriter, r *http.Request) {
+	if err := s.Allocator.Free(mux.Vars(r)["ident"]); err != nil {
+		replyError(w, http.StatusNotFound, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Sources) withDNS(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.Zone == nil {
+			replyError(w, http.StatusNotFound, fmt.Errorf("DNS is not enabled"))
+			return
+		}
+		h(w, r)
+	}
+}
+
+func (s *Sources) dns(w http.ResponseWriter, r *http.Request) {
+	reply(w, s.dnsRecords())
+}
+
+func (s *Sources) dnsRecords() []DNSRecord {
+	records := []DNSRecord{}
+	for _, entry := range s.ZoneDb.Entries() {
+		records = append(records, DNSRecord{entry.Ident, entry.Name, entry.IP.String(), entry.Origin.String(), entry.Local})
+	}
+	return records
+}
+
+func (s *Sources) addName(w http.ResponseWriter, r *http.Request) {
+	var req DNSRequest
+	if !decode(w, r, &req) {
+		return
+	}
+	ip := net.ParseIP(req.Address)
+	if ip == nil || ip.To4() == nil {
+		replyError(w, http.StatusBadRequest, fmt.Errorf("Invalid IP %q", req.Address))
+		return
+	}
+	if req.Name == "" {
+		replyError(w, http.StatusBadRequest, fmt.Errorf("No name given"))
+		return
+	}
+	err := s.Zone.AddRecord(mux.Vars(r)["ident"], req.Name, ip)
+	if _, dup := err.(nameserver.DuplicateError); err != nil && !dup {
+		replyError(w, http.StatusBadRequest, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// All the ident's names, or just those for the address given as a
+// query parameter
+func (s *Sources) deleteNames(w http.ResponseWriter, r *http.Request) {
+	ident := mux.Vars(r)["ident"]
+	var err error
+	if addr := r.FormValue("address"); addr != "" {
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			replyError(w, http.StatusBadRequest, fmt.Errorf("Invalid IP %q", addr))
+			return
+		}
+		err = s.Zone.DeleteRecord(ident, ip)
+	} else {
+		err = s.Zone.DeleteRecordsFor(ident)
+	}
+	if err != nil {
+		replyError(w, http.StatusNotFound, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// The unversioned paths that version 1 replaces, and what with
+var deprecated = []struct {
+	path        string
+	replacement string
+}{
+	{"/status", "/status"},
+	{"/status-json", "/peers"},
+	{"/connect", "/connections"},
+	{"/forget", "/connections"},
+	{"/ip/", "/ipam"},
+	{"/name/", "/dns"},
+}
+
+// Deprecated marks replies to the unversioned paths that version 1
+// replaces with a warning header saying so, leaving them otherwise as
+// they were.
+func Deprecated(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, d := range deprecated {
+			if r.URL.Path == d.path || (strings.HasSuffix(d.path, "/") && strings.HasPrefix(r.URL.Path, d.path)) {
+				w.Header().Set("Warning", fmt.Sprintf(`299 - "Deprecated: use %s%s"`, Prefix, d.replacement))
+				break
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,76 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/weaveworks/weave/networks"
+
+	wt "github.com/weaveworks/weave/testing"
+)
+
+func TestDeprecated(t *testing.T) {
+	handler := Deprecated(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for path, warning := range map[string]string{
+		"/status-json":     `299 - "Deprecated: use /api/v1/peers"`,
+		"/ip/container":    `299 - "Deprecated: use /api/v1/ipam"`,
+		"/name/container":  `299 - "Deprecated: use /api/v1/dns"`,
+		"/api/v1/peers":    "",
+		"/status/extra":    "",
+		"/expose":          "",
+		"/ipsomethingelse": "",
+	} {
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("GET", "http://localhost"+path, nil)
+		handler.ServeHTTP(w, r)
+		wt.AssertEqualString(t, w.Header().Get("Warning"), warning, path)
+	}
+}
+
+func TestNotEnabled(t *testing.T) {
+	muxRouter := mux.NewRouter()
+	HandleHTTP(muxRouter, &Sources{})
+	for _, path := range []string{"/api/v1/ipam", "/api/v1/dns", "/api/v1/networks", "/status/ipam", "/status/dns"} {
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("GET", "http://localhost"+path, nil)
+		muxRouter.ServeHTTP(w, r)
+		wt.AssertStatus(t, w.Code, http.StatusNotFound, path)
+		var reply ErrorReply
+		wt.AssertNoErr(t, json.NewDecoder(w.Body).Decode(&reply))
+		wt.AssertTrue(t, reply.Message != "", "error message")
+	}
+}
+
+func TestNetworks(t *testing.T) {
+	muxRouter := mux.NewRouter()
+	HandleHTTP(muxRouter, &Sources{Networks: networks.NewRegistry()})
+	call := func(method, path, body string, status int) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest(method, "http://localhost"+path, strings.NewReader(body))
+		muxRouter.ServeHTTP(w, r)
+		wt.AssertStatus(t, w.Code, status, method+" "+path)
+		return w
+	}
+
+	call("POST", "/api/v1/networks", `{"Name":"blue","Subnet":"10.2.0.0/16"}`, http.StatusOK)
+	call("POST", "/networks", `{"Name":"blue","Subnet":"10.3.0.0/16"}`, http.StatusConflict)
+	call("POST", "/api/v1/networks", `{"Name":"red","Subnet":"10.2.0.0"}`, http.StatusBadRequest)
+	call("PUT", "/api/v1/networks/blue/members/c1", "", http.StatusNoContent)
+	call("PUT", "/api/v1/networks/green/members/c1", "", http.StatusNotFound)
+
+	var network Network
+	wt.AssertNoErr(t, json.NewDecoder(call("GET", "/api/v1/networks/blue", "", http.StatusOK).Body).Decode(&network))
+	wt.AssertEqualString(t, network.Subnet, "10.2.0.0/16", "subnet")
+	wt.AssertEqualInt(t, len(network.Members), 1, "members")
+	wt.AssertEqualString(t, network.Members[0].Container, "c1", "member")
+
+	call("DELETE", "/api/v1/networks/blue/members/c1", "", http.StatusNoContent)
+	call("DELETE", "/networks/blue", "", http.StatusNoContent)
+	var list []Network
+	wt.AssertNoErr(t, json.NewDecoder(call("GET", "/api/v1/networks", "", http.StatusOK).Body).Decode(&list))
+	wt.AssertEqualInt(t, len(list), 0, "networks once deleted")
+}
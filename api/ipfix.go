@@ -0,0 +1,269 @@
+package api
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net"
+	"net/url"
+	"sort"
+	"time"
+
+	. "github.com/weaveworks/weave/common"
+	"github.com/weaveworks/weave/router"
+)
+
+// IPFIX, as in RFC 7011, and its information elements, from IANA's
+// registry
+const (
+	ipfixVersion     = 10
+	ipfixTemplateSet = 2
+	// Keep messages within a single unfragmented UDP datagram
+	maxIPFIXMessage = 1400
+
+	ipfixTemplateIPv4 = 256
+	ipfixTemplateMAC  = 257
+
+	ieOctetDeltaCount         = 1
+	iePacketDeltaCount        = 2
+	ieSourceIPv4Address       = 8
+	ieDestinationIPv4Address  = 12
+	ieIPNextHopIPv4Address    = 15
+	ieSourceMacAddress        = 56
+	ieFlowDirection           = 61
+	ieDestinationMacAddress   = 80
+	ieFlowStartMilliseconds   = 152
+	ieFlowEndMilliseconds     = 153
+	ipfixHeaderLen            = 16
+	ipfixSetHeaderLen         = 4
+	ipfixFlowDirectionEgress  = 1
+	ipfixFlowDirectionIngress = 0
+)
+
+type ipfixField struct {
+	id, length uint16
+}
+
+// What we send of each flow, after its addresses, which are IPv4 or
+// MAC addresses, according to the template
+var ipfixFlowFields = []ipfixField{
+	{ieOctetDeltaCount, 8},
+	{iePacketDeltaCount, 8},
+	{ieFlowStartMilliseconds, 8},
+	{ieFlowEndMilliseconds, 8},
+	{ieFlowDirection, 1},
+	{ieIPNextHopIPv4Address, 4},
+}
+
+var ipfixTemplates = []struct {
+	id     uint16
+	fields []ipfixField
+}{
+	{ipfixTemplateIPv4, append([]ipfixField{{ieSourceIPv4Address, 4}, {ieDestinationIPv4Address, 4}}, ipfixFlowFields...)},
+	{ipfixTemplateMAC, append([]ipfixField{{ieSourceMacAddress, 6}, {ieDestinationMacAddress, 6}}, ipfixFlowFields...)},
+}
+
+// ExportFlows starts exporting records of the flows between local
+// containers and remote ones, every interval, to target, which is
+// ipfix://<host>:<port>, an IPFIX collector listening on UDP
+func ExportFlows(target string, interval time.Duration, s *Sources) error {
+	u, err := url.Parse(target)
+	if err != nil {
+		return err
+	}
+	if u.Host == "" || u.Scheme != "ipfix" {
+		return fmt.Errorf("Invalid flow export target %q: expected ipfix://<host>:<port>", target)
+	}
+	if interval <= 0 {
+		return fmt.Errorf("Invalid flow export interval %s", interval)
+	}
+	h := fnv.New32a()
+	h.Write([]byte(s.Router.Ourself.Name.String()))
+	e := newFlowExporter(h.Sum32())
+	go func() {
+		for range time.Tick(interval) {
+			if err := e.exportTo(u.Host, s); err != nil {
+				Warning.Printf("[api] Unable to export flows to %s: %s", target, err)
+			}
+		}
+	}()
+	return nil
+}
+
+// Exports flow records, with the packets and bytes of each flow since
+// it was last exported
+type flowExporter struct {
+	domain   uint32 // IPFIX's observation domain, which is this peer
+	sequence uint32 // how many data records we have sent
+	last     map[router.FlowKey]router.Flow
+}
+
+func newFlowExporter(domain uint32) *flowExporter {
+	return &flowExporter{domain: domain, last: make(map[router.FlowKey]router.Flow)}
+}
+
+func (e *flowExporter) exportTo(addr string, s *Sources) error {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	flows, _ := s.Router.Flows.Top(-1)
+	return e.export(conn, flows, s.nextHop, time.Now())
+}
+
+// The address of the connection over which frames to and from peer
+// go, which is the overlay link the flow uses
+func (s *Sources) nextHop(peer router.PeerName) net.IP {
+	if peer == router.UnknownPeerName {
+		return nil
+	}
+	via, found := s.Router.Routes.Unicast(peer)
+	if !found {
+		return nil
+	}
+	conn, found := s.Router.Ourself.ConnectionTo(via)
+	if !found {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(conn.RemoteTCPAddr())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host).To4()
+}
+
+type ipfixRecord struct {
+	template uint16
+	data     []byte
+}
+
+// Write IPFIX messages, each a datagram, to w, with the records of
+// the flows that have carried frames since the last export
+func (e *flowExporter) export(w io.Writer, flows []router.Flow, nextHop func(router.PeerName) net.IP, now time.Time) error {
+	var records []ipfixRecord
+	last := make(map[router.FlowKey]router.Flow, len(flows))
+	for _, flow := range flows {
+		last[flow.FlowKey] = flow
+		packets, octets := flow.Packets, flow.Bytes
+		// a flow seen since it was exported may have been forgotten
+		// and counted afresh
+		if prev, found := e.last[flow.FlowKey]; found && prev.FirstSeen.Equal(flow.FirstSeen) {
+			packets, octets = packets-prev.Packets, octets-prev.Bytes
+		}
+		if packets == 0 {
+			continue
+		}
+		if record, ok := flowRecord(flow, packets, octets, nextHop(flow.Peer)); ok {
+			records = append(records, record)
+		}
+	}
+	e.last = last
+	// so that messages need few sets
+	sort.Stable(byTemplate(records))
+
+	var msg bytes.Buffer
+	var set, count int // where the open data set starts, and how many records are in the message
+	var setTemplate uint16
+	closeSet := func() {
+		if set > 0 {
+			binary.BigEndian.PutUint16(msg.Bytes()[set+2:], uint16(msg.Len()-set))
+			set = 0
+		}
+	}
+	flush := func() error {
+		closeSet()
+		if count == 0 {
+			return nil
+		}
+		binary.BigEndian.PutUint16(msg.Bytes()[2:], uint16(msg.Len()))
+		_, err := w.Write(msg.Bytes())
+		e.sequence += uint32(count)
+		count = 0
+		return err
+	}
+	for _, record := range records {
+		if count > 0 && msg.Len()+ipfixSetHeaderLen+len(record.data) > maxIPFIXMessage {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+		if count == 0 {
+			msg.Reset()
+			e.writeHeader(&msg, now)
+			writeTemplates(&msg)
+		}
+		if set == 0 || setTemplate != record.template {
+			closeSet()
+			set, setTemplate = msg.Len(), record.template
+			binary.Write(&msg, binary.BigEndian, [2]uint16{record.template, 0})
+		}
+		msg.Write(record.data)
+		count++
+	}
+	return flush()
+}
+
+func (e *flowExporter) writeHeader(msg *bytes.Buffer, now time.Time) {
+	binary.Write(msg, binary.BigEndian, struct {
+		Version, Length uint16
+		ExportTime      uint32
+		Sequence        uint32
+		Domain          uint32
+	}{ipfixVersion, 0, uint32(now.Unix()), e.sequence, e.domain})
+}
+
+// Collectors may have missed, or forgotten, earlier templates, so
+// every message carries them
+func writeTemplates(msg *bytes.Buffer) {
+	start := msg.Len()
+	binary.Write(msg, binary.BigEndian, [2]uint16{ipfixTemplateSet, 0})
+	for _, t := range ipfixTemplates {
+		binary.Write(msg, binary.BigEndian, [2]uint16{t.id, uint16(len(t.fields))})
+		for _, f := range t.fields {
+			binary.Write(msg, binary.BigEndian, [2]uint16{f.id, f.length})
+		}
+	}
+	binary.BigEndian.PutUint16(msg.Bytes()[start+2:], uint16(msg.Len()-start))
+}
+
+// The record of a flow, by the template its addresses fit
+func flowRecord(flow router.Flow, packets, octets uint64, nextHop net.IP) (ipfixRecord, bool) {
+	var record ipfixRecord
+	src, dst := net.ParseIP(flow.Src).To4(), net.ParseIP(flow.Dst).To4()
+	if src != nil && dst != nil {
+		record.template = ipfixTemplateIPv4
+		record.data = append(append(record.data, src...), dst...)
+	} else {
+		srcMAC, err1 := net.ParseMAC(flow.Src)
+		dstMAC, err2 := net.ParseMAC(flow.Dst)
+		if err1 != nil || err2 != nil || len(srcMAC) != 6 || len(dstMAC) != 6 {
+			return record, false
+		}
+		record.template = ipfixTemplateMAC
+		record.data = append(append(record.data, srcMAC...), dstMAC...)
+	}
+	var buf [8]byte
+	for _, n := range []uint64{octets, packets, uint64(flow.FirstSeen.UnixNano() / 1e6), uint64(flow.LastSeen.UnixNano() / 1e6)} {
+		binary.BigEndian.PutUint64(buf[:], n)
+		record.data = append(record.data, buf[:]...)
+	}
+	direction := byte(ipfixFlowDirectionIngress)
+	if flow.Outbound {
+		direction = ipfixFlowDirectionEgress
+	}
+	record.data = append(record.data, direction)
+	if nextHop = nextHop.To4(); nextHop == nil {
+		nextHop = net.IPv4zero.To4()
+	}
+	record.data = append(record.data, nextHop...)
+	return record, true
+}
+
+type byTemplate []ipfixRecord
+
+func (r byTemplate) Len() int           { return len(r) }
+func (r byTemplate) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+func (r byTemplate) Less(i, j int) bool { return r[i].template < r[j].template }
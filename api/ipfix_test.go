@@ -0,0 +1,127 @@
+package api
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/weaveworks/weave/router"
+	wt "github.com/weaveworks/weave/testing"
+)
+
+type datagrams [][]byte
+
+func (d *datagrams) Write(b []byte) (int, error) {
+	*d = append(*d, append([]byte{}, b...))
+	return len(b), nil
+}
+
+type decodedRecord struct {
+	template        uint16
+	src, dst        string
+	octets, packets uint64
+	direction       byte
+	nextHop         string
+	start, end      uint64
+}
+
+// Decode a message, checking its header and templates
+func decodeIPFIX(t *testing.T, msg []byte, domain, sequence uint32) []decodedRecord {
+	be := binary.BigEndian
+	wt.AssertEqualInt(t, int(be.Uint16(msg)), ipfixVersion, "version")
+	wt.AssertEqualInt(t, int(be.Uint16(msg[2:])), len(msg), "message length")
+	wt.AssertTrue(t, len(msg) <= maxIPFIXMessage, "message fits")
+	wt.AssertEqualInt(t, int(be.Uint32(msg[8:])), int(sequence), "sequence")
+	wt.AssertEqualInt(t, int(be.Uint32(msg[12:])), int(domain), "observation domain")
+	var records []decodedRecord
+	for sets := msg[ipfixHeaderLen:]; len(sets) > 0; {
+		id, length := be.Uint16(sets), int(be.Uint16(sets[2:]))
+		set := sets[ipfixSetHeaderLen:length]
+		sets = sets[length:]
+		if id == ipfixTemplateSet {
+			wt.AssertEqualInt(t, int(be.Uint16(set)), ipfixTemplateIPv4, "first template")
+			wt.AssertEqualInt(t, int(be.Uint16(set[2:])), 8, "fields of first template")
+			wt.AssertEqualInt(t, int(be.Uint16(set[4:])), ieSourceIPv4Address, "first field")
+			continue
+		}
+		addrLen := 4
+		if id == ipfixTemplateMAC {
+			addrLen = 6
+		}
+		for len(set) > 0 {
+			r := decodedRecord{template: id}
+			if addrLen == 4 {
+				r.src, r.dst = net.IP(set[:4]).String(), net.IP(set[4:8]).String()
+			} else {
+				r.src, r.dst = net.HardwareAddr(set[:6]).String(), net.HardwareAddr(set[6:12]).String()
+			}
+			set = set[2*addrLen:]
+			r.octets, r.packets, r.start, r.end = be.Uint64(set), be.Uint64(set[8:]), be.Uint64(set[16:]), be.Uint64(set[24:])
+			r.direction = set[32]
+			r.nextHop = net.IP(set[33:37]).String()
+			set = set[37:]
+			records = append(records, r)
+		}
+	}
+	return records
+}
+
+func TestIPFIX(t *testing.T) {
+	peer, _ := router.PeerNameFromString("01:00:00:01:00:00")
+	start := time.Unix(1433160000, 0)
+	flows := []router.Flow{
+		{FlowKey: router.FlowKey{Src: "de:ad:be:ef:00:01", Dst: "ff:ff:ff:ff:ff:ff"}, Peer: router.UnknownPeerName,
+			Outbound: true, Packets: 2, Bytes: 84, FirstSeen: start, LastSeen: start.Add(time.Second)},
+		{FlowKey: router.FlowKey{Src: "10.2.1.3", Dst: "10.2.1.7"}, Peer: peer,
+			Outbound: true, Packets: 10, Bytes: 15000, FirstSeen: start, LastSeen: start.Add(2 * time.Second)},
+		{FlowKey: router.FlowKey{Src: "10.2.1.7", Dst: "10.2.1.3"}, Peer: peer,
+			Packets: 5, Bytes: 300, FirstSeen: start, LastSeen: start.Add(2 * time.Second)},
+	}
+	nextHop := func(name router.PeerName) net.IP {
+		if name == peer {
+			return net.ParseIP("192.168.48.12")
+		}
+		return nil
+	}
+	e := newFlowExporter(42)
+	var sent datagrams
+	wt.AssertNoErr(t, e.export(&sent, flows, nextHop, start.Add(10*time.Second)))
+	wt.AssertEqualInt(t, len(sent), 1, "messages")
+	records := decodeIPFIX(t, sent[0], 42, 0)
+	wt.AssertEqualInt(t, len(records), 3, "records")
+	// IPv4 flows come first
+	wt.AssertEquals(t, records[0], decodedRecord{ipfixTemplateIPv4, "10.2.1.3", "10.2.1.7", 15000, 10, ipfixFlowDirectionEgress, "192.168.48.12",
+		uint64(start.UnixNano() / 1e6), uint64(start.UnixNano()/1e6) + 2000})
+	wt.AssertEquals(t, records[1].direction, byte(ipfixFlowDirectionIngress))
+	wt.AssertEquals(t, records[2], decodedRecord{ipfixTemplateMAC, "de:ad:be:ef:00:01", "ff:ff:ff:ff:ff:ff", 84, 2, ipfixFlowDirectionEgress, "0.0.0.0",
+		uint64(start.UnixNano() / 1e6), uint64(start.UnixNano()/1e6) + 1000})
+
+	// only what flows have carried since, of flows that carried any
+	flows[1].Packets, flows[1].Bytes = 15, 22500
+	// forgotten, and counted afresh
+	flows[2].Packets, flows[2].Bytes, flows[2].FirstSeen = 1, 60, start.Add(time.Minute)
+	sent = nil
+	wt.AssertNoErr(t, e.export(&sent, flows, nextHop, start.Add(20*time.Second)))
+	records = decodeIPFIX(t, sent[0], 42, 3)
+	wt.AssertEqualInt(t, len(records), 2, "records")
+	wt.AssertEquals(t, [2]uint64{records[0].octets, records[0].packets}, [2]uint64{7500, 5})
+	wt.AssertEquals(t, [2]uint64{records[1].octets, records[1].packets}, [2]uint64{60, 1})
+
+	// many flows take many messages
+	flows = nil
+	for i := 0; i < 100; i++ {
+		flows = append(flows, router.Flow{FlowKey: router.FlowKey{Src: "10.2.1.3", Dst: net.IPv4(10, 2, 2, byte(i)).String()},
+			Peer: peer, Packets: 1, Bytes: 100, FirstSeen: start, LastSeen: start})
+	}
+	sent = nil
+	wt.AssertNoErr(t, e.export(&sent, flows, nextHop, start.Add(30*time.Second)))
+	wt.AssertTrue(t, len(sent) > 1, "split into several messages")
+	sequence, total := uint32(5), 0
+	for _, msg := range sent {
+		n := len(decodeIPFIX(t, msg, 42, sequence))
+		sequence += uint32(n)
+		total += n
+	}
+	wt.AssertEqualInt(t, total, 100, "records in all messages")
+}
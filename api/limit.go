@@ -0,0 +1,115 @@
+package api
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// How many clients we track before forgetting those that have been
+	// quiet long enough to have a full bucket again
+	maxLimitedClients = 1024
+	// Too Many Requests, from RFC 6585, which net/http has no name
+	// for in the Go we build with
+	statusTooManyRequests = 429
+)
+
+// A token bucket for each client, by address
+type limiter struct {
+	sync.Mutex
+	rate    float64 // tokens added per second
+	burst   float64 // tokens a bucket holds at most
+	clients map[string]*bucket
+	now     func() time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newLimiter(rate float64, burst int) *limiter {
+	return &limiter{rate: rate, burst: float64(burst), clients: make(map[string]*bucket), now: time.Now}
+}
+
+// Take a token from the client's bucket, if there is one
+func (l *limiter) allow(client string) bool {
+	l.Lock()
+	defer l.Unlock()
+	now := l.now()
+	b, found := l.clients[client]
+	if !found {
+		if len(l.clients) >= maxLimitedClients {
+			l.forgetQuiet(now)
+		}
+		b = &bucket{tokens: l.burst, last: now}
+		l.clients[client] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * l.rate
+	if b.tokens > l.burst {
+		b.tokens = l.burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+func (l *limiter) forgetQuiet(now time.Time) {
+	for client, b := range l.clients {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.clients, client)
+		}
+	}
+}
+
+// Limit the rate of each client's requests to h, to rate a second
+// with bursts of up to burst, replying to those over the limit with
+// 429 Too Many Requests
+func Limit(h http.Handler, rate float64, burst int) http.Handler {
+	l := newLimiter(rate, burst)
+	retryAfter := fmt.Sprint(int(1/rate) + 1)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		client, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			client = r.RemoteAddr // e.g. on a unix socket
+		}
+		if !l.allow(client) {
+			w.Header().Set("Retry-After", retryAfter)
+			http.Error(w, "Too many requests", statusTooManyRequests)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// Paths of GET requests that take as long as they take: streams and
+// profiles
+var untimedPaths = []string{"/events", "/debug/pprof/", "/capture"}
+
+// Timeout replies to GET requests that h takes longer than timeout to
+// reply to with 503 Service Unavailable. Other requests, which may
+// legitimately wait, e.g. for an address to be allocated, and streams
+// are left alone.
+func Timeout(h http.Handler, timeout time.Duration) http.Handler {
+	timed := http.TimeoutHandler(h, timeout, "Timed out")
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		for _, path := range untimedPaths {
+			if strings.HasPrefix(r.URL.Path, path) {
+				h.ServeHTTP(w, r)
+				return
+			}
+		}
+		timed.ServeHTTP(w, r)
+	})
+}
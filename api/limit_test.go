@@ -0,0 +1,55 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	wt "github.com/weaveworks/weave/testing"
+)
+
+func TestLimiter(t *testing.T) {
+	now := time.Unix(0, 0)
+	l := newLimiter(1, 2)
+	l.now = func() time.Time { return now }
+
+	wt.AssertTrue(t, l.allow("a"), "first of burst")
+	wt.AssertTrue(t, l.allow("a"), "second of burst")
+	wt.AssertFalse(t, l.allow("a"), "over burst")
+	wt.AssertTrue(t, l.allow("b"), "another client")
+	now = now.Add(time.Second)
+	wt.AssertTrue(t, l.allow("a"), "after refill")
+	wt.AssertFalse(t, l.allow("a"), "refilled only one")
+}
+
+func TestLimit(t *testing.T) {
+	h := Limit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), 0.1, 1)
+	codes := []int{}
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("GET", "http://localhost/status", nil)
+		r.RemoteAddr = "10.0.0.1:12345"
+		h.ServeHTTP(w, r)
+		codes = append(codes, w.Code)
+	}
+	wt.AssertEquals(t, codes, []int{http.StatusOK, statusTooManyRequests})
+}
+
+func TestTimeout(t *testing.T) {
+	slow := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { time.Sleep(50 * time.Millisecond) })
+	h := Timeout(slow, time.Millisecond)
+	for _, c := range []struct {
+		method, path string
+		code         int
+	}{
+		{"GET", "/status", http.StatusServiceUnavailable},
+		{"GET", "/events", http.StatusOK},
+		{"PUT", "/ip/container", http.StatusOK},
+	} {
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest(c.method, "http://localhost"+c.path, nil)
+		h.ServeHTTP(w, r)
+		wt.AssertStatus(t, w.Code, c.code, c.method+" "+c.path)
+	}
+}
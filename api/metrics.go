@@ -0,0 +1,171 @@
+package api
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	. "github.com/weaveworks/weave/common"
+)
+
+// A number describing the router, which is either a gauge or, if
+// counter, only ever goes up
+type metric struct {
+	name    string
+	value   uint64
+	counter bool
+}
+
+func boolMetric(b bool) uint64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// What we push to statsd and graphite
+func (s *Sources) metrics() []metric {
+	established, pending := 0, 0
+	for _, conn := range s.ourConnections() {
+		if conn.State == ConnectionEstablished {
+			established++
+		} else {
+			pending++
+		}
+	}
+	totals, flows := s.Router.Flows.Totals()
+	frag := s.Router.Fragmentation.Totals()
+	drops := s.Router.Drops.Totals()
+	metrics := []metric{
+		{"router.peers", uint64(len(s.Router.Peers.Names())), false},
+		{"router.connections.established", uint64(established), false},
+		{"router.connections.pending", uint64(pending), false},
+		{"router.connections.targets", uint64(len(s.Router.ConnectionMaker.Targets())), false},
+		{"router.flows", uint64(flows), false},
+		{"router.frames.out.packets", totals.OutPackets, true},
+		{"router.frames.out.bytes", totals.OutBytes, true},
+		{"router.frames.in.packets", totals.InPackets, true},
+		{"router.frames.in.bytes", totals.InBytes, true},
+		{"router.fragmentation.frames", frag.FramesFragmented, true},
+		{"router.fragmentation.fragments", frag.FragmentsSent, true},
+		{"router.reassembly.fragments", frag.FragmentsReceived, true},
+		{"router.reassembly.frames", frag.FramesReassembled, true},
+		{"router.reassembly.timeouts", frag.ReassemblyTimeouts, true},
+		{"router.reassembly.drops", frag.ReassemblyDrops, true},
+		{"router.queue.full", drops.QueueFull, true},
+		{"router.queue.dropped", drops.FramesDropped, true},
+		{"router.datapath.restarts", uint64(s.Router.DatapathRestarts()), true},
+	}
+	if xdp, ok := s.Router.XDPTotals(); ok {
+		metrics = append(metrics,
+			metric{"router.xdp.frames", xdp.Frames, true},
+			metric{"router.xdp.bytes", xdp.Bytes, true})
+	}
+	for name, channel := range s.gossipStats() {
+		prefix := "gossip." + name + "."
+		metrics = append(metrics,
+			metric{prefix + "sent.messages", channel.SentMessages, true},
+			metric{prefix + "sent.bytes", channel.SentBytes, true},
+			metric{prefix + "received.messages", channel.ReceivedMessages, true},
+			metric{prefix + "received.bytes", channel.ReceivedBytes, true},
+			metric{prefix + "queued.messages", channel.QueuedMessages, false},
+			metric{prefix + "dropped.messages", channel.DroppedMessages, true},
+			metric{prefix + "throttled.messages", channel.ThrottledMessages, true})
+	}
+	if s.Allocator != nil {
+		ipam := s.ipamStatus()
+		metrics = append(metrics,
+			metric{"ipam.ready", boolMetric(ipam.Ready), false},
+			metric{"ipam.allocations", uint64(len(ipam.Allocations)), false})
+	}
+	if s.ZoneDb != nil {
+		metrics = append(metrics, metric{"dns.records", uint64(len(s.ZoneDb.Entries())), false})
+	}
+	return metrics
+}
+
+// Most statsd servers read packets of at most this many bytes
+const maxStatsdPacket = 1432
+
+// PushMetrics starts pushing the router's metrics, every interval,
+// with names starting with prefix, to target, which is
+// statsd://<host>:<port>, for statsd's protocol over UDP, or
+// graphite://<host>:<port>, for graphite's plaintext protocol over TCP
+func PushMetrics(target, prefix string, interval time.Duration, s *Sources) error {
+	u, err := url.Parse(target)
+	if err != nil {
+		return err
+	}
+	if u.Host == "" || (u.Scheme != "statsd" && u.Scheme != "graphite") {
+		return fmt.Errorf("Invalid metrics target %q: expected statsd://<host>:<port> or graphite://<host>:<port>", target)
+	}
+	if interval <= 0 {
+		return fmt.Errorf("Invalid metrics interval %s", interval)
+	}
+	if prefix != "" && !strings.HasSuffix(prefix, ".") {
+		prefix += "."
+	}
+	push := pushGraphite
+	if u.Scheme == "statsd" {
+		push = newStatsdPusher()
+	}
+	go func() {
+		for range time.Tick(interval) {
+			if err := push(u.Host, prefix, s.metrics(), time.Now()); err != nil {
+				Warning.Printf("[api] Unable to push metrics to %s: %s", target, err)
+			}
+		}
+	}()
+	return nil
+}
+
+type pusher func(addr, prefix string, metrics []metric, now time.Time) error
+
+// statsd sums the counters it is sent, so we send counters' increases
+// since the last push
+func newStatsdPusher() pusher {
+	last := map[string]uint64{}
+	return func(addr, prefix string, metrics []metric, now time.Time) error {
+		conn, err := net.Dial("udp", addr)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		var packet bytes.Buffer
+		for _, m := range metrics {
+			line := fmt.Sprintf("%s%s:%d|g\n", prefix, m.name, m.value)
+			if m.counter {
+				line = fmt.Sprintf("%s%s:%d|c\n", prefix, m.name, m.value-last[m.name])
+				last[m.name] = m.value
+			}
+			if packet.Len()+len(line) > maxStatsdPacket {
+				if _, err := conn.Write(packet.Bytes()); err != nil {
+					return err
+				}
+				packet.Reset()
+			}
+			packet.WriteString(line)
+		}
+		if packet.Len() > 0 {
+			_, err = conn.Write(packet.Bytes())
+		}
+		return err
+	}
+}
+
+func pushGraphite(addr, prefix string, metrics []metric, now time.Time) error {
+	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	var buf bytes.Buffer
+	for _, m := range metrics {
+		fmt.Fprintf(&buf, "%s%s %d %d\n", prefix, m.name, m.value, now.Unix())
+	}
+	_, err = conn.Write(buf.Bytes())
+	return err
+}
@@ -0,0 +1,70 @@
+package api
+
+import (
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/weaveworks/weave/router"
+	wt "github.com/weaveworks/weave/testing"
+)
+
+func TestStatsd(t *testing.T) {
+	l, err := net.ListenPacket("udp", "127.0.0.1:0")
+	wt.AssertNoErr(t, err)
+	defer l.Close()
+	push := newStatsdPusher()
+	metrics := []metric{{"router.peers", 3, false}, {"router.frames.in.packets", 10, true}}
+	read := func() string {
+		buf := make([]byte, maxStatsdPacket)
+		l.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, _, err := l.ReadFrom(buf)
+		wt.AssertNoErr(t, err)
+		return string(buf[:n])
+	}
+
+	wt.AssertNoErr(t, push(l.LocalAddr().String(), "weave.", metrics, time.Now()))
+	wt.AssertEqualString(t, read(), "weave.router.peers:3|g\nweave.router.frames.in.packets:10|c\n", "first push")
+	metrics[1].value = 15
+	wt.AssertNoErr(t, push(l.LocalAddr().String(), "weave.", metrics, time.Now()))
+	wt.AssertEqualString(t, read(), "weave.router.peers:3|g\nweave.router.frames.in.packets:5|c\n", "increase of counter")
+}
+
+func TestGraphite(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	wt.AssertNoErr(t, err)
+	defer l.Close()
+	received := make(chan string, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		b, _ := ioutil.ReadAll(conn)
+		received <- string(b)
+	}()
+
+	metrics := []metric{{"router.peers", 3, false}}
+	wt.AssertNoErr(t, pushGraphite(l.Addr().String(), "weave.", metrics, time.Unix(1433160000, 0)))
+	wt.AssertEqualString(t, <-received, "weave.router.peers 3 1433160000\n", "graphite")
+}
+
+func TestMetrics(t *testing.T) {
+	name, _ := router.PeerNameFromString("01:00:00:01:00:00")
+	r := router.NewRouter(router.RouterConfig{}, name, "nick")
+	r.ConnectionMaker.Start()
+	s := &Sources{Router: r}
+	found := map[string]uint64{}
+	for _, m := range s.metrics() {
+		found[m.name] = m.value
+	}
+	wt.AssertEqualuint64(t, found["router.peers"], 1, "peers")
+	_, hasIPAM := found["ipam.allocations"]
+	wt.AssertFalse(t, hasIPAM, "IPAM metrics without IPAM")
+
+	wt.AssertTrue(t, PushMetrics("http://localhost:8125", "weave", time.Second, s) != nil, "invalid target")
+	wt.AssertTrue(t, strings.HasPrefix(PushMetrics("statsd://localhost:8125", "weave", 0, s).Error(), "Invalid metrics interval"), "invalid interval")
+}
@@ -0,0 +1,81 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/weaveworks/weave/router"
+)
+
+// startMirror starts copying the frames matching the filter asked
+// for, as for captures, to the interface asked for, on the peer, by
+// name or nickname, asked for, or this one, for the duration asked for
+func (s *Sources) startMirror(w http.ResponseWriter, r *http.Request) {
+	iface := r.FormValue("iface")
+	if iface == "" {
+		replyError(w, http.StatusBadRequest, fmt.Errorf("No interface given"))
+		return
+	}
+	peer := s.Router.Ourself.Name
+	if p := r.FormValue("peer"); p != "" {
+		var found bool
+		if peer, found = s.findPeer(p); !found {
+			replyError(w, http.StatusNotFound, fmt.Errorf("Unknown peer %q", p))
+			return
+		}
+	}
+	duration := router.DefaultMirrorDuration
+	if d := r.FormValue("duration"); d != "" {
+		var err error
+		if duration, err = time.ParseDuration(d); err != nil || duration <= 0 || duration > router.MaxMirrorDuration {
+			replyError(w, http.StatusBadRequest, fmt.Errorf("Invalid duration %q: expected up to %s", d, router.MaxMirrorDuration))
+			return
+		}
+	}
+	filter := r.FormValue("filter")
+	match, err := parseCaptureFilter(filter)
+	if err != nil {
+		replyError(w, http.StatusBadRequest, err)
+		return
+	}
+	session, err := s.Router.StartMirror(filter, match, peer, iface, duration)
+	if err != nil {
+		replyError(w, http.StatusBadRequest, err)
+		return
+	}
+	reply(w, s.mirror(session))
+}
+
+func (s *Sources) mirrors(w http.ResponseWriter, r *http.Request) {
+	mirrors := []Mirror{}
+	for _, session := range s.Router.Mirrors() {
+		mirrors = append(mirrors, s.mirror(session))
+	}
+	reply(w, mirrors)
+}
+
+func (s *Sources) stopMirror(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if !s.Router.StopMirror(id) {
+		replyError(w, http.StatusNotFound, fmt.Errorf("Unknown mirror %q", id))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Sources) mirror(session router.MirrorSession) Mirror {
+	m := Mirror{
+		ID:      session.ID,
+		Filter:  session.Filter,
+		Peer:    session.Peer.String(),
+		Iface:   session.Iface,
+		Expires: session.Expires,
+		Frames:  session.Frames,
+		Dropped: session.Dropped}
+	if peer, found := s.Router.Peers.Fetch(session.Peer); found {
+		m.NickName = peer.NickName
+	}
+	return m
+}
@@ -0,0 +1,99 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/weaveworks/weave/networks"
+)
+
+func (s *Sources) withNetworks(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.Networks == nil {
+			replyError(w, http.StatusNotFound, fmt.Errorf("Virtual networks are not enabled"))
+			return
+		}
+		h(w, r)
+	}
+}
+
+func (s *Sources) networkList(w http.ResponseWriter, r *http.Request) {
+	reply(w, s.networkStatus())
+}
+
+func (s *Sources) networkStatus() []Network {
+	list := []Network{}
+	for _, network := range s.Networks.Networks() {
+		list = append(list, apiNetwork(network))
+	}
+	return list
+}
+
+func apiNetwork(network networks.Network) Network {
+	n := Network{Name: network.Name, Subnet: network.Subnet, Members: []NetworkMember{}}
+	for _, member := range network.Members {
+		n.Members = append(n.Members, NetworkMember{member.Container, member.Peer})
+	}
+	return n
+}
+
+// The status for an error from the registry
+func networkError(w http.ResponseWriter, err error) {
+	switch err.(type) {
+	case networks.NotFoundError:
+		replyError(w, http.StatusNotFound, err)
+	case networks.ConflictError:
+		replyError(w, http.StatusConflict, err)
+	default:
+		replyError(w, http.StatusBadRequest, err)
+	}
+}
+
+func (s *Sources) createNetwork(w http.ResponseWriter, r *http.Request) {
+	var req NetworkRequest
+	if !decode(w, r, &req) {
+		return
+	}
+	network, err := s.Networks.Create(req.Name, req.Subnet)
+	if err != nil {
+		networkError(w, err)
+		return
+	}
+	reply(w, apiNetwork(network))
+}
+
+func (s *Sources) network(w http.ResponseWriter, r *http.Request) {
+	network, err := s.Networks.Lookup(mux.Vars(r)["name"])
+	if err != nil {
+		networkError(w, err)
+		return
+	}
+	reply(w, apiNetwork(network))
+}
+
+func (s *Sources) deleteNetwork(w http.ResponseWriter, r *http.Request) {
+	if err := s.Networks.Delete(mux.Vars(r)["name"]); err != nil {
+		networkError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Sources) joinNetwork(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	if err := s.Networks.Join(vars["name"], vars["container"]); err != nil {
+		networkError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Sources) leaveNetwork(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	if err := s.Networks.Leave(vars["name"], vars["container"]); err != nil {
+		networkError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
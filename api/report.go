@@ -0,0 +1,124 @@
+package api
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"runtime"
+	"runtime/pprof"
+	"strings"
+	"time"
+
+	. "github.com/weaveworks/weave/common"
+)
+
+// A file in a diagnostic report
+type reportFile struct {
+	name    string
+	content func() ([]byte, error)
+}
+
+func jsonFile(name string, v func() interface{}) reportFile {
+	return reportFile{name, func() ([]byte, error) { return json.MarshalIndent(v(), "", "  ") }}
+}
+
+func textFile(name string, text func() string) reportFile {
+	return reportFile{name, func() ([]byte, error) { return []byte(text()), nil }}
+}
+
+// The files of a report: what we would otherwise ask for, one by one,
+// to diagnose a problem
+func (s *Sources) reportFiles() []reportFile {
+	files := []reportFile{
+		jsonFile("config.json", func() interface{} {
+			return map[string]interface{}{
+				"version": s.Version,
+				"go":      runtime.Version(),
+				"options": s.Options,
+			}
+		}),
+		jsonFile("status.json", func() interface{} { return s.describe() }),
+		jsonFile("peers.json", func() interface{} { return s.peerList() }),
+		textFile("topology.txt", func() string { return s.Router.Status() }),
+		jsonFile("connections.json", func() interface{} { return append(s.ourConnections(), s.targets()...) }),
+		jsonFile("connection-targets.json", func() interface{} { return s.allTargets() }),
+		jsonFile("connection-history.json", func() interface{} { return s.history() }),
+		jsonFile("connection-annotations.json", func() interface{} { return s.Router.Annotations.All() }),
+		jsonFile("gossip.json", func() interface{} { return s.gossipStats() }),
+	}
+	if s.Router.Bindings != nil {
+		files = append(files, jsonFile("duplicates.json", func() interface{} { return s.duplicateAddresses() }))
+	}
+	if s.Allocator != nil {
+		files = append(files,
+			jsonFile("ipam.json", func() interface{} { return s.ipamStatus() }),
+			textFile("ipam-ring.txt", func() string { return s.Allocator.String() }))
+	}
+	if s.Zone != nil {
+		files = append(files, jsonFile("dns.json", func() interface{} { return s.dnsRecords() }))
+	}
+	if s.Networks != nil {
+		files = append(files, jsonFile("networks.json", func() interface{} { return s.networkStatus() }))
+	}
+	return append(files,
+		textFile("logs.txt", func() string { return strings.Join(RecentLogs(), "") }),
+		reportFile{"goroutines.txt", func() ([]byte, error) {
+			var buf bytes.Buffer
+			err := s.writeGoroutines(&buf)
+			return buf.Bytes(), err
+		}})
+}
+
+// Write the stacks of all goroutines, after the parts of the router
+// the watchdog finds stuck, if any, which the stacks show the cause of
+func (s *Sources) writeGoroutines(w io.Writer) error {
+	if stalled := s.Router.Watchdog.Stalled(); len(stalled) > 0 {
+		fmt.Fprintf(w, "No progress in %s\n\n", strings.Join(stalled, ", "))
+	}
+	return pprof.Lookup("goroutine").WriteTo(w, 2)
+}
+
+// goroutines serves the stacks of all goroutines, as a report has
+// them, for when the router seems stuck
+func (s *Sources) goroutines(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	s.writeGoroutines(w)
+}
+
+// Write a report, as a gzipped tarball, noting in it anything we
+// couldn't find out
+func (s *Sources) writeReport(w io.Writer, now time.Time) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	dir := "weave-report-" + now.UTC().Format("20060102T150405Z") + "/"
+	for _, file := range s.reportFiles() {
+		content, err := file.content()
+		if err != nil {
+			content = []byte(fmt.Sprintf("Unable to get %s: %s\n", file.name, err))
+		}
+		header := &tar.Header{Name: dir + file.name, Mode: 0644, Size: int64(len(content)), ModTime: now}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if _, err := tw.Write(content); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+func (s *Sources) report(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="weave-report-%s.tar.gz"`, now.UTC().Format("20060102T150405Z")))
+	if err := s.writeReport(w, now); err != nil {
+		Warning.Printf("[api] Unable to write report: %s", err)
+	}
+}
@@ -0,0 +1,42 @@
+package api
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/weaveworks/weave/router"
+	wt "github.com/weaveworks/weave/testing"
+)
+
+func TestReport(t *testing.T) {
+	name, _ := router.PeerNameFromString("01:00:00:01:00:00")
+	r := router.NewRouter(router.RouterConfig{}, name, "nick")
+	r.Ourself.Start()
+	r.Macs.Start()
+	r.Routes.Start()
+	r.ConnectionMaker.Start()
+	s := &Sources{Version: "test", Router: r, Options: map[string]string{"name": name.String()}}
+
+	var buf bytes.Buffer
+	wt.AssertNoErr(t, s.writeReport(&buf, time.Date(2015, 6, 1, 12, 0, 0, 0, time.UTC)))
+	gz, err := gzip.NewReader(&buf)
+	wt.AssertNoErr(t, err)
+	tr := tar.NewReader(gz)
+	files := map[string]bool{}
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		wt.AssertNoErr(t, err)
+		files[header.Name] = true
+	}
+	for _, file := range []string{"config.json", "status.json", "peers.json", "topology.txt", "connections.json", "connection-targets.json", "connection-history.json", "connection-annotations.json", "gossip.json", "logs.txt", "goroutines.txt"} {
+		wt.AssertTrue(t, files["weave-report-20150601T120000Z/"+file], file)
+	}
+	wt.AssertFalse(t, files["weave-report-20150601T120000Z/ipam.json"], "ipam.json without IPAM")
+}
@@ -0,0 +1,67 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/weaveworks/weave/router"
+)
+
+// selfTest runs a self-test of the overlay to the peer asked for,
+// with the name or nickname given, for the duration asked for, at
+// the rate asked for, in bits per second, or as fast as we can
+func (s *Sources) selfTest(w http.ResponseWriter, r *http.Request) {
+	p := r.FormValue("peer")
+	if p == "" {
+		replyError(w, http.StatusBadRequest, fmt.Errorf("No peer given"))
+		return
+	}
+	peer, found := s.findPeer(p)
+	if !found {
+		replyError(w, http.StatusNotFound, fmt.Errorf("Unknown peer %q", p))
+		return
+	}
+	duration := router.DefaultSelfTestDuration
+	if d := r.FormValue("duration"); d != "" {
+		var err error
+		if duration, err = time.ParseDuration(d); err != nil || duration <= 0 || duration > router.MaxSelfTestDuration {
+			replyError(w, http.StatusBadRequest, fmt.Errorf("Invalid duration %q: expected up to %s", d, router.MaxSelfTestDuration))
+			return
+		}
+	}
+	var rate uint64
+	if rateStr := r.FormValue("rate"); rateStr != "" {
+		var err error
+		if rate, err = strconv.ParseUint(rateStr, 10, 64); err != nil {
+			replyError(w, http.StatusBadRequest, fmt.Errorf("Invalid rate %q: expected bits per second", rateStr))
+			return
+		}
+	}
+	result, err := s.Router.SelfTest(peer, duration, rate)
+	if err != nil {
+		replyError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	reply(w, SelfTest{
+		Peer:           result.Peer.Name.String(),
+		NickName:       result.Peer.NickName,
+		Seconds:        result.Duration.Seconds(),
+		SentFrames:     result.SentFrames,
+		SentBytes:      result.SentBytes,
+		ReceivedFrames: result.ReceivedFrames,
+		ReceivedBytes:  result.ReceivedBytes,
+		Throughput:     result.Throughput(),
+		LossPercent:    result.Loss(),
+		PingsSent:      result.PingsSent,
+		PingsLost:      result.PingsLost,
+		RTTMinMillis:   millis(result.RTTMin),
+		RTTAvgMillis:   millis(result.RTTAvg),
+		RTTMaxMillis:   millis(result.RTTMax),
+		CPUPercent:     result.CPU()})
+}
+
+func millis(d time.Duration) float64 {
+	return d.Seconds() * 1000
+}
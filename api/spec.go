@@ -0,0 +1,179 @@
+package api
+
+import (
+	"net/http"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A route of the API, with what the spec says about it
+type route struct {
+	method  string
+	path    string // under Prefix
+	summary string
+	handle  func(*Sources, http.ResponseWriter, *http.Request)
+	needs   string      // "ipam", "dns" or "networks", for routes that 404 without
+	query   []string    // optional query parameters
+	request interface{} // the body's type, if any
+	reply   interface{} // the body's type, or nil for 204 No Content
+}
+
+// Everything HandleHTTP serves, other than the spec itself, which is
+// generated from this
+var routes = []route{
+	{"GET", "/status", "Describe the router", (*Sources).status, "", nil, nil, Status{}},
+	{"GET", "/peers", "List the peers and their connections", (*Sources).peers, "", []string{"label"}, nil, []Peer{}},
+	{"GET", "/connections", "List our connections, and addresses we are trying to connect to", (*Sources).connections, "", nil, nil, []Connection{}},
+	{"GET", "/connections/targets", "List the addresses we are connecting to, or have, with the outcome of our last attempt", (*Sources).connectionTargets, "", nil, nil, []ConnectionTarget{}},
+	{"GET", "/connections/annotations", "List what operators have said about connections, by peer name or nickname, or address", (*Sources).annotations, "", nil, nil, map[string]Annotation{}},
+	{"PUT", "/connections/annotations/{peer}", "Annotate the connection to a peer, by its name or nickname, or address", (*Sources).annotate, "", nil, Annotation{}, nil},
+	{"DELETE", "/connections/annotations/{peer}", "Remove a connection's annotation", (*Sources).deleteAnnotation, "", nil, nil, nil},
+	{"GET", "/connections/history", "List recent connection events, by peer or address", (*Sources).connectionHistory, "", nil, nil, map[string][]ConnectionEvent{}},
+	{"GET", "/duplicates", "List addresses found in use with two MACs at once", (*Sources).duplicates, "", nil, nil, []DuplicateAddress{}},
+	{"GET", "/gossip", "Count the traffic of each gossip channel, by peer", (*Sources).gossip, "", nil, nil, map[string]GossipChannel{}},
+	{"GET", "/flows/top", "List the busiest flows to and from local containers", (*Sources).topFlows, "", []string{"n"}, nil, TopFlows{}},
+	{"POST", "/selftest", "Measure the throughput, loss and latency of the overlay to a peer", (*Sources).selfTest, "", []string{"peer", "duration", "rate"}, nil, SelfTest{}},
+	{"POST", "/diag/ping", "Probe a peer, or a container's address, over the overlay's data path", (*Sources).diagPing, "", []string{"target", "count"}, nil, DiagPing{}},
+	{"POST", "/diag/traceroute", "Find the peers the overlay's data path goes through to a peer, or a container's address", (*Sources).diagTraceroute, "", []string{"target"}, nil, DiagTraceroute{}},
+	{"POST", "/diag/connectivity", "Have every peer probe every other over the overlay's data path", (*Sources).connectivity, "", []string{"probes"}, nil, Connectivity{}},
+	{"GET", "/mirrors", "List the sessions mirroring frames to an interface", (*Sources).mirrors, "", nil, nil, []Mirror{}},
+	{"POST", "/mirrors", "Mirror the frames matching a filter to an interface, here or on another peer, for a while", (*Sources).startMirror, "", []string{"filter", "iface", "peer", "duration"}, nil, Mirror{}},
+	{"DELETE", "/mirrors/{id}", "Stop mirroring frames", (*Sources).stopMirror, "", nil, nil, nil},
+	{"POST", "/connections", "Connect to a peer, and keep connecting", (*Sources).connect, "", nil, ConnectRequest{}, nil},
+	{"DELETE", "/connections/{peer}", "Stop trying to connect to a peer", (*Sources).forget, "", nil, nil, nil},
+	{"GET", "/networks", "List the virtual networks and their members", (*Sources).networkList, "networks", nil, nil, []Network{}},
+	{"POST", "/networks", "Create a virtual network", (*Sources).createNetwork, "networks", nil, NetworkRequest{}, Network{}},
+	{"GET", "/networks/{name}", "Describe a virtual network and its members", (*Sources).network, "networks", nil, nil, Network{}},
+	{"DELETE", "/networks/{name}", "Delete a virtual network", (*Sources).deleteNetwork, "networks", nil, nil, nil},
+	{"PUT", "/networks/{name}/members/{container}", "Join a container to a virtual network", (*Sources).joinNetwork, "networks", nil, nil, nil},
+	{"DELETE", "/networks/{name}/members/{container}", "Have a container leave a virtual network", (*Sources).leaveNetwork, "networks", nil, nil, nil},
+	{"GET", "/ipam", "Describe the allocator and its allocations", (*Sources).ipam, "ipam", nil, nil, IPAM{}},
+	{"POST", "/ipam/{ident}", "Allocate an address", (*Sources).allocate, "ipam", nil, nil, Allocation{}},
+	{"PUT", "/ipam/{ident}/{address}", "Claim a particular address", (*Sources).claim, "ipam", nil, nil, Allocation{}},
+	{"DELETE", "/ipam/{ident}", "Free the ident's addresses", (*Sources).free, "ipam", nil, nil, nil},
+	{"GET", "/dns", "List the names in weaveDNS", (*Sources).dns, "dns", nil, nil, []DNSRecord{}},
+	{"PUT", "/dns/{ident}", "Register a name for an address", (*Sources).addName, "dns", nil, DNSRequest{}, nil},
+	{"DELETE", "/dns/{ident}", "Delete the ident's names, or just those for an address", (*Sources).deleteNames, "dns", []string{"address"}, nil, nil},
+}
+
+var pathParam = regexp.MustCompile(`{([^}]+)}`)
+
+// Spec is the Swagger 2.0 document describing version 1 of the API,
+// served at /api/v1/spec
+func Spec() map[string]interface{} {
+	definitions := map[string]interface{}{}
+	errorReply := map[string]interface{}{
+		"description": "Error",
+		"schema":      schema(reflect.TypeOf(ErrorReply{}), definitions),
+	}
+	paths := map[string]map[string]interface{}{}
+	for _, route := range routes {
+		var parameters []interface{}
+		for _, match := range pathParam.FindAllStringSubmatch(route.path, -1) {
+			parameters = append(parameters, map[string]interface{}{
+				"name": match[1], "in": "path", "required": true, "type": "string"})
+		}
+		for _, name := range route.query {
+			parameters = append(parameters, map[string]interface{}{
+				"name": name, "in": "query", "required": false, "type": "string"})
+		}
+		if route.request != nil {
+			parameters = append(parameters, map[string]interface{}{
+				"name": "body", "in": "body", "required": true,
+				"schema": schema(reflect.TypeOf(route.request), definitions)})
+		}
+		responses := map[string]interface{}{"default": errorReply}
+		if route.reply == nil {
+			responses[strconv.Itoa(http.StatusNoContent)] = map[string]interface{}{"description": "Done"}
+		} else {
+			responses[strconv.Itoa(http.StatusOK)] = map[string]interface{}{
+				"description": "OK",
+				"schema":      schema(reflect.TypeOf(route.reply), definitions),
+			}
+		}
+		operation := map[string]interface{}{
+			"summary":    route.summary,
+			"responses":  responses,
+			"parameters": parameters,
+		}
+		if route.needs != "" {
+			operation["tags"] = []string{route.needs}
+		}
+		if paths[route.path] == nil {
+			paths[route.path] = map[string]interface{}{}
+		}
+		paths[route.path][strings.ToLower(route.method)] = operation
+	}
+	paths["/spec"] = map[string]interface{}{"get": map[string]interface{}{
+		"summary":   "This document",
+		"responses": map[string]interface{}{"200": map[string]interface{}{"description": "OK"}},
+	}}
+	return map[string]interface{}{
+		"swagger": "2.0",
+		"info": map[string]interface{}{
+			"title":   "Weave router API",
+			"version": strings.TrimPrefix(Prefix, "/api/"),
+		},
+		"basePath":    Prefix,
+		"consumes":    []string{"application/json"},
+		"produces":    []string{"application/json"},
+		"paths":       paths,
+		"definitions": definitions,
+	}
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// The JSON schema of a type as encoding/json encodes it, adding the
+// structs it refers to, by name, to definitions
+func schema(t reflect.Type, definitions map[string]interface{}) map[string]interface{} {
+	switch {
+	case t == timeType:
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case t.Kind() == reflect.Ptr:
+		return schema(t.Elem(), definitions)
+	case t.Kind() == reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": schema(t.Elem(), definitions)}
+	case t.Kind() == reflect.Slice:
+		return map[string]interface{}{"type": "array", "items": schema(t.Elem(), definitions)}
+	case t.Kind() == reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case t.Kind() == reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case t.Kind() >= reflect.Int && t.Kind() <= reflect.Uint64:
+		return map[string]interface{}{"type": "integer", "format": "int" + strconv.Itoa(t.Bits())}
+	case t.Kind() == reflect.Float32 || t.Kind() == reflect.Float64:
+		return map[string]interface{}{"type": "number", "format": map[int]string{32: "float", 64: "double"}[t.Bits()]}
+	case t.Kind() == reflect.Struct:
+		if _, found := definitions[t.Name()]; !found {
+			definitions[t.Name()] = nil // stop recursion
+			properties := map[string]interface{}{}
+			var required []string
+			for i := 0; i < t.NumField(); i++ {
+				field := t.Field(i)
+				name, omitempty := field.Name, false
+				if tag := strings.Split(field.Tag.Get("json"), ","); len(tag) > 1 {
+					if tag[0] != "" {
+						name = tag[0]
+					}
+					omitempty = tag[1] == "omitempty"
+				}
+				properties[name] = schema(field.Type, definitions)
+				if !omitempty {
+					required = append(required, name)
+				}
+			}
+			definitions[t.Name()] = map[string]interface{}{
+				"type": "object", "properties": properties, "required": required}
+		}
+		return map[string]interface{}{"$ref": "#/definitions/" + t.Name()}
+	}
+	return map[string]interface{}{}
+}
+
+func serveSpec(w http.ResponseWriter, r *http.Request) {
+	reply(w, Spec())
+}
@@ -0,0 +1,44 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+
+	wt "github.com/weaveworks/weave/testing"
+)
+
+func TestSpec(t *testing.T) {
+	muxRouter := mux.NewRouter()
+	HandleHTTP(muxRouter, &Sources{})
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "http://localhost"+Prefix+"/spec", nil)
+	muxRouter.ServeHTTP(w, r)
+	wt.AssertStatus(t, w.Code, http.StatusOK, "spec")
+
+	var spec struct {
+		BasePath    string
+		Paths       map[string]map[string]interface{}
+		Definitions map[string]struct {
+			Properties map[string]map[string]interface{}
+			Required   []string
+		}
+	}
+	wt.AssertNoErr(t, json.NewDecoder(w.Body).Decode(&spec))
+	wt.AssertEqualString(t, spec.BasePath, Prefix, "base path")
+	for _, route := range routes {
+		_, found := spec.Paths[route.path][strings.ToLower(route.method)]
+		wt.AssertTrue(t, found, route.method+" "+route.path)
+	}
+	for _, name := range []string{"Status", "Peer", "PeerConnection", "Connection", "IPAM", "Allocation", "DNSRecord", "ErrorReply"} {
+		_, found := spec.Definitions[name]
+		wt.AssertTrue(t, found, name)
+	}
+	connection := spec.Definitions["Connection"]
+	wt.AssertEquals(t, connection.Properties["TryAfter"]["format"], "date-time")
+	wt.AssertEquals(t, connection.Required, []string{"Address", "State"})
+}
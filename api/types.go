@@ -0,0 +1,317 @@
+package api
+
+import (
+	"time"
+)
+
+// The types here are the request and response bodies of version 1 of
+// the router's HTTP API, served under /api/v1, which are encoded as
+// JSON with these field names. Fields may be added within a version,
+// but never renamed, removed or given a different meaning.
+
+// Status describes the router, in reply to GET /api/v1/status
+type Status struct {
+	Version    string
+	Encryption bool
+	Name       string // the peer name
+	NickName   string
+	Labels     map[string]string `json:",omitempty"`
+	Port       int               // the port peers connect to
+	Interface  string            `json:",omitempty"`
+	IPAM       bool              // whether we allocate addresses
+	DNS        bool              // whether we answer DNS queries
+}
+
+// Peer describes a peer on the weave network, and its connections,
+// as in the reply to GET /api/v1/peers, which lists only the peers
+// with the labels given as ?label=<key>[=<value>], if any
+type Peer struct {
+	Name     string
+	NickName string
+	UID      uint64
+	Labels   map[string]string `json:",omitempty"` // which the peer was started with
+	Version  uint64            // of the peer's view of its connections
+	// of weave the peer runs, unless it is too old to tell us, and the
+	// features it has enabled
+	WeaveVersion string   `json:",omitempty"`
+	Features     []string `json:",omitempty"`
+	Connections  []PeerConnection
+}
+
+// PeerConnection is a connection from a peer to another
+type PeerConnection struct {
+	Name        string // of the peer at the other end
+	NickName    string
+	Address     string // the other end's
+	Outbound    bool
+	Established bool
+}
+
+// Connection is a connection from us to another peer, or an address
+// we are trying to connect to, as in the reply to GET
+// /api/v1/connections
+type Connection struct {
+	Address  string
+	State    string // ConnectionEstablished etc.
+	Outbound bool   `json:",omitempty"`
+	Name     string `json:",omitempty"` // of the peer, once connected
+	NickName string `json:",omitempty"`
+	Error    string `json:",omitempty"` // why we last failed to connect
+	// when we will next try, for ConnectionRetrying
+	TryAfter   *time.Time  `json:",omitempty"`
+	Annotation *Annotation `json:",omitempty"` // what an operator has said about it
+}
+
+// Connection states
+const (
+	ConnectionEstablished = "established"
+	ConnectionPending     = "pending" // connected, but not yet heard from
+	ConnectionConnecting  = "connecting"
+	ConnectionRetrying    = "retrying"
+)
+
+// ConnectionTarget is an address we are connecting to, will try again,
+// or have connected to, as in the reply to GET
+// /api/v1/connections/targets
+type ConnectionTarget struct {
+	Address     string
+	State       string      // "connecting", "retrying", "failed" (retried only every 10 minutes) or "established"
+	LastAttempt *time.Time  `json:",omitempty"` // when we last tried to connect
+	Error       string      `json:",omitempty"` // why that attempt failed
+	Failures    int         `json:",omitempty"` // attempts that have failed in a row
+	TryAfter    *time.Time  `json:",omitempty"` // when we will next try, unless connecting or established
+	Name        string      `json:",omitempty"` // of the peer, once connected
+	Annotation  *Annotation `json:",omitempty"` // what an operator has said about it
+}
+
+// DuplicateAddress is an address found in use with two MACs at once,
+// as in the reply to GET /api/v1/duplicates, which lists the latest,
+// oldest first, when the router was launched with -detect-duplicates
+type DuplicateAddress struct {
+	Time      time.Time
+	Address   string
+	MAC       string
+	Peer      string // which saw MAC
+	OtherMAC  string
+	OtherPeer string
+}
+
+// ConnectionEvent is something that happened to one of our
+// connections, as in the reply to GET /api/v1/connections/history,
+// which lists the latest, oldest first, by the peer's name or, for
+// connections that failed before we learnt that, the address
+type ConnectionEvent struct {
+	Time     time.Time
+	Type     string // "established", "dropped", "failed", "handshake failed" or "dial failed"
+	Address  string
+	Outbound bool
+	Reason   string `json:",omitempty"` // why the connection failed
+}
+
+// TopFlows lists the flows between local containers and remote ones
+// that have carried the most bytes, busiest first, in reply to GET
+// /api/v1/flows/top?n=<n>
+type TopFlows struct {
+	Flows     []Flow
+	Untracked uint64 // frames not counted, because there were too many flows
+}
+
+// Flow is the traffic between two addresses, IP or, for anything
+// other than IPv4, MAC
+type Flow struct {
+	Source      string
+	Destination string
+	Peer        string `json:",omitempty"` // at the remote end, unless broadcast
+	NickName    string `json:",omitempty"`
+	Outbound    bool   // from a local container
+	Packets     uint64
+	Bytes       uint64
+	FirstSeen   time.Time
+	LastSeen    time.Time
+}
+
+// GossipChannel describes the traffic of a gossip channel: the
+// messages, and their bytes, that we sent to our neighbours, and that
+// we received, as originated by each peer, as in the reply to GET
+// /api/v1/gossip, which lists the channels by name
+type GossipChannel struct {
+	GossipCounts
+	Peers map[string]GossipCounts // by the peer's name
+}
+
+// GossipCounts counts gossip messages
+type GossipCounts struct {
+	SentMessages      uint64
+	SentBytes         uint64
+	ReceivedMessages  uint64
+	ReceivedBytes     uint64
+	QueuedMessages    uint64 // waiting to be sent, by priority
+	DroppedMessages   uint64 // as the queue was full
+	ThrottledMessages uint64 // held back to keep to the channel's rate
+}
+
+// SelfTest reports a self-test of the overlay to a peer, in reply to
+// POST /api/v1/selftest: how fast we could send frames to it, and how
+// many it received, along with the round trip times of pings, and the
+// CPU we used while sending
+type SelfTest struct {
+	Peer           string
+	NickName       string
+	Seconds        float64 // that we sent for
+	SentFrames     uint64
+	SentBytes      uint64
+	ReceivedFrames uint64 // as the peer counted them
+	ReceivedBytes  uint64
+	Throughput     uint64 // bits per second the peer received
+	LossPercent    float64
+	PingsSent      int
+	PingsLost      int
+	RTTMinMillis   float64
+	RTTAvgMillis   float64
+	RTTMaxMillis   float64
+	CPUPercent     float64 // of one CPU, used by the router while sending
+}
+
+// DiagPing reports probes sent over the overlay, in reply to POST
+// /api/v1/diag/ping, to a peer, which answers them, or a container's
+// address, which the container answers, wherever it is
+type DiagPing struct {
+	Target       string
+	Peer         string `json:",omitempty"` // that answered; the container's, for an address
+	NickName     string `json:",omitempty"`
+	Sent         int
+	Received     int
+	LossPercent  float64
+	RTTMinMillis float64
+	RTTAvgMillis float64
+	RTTMaxMillis float64
+}
+
+// DiagTraceroute reports the route over the overlay to a peer, or a
+// container's address, in reply to POST /api/v1/diag/traceroute
+type DiagTraceroute struct {
+	Target  string
+	Reached bool
+	Hops    []DiagHop
+}
+
+// Connectivity reports, in reply to POST /api/v1/diag/connectivity,
+// what each peer found probing every other over the overlay, as for
+// DiagPing: Matrix[i][j] is what Peers[i] found probing Peers[j]
+type Connectivity struct {
+	Peers  []ConnectivityPeer
+	Matrix [][]*ConnectivityCell // null where a peer probed itself, didn't answer, or didn't know of the other
+}
+
+// ConnectivityPeer is a peer in a connectivity matrix
+type ConnectivityPeer struct {
+	Name     string
+	NickName string
+	Answered bool // whether it sent us what it found in time
+}
+
+// ConnectivityCell is what a peer found probing another
+type ConnectivityCell struct {
+	Sent        int
+	Received    int
+	LossPercent float64
+	RTTMillis   float64 // average, of the probes answered
+	Error       string  `json:",omitempty"` // why the peer couldn't probe the other, e.g. having no route to it
+}
+
+// DiagHop is the peer that answered a probe with a hop limit, or the
+// container at the end of a route to one
+type DiagHop struct {
+	Peer      string `json:",omitempty"` // unless nothing answered
+	NickName  string `json:",omitempty"`
+	Address   string `json:",omitempty"` // of the container, for the last hop to one
+	RTTMillis float64
+	Lost      bool
+}
+
+// Annotation is what an operator has said about a connection, as put
+// by PUT /api/v1/connections/annotations/<peer>, where peer is the
+// peer's name or nickname, or the address we connect to, and listed,
+// by that, by GET /api/v1/connections/annotations
+type Annotation struct {
+	Labels map[string]string `json:",omitempty"`
+	Note   string            `json:",omitempty"`
+	Time   time.Time         // when it was set; ignored in requests
+}
+
+// Mirror is a session copying the frames matching a filter to an
+// interface, here or on another peer, as started by POST
+// /api/v1/mirrors and listed by GET /api/v1/mirrors
+type Mirror struct {
+	ID       string
+	Filter   string `json:",omitempty"` // as for captures; all frames if blank
+	Peer     string // which sends the copies
+	NickName string
+	Iface    string // which they are sent from
+	Expires  time.Time
+	Frames   uint64 // copied
+	Dropped  uint64 // not copied, because we couldn't keep up, or couldn't send them
+}
+
+// ConnectRequest is the body of POST /api/v1/connections, asking us
+// to connect to a peer, and to keep connecting, as 'weave connect'
+type ConnectRequest struct {
+	Peer string // <host>[:<port>]
+}
+
+// IPAM describes the address allocator, in reply to GET /api/v1/ipam
+type IPAM struct {
+	Range       string // in CIDR notation
+	PickedBy    string `json:",omitempty"` // the peer that picked the range, unless it was given with -iprange
+	Ready       bool   // the peers have agreed how to divide the range, and, if it was picked, on the range
+	Allocations []Allocation
+}
+
+// Allocation is an address held by a container, or other ident, on
+// this peer, as in the reply to POST or PUT /api/v1/ipam/{ident}
+type Allocation struct {
+	Ident   string
+	Address string // in CIDR notation, with the range's prefix length
+}
+
+// DNSRecord is a name in weaveDNS, as in the reply to GET /api/v1/dns
+type DNSRecord struct {
+	Ident   string
+	Name    string // fully qualified
+	Address string
+	Origin  string // the peer that registered it
+	Local   bool   // registered on this peer
+}
+
+// DNSRequest is the body of PUT /api/v1/dns/{ident}, registering a
+// name for the ident's address
+type DNSRequest struct {
+	Name    string
+	Address string
+}
+
+// Network is a virtual network, a named subnet, with the containers
+// joined to it, as in the reply to GET /api/v1/networks
+type Network struct {
+	Name    string
+	Subnet  string // in CIDR notation
+	Members []NetworkMember
+}
+
+// NetworkMember is a container joined to a network
+type NetworkMember struct {
+	Container string
+	Peer      string // the name of the peer it was joined on
+}
+
+// NetworkRequest is the body of POST /api/v1/networks, creating a
+// network, whose subnet mustn't overlap any other's
+type NetworkRequest struct {
+	Name   string
+	Subnet string
+}
+
+// ErrorReply is the body of replies with error statuses
+type ErrorReply struct {
+	Message string
+}
@@ -0,0 +1,332 @@
+package attach
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+	. "github.com/weaveworks/weave/common"
+	"github.com/weaveworks/weave/ipam"
+	"github.com/weaveworks/weave/ipam/address"
+	weavenet "github.com/weaveworks/weave/net"
+)
+
+const (
+	DefaultBridge   = "weave"
+	ContainerIfName = "ethwe"
+)
+
+// Names of networks other than the default, which go into interface
+// names, so must be short and plain
+var networkNameRegexp = regexp.MustCompile("^[a-z0-9]{1,9}$")
+
+// Attacher attaches containers to the weave network, and detaches
+// them, as 'weave attach' and 'weave detach' do. We may well be in a
+// network namespace of our own, so it finds both the containers' and
+// the host's, where the bridge is, via the host's /proc.
+type Attacher struct {
+	sync.Mutex
+	client *docker.Client
+	procfs string // where the host's /proc is mounted
+	bridge string
+	alloc  *ipam.Allocator
+	names  Names
+	// by host port and protocol
+	published map[string]*Publication
+	// host-side veths of containers, by ID, to remove when they die
+	veths     map[string][]string
+	probeWait time.Duration    // for duplicate address detection
+	macPrefix net.HardwareAddr // to make MACs from addresses with, if not nil
+	conflicts []Conflict
+	// the iptables rules for exposing and publishing
+	rules *weavenet.IPTablesRules
+}
+
+// NewAttacher creates an attacher for the containers client knows of,
+// attaching them to bridge, and handing out addresses from alloc to
+// those attached without any, if alloc is not nil.
+func NewAttacher(client *docker.Client, procfs, bridge string, alloc *ipam.Allocator) *Attacher {
+	a := &Attacher{client: client, procfs: procfs, bridge: bridge, alloc: alloc, published: make(map[string]*Publication), veths: make(map[string][]string)}
+	a.rules = weavenet.NewIPTablesRules(a.hostNetNSPath())
+	return a
+}
+
+// The address allocated, with the prefix length of the allocator's
+// range, which is settled once it has allocated
+func (a *Attacher) allocated(addr address.Address) []*net.IPNet {
+	subnet, _ := a.alloc.Range()
+	return []*net.IPNet{{IP: addr.IP4(), Mask: subnet.Mask}}
+}
+
+func (a *Attacher) hostNetNSPath() string {
+	return weavenet.NetNSPath(a.procfs, 1)
+}
+
+func (a *Attacher) netNSPath(pid int) string {
+	return weavenet.NetNSPath(a.procfs, pid)
+}
+
+// A container we can attach or detach, and where to find its network
+// namespace
+func (a *Attacher) runningContainer(id string) (*docker.Container, string, error) {
+	container, err := a.client.InspectContainer(id)
+	if err != nil {
+		return nil, "", &containerError{fmt.Sprintf("No such container: %s", id)}
+	}
+	if !container.State.Running || container.State.Pid == 0 {
+		return nil, "", &containerError{fmt.Sprintf("Container %s not running.", id)}
+	}
+	nsPath := a.netNSPath(container.State.Pid)
+	ns, err1 := os.Readlink(nsPath)
+	hostNS, err2 := os.Readlink(a.hostNetNSPath())
+	if err1 == nil && err2 == nil && ns == hostNS {
+		return nil, "", &containerError{"Container is running in the host network namespace, and therefore cannot be connected to weave. Perhaps the container was started with --net=host."}
+	}
+	return container, nsPath, nil
+}
+
+// A container is attached to each network through an interface of
+// its own: "ethwe" for the default network, named "", and
+// "ethwe-<name>" for the others.
+func ifName(network string) (string, error) {
+	if network == "" {
+		return ContainerIfName, nil
+	}
+	if !networkNameRegexp.MatchString(network) {
+		return "", &containerError{fmt.Sprintf("Invalid network name %q: expected up to 9 lower-case letters and digits", network)}
+	}
+	return ContainerIfName + "-" + network, nil
+}
+
+// The veth pair for the default network is named as 'weave attach'
+// names it; the names of those for other networks would be too long
+// that way, so are made from a hash instead.
+func vethNames(ifName string, pid int) (local, guest string) {
+	if ifName == ContainerIfName {
+		return weavenet.ContainerVethNames(ifName, pid)
+	}
+	h := fnv.New32a()
+	fmt.Fprintf(h, "%s/%d", ifName, pid)
+	sum := h.Sum32()
+	return fmt.Sprintf("vethwl%08x", sum), fmt.Sprintf("vethwg%08x", sum)
+}
+
+// Attach connects the container with ID, or name, id to network with
+// the addresses in cidrs, returning the addresses it now has from us.
+// With no addresses, a container on the default network gets one from
+// the allocator, which may block until cancelChan is closed; the
+// allocator only has the one range, so those on other networks must
+// be given theirs.
+func (a *Attacher) Attach(id, network string, cidrs []string, cancelChan <-chan bool) ([]*net.IPNet, error) {
+	ifName, err := ifName(network)
+	if err != nil {
+		return nil, err
+	}
+	container, nsPath, err := a.runningContainer(id)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := parseCIDRs(cidrs)
+	if err != nil {
+		return nil, err
+	}
+	if len(addrs) == 0 {
+		if network != "" {
+			return nil, &containerError{fmt.Sprintf("No IP address supplied for network %s", network)}
+		}
+		if a.alloc == nil {
+			return nil, &containerError{"No IP address supplied (use the -iprange option on 'weave launch' to enable IP address allocation)"}
+		}
+		addr, err := a.alloc.Allocate(container.ID, cancelChan)
+		if err != nil {
+			return nil, err
+		}
+		addrs = a.allocated(addr)
+	}
+	if err := a.checkConflicts(container.ID, nsPath, ifName, addrs); err != nil {
+		return nil, err
+	}
+	local, guest := vethNames(ifName, container.State.Pid)
+	if err := weavenet.AttachContainer(a.hostNetNSPath(), nsPath, a.bridge, local, guest, ifName, a.macFor(addrs), addrs); err != nil {
+		return nil, err
+	}
+	a.noteVeth(container.ID, local)
+	Info.Printf("[attach] Attached container %s to %s with %s", container.ID, ifName, addrsString(addrs))
+	return addrs, nil
+}
+
+// Detach removes the addresses in cidrs, or all we gave it if there
+// are none, from the container with ID, or name, id on network,
+// disconnecting it from that network altogether when it has none
+// left. Having lost them all on the default network, it has no use
+// for an address from the allocator.
+func (a *Attacher) Detach(id, network string, cidrs []string) ([]*net.IPNet, error) {
+	ifName, err := ifName(network)
+	if err != nil {
+		return nil, err
+	}
+	container, nsPath, err := a.runningContainer(id)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := parseCIDRs(cidrs)
+	if err != nil {
+		return nil, err
+	}
+	removed, err := weavenet.DetachContainer(nsPath, ifName, addrs)
+	if err != nil {
+		return nil, err
+	}
+	if len(addrs) == 0 && network == "" && a.alloc != nil {
+		a.alloc.Free(container.ID)
+	}
+	Info.Printf("[attach] Detached container %s from %s on %s", container.ID, addrsString(removed), ifName)
+	return removed, nil
+}
+
+// SetMACPrefix has us give each interface we create a MAC made from
+// prefix and its first address, as by weavenet.MACFromIP, rather than
+// a random one, so that which MAC has which address is predictable,
+// and whatever sees an ARP packet can tell whether the two match.
+func (a *Attacher) SetMACPrefix(prefix net.HardwareAddr) {
+	a.macPrefix = prefix
+}
+
+func (a *Attacher) macFor(addrs []*net.IPNet) net.HardwareAddr {
+	if a.macPrefix == nil || len(addrs) == 0 {
+		return nil
+	}
+	return weavenet.MACFromIP(a.macPrefix, addrs[0].IP)
+}
+
+func (a *Attacher) noteVeth(id, veth string) {
+	a.Lock()
+	defer a.Unlock()
+	for _, v := range a.veths[id] {
+		if v == veth {
+			return
+		}
+	}
+	a.veths[id] = append(a.veths[id], veth)
+}
+
+// ContainerStarted, ContainerDied and ContainerDestroyed make the
+// attacher a ContainerObserver for the updater. We note where the
+// interface of a container started, however it gets attached, will
+// be on the host, and keep publications to it in step with it.
+func (a *Attacher) ContainerStarted(ident string) {
+	if container, err := a.client.InspectContainer(ident); err == nil && container.State.Pid != 0 {
+		local, _ := vethNames(ContainerIfName, container.State.Pid)
+		a.noteVeth(container.ID, local)
+	}
+	a.reconcilePublications(ident)
+}
+
+// A dead container's veths usually go with its network namespace,
+// but that can outlive it, e.g. when something else has it open, so
+// we remove them ourselves, before the updater has its names and
+// addresses released, so that they cannot be reused whilst still
+// reachable here.
+func (a *Attacher) ContainerDied(ident string) error {
+	a.Lock()
+	veths := a.veths[ident]
+	delete(a.veths, ident)
+	a.Unlock()
+	err := weavenet.WithNetNSPath(a.hostNetNSPath(), func() error {
+		for _, veth := range veths {
+			deleted, err := weavenet.DeleteLinkIfPresent(veth)
+			if err != nil {
+				return err
+			}
+			if deleted {
+				Info.Printf("[attach] Removed %s of dead container %s", veth, ident)
+			}
+		}
+		return nil
+	})
+	a.reconcilePublications(ident)
+	return err
+}
+
+func (a *Attacher) ContainerDestroyed(ident string) error {
+	a.unpublishContainer(ident)
+	return nil
+}
+
+// Endpoint is a container's attachment to one network
+type Endpoint struct {
+	Network   string
+	Interface string
+	MAC       string
+	Addresses []string
+}
+
+// Endpoints lists the networks the container with ID, or name, id is
+// attached to
+func (a *Attacher) Endpoints(id string) ([]Endpoint, error) {
+	_, nsPath, err := a.runningContainer(id)
+	if err != nil {
+		return nil, err
+	}
+	return endpoints(nsPath)
+}
+
+func endpoints(nsPath string) ([]Endpoint, error) {
+	ifaces, err := weavenet.ContainerInterfaces(nsPath, ContainerIfName)
+	if err != nil {
+		return nil, err
+	}
+	endpoints := []Endpoint{}
+	for _, iface := range ifaces {
+		endpoint := Endpoint{Interface: iface.Name, MAC: iface.MAC.String(), Addresses: []string{}}
+		if iface.Name != ContainerIfName {
+			if !strings.HasPrefix(iface.Name, ContainerIfName+"-") {
+				continue
+			}
+			endpoint.Network = strings.TrimPrefix(iface.Name, ContainerIfName+"-")
+		}
+		for _, addr := range iface.Addrs {
+			endpoint.Addresses = append(endpoint.Addresses, addr.String())
+		}
+		endpoints = append(endpoints, endpoint)
+	}
+	return endpoints, nil
+}
+
+// containerError reports a problem with the request rather than with
+// us, so is for the client to fix
+type containerError struct {
+	msg string
+}
+
+func (err *containerError) Error() string {
+	return err.msg
+}
+
+// Addresses may be given one to a value, or several, space-separated,
+// as in WEAVE_CIDR
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	var addrs []*net.IPNet
+	for _, cidr := range strings.Fields(strings.Join(cidrs, " ")) {
+		ip, subnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, &containerError{fmt.Sprintf("Invalid CIDR %q: %s", cidr, err)}
+		}
+		addrs = append(addrs, &net.IPNet{IP: ip, Mask: subnet.Mask})
+	}
+	return addrs, nil
+}
+
+func addrsString(addrs []*net.IPNet) string {
+	strs := make([]string, len(addrs))
+	for i, addr := range addrs {
+		strs[i] = addr.String()
+	}
+	return strings.Join(strs, " ")
+}
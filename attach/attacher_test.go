@@ -0,0 +1,94 @@
+package attach
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	weavenet "github.com/weaveworks/weave/net"
+	wt "github.com/weaveworks/weave/testing"
+)
+
+func TestParseCIDRs(t *testing.T) {
+	addrs, err := parseCIDRs([]string{"10.2.1.1/24 10.2.2.1/24", "10.3.0.1/16"})
+	wt.AssertNoErr(t, err)
+	wt.AssertEqualString(t, addrsString(addrs), "10.2.1.1/24 10.2.2.1/24 10.3.0.1/16", "addresses")
+
+	addrs, err = parseCIDRs([]string{""})
+	wt.AssertNoErr(t, err)
+	wt.AssertEqualInt(t, len(addrs), 0, "no addresses")
+
+	_, err = parseCIDRs([]string{"10.2.1.1"})
+	wt.AssertErrorType(t, err, (**containerError)(nil), "bad CIDR")
+}
+
+func TestReply(t *testing.T) {
+	addrs, _ := parseCIDRs([]string{"10.2.1.1/24", "10.2.2.1/24"})
+	rec := httptest.NewRecorder()
+	reply(rec, addrs, nil)
+	wt.AssertStatus(t, rec.Code, http.StatusOK, "success")
+	wt.AssertEqualString(t, rec.Body.String(), "10.2.1.1/24\n10.2.2.1/24\n", "body")
+
+	rec = httptest.NewRecorder()
+	reply(rec, nil, &containerError{"Container foo not running."})
+	wt.AssertStatus(t, rec.Code, http.StatusBadRequest, "container error")
+}
+
+func TestNetworkNames(t *testing.T) {
+	name, err := ifName("")
+	wt.AssertNoErr(t, err)
+	wt.AssertEqualString(t, name, "ethwe", "default network")
+	name, err = ifName("front1")
+	wt.AssertNoErr(t, err)
+	wt.AssertEqualString(t, name, "ethwe-front1", "named network")
+	_, err = ifName("toolongname")
+	wt.AssertErrorType(t, err, (**containerError)(nil), "long name")
+	_, err = ifName("Front")
+	wt.AssertErrorType(t, err, (**containerError)(nil), "upper-case name")
+
+	local, guest := vethNames("ethwe", 1234)
+	wt.AssertEqualString(t, local, "vethwepl1234", "default local name")
+	wt.AssertEqualString(t, guest, "vethwepg1234", "default guest name")
+	local, guest = vethNames("ethwe-front1", 4194303)
+	wt.AssertTrue(t, len(local) <= 15 && len(guest) <= 15, "names fit")
+	wt.AssertTrue(t, local != guest, "names differ")
+	other, _ := vethNames("ethwe-back", 4194303)
+	wt.AssertTrue(t, local != other, "names differ between networks")
+}
+
+func TestNoteVeth(t *testing.T) {
+	a := &Attacher{veths: make(map[string][]string)}
+	a.noteVeth("c1", "vethwepl1234")
+	a.noteVeth("c1", "vethwl0000abcd")
+	a.noteVeth("c1", "vethwepl1234")
+	wt.AssertEquals(t, a.veths["c1"], []string{"vethwepl1234", "vethwl0000abcd"})
+}
+
+func TestMACFor(t *testing.T) {
+	addrs, _ := parseCIDRs([]string{"10.32.1.2/12", "10.2.2.1/24"})
+	a := &Attacher{}
+	wt.AssertTrue(t, a.macFor(addrs) == nil, "random MAC without a prefix")
+
+	oui, err := weavenet.ParseMACPrefix("02:77:65")
+	wt.AssertNoErr(t, err)
+	a.SetMACPrefix(oui)
+	wt.AssertEqualString(t, a.macFor(addrs).String(), "02:77:65:20:01:02", "MAC from OUI")
+	wt.AssertTrue(t, a.macFor(nil) == nil, "no addresses")
+
+	prefix, err := weavenet.ParseMACPrefix("0a:58")
+	wt.AssertNoErr(t, err)
+	a.SetMACPrefix(prefix)
+	wt.AssertEqualString(t, a.macFor(addrs).String(), "0a:58:0a:20:01:02", "MAC from two-byte prefix")
+	wt.AssertEqualString(t, weavenet.MACFromIP(prefix, net.ParseIP("10.2.2.1")).String(), "0a:58:0a:02:02:01", "MAC of IP")
+
+	v6, err := parseCIDRs([]string{"fd00::1:2/64"})
+	wt.AssertNoErr(t, err)
+	wt.AssertTrue(t, a.macFor(v6) == nil, "random MAC for an IPv6 address")
+	wt.AssertTrue(t, weavenet.MACFromIP(oui, net.ParseIP("fd00::1:2")) == nil, "no MAC of IPv6 address")
+
+	for _, bad := range []string{"", "02", "02:77:65:01", "02:7:65", "zz:77:65", "03:77:65"} {
+		_, err := weavenet.ParseMACPrefix(bad)
+		wt.AssertTrue(t, err != nil, "invalid prefix "+bad)
+	}
+}
@@ -0,0 +1,103 @@
+package attach
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	. "github.com/weaveworks/weave/common"
+	"github.com/weaveworks/weave/common/events"
+	weavenet "github.com/weaveworks/weave/net"
+)
+
+// How many conflicts we remember
+const maxConflicts = 32
+
+// Conflict is an address that we found something on the weave network
+// had already, when we were about to give it to a container, or to
+// the host
+type Conflict struct {
+	Time    time.Time
+	Ident   string // the container's ID, or weave:expose
+	Address string
+	MAC     string // of whatever has the address
+}
+
+// conflictError reports a Conflict, which we refuse to create
+type conflictError struct {
+	Conflict
+}
+
+func (err *conflictError) Error() string {
+	return fmt.Sprintf("Address %s is in use already, by %s", err.Address, err.MAC)
+}
+
+// SetProbeWait has us probe for each address with ARP, for wait,
+// before giving it to a container or the host, and refuse to if
+// anything answers; we don't probe if wait is 0
+func (a *Attacher) SetProbeWait(wait time.Duration) {
+	a.probeWait = wait
+}
+
+// Probe for addrs on the bridge, other than those the interface
+// ifName in the network namespace at nsPath, if given, has already.
+// Addresses from the allocator that turn out to be in use stay
+// allocated to ident, so that they aren't handed to anything else.
+func (a *Attacher) checkConflicts(ident, nsPath, ifName string, addrs []*net.IPNet) error {
+	if a.probeWait == 0 {
+		return nil
+	}
+	var have []*net.IPNet
+	if nsPath != "" {
+		ifaces, err := weavenet.ContainerInterfaces(nsPath, ifName)
+		if err != nil {
+			return err
+		}
+		for _, iface := range ifaces {
+			if iface.Name == ifName {
+				have = iface.Addrs
+			}
+		}
+	}
+	var probe []*net.IPNet
+	for _, addr := range addrs {
+		if !containsIP(have, addr.IP) {
+			probe = append(probe, addr)
+		}
+	}
+	err := weavenet.WithNetNSPath(a.hostNetNSPath(), func() error {
+		return weavenet.ProbeAddresses(a.bridge, probe, a.probeWait)
+	})
+	if inUse, ok := err.(*weavenet.AddressInUseError); ok {
+		return a.noteConflict(Conflict{Time: time.Now(), Ident: ident, Address: inUse.IP.String(), MAC: inUse.MAC.String()})
+	}
+	return err
+}
+
+func containsIP(addrs []*net.IPNet, ip net.IP) bool {
+	for _, addr := range addrs {
+		if addr.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *Attacher) noteConflict(conflict Conflict) error {
+	a.Lock()
+	a.conflicts = append(a.conflicts, conflict)
+	if len(a.conflicts) > maxConflicts {
+		a.conflicts = a.conflicts[len(a.conflicts)-maxConflicts:]
+	}
+	a.Unlock()
+	Warning.Printf("[attach] Not giving %s to %s: in use already by %s", conflict.Address, conflict.Ident, conflict.MAC)
+	events.Publish(events.AddressConflict, map[string]string{"ident": conflict.Ident, "address": conflict.Address, "mac": conflict.MAC})
+	return &conflictError{conflict}
+}
+
+// Conflicts lists the conflicts we found lately, oldest first
+func (a *Attacher) Conflicts() []Conflict {
+	a.Lock()
+	defer a.Unlock()
+	return append([]Conflict{}, a.conflicts...)
+}
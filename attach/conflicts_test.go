@@ -0,0 +1,35 @@
+package attach
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/weaveworks/weave/common/events"
+	wt "github.com/weaveworks/weave/testing"
+)
+
+func TestNoteConflict(t *testing.T) {
+	a := &Attacher{}
+	ch := events.Subscribe()
+	defer events.Unsubscribe(ch)
+
+	for i := 0; i < maxConflicts+2; i++ {
+		err := a.noteConflict(Conflict{Time: time.Now(), Ident: fmt.Sprint("c", i), Address: "10.32.0.1", MAC: "02:00:00:00:00:01"})
+		wt.AssertErrorType(t, err, (**conflictError)(nil), "conflict")
+	}
+	conflicts := a.Conflicts()
+	wt.AssertEqualInt(t, len(conflicts), maxConflicts, "conflicts kept")
+	wt.AssertEqualString(t, conflicts[0].Ident, "c2", "oldest conflict kept")
+
+	event := <-ch
+	wt.AssertEqualString(t, event.Type, events.AddressConflict, "event type")
+	wt.AssertEqualString(t, event.Fields["address"], "10.32.0.1", "event address")
+	wt.AssertEqualString(t, event.Fields["ident"], "c0", "event ident")
+
+	rec := httptest.NewRecorder()
+	reply(rec, nil, &conflictError{conflicts[0]})
+	wt.AssertStatus(t, rec.Code, http.StatusConflict, "conflict error")
+}
@@ -0,0 +1,64 @@
+package attach
+
+import (
+	"sort"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// Container is what we know of a container on this host that is
+// attached to the weave network, as 'weave ps' shows
+type Container struct {
+	ID        string
+	Name      string
+	Endpoints []Endpoint
+	Allocated string   `json:",omitempty"` // address from the allocator, if any
+	DNSNames  []string `json:",omitempty"`
+}
+
+// Containers lists the running containers on this host that are
+// attached to the weave network, in order of name, with their
+// interfaces from their network namespaces, and what the allocator
+// and DNS hold for them.
+func (a *Attacher) Containers() ([]Container, error) {
+	running, err := a.client.ListContainers(docker.ListContainersOptions{})
+	if err != nil {
+		return nil, err
+	}
+	containers := []Container{}
+	for _, c := range running {
+		container, nsPath, err := a.runningContainer(c.ID)
+		if err != nil {
+			// gone since we listed it, or in the host's namespace
+			continue
+		}
+		endpoints, err := endpoints(nsPath)
+		if err != nil || len(endpoints) == 0 {
+			continue
+		}
+		info := Container{ID: container.ID, Name: container.Name, Endpoints: endpoints}
+		if len(info.Name) > 0 && info.Name[0] == '/' {
+			info.Name = info.Name[1:]
+		}
+		if a.alloc != nil {
+			if addr, found := a.alloc.Lookup(container.ID); found {
+				info.Allocated = addr.String()
+			}
+		}
+		if a.names != nil {
+			recs, _ := a.names.LookupIdent(container.ID)
+			for _, rec := range recs {
+				info.DNSNames = append(info.DNSNames, rec.Name())
+			}
+		}
+		containers = append(containers, info)
+	}
+	sort.Sort(byName(containers))
+	return containers, nil
+}
+
+type byName []Container
+
+func (cs byName) Len() int           { return len(cs) }
+func (cs byName) Swap(i, j int)      { cs[i], cs[j] = cs[j], cs[i] }
+func (cs byName) Less(i, j int) bool { return cs[i].Name < cs[j].Name }
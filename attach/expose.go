@@ -0,0 +1,197 @@
+package attach
+
+import (
+	"net"
+	"strings"
+
+	. "github.com/weaveworks/weave/common"
+	"github.com/weaveworks/weave/nameserver"
+	weavenet "github.com/weaveworks/weave/net"
+)
+
+// The ident of the host's addresses, in the allocator and DNS, as in
+// the weave script
+const exposeIdent = "weave:expose"
+
+// Names is where we register the names given to the host's addresses,
+// and find those of containers, e.g. a nameserver.Zone
+type Names interface {
+	AddRecord(ident string, name string, ip net.IP) error
+	DeleteRecord(ident string, ip net.IP) error
+	LookupIdent(ident string) ([]nameserver.ZoneRecord, error)
+}
+
+// SetNames tells us where to register the names given to the host's
+// addresses, and to look up those of containers
+func (a *Attacher) SetNames(names Names) {
+	a.names = names
+}
+
+func (a *Attacher) exposeRules(addr *net.IPNet) []weavenet.IPTablesRule {
+	cidr := addr.String()
+	return []weavenet.IPTablesRule{
+		{Table: "nat", Chain: "WEAVE", Spec: []string{"-d", cidr, "!", "-s", cidr, "-j", "MASQUERADE"}},
+		{Table: "nat", Chain: "WEAVE", Spec: []string{"-s", cidr, "!", "-d", cidr, "-j", "MASQUERADE"}},
+	}
+}
+
+// What owns the rules for exposing addr, or, if nil, the prefix of
+// all those
+func exposeOwner(addr *net.IPNet) string {
+	if addr == nil {
+		return "expose:"
+	}
+	return "expose:" + addr.String()
+}
+
+// Expose gives the bridge, and so the host, the addresses in cidrs,
+// or one from the allocator if there are none, so that the host can
+// talk to containers on the weave network, masquerading traffic that
+// crosses between the two, as 'weave expose' does. The addresses are
+// registered under fqdn, if not blank.
+func (a *Attacher) Expose(cidrs []string, fqdn string, cancelChan <-chan bool) ([]*net.IPNet, error) {
+	addrs, err := parseCIDRs(cidrs)
+	if err != nil {
+		return nil, err
+	}
+	if len(addrs) == 0 {
+		if a.alloc == nil {
+			return nil, &containerError{"No IP address supplied (use the -iprange option on 'weave launch' to enable IP address allocation)"}
+		}
+		addr, err := a.alloc.Allocate(exposeIdent, cancelChan)
+		if err != nil {
+			return nil, err
+		}
+		addrs = a.allocated(addr)
+	}
+	// the bridge answers for the addresses it has already with its
+	// own MAC, which we ignore
+	if err := a.checkConflicts(exposeIdent, "", "", addrs); err != nil {
+		return nil, err
+	}
+
+	a.Lock()
+	defer a.Unlock()
+	if err := a.rules.Chain("nat", "WEAVE", "POSTROUTING"); err != nil {
+		return nil, err
+	}
+	for _, addr := range addrs {
+		err := weavenet.WithNetNSPath(a.hostNetNSPath(), func() error {
+			_, err := weavenet.AddInterfaceAddress(a.bridge, addr)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		if err := a.rules.Set(exposeOwner(addr), a.exposeRules(addr)...); err != nil {
+			return nil, err
+		}
+	}
+	if fqdn != "" && a.names != nil {
+		for _, addr := range addrs {
+			if err := a.names.AddRecord(exposeIdent, fqdn, addr.IP); err != nil {
+				Warning.Printf("[attach] Unable to register %s for %s: %s", fqdn, addr.IP, err)
+			}
+		}
+	}
+	Info.Printf("[attach] Exposed %s", addrsString(addrs))
+	return addrs, nil
+}
+
+// Hide undoes Expose for the addresses in cidrs, or for all the
+// bridge's addresses if there are none, in which case the address
+// from the allocator, if any, is released too. The bridge is the
+// record of what is exposed, so this works after a restart too.
+func (a *Attacher) Hide(cidrs []string) ([]*net.IPNet, error) {
+	addrs, err := parseCIDRs(cidrs)
+	if err != nil {
+		return nil, err
+	}
+	a.Lock()
+	defer a.Unlock()
+	all := len(addrs) == 0
+	var hidden []*net.IPNet
+	err = weavenet.WithNetNSPath(a.hostNetNSPath(), func() error {
+		if all {
+			if addrs, err = weavenet.InterfaceAddresses(a.bridge); err != nil {
+				return err
+			}
+		}
+		for _, addr := range addrs {
+			removed, err := weavenet.DeleteInterfaceAddress(a.bridge, addr)
+			if err != nil {
+				return err
+			}
+			// as 'weave expose' adds them, without our tag
+			for _, rule := range a.exposeRules(addr) {
+				if err := weavenet.DeleteIPTablesRule(rule.Table, rule.Chain, rule.Spec...); err != nil {
+					return err
+				}
+			}
+			if removed {
+				hidden = append(hidden, addr)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, addr := range addrs {
+		if err := a.rules.Remove(exposeOwner(addr)); err != nil {
+			return nil, err
+		}
+	}
+	if a.names != nil {
+		for _, addr := range hidden {
+			a.names.DeleteRecord(exposeIdent, addr.IP)
+		}
+	}
+	if all && a.alloc != nil {
+		a.alloc.Free(exposeIdent)
+	}
+	Info.Printf("[attach] Hid %s", addrsString(hidden))
+	return hidden, nil
+}
+
+// Keep the rules for the addresses we have exposed, including before
+// a restart, and only those, since the bridge is the record of what is
+// exposed. Those exposed by the weave script are its business.
+func (a *Attacher) keepExposed() error {
+	if err := a.ensureChains(); err != nil {
+		return err
+	}
+	var addrs []*net.IPNet
+	err := weavenet.WithNetNSPath(a.hostNetNSPath(), func() (err error) {
+		addrs, err = weavenet.OwnedAddresses(a.bridge)
+		return
+	})
+	if err != nil {
+		return err
+	}
+	exposed := make(map[string]bool)
+	for _, addr := range addrs {
+		exposed[exposeOwner(addr)] = true
+		if err := a.rules.Set(exposeOwner(addr), a.exposeRules(addr)...); err != nil {
+			return err
+		}
+	}
+	for _, owner := range a.rules.Owners() {
+		if strings.HasPrefix(owner, exposeOwner(nil)) && !exposed[owner] {
+			if err := a.rules.Remove(owner); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Exposed lists the addresses of the bridge, i.e. those exposed
+func (a *Attacher) Exposed() ([]*net.IPNet, error) {
+	var addrs []*net.IPNet
+	err := weavenet.WithNetNSPath(a.hostNetNSPath(), func() (err error) {
+		addrs, err = weavenet.InterfaceAddresses(a.bridge)
+		return
+	})
+	return addrs, err
+}
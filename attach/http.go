@@ -0,0 +1,120 @@
+package attach
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	. "github.com/weaveworks/weave/common"
+)
+
+// HandleHTTP wires up the attach and detach endpoints to the provided
+// mux. Both take the addresses as "cidr" form values, and the network,
+// if not the default, as "net", and reply with the addresses attached
+// or detached, one per line. GET lists the container's networks, and
+// GET /containers all the attached containers.
+// Likewise for exposing the host, with an optional "fqdn" to give
+// its addresses in DNS. Publishing a host port takes the "container",
+// or "address", its "port" and "proto"col. GET /conflicts lists the
+// addresses we refused to give out lately because something had them
+// already.
+func (a *Attacher) HandleHTTP(router *mux.Router) {
+	router.Methods("PUT").Path("/attach/{id}").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		closedChan := w.(http.CloseNotifier).CloseNotify()
+		r.ParseForm()
+		addrs, err := a.Attach(mux.Vars(r)["id"], r.FormValue("net"), r.Form["cidr"], closedChan)
+		reply(w, addrs, err)
+	})
+
+	router.Methods("DELETE").Path("/attach/{id}").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		addrs, err := a.Detach(mux.Vars(r)["id"], r.FormValue("net"), r.Form["cidr"])
+		reply(w, addrs, err)
+	})
+
+	router.Methods("GET").Path("/attach/{id}").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		endpoints, err := a.Endpoints(mux.Vars(r)["id"])
+		if err != nil {
+			replyError(w, err)
+			return
+		}
+		json.NewEncoder(w).Encode(endpoints)
+	})
+
+	router.Methods("GET").Path("/containers").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		containers, err := a.Containers()
+		if err != nil {
+			replyError(w, err)
+			return
+		}
+		json.NewEncoder(w).Encode(containers)
+	})
+
+	router.Methods("PUT").Path("/expose").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		closedChan := w.(http.CloseNotifier).CloseNotify()
+		r.ParseForm()
+		addrs, err := a.Expose(r.Form["cidr"], r.FormValue("fqdn"), closedChan)
+		reply(w, addrs, err)
+	})
+
+	router.Methods("DELETE").Path("/expose").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		addrs, err := a.Hide(r.Form["cidr"])
+		reply(w, addrs, err)
+	})
+
+	router.Methods("GET").Path("/expose").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		addrs, err := a.Exposed()
+		reply(w, addrs, err)
+	})
+
+	router.Methods("PUT").Path("/publish/{hostport}").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, err := a.Publish(mux.Vars(r)["hostport"], r.FormValue("proto"), r.FormValue("container"), r.FormValue("address"), r.FormValue("port"))
+		if err != nil {
+			replyError(w, err)
+			return
+		}
+		fmt.Fprintln(w, p)
+	})
+
+	router.Methods("DELETE").Path("/publish/{hostport}").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, err := a.Unpublish(mux.Vars(r)["hostport"], r.FormValue("proto"))
+		if err != nil {
+			replyError(w, err)
+			return
+		}
+		fmt.Fprintln(w, p)
+	})
+
+	router.Methods("GET").Path("/publish").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(a.Published())
+	})
+
+	router.Methods("GET").Path("/conflicts").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(a.Conflicts())
+	})
+}
+
+func replyError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	switch err.(type) {
+	case *containerError:
+		status = http.StatusBadRequest
+	case *conflictError:
+		status = http.StatusConflict
+	}
+	http.Error(w, err.Error(), status)
+	Warning.Println("[attach]", err)
+}
+
+func reply(w http.ResponseWriter, addrs []*net.IPNet, err error) {
+	if err != nil {
+		replyError(w, err)
+		return
+	}
+	for _, addr := range addrs {
+		fmt.Fprintln(w, addr)
+	}
+}
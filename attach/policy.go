@@ -0,0 +1,108 @@
+package attach
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/fsouza/go-dockerclient"
+	. "github.com/weaveworks/weave/common"
+)
+
+const (
+	DefaultPolicyLabel = "weave"
+
+	// Values of the policy label with special meanings; any other
+	// value gives the container's addresses, as in WEAVE_CIDR
+	LabelOn  = "on"  // attach with an address from the allocator
+	LabelOff = "off" // don't attach
+)
+
+// Policy decides, from a container's labels, whether to attach it to
+// the weave network and with which addresses: either only containers
+// carrying the label are, or all containers are unless it says "off".
+type Policy struct {
+	Label string
+	All   bool
+}
+
+// ParsePolicy makes a policy from its name, "labelled" or "all", and
+// the label it looks at.
+func ParsePolicy(name, label string) (*Policy, error) {
+	switch name {
+	case "labelled", "labeled":
+		return &Policy{Label: label}, nil
+	case "all":
+		return &Policy{Label: label, All: true}, nil
+	}
+	return nil, fmt.Errorf("Unknown attach policy %q; expected \"labelled\" or \"all\"", name)
+}
+
+// CIDRs says whether a container with labels should be attached, and
+// with which addresses; none means one from the allocator.
+func (p *Policy) CIDRs(labels map[string]string) ([]string, bool) {
+	value, found := labels[p.Label]
+	switch {
+	case !found:
+		return nil, p.All
+	case value == LabelOff:
+		return nil, false
+	case value == LabelOn || value == "":
+		return nil, true
+	}
+	return strings.Fields(value), true
+}
+
+func (p *Policy) String() string {
+	if p.All {
+		return fmt.Sprintf("all containers unless labelled %s=%s", p.Label, LabelOff)
+	}
+	return fmt.Sprintf("containers labelled %s", p.Label)
+}
+
+// AutoAttacher is a ContainerObserver for the updater, attaching
+// containers as they start according to a policy.
+type AutoAttacher struct {
+	attacher *Attacher
+	policy   *Policy
+}
+
+func NewAutoAttacher(attacher *Attacher, policy *Policy) *AutoAttacher {
+	return &AutoAttacher{attacher: attacher, policy: policy}
+}
+
+func (aa *AutoAttacher) ContainerStarted(ident string) {
+	container, err := aa.attacher.client.InspectContainer(ident)
+	if err != nil {
+		Warning.Printf("[attach] Unable to inspect container %s: %s", ident, err)
+		return
+	}
+	if !sharesNetwork(container.HostConfig) {
+		if cidrs, ok := aa.policy.CIDRs(container.Config.Labels); ok {
+			// there is nobody to cancel allocation, if it blocks
+			go func() {
+				if _, err := aa.attacher.Attach(container.ID, "", cidrs, nil); err != nil {
+					Warning.Printf("[attach] Unable to attach container %s: %s", container.ID, err)
+				}
+				aa.attacher.ContainerStarted(container.ID)
+			}()
+			return
+		}
+	}
+	aa.attacher.ContainerStarted(container.ID)
+}
+
+// A container's interface goes with it, so there is nothing more for
+// us to do when it dies than for the attacher itself.
+func (aa *AutoAttacher) ContainerDied(ident string) error {
+	return aa.attacher.ContainerDied(ident)
+}
+
+func (aa *AutoAttacher) ContainerDestroyed(ident string) error {
+	return aa.attacher.ContainerDestroyed(ident)
+}
+
+// Containers sharing the host's or another container's network get
+// that network's interfaces, so there is nothing to attach
+func sharesNetwork(hostConfig *docker.HostConfig) bool {
+	return hostConfig != nil && (hostConfig.NetworkMode == "host" || strings.HasPrefix(hostConfig.NetworkMode, "container:"))
+}
@@ -0,0 +1,30 @@
+package attach
+
+import (
+	"testing"
+
+	wt "github.com/weaveworks/weave/testing"
+)
+
+func TestPolicy(t *testing.T) {
+	check := func(policy *Policy, labels map[string]string, wantCIDRs []string, wantOK bool, desc string) {
+		cidrs, ok := policy.CIDRs(labels)
+		wt.AssertTrue(t, ok == wantOK, desc)
+		wt.AssertEquals(t, cidrs, wantCIDRs)
+	}
+
+	labelled, err := ParsePolicy("labelled", "weave")
+	wt.AssertNoErr(t, err)
+	check(labelled, nil, nil, false, "unlabelled")
+	check(labelled, map[string]string{"weave": "on"}, nil, true, "on")
+	check(labelled, map[string]string{"weave": "off"}, nil, false, "off")
+	check(labelled, map[string]string{"weave": "10.2.1.1/24 10.2.2.1/24"}, []string{"10.2.1.1/24", "10.2.2.1/24"}, true, "addresses")
+
+	all, err := ParsePolicy("all", "weave")
+	wt.AssertNoErr(t, err)
+	check(all, map[string]string{"other": "off"}, nil, true, "unlabelled")
+	check(all, map[string]string{"weave": "off"}, nil, false, "off")
+
+	_, err = ParsePolicy("some", "weave")
+	wt.AssertTrue(t, err != nil, "unknown policy")
+}
@@ -0,0 +1,296 @@
+package attach
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"time"
+
+	. "github.com/weaveworks/weave/common"
+	weavenet "github.com/weaveworks/weave/net"
+)
+
+// The nat chain holding the rules that send connections to published
+// ports on to their destinations; it is ours alone, so we can clear
+// it out when we start.
+const publishChain = "WEAVE-PUBLISH"
+
+// Publication makes a port on the weave network, of a container on
+// this host or of any address, reachable on a port of the host, as
+// described under "Service export" in the docs. A container's address
+// is looked up afresh whenever it may have changed; Address is blank
+// while the container has none.
+type Publication struct {
+	HostPort  int
+	Protocol  string
+	Container string `json:",omitempty"`
+	Address   string
+	Port      int
+}
+
+func (p *Publication) key() string {
+	return fmt.Sprintf("%d/%s", p.HostPort, p.Protocol)
+}
+
+func (p *Publication) String() string {
+	target := p.Address
+	if p.Container != "" {
+		target = fmt.Sprintf("%.12s(%s)", p.Container, p.Address)
+	}
+	return fmt.Sprintf("%s -> %s:%d", p.key(), target, p.Port)
+}
+
+// Connections to the host port arriving from elsewhere are sent on to
+// the destination, and appear to come from the host, so that replies
+// come back through it.
+func (a *Attacher) publicationRules(p *Publication) (dnat, snat []string) {
+	hostPort, port := strconv.Itoa(p.HostPort), strconv.Itoa(p.Port)
+	dnat = []string{"-p", p.Protocol, "--dport", hostPort, "-j", "DNAT", "--to-destination", net.JoinHostPort(p.Address, port)}
+	snat = []string{"-o", a.bridge, "-p", p.Protocol, "-d", p.Address, "--dport", port, "-m", "conntrack", "--ctstate", "DNAT", "-j", "MASQUERADE"}
+	return
+}
+
+func (a *Attacher) addPublicationRules(p *Publication) error {
+	if err := a.ensureChains(); err != nil {
+		return err
+	}
+	dnat, snat := a.publicationRules(p)
+	return a.rules.Set("publish:"+p.key(),
+		weavenet.IPTablesRule{Table: "nat", Chain: publishChain, Spec: dnat},
+		weavenet.IPTablesRule{Table: "nat", Chain: "WEAVE", Spec: snat})
+}
+
+func (a *Attacher) deletePublicationRules(p *Publication) error {
+	return a.rules.Remove("publish:" + p.key())
+}
+
+// The chains for exposing and publishing
+func (a *Attacher) ensureChains() error {
+	if err := a.rules.Chain("nat", publishChain, "PREROUTING", "-m", "addrtype", "--dst-type", "LOCAL"); err != nil {
+		return err
+	}
+	return a.rules.Chain("nat", "WEAVE", "POSTROUTING")
+}
+
+// The address on the default network of the container with ID, or
+// name, id, along with its full ID
+func (a *Attacher) containerAddress(id string) (string, net.IP, error) {
+	container, nsPath, err := a.runningContainer(id)
+	if err != nil {
+		return "", nil, err
+	}
+	ifaces, err := weavenet.ContainerInterfaces(nsPath, ContainerIfName)
+	if err != nil {
+		return "", nil, err
+	}
+	for _, iface := range ifaces {
+		if iface.Name == ContainerIfName && len(iface.Addrs) > 0 {
+			return container.ID, iface.Addrs[0].IP, nil
+		}
+	}
+	return "", nil, &containerError{fmt.Sprintf("Container %s is not attached to the weave network", id)}
+}
+
+func parsePort(port, what string) (int, error) {
+	n, err := strconv.Atoi(port)
+	if err != nil || n < 1 || n > 65535 {
+		return 0, &containerError{fmt.Sprintf("Invalid %s %q", what, port)}
+	}
+	return n, nil
+}
+
+func parseProtocol(protocol string) (string, error) {
+	switch protocol {
+	case "":
+		return "tcp", nil
+	case "tcp", "udp":
+		return protocol, nil
+	}
+	return "", &containerError{fmt.Sprintf("Invalid protocol %q: expected tcp or udp", protocol)}
+}
+
+// Publish makes port, or hostPort if blank, of the container with ID,
+// or name, container, or else of address, reachable on hostPort of
+// the host, over protocol, "tcp" if blank, or "udp".
+func (a *Attacher) Publish(hostPort, protocol, container, address, port string) (*Publication, error) {
+	p := &Publication{}
+	var err error
+	if p.HostPort, err = parsePort(hostPort, "host port"); err != nil {
+		return nil, err
+	}
+	if port == "" {
+		port = hostPort
+	}
+	if p.Port, err = parsePort(port, "port"); err != nil {
+		return nil, err
+	}
+	if p.Protocol, err = parseProtocol(protocol); err != nil {
+		return nil, err
+	}
+	switch {
+	case container != "" && address != "":
+		return nil, &containerError{"Give a container or an address to publish, not both"}
+	case container != "":
+		var ip net.IP
+		if p.Container, ip, err = a.containerAddress(container); err != nil {
+			return nil, err
+		}
+		p.Address = ip.String()
+	default:
+		ip := net.ParseIP(address)
+		if ip == nil || ip.To4() == nil {
+			return nil, &containerError{fmt.Sprintf("Invalid IP %q", address)}
+		}
+		p.Address = ip.String()
+	}
+
+	a.Lock()
+	defer a.Unlock()
+	if existing, found := a.published[p.key()]; found {
+		return nil, &containerError{fmt.Sprintf("Host port %s is already published, to %s", p.key(), existing.Address)}
+	}
+	if err := a.addPublicationRules(p); err != nil {
+		return nil, err
+	}
+	a.published[p.key()] = p
+	Info.Printf("[attach] Published %s", p)
+	return p, nil
+}
+
+// Unpublish undoes Publish for hostPort over protocol, "tcp" if blank,
+// or "udp".
+func (a *Attacher) Unpublish(hostPort, protocol string) (*Publication, error) {
+	p := &Publication{}
+	var err error
+	if p.HostPort, err = parsePort(hostPort, "host port"); err != nil {
+		return nil, err
+	}
+	if p.Protocol, err = parseProtocol(protocol); err != nil {
+		return nil, err
+	}
+	key := p.key()
+	a.Lock()
+	defer a.Unlock()
+	p, found := a.published[key]
+	if !found {
+		return nil, &containerError{fmt.Sprintf("Host port %s is not published", key)}
+	}
+	if p.Address != "" {
+		if err := a.deletePublicationRules(p); err != nil {
+			return nil, err
+		}
+	}
+	delete(a.published, key)
+	Info.Printf("[attach] Unpublished %s", p)
+	return p, nil
+}
+
+// Published lists our publications, in order of host port
+func (a *Attacher) Published() []Publication {
+	a.Lock()
+	defer a.Unlock()
+	published := make([]Publication, 0, len(a.published))
+	for _, p := range a.published {
+		published = append(published, *p)
+	}
+	sort.Sort(byHostPort(published))
+	return published
+}
+
+type byHostPort []Publication
+
+func (ps byHostPort) Len() int      { return len(ps) }
+func (ps byHostPort) Swap(i, j int) { ps[i], ps[j] = ps[j], ps[i] }
+func (ps byHostPort) Less(i, j int) bool {
+	if ps[i].HostPort != ps[j].HostPort {
+		return ps[i].HostPort < ps[j].HostPort
+	}
+	return ps[i].Protocol < ps[j].Protocol
+}
+
+// StartPublishing clears out any rules left behind by a previous run,
+// other than those for the addresses still exposed, then follows
+// containers to their current addresses every interval, and has the
+// rules for both put back, if deleted behind our back, or cleared out
+// if stale, as often.
+func (a *Attacher) StartPublishing(interval time.Duration) {
+	weavenet.WithNetNSPath(a.hostNetNSPath(), func() error {
+		// fails harmlessly if the chain does not exist
+		weavenet.FlushIPTablesChain("nat", publishChain)
+		return nil
+	})
+	keepExposed := weavenet.LabelsAddresses(a.bridge)
+	if !keepExposed {
+		Warning.Printf("[attach] Not keeping the rules for exposed addresses, since the name of %s is too long for us to tell which of its addresses we added", a.bridge)
+	} else if err := a.keepExposed(); err != nil {
+		Warning.Printf("[attach] Unable to keep the rules for exposed addresses: %s", err)
+	}
+	if _, err := a.rules.Reconcile(); err != nil {
+		Warning.Printf("[attach] Unable to clear out stale iptables rules: %s", err)
+	}
+	go func() {
+		for range time.Tick(interval) {
+			a.reconcilePublications("")
+			if !keepExposed {
+				continue
+			}
+			if err := a.keepExposed(); err != nil {
+				Warning.Printf("[attach] Unable to keep the rules for exposed addresses: %s", err)
+			}
+		}
+	}()
+	a.rules.Start(interval, func(repairs []string, err error) {
+		for _, repair := range repairs {
+			Info.Printf("[attach] iptables: %s", repair)
+		}
+		if err != nil {
+			Warning.Printf("[attach] Unable to reconcile iptables rules: %s", err)
+		}
+	})
+}
+
+// Bring the rules of publications to the container with ID ident, or
+// to any container or address if ident is blank, into line with where
+// they should now go.
+func (a *Attacher) reconcilePublications(ident string) {
+	a.Lock()
+	defer a.Unlock()
+	for _, p := range a.published {
+		if ident != "" && p.Container != ident {
+			continue
+		}
+		if p.Container != "" {
+			address := ""
+			if _, ip, err := a.containerAddress(p.Container); err == nil {
+				address = ip.String()
+			}
+			if address != p.Address && p.Address != "" {
+				if err := a.deletePublicationRules(p); err != nil {
+					Warning.Printf("[attach] Unable to remove rules for %s: %s", p, err)
+				}
+			}
+			p.Address = address
+		}
+		if p.Address != "" {
+			if err := a.addPublicationRules(p); err != nil {
+				Warning.Printf("[attach] Unable to add rules for %s: %s", p, err)
+			}
+		}
+	}
+}
+
+// Publications to a container go with it
+func (a *Attacher) unpublishContainer(ident string) {
+	a.Lock()
+	defer a.Unlock()
+	for key, p := range a.published {
+		if p.Container == ident {
+			if p.Address != "" {
+				a.deletePublicationRules(p)
+			}
+			delete(a.published, key)
+			Info.Printf("[attach] Unpublished %s, the container having gone", p)
+		}
+	}
+}
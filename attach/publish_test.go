@@ -0,0 +1,48 @@
+package attach
+
+import (
+	"testing"
+
+	wt "github.com/weaveworks/weave/testing"
+)
+
+func TestPublicationRules(t *testing.T) {
+	a := &Attacher{bridge: "weave"}
+	p := &Publication{HostPort: 2211, Protocol: "tcp", Address: "10.2.1.1", Port: 4422}
+	dnat, snat := a.publicationRules(p)
+	wt.AssertEquals(t, dnat, []string{"-p", "tcp", "--dport", "2211", "-j", "DNAT", "--to-destination", "10.2.1.1:4422"})
+	wt.AssertEquals(t, snat, []string{"-o", "weave", "-p", "tcp", "-d", "10.2.1.1", "--dport", "4422", "-m", "conntrack", "--ctstate", "DNAT", "-j", "MASQUERADE"})
+	wt.AssertEqualString(t, p.String(), "2211/tcp -> 10.2.1.1:4422", "publication")
+}
+
+func TestPublishBadRequests(t *testing.T) {
+	a := &Attacher{bridge: "weave", published: make(map[string]*Publication)}
+	for _, args := range [][]string{
+		{"0", "", "", "10.2.1.1", ""},
+		{"2211", "", "", "10.2.1.1", "65536"},
+		{"2211", "sctp", "", "10.2.1.1", ""},
+		{"2211", "", "", "10.2.1", ""},
+		{"2211", "", "foo", "10.2.1.1", ""},
+	} {
+		_, err := a.Publish(args[0], args[1], args[2], args[3], args[4])
+		wt.AssertErrorType(t, err, (**containerError)(nil), "bad request")
+	}
+	_, err := a.Unpublish("2211", "udp")
+	wt.AssertErrorType(t, err, (**containerError)(nil), "not published")
+}
+
+func TestPublishedOrder(t *testing.T) {
+	a := &Attacher{published: make(map[string]*Publication)}
+	for _, p := range []*Publication{
+		{HostPort: 8080, Protocol: "tcp"},
+		{HostPort: 53, Protocol: "udp"},
+		{HostPort: 53, Protocol: "tcp"},
+	} {
+		a.published[p.key()] = p
+	}
+	published := a.Published()
+	wt.AssertEqualInt(t, len(published), 3, "publications")
+	wt.AssertEqualString(t, published[0].key(), "53/tcp", "first")
+	wt.AssertEqualString(t, published[1].key(), "53/udp", "second")
+	wt.AssertEqualString(t, published[2].key(), "8080/tcp", "third")
+}
@@ -0,0 +1,225 @@
+package bgp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+)
+
+// BGP-4, as in RFC 4271, with four-octet AS numbers, as in RFC 6793
+const (
+	version     = 4
+	headerLen   = 19
+	maxMessage  = 4096
+	asTrans     = 23456 // stands in for four-octet AS numbers in two-octet fields
+	holdTime    = 90    // seconds, that we propose
+	minHoldTime = 3     // seconds, the least we accept other than none
+	originIGP   = 0
+	asSequence  = 2
+	localPref   = 100
+	attrTransit = 0x40
+
+	msgOpen         = 1
+	msgUpdate       = 2
+	msgNotification = 3
+	msgKeepalive    = 4
+
+	attrOrigin    = 1
+	attrASPath    = 2
+	attrNextHop   = 3
+	attrLocalPref = 5
+
+	paramCapabilities = 2
+	capMultiprotocol  = 1
+	capFourOctetAS    = 65
+	afiIPv4           = 1
+	safiUnicast       = 1
+
+	errOpenMessage = 2
+	errHoldTimer   = 4
+	errCease       = 6
+
+	subcodeBadPeerAS     = 2
+	subcodeBadHoldTime   = 6
+	subcodeAdminShutdown = 2
+)
+
+type header struct {
+	Marker [16]byte
+	Length uint16
+	Type   uint8
+}
+
+type open struct {
+	Version  uint8
+	AS       uint16
+	HoldTime uint16
+	ID       [4]byte
+}
+
+// An OPEN message, as sent or received
+type openMessage struct {
+	as          uint32 // four-octet if given as a capability
+	holdTime    uint16
+	id          net.IP
+	fourOctetAS bool
+}
+
+func writeMessage(w io.Writer, kind uint8, body []byte) error {
+	if headerLen+len(body) > maxMessage {
+		return fmt.Errorf("BGP message of %d bytes is too long", headerLen+len(body))
+	}
+	var buf bytes.Buffer
+	h := header{Length: uint16(headerLen + len(body)), Type: kind}
+	for i := range h.Marker {
+		h.Marker[i] = 0xff
+	}
+	binary.Write(&buf, binary.BigEndian, h)
+	buf.Write(body)
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+func readMessage(r io.Reader) (uint8, []byte, error) {
+	var h header
+	if err := binary.Read(r, binary.BigEndian, &h); err != nil {
+		return 0, nil, err
+	}
+	if h.Length < headerLen || h.Length > maxMessage {
+		return 0, nil, fmt.Errorf("BGP message with bad length %d", h.Length)
+	}
+	body := make([]byte, h.Length-headerLen)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, nil, err
+	}
+	return h.Type, body, nil
+}
+
+func (m openMessage) encode() []byte {
+	var buf bytes.Buffer
+	as := uint16(asTrans)
+	if m.as <= 0xffff {
+		as = uint16(m.as)
+	}
+	o := open{Version: version, AS: as, HoldTime: m.holdTime}
+	copy(o.ID[:], m.id.To4())
+	binary.Write(&buf, binary.BigEndian, o)
+	caps := []byte{
+		capMultiprotocol, 4, 0, afiIPv4, 0, safiUnicast,
+		capFourOctetAS, 4, 0, 0, 0, 0,
+	}
+	binary.BigEndian.PutUint32(caps[8:], m.as)
+	buf.WriteByte(byte(2 + len(caps)))
+	buf.WriteByte(paramCapabilities)
+	buf.WriteByte(byte(len(caps)))
+	buf.Write(caps)
+	return buf.Bytes()
+}
+
+func decodeOpen(body []byte) (openMessage, error) {
+	var m openMessage
+	var o open
+	r := bytes.NewReader(body)
+	if err := binary.Read(r, binary.BigEndian, &o); err != nil {
+		return m, fmt.Errorf("Short BGP OPEN message")
+	}
+	if o.Version != version {
+		return m, fmt.Errorf("Unsupported BGP version %d", o.Version)
+	}
+	m.as, m.holdTime, m.id = uint32(o.AS), o.HoldTime, net.IP(o.ID[:])
+	paramsLen, err := r.ReadByte()
+	if err != nil || int(paramsLen) != r.Len() {
+		return m, fmt.Errorf("BGP OPEN message with bad parameters length")
+	}
+	params := body[len(body)-r.Len():]
+	for len(params) >= 2 {
+		kind, length := params[0], int(params[1])
+		if len(params) < 2+length {
+			return m, fmt.Errorf("BGP OPEN message with truncated parameter")
+		}
+		caps := params[2 : 2+length]
+		params = params[2+length:]
+		if kind != paramCapabilities {
+			continue
+		}
+		for len(caps) >= 2 {
+			code, capLen := caps[0], int(caps[1])
+			if len(caps) < 2+capLen {
+				return m, fmt.Errorf("BGP OPEN message with truncated capability")
+			}
+			if code == capFourOctetAS && capLen == 4 {
+				m.as, m.fourOctetAS = binary.BigEndian.Uint32(caps[2:]), true
+			}
+			caps = caps[2+capLen:]
+		}
+	}
+	return m, nil
+}
+
+func notification(code, subcode uint8) []byte {
+	return []byte{code, subcode}
+}
+
+// Append prefixes, as NLRI, to buf
+func appendPrefixes(buf *bytes.Buffer, prefixes []*net.IPNet) {
+	for _, prefix := range prefixes {
+		ones, _ := prefix.Mask.Size()
+		buf.WriteByte(byte(ones))
+		buf.Write(prefix.IP.To4()[:(ones+7)/8])
+	}
+}
+
+// The most prefixes that fit in an UPDATE message, with room for the
+// path attributes
+const maxPrefixesPerUpdate = (maxMessage - headerLen - 4 - 64) / 5
+
+// An UPDATE message withdrawing prefixes
+func withdrawal(prefixes []*net.IPNet) []byte {
+	var withdrawn bytes.Buffer
+	appendPrefixes(&withdrawn, prefixes)
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, uint16(withdrawn.Len()))
+	buf.Write(withdrawn.Bytes())
+	binary.Write(&buf, binary.BigEndian, uint16(0))
+	return buf.Bytes()
+}
+
+// An UPDATE message announcing prefixes, via nextHop, as originated by
+// as, to a peer in peerAS
+func announcement(prefixes []*net.IPNet, nextHop net.IP, as, peerAS uint32, fourOctetAS bool) []byte {
+	var attrs bytes.Buffer
+	attr := func(flags, kind uint8, value []byte) {
+		attrs.Write([]byte{flags, kind, byte(len(value))})
+		attrs.Write(value)
+	}
+	attr(attrTransit, attrOrigin, []byte{originIGP})
+	if as == peerAS {
+		// a peer in our own AS is told an empty path, and our preference
+		attr(attrTransit, attrASPath, nil)
+		pref := make([]byte, 4)
+		binary.BigEndian.PutUint32(pref, localPref)
+		attr(attrTransit, attrLocalPref, pref)
+	} else if fourOctetAS {
+		path := []byte{asSequence, 1, 0, 0, 0, 0}
+		binary.BigEndian.PutUint32(path[2:], as)
+		attr(attrTransit, attrASPath, path)
+	} else {
+		path := []byte{asSequence, 1, 0, 0}
+		short := uint16(asTrans)
+		if as <= 0xffff {
+			short = uint16(as)
+		}
+		binary.BigEndian.PutUint16(path[2:], short)
+		attr(attrTransit, attrASPath, path)
+	}
+	attr(attrTransit, attrNextHop, nextHop.To4())
+
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, uint16(0))
+	binary.Write(&buf, binary.BigEndian, uint16(attrs.Len()))
+	buf.Write(attrs.Bytes())
+	appendPrefixes(&buf, prefixes)
+	return buf.Bytes()
+}
@@ -0,0 +1,359 @@
+// Package bgp advertises the weave network's prefixes to routers in
+// the datacenter, over BGP, so that hosts that aren't on the weave
+// network can route straight to containers, where the fabric allows.
+// It only speaks: routes the routers tell it of are ignored.
+package bgp
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/weaveworks/weave/common"
+	weavenet "github.com/weaveworks/weave/net"
+)
+
+const (
+	Port = 179
+	// How long we wait for a neighbour to accept a connection, and for
+	// its OPEN and KEEPALIVE once it has
+	connectTimeout = 10 * time.Second
+	// How long we wait before connecting to a neighbour again after
+	// losing the session
+	retryInterval = 30 * time.Second
+)
+
+// Neighbour is a router we advertise prefixes to
+type Neighbour struct {
+	Addr string // <host>:<port>
+	AS   uint32
+}
+
+func (n Neighbour) String() string {
+	return fmt.Sprintf("%s (AS %d)", n.Addr, n.AS)
+}
+
+// ParseNeighbours parses the routers, as <host>[:<port>], to advertise
+// to, all in as
+func ParseNeighbours(descs []string, as uint32) ([]Neighbour, error) {
+	var neighbours []Neighbour
+	for _, desc := range descs {
+		desc = strings.TrimSpace(desc)
+		if desc == "" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(desc); err != nil {
+			desc = net.JoinHostPort(desc, strconv.Itoa(Port))
+		}
+		neighbours = append(neighbours, Neighbour{Addr: desc, AS: as})
+	}
+	if len(neighbours) == 0 {
+		return nil, fmt.Errorf("No BGP neighbours given")
+	}
+	return neighbours, nil
+}
+
+// Speaker keeps a session with each neighbour, announcing the prefixes
+// it is given, and withdrawing those it no longer is, next hop being
+// our address on the session. Stopping it closes the sessions, so the
+// neighbours withdraw the routes.
+type Speaker struct {
+	sync.Mutex
+	as         uint32
+	neighbours []Neighbour
+	nsPath     string // of the network namespace we connect from; ours if blank
+	prefixes   []*net.IPNet
+	changed    chan struct{} // closed, and replaced, when prefixes change
+	stop       chan struct{}
+	done       sync.WaitGroup
+}
+
+// NewSpeaker makes a speaker in as, advertising to neighbours, which
+// it connects to from the network namespace at nsPath, or its own if
+// blank. A router in a container should connect from the host's, so
+// that the next hop it gives is the host's address, which the
+// neighbours can reach, and not the container's.
+func NewSpeaker(as uint32, neighbours []Neighbour, nsPath string) *Speaker {
+	return &Speaker{as: as, neighbours: neighbours, nsPath: nsPath, changed: make(chan struct{}), stop: make(chan struct{})}
+}
+
+// Start connects to the neighbours, and keeps connecting to them
+func (s *Speaker) Start() {
+	for _, n := range s.neighbours {
+		s.done.Add(1)
+		go s.keepSession(n)
+	}
+}
+
+// Stop ends the sessions, with a notification that we are shutting
+// down
+func (s *Speaker) Stop() {
+	close(s.stop)
+	s.done.Wait()
+}
+
+// Advertise has the speaker announce prefixes, and only those, to its
+// neighbours
+func (s *Speaker) Advertise(prefixes []*net.IPNet) {
+	keyed := keyPrefixes(prefixes)
+	s.Lock()
+	defer s.Unlock()
+	if samePrefixes(keyed, keyPrefixes(s.prefixes)) {
+		return
+	}
+	s.prefixes = make([]*net.IPNet, 0, len(keyed))
+	for _, prefix := range keyed {
+		s.prefixes = append(s.prefixes, prefix)
+	}
+	sort.Sort(byPrefix(s.prefixes))
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// The prefixes to advertise, and what will tell us they have changed
+func (s *Speaker) current() ([]*net.IPNet, <-chan struct{}) {
+	s.Lock()
+	defer s.Unlock()
+	return s.prefixes, s.changed
+}
+
+func (s *Speaker) keepSession(n Neighbour) {
+	defer s.done.Done()
+	for {
+		err := s.session(n)
+		select {
+		case <-s.stop:
+			return
+		default:
+		}
+		Warning.Printf("[bgp] Session with %s ended: %s", n, err)
+		select {
+		case <-time.After(retryInterval):
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// Connect to n, in our namespace; the socket stays in it
+func (s *Speaker) dial(n Neighbour) (net.Conn, error) {
+	var conn net.Conn
+	err := weavenet.WithNetNSPath(s.nsPath, func() error {
+		var err error
+		conn, err = net.DialTimeout("tcp", n.Addr, connectTimeout)
+		return err
+	})
+	return conn, err
+}
+
+// Run a session with n until it fails, or we are stopped
+func (s *Speaker) session(n Neighbour) error {
+	conn, err := s.dial(n)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	local := conn.LocalAddr().(*net.TCPAddr).IP.To4()
+	if local == nil {
+		return fmt.Errorf("only IPv4 sessions are supported")
+	}
+
+	conn.SetDeadline(time.Now().Add(connectTimeout))
+	if err := writeMessage(conn, msgOpen, openMessage{as: s.as, holdTime: holdTime, id: local}.encode()); err != nil {
+		return err
+	}
+	body, err := expect(conn, msgOpen)
+	if err != nil {
+		return err
+	}
+	theirs, err := decodeOpen(body)
+	if err != nil {
+		writeMessage(conn, msgNotification, notification(errOpenMessage, 0))
+		return err
+	}
+	if theirs.as != n.AS {
+		writeMessage(conn, msgNotification, notification(errOpenMessage, subcodeBadPeerAS))
+		return fmt.Errorf("neighbour is in AS %d", theirs.as)
+	}
+	hold := theirs.holdTime
+	if hold > holdTime {
+		hold = holdTime
+	}
+	if hold > 0 && hold < minHoldTime {
+		writeMessage(conn, msgNotification, notification(errOpenMessage, subcodeBadHoldTime))
+		return fmt.Errorf("neighbour proposed hold time of %ds", hold)
+	}
+	if err := writeMessage(conn, msgKeepalive, nil); err != nil {
+		return err
+	}
+	if _, err := expect(conn, msgKeepalive); err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Time{})
+	Info.Printf("[bgp] Session with %s established, as %s", n, local)
+
+	holdFor := time.Duration(hold) * time.Second
+	received := make(chan error, 1)
+	go func() {
+		for {
+			if holdFor > 0 {
+				conn.SetReadDeadline(time.Now().Add(holdFor))
+			}
+			kind, body, err := readMessage(conn)
+			switch {
+			case err != nil:
+				if ne, ok := err.(net.Error); ok && ne.Timeout() {
+					writeMessage(conn, msgNotification, notification(errHoldTimer, 0))
+					err = fmt.Errorf("hold timer expired")
+				}
+			case kind == msgNotification:
+				err = notificationError(body)
+			default:
+				// keepalives, and updates, which we ignore, keep the
+				// session alive
+				continue
+			}
+			received <- err
+			return
+		}
+	}()
+
+	var keepalives <-chan time.Time
+	if holdFor > 0 {
+		ticker := time.NewTicker(holdFor / 3)
+		defer ticker.Stop()
+		keepalives = ticker.C
+	}
+	advertised := make(map[string]*net.IPNet)
+	for {
+		prefixes, changed := s.current()
+		if err := s.update(conn, advertised, prefixes, local, n.AS, theirs.fourOctetAS); err != nil {
+			return err
+		}
+		select {
+		case <-changed:
+		case <-keepalives:
+			if err := writeMessage(conn, msgKeepalive, nil); err != nil {
+				return err
+			}
+		case err := <-received:
+			return err
+		case <-s.stop:
+			writeMessage(conn, msgNotification, notification(errCease, subcodeAdminShutdown))
+			Info.Printf("[bgp] Closed session with %s", n)
+			return nil
+		}
+	}
+}
+
+// Read a message, which must be of kind
+func expect(conn net.Conn, kind uint8) ([]byte, error) {
+	got, body, err := readMessage(conn)
+	switch {
+	case err != nil:
+		return nil, err
+	case got == msgNotification:
+		return nil, notificationError(body)
+	case got != kind:
+		return nil, fmt.Errorf("expected BGP message of type %d, got %d", kind, got)
+	}
+	return body, nil
+}
+
+func notificationError(body []byte) error {
+	if len(body) < 2 {
+		return fmt.Errorf("neighbour sent a notification")
+	}
+	return fmt.Errorf("neighbour sent notification, code %d, subcode %d", body[0], body[1])
+}
+
+// Withdraw the advertised prefixes not in prefixes, and announce those
+// not advertised, noting them in advertised
+func (s *Speaker) update(conn net.Conn, advertised map[string]*net.IPNet, prefixes []*net.IPNet, nextHop net.IP, peerAS uint32, fourOctetAS bool) error {
+	want := keyPrefixes(prefixes)
+	var withdrawn, announced []*net.IPNet
+	for key, prefix := range advertised {
+		if _, found := want[key]; !found {
+			withdrawn = append(withdrawn, prefix)
+		}
+	}
+	for key, prefix := range want {
+		if _, found := advertised[key]; !found {
+			announced = append(announced, prefix)
+		}
+	}
+	sort.Sort(byPrefix(withdrawn))
+	sort.Sort(byPrefix(announced))
+	for _, batch := range batches(withdrawn) {
+		if err := writeMessage(conn, msgUpdate, withdrawal(batch)); err != nil {
+			return err
+		}
+	}
+	for _, batch := range batches(announced) {
+		if err := writeMessage(conn, msgUpdate, announcement(batch, nextHop, s.as, peerAS, fourOctetAS)); err != nil {
+			return err
+		}
+	}
+	for _, prefix := range withdrawn {
+		delete(advertised, prefix.String())
+	}
+	for _, prefix := range announced {
+		advertised[prefix.String()] = prefix
+	}
+	return nil
+}
+
+// Prefixes in batches that fit in an UPDATE message
+func batches(prefixes []*net.IPNet) [][]*net.IPNet {
+	var batches [][]*net.IPNet
+	for len(prefixes) > maxPrefixesPerUpdate {
+		batches = append(batches, prefixes[:maxPrefixesPerUpdate])
+		prefixes = prefixes[maxPrefixesPerUpdate:]
+	}
+	if len(prefixes) > 0 {
+		batches = append(batches, prefixes)
+	}
+	return batches
+}
+
+// IPv4 prefixes, by CIDR, with their host bits cleared
+func keyPrefixes(prefixes []*net.IPNet) map[string]*net.IPNet {
+	keyed := make(map[string]*net.IPNet, len(prefixes))
+	for _, prefix := range prefixes {
+		ip := prefix.IP.To4()
+		if ip == nil {
+			continue
+		}
+		clean := &net.IPNet{IP: ip.Mask(prefix.Mask), Mask: prefix.Mask}
+		keyed[clean.String()] = clean
+	}
+	return keyed
+}
+
+func samePrefixes(a, b map[string]*net.IPNet) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for key := range a {
+		if _, found := b[key]; !found {
+			return false
+		}
+	}
+	return true
+}
+
+type byPrefix []*net.IPNet
+
+func (ps byPrefix) Len() int      { return len(ps) }
+func (ps byPrefix) Swap(i, j int) { ps[i], ps[j] = ps[j], ps[i] }
+func (ps byPrefix) Less(i, j int) bool {
+	if c := bytes.Compare(ps[i].IP.To4(), ps[j].IP.To4()); c != 0 {
+		return c < 0
+	}
+	return bytes.Compare(ps[i].Mask, ps[j].Mask) < 0
+}
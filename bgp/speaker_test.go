@@ -0,0 +1,132 @@
+package bgp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	wt "github.com/weaveworks/weave/testing"
+)
+
+// The prefixes NLRI gives
+func decodePrefixes(nlri []byte) ([]*net.IPNet, error) {
+	var prefixes []*net.IPNet
+	for len(nlri) > 0 {
+		ones := int(nlri[0])
+		n := (ones + 7) / 8
+		if ones > 32 || len(nlri) < 1+n {
+			return nil, fmt.Errorf("bad prefix")
+		}
+		ip := make(net.IP, net.IPv4len)
+		copy(ip, nlri[1:1+n])
+		prefixes = append(prefixes, &net.IPNet{IP: ip, Mask: net.CIDRMask(ones, 32)})
+		nlri = nlri[1+n:]
+	}
+	return prefixes, nil
+}
+
+// The prefixes an UPDATE message withdraws and announces, as CIDRs
+func decodeUpdate(t *testing.T, body []byte) (withdrawn, announced string) {
+	n := int(binary.BigEndian.Uint16(body))
+	w, err := decodePrefixes(body[2 : 2+n])
+	wt.AssertNoErr(t, err)
+	body = body[2+n:]
+	n = int(binary.BigEndian.Uint16(body))
+	a, err := decodePrefixes(body[2+n:])
+	wt.AssertNoErr(t, err)
+	return cidrs(w), cidrs(a)
+}
+
+func cidrs(prefixes []*net.IPNet) string {
+	var ss []string
+	for _, prefix := range prefixes {
+		ss = append(ss, prefix.String())
+	}
+	return strings.Join(ss, " ")
+}
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	var prefixes []*net.IPNet
+	for _, cidr := range cidrs {
+		ip, prefix, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		prefix.IP = ip
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes
+}
+
+// Read messages from conn, answering keepalives, until one of kind
+func expectFrom(t *testing.T, conn net.Conn, kind uint8) []byte {
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		got, body, err := readMessage(conn)
+		wt.AssertNoErr(t, err)
+		if got == kind {
+			return body
+		}
+		wt.AssertTrue(t, got == msgKeepalive, "keepalive or expected message")
+	}
+}
+
+func TestSpeaker(t *testing.T) {
+	listener, err := net.Listen("tcp4", "127.0.0.1:0")
+	wt.AssertNoErr(t, err)
+	defer listener.Close()
+
+	neighbours, err := ParseNeighbours([]string{listener.Addr().String()}, 4200000001)
+	wt.AssertNoErr(t, err)
+	speaker := NewSpeaker(65001, neighbours, "")
+	speaker.Advertise(mustParseCIDRs("10.32.0.0/13", "10.40.1.2/16"))
+	speaker.Start()
+
+	conn, err := listener.Accept()
+	wt.AssertNoErr(t, err)
+	defer conn.Close()
+	ours, err := decodeOpen(expectFrom(t, conn, msgOpen))
+	wt.AssertNoErr(t, err)
+	wt.AssertTrue(t, ours.as == 65001 && ours.holdTime == holdTime && ours.fourOctetAS, "our OPEN")
+	wt.AssertEqualString(t, ours.id.String(), "127.0.0.1", "router ID")
+	wt.AssertNoErr(t, writeMessage(conn, msgOpen, openMessage{as: 4200000001, holdTime: 30, id: net.IPv4(192, 0, 2, 1)}.encode()))
+	wt.AssertNoErr(t, writeMessage(conn, msgKeepalive, nil))
+	expectFrom(t, conn, msgKeepalive)
+
+	withdrawn, announced := decodeUpdate(t, expectFrom(t, conn, msgUpdate))
+	wt.AssertEqualString(t, withdrawn, "", "withdrawn at first")
+	wt.AssertEqualString(t, announced, "10.32.0.0/13 10.40.0.0/16", "announced at first")
+
+	speaker.Advertise(mustParseCIDRs("10.40.0.0/16", "10.48.0.0/12"))
+	withdrawn, announced = decodeUpdate(t, expectFrom(t, conn, msgUpdate))
+	wt.AssertEqualString(t, withdrawn, "10.32.0.0/13", "withdrawn")
+	withdrawn, announced = decodeUpdate(t, expectFrom(t, conn, msgUpdate))
+	wt.AssertEqualString(t, announced, "10.48.0.0/12", "announced")
+
+	speaker.Stop()
+	body := expectFrom(t, conn, msgNotification)
+	wt.AssertTrue(t, body[0] == errCease && body[1] == subcodeAdminShutdown, "shutting down")
+}
+
+func TestSpeakerWrongAS(t *testing.T) {
+	listener, err := net.Listen("tcp4", "127.0.0.1:0")
+	wt.AssertNoErr(t, err)
+	defer listener.Close()
+
+	neighbours, err := ParseNeighbours([]string{listener.Addr().String()}, 65002)
+	wt.AssertNoErr(t, err)
+	speaker := NewSpeaker(65001, neighbours, "")
+	speaker.Start()
+	defer speaker.Stop()
+
+	conn, err := listener.Accept()
+	wt.AssertNoErr(t, err)
+	defer conn.Close()
+	expectFrom(t, conn, msgOpen)
+	wt.AssertNoErr(t, writeMessage(conn, msgOpen, openMessage{as: 65003, holdTime: 30, id: net.IPv4(192, 0, 2, 1)}.encode()))
+	body := expectFrom(t, conn, msgNotification)
+	wt.AssertTrue(t, body[0] == errOpenMessage && body[1] == subcodeBadPeerAS, "bad peer AS")
+}
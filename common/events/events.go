@@ -0,0 +1,92 @@
+/*
+Package events implements a simple publish/subscribe hub for
+structured events (peers joining and leaving, connections coming up
+and going down, addresses being allocated and freed, or found in use
+already), which are streamed to interested clients over HTTP.
+*/
+package events
+
+import (
+	"sync"
+	"time"
+)
+
+// Types of event we publish
+const (
+	PeerJoined            = "peer.joined"
+	PeerLeft              = "peer.left"
+	ConnectionEstablished = "connection.established"
+	ConnectionLost        = "connection.lost"
+	AddressAllocated      = "address.allocated"
+	AddressFreed          = "address.freed"
+	AddressConflict       = "address.conflict"
+	AddressDuplicate      = "address.duplicate"
+)
+
+// How many events we buffer for a subscriber before dropping them
+const subscriberBufferSize = 64
+
+type Event struct {
+	Time   time.Time         `json:"time"`
+	Type   string            `json:"type"`
+	Fields map[string]string `json:"fields,omitempty"`
+}
+
+type Hub struct {
+	sync.Mutex
+	subscribers map[chan Event]struct{}
+	dropped     uint64
+}
+
+func NewHub() *Hub {
+	return &Hub{subscribers: make(map[chan Event]struct{})}
+}
+
+// Publish an event to all subscribers. Never blocks; subscribers that
+// aren't keeping up miss events.
+func (hub *Hub) Publish(eventType string, fields map[string]string) {
+	event := Event{Time: time.Now(), Type: eventType, Fields: fields}
+	hub.Lock()
+	defer hub.Unlock()
+	for ch := range hub.subscribers {
+		select {
+		case ch <- event:
+		default:
+			hub.dropped++
+		}
+	}
+}
+
+func (hub *Hub) Subscribe() <-chan Event {
+	ch := make(chan Event, subscriberBufferSize)
+	hub.Lock()
+	hub.subscribers[ch] = struct{}{}
+	hub.Unlock()
+	return ch
+}
+
+func (hub *Hub) Unsubscribe(ch <-chan Event) {
+	hub.Lock()
+	defer hub.Unlock()
+	for sub := range hub.subscribers {
+		if sub == ch {
+			delete(hub.subscribers, sub)
+			close(sub)
+		}
+	}
+}
+
+// The hub everything publishes to
+var std = NewHub()
+
+func Publish(eventType string, fields map[string]string) {
+	std.Publish(eventType, fields)
+}
+
+func Subscribe() <-chan Event {
+	return std.Subscribe()
+}
+
+func Unsubscribe(ch <-chan Event) {
+	std.Unsubscribe(ch)
+}
@@ -0,0 +1,37 @@
+package events
+
+import (
+	"testing"
+
+	wt "github.com/weaveworks/weave/testing"
+)
+
+func TestPublishSubscribe(t *testing.T) {
+	hub := NewHub()
+	ch1 := hub.Subscribe()
+	ch2 := hub.Subscribe()
+
+	hub.Publish(PeerJoined, map[string]string{"name": "foo"})
+	for _, ch := range []<-chan Event{ch1, ch2} {
+		event := <-ch
+		wt.AssertEqualString(t, event.Type, PeerJoined, "event type")
+		wt.AssertEqualString(t, event.Fields["name"], "foo", "event field")
+	}
+
+	hub.Unsubscribe(ch1)
+	_, ok := <-ch1
+	wt.AssertFalse(t, ok, "receive on unsubscribed channel")
+
+	hub.Publish(PeerLeft, nil)
+	wt.AssertEqualString(t, (<-ch2).Type, PeerLeft, "event type")
+}
+
+func TestSlowSubscriber(t *testing.T) {
+	hub := NewHub()
+	ch := hub.Subscribe()
+	for i := 0; i < subscriberBufferSize+10; i++ {
+		hub.Publish(AddressAllocated, nil)
+	}
+	wt.AssertEqualInt(t, len(ch), subscriberBufferSize, "buffered events")
+	wt.AssertEqualuint64(t, hub.dropped, 10, "dropped events")
+}
@@ -0,0 +1,56 @@
+package events
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// HandleHTTP wires up the event stream endpoint to the provided mux.
+// Events are sent as Server-Sent Events, optionally restricted to
+// those whose type has a given prefix, e.g. /events?type=peer.
+func HandleHTTP(router *mux.Router) {
+	router.Methods("GET").Path("/events").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		std.ServeEvents(w, r)
+	})
+}
+
+func (hub *Hub) ServeEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	prefix := r.FormValue("type")
+	closedChan := w.(http.CloseNotifier).CloseNotify()
+
+	ch := hub.Subscribe()
+	defer hub.Unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case event := <-ch:
+			if !strings.HasPrefix(event.Type, prefix) {
+				continue
+			}
+			data, err := json.Marshal(event)
+			if err != nil {
+				return
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-closedChan:
+			return
+		}
+	}
+}
@@ -0,0 +1,157 @@
+/*
+Package flagfile reads command-line flags from a configuration file, in
+YAML or TOML, so that deployments can keep them there rather than in
+unit files, and from environment variables. The file maps flag names,
+without their dashes, to values, e.g.
+
+	port: 6783
+	iprange: 10.32.0.0/12
+	peers: [host1, host2]
+
+where "peers" gives the arguments that follow the flags. The
+environment variables are named after the flags, e.g. WEAVE_IPRANGE
+and WEAVE_HTTP_RATE for -iprange and -http-rate, and WEAVE_PEERS. Flags
+given on the command line override those in the environment, which
+override those in the file.
+*/
+package flagfile
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+)
+
+// ArgsKey is what the file calls the arguments after the flags
+const ArgsKey = "peers"
+
+// Load reads the values in a configuration file: TOML if its name
+// ends in .toml, otherwise YAML
+func Load(path string) (map[string]interface{}, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[string]interface{})
+	if strings.ToLower(filepath.Ext(path)) == ".toml" {
+		_, err = toml.Decode(string(contents), &values)
+	} else {
+		err = yaml.Unmarshal(contents, &values)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return values, nil
+}
+
+// Apply sets the flags in fs named in values which weren't set on the
+// command line, and returns args, the arguments after the flags on
+// the command line, or, if there are none, those given in values
+// under ArgsKey
+func Apply(fs *flag.FlagSet, values map[string]interface{}, args []string) ([]string, error) {
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names) // so that errors are reported consistently
+	for _, name := range names {
+		value := values[name]
+		if name == ArgsKey {
+			fileArgs, err := stringList(value)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid %s: %s", name, err)
+			}
+			if len(args) == 0 {
+				args = fileArgs
+			}
+			continue
+		}
+		if fs.Lookup(name) == nil {
+			return nil, fmt.Errorf("Unknown flag %q", name)
+		}
+		if set[name] {
+			continue
+		}
+		str, err := flagValue(value)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid value for %s: %s", name, err)
+		}
+		if err := fs.Set(name, str); err != nil {
+			return nil, fmt.Errorf("Invalid value for %s: %s", name, err)
+		}
+	}
+	return args, nil
+}
+
+// EnvName is the environment variable ApplyEnv looks in for a flag
+func EnvName(prefix, name string) string {
+	return prefix + strings.ToUpper(strings.Replace(name, "-", "_", -1))
+}
+
+// ApplyEnv sets the flags in fs, other than those excepted, which
+// weren't set on the command line but are in the environment, as
+// named by EnvName, and returns args, the arguments after the flags
+// on the command line, or, if there are none, those in the
+// environment variable for ArgsKey, separated by spaces or commas
+func ApplyEnv(fs *flag.FlagSet, prefix string, args []string, except ...string) ([]string, error) {
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	for _, name := range except {
+		set[name] = true
+	}
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if value, found := os.LookupEnv(EnvName(prefix, f.Name)); found && !set[f.Name] && err == nil {
+			if setErr := fs.Set(f.Name, value); setErr != nil {
+				err = fmt.Errorf("Invalid value for %s in %s: %s", f.Name, EnvName(prefix, f.Name), setErr)
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if envArgs := os.Getenv(EnvName(prefix, ArgsKey)); len(args) == 0 && envArgs != "" {
+		args = strings.FieldsFunc(envArgs, func(r rune) bool { return r == ' ' || r == ',' })
+	}
+	return args, nil
+}
+
+// The value of a flag as it would appear on the command line; lists
+// are joined with commas, as for e.g. -dns-upstream
+func flagValue(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case bool, int, int64, uint64, float64:
+		return fmt.Sprint(v), nil
+	case []interface{}:
+		strs, err := stringList(v)
+		return strings.Join(strs, ","), err
+	}
+	return "", fmt.Errorf("unexpected %T", value)
+}
+
+func stringList(value interface{}) ([]string, error) {
+	list, ok := value.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("expected a list, got %T", value)
+	}
+	strs := make([]string, len(list))
+	for i, item := range list {
+		switch item.(type) {
+		case []interface{}, map[interface{}]interface{}, map[string]interface{}:
+			return nil, fmt.Errorf("unexpected %T in list", item)
+		}
+		strs[i] = fmt.Sprint(item)
+	}
+	return strs, nil
+}
@@ -0,0 +1,115 @@
+package flagfile
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	wt "github.com/weaveworks/weave/testing"
+)
+
+type flags struct {
+	fs       *flag.FlagSet
+	port     int
+	iprange  string
+	debug    bool
+	timeout  time.Duration
+	upstream string
+}
+
+func newFlags() *flags {
+	f := &flags{fs: flag.NewFlagSet("test", flag.ContinueOnError)}
+	f.fs.IntVar(&f.port, "port", 6783, "")
+	f.fs.StringVar(&f.iprange, "iprange", "", "")
+	f.fs.BoolVar(&f.debug, "debug", false, "")
+	f.fs.DurationVar(&f.timeout, "http-timeout", 30*time.Second, "")
+	f.fs.StringVar(&f.upstream, "dns-upstream", "", "")
+	return f
+}
+
+func writeFile(t *testing.T, dir, name, contents string) string {
+	path := filepath.Join(dir, name)
+	wt.AssertNoErr(t, ioutil.WriteFile(path, []byte(contents), 0600))
+	return path
+}
+
+func TestFlagFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flagfile")
+	wt.AssertNoErr(t, err)
+	defer os.RemoveAll(dir)
+
+	yamlFile := writeFile(t, dir, "weave.yaml", `
+port: 6790
+iprange: 10.32.0.0/12
+debug: true
+http-timeout: 10s
+dns-upstream: [8.8.8.8, 8.8.4.4]
+peers: [host1, host2]
+`)
+	tomlFile := writeFile(t, dir, "weave.toml", `
+port = 6790
+iprange = "10.32.0.0/12"
+peers = ["host1", "host2"]
+`)
+	for _, path := range []string{yamlFile, tomlFile} {
+		f := newFlags()
+		wt.AssertNoErr(t, f.fs.Parse([]string{"-iprange", "10.0.0.0/8"}))
+		values, err := Load(path)
+		wt.AssertNoErr(t, err)
+		args, err := Apply(f.fs, values, f.fs.Args())
+		wt.AssertNoErr(t, err)
+		wt.AssertEqualInt(t, f.port, 6790, path+": port from file")
+		wt.AssertEqualString(t, f.iprange, "10.0.0.0/8", path+": command line overrides file")
+		wt.AssertEquals(t, args, []string{"host1", "host2"})
+	}
+
+	f := newFlags()
+	f.fs.Parse([]string{"host3"})
+	values, err := Load(yamlFile)
+	wt.AssertNoErr(t, err)
+	args, err := Apply(f.fs, values, f.fs.Args())
+	wt.AssertNoErr(t, err)
+	wt.AssertTrue(t, f.debug, "debug")
+	wt.AssertTrue(t, f.timeout == 10*time.Second, "duration")
+	wt.AssertEqualString(t, f.upstream, "8.8.8.8,8.8.4.4", "list")
+	wt.AssertEquals(t, args, []string{"host3"})
+
+	_, err = Apply(newFlags().fs, map[string]interface{}{"nosuchflag": 1}, nil)
+	wt.AssertTrue(t, err != nil, "unknown flag")
+	_, err = Apply(newFlags().fs, map[string]interface{}{"port": "many"}, nil)
+	wt.AssertTrue(t, err != nil, "invalid value")
+	_, err = Load(writeFile(t, dir, "bad.yaml", "port: [\n"))
+	wt.AssertTrue(t, err != nil, "invalid YAML")
+}
+
+func TestApplyEnv(t *testing.T) {
+	f := newFlags()
+	f.fs.Parse([]string{"-port", "7000"})
+	os.Setenv("TEST_PORT", "8000")
+	os.Setenv("TEST_HTTP_TIMEOUT", "5s")
+	os.Setenv("TEST_DEBUG", "true")
+	os.Setenv("TEST_PEERS", "host1, host2")
+	defer func() {
+		for _, name := range []string{"PORT", "HTTP_TIMEOUT", "DEBUG", "PEERS"} {
+			os.Unsetenv("TEST_" + name)
+		}
+	}()
+	args, err := ApplyEnv(f.fs, "TEST_", f.fs.Args(), "debug")
+	wt.AssertNoErr(t, err)
+	wt.AssertEqualInt(t, f.port, 7000, "port from the command line")
+	wt.AssertEqualInt(t, int(f.timeout), int(5*time.Second), "http-timeout from the environment")
+	wt.AssertTrue(t, !f.debug, "excepted flag left alone")
+	wt.AssertEqualInt(t, len(args), 2, "peers from the environment")
+	wt.AssertEqualString(t, args[1], "host2", "second peer")
+
+	args, err = ApplyEnv(newFlags().fs, "TEST_", []string{"host3"})
+	wt.AssertNoErr(t, err)
+	wt.AssertEqualInt(t, len(args), 1, "peers from the command line")
+
+	os.Setenv("TEST_PORT", "x")
+	_, err = ApplyEnv(newFlags().fs, "TEST_", nil)
+	wt.AssertTrue(t, err != nil, "error for an invalid value")
+}
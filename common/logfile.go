@@ -0,0 +1,109 @@
+package common
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// LogFile is a file the loggers write to, which is rotated, as
+// <path>.1, <path>.2 and so on, when it grows beyond a size or has
+// been written to for long enough
+type LogFile struct {
+	sync.Mutex
+	path    string
+	maxSize int64         // 0 for no limit
+	maxAge  time.Duration // 0 for no limit
+	keep    int           // how many rotated files to keep
+	file    *os.File
+	size    int64
+	opened  time.Time
+}
+
+// OpenLogFile opens path for appending to, creating it if need be
+func OpenLogFile(path string, maxSize int64, maxAge time.Duration, keep int) (*LogFile, error) {
+	f := &LogFile{path: path, maxSize: maxSize, maxAge: maxAge, keep: keep}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *LogFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("Unable to open log file: %s", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("Unable to open log file: %s", err)
+	}
+	f.file, f.size, f.opened = file, info.Size(), time.Now()
+	return nil
+}
+
+func (f *LogFile) Write(p []byte) (int, error) {
+	f.Lock()
+	defer f.Unlock()
+	if f.file != nil && f.size > 0 &&
+		(f.maxSize > 0 && f.size+int64(len(p)) > f.maxSize || f.maxAge > 0 && time.Since(f.opened) > f.maxAge) {
+		f.rotate()
+	}
+	if f.file == nil {
+		// we failed to reopen it; try again
+		if err := f.open(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// Move <path>.<n> to <path>.<n+1>, and so on, dropping the oldest, and
+// start a new file at path
+func (f *LogFile) rotate() error {
+	f.file.Close()
+	f.file = nil
+	for i := f.keep - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", f.path, i), fmt.Sprintf("%s.%d", f.path, i+1))
+	}
+	if f.keep > 0 {
+		os.Rename(f.path, f.path+".1")
+	} else {
+		os.Remove(f.path)
+	}
+	return f.open()
+}
+
+// Reopen closes the file and opens path again, e.g. after logrotate
+// has moved it
+func (f *LogFile) Reopen() error {
+	f.Lock()
+	defer f.Unlock()
+	if f.file != nil {
+		f.file.Close()
+		f.file = nil
+	}
+	return f.open()
+}
+
+// The file the loggers write to, if any, reopened on SIGUSR1
+var logFile *LogFile
+
+// LogToFile has the loggers, including the standard logger, write to
+// f rather than to stdout and stderr
+func LogToFile(f *LogFile) {
+	logFile = f
+	stdLogOutput = f
+	InitLogging(f, f, f, f)
+	log.SetOutput(f)
+}
+
+// Where the standard logger writes to, once SetLogFormat has been
+// called
+var stdLogOutput io.Writer = os.Stderr
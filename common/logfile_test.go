@@ -0,0 +1,42 @@
+package common
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	wt "github.com/weaveworks/weave/testing"
+)
+
+func readLog(t *testing.T, path string) string {
+	contents, err := ioutil.ReadFile(path)
+	wt.AssertNoErr(t, err)
+	return string(contents)
+}
+
+func TestLogFileRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logfile")
+	wt.AssertNoErr(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "weave.log")
+
+	f, err := OpenLogFile(path, 8, 0, 2)
+	wt.AssertNoErr(t, err)
+	for _, line := range []string{"one\n", "two\n", "three\n", "four\n", "five\n"} {
+		_, err := f.Write([]byte(line))
+		wt.AssertNoErr(t, err)
+	}
+	wt.AssertEqualString(t, readLog(t, path), "five\n", "current file")
+	wt.AssertEqualString(t, readLog(t, path+".1"), "four\n", "first rotated file")
+	wt.AssertEqualString(t, readLog(t, path+".2"), "three\n", "second rotated file")
+	_, err = os.Stat(path + ".3")
+	wt.AssertTrue(t, os.IsNotExist(err), "only two rotated files kept")
+
+	// as logrotate would
+	wt.AssertNoErr(t, os.Rename(path, path+".old"))
+	wt.AssertNoErr(t, f.Reopen())
+	f.Write([]byte("six\n"))
+	wt.AssertEqualString(t, readLog(t, path), "six\n", "reopened file")
+	wt.AssertEqualString(t, readLog(t, path+".old"), "five\n", "moved file")
+}
@@ -1,16 +1,29 @@
 package common
 
 import (
+	"encoding/json"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 )
 
 const (
 	standardLogFlags = log.Ldate | log.Ltime | log.Lmicroseconds
 )
 
+// Log formats
+const (
+	TextLogFormat = "text"
+	JSONLogFormat = "json"
+)
+
 // Largely taken from
 // http://www.goinggo.net/2013/11/using-log-package-in-go.html
 
@@ -19,6 +32,9 @@ var (
 	Info    *log.Logger
 	Warning *log.Logger
 	Error   *log.Logger
+
+	logFormat  = TextLogFormat
+	logHandles [4]io.Writer
 )
 
 func InitLogging(debugHandle io.Writer,
@@ -26,16 +42,235 @@ func InitLogging(debugHandle io.Writer,
 	warningHandle io.Writer,
 	errorHandle io.Writer) {
 
-	Debug = log.New(debugHandle, "DEBUG: ", standardLogFlags)
-	Info = log.New(infoHandle, "INFO: ", standardLogFlags)
-	Warning = log.New(warningHandle, "WARNING: ", standardLogFlags)
-	Error = log.New(errorHandle, "ERROR: ", standardLogFlags)
+	logHandles = [4]io.Writer{debugHandle, infoHandle, warningHandle, errorHandle}
+	Debug = log.New(&debugFilter{newLogger(debugHandle, "DEBUG")}, "", 0)
+	Info = newLogger(infoHandle, "INFO")
+	Warning = newLogger(warningHandle, "WARNING")
+	Error = newLogger(errorHandle, "ERROR")
+}
+
+func newLogger(handle io.Writer, level string) *log.Logger {
+	if logFormat == JSONLogFormat && handle != ioutil.Discard {
+		return log.New(&jsonLogWriter{level: strings.ToLower(level), out: io.MultiWriter(handle, recentLogs)}, "", 0)
+	}
+	return log.New(io.MultiWriter(handle, recentLogs), level+": ", standardLogFlags)
+}
+
+// How many lines of logs we keep in memory, for diagnostic reports
+const recentLogSize = 1000
+
+var recentLogs = &logRing{lines: make([]string, recentLogSize)}
+
+// A writer for loggers, keeping the last few lines they write
+type logRing struct {
+	sync.Mutex
+	lines []string
+	next  int
+	full  bool
+}
+
+func (r *logRing) Write(p []byte) (int, error) {
+	r.Lock()
+	r.lines[r.next] = string(p)
+	r.next = (r.next + 1) % len(r.lines)
+	r.full = r.full || r.next == 0
+	r.Unlock()
+	return len(p), nil
+}
+
+// RecentLogs returns the last lines logged, oldest first, including
+// those of the standard logger once SetLogFormat has been called
+func RecentLogs() []string {
+	recentLogs.Lock()
+	defer recentLogs.Unlock()
+	if !recentLogs.full {
+		return append([]string{}, recentLogs.lines[:recentLogs.next]...)
+	}
+	return append(append([]string{}, recentLogs.lines[recentLogs.next:]...), recentLogs.lines[:recentLogs.next]...)
 }
 
 func InitDefaultLogging(debug bool) {
-	debugOut := ioutil.Discard
+	InitLogging(os.Stderr, os.Stdout, os.Stdout, os.Stderr)
+	SetDebugLogging("", debug)
+}
+
+// Debug logging is on for a subsystem, as given by the prefix of its
+// messages, e.g. "allocator" for "[allocator 7a:c4:8b:a1:e6:ad] ...",
+// if it is in debugLevels, or else if debugAll.
+var (
+	debugLock   sync.RWMutex
+	debugAll    bool
+	debugLevels = map[string]bool{}
+)
+
+// Names for the subsystems of each part of weave
+var subsystemGroups = map[string][]string{
+	"router": {"connection", "gossip"},
+	"ipam":   {"allocator", "kube"},
+	"dns":    {"dns", "mdns", "cache", "zonedb", "registrar"},
+}
+
+// SetDebugLogging turns debug logging on or off for a subsystem, or
+// a group of them, i.e. "router", "ipam" or "dns", or for all of them
+// if subsystem is blank.
+func SetDebugLogging(subsystem string, on bool) {
+	debugLock.Lock()
+	defer debugLock.Unlock()
+	if subsystem == "" {
+		debugAll, debugLevels = on, map[string]bool{}
+		return
+	}
+	if group, found := subsystemGroups[subsystem]; found {
+		for _, member := range group {
+			debugLevels[member] = on
+		}
+		return
+	}
+	debugLevels[subsystem] = on
+}
+
+// LogLevels describes, as "debug" or "info", the level of logging for
+// the subsystems set apart by SetDebugLogging, and for "all" others
+func LogLevels() map[string]string {
+	debugLock.RLock()
+	defer debugLock.RUnlock()
+	levels := map[string]string{"all": logLevel(debugAll)}
+	for subsystem, on := range debugLevels {
+		levels[subsystem] = logLevel(on)
+	}
+	return levels
+}
+
+// LogLevelsString is LogLevels, one "<subsystem>: <level>" per line,
+// with "all" first
+func LogLevelsString() string {
+	levels := LogLevels()
+	lines := []string{"all: " + levels["all"]}
+	delete(levels, "all")
+	var subsystems []string
+	for subsystem := range levels {
+		subsystems = append(subsystems, subsystem)
+	}
+	sort.Strings(subsystems)
+	for _, subsystem := range subsystems {
+		lines = append(lines, subsystem+": "+levels[subsystem])
+	}
+	return strings.Join(lines, "\n")
+}
+
+func logLevel(debug bool) string {
 	if debug {
-		debugOut = os.Stderr
+		return "debug"
+	}
+	return "info"
+}
+
+func debugEnabled(subsystem string) bool {
+	debugLock.RLock()
+	defer debugLock.RUnlock()
+	if on, found := debugLevels[subsystem]; found {
+		return on
+	}
+	return debugAll
+}
+
+// A writer for the Debug logger, passing on the messages of the
+// subsystems for which debug logging is on
+type debugFilter struct {
+	logger *log.Logger
+}
+
+func (f *debugFilter) Write(p []byte) (int, error) {
+	line := string(p)
+	if debugEnabled(parseLogLine(line).Subsystem) {
+		if err := f.logger.Output(0, line); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// SetLogFormat switches the loggers, keeping their handles, to the
+// given format, and has the standard logger's lines kept for
+// RecentLogs. In the JSON format, every line is a record with the
+// time, level and message, and the subsystem, peer and connection
+// where the message's prefix gives them. It applies to the standard
+// logger too, whose messages are recorded at level "info" and
+// attributed to the subsystem given.
+func SetLogFormat(format, subsystem string) error {
+	switch format {
+	case TextLogFormat, JSONLogFormat:
+	default:
+		return fmt.Errorf("Invalid log format %q: expected %q or %q", format, TextLogFormat, JSONLogFormat)
+	}
+	logFormat = format
+	InitLogging(logHandles[0], logHandles[1], logHandles[2], logHandles[3])
+	if format == JSONLogFormat {
+		log.SetFlags(0)
+		log.SetPrefix("")
+		log.SetOutput(&jsonLogWriter{level: "info", subsystem: subsystem, out: io.MultiWriter(stdLogOutput, recentLogs)})
+	} else {
+		log.SetOutput(io.MultiWriter(stdLogOutput, recentLogs))
+	}
+	return nil
+}
+
+type logRecord struct {
+	Time       string `json:"time"`
+	Level      string `json:"level"`
+	Subsystem  string `json:"subsystem,omitempty"`
+	Peer       string `json:"peer,omitempty"`
+	Connection string `json:"connection,omitempty"`
+	Message    string `json:"msg"`
+}
+
+var (
+	// e.g. "->[192.168.48.12:6783|7a:c4:8b:a1:e6:ad(host2)]: "
+	connectionPrefix = regexp.MustCompile(`^->\[([^|\]]*)(?:\|([^\]]*))?\]:?\s*`)
+	// e.g. "[allocator 7a:c4:8b:a1:e6:ad] " or "[dns msgid 4] "
+	subsystemPrefix = regexp.MustCompile(`^\[(\w+)(?: ([^\]]*))?\]:?\s*`)
+)
+
+// A writer for a log.Logger with no prefix or flags, turning each
+// line into a JSON record
+type jsonLogWriter struct {
+	level     string
+	subsystem string // when the message doesn't give one
+	out       io.Writer
+}
+
+func parseLogLine(line string) logRecord {
+	record := logRecord{Message: strings.TrimRight(line, "\n")}
+	if match := connectionPrefix.FindStringSubmatch(record.Message); match != nil {
+		record.Subsystem, record.Connection, record.Peer = "connection", match[1], match[2]
+		record.Message = record.Message[len(match[0]):]
+	} else if match := subsystemPrefix.FindStringSubmatch(record.Message); match != nil {
+		record.Subsystem = match[1]
+		record.Message = record.Message[len(match[0]):]
+		switch {
+		case match[2] == "":
+		case record.Subsystem == "allocator":
+			record.Peer = match[2]
+		default:
+			record.Message = match[2] + ": " + record.Message
+		}
+	}
+	return record
+}
+
+func (w *jsonLogWriter) Write(p []byte) (int, error) {
+	record := parseLogLine(string(p))
+	record.Time = time.Now().UTC().Format(time.RFC3339Nano)
+	record.Level = w.level
+	if record.Subsystem == "" {
+		record.Subsystem = w.subsystem
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := w.out.Write(append(line, '\n')); err != nil {
+		return 0, err
 	}
-	InitLogging(debugOut, os.Stdout, os.Stdout, os.Stderr)
+	return len(p), nil
 }
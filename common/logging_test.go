@@ -0,0 +1,82 @@
+package common
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	wt "github.com/weaveworks/weave/testing"
+)
+
+func TestParseLogLine(t *testing.T) {
+	for line, wanted := range map[string]logRecord{
+		"->[10.0.0.1:6783|7a:c4:8b:a1:e6:ad(host2)]: connection added\n": {Subsystem: "connection", Connection: "10.0.0.1:6783", Peer: "7a:c4:8b:a1:e6:ad(host2)", Message: "connection added"},
+		"->[10.0.0.1:6783] attempting connection\n":                      {Subsystem: "connection", Connection: "10.0.0.1:6783", Message: "attempting connection"},
+		"[allocator 7a:c4:8b:a1:e6:ad] Initialising\n":                   {Subsystem: "allocator", Peer: "7a:c4:8b:a1:e6:ad", Message: "Initialising"},
+		"[dns msgid 4] No answer\n":                                      {Subsystem: "dns", Message: "msgid 4: No answer"},
+		"[attach] Attached foo\n":                                        {Subsystem: "attach", Message: "Attached foo"},
+		"Sniffing traffic on weave\n":                                    {Message: "Sniffing traffic on weave"},
+	} {
+		wt.AssertEquals(t, parseLogLine(line), wanted)
+	}
+}
+
+func TestJSONLogWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w := &jsonLogWriter{level: "info", subsystem: "router", out: &buf}
+	_, err := w.Write([]byte("Discovered our MAC 7a:c4:8b:a1:e6:ad\n"))
+	wt.AssertNoErr(t, err)
+	var record logRecord
+	wt.AssertNoErr(t, json.Unmarshal(buf.Bytes(), &record))
+	wt.AssertEqualString(t, record.Level, "info", "level")
+	wt.AssertEqualString(t, record.Subsystem, "router", "subsystem")
+	wt.AssertEqualString(t, record.Message, "Discovered our MAC 7a:c4:8b:a1:e6:ad", "message")
+	wt.AssertTrue(t, record.Time != "", "time")
+}
+
+func TestDebugLogging(t *testing.T) {
+	var buf bytes.Buffer
+	InitLogging(&buf, &buf, &buf, &buf)
+	defer InitLogging(ioutil.Discard, os.Stdout, os.Stdout, os.Stderr)
+	defer SetDebugLogging("", false)
+
+	SetDebugLogging("", false)
+	Debug.Printf("[allocator 7a:c4:8b:a1:e6:ad] hidden")
+	wt.AssertEqualInt(t, buf.Len(), 0, "debug output while off")
+
+	SetDebugLogging("ipam", true)
+	Debug.Printf("[allocator 7a:c4:8b:a1:e6:ad] shown")
+	Debug.Printf("[dns msgid 4] hidden")
+	Debug.Printf("unprefixed, hidden")
+	wt.AssertEqualInt(t, strings.Count(buf.String(), "shown"), 1, "ipam debug output")
+	wt.AssertFalse(t, strings.Contains(buf.String(), "hidden"), "other debug output")
+	wt.AssertEqualString(t, LogLevelsString(), "all: info\nallocator: debug\nkube: debug", "levels")
+
+	buf.Reset()
+	SetDebugLogging("", true)
+	SetDebugLogging("dns", false)
+	Debug.Printf("[dns msgid 4] hidden")
+	Debug.Printf("unprefixed, shown")
+	wt.AssertEqualInt(t, strings.Count(buf.String(), "shown"), 1, "debug output")
+	wt.AssertFalse(t, strings.Contains(buf.String(), "hidden"), "dns debug output")
+}
+
+func TestRecentLogs(t *testing.T) {
+	defer func() { recentLogs = &logRing{lines: make([]string, recentLogSize)} }()
+	recentLogs = &logRing{lines: make([]string, 3)}
+	InitLogging(ioutil.Discard, ioutil.Discard, ioutil.Discard, ioutil.Discard)
+	defer InitLogging(ioutil.Discard, os.Stdout, os.Stdout, os.Stderr)
+
+	Info.Println("one")
+	wt.AssertEqualInt(t, len(RecentLogs()), 1, "lines")
+	for _, line := range []string{"two", "three", "four"} {
+		Warning.Println(line)
+	}
+	lines := RecentLogs()
+	wt.AssertEqualInt(t, len(lines), 3, "lines")
+	wt.AssertTrue(t, strings.HasSuffix(lines[0], "two\n"), "oldest line")
+	wt.AssertTrue(t, strings.HasSuffix(lines[2], "four\n"), "newest line")
+}
@@ -0,0 +1,53 @@
+package common
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// PidFile is a file holding our process ID, locked so that only one
+// process can hold it at a time
+type PidFile struct {
+	file *os.File
+}
+
+// WritePidFile locks the file at path, creating it, and its directory,
+// if need be, and writes our process ID to it, failing if another
+// process holds it
+func WritePidFile(path string) (*PidFile, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("Unable to create pidfile directory: %s", err)
+	}
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open pidfile: %s", err)
+	}
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		defer file.Close()
+		if err == syscall.EWOULDBLOCK {
+			pid, _ := ioutil.ReadAll(file)
+			return nil, fmt.Errorf("Another instance, with process ID %s, holds %s", strings.TrimSpace(string(pid)), path)
+		}
+		return nil, fmt.Errorf("Unable to lock pidfile: %s", err)
+	}
+	if err := file.Truncate(0); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("Unable to write pidfile: %s", err)
+	}
+	if _, err := fmt.Fprintf(file, "%d\n", os.Getpid()); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("Unable to write pidfile: %s", err)
+	}
+	return &PidFile{file: file}, nil
+}
+
+// Remove removes the file and releases the lock, which is released
+// anyway when we exit
+func (p *PidFile) Remove() {
+	os.Remove(p.file.Name())
+	p.file.Close()
+}
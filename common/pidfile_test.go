@@ -0,0 +1,33 @@
+package common
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	wt "github.com/weaveworks/weave/testing"
+)
+
+func TestPidFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pidfile")
+	wt.AssertNoErr(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "run", "weaver.pid")
+
+	p, err := WritePidFile(path)
+	wt.AssertNoErr(t, err)
+	wt.AssertEqualString(t, readLog(t, path), fmt.Sprintf("%d\n", os.Getpid()), "pid")
+
+	_, err = WritePidFile(path)
+	wt.AssertTrue(t, err != nil, "second instance refused")
+
+	p.Remove()
+	_, err = os.Stat(path)
+	wt.AssertTrue(t, os.IsNotExist(err), "pidfile removed")
+
+	p, err = WritePidFile(path)
+	wt.AssertNoErr(t, err)
+	p.Remove()
+}
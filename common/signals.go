@@ -15,23 +15,41 @@ type SignalReceiver interface {
 
 func SignalHandlerLoop(ss ...SignalReceiver) {
 	sigs := make(chan os.Signal, 1)
-	signal.Notify(sigs, syscall.SIGINT, syscall.SIGQUIT, syscall.SIGUSR1)
-	buf := make([]byte, 1<<20)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT, syscall.SIGUSR1)
 	for {
-		switch <-sigs {
-		case syscall.SIGINT:
-			Info.Printf("=== received SIGINT ===\n*** exiting\n")
+		switch sig := <-sigs; sig {
+		case syscall.SIGINT, syscall.SIGTERM:
+			name := "SIGINT"
+			if sig == syscall.SIGTERM {
+				name = "SIGTERM"
+			}
+			Info.Printf("=== received %s ===\n*** exiting\n", name)
 			for _, subsystem := range ss {
 				subsystem.Stop()
 			}
 			return
 		case syscall.SIGQUIT:
-			stacklen := runtime.Stack(buf, true)
-			Info.Printf("=== received SIGQUIT ===\n*** goroutine dump...\n%s\n*** end\n", buf[:stacklen])
+			Info.Printf("=== received SIGQUIT ===\n*** goroutine dump...\n%s\n*** end\n", Goroutines())
 		case syscall.SIGUSR1:
+			if logFile != nil {
+				if err := logFile.Reopen(); err != nil {
+					Error.Println(err)
+				}
+			}
 			for _, subsystem := range ss {
 				Info.Printf("=== received SIGUSR1 ===\n*** status...\n%s\n*** end\n", subsystem.Status())
 			}
 		}
 	}
 }
+
+// Goroutines is the stacks of all goroutines, as printed when a
+// program panics, however many there are
+func Goroutines() []byte {
+	for size := 1 << 20; ; size *= 2 {
+		buf := make([]byte, size)
+		if n := runtime.Stack(buf, true); n < size {
+			return buf[:n]
+		}
+	}
+}
@@ -0,0 +1,76 @@
+/*
+Package systemd implements the two parts of systemd's protocol with
+the services it starts that we need: socket activation, in which
+systemd opens the sockets we listen on and passes them to us, and
+readiness notification, in which we tell systemd when we are ready to
+be depended on.
+*/
+package systemd
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+)
+
+// The first file descriptor systemd passes
+const listenFdsStart = 3
+
+// Listeners returns the sockets systemd has passed to us, in the
+// order they appear in the socket unit, or none if we weren't socket
+// activated. The environment variables saying what was passed are
+// unset, so that our children don't think it was passed to them.
+func Listeners() ([]net.Listener, error) {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	nfds, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || nfds <= 0 {
+		return nil, nil
+	}
+
+	listeners := make([]net.Listener, 0, nfds)
+	for fd := listenFdsStart; fd < listenFdsStart+nfds; fd++ {
+		syscall.CloseOnExec(fd)
+		file := os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+		l, err := net.FileListener(file)
+		file.Close() // FileListener has its own copy
+		if err != nil {
+			return nil, err
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+// Notifying says whether systemd wants to hear from us
+func Notifying() bool {
+	return os.Getenv("NOTIFY_SOCKET") != ""
+}
+
+// Notify tells systemd about a change in our state, e.g. "READY=1",
+// if it asked us to by setting NOTIFY_SOCKET, returning whether it did.
+func Notify(state string) (bool, error) {
+	socketPath := os.Getenv("NOTIFY_SOCKET")
+	if socketPath == "" {
+		return false, nil
+	}
+	if socketPath[0] == '@' {
+		// an abstract socket
+		socketPath = "\x00" + socketPath[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socketPath, Net: "unixgram"})
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
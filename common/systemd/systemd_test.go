@@ -0,0 +1,47 @@
+package systemd
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	wt "github.com/weaveworks/weave/testing"
+)
+
+func TestNotify(t *testing.T) {
+	os.Unsetenv("NOTIFY_SOCKET")
+	sent, err := Notify("READY=1")
+	wt.AssertNoErr(t, err)
+	wt.AssertFalse(t, sent, "sent without NOTIFY_SOCKET")
+
+	dir, err := ioutil.TempDir("", "systemd")
+	wt.AssertNoErr(t, err)
+	defer os.RemoveAll(dir)
+	socketPath := filepath.Join(dir, "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socketPath, Net: "unixgram"})
+	wt.AssertNoErr(t, err)
+	defer conn.Close()
+
+	os.Setenv("NOTIFY_SOCKET", socketPath)
+	defer os.Unsetenv("NOTIFY_SOCKET")
+	sent, err = Notify("READY=1")
+	wt.AssertNoErr(t, err)
+	wt.AssertTrue(t, sent, "sent")
+	buf := make([]byte, 64)
+	n, err := conn.Read(buf)
+	wt.AssertNoErr(t, err)
+	wt.AssertEqualString(t, string(buf[:n]), "READY=1", "state")
+}
+
+func TestListenersNotActivated(t *testing.T) {
+	// addressed to some other process
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()+1))
+	os.Setenv("LISTEN_FDS", "1")
+	listeners, err := Listeners()
+	wt.AssertNoErr(t, err)
+	wt.AssertEqualInt(t, len(listeners), 0, "listeners")
+	wt.AssertEqualString(t, os.Getenv("LISTEN_FDS"), "", "LISTEN_FDS")
+}
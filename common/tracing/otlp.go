@@ -0,0 +1,198 @@
+package tracing
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	. "github.com/weaveworks/weave/common"
+)
+
+const (
+	// How many ended spans we hold, waiting to be exported, before
+	// dropping them
+	exportQueueSize = 2048
+	// How many spans we send at most in one request
+	exportBatchSize = 512
+	// How often we send what we have
+	exportInterval = 5 * time.Second
+)
+
+type exporter struct {
+	url      string
+	resource []otlpAttribute
+	queue    chan *Span
+	client   *http.Client
+}
+
+// Init enables tracing, exporting spans to the OTLP/HTTP collector at
+// endpoint, e.g. http://collector:4318, with the given attributes of
+// the process, e.g. the service name and our peer name, as key, value
+// pairs
+func Init(endpoint string, resource ...string) error {
+	if !strings.HasPrefix(endpoint, "http://") && !strings.HasPrefix(endpoint, "https://") {
+		return fmt.Errorf("Invalid trace endpoint %q: expected http:// or https:// URL", endpoint)
+	}
+	exp := &exporter{
+		url:      strings.TrimSuffix(endpoint, "/") + "/v1/traces",
+		resource: attributes(resource...),
+		queue:    make(chan *Span, exportQueueSize),
+		client:   &http.Client{Timeout: exportInterval},
+	}
+	go exp.run()
+	std = exp
+	return nil
+}
+
+func (exp *exporter) export(s *Span) {
+	select {
+	case exp.queue <- s:
+	default:
+	}
+}
+
+func (exp *exporter) run() {
+	ticker := time.NewTicker(exportInterval)
+	defer ticker.Stop()
+	var batch []*Span
+	for {
+		select {
+		case s := <-exp.queue:
+			if batch = append(batch, s); len(batch) < exportBatchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		if err := exp.send(batch); err != nil {
+			Warning.Printf("[tracing] Unable to export %d spans: %s", len(batch), err)
+		}
+		batch = nil
+	}
+}
+
+// The OTLP JSON encoding, of just what we use
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope struct {
+		Name string `json:"name"`
+	} `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpAttribute struct {
+	Key   string `json:"key"`
+	Value struct {
+		StringValue string `json:"stringValue"`
+	} `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// Span kinds and status codes
+const (
+	spanKindInternal = 1
+	statusOK         = 1
+	statusError      = 2
+)
+
+func attributes(pairs ...string) []otlpAttribute {
+	var attrs []otlpAttribute
+	for i := 0; i+1 < len(pairs); i += 2 {
+		var attr otlpAttribute
+		attr.Key, attr.Value.StringValue = pairs[i], pairs[i+1]
+		attrs = append(attrs, attr)
+	}
+	return attrs
+}
+
+func (s *Span) otlp() otlpSpan {
+	s.Lock()
+	defer s.Unlock()
+	var keys []string
+	for key := range s.attrs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var pairs []string
+	for _, key := range keys {
+		pairs = append(pairs, key, s.attrs[key])
+	}
+	span := otlpSpan{
+		TraceID:           s.traceID,
+		SpanID:            s.spanID,
+		ParentSpanID:      s.parentID,
+		Name:              s.name,
+		Kind:              spanKindInternal,
+		StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+		Attributes:        attributes(pairs...),
+		Status:            otlpStatus{Code: statusOK},
+	}
+	if s.err != nil {
+		span.Status = otlpStatus{Code: statusError, Message: s.err.Error()}
+	}
+	return span
+}
+
+func (exp *exporter) encode(batch []*Span) ([]byte, error) {
+	scopeSpans := otlpScopeSpans{}
+	scopeSpans.Scope.Name = "github.com/weaveworks/weave"
+	for _, s := range batch {
+		scopeSpans.Spans = append(scopeSpans.Spans, s.otlp())
+	}
+	return json.Marshal(otlpRequest{[]otlpResourceSpans{{
+		Resource:   otlpResource{exp.resource},
+		ScopeSpans: []otlpScopeSpans{scopeSpans},
+	}}})
+}
+
+func (exp *exporter) send(batch []*Span) error {
+	body, err := exp.encode(batch)
+	if err != nil {
+		return err
+	}
+	resp, err := exp.client.Post(exp.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("POST %s: %s", exp.url, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+/*
+Package tracing records spans of control-plane operations
+(establishing connections, gossip rounds, IPAM consensus) and exports
+them to an OpenTelemetry collector over OTLP/HTTP, in its JSON
+encoding.
+
+Until Init is called, Start returns nil, and all the methods of a nil
+*Span do nothing, so instrumented code needn't check whether tracing
+is enabled.
+*/
+package tracing
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// Span is a timed operation, possibly part of a larger one
+type Span struct {
+	sync.Mutex
+	traceID  string
+	spanID   string
+	parentID string
+	name     string
+	start    time.Time
+	end      time.Time
+	attrs    map[string]string
+	err      error
+	ended    bool
+}
+
+// The exporter that ended spans are handed to, if tracing is enabled
+var std *exporter
+
+// Start a span of an operation that isn't part of another, with
+// attributes given as key, value pairs
+func Start(name string, attrs ...string) *Span {
+	if std == nil {
+		return nil
+	}
+	return newSpan(newID(16), "", name, attrs)
+}
+
+// Child starts a span of an operation that is part of s
+func (s *Span) Child(name string, attrs ...string) *Span {
+	if s == nil {
+		return nil
+	}
+	return newSpan(s.traceID, s.spanID, name, attrs)
+}
+
+func newSpan(traceID, parentID, name string, attrs []string) *Span {
+	s := &Span{traceID: traceID, spanID: newID(8), parentID: parentID, name: name, start: time.Now(), attrs: make(map[string]string)}
+	for i := 0; i+1 < len(attrs); i += 2 {
+		s.attrs[attrs[i]] = attrs[i+1]
+	}
+	return s
+}
+
+// SetAttribute records something more about the operation
+func (s *Span) SetAttribute(key, value string) {
+	if s == nil {
+		return
+	}
+	s.Lock()
+	s.attrs[key] = value
+	s.Unlock()
+}
+
+// End the span, with the error the operation failed with, if any.
+// Only the first call has any effect.
+func (s *Span) End(err error) {
+	if s == nil {
+		return
+	}
+	s.Lock()
+	if s.ended {
+		s.Unlock()
+		return
+	}
+	s.ended, s.end, s.err = true, time.Now(), err
+	s.Unlock()
+	if exp := std; exp != nil {
+		exp.export(s)
+	}
+}
+
+func newID(size int) string {
+	id := make([]byte, size)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
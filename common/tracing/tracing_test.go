@@ -0,0 +1,53 @@
+package tracing
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	wt "github.com/weaveworks/weave/testing"
+)
+
+func TestDisabled(t *testing.T) {
+	std = nil
+	span := Start("op", "key", "value")
+	wt.AssertTrue(t, span == nil, "span while disabled")
+	child := span.Child("child")
+	child.SetAttribute("key", "value")
+	child.End(nil)
+	span.End(nil)
+}
+
+func TestSpans(t *testing.T) {
+	exp := &exporter{resource: attributes("service.name", "weave"), queue: make(chan *Span, 10)}
+	std = exp
+	defer func() { std = nil }()
+
+	span := Start("connection", "address", "10.0.0.1:6783")
+	child := span.Child("handshake")
+	child.End(errors.New("bad password"))
+	span.SetAttribute("peer", "7a:c4:8b:a1:e6:ad")
+	span.End(nil)
+	span.End(errors.New("ignored"))
+	wt.AssertEqualInt(t, len(exp.queue), 2, "exported spans")
+
+	body, err := exp.encode([]*Span{<-exp.queue, <-exp.queue})
+	wt.AssertNoErr(t, err)
+	var req otlpRequest
+	wt.AssertNoErr(t, json.Unmarshal(body, &req))
+	wt.AssertEqualString(t, req.ResourceSpans[0].Resource.Attributes[0].Value.StringValue, "weave", "service name")
+	spans := req.ResourceSpans[0].ScopeSpans[0].Spans
+	wt.AssertEqualInt(t, len(spans), 2, "spans")
+	handshake, connection := spans[0], spans[1]
+	wt.AssertEqualString(t, handshake.Name, "handshake", "name")
+	wt.AssertEqualString(t, handshake.TraceID, connection.TraceID, "trace ID")
+	wt.AssertEqualString(t, handshake.ParentSpanID, connection.SpanID, "parent")
+	wt.AssertEqualInt(t, handshake.Status.Code, statusError, "status")
+	wt.AssertEqualString(t, handshake.Status.Message, "bad password", "status message")
+	wt.AssertEqualInt(t, len(connection.TraceID), 32, "trace ID length")
+	wt.AssertEqualInt(t, len(connection.SpanID), 16, "span ID length")
+	wt.AssertEqualString(t, connection.ParentSpanID, "", "parent")
+	wt.AssertEqualInt(t, connection.Status.Code, statusOK, "status")
+	wt.AssertEqualInt(t, len(connection.Attributes), 2, "attributes")
+	wt.AssertEqualString(t, connection.Attributes[0].Key, "address", "sorted attributes")
+}
@@ -0,0 +1,53 @@
+package updater
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// NewClient creates a Docker API client for apiPath, which may be a
+// unix:// or tcp:// URL, or one of podman's prefixed "podman+", since
+// podman serves the Docker API too. For tcp:// endpoints, client certificates
+// are used following the docker CLI conventions: they are read from
+// $DOCKER_CERT_PATH (default ~/.docker) when either that or
+// $DOCKER_TLS_VERIFY is set, and the daemon's certificate is only
+// verified against ca.pem when $DOCKER_TLS_VERIFY is set.
+func NewClient(apiPath string) (*docker.Client, error) {
+	if strings.HasPrefix(apiPath, criPrefix) {
+		return nil, fmt.Errorf("%s is a CRI runtime, which has no Docker API", apiPath)
+	}
+	apiPath = strings.TrimPrefix(apiPath, podmanPrefix)
+	u, err := url.Parse(apiPath)
+	if err != nil {
+		return nil, err
+	}
+	certPath := os.Getenv("DOCKER_CERT_PATH")
+	verify := os.Getenv("DOCKER_TLS_VERIFY") != ""
+	if u.Scheme != "tcp" || (certPath == "" && !verify) {
+		return docker.NewClient(apiPath)
+	}
+	if certPath == "" {
+		certPath = filepath.Join(os.Getenv("HOME"), ".docker")
+	}
+	cert, err := ioutil.ReadFile(filepath.Join(certPath, "cert.pem"))
+	if err != nil {
+		return nil, err
+	}
+	key, err := ioutil.ReadFile(filepath.Join(certPath, "key.pem"))
+	if err != nil {
+		return nil, err
+	}
+	var ca []byte // nil means don't verify the daemon's certificate
+	if verify {
+		if ca, err = ioutil.ReadFile(filepath.Join(certPath, "ca.pem")); err != nil {
+			return nil, err
+		}
+	}
+	return docker.NewTLSClientFromBytes(apiPath, cert, key, ca)
+}
@@ -0,0 +1,169 @@
+package updater
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/weaveworks/weave/common/updater/cri"
+)
+
+const (
+	// How long we give a CRI runtime to answer each call
+	criTimeout = 10 * time.Second
+	// How often we ask a CRI runtime which containers it has, when it
+	// can't tell us as they change
+	criPollInterval = 2 * time.Second
+)
+
+// The CRI's GetContainerEvents, as Docker's events have them
+var criStatuses = map[cri.ContainerEventType]string{
+	cri.ContainerEventType_CONTAINER_STARTED_EVENT: "start",
+	cri.ContainerEventType_CONTAINER_STOPPED_EVENT: "die",
+	cri.ContainerEventType_CONTAINER_DELETED_EVENT: "destroy",
+}
+
+// We talk to CRI runtimes over gRPC, on their socket, following
+// their containers with GetContainerEvents. Runtimes without evented
+// PLEG don't have that, so with them we fall back to listing the
+// containers every criPollInterval, and looking for changes from one
+// list to the next.
+type criRuntime struct {
+	sync.Mutex
+	endpoint     string
+	pollInterval time.Duration
+	conn         *grpc.ClientConn // replaced on reconnecting
+	client       cri.RuntimeServiceClient
+}
+
+func newCRIRuntime(endpoint string) *criRuntime {
+	return &criRuntime{endpoint: endpoint, pollInterval: criPollInterval}
+}
+
+func (r *criRuntime) Connect() (<-chan Event, string, error) {
+	conn, err := grpc.Dial(r.endpoint, grpc.WithInsecure())
+	if err != nil {
+		return nil, "", err
+	}
+	client := cri.NewRuntimeServiceClient(conn)
+	ctx, cancel := context.WithTimeout(context.Background(), criTimeout)
+	version, err := client.Version(ctx, &cri.VersionRequest{})
+	cancel()
+	if err != nil {
+		conn.Close()
+		return nil, "", err
+	}
+	ctx, cancel = context.WithCancel(context.Background())
+	stream, err := client.GetContainerEvents(ctx, &cri.GetEventsRequest{})
+	if err != nil {
+		cancel()
+		conn.Close()
+		return nil, "", err
+	}
+	r.Lock()
+	old := r.conn
+	r.conn, r.client = conn, client
+	r.Unlock()
+	if old != nil {
+		old.Close()
+	}
+	events := make(chan Event)
+	go func() {
+		defer close(events)
+		defer cancel()
+		for {
+			event, err := stream.Recv()
+			if status.Code(err) == codes.Unimplemented {
+				r.poll(events)
+				return
+			} else if err != nil {
+				return
+			}
+			if s, found := criStatuses[event.ContainerEventType]; found {
+				events <- Event{ID: event.ContainerId, Status: s}
+			}
+		}
+	}()
+	return events, fmt.Sprintf("CRI runtime on %s: %s %s, API %s", r.endpoint, version.RuntimeName, version.RuntimeVersion, version.RuntimeApiVersion), nil
+}
+
+// The IDs of the containers the runtime has, and of those running
+func (r *criRuntime) list() (existing, running map[string]struct{}, err error) {
+	r.Lock()
+	client := r.client
+	r.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), criTimeout)
+	defer cancel()
+	resp, err := client.ListContainers(ctx, &cri.ListContainersRequest{})
+	if err != nil {
+		return nil, nil, err
+	}
+	existing, running = make(map[string]struct{}), make(map[string]struct{})
+	for _, c := range resp.Containers {
+		existing[c.Id] = struct{}{}
+		if c.State == cri.ContainerState_CONTAINER_RUNNING {
+			running[c.Id] = struct{}{}
+		}
+	}
+	return existing, running, nil
+}
+
+// Send the events that take us from each list of the containers to
+// the next, until listing them fails
+func (r *criRuntime) poll(events chan<- Event) {
+	existing, running, err := r.list()
+	if err != nil {
+		return
+	}
+	ticker := time.NewTicker(r.pollInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		nowExisting, nowRunning, err := r.list()
+		if err != nil {
+			return
+		}
+		for _, e := range diffEvents(running, existing, nowRunning, nowExisting) {
+			events <- e
+		}
+		running, existing = nowRunning, nowExisting
+	}
+}
+
+// The events that take us from one poll's view of the containers to
+// the next one's
+func diffEvents(running, existing, nowRunning, nowExisting map[string]struct{}) []Event {
+	var events []Event
+	for id := range nowRunning {
+		if _, found := running[id]; !found {
+			events = append(events, Event{ID: id, Status: "start"})
+		}
+	}
+	for id := range running {
+		if _, found := nowRunning[id]; !found {
+			events = append(events, Event{ID: id, Status: "die"})
+		}
+	}
+	for id := range existing {
+		if _, found := nowExisting[id]; !found {
+			events = append(events, Event{ID: id, Status: "destroy"})
+		}
+	}
+	return events
+}
+
+func (r *criRuntime) Running() ([]string, error) {
+	_, running, err := r.list()
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0, len(running))
+	for id := range running {
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
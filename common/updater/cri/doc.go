@@ -0,0 +1,12 @@
+/*
+Package cri has the messages and client of cri.proto, the part of the
+Kubernetes Container Runtime Interface that the updater uses to follow
+the containers of CRI runtimes.
+
+cri.pb.go is generated from cri.proto by protoc with the protoc-gen-go
+of github.com/golang/protobuf; run "go generate" here after changing
+cri.proto.
+*/
+package cri
+
+//go:generate protoc --go_out=plugins=grpc,paths=source_relative:. cri.proto
@@ -0,0 +1,121 @@
+package updater
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+)
+
+// podman's own API, which we talk to over plain HTTP, has events much
+// like Docker's, but with its own names for some of them
+var podmanStatuses = map[string]string{
+	"died":   "die",
+	"remove": "destroy",
+}
+
+type podmanRuntime struct {
+	apiPath string
+	baseURL string
+	client  *http.Client
+}
+
+func newPodmanRuntime(apiPath string) (*podmanRuntime, error) {
+	u, err := url.Parse(apiPath)
+	if err != nil {
+		return nil, err
+	}
+	r := &podmanRuntime{apiPath: apiPath}
+	switch u.Scheme {
+	case "unix":
+		r.baseURL = "http://podman"
+		r.client = &http.Client{Transport: &http.Transport{
+			Dial: func(network, addr string) (net.Conn, error) {
+				return net.Dial("unix", u.Path)
+			},
+		}}
+	case "tcp":
+		r.baseURL = "http://" + u.Host
+		r.client = &http.Client{}
+	default:
+		return nil, fmt.Errorf("Invalid podman API URL %q: expected unix:// or tcp://", apiPath)
+	}
+	return r, nil
+}
+
+func (r *podmanRuntime) get(path string) (*http.Response, error) {
+	resp, err := r.client.Get(r.baseURL + "/v1.0.0/libpod" + path)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("GET %s: %s", path, resp.Status)
+	}
+	return resp, nil
+}
+
+func (r *podmanRuntime) Connect() (<-chan Event, string, error) {
+	var version struct {
+		Version struct {
+			Version string
+		}
+	}
+	resp, err := r.get("/info")
+	if err != nil {
+		return nil, "", err
+	}
+	err = json.NewDecoder(resp.Body).Decode(&version)
+	resp.Body.Close()
+	if err != nil {
+		return nil, "", err
+	}
+	resp, err = r.get("/events?stream=true&filters=" + url.QueryEscape(`{"type":["container"]}`))
+	if err != nil {
+		return nil, "", err
+	}
+	events := make(chan Event)
+	go func() {
+		defer close(events)
+		defer resp.Body.Close()
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			var event struct {
+				Action string
+				Actor  struct {
+					ID string
+				}
+			}
+			if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+				continue
+			}
+			status := event.Action
+			if docker, found := podmanStatuses[status]; found {
+				status = docker
+			}
+			events <- Event{ID: event.Actor.ID, Status: status}
+		}
+	}()
+	return events, fmt.Sprintf("podman API on %s: version %s", r.apiPath, version.Version.Version), nil
+}
+
+func (r *podmanRuntime) Running() ([]string, error) {
+	resp, err := r.get("/containers/json")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var containers []struct {
+		Id string
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&containers); err != nil {
+		return nil, err
+	}
+	ids := make([]string, len(containers))
+	for i, container := range containers {
+		ids[i] = container.Id
+	}
+	return ids, nil
+}
@@ -0,0 +1,94 @@
+package updater
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// Event is a container changing state, with Status as in Docker's
+// events: "start", "restart", "unpause", "die", "destroy" and so on
+type Event struct {
+	ID     string
+	Status string
+}
+
+// ContainerRuntime is what we watch for containers starting and dying
+type ContainerRuntime interface {
+	// Connect starts a stream of events, which is closed when it is
+	// lost, and describes the runtime, for logging
+	Connect() (<-chan Event, string, error)
+	// Running lists the IDs of the containers running now
+	Running() ([]string, error)
+}
+
+const (
+	podmanPrefix = "podman+"
+	criPrefix    = "cri+"
+)
+
+// NewRuntime makes a ContainerRuntime for apiPath: a Docker API URL,
+// as for NewClient, or podman's API URL prefixed with "podman+", or a
+// CRI runtime endpoint prefixed with "cri+", e.g.
+// podman+unix:///run/podman/podman.sock or
+// cri+unix:///run/containerd/containerd.sock.
+func NewRuntime(apiPath string) (ContainerRuntime, error) {
+	switch {
+	case strings.HasPrefix(apiPath, podmanPrefix):
+		return newPodmanRuntime(strings.TrimPrefix(apiPath, podmanPrefix))
+	case strings.HasPrefix(apiPath, criPrefix):
+		return newCRIRuntime(strings.TrimPrefix(apiPath, criPrefix)), nil
+	}
+	return &dockerRuntime{apiPath: apiPath}, nil
+}
+
+type dockerRuntime struct {
+	sync.Mutex
+	apiPath string
+	client  *docker.Client // replaced on reconnecting
+}
+
+func (r *dockerRuntime) Connect() (<-chan Event, string, error) {
+	client, err := NewClient(r.apiPath)
+	if err != nil {
+		return nil, "", err
+	}
+	env, err := client.Version()
+	if err != nil {
+		return nil, "", err
+	}
+	dockerEvents := make(chan *docker.APIEvents)
+	if err := client.AddEventListener(dockerEvents); err != nil {
+		return nil, "", err
+	}
+	r.Lock()
+	r.client = client
+	r.Unlock()
+	events := make(chan Event)
+	go func() {
+		// The docker client closes listener channels when it loses
+		// the event stream, e.g. because the daemon was restarted.
+		for event := range dockerEvents {
+			events <- Event{ID: event.ID, Status: event.Status}
+		}
+		close(events)
+	}()
+	return events, fmt.Sprintf("Docker API on %s: %v", r.apiPath, env), nil
+}
+
+func (r *dockerRuntime) Running() ([]string, error) {
+	r.Lock()
+	client := r.client
+	r.Unlock()
+	containers, err := client.ListContainers(docker.ListContainersOptions{})
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, len(containers))
+	for i, container := range containers {
+		ids[i] = container.ID
+	}
+	return ids, nil
+}
@@ -0,0 +1,173 @@
+package updater
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+
+	"github.com/weaveworks/weave/common/updater/cri"
+	wt "github.com/weaveworks/weave/testing"
+)
+
+func set(ids ...string) map[string]struct{} {
+	s := make(map[string]struct{})
+	for _, id := range ids {
+		s[id] = struct{}{}
+	}
+	return s
+}
+
+func TestCRIDiffEvents(t *testing.T) {
+	events := diffEvents(set("a", "b"), set("a", "b", "c"), set("b", "d"), set("b", "c", "d"))
+	var got []string
+	for _, e := range events {
+		got = append(got, e.Status+" "+e.ID)
+	}
+	sort.Strings(got)
+	wt.AssertEquals(t, got, []string{"destroy a", "die a", "start d"})
+}
+
+type mockCRIServer struct {
+	cri.UnimplementedRuntimeServiceServer
+	events     []*cri.ContainerEventResponse // nil without evented PLEG
+	containers chan []*cri.Container         // what each list gives
+}
+
+func (s *mockCRIServer) Version(context.Context, *cri.VersionRequest) (*cri.VersionResponse, error) {
+	return &cri.VersionResponse{RuntimeName: "mock", RuntimeVersion: "1.0", RuntimeApiVersion: "v1"}, nil
+}
+
+func (s *mockCRIServer) ListContainers(context.Context, *cri.ListContainersRequest) (*cri.ListContainersResponse, error) {
+	return &cri.ListContainersResponse{Containers: <-s.containers}, nil
+}
+
+func (s *mockCRIServer) GetContainerEvents(req *cri.GetEventsRequest, stream cri.RuntimeService_GetContainerEventsServer) error {
+	if s.events == nil {
+		return s.UnimplementedRuntimeServiceServer.GetContainerEvents(req, stream)
+	}
+	for _, e := range s.events {
+		if err := stream.Send(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Serve server on a socket in a temporary directory, returning its
+// endpoint and a function to stop it
+func serveCRI(t *testing.T, server *mockCRIServer) (string, func()) {
+	dir, err := ioutil.TempDir("", "cri")
+	wt.AssertNoErr(t, err)
+	path := filepath.Join(dir, "cri.sock")
+	l, err := net.Listen("unix", path)
+	wt.AssertNoErr(t, err)
+	s := grpc.NewServer()
+	cri.RegisterRuntimeServiceServer(s, server)
+	go s.Serve(l)
+	return "unix://" + path, func() {
+		s.Stop()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestCRIRuntimeEvents(t *testing.T) {
+	server := &mockCRIServer{
+		events: []*cri.ContainerEventResponse{
+			{ContainerId: "c1", ContainerEventType: cri.ContainerEventType_CONTAINER_CREATED_EVENT},
+			{ContainerId: "c1", ContainerEventType: cri.ContainerEventType_CONTAINER_STARTED_EVENT},
+			{ContainerId: "c1", ContainerEventType: cri.ContainerEventType_CONTAINER_STOPPED_EVENT},
+			{ContainerId: "c1", ContainerEventType: cri.ContainerEventType_CONTAINER_DELETED_EVENT}},
+		containers: make(chan []*cri.Container, 1)}
+	endpoint, stop := serveCRI(t, server)
+	defer stop()
+
+	runtime, err := NewRuntime("cri+" + endpoint)
+	wt.AssertNoErr(t, err)
+	events, desc, err := runtime.Connect()
+	wt.AssertNoErr(t, err)
+	wt.AssertTrue(t, strings.HasSuffix(desc, "mock 1.0, API v1"), "description")
+	var got []Event
+	for e := range events {
+		got = append(got, e)
+	}
+	wt.AssertEquals(t, got, []Event{{"c1", "start"}, {"c1", "die"}, {"c1", "destroy"}})
+
+	server.containers <- []*cri.Container{
+		{Id: "c2", State: cri.ContainerState_CONTAINER_RUNNING},
+		{Id: "c3", State: cri.ContainerState_CONTAINER_EXITED}}
+	running, err := runtime.Running()
+	wt.AssertNoErr(t, err)
+	wt.AssertEquals(t, running, []string{"c2"})
+}
+
+// Without evented PLEG, we list the containers instead
+func TestCRIRuntimePolling(t *testing.T) {
+	server := &mockCRIServer{containers: make(chan []*cri.Container, 4)}
+	running := func(id string) *cri.Container {
+		return &cri.Container{Id: id, State: cri.ContainerState_CONTAINER_RUNNING}
+	}
+	exited := func(id string) *cri.Container {
+		return &cri.Container{Id: id, State: cri.ContainerState_CONTAINER_EXITED}
+	}
+	server.containers <- []*cri.Container{running("c1"), running("c2")}
+	server.containers <- []*cri.Container{exited("c1"), running("c2"), running("c3")}
+	server.containers <- []*cri.Container{running("c2"), running("c3")}
+	endpoint, stop := serveCRI(t, server)
+	defer stop()
+
+	runtime := newCRIRuntime(endpoint)
+	runtime.pollInterval = 10 * time.Millisecond
+	events, _, err := runtime.Connect()
+	wt.AssertNoErr(t, err)
+	var got []string
+	for len(got) < 3 {
+		e := <-events
+		got = append(got, e.Status+" "+e.ID)
+	}
+	sort.Strings(got)
+	wt.AssertEquals(t, got, []string{"destroy c1", "die c1", "start c3"})
+}
+
+func TestPodmanRuntime(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1.0.0/libpod/info":
+			fmt.Fprint(w, `{"version":{"Version":"2.0.0"}}`)
+		case "/v1.0.0/libpod/events":
+			fmt.Fprintln(w, `{"Type":"container","Action":"start","Actor":{"ID":"c1"}}`)
+			fmt.Fprintln(w, `{"Type":"container","Action":"died","Actor":{"ID":"c1"}}`)
+			fmt.Fprintln(w, `{"Type":"container","Action":"remove","Actor":{"ID":"c1"}}`)
+		case "/v1.0.0/libpod/containers/json":
+			fmt.Fprint(w, `[{"Id":"c2"}]`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	runtime, err := NewRuntime("podman+tcp://" + strings.TrimPrefix(server.URL, "http://"))
+	wt.AssertNoErr(t, err)
+	events, desc, err := runtime.Connect()
+	wt.AssertNoErr(t, err)
+	wt.AssertTrue(t, strings.HasSuffix(desc, "version 2.0.0"), "description")
+	var got []Event
+	for e := range events {
+		got = append(got, e)
+	}
+	wt.AssertEquals(t, got, []Event{{"c1", "start"}, {"c1", "die"}, {"c1", "destroy"}})
+
+	running, err := runtime.Running()
+	wt.AssertNoErr(t, err)
+	wt.AssertEquals(t, running, []string{"c2"})
+}
@@ -1,47 +1,185 @@
 package updater
 
 import (
-	"github.com/fsouza/go-dockerclient"
+	"regexp"
+	"sync/atomic"
+	"time"
+
 	. "github.com/weaveworks/weave/common"
 )
 
+const (
+	initialInterval = 1 * time.Second
+	maxInterval     = 1 * time.Minute
+)
+
+// Docker container IDs as reported in events and by the API; we only
+// ever consider idents of this form when resyncing, so as not to
+// disturb things like "weave:expose" that aren't containers at all.
+var containerIDRegexp = regexp.MustCompile("^[0-9a-f]{64}$")
+
+// IsContainerID says whether ident looks like a Docker container ID
+func IsContainerID(ident string) bool {
+	return containerIDRegexp.MatchString(ident)
+}
+
 type ContainerObserver interface {
 	ContainerDied(ident string) error
 }
 
+// ContainerStartObserver may be implemented by a ContainerObserver
+// that wants to hear about containers being (re)started, e.g. so it
+// can hang on to state for a container that dies and comes back.
+type ContainerStartObserver interface {
+	ContainerStarted(ident string)
+}
+
+// ContainerDestroyObserver may be implemented by a ContainerObserver
+// that wants to hear about containers being removed altogether.
+type ContainerDestroyObserver interface {
+	ContainerDestroyed(ident string) error
+}
+
+// ContainerLister may be implemented by a ContainerObserver that
+// holds state for containers, so that after losing contact with
+// Docker we can tell it about any containers that died whilst we
+// weren't listening.
+type ContainerLister interface {
+	ContainerIdents() []string
+}
+
+// Updater is what Start returns, watching the container runtime
+type Updater struct {
+	apiPath   string
+	runtime   ContainerRuntime
+	obs       []ContainerObserver
+	connected int32 // 1 while we have the runtime's event stream
+}
+
 func checkError(err error, apiPath string) {
 	if err != nil {
-		Error.Fatalf("[updater] Unable to connect to Docker API on %s: %s",
+		Error.Fatalf("[updater] Unable to connect to container runtime on %s: %s",
 			apiPath, err)
 	}
 }
 
-func Start(apiPath string, ob ContainerObserver) error {
-	client, err := docker.NewClient(apiPath)
-	checkError(err, apiPath)
+// Start watches the container runtime on apiPath, as for NewRuntime,
+// for containers starting, dying and being removed, and tells each of
+// obs, in turn, so that e.g. a container's interface can be gone
+// before its addresses are released for reuse.
+func Start(apiPath string, obs ...ContainerObserver) (*Updater, error) {
+	runtime, err := NewRuntime(apiPath)
+	if err != nil {
+		return nil, err
+	}
+	u := &Updater{apiPath: apiPath, runtime: runtime, obs: obs}
 
-	env, err := client.Version()
+	events, desc, err := runtime.Connect()
 	checkError(err, apiPath)
 
-	events := make(chan *docker.APIEvents)
-	err = client.AddEventListener(events)
-	checkError(err, apiPath)
+	Info.Printf("[updater] Using %s", desc)
 
-	Info.Printf("[updater] Using Docker API on %s: %v", apiPath, env)
+	go u.run(events)
+	return u, nil
+}
+
+// Connected says whether we are hearing about containers from the
+// runtime, as opposed to trying to reconnect to it
+func (u *Updater) Connected() bool {
+	return atomic.LoadInt32(&u.connected) == 1
+}
+
+// Running lists the IDs of the containers running now
+func (u *Updater) Running() ([]string, error) {
+	return u.runtime.Running()
+}
 
-	go func() {
+func (u *Updater) run(events <-chan Event) {
+	for {
+		atomic.StoreInt32(&u.connected, 1)
 		for event := range events {
-			handleEvent(ob, event, client)
+			for _, ob := range u.obs {
+				handleEvent(ob, event)
+			}
 		}
-	}()
-	return nil
+		atomic.StoreInt32(&u.connected, 0)
+		Warning.Printf("[updater] Lost event stream from container runtime on %s; reconnecting", u.apiPath)
+		events = u.reconnect()
+		u.resync()
+	}
+}
+
+func (u *Updater) reconnect() <-chan Event {
+	interval := initialInterval
+	for {
+		time.Sleep(interval)
+		events, desc, err := u.runtime.Connect()
+		if err == nil {
+			Info.Printf("[updater] Reconnected to %s", desc)
+			return events
+		}
+		Warning.Printf("[updater] Unable to reconnect to container runtime on %s (retrying in %v): %s", u.apiPath, interval, err)
+		if interval *= 2; interval > maxInterval {
+			interval = maxInterval
+		}
+	}
 }
 
-func handleEvent(ob ContainerObserver, event *docker.APIEvents, client *docker.Client) error {
+// Tell the observers about any containers they know of that are no
+// longer running, since we may have missed their 'die' events.
+func (u *Updater) resync() {
+	ids, err := u.runtime.Running()
+	if err != nil {
+		Warning.Printf("[updater] Unable to list containers on %s: %s", u.apiPath, err)
+		return
+	}
+	running := make(map[string]struct{})
+	for _, id := range ids {
+		running[id] = struct{}{}
+	}
+	for _, ob := range u.obs {
+		if lister, ok := ob.(ContainerLister); ok {
+			resync(ob, lister, running)
+		}
+	}
+}
+
+func resync(ob ContainerObserver, lister ContainerLister, running map[string]struct{}) {
+	for _, ident := range lister.ContainerIdents() {
+		if !IsContainerID(ident) {
+			continue
+		}
+		if _, found := running[ident]; found {
+			// it may have died and been restarted meanwhile
+			containerStarted(ob, ident)
+		} else {
+			Info.Printf("[updater] Container %s died whilst disconnected from Docker", ident)
+			ob.ContainerDied(ident)
+		}
+	}
+}
+
+func handleEvent(ob ContainerObserver, event Event) error {
+	id := event.ID
 	switch event.Status {
+	case "start", "restart", "unpause":
+		containerStarted(ob, id)
 	case "die":
-		id := event.ID
 		ob.ContainerDied(id)
+	case "destroy":
+		if do, ok := ob.(ContainerDestroyObserver); ok {
+			return do.ContainerDestroyed(id)
+		}
+	case "pause", "stop":
+		// A paused container keeps its network; a stopped one
+		// also gets a 'die', which is where we act.
+		Debug.Printf("[updater] Container %s: %s", id, event.Status)
 	}
 	return nil
 }
+
+func containerStarted(ob ContainerObserver, ident string) {
+	if so, ok := ob.(ContainerStartObserver); ok {
+		so.ContainerStarted(ident)
+	}
+}
@@ -0,0 +1,128 @@
+package discovery
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	. "github.com/weaveworks/weave/common"
+)
+
+// Where routers register themselves in the store, under their peer
+// names
+const peersPrefix = "weave/peers/"
+
+// Connector is the part of the router's ConnectionMaker we use
+type Connector interface {
+	InitiateConnection(peer string) error
+	ForgetConnection(peer string)
+}
+
+// Discoverer registers our router in a store, and has it connect to
+// the others registered there, forgetting them again when they drop
+// out of it.
+type Discoverer struct {
+	sync.Mutex
+	store Store
+	name  string // our peer name, which is our key
+	addr  string // where other routers can reach us
+	peers peerSet
+}
+
+func NewDiscoverer(store Store, name, addr string, connector Connector) *Discoverer {
+	return &Discoverer{store: store, name: name, addr: addr, peers: newPeerSet(connector)}
+}
+
+// Start registers us, and looks for other routers, every interval, and,
+// if the store can tell us of changes, whenever they are registered or
+// drop out in between; we are registered for a few intervals, so that
+// we don't drop out just because the store was unavailable for a
+// moment.
+func (d *Discoverer) Start(interval time.Duration) {
+	go func() {
+		next := time.Now()
+		for {
+			if !time.Now().Before(next) {
+				if err := d.register(3 * interval); err != nil {
+					Warning.Printf("[discovery] %s", err)
+				}
+				next = time.Now().Add(interval)
+			}
+			if err := d.list(); err != nil {
+				Warning.Printf("[discovery] %s", err)
+			}
+			d.wait(next)
+		}
+	}()
+}
+
+func (d *Discoverer) wait(until time.Time) {
+	if watcher, ok := d.store.(Watcher); ok {
+		err := watcher.Watch(peersPrefix, time.Until(until))
+		if err == nil {
+			return
+		}
+		Warning.Printf("[discovery] Unable to watch store: %s", err)
+	}
+	time.Sleep(time.Until(until))
+}
+
+func (d *Discoverer) refresh(ttl time.Duration) error {
+	if err := d.register(ttl); err != nil {
+		return err
+	}
+	return d.list()
+}
+
+func (d *Discoverer) register(ttl time.Duration) error {
+	if err := d.store.Register(peersPrefix+d.name, d.addr, ttl); err != nil {
+		return fmt.Errorf("Unable to register in store: %s", err)
+	}
+	return nil
+}
+
+func (d *Discoverer) list() error {
+	peers, err := d.store.List(peersPrefix)
+	if err != nil {
+		return fmt.Errorf("Unable to list peers in store: %s", err)
+	}
+	d.Lock()
+	defer d.Unlock()
+	found := make(map[string]string)
+	for key, addr := range peers {
+		if key == peersPrefix+d.name || addr == d.addr {
+			continue
+		}
+		found[addr] = "peer " + key[len(peersPrefix):]
+	}
+	d.peers.update(found, "the store")
+	return nil
+}
+
+// AdvertiseHost gives the IP address in advertise, which, as in
+// Docker's --cluster-advertise, may be given as <ip>:<port>,
+// <interface>:<port>, or either without the port.
+func AdvertiseHost(advertise string) (string, error) {
+	host, _, err := net.SplitHostPort(advertise)
+	if err != nil {
+		host = advertise
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.String(), nil
+	}
+	iface, err := net.InterfaceByName(host)
+	if err != nil {
+		return "", fmt.Errorf("Invalid advertise address %q: neither an IP address nor an interface", advertise)
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return "", err
+	}
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.To4() != nil {
+			return ipnet.IP.String(), nil
+		}
+	}
+	return "", fmt.Errorf("Interface %s has no IPv4 address to advertise", host)
+}
@@ -0,0 +1,387 @@
+package discovery
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	wt "github.com/weaveworks/weave/testing"
+)
+
+type mockConnector struct {
+	sync.Mutex
+	peers map[string]struct{}
+}
+
+func (c *mockConnector) InitiateConnection(peer string) error {
+	c.Lock()
+	defer c.Unlock()
+	c.peers[peer] = struct{}{}
+	return nil
+}
+
+func (c *mockConnector) ForgetConnection(peer string) {
+	c.Lock()
+	defer c.Unlock()
+	delete(c.peers, peer)
+}
+
+// mockStore keeps its keys in memory, ignoring TTLs
+type mockStore struct {
+	values map[string]string
+}
+
+func (s *mockStore) Register(key, value string, ttl time.Duration) error {
+	s.values[key] = value
+	return nil
+}
+
+func (s *mockStore) List(prefix string) (map[string]string, error) {
+	values := make(map[string]string)
+	for key, value := range s.values {
+		if strings.HasPrefix(key, prefix) {
+			values[key] = value
+		}
+	}
+	return values, nil
+}
+
+func TestDiscoverer(t *testing.T) {
+	store := &mockStore{values: map[string]string{
+		peersPrefix + "aa:aa:aa:aa:aa:aa": "10.0.0.1:6783",
+		peersPrefix + "bb:bb:bb:bb:bb:bb": "10.0.0.2:6783",
+		"elsewhere":                       "10.0.0.3:6783",
+	}}
+	connector := &mockConnector{peers: make(map[string]struct{})}
+	d := NewDiscoverer(store, "cc:cc:cc:cc:cc:cc", "10.0.0.4:6783", connector)
+
+	wt.AssertNoErr(t, d.refresh(time.Minute))
+	wt.AssertEqualString(t, store.values[peersPrefix+"cc:cc:cc:cc:cc:cc"], "10.0.0.4:6783", "registration")
+	wt.AssertEquals(t, connector.peers, map[string]struct{}{"10.0.0.1:6783": {}, "10.0.0.2:6783": {}})
+
+	delete(store.values, peersPrefix+"aa:aa:aa:aa:aa:aa")
+	wt.AssertNoErr(t, d.refresh(time.Minute))
+	wt.AssertEquals(t, connector.peers, map[string]struct{}{"10.0.0.2:6783": {}})
+}
+
+func TestFinder(t *testing.T) {
+	records := []*net.SRV{{Target: "host1.example.com.", Port: 6783}, {Target: "host2.example.com.", Port: 7000}}
+	saved := lookupSRV
+	defer func() { lookupSRV = saved }()
+	lookupSRV = func(service, proto, name string) (string, []*net.SRV, error) {
+		if name != "_weave._tcp.example.com" {
+			return "", nil, fmt.Errorf("no such name %s", name)
+		}
+		return name, records, nil
+	}
+
+	_, err := NewSource("dns")
+	wt.AssertTrue(t, err != nil, "error for no name")
+	_, err = NewSource("carrier-pigeon:loft")
+	wt.AssertTrue(t, err != nil, "error for an unsupported kind")
+	source, err := NewSource("dns:_weave._tcp.example.com")
+	wt.AssertNoErr(t, err)
+
+	connector := &mockConnector{peers: make(map[string]struct{})}
+	f := NewFinder(source, connector)
+	wt.AssertNoErr(t, f.refresh())
+	wt.AssertEquals(t, connector.peers, map[string]struct{}{"host1.example.com:6783": {}, "host2.example.com:7000": {}})
+
+	records = records[1:]
+	wt.AssertNoErr(t, f.refresh())
+	wt.AssertEquals(t, connector.peers, map[string]struct{}{"host2.example.com:7000": {}})
+
+	f = NewFinder(&dnsSource{name: "_weave._tcp.example.org"}, connector)
+	wt.AssertTrue(t, f.refresh() != nil, "error for a name without records")
+	wt.AssertEquals(t, connector.peers, map[string]struct{}{"host2.example.com:7000": {}})
+}
+
+func TestEC2Sign(t *testing.T) {
+	// AWS's example of signature version 4
+	query := url.Values{"Action": {"ListUsers"}, "Version": {"2010-05-08"}}
+	req, err := http.NewRequest("GET", "https://iam.amazonaws.com/?"+ec2CanonicalQuery(query), nil)
+	wt.AssertNoErr(t, err)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	req.Header.Set("X-Amz-Date", "20150830T123600Z")
+	ec2Sign(req, query, ec2Credentials{AccessKeyID: "AKIDEXAMPLE", SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"}, "us-east-1", "iam")
+	wt.AssertEqualString(t, req.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/iam/aws4_request, SignedHeaders=content-type;host;x-amz-date, Signature=5d672d79c15b13162d9279b0855cfba6789a8edb4c82c400e06b5924a6f2b5d7", "authorization")
+}
+
+func TestEC2Source(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/latest/api/token":
+			fmt.Fprint(w, "token1")
+		case "/latest/meta-data/instance-id":
+			fmt.Fprint(w, "i-1")
+		case "/latest/meta-data/placement/region":
+			fmt.Fprint(w, "eu-west-1")
+		case "/latest/meta-data/iam/security-credentials/":
+			fmt.Fprint(w, "weave-role")
+		case "/latest/meta-data/iam/security-credentials/weave-role":
+			fmt.Fprint(w, `{"AccessKeyId":"AKID","SecretAccessKey":"secret","Token":"session","Expiration":"2100-01-01T00:00:00Z"}`)
+		case "/":
+			wt.AssertEqualString(t, r.FormValue("Action"), "DescribeInstances", "action")
+			wt.AssertEqualString(t, r.FormValue("Filter.1.Name"), "tag:aws:autoscaling:groupName", "filter")
+			wt.AssertEqualString(t, r.FormValue("Filter.1.Value.1"), "weave-asg", "filter value")
+			wt.AssertEqualString(t, r.Header.Get("X-Amz-Security-Token"), "session", "session token")
+			wt.AssertTrue(t, strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKID/"), "authorization")
+			fmt.Fprint(w, `<DescribeInstancesResponse><reservationSet><item><instancesSet>
+<item><instanceId>i-1</instanceId><privateIpAddress>10.0.0.1</privateIpAddress></item>
+<item><instanceId>i-2</instanceId><privateIpAddress>10.0.0.2</privateIpAddress></item>
+</instancesSet></item></reservationSet></DescribeInstancesResponse>`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	savedMetadata, savedEndpoint := ec2MetadataURL, ec2Endpoint
+	defer func() { ec2MetadataURL, ec2Endpoint = savedMetadata, savedEndpoint }()
+	ec2MetadataURL, ec2Endpoint = server.URL, func(string) string { return server.URL }
+
+	_, err := NewSource("ec2:tag:Name")
+	wt.AssertTrue(t, err != nil, "error for a tag without a value")
+	source, err := NewSource("ec2:asg:weave-asg")
+	wt.AssertNoErr(t, err)
+	peers, err := source.Peers()
+	wt.AssertNoErr(t, err)
+	wt.AssertEquals(t, peers, map[string]string{"10.0.0.2": "instance i-2"})
+}
+
+func TestGCESource(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/computeMetadata/") {
+			wt.AssertEqualString(t, r.Header.Get("Metadata-Flavor"), "Google", "metadata flavor")
+		} else {
+			wt.AssertEqualString(t, r.Header.Get("Authorization"), "Bearer token1", "authorization")
+		}
+		instance := func(id, name, ip, status string) string {
+			return fmt.Sprintf(`{"id":"%s","name":"%s","status":"%s","selfLink":"https://compute/%s","networkInterfaces":[{"networkIP":"%s"}]}`, id, name, status, name, ip)
+		}
+		switch r.URL.Path {
+		case "/computeMetadata/v1/instance/id":
+			fmt.Fprint(w, "1")
+		case "/computeMetadata/v1/instance/zone":
+			fmt.Fprint(w, "projects/123/zones/europe-west1-b")
+		case "/computeMetadata/v1/project/project-id":
+			fmt.Fprint(w, "proj")
+		case "/computeMetadata/v1/instance/service-accounts/default/token":
+			fmt.Fprint(w, `{"access_token":"token1","expires_in":3600}`)
+		case "/projects/proj/aggregated/instances":
+			wt.AssertEqualString(t, r.FormValue("filter"), "labels.weave=prod", "filter")
+			fmt.Fprintf(w, `{"items":{"zones/a":{"instances":[%s,%s]},"zones/b":{"instances":[%s]}}}`,
+				instance("1", "us", "10.0.0.1", "RUNNING"), instance("2", "two", "10.0.0.2", "RUNNING"), instance("3", "three", "10.0.0.3", "TERMINATED"))
+		case "/projects/proj/zones/europe-west1-b/instanceGroups/weave-group/listInstances":
+			wt.AssertEqualString(t, r.Method, "POST", "method")
+			fmt.Fprint(w, `{"items":[{"instance":"https://compute/two"}]}`)
+		case "/projects/proj/zones/europe-west1-b/instances":
+			fmt.Fprintf(w, `{"items":[%s,%s]}`, instance("2", "two", "10.0.0.2", "RUNNING"), instance("4", "four", "10.0.0.4", "RUNNING"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	savedMetadata, savedCompute := gceMetadataURL, gceComputeURL
+	defer func() { gceMetadataURL, gceComputeURL = savedMetadata, savedCompute }()
+	gceMetadataURL, gceComputeURL = server.URL, server.URL
+
+	_, err := NewSource("gce:group:a/b/c")
+	wt.AssertTrue(t, err != nil, "error for a malformed group")
+	source, err := NewSource("gce:label:weave=prod")
+	wt.AssertNoErr(t, err)
+	peers, err := source.Peers()
+	wt.AssertNoErr(t, err)
+	wt.AssertEquals(t, peers, map[string]string{"10.0.0.2": "instance two"})
+
+	source, err = NewSource("gce:group:weave-group")
+	wt.AssertNoErr(t, err)
+	peers, err = source.Peers()
+	wt.AssertNoErr(t, err)
+	wt.AssertEquals(t, peers, map[string]string{"10.0.0.2": "instance two"})
+}
+
+func TestEtcdStore(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "PUT":
+			wt.AssertEqualString(t, r.URL.Path, "/v2/keys/cluster/weave/peers/aa", "path")
+			wt.AssertEqualString(t, r.FormValue("value"), "10.0.0.1:6783", "value")
+			wt.AssertEqualString(t, r.FormValue("ttl"), "90", "ttl")
+		case "GET":
+			wt.AssertEqualString(t, r.URL.Path, "/v2/keys/cluster/weave/peers/", "path")
+			fmt.Fprint(w, `{"action":"get","node":{"key":"/cluster/weave/peers","dir":true,"nodes":[{"key":"/cluster/weave/peers/aa","value":"10.0.0.1:6783"}]}}`)
+		}
+	}))
+	defer server.Close()
+
+	store, err := NewStore("etcd://" + strings.TrimPrefix(server.URL, "http://") + "/cluster")
+	wt.AssertNoErr(t, err)
+	wt.AssertNoErr(t, store.Register(peersPrefix+"aa", "10.0.0.1:6783", 90*time.Second))
+	values, err := store.List(peersPrefix)
+	wt.AssertNoErr(t, err)
+	wt.AssertEquals(t, values, map[string]string{peersPrefix + "aa": "10.0.0.1:6783"})
+}
+
+func TestConsulStore(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/session/create":
+			fmt.Fprint(w, `{"ID":"session1"}`)
+		case "/v1/kv/weave/peers/aa":
+			wt.AssertEqualString(t, r.FormValue("acquire"), "session1", "session")
+			fmt.Fprint(w, `true`)
+		case "/v1/kv/weave/peers/":
+			fmt.Fprintf(w, `[{"Key":"weave/peers/aa","Value":"%s"}]`, base64.StdEncoding.EncodeToString([]byte("10.0.0.1:6783")))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	store, err := NewStore("consul://" + strings.TrimPrefix(server.URL, "http://"))
+	wt.AssertNoErr(t, err)
+	wt.AssertNoErr(t, store.Register(peersPrefix+"aa", "10.0.0.1:6783", 90*time.Second))
+	values, err := store.List(peersPrefix)
+	wt.AssertNoErr(t, err)
+	wt.AssertEquals(t, values, map[string]string{peersPrefix + "aa": "10.0.0.1:6783"})
+
+	_, err = NewStore("zk://localhost:2181")
+	wt.AssertTrue(t, err != nil, "unsupported store")
+}
+
+func TestEtcdWatch(t *testing.T) {
+	var puts []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Etcd-Index", "7")
+		switch {
+		case r.Method == "PUT":
+			puts = append(puts, r.FormValue("value")+","+r.FormValue("refresh"))
+		case r.FormValue("wait") == "true":
+			wt.AssertEqualString(t, r.FormValue("waitIndex"), "8", "index waited for")
+			wt.AssertEqualString(t, r.FormValue("recursive"), "true", "recursive")
+			fmt.Fprint(w, `{"action":"set","node":{"key":"/weave/peers/bb","value":"10.0.0.2:6783"}}`)
+		default:
+			fmt.Fprint(w, `{"action":"get","node":{"key":"/weave/peers","dir":true}}`)
+		}
+	}))
+	defer server.Close()
+
+	store, err := NewStore("etcd://" + strings.TrimPrefix(server.URL, "http://"))
+	wt.AssertNoErr(t, err)
+	watcher := store.(Watcher)
+	wt.AssertTrue(t, watcher.Watch(peersPrefix, time.Second) != nil, "error watching before listing")
+	wt.AssertNoErr(t, store.Register(peersPrefix+"aa", "10.0.0.1:6783", 90*time.Second))
+	wt.AssertNoErr(t, store.Register(peersPrefix+"aa", "10.0.0.1:6783", 90*time.Second))
+	wt.AssertNoErr(t, store.Register(peersPrefix+"aa", "10.0.0.3:6783", 90*time.Second))
+	wt.AssertEquals(t, puts, []string{"10.0.0.1:6783,", ",true", "10.0.0.3:6783,"})
+	_, err = store.List(peersPrefix)
+	wt.AssertNoErr(t, err)
+	wt.AssertNoErr(t, watcher.Watch(peersPrefix, time.Second))
+}
+
+func TestConsulWatch(t *testing.T) {
+	acquired := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Consul-Index", "42")
+		switch r.URL.Path {
+		case "/v1/session/create":
+			fmt.Fprint(w, `{"ID":"session1"}`)
+		case "/v1/session/renew/session1":
+			fmt.Fprint(w, `[{"ID":"session1"}]`)
+		case "/v1/kv/weave/peers/aa":
+			acquired++
+			fmt.Fprint(w, `true`)
+		case "/v1/kv/weave/peers/":
+			if r.FormValue("index") != "" {
+				wt.AssertEqualString(t, r.FormValue("index"), "42", "index waited for")
+				wt.AssertEqualString(t, r.FormValue("wait"), "1000ms", "wait")
+			}
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	store, err := NewStore("consul://" + strings.TrimPrefix(server.URL, "http://"))
+	wt.AssertNoErr(t, err)
+	wt.AssertNoErr(t, store.Register(peersPrefix+"aa", "10.0.0.1:6783", 90*time.Second))
+	wt.AssertNoErr(t, store.Register(peersPrefix+"aa", "10.0.0.1:6783", 90*time.Second))
+	wt.AssertEqualInt(t, acquired, 1, "acquisitions of an unchanged key")
+	values, err := store.List(peersPrefix)
+	wt.AssertNoErr(t, err)
+	wt.AssertEqualInt(t, len(values), 0, "peers")
+	wt.AssertNoErr(t, store.(Watcher).Watch(peersPrefix, time.Second))
+}
+
+func TestTokenStore(t *testing.T) {
+	registered := make(map[string]struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		wt.AssertEqualString(t, r.URL.Path, "/v1/clusters/abc123", "path")
+		switch r.Method {
+		case "POST":
+			wt.AssertEqualString(t, r.URL.Query().Get("ttl"), "90", "ttl")
+			addr, _ := ioutil.ReadAll(r.Body)
+			registered[string(addr)] = struct{}{}
+		case "GET":
+			var addrs []string
+			for addr := range registered {
+				addrs = append(addrs, addr)
+			}
+			json.NewEncoder(w).Encode(addrs)
+		}
+	}))
+	defer server.Close()
+
+	_, err := NewStore("token://")
+	wt.AssertTrue(t, err != nil, "error for no token")
+	store, err := NewStore("token://abc123@" + strings.TrimPrefix(server.URL, "http://"))
+	wt.AssertNoErr(t, err)
+	wt.AssertNoErr(t, store.Register(peersPrefix+"aa", "10.0.0.1:6783", 90*time.Second))
+	wt.AssertTrue(t, store.Register("elsewhere", "10.0.0.3:6783", 90*time.Second) != nil, "error registering other than a peer")
+
+	connector := &mockConnector{peers: make(map[string]struct{})}
+	registered["10.0.0.2:6783"] = struct{}{}
+	d := NewDiscoverer(store, "aa", "10.0.0.1:6783", connector)
+	wt.AssertNoErr(t, d.refresh(90*time.Second))
+	wt.AssertEquals(t, connector.peers, map[string]struct{}{"10.0.0.2:6783": {}})
+}
+
+func TestLAN(t *testing.T) {
+	us := NewLAN("aa:aa:aa:aa:aa:aa", 6783)
+	them := NewLAN("bb:bb:bb:bb:bb:bb", 7000)
+
+	query := new(dns.Msg)
+	query.SetQuestion(LANService, dns.TypePTR)
+	response := them.response(query, true)
+	wt.AssertTrue(t, response != nil, "response to a query for the service")
+	wt.AssertEqualInt(t, int(response.Id), int(query.Id), "legacy response ID")
+	wt.AssertEqualInt(t, len(response.Question), 1, "legacy response questions")
+	wt.AssertEquals(t, us.instances(response), map[string]uint16{"bb:bb:bb:bb:bb:bb": 7000})
+	wt.AssertEqualInt(t, len(us.instances(us.response(query, false))), 0, "our own instances")
+	wt.AssertEqualInt(t, len(us.response(query, false).Question), 0, "response questions")
+
+	query.SetQuestion("bb:bb:bb:bb:bb:bb."+LANService, dns.TypeSRV)
+	wt.AssertEquals(t, us.instances(them.response(query, false)), map[string]uint16{"bb:bb:bb:bb:bb:bb": 7000})
+	query.SetQuestion("_http._tcp.local.", dns.TypePTR)
+	wt.AssertTrue(t, them.response(query, false) == nil, "no response to a query for another service")
+}
+
+func TestAdvertiseHost(t *testing.T) {
+	host, err := AdvertiseHost("192.168.1.10:2376")
+	wt.AssertNoErr(t, err)
+	wt.AssertEqualString(t, host, "192.168.1.10", "IP with port")
+	host, err = AdvertiseHost("lo:2376")
+	wt.AssertNoErr(t, err)
+	wt.AssertEqualString(t, host, "127.0.0.1", "interface with port")
+	_, err = AdvertiseHost("nosuchiface0")
+	wt.AssertTrue(t, err != nil, "unknown interface")
+}
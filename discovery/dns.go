@@ -0,0 +1,33 @@
+package discovery
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+var lookupSRV = net.LookupSRV
+
+// dnsSource gives the targets of the SRV records of a name, such as
+// _weave._tcp.example.com, which DNS servers commonly let routers be
+// added to and removed from with little ceremony
+type dnsSource struct {
+	name string
+}
+
+func (s *dnsSource) Peers() (map[string]string, error) {
+	_, srvs, err := lookupSRV("", "", s.name)
+	if err != nil {
+		return nil, err
+	}
+	peers := make(map[string]string)
+	for _, srv := range srvs {
+		host := strings.TrimSuffix(srv.Target, ".")
+		peers[net.JoinHostPort(host, fmt.Sprint(srv.Port))] = "peer " + host
+	}
+	return peers, nil
+}
+
+func (s *dnsSource) String() string {
+	return "the SRV records of " + s.name
+}
@@ -0,0 +1,254 @@
+package discovery
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// So that tests can stand in for EC2
+var (
+	ec2MetadataURL = "http://169.254.169.254"
+	ec2Endpoint    = func(region string) string { return "https://ec2." + region + ".amazonaws.com" }
+)
+
+const ec2APIVersion = "2016-11-15"
+
+// ec2Source gives the private addresses of the running instances in
+// our region with a tag, which is how EC2 marks those of an
+// autoscaling group too, asking with the credentials of our
+// instance's IAM role, which must allow ec2:DescribeInstances
+type ec2Source struct {
+	sync.Mutex
+	tag, value string
+	instanceID string // ours, which we leave out
+	region     string
+	creds      ec2Credentials
+}
+
+type ec2Credentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	Token           string
+	Expiration      time.Time
+}
+
+func newEC2Source(where string) (Source, error) {
+	var tag, value string
+	switch {
+	case strings.HasPrefix(where, "tag:"):
+		i := strings.Index(where, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("Invalid EC2 tag %q: expected tag:<key>=<value>", where)
+		}
+		tag, value = where[len("tag:"):i], where[i+1:]
+	case strings.HasPrefix(where, "asg:"):
+		tag, value = "aws:autoscaling:groupName", where[len("asg:"):]
+	default:
+		return nil, fmt.Errorf("Invalid EC2 discovery %q: expected tag:<key>=<value> or asg:<group>", where)
+	}
+	if tag == "" || value == "" {
+		return nil, fmt.Errorf("Invalid EC2 discovery %q: nothing to look for", where)
+	}
+	return &ec2Source{tag: tag, value: value}, nil
+}
+
+func (s *ec2Source) String() string {
+	return fmt.Sprintf("EC2 instances tagged %s=%s", s.tag, s.value)
+}
+
+// The instance metadata service wants a token, for which we ask
+// afresh each time, since we don't ask often
+func (s *ec2Source) metadata(path string) (string, error) {
+	req, err := http.NewRequest("PUT", ec2MetadataURL+"/latest/api/token", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "60")
+	token, err := httpGetString(req)
+	if err != nil {
+		return "", fmt.Errorf("Unable to get instance metadata token: %s", err)
+	}
+	if req, err = http.NewRequest("GET", ec2MetadataURL+"/latest/meta-data/"+path, nil); err != nil {
+		return "", err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token", token)
+	value, err := httpGetString(req)
+	if err != nil {
+		return "", fmt.Errorf("Unable to get instance metadata %s: %s", path, err)
+	}
+	return strings.TrimSpace(value), nil
+}
+
+// Our instance, region and role credentials, which we get again
+// shortly before they expire
+func (s *ec2Source) init() error {
+	if s.instanceID == "" {
+		id, err := s.metadata("instance-id")
+		if err != nil {
+			return err
+		}
+		if s.region, err = s.metadata("placement/region"); err != nil {
+			return err
+		}
+		s.instanceID = id
+	}
+	if time.Now().Add(5 * time.Minute).Before(s.creds.Expiration) {
+		return nil
+	}
+	role, err := s.metadata("iam/security-credentials/")
+	if err != nil {
+		return err
+	}
+	if role == "" {
+		return fmt.Errorf("Instance has no IAM role")
+	}
+	creds, err := s.metadata("iam/security-credentials/" + strings.SplitN(role, "\n", 2)[0])
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal([]byte(creds), &s.creds)
+}
+
+type ec2Instances struct {
+	Reservations []struct {
+		Instances []struct {
+			InstanceID       string `xml:"instanceId"`
+			PrivateIPAddress string `xml:"privateIpAddress"`
+		} `xml:"instancesSet>item"`
+	} `xml:"reservationSet>item"`
+	NextToken string `xml:"nextToken"`
+}
+
+func (s *ec2Source) Peers() (map[string]string, error) {
+	s.Lock()
+	defer s.Unlock()
+	if err := s.init(); err != nil {
+		return nil, err
+	}
+	peers := make(map[string]string)
+	for nextToken := ""; ; {
+		query := url.Values{
+			"Action":           {"DescribeInstances"},
+			"Version":          {ec2APIVersion},
+			"Filter.1.Name":    {"tag:" + s.tag},
+			"Filter.1.Value.1": {s.value},
+			"Filter.2.Name":    {"instance-state-name"},
+			"Filter.2.Value.1": {"running"}}
+		if nextToken != "" {
+			query.Set("NextToken", nextToken)
+		}
+		var result ec2Instances
+		if err := s.describe(query, &result); err != nil {
+			return nil, err
+		}
+		for _, reservation := range result.Reservations {
+			for _, instance := range reservation.Instances {
+				if instance.InstanceID != s.instanceID && instance.PrivateIPAddress != "" {
+					peers[instance.PrivateIPAddress] = "instance " + instance.InstanceID
+				}
+			}
+		}
+		if nextToken = result.NextToken; nextToken == "" {
+			return peers, nil
+		}
+	}
+}
+
+func (s *ec2Source) describe(query url.Values, result interface{}) error {
+	endpoint, err := url.Parse(ec2Endpoint(s.region))
+	if err != nil {
+		return err
+	}
+	endpoint.Path = "/"
+	endpoint.RawQuery = ec2CanonicalQuery(query)
+	req, err := http.NewRequest("GET", endpoint.String(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Amz-Date", time.Now().UTC().Format(ec2TimeFormat))
+	if s.creds.Token != "" {
+		req.Header.Set("X-Amz-Security-Token", s.creds.Token)
+	}
+	ec2Sign(req, query, s.creds, s.region, "ec2")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return &statusError{resp.StatusCode, string(msg)}
+	}
+	return xml.NewDecoder(resp.Body).Decode(result)
+}
+
+const ec2TimeFormat = "20060102T150405Z"
+
+// The query string as AWS signs it: sorted, and with spaces escaped as
+// %20 rather than +
+func ec2CanonicalQuery(query url.Values) string {
+	return strings.Replace(query.Encode(), "+", "%20", -1)
+}
+
+// Sign req, a GET of query without a body, with AWS's signature
+// version 4, from its X-Amz-Date header and the others it has
+func ec2Sign(req *http.Request, query url.Values, creds ec2Credentials, region, service string) {
+	date := req.Header.Get("X-Amz-Date")
+	req.Header.Set("Host", req.URL.Host)
+	var names []string
+	for name := range req.Header {
+		names = append(names, strings.ToLower(name))
+	}
+	sort.Strings(names)
+	var headers []string
+	for _, name := range names {
+		headers = append(headers, name+":"+strings.TrimSpace(req.Header.Get(name)))
+	}
+	signedHeaders := strings.Join(names, ";")
+	emptyHash := sha256.Sum256(nil)
+	canonical := strings.Join([]string{"GET", "/", ec2CanonicalQuery(query),
+		strings.Join(headers, "\n") + "\n", signedHeaders, hex.EncodeToString(emptyHash[:])}, "\n")
+	canonicalHash := sha256.Sum256([]byte(canonical))
+	scope := date[:8] + "/" + region + "/" + service + "/aws4_request"
+	toSign := "AWS4-HMAC-SHA256\n" + date + "\n" + scope + "\n" + hex.EncodeToString(canonicalHash[:])
+	key := []byte("AWS4" + creds.SecretAccessKey)
+	for _, part := range []string{date[:8], region, service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		creds.AccessKeyID, scope, signedHeaders, hex.EncodeToString(hmacSHA256(key, toSign))))
+	req.Header.Del("Host") // Go sends it from req.Host
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func httpGetString(req *http.Request) (string, error) {
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", &statusError{resp.StatusCode, string(body)}
+	}
+	return string(body), nil
+}
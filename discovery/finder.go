@@ -0,0 +1,110 @@
+package discovery
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/weaveworks/weave/common"
+)
+
+// Source gives the addresses, as <host>:<port>, of the routers to
+// connect to, found in some way other than registering in a store,
+// with a description of each for the log
+type Source interface {
+	Peers() (map[string]string, error)
+	String() string
+}
+
+// NewSource makes a source from a description as given to
+// -peer-discovery: dns:<name>, for the SRV records of name,
+// ec2:tag:<key>=<value> or ec2:asg:<group>, for EC2 instances, or
+// gce:label:<key>=<value> or gce:group:[<zone>/]<name>, for GCE ones
+func NewSource(desc string) (Source, error) {
+	i := strings.Index(desc, ":")
+	if i < 0 {
+		return nil, fmt.Errorf("Invalid peer discovery %q: expected <kind>:<where>", desc)
+	}
+	kind, where := desc[:i], desc[i+1:]
+	if where == "" {
+		return nil, fmt.Errorf("Invalid peer discovery %q: nowhere given to look", desc)
+	}
+	switch kind {
+	case "dns":
+		return &dnsSource{name: where}, nil
+	case "ec2":
+		return newEC2Source(where)
+	case "gce":
+		return newGCESource(where)
+	}
+	return nil, fmt.Errorf("Unsupported peer discovery %q: expected dns:, ec2: or gce:", desc)
+}
+
+// Finder has our router connect to the routers a source gives,
+// forgetting them again when it stops giving them.
+type Finder struct {
+	sync.Mutex
+	source Source
+	peers  peerSet
+}
+
+func NewFinder(source Source, connector Connector) *Finder {
+	return &Finder{source: source, peers: newPeerSet(connector)}
+}
+
+// Start looks for routers every interval
+func (f *Finder) Start(interval time.Duration) {
+	go func() {
+		for {
+			if err := f.refresh(); err != nil {
+				Warning.Printf("[discovery] %s", err)
+			}
+			time.Sleep(interval)
+		}
+	}()
+}
+
+func (f *Finder) refresh() error {
+	found, err := f.source.Peers()
+	if err != nil {
+		return fmt.Errorf("Unable to look for peers in %s: %s", f.source, err)
+	}
+	f.Lock()
+	defer f.Unlock()
+	f.peers.update(found, "in "+f.source.String())
+	return nil
+}
+
+// The routers we have told the connector of, by address
+type peerSet struct {
+	connector Connector
+	known     map[string]struct{}
+}
+
+func newPeerSet(connector Connector) peerSet {
+	return peerSet{connector: connector, known: make(map[string]struct{})}
+}
+
+// Connect to the routers in found, described by the values, and
+// forget those that are not in it any more, which were found where
+func (ps *peerSet) update(found map[string]string, where string) {
+	for addr, desc := range found {
+		if _, known := ps.known[addr]; known {
+			continue
+		}
+		if err := ps.connector.InitiateConnection(addr); err != nil {
+			Warning.Printf("[discovery] Unable to connect to %s: %s", addr, err)
+			continue
+		}
+		Info.Printf("[discovery] Found %s at %s", desc, addr)
+		ps.known[addr] = struct{}{}
+	}
+	for addr := range ps.known {
+		if _, stillThere := found[addr]; !stillThere {
+			Info.Printf("[discovery] Peer at %s has gone from %s", addr, where)
+			ps.connector.ForgetConnection(addr)
+			delete(ps.known, addr)
+		}
+	}
+}
@@ -0,0 +1,226 @@
+package discovery
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// So that tests can stand in for GCE
+var (
+	gceMetadataURL = "http://metadata.google.internal"
+	gceComputeURL  = "https://compute.googleapis.com/compute/v1"
+)
+
+// gceSource gives the internal addresses of the running instances in
+// our project with a label, or in an instance group, asking with the
+// token of our instance's service account, which must be allowed to
+// list them
+type gceSource struct {
+	sync.Mutex
+	label, value string
+	group        string // zone/name
+	project      string
+	instanceID   string // ours, which we leave out
+	token        string
+	expires      time.Time
+}
+
+func newGCESource(where string) (Source, error) {
+	s := &gceSource{}
+	switch {
+	case strings.HasPrefix(where, "label:"):
+		i := strings.Index(where, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("Invalid GCE label %q: expected label:<key>=<value>", where)
+		}
+		s.label, s.value = where[len("label:"):i], where[i+1:]
+		if s.label == "" || s.value == "" {
+			return nil, fmt.Errorf("Invalid GCE discovery %q: nothing to look for", where)
+		}
+	case strings.HasPrefix(where, "group:"):
+		s.group = where[len("group:"):]
+		if s.group == "" || strings.Count(s.group, "/") > 1 {
+			return nil, fmt.Errorf("Invalid GCE instance group %q: expected group:[<zone>/]<name>", where)
+		}
+	default:
+		return nil, fmt.Errorf("Invalid GCE discovery %q: expected label:<key>=<value> or group:[<zone>/]<name>", where)
+	}
+	return s, nil
+}
+
+func (s *gceSource) String() string {
+	if s.group != "" {
+		return "GCE instance group " + s.group
+	}
+	return fmt.Sprintf("GCE instances labelled %s=%s", s.label, s.value)
+}
+
+func (s *gceSource) metadata(path string) (string, error) {
+	req, err := http.NewRequest("GET", gceMetadataURL+"/computeMetadata/v1/"+path, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	value, err := httpGetString(req)
+	if err != nil {
+		return "", fmt.Errorf("Unable to get instance metadata %s: %s", path, err)
+	}
+	return strings.TrimSpace(value), nil
+}
+
+// Our project, instance and service account token, which we get again
+// shortly before it expires; an instance group without a zone is in
+// ours
+func (s *gceSource) init() error {
+	if s.project == "" {
+		id, err := s.metadata("instance/id")
+		if err != nil {
+			return err
+		}
+		if s.group != "" && !strings.Contains(s.group, "/") {
+			zone, err := s.metadata("instance/zone") // projects/<number>/zones/<zone>
+			if err != nil {
+				return err
+			}
+			s.group = path.Base(zone) + "/" + s.group
+		}
+		if s.project, err = s.metadata("project/project-id"); err != nil {
+			return err
+		}
+		s.instanceID = id
+	}
+	if time.Now().Add(time.Minute).Before(s.expires) {
+		return nil
+	}
+	token, err := s.metadata("instance/service-accounts/default/token")
+	if err != nil {
+		return err
+	}
+	var result struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.Unmarshal([]byte(token), &result); err != nil {
+		return err
+	}
+	s.token, s.expires = result.AccessToken, time.Now().Add(time.Duration(result.ExpiresIn)*time.Second)
+	return nil
+}
+
+type gceInstance struct {
+	ID                string `json:"id"`
+	Name              string `json:"name"`
+	Status            string `json:"status"`
+	SelfLink          string `json:"selfLink"`
+	NetworkInterfaces []struct {
+		NetworkIP string `json:"networkIP"`
+	} `json:"networkInterfaces"`
+}
+
+func (s *gceSource) Peers() (map[string]string, error) {
+	s.Lock()
+	defer s.Unlock()
+	if err := s.init(); err != nil {
+		return nil, err
+	}
+	var instances []gceInstance
+	var err error
+	if s.group != "" {
+		instances, err = s.groupInstances()
+	} else {
+		instances, err = s.labelledInstances()
+	}
+	if err != nil {
+		return nil, err
+	}
+	peers := make(map[string]string)
+	for _, instance := range instances {
+		if instance.ID != s.instanceID && instance.Status == "RUNNING" && len(instance.NetworkInterfaces) > 0 {
+			peers[instance.NetworkInterfaces[0].NetworkIP] = "instance " + instance.Name
+		}
+	}
+	return peers, nil
+}
+
+func (s *gceSource) labelledInstances() ([]gceInstance, error) {
+	var instances []gceInstance
+	filter := url.QueryEscape(fmt.Sprintf("labels.%s=%s", s.label, s.value))
+	for pageToken := ""; ; {
+		var result struct {
+			Items map[string]struct {
+				Instances []gceInstance `json:"instances"`
+			} `json:"items"`
+			NextPageToken string `json:"nextPageToken"`
+		}
+		if err := s.call("GET", "/projects/"+s.project+"/aggregated/instances?filter="+filter+"&pageToken="+pageToken, &result); err != nil {
+			return nil, err
+		}
+		for _, zone := range result.Items {
+			instances = append(instances, zone.Instances...)
+		}
+		if pageToken = result.NextPageToken; pageToken == "" {
+			return instances, nil
+		}
+	}
+}
+
+// Instance groups only list their instances' links, so we look for
+// those among the instances in the group's zone
+func (s *gceSource) groupInstances() ([]gceInstance, error) {
+	zone, name := path.Dir(s.group), path.Base(s.group)
+	members := make(map[string]struct{})
+	for pageToken := ""; ; {
+		var result struct {
+			Items []struct {
+				Instance string `json:"instance"`
+			} `json:"items"`
+			NextPageToken string `json:"nextPageToken"`
+		}
+		if err := s.call("POST", "/projects/"+s.project+"/zones/"+zone+"/instanceGroups/"+name+"/listInstances?pageToken="+pageToken, &result); err != nil {
+			return nil, err
+		}
+		for _, item := range result.Items {
+			members[item.Instance] = struct{}{}
+		}
+		if pageToken = result.NextPageToken; pageToken == "" {
+			break
+		}
+	}
+	var instances []gceInstance
+	for pageToken := ""; ; {
+		var result struct {
+			Items         []gceInstance `json:"items"`
+			NextPageToken string        `json:"nextPageToken"`
+		}
+		if err := s.call("GET", "/projects/"+s.project+"/zones/"+zone+"/instances?pageToken="+pageToken, &result); err != nil {
+			return nil, err
+		}
+		for _, instance := range result.Items {
+			if _, found := members[instance.SelfLink]; found {
+				instances = append(instances, instance)
+			}
+		}
+		if pageToken = result.NextPageToken; pageToken == "" {
+			return instances, nil
+		}
+	}
+}
+
+func (s *gceSource) call(method, path string, result interface{}) error {
+	req, err := http.NewRequest(method, gceComputeURL+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+s.token)
+	body, err := httpGetString(req)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal([]byte(body), result)
+}
@@ -0,0 +1,178 @@
+package discovery
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	. "github.com/weaveworks/weave/common"
+)
+
+const (
+	// LANService is the DNS-SD service under which routers announce
+	// themselves, each as an instance named after its peer name
+	LANService = "_weave._tcp.local."
+	lanTTL     = 120 // seconds
+	lanQueries = 3   // we send, in case some are lost
+)
+
+var (
+	mdnsGroup = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+	// how long we wait for answers after each query
+	lanWait = 300 * time.Millisecond
+)
+
+// LAN announces our router to the others on the local network with
+// multicast DNS, as an instance of LANService, and finds theirs. Since
+// it is meant for a flat network, we don't announce the addresses we
+// can be reached at: others connect to the one our answers come from.
+type LAN struct {
+	name string // our peer name
+	port int
+}
+
+func NewLAN(name string, port int) *LAN {
+	return &LAN{name: name, port: port}
+}
+
+// Start answering queries for LANService
+func (l *LAN) Start() error {
+	conn, err := net.ListenMulticastUDP("udp4", nil, mdnsGroup)
+	if err != nil {
+		return fmt.Errorf("Unable to listen for multicast DNS queries: %s", err)
+	}
+	go l.answer(conn)
+	return nil
+}
+
+func (l *LAN) String() string {
+	return "the local network"
+}
+
+func (l *LAN) answer(conn *net.UDPConn) {
+	buf := make([]byte, 9000)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			Warning.Printf("[discovery] Stopped answering multicast DNS queries: %s", err)
+			return
+		}
+		query := new(dns.Msg)
+		if query.Unpack(buf[:n]) != nil || query.Response {
+			continue
+		}
+		response := l.response(query, from.Port != mdnsGroup.Port)
+		if response == nil {
+			continue
+		}
+		packed, err := response.Pack()
+		if err != nil {
+			Warning.Printf("[discovery] Unable to pack multicast DNS response: %s", err)
+			continue
+		}
+		// queriers other than mDNS responders, as we are when we
+		// look, would like their answers to themselves
+		to := mdnsGroup
+		if from.Port != mdnsGroup.Port {
+			to = from
+		}
+		if _, err := conn.WriteToUDP(packed, to); err != nil {
+			Warning.Printf("[discovery] Unable to send multicast DNS response to %s: %s", to, err)
+		}
+	}
+}
+
+func (l *LAN) instance() string {
+	return l.name + "." + LANService
+}
+
+// Our answer to query, if it asks for instances of LANService, or for
+// ours; legacy queriers, from ports other than mDNS's, would like
+// their query repeated back to them.
+func (l *LAN) response(query *dns.Msg, legacy bool) *dns.Msg {
+	instance := l.instance()
+	target := dns.Fqdn(strings.Replace(l.name, ":", "-", -1) + ".local.")
+	ptr := &dns.PTR{Hdr: dns.RR_Header{Name: LANService, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: lanTTL}, Ptr: instance}
+	srv := &dns.SRV{Hdr: dns.RR_Header{Name: instance, Rrtype: dns.TypeSRV, Class: dns.ClassINET, Ttl: lanTTL}, Port: uint16(l.port), Target: target}
+	txt := &dns.TXT{Hdr: dns.RR_Header{Name: instance, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: lanTTL}, Txt: []string{"peer=" + l.name}}
+	response := new(dns.Msg)
+	for _, q := range query.Question {
+		switch {
+		case strings.EqualFold(q.Name, LANService) && (q.Qtype == dns.TypePTR || q.Qtype == dns.TypeANY):
+			response.Answer = append(response.Answer, ptr)
+			response.Extra = append(response.Extra, srv, txt)
+		case strings.EqualFold(q.Name, instance) && (q.Qtype == dns.TypeSRV || q.Qtype == dns.TypeANY):
+			response.Answer = append(response.Answer, srv)
+		case strings.EqualFold(q.Name, instance) && q.Qtype == dns.TypeTXT:
+			response.Answer = append(response.Answer, txt)
+		}
+	}
+	if len(response.Answer) == 0 {
+		return nil
+	}
+	response.Response = true
+	response.Authoritative = true
+	if legacy {
+		response.Id = query.Id
+		response.Question = query.Question
+	}
+	return response
+}
+
+// Peers asks on the local network for instances of LANService, and
+// gives the routers that answer, other than us
+func (l *LAN) Peers() (map[string]string, error) {
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	query := new(dns.Msg)
+	query.SetQuestion(LANService, dns.TypePTR)
+	query.RecursionDesired = false
+	packed, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+	peers := make(map[string]string)
+	buf := make([]byte, 9000)
+	for i := 0; i < lanQueries; i++ {
+		if _, err := conn.WriteToUDP(packed, mdnsGroup); err != nil {
+			return nil, fmt.Errorf("Unable to send multicast DNS query: %s", err)
+		}
+		conn.SetReadDeadline(time.Now().Add(lanWait))
+		for {
+			n, from, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				break // we have waited long enough
+			}
+			response := new(dns.Msg)
+			if response.Unpack(buf[:n]) != nil || !response.Response {
+				continue
+			}
+			for name, port := range l.instances(response) {
+				peers[net.JoinHostPort(from.IP.String(), fmt.Sprint(port))] = "peer " + name
+			}
+		}
+	}
+	return peers, nil
+}
+
+// The peer names and ports of the instances of LANService other than
+// ours in response
+func (l *LAN) instances(response *dns.Msg) map[string]uint16 {
+	suffix := "." + LANService
+	instances := make(map[string]uint16)
+	for _, rr := range append(response.Answer, response.Extra...) {
+		srv, ok := rr.(*dns.SRV)
+		if !ok || !strings.HasSuffix(strings.ToLower(srv.Hdr.Name), suffix) {
+			continue
+		}
+		if name := srv.Hdr.Name[:len(srv.Hdr.Name)-len(suffix)]; name != l.name {
+			instances[name] = srv.Port
+		}
+	}
+	return instances
+}
@@ -0,0 +1,311 @@
+package discovery
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Store is a key/value store, such as the cluster store Docker is
+// configured with, in which routers register themselves and look for
+// each other.
+type Store interface {
+	// Register sets key to value, until ttl has passed without it
+	// being registered again
+	Register(key, value string, ttl time.Duration) error
+	// List gives the values of the keys under prefix, by key
+	List(prefix string) (map[string]string, error)
+}
+
+// Watcher is a store that can tell us when keys change, so that we
+// needn't wait until we next look to find routers coming and going
+type Watcher interface {
+	// Watch returns once a key under prefix has changed since it was
+	// last listed, or once wait has passed
+	Watch(prefix string, wait time.Duration) error
+}
+
+// NewStore makes a store from a URL as given to Docker's
+// --cluster-store: consul://<host>:<port>[/<path>] or
+// etcd://<host>:<port>[,<host>:<port>...][/<path>]; keys go under
+// path, if given. token://<token>[@<host>[:<port>]] is a rendezvous
+// service, as for Docker Swarm's token discovery.
+func NewStore(storeURL string) (Store, error) {
+	u, err := url.Parse(storeURL)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid store URL %q: %s", storeURL, err)
+	}
+	if u.Scheme == "token" {
+		return newTokenStore(u)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("Invalid store URL %q: no host given", storeURL)
+	}
+	hosts := strings.Split(u.Host, ",")
+	prefix := strings.Trim(u.Path, "/")
+	switch u.Scheme {
+	case "consul":
+		return &consulStore{httpStore: httpStore{hosts: hosts, prefix: prefix, indexHeader: "X-Consul-Index"}}, nil
+	case "etcd":
+		return &etcdStore{httpStore{hosts: hosts, prefix: prefix, indexHeader: "X-Etcd-Index"}, make(map[string]string)}, nil
+	}
+	return nil, fmt.Errorf("Unsupported store %q: expected consul://, etcd:// or token://", storeURL)
+}
+
+// Both consul and etcd have HTTP APIs, so that is what we use, trying
+// each of the hosts we know of in turn. Both also number their changes,
+// and give the number they are up to in a header of every response,
+// which we watch for changes beyond.
+type httpStore struct {
+	sync.Mutex
+	scheme      string // http if blank
+	hosts       []string
+	prefix      string
+	indexHeader string
+	index       uint64 // the last one we were given, accessed atomically
+}
+
+func (s *httpStore) key(key string) string {
+	if s.prefix == "" {
+		return key
+	}
+	return s.prefix + "/" + key
+}
+
+type statusError struct {
+	status int
+	body   string
+}
+
+func (err *statusError) Error() string {
+	return fmt.Sprintf("%d %s: %s", err.status, http.StatusText(err.status), strings.TrimSpace(err.body))
+}
+
+func isNotFound(err error) bool {
+	statusErr, ok := err.(*statusError)
+	return ok && statusErr.status == http.StatusNotFound
+}
+
+func (s *httpStore) call(method, path, body string, result interface{}) error {
+	return s.callWith(http.DefaultClient, method, path, body, result)
+}
+
+func (s *httpStore) callWith(client *http.Client, method, path, body string, result interface{}) error {
+	var err error
+	for _, host := range s.hosts {
+		if err = s.callHost(client, host, method, path, body, result); err == nil {
+			return nil
+		} else if _, ok := err.(*statusError); ok {
+			// the store answered; another host would say the same
+			return err
+		}
+	}
+	return err
+}
+
+func (s *httpStore) callHost(client *http.Client, host, method, path, body string, result interface{}) error {
+	scheme := s.scheme
+	if scheme == "" {
+		scheme = "http"
+	}
+	req, err := http.NewRequest(method, scheme+"://"+host+path, strings.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if body != "" {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if index, err := strconv.ParseUint(resp.Header.Get(s.indexHeader), 10, 64); err == nil {
+		atomic.StoreUint64(&s.index, index)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return &statusError{resp.StatusCode, string(msg)}
+	}
+	if result == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+// Wait for a change beyond the last index we were given, with a
+// request of the path for that index; a change is answered at once,
+// otherwise the store or we give up after wait.
+func (s *httpStore) watch(path func(index uint64) string, wait time.Duration) error {
+	index := atomic.LoadUint64(&s.index)
+	if index == 0 {
+		return fmt.Errorf("Unable to watch for changes: no index to watch from")
+	}
+	client := &http.Client{Timeout: wait + time.Second}
+	err := s.callWith(client, "GET", path(index), "", nil)
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() || isNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// etcd's v2 API has keys expire of their own accord. We keep them
+// from expiring without changing them, once set, so as not to wake
+// every router watching them each time we do so.
+type etcdStore struct {
+	httpStore
+	values map[string]string // as we last set them
+}
+
+func (s *etcdStore) Register(key, value string, ttl time.Duration) error {
+	s.Lock()
+	defer s.Unlock()
+	ttlSecs := fmt.Sprint(int(ttl.Seconds()))
+	if s.values[key] == value {
+		form := url.Values{"ttl": {ttlSecs}, "refresh": {"true"}, "prevExist": {"true"}}
+		err := s.call("PUT", "/v2/keys/"+s.key(key), form.Encode(), nil)
+		if !isNotFound(err) {
+			return err
+		}
+		// it expired after all
+	}
+	delete(s.values, key)
+	form := url.Values{"value": {value}, "ttl": {ttlSecs}}
+	if err := s.call("PUT", "/v2/keys/"+s.key(key), form.Encode(), nil); err != nil {
+		return err
+	}
+	s.values[key] = value
+	return nil
+}
+
+// etcd has us wait for the change after the index we were given; it
+// doesn't give up of its own accord
+func (s *etcdStore) Watch(prefix string, wait time.Duration) error {
+	return s.watch(func(index uint64) string {
+		return fmt.Sprintf("/v2/keys/%s?wait=true&recursive=true&waitIndex=%d", s.key(prefix), index+1)
+	}, wait)
+}
+
+type etcdNode struct {
+	Key   string     `json:"key"`
+	Value string     `json:"value"`
+	Dir   bool       `json:"dir"`
+	Nodes []etcdNode `json:"nodes"`
+}
+
+func (s *etcdStore) List(prefix string) (map[string]string, error) {
+	var result struct {
+		Node etcdNode `json:"node"`
+	}
+	values := make(map[string]string)
+	err := s.call("GET", "/v2/keys/"+s.key(prefix)+"?recursive=true", "", &result)
+	if isNotFound(err) {
+		return values, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var walk func(nodes []etcdNode)
+	walk = func(nodes []etcdNode) {
+		for _, node := range nodes {
+			if node.Dir {
+				walk(node.Nodes)
+			} else {
+				values[strings.TrimPrefix(node.Key, "/"+s.key(""))] = node.Value
+			}
+		}
+	}
+	walk(result.Node.Nodes)
+	return values, nil
+}
+
+// consul's keys only expire with the session holding them, so we keep
+// one of those going, which deletes our key when it expires, and which
+// we renew without changing the key.
+type consulStore struct {
+	httpStore
+	session string
+	values  map[string]string // as we last set them, in this session
+}
+
+func (s *consulStore) renewSession(ttl time.Duration) error {
+	if s.session != "" {
+		if err := s.call("PUT", "/v1/session/renew/"+s.session, "", nil); err == nil {
+			return nil
+		}
+		s.session = ""
+	}
+	s.values = make(map[string]string)
+	var session struct {
+		ID string
+	}
+	// consul won't have TTLs below 10s
+	if ttl < 10*time.Second {
+		ttl = 10 * time.Second
+	}
+	body := fmt.Sprintf(`{"Name":"weave","Behavior":"delete","LockDelay":"0s","TTL":"%ds"}`, int(ttl.Seconds()))
+	if err := s.call("PUT", "/v1/session/create", body, &session); err != nil {
+		return err
+	}
+	s.session = session.ID
+	return nil
+}
+
+func (s *consulStore) Register(key, value string, ttl time.Duration) error {
+	s.Lock()
+	defer s.Unlock()
+	if err := s.renewSession(ttl); err != nil {
+		return err
+	}
+	if value == s.values[key] {
+		return nil
+	}
+	var acquired bool
+	if err := s.call("PUT", "/v1/kv/"+s.key(key)+"?acquire="+s.session, value, &acquired); err != nil {
+		return err
+	}
+	if !acquired {
+		// e.g. our session from before a restart still holds it
+		return fmt.Errorf("Unable to acquire %s in consul", key)
+	}
+	s.values[key] = value
+	return nil
+}
+
+func (s *consulStore) List(prefix string) (map[string]string, error) {
+	var pairs []struct {
+		Key   string
+		Value string // base64
+	}
+	values := make(map[string]string)
+	err := s.call("GET", "/v1/kv/"+s.key(prefix)+"?recurse", "", &pairs)
+	if isNotFound(err) {
+		return values, nil
+	} else if err != nil {
+		return nil, err
+	}
+	for _, pair := range pairs {
+		value, err := base64.StdEncoding.DecodeString(pair.Value)
+		if err != nil {
+			return nil, err
+		}
+		values[strings.TrimPrefix(pair.Key, s.key(""))] = string(value)
+	}
+	return values, nil
+}
+
+// consul has us wait for the index after the one we were given to be
+// reached, giving up after as long as we ask
+func (s *consulStore) Watch(prefix string, wait time.Duration) error {
+	return s.watch(func(index uint64) string {
+		return fmt.Sprintf("/v1/kv/%s?recurse&wait=%dms&index=%d", s.key(prefix), wait/time.Millisecond, index)
+	}, wait)
+}
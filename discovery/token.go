@@ -0,0 +1,61 @@
+package discovery
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// DefaultRendezvous is the rendezvous service for tokens given without
+// one of their own
+const DefaultRendezvous = "discovery.hub.docker.com"
+
+// tokenStore keeps its values at a rendezvous service, as Docker
+// Swarm's token discovery does: routers sharing a token register
+// their addresses there, for a while, and list those registered, all
+// in one list for the token. Only values under peersPrefix are kept,
+// by value, since the service has no keys.
+type tokenStore struct {
+	httpStore
+	token string
+}
+
+func newTokenStore(u *url.URL) (Store, error) {
+	if u.User != nil {
+		// token://<token>@<host>[:<port>], our own service
+		if u.Host == "" {
+			return nil, fmt.Errorf("Invalid token URL %q: no rendezvous host given", u)
+		}
+		return &tokenStore{httpStore{hosts: []string{u.Host}}, u.User.Username()}, nil
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("Invalid token URL %q: no token given", u)
+	}
+	return &tokenStore{httpStore{scheme: "https", hosts: []string{DefaultRendezvous}}, u.Host}, nil
+}
+
+func (s *tokenStore) Register(key, value string, ttl time.Duration) error {
+	if !strings.HasPrefix(key, peersPrefix) {
+		return fmt.Errorf("Unable to register %s: a rendezvous service only keeps peers", key)
+	}
+	return s.call("POST", fmt.Sprintf("/v1/clusters/%s?ttl=%d", url.QueryEscape(s.token), int(ttl.Seconds())), value, nil)
+}
+
+func (s *tokenStore) List(prefix string) (map[string]string, error) {
+	values := make(map[string]string)
+	if prefix != peersPrefix {
+		return values, nil
+	}
+	var addrs []string
+	err := s.call("GET", "/v1/clusters/"+url.QueryEscape(s.token), "", &addrs)
+	if isNotFound(err) {
+		return values, nil
+	} else if err != nil {
+		return nil, err
+	}
+	for _, addr := range addrs {
+		values[peersPrefix+addr] = addr
+	}
+	return values, nil
+}
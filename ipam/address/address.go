@@ -52,3 +52,24 @@ func Subtract(a, b Address) Offset {
 	common.Assert(a >= b)
 	return Offset(a - b)
 }
+
+// CIDRs returns the fewest CIDR blocks that, between them, cover r
+// exactly, in order
+func (r Range) CIDRs() []*net.IPNet {
+	var cidrs []*net.IPNet
+	start, end := uint64(r.Start), uint64(r.End)
+	for start < end {
+		// the biggest block starting at start, aligned, that fits
+		size := uint64(1)
+		for start%(size*2) == 0 && start+size*2 <= end {
+			size *= 2
+		}
+		ones := 32
+		for s := size; s > 1; s /= 2 {
+			ones--
+		}
+		cidrs = append(cidrs, &net.IPNet{IP: Address(start).IP4(), Mask: net.CIDRMask(ones, 32)})
+		start += size
+	}
+	return cidrs
+}
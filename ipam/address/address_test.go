@@ -0,0 +1,25 @@
+package address
+
+import (
+	"strings"
+	"testing"
+
+	wt "github.com/weaveworks/weave/testing"
+)
+
+func TestCIDRs(t *testing.T) {
+	cidrs := func(start, end string) string {
+		s, _ := ParseIP(start)
+		e, _ := ParseIP(end)
+		var ss []string
+		for _, cidr := range (Range{Start: s, End: e}).CIDRs() {
+			ss = append(ss, cidr.String())
+		}
+		return strings.Join(ss, " ")
+	}
+	wt.AssertEqualString(t, cidrs("10.32.0.0", "10.48.0.0"), "10.32.0.0/12", "aligned")
+	wt.AssertEqualString(t, cidrs("10.32.0.0", "10.32.0.0"), "", "empty")
+	wt.AssertEqualString(t, cidrs("10.32.0.1", "10.32.0.8"), "10.32.0.1/32 10.32.0.2/31 10.32.0.4/30", "unaligned")
+	wt.AssertEqualString(t, cidrs("10.32.128.0", "10.33.64.0"), "10.32.128.0/17 10.33.0.0/18", "across a boundary")
+	wt.AssertEqualString(t, cidrs("0.0.0.0", "255.255.255.255"), "0.0.0.0/1 128.0.0.0/2 192.0.0.0/3 224.0.0.0/4 240.0.0.0/5 248.0.0.0/6 252.0.0.0/7 254.0.0.0/8 255.0.0.0/9 255.128.0.0/10 255.192.0.0/11 255.224.0.0/12 255.240.0.0/13 255.248.0.0/14 255.252.0.0/15 255.254.0.0/16 255.255.0.0/17 255.255.128.0/18 255.255.192.0/19 255.255.224.0/20 255.255.240.0/21 255.255.248.0/22 255.255.252.0/23 255.255.254.0/24 255.255.255.0/25 255.255.255.128/26 255.255.255.192/27 255.255.255.224/28 255.255.255.240/29 255.255.255.248/30 255.255.255.252/31 255.255.255.254/32", "nearly everything")
+}
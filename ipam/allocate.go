@@ -25,6 +25,7 @@ func (g *allocate) Try(alloc *Allocator) bool {
 
 	// If we have previously stored an address for this container, return it.
 	if addr, found := alloc.owned[g.ident]; found {
+		delete(alloc.dead, g.ident) // evidently it's alive after all
 		g.resultChan <- allocateResult{addr, nil}
 		return true
 	}
@@ -10,6 +10,8 @@ import (
 	"time"
 
 	"github.com/weaveworks/weave/common"
+	"github.com/weaveworks/weave/common/events"
+	"github.com/weaveworks/weave/common/tracing"
 	"github.com/weaveworks/weave/ipam/address"
 	"github.com/weaveworks/weave/ipam/paxos"
 	"github.com/weaveworks/weave/ipam/ring"
@@ -21,8 +23,14 @@ import (
 const (
 	msgSpaceRequest = iota
 	msgRingUpdate
+	msgRingViewRequest
+	msgRingViewResponse
 
 	paxosInterval = time.Second * 5
+
+	// How long we hang on to the addresses of a container that has
+	// died, in case it is restarted
+	containerDiedTimeout = time.Second * 30
 )
 
 // operation represents something which Allocator wants to do, but
@@ -52,45 +60,100 @@ type Allocator struct {
 	ring             *ring.Ring                 // information on ranges owned by all peers
 	space            space.Space                // more detail on ranges owned by us
 	owned            map[string]address.Address // who owns what address, indexed by container-ID
+	dead             map[string]time.Time       // containers we heard were dead, and when
 	nicknames        map[router.PeerName]string // so we can map nicknames for rmpeer
 	pendingAllocates []operation                // held until we get some free space
 	pendingClaims    []operation                // held until we know who owns the space
 	gossip           router.Gossip              // our link to the outside world for sending messages
 	paxos            *paxos.Node
 	paxosTicker      *time.Ticker
-	shuttingDown     bool // to avoid doing any requests while trying to shut down
+	consensusSpan    *tracing.Span   // from first proposing until we have a ring
+	shuttingDown     bool            // to avoid doing any requests while trying to shut down
+	ringCheck        *ringCheck      // consistency check in progress, if any
+	readyChans       []chan struct{} // closed once we have a ring
+	rangeAuto        bool            // whether the range was picked automatically, and may yet give way to another
+	rangeFrom        router.PeerName // which picked it, if it was picked automatically
+	checkRange       func(*net.IPNet) error
+	progress         *router.Progress // of the actor, for the watchdog
 	now              func() time.Time
 }
 
 // NewAllocator creates and initialises a new Allocator
 func NewAllocator(ourName router.PeerName, ourUID router.PeerUID, ourNickname string, subnetCIDR string, quorum uint) (*Allocator, error) {
+	alloc := &Allocator{
+		ourName:   ourName,
+		owned:     make(map[string]address.Address),
+		dead:      make(map[string]time.Time),
+		paxos:     paxos.NewNode(ourName, ourUID, quorum),
+		nicknames: map[router.PeerName]string{ourName: ourNickname},
+		now:       time.Now,
+	}
+	if err := alloc.setRange(subnetCIDR); err != nil {
+		return nil, err
+	}
+	return alloc, nil
+}
+
+func (alloc *Allocator) setRange(subnetCIDR string) error {
 	_, subnet, err := net.ParseCIDR(subnetCIDR)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	if subnet.IP.To4() == nil {
-		return nil, errors.New("Non-IPv4 address not supported")
+		return errors.New("Non-IPv4 address not supported")
 	}
 	// Get the size of the network from the mask
 	ones, bits := subnet.Mask.Size()
 	var subnetSize address.Offset = 1 << uint(bits-ones)
 	if subnetSize < 4 {
-		return nil, errors.New("Allocation subnet too small")
+		return errors.New("Allocation subnet too small")
 	}
-	subnetStart := address.FromIP4(subnet.IP)
-	alloc := &Allocator{
-		ourName:     ourName,
-		subnetStart: subnetStart,
-		subnetSize:  subnetSize,
-		prefixLen:   ones,
-		// per RFC 1122, don't allocate the first and last address in the subnet
-		ring:      ring.New(address.Add(subnetStart, 1), address.Add(subnetStart, subnetSize-1), ourName),
-		owned:     make(map[string]address.Address),
-		paxos:     paxos.NewNode(ourName, ourUID, quorum),
-		nicknames: map[router.PeerName]string{ourName: ourNickname},
-		now:       time.Now,
+	alloc.subnetStart = address.FromIP4(subnet.IP)
+	alloc.subnetSize = subnetSize
+	alloc.prefixLen = ones
+	// per RFC 1122, don't allocate the first and last address in the subnet
+	alloc.ring = ring.New(address.Add(alloc.subnetStart, 1), address.Add(alloc.subnetStart, subnetSize-1), alloc.ourName)
+	return nil
+}
+
+// AutoRange says that we picked the range automatically, so that it
+// gives way, until the peers have agreed how to divide it, to one
+// another peer was given, or is using already, or picked, if that peer
+// has a lower name, so that the peers all end up with the same range.
+// Call before Start.
+func (alloc *Allocator) AutoRange() {
+	alloc.rangeAuto = true
+	alloc.rangeFrom = alloc.ourName
+}
+
+// CheckRange has check say, whenever the range we allocate from
+// changes, whether the new one suits this host; we only warn if it
+// doesn't, since by then we are running. Call before Start.
+func (alloc *Allocator) CheckRange(check func(*net.IPNet) error) {
+	alloc.checkRange = check
+}
+
+// Watch has the watchdog watch the allocator's actor, which can't be
+// restarted should it stall. Call before Start.
+func (alloc *Allocator) Watch(watchdog *router.Watchdog) {
+	alloc.progress = watchdog.Watch("IPAM allocator", nil)
+}
+
+// Range (Sync) returns the range we allocate from, and the peer that
+// picked it automatically, or UnknownPeerName if it was given to us,
+// or to the peers we adopted it from
+func (alloc *Allocator) Range() (*net.IPNet, router.PeerName) {
+	resultChan := make(chan *net.IPNet)
+	var from router.PeerName
+	alloc.actionChan <- func() {
+		from = alloc.rangeFrom
+		resultChan <- alloc.subnet()
 	}
-	return alloc, nil
+	return <-resultChan, from
+}
+
+func (alloc *Allocator) subnet() *net.IPNet {
+	return &net.IPNet{IP: alloc.subnetStart.IP4(), Mask: net.CIDRMask(alloc.prefixLen, 32)}
 }
 
 // Start runs the allocator goroutine
@@ -222,20 +285,141 @@ func (alloc *Allocator) Free(ident string) error {
 	return alloc.free(ident)
 }
 
-// ContainerDied is provided to satisfy the updater interface; does a free underneath.  Async.
+// FreeAddress (Sync) - release addr, whoever holds it; for callers
+// that keep track of addresses rather than of who they gave them to
+func (alloc *Allocator) FreeAddress(addr address.Address) error {
+	errChan := make(chan error)
+	alloc.actionChan <- func() {
+		ident := alloc.findOwner(addr)
+		if ident == "" {
+			errChan <- fmt.Errorf("Free: %s is not allocated", addr)
+			return
+		}
+		alloc.space.Free(addr)
+		publishAddressEvent(events.AddressFreed, ident, addr)
+		delete(alloc.owned, ident)
+		delete(alloc.dead, ident)
+		errChan <- nil
+	}
+	return <-errChan
+}
+
+// Ready (Async) returns a channel that is closed once the peers have
+// agreed how to divide up the address range, so that we can allocate
+// from it; we ask them to, if nobody has yet.
+func (alloc *Allocator) Ready() <-chan struct{} {
+	readyChan := make(chan struct{})
+	alloc.actionChan <- func() {
+		if !alloc.ring.Empty() {
+			close(readyChan)
+			return
+		}
+		alloc.readyChans = append(alloc.readyChans, readyChan)
+		alloc.establishRing()
+	}
+	return readyChan
+}
+
+// ContainerDied is provided to satisfy the updater interface. The
+// container's addresses are released after containerDiedTimeout,
+// unless it is started again in the meantime.  Sync.
 func (alloc *Allocator) ContainerDied(ident string) error {
-	alloc.debugln("Container", ident, "died; releasing addresses")
+	doneChan := make(chan struct{})
+	alloc.actionChan <- func() {
+		if _, found := alloc.owned[ident]; found {
+			alloc.debugln("Container", ident, "died; noting to release addresses if it doesn't restart")
+			alloc.dead[ident] = alloc.now()
+		}
+		// Nobody is waiting for these any more
+		alloc.cancelOpsFor(&alloc.pendingAllocates, ident)
+		alloc.cancelOpsFor(&alloc.pendingClaims, ident)
+		doneChan <- struct{}{}
+	}
+	<-doneChan
+	return nil
+}
+
+// ContainerStarted is provided to satisfy the updater interface; a
+// restarted container keeps the addresses it had.  Async.
+func (alloc *Allocator) ContainerStarted(ident string) {
+	alloc.actionChan <- func() {
+		if _, found := alloc.dead[ident]; found {
+			alloc.debugln("Container", ident, "restarted; keeping its addresses")
+			delete(alloc.dead, ident)
+		}
+	}
+}
+
+// ContainerDestroyed is provided to satisfy the updater interface;
+// does a free underneath.  Sync.
+func (alloc *Allocator) ContainerDestroyed(ident string) error {
+	alloc.debugln("Container", ident, "destroyed; releasing addresses")
 	return alloc.free(ident)
 }
 
+// ContainerIdents (Sync) - idents of everything we hold addresses
+// for; provided to satisfy the updater ContainerLister interface.
+func (alloc *Allocator) ContainerIdents() []string {
+	resultChan := make(chan []string)
+	alloc.actionChan <- func() {
+		idents := make([]string, 0, len(alloc.owned))
+		for ident := range alloc.owned {
+			idents = append(idents, ident)
+		}
+		resultChan <- idents
+	}
+	return <-resultChan
+}
+
+// Owned (Sync) - the addresses held, by ident.
+func (alloc *Allocator) Owned() map[string]address.Address {
+	resultChan := make(chan map[string]address.Address)
+	alloc.actionChan <- func() {
+		owned := make(map[string]address.Address, len(alloc.owned))
+		for ident, addr := range alloc.owned {
+			owned[ident] = addr
+		}
+		resultChan <- owned
+	}
+	return <-resultChan
+}
+
+// OwnedRanges (Sync) - the ranges of addresses this peer owns, whether
+// free or not, in order.
+func (alloc *Allocator) OwnedRanges() []address.Range {
+	resultChan := make(chan []address.Range)
+	alloc.actionChan <- func() {
+		resultChan <- alloc.space.OwnedRanges()
+	}
+	return <-resultChan
+}
+
+// Lookup (Sync) - the address ident holds, if any, without
+// allocating one.
+func (alloc *Allocator) Lookup(ident string) (address.Address, bool) {
+	type result struct {
+		addr  address.Address
+		found bool
+	}
+	resultChan := make(chan result)
+	alloc.actionChan <- func() {
+		addr, found := alloc.owned[ident]
+		resultChan <- result{addr, found}
+	}
+	r := <-resultChan
+	return r.addr, r.found
+}
+
 func (alloc *Allocator) free(ident string) error {
 	errChan := make(chan error)
 	alloc.actionChan <- func() {
 		addr, found := alloc.owned[ident]
 		if found {
 			alloc.space.Free(addr)
+			publishAddressEvent(events.AddressFreed, ident, addr)
 		}
 		delete(alloc.owned, ident)
+		delete(alloc.dead, ident)
 
 		// Also remove any pending ops
 		found = alloc.cancelOpsFor(&alloc.pendingAllocates, ident) || found
@@ -339,6 +523,13 @@ func (alloc *Allocator) OnGossipUnicast(sender router.PeerName, msg []byte) erro
 			resultChan <- nil
 		case msgRingUpdate:
 			resultChan <- alloc.update(msg[1:])
+		case msgRingViewRequest:
+			alloc.sendRingView(sender)
+			resultChan <- nil
+		case msgRingViewResponse:
+			resultChan <- alloc.receiveRingView(sender, msg[1:])
+		default:
+			resultChan <- fmt.Errorf("unknown message type %d", msg[0])
 		}
 	}
 	return <-resultChan
@@ -362,12 +553,22 @@ type gossipState struct {
 
 	Paxos paxos.GossipState
 	Ring  *ring.Ring
+
+	// The range we allocate from, whether it was picked automatically
+	// and may yet give way to another, and which peer picked it, if
+	// one did; absent from the gossip of older peers
+	Range     string
+	RangeAuto bool
+	RangeFrom router.PeerName
 }
 
 func (alloc *Allocator) encode() []byte {
 	data := gossipState{
 		Now:       alloc.now().Unix(),
 		Nicknames: alloc.nicknames,
+		Range:     alloc.subnet().String(),
+		RangeAuto: alloc.rangeAuto && alloc.ring.Empty(),
+		RangeFrom: alloc.rangeFrom,
 	}
 
 	// We're only interested in Paxos until we have a Ring.
@@ -431,6 +632,8 @@ func (alloc *Allocator) SetInterfaces(gossip router.Gossip) {
 // ACTOR server
 
 func (alloc *Allocator) actorLoop(actionChan <-chan func()) {
+	deadTicker := time.NewTicker(containerDiedTimeout / 2)
+	defer deadTicker.Stop()
 	for {
 		var tickChan <-chan time.Time
 		if alloc.paxosTicker != nil {
@@ -442,13 +645,19 @@ func (alloc *Allocator) actorLoop(actionChan <-chan func()) {
 			if action == nil {
 				return
 			}
+			alloc.progress.Begin()
 			action()
 		case <-tickChan:
+			alloc.progress.Begin()
 			alloc.propose()
+		case <-deadTicker.C:
+			alloc.progress.Begin()
+			alloc.removeDeadContainers()
 		}
 
 		alloc.assertInvariants()
 		alloc.reportFreeSpace()
+		alloc.progress.End()
 	}
 }
 
@@ -493,6 +702,7 @@ func (alloc *Allocator) establishRing() {
 		return
 	}
 
+	alloc.consensusSpan = tracing.Start("ipam.consensus", "peer", alloc.ourName.String())
 	alloc.propose()
 	if cons := alloc.consensus(); cons != nil {
 		// If the quorum was 1, then proposing immediately
@@ -506,7 +716,9 @@ func (alloc *Allocator) establishRing() {
 
 func (alloc *Allocator) createRing(peers []router.PeerName) {
 	alloc.debugln("Paxos consensus:", peers)
-	alloc.ring.ClaimForPeers(normalizeConsensus(peers))
+	peers = normalizeConsensus(peers)
+	alloc.consensusSpan.SetAttribute("peers", fmt.Sprint(len(peers)))
+	alloc.ring.ClaimForPeers(peers)
 	alloc.gossip.GossipBroadcast(alloc.Gossip())
 	alloc.ringUpdated()
 }
@@ -515,6 +727,8 @@ func (alloc *Allocator) ringUpdated() {
 	// When we have a ring, we don't need paxos any more
 	if alloc.paxos != nil {
 		alloc.paxos = nil
+		alloc.consensusSpan.End(nil)
+		alloc.consensusSpan = nil
 
 		if alloc.paxosTicker != nil {
 			alloc.paxosTicker.Stop()
@@ -524,6 +738,13 @@ func (alloc *Allocator) ringUpdated() {
 
 	alloc.space.UpdateRanges(alloc.ring.OwnedRanges())
 	alloc.tryPendingOps()
+
+	if !alloc.ring.Empty() {
+		for _, readyChan := range alloc.readyChans {
+			close(readyChan)
+		}
+		alloc.readyChans = nil
+	}
 }
 
 // For compatibility with sort.Interface
@@ -587,6 +808,8 @@ func (alloc *Allocator) update(msg []byte) error {
 		alloc.nicknames[peer] = nickname
 	}
 
+	alloc.adoptRange(data)
+
 	// only one of Ring and Paxos should be present.  And we
 	// shouldn't get updates for a empty Ring. But tolerate
 	// them just in case.
@@ -615,6 +838,42 @@ func (alloc *Allocator) update(msg []byte) error {
 	return nil
 }
 
+// Give way to the range in data, if ours was picked automatically and
+// theirs should win: because they have a ring, or were given it, or
+// picked it, but have a lower name than the peer that picked ours
+func (alloc *Allocator) adoptRange(data gossipState) {
+	if !alloc.rangeAuto || !alloc.ring.Empty() || data.Range == "" || data.Range == alloc.subnet().String() {
+		return
+	}
+	if data.Ring == nil && data.RangeAuto && data.RangeFrom >= alloc.rangeFrom {
+		return
+	}
+	if err := alloc.setRange(data.Range); err != nil {
+		alloc.infof("Unable to adopt IP range %s: %s", data.Range, err)
+		return
+	}
+	// once they have a ring, or if they were given the range, it is
+	// settled
+	alloc.rangeAuto = data.Ring == nil && data.RangeAuto
+	alloc.rangeFrom = data.RangeFrom
+	if alloc.rangeFrom == router.UnknownPeerName {
+		alloc.infof("Adopted IP range %s, as given to other peers", data.Range)
+	} else {
+		alloc.infof("Adopted IP range %s, picked by %s", data.Range, data.RangeFrom)
+	}
+	alloc.rangeChanged()
+	alloc.gossip.GossipBroadcast(alloc.Gossip())
+}
+
+func (alloc *Allocator) rangeChanged() {
+	if alloc.checkRange == nil {
+		return
+	}
+	if err := alloc.checkRange(alloc.subnet()); err != nil {
+		common.Warning.Printf("[allocator %s] %s", alloc.ourName, err)
+	}
+}
+
 func (alloc *Allocator) donateSpace(to router.PeerName) {
 	// No matter what we do, we'll send a unicast gossip
 	// of our ring back to tha chap who asked for space.
@@ -670,6 +929,29 @@ func (alloc *Allocator) reportFreeSpace() {
 
 func (alloc *Allocator) addOwned(ident string, addr address.Address) {
 	alloc.owned[ident] = addr
+	publishAddressEvent(events.AddressAllocated, ident, addr)
+}
+
+func publishAddressEvent(eventType string, ident string, addr address.Address) {
+	events.Publish(eventType, map[string]string{"container": ident, "address": addr.String()})
+}
+
+// Release the addresses of containers that died more than
+// containerDiedTimeout ago and haven't been started since
+func (alloc *Allocator) removeDeadContainers() {
+	cutoff := alloc.now().Add(-containerDiedTimeout)
+	for ident, timeOfDeath := range alloc.dead {
+		if timeOfDeath.After(cutoff) {
+			continue
+		}
+		if addr, found := alloc.owned[ident]; found {
+			alloc.debugln("Releasing", addr, "held by dead container", ident)
+			alloc.space.Free(addr)
+			delete(alloc.owned, ident)
+			publishAddressEvent(events.AddressFreed, ident, addr)
+		}
+		delete(alloc.dead, ident)
+	}
 }
 
 func (alloc *Allocator) findOwner(addr address.Address) string {
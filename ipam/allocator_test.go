@@ -3,6 +3,7 @@ package ipam
 import (
 	"fmt"
 	"math/rand"
+	"reflect"
 	"sync"
 	"testing"
 	"time"
@@ -46,15 +47,72 @@ func TestAllocFree(t *testing.T) {
 	addr1a, _ := alloc.Allocate(container1, nil)
 	wt.AssertEqualString(t, addr1a.String(), testAddr1, "address")
 
+	// Looking up what a container holds doesn't allocate anything
+	addr1b, found := alloc.Lookup(container1)
+	wt.AssertTrue(t, found, "lookup")
+	wt.AssertEqualString(t, addr1b.String(), testAddr1, "address")
+	_, found = alloc.Lookup(container3)
+	wt.AssertFalse(t, found, "lookup of container without address")
+
 	// Now free the first one, and we should get it back when we ask
 	wt.AssertSuccess(t, alloc.Free(container1))
 	addr3, _ := alloc.Allocate(container3, nil)
 	wt.AssertEqualString(t, addr3.String(), testAddr1, "address")
 
+	// Addresses can also be freed by address, whoever holds them
+	wt.AssertSuccess(t, alloc.FreeAddress(addr3))
+	wt.AssertTrue(t, alloc.FreeAddress(addr3) != nil, "free unallocated address")
+	addr3, _ = alloc.Allocate(container3, nil)
+	wt.AssertEqualString(t, addr3.String(), testAddr1, "address")
+
 	alloc.ContainerDied(container2)
 	alloc.ContainerDied(container3)
-	alloc.String() // force sync-up after async call
-	wt.AssertEquals(t, alloc.space.NumFreeAddresses(), address.Offset(spaceSize))
+	// addresses are held on to for a while in case the containers restart
+	var free address.Offset
+	alloc.inActor(func() { free = alloc.space.NumFreeAddresses() })
+	wt.AssertEquals(t, free, address.Offset(spaceSize-2))
+	alloc.inActor(func() {
+		alloc.now = func() time.Time { return time.Now().Add(containerDiedTimeout) }
+		alloc.removeDeadContainers()
+		free = alloc.space.NumFreeAddresses()
+	})
+	wt.AssertEquals(t, free, address.Offset(spaceSize))
+}
+
+func TestContainerRestart(t *testing.T) {
+	const (
+		container1 = "abcdef"
+		container2 = "baddf00d"
+		universe   = "10.0.3.0/28"
+	)
+
+	alloc := makeAllocatorWithMockGossip(t, "01:00:00:01:00:00", universe, 1)
+	defer alloc.Stop()
+
+	alloc.claimRingForTesting()
+	addr1, _ := alloc.Allocate(container1, nil)
+	addr2, _ := alloc.Allocate(container2, nil)
+
+	alloc.ContainerDied(container1)
+	alloc.ContainerStarted(container1)
+	alloc.ContainerDied(container2)
+	alloc.inActor(func() {
+		alloc.now = func() time.Time { return time.Now().Add(containerDiedTimeout) }
+		alloc.removeDeadContainers()
+	})
+
+	// The restarted container keeps its address...
+	addr1a, _ := alloc.Allocate(container1, nil)
+	wt.AssertEqualString(t, addr1a.String(), addr1.String(), "address after restart")
+	// ...whereas the other one was released
+	var owner string
+	alloc.inActor(func() { owner = alloc.findOwner(addr2) })
+	wt.AssertEqualString(t, owner, "", "owner of released address")
+
+	// Destroying a container releases its address straight away
+	wt.AssertSuccess(t, alloc.ContainerDestroyed(container1))
+	alloc.inActor(func() { owner = alloc.findOwner(addr1) })
+	wt.AssertEqualString(t, owner, "", "owner of destroyed container's address")
 }
 
 func TestBootstrap(t *testing.T) {
@@ -115,6 +173,28 @@ func TestBootstrap(t *testing.T) {
 	CheckAllExpectedMessagesSent(alloc1, alloc2)
 }
 
+func TestReady(t *testing.T) {
+	alloc := makeAllocatorWithMockGossip(t, "01:00:00:01:00:00", "10.0.3.0/28", 1)
+	defer alloc.Stop()
+
+	// With a quorum of one, asking is enough to get consensus
+	ExpectBroadcastMessage(alloc, nil)
+	ExpectBroadcastMessage(alloc, nil)
+	select {
+	case <-alloc.Ready():
+	case <-time.After(10 * time.Second):
+		wt.Fatalf(t, "Allocator not ready")
+	}
+	CheckAllExpectedMessagesSent(alloc)
+
+	// and once we have a ring, we're ready straight away
+	select {
+	case <-alloc.Ready():
+	case <-time.After(10 * time.Second):
+		wt.Fatalf(t, "Allocator not ready")
+	}
+}
+
 func TestAllocatorClaim(t *testing.T) {
 	const (
 		container1 = "abcdef"
@@ -451,3 +531,89 @@ func TestGossipSkew(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestRingCheck(t *testing.T) {
+	const (
+		cidr = "10.0.1.7/22"
+	)
+	allocs, gossipRouter := makeNetworkOfAllocators(3, cidr)
+	defer stopNetworkOfAllocators(allocs)
+
+	for i, alloc := range allocs {
+		_, err := alloc.Allocate(fmt.Sprintf("container%d", i), nil)
+		wt.AssertNoErr(t, err)
+	}
+	for _, alloc := range allocs {
+		gossipRouter.GossipBroadcast(alloc.Gossip())
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	result, err := allocs[0].CheckRing(time.Second)
+	wt.AssertNoErr(t, err)
+	wt.AssertEqualInt(t, len(result.Responded), 3, "peers responded")
+	wt.AssertEqualInt(t, len(result.NoResponse), 0, "peers not responded")
+	wt.AssertEqualInt(t, len(result.Inconsistencies), 0, "inconsistencies")
+
+	gossipRouter.removePeer(allocs[2].ourName)
+	result, err = allocs[0].CheckRing(100 * time.Millisecond)
+	wt.AssertNoErr(t, err)
+	wt.AssertEquals(t, result.NoResponse, []router.PeerName{allocs[2].ourName})
+}
+
+func TestAutoRange(t *testing.T) {
+	gossipRouter := TestGossipRouter{make(map[router.PeerName]chan gossipMessage), 0.0}
+	var allocs []*Allocator
+	for i, cidr := range []string{"10.48.0.0/12", "10.32.0.0/12", "10.64.0.0/12"} {
+		alloc := makeAllocator(fmt.Sprintf("%02d:00:00:02:00:00", i+1), cidr, 2)
+		if i < 2 {
+			alloc.AutoRange()
+		}
+		alloc.SetInterfaces(gossipRouter.connect(alloc.ourName, alloc))
+		alloc.Start()
+		allocs = append(allocs, alloc)
+	}
+	defer stopNetworkOfAllocators(allocs)
+	ranges := func() []string {
+		var rs []string
+		for _, alloc := range allocs {
+			subnet, _ := alloc.Range()
+			rs = append(rs, subnet.String())
+		}
+		return rs
+	}
+	// the gossip is encoded as it is broadcast, so that must be done
+	// in the actor, as the allocator itself does
+	broadcast := func(alloc *Allocator) {
+		alloc.inActor(func() { gossipRouter.GossipBroadcast(alloc.Gossip()) })
+	}
+	// and is received in the background
+	awaitRanges := func(want []string) {
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			if reflect.DeepEqual(ranges(), want) {
+				return
+			}
+		}
+		wt.AssertEquals(t, ranges(), want)
+	}
+
+	// the picked ranges give way to the one of the peer with the lowest
+	// name
+	broadcast(allocs[1])
+	broadcast(allocs[0])
+	awaitRanges([]string{"10.48.0.0/12", "10.48.0.0/12", "10.64.0.0/12"})
+	_, pickedBy := allocs[1].Range()
+	wt.AssertEquals(t, pickedBy, allocs[0].ourName)
+
+	// and both to one given
+	broadcast(allocs[2])
+	awaitRanges([]string{"10.64.0.0/12", "10.64.0.0/12", "10.64.0.0/12"})
+	_, pickedBy = allocs[0].Range()
+	wt.AssertEquals(t, pickedBy, router.UnknownPeerName)
+	broadcast(allocs[1])
+	awaitRanges([]string{"10.64.0.0/12", "10.64.0.0/12", "10.64.0.0/12"})
+
+	addr, err := allocs[0].Allocate("foo", nil)
+	wt.AssertNoErr(t, err)
+	subnet, _ := allocs[1].Range()
+	wt.AssertTrue(t, subnet.Contains(addr.IP4()), "allocated from the range agreed")
+}
@@ -0,0 +1,170 @@
+package ipam
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/weaveworks/weave/ipam/ring"
+	"github.com/weaveworks/weave/router"
+)
+
+// How long we wait for other peers to send us their view of the ring
+const ringCheckTimeout = time.Second * 5
+
+// ringCheck gathers views of the ring from all the peers in it, so
+// that we can look for inconsistencies between them.
+type ringCheck struct {
+	views    []ring.View
+	awaiting map[router.PeerName]struct{}
+	done     chan struct{}
+}
+
+type RingCheckResult struct {
+	Responded       []router.PeerName
+	NoResponse      []router.PeerName
+	Inconsistencies []ring.Inconsistency
+	nicknames       map[router.PeerName]string
+}
+
+// CheckRing (Sync) asks all peers in the ring for their view of it,
+// waits up to timeout for them to respond, and reports any overlaps,
+// gaps or divergent ownership between what they said.
+func (alloc *Allocator) CheckRing(timeout time.Duration) (*RingCheckResult, error) {
+	type started struct {
+		done chan struct{}
+		err  error
+	}
+	startChan := make(chan started)
+	alloc.actionChan <- func() {
+		done, err := alloc.startRingCheck()
+		startChan <- started{done, err}
+	}
+	s := <-startChan
+	if s.err != nil {
+		return nil, s.err
+	}
+
+	select {
+	case <-s.done:
+	case <-time.After(timeout):
+	}
+
+	resultChan := make(chan *RingCheckResult)
+	alloc.actionChan <- func() {
+		resultChan <- alloc.finishRingCheck()
+	}
+	return <-resultChan, nil
+}
+
+func (alloc *Allocator) ourView() ring.View {
+	return ring.View{Peer: alloc.ourName, Ring: alloc.ring, Ranges: alloc.space.OwnedRanges()}
+}
+
+func (alloc *Allocator) startRingCheck() (chan struct{}, error) {
+	if alloc.ringCheck != nil {
+		return nil, errors.New("Ring check already in progress")
+	}
+	if alloc.ring.Empty() {
+		return nil, errors.New("Ring not yet established")
+	}
+	check := &ringCheck{
+		views:    []ring.View{alloc.ourView()},
+		awaiting: make(map[router.PeerName]struct{}),
+		done:     make(chan struct{}),
+	}
+	for peer := range alloc.ring.PeerNames() {
+		if peer != alloc.ourName {
+			check.awaiting[peer] = struct{}{}
+			alloc.gossip.GossipUnicast(peer, []byte{msgRingViewRequest})
+		}
+	}
+	if len(check.awaiting) == 0 {
+		close(check.done)
+	}
+	alloc.ringCheck = check
+	return check.done, nil
+}
+
+func (alloc *Allocator) finishRingCheck() *RingCheckResult {
+	check := alloc.ringCheck
+	alloc.ringCheck = nil
+	result := &RingCheckResult{
+		Inconsistencies: ring.Check(alloc.ring.Start, alloc.ring.End, check.views),
+		nicknames:       make(map[router.PeerName]string),
+	}
+	for _, view := range check.views {
+		result.Responded = append(result.Responded, view.Peer)
+	}
+	for peer := range check.awaiting {
+		result.NoResponse = append(result.NoResponse, peer)
+	}
+	for peer, nickname := range alloc.nicknames {
+		result.nicknames[peer] = nickname
+	}
+	return result
+}
+
+// Some other peer wants to know what we think the ring looks like
+func (alloc *Allocator) sendRingView(to router.PeerName) {
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(alloc.ourView()); err != nil {
+		panic(err)
+	}
+	alloc.gossip.GossipUnicast(to, router.Concat([]byte{msgRingViewResponse}, buf.Bytes()))
+}
+
+func (alloc *Allocator) receiveRingView(sender router.PeerName, msg []byte) error {
+	check := alloc.ringCheck
+	if check == nil {
+		return nil // too late; never mind
+	}
+	if _, found := check.awaiting[sender]; !found {
+		return nil
+	}
+	var view ring.View
+	if err := gob.NewDecoder(bytes.NewReader(msg)).Decode(&view); err != nil {
+		return err
+	}
+	view.Peer = sender
+	check.views = append(check.views, view)
+	delete(check.awaiting, sender)
+	if len(check.awaiting) == 0 {
+		close(check.done)
+	}
+	return nil
+}
+
+func (result *RingCheckResult) peerString(peer router.PeerName) string {
+	if nickname, found := result.nicknames[peer]; found {
+		return fmt.Sprintf("%s(%s)", peer, nickname)
+	}
+	return peer.String()
+}
+
+func (result *RingCheckResult) Fprint(w io.Writer) {
+	fmt.Fprintf(w, "Ring views received from %d peers\n", len(result.Responded))
+	for _, peer := range result.NoResponse {
+		fmt.Fprintf(w, "No response from %s\n", result.peerString(peer))
+	}
+	if len(result.Inconsistencies) == 0 {
+		fmt.Fprintln(w, "No inconsistencies found")
+		return
+	}
+	for _, inc := range result.Inconsistencies {
+		fmt.Fprintf(w, "%s [%s, %s):", inc.Kind, inc.Range.Start, inc.Range.End)
+		for i, peer := range inc.Peers {
+			fmt.Fprintf(w, " %s", result.peerString(peer))
+			if inc.Kind == ring.Divergent {
+				fmt.Fprintf(w, " says %s", result.peerString(inc.Owners[i]))
+			}
+			if i+1 < len(inc.Peers) {
+				fmt.Fprint(w, ",")
+			}
+		}
+		fmt.Fprintln(w)
+	}
+}
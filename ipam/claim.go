@@ -48,6 +48,7 @@ func (c *claim) Try(alloc *Allocator) bool {
 	existingIdent := alloc.findOwner(c.addr)
 	if existingIdent == c.ident {
 		// same identifier is claiming same address; that's OK
+		delete(alloc.dead, c.ident)
 		c.resultChan <- nil
 		return true
 	}
@@ -55,6 +55,15 @@ func (alloc *Allocator) HandleHTTP(router *mux.Router) {
 		w.WriteHeader(204)
 	})
 
+	router.Methods("GET").Path("/ring/check").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		result, err := alloc.CheckRing(ringCheckTimeout)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		result.Fprint(w)
+	})
+
 	router.Methods("DELETE").Path("/peer").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		alloc.Shutdown()
 		w.WriteHeader(204)
@@ -0,0 +1,126 @@
+package ring
+
+import (
+	"sort"
+
+	"github.com/weaveworks/weave/ipam/address"
+	"github.com/weaveworks/weave/router"
+)
+
+// View is one peer's account of the state of allocation: the ring as
+// that peer sees it, and the ranges it is actually allocating from.
+type View struct {
+	Peer   router.PeerName
+	Ring   *Ring
+	Ranges []address.Range
+}
+
+// Kinds of inconsistency reported by Check
+const (
+	Overlap   = "overlap"   // more than one peer allocating from a range
+	Gap       = "gap"       // nobody allocating from a range its owner should be
+	Divergent = "divergent" // peers disagree on who owns a range
+)
+
+type Inconsistency struct {
+	Kind   string
+	Range  address.Range
+	Peers  []router.PeerName // the peers involved
+	Owners []router.PeerName // for Divergent, owner according to each of Peers
+}
+
+// Check compares the views of the range [start, end) gathered from a
+// number of peers, and reports any ranges which more than one peer is
+// allocating from, ranges which should be allocated from by one of
+// the responding peers but aren't, and ranges whose ownership the
+// peers' rings disagree on. Views with an empty ring, or a ring for a
+// different range, are only considered for the ranges they hold.
+func Check(start, end address.Address, views []View) []Inconsistency {
+	responded := make(map[router.PeerName]struct{})
+	boundaries := []address.Address{start, end}
+	for _, view := range views {
+		responded[view.Peer] = struct{}{}
+		for _, r := range view.Ranges {
+			boundaries = append(boundaries, r.Start, r.End)
+		}
+		if view.Ring != nil {
+			for _, entry := range view.Ring.Entries {
+				boundaries = append(boundaries, entry.Token)
+			}
+		}
+	}
+	sort.Sort(addressSlice(boundaries))
+
+	var result []Inconsistency
+	report := func(inc Inconsistency) {
+		// coalesce with the previous report if it is a continuation
+		if n := len(result); n > 0 {
+			last := &result[n-1]
+			if last.Kind == inc.Kind && last.Range.End == inc.Range.Start &&
+				samePeers(last.Peers, inc.Peers) && samePeers(last.Owners, inc.Owners) {
+				last.Range.End = inc.Range.End
+				return
+			}
+		}
+		result = append(result, inc)
+	}
+
+	for i := 0; i+1 < len(boundaries); i++ {
+		segment := address.Range{Start: boundaries[i], End: boundaries[i+1]}
+		if segment.Start == segment.End || segment.Start < start || segment.End > end {
+			continue
+		}
+
+		var holders, viewers, owners []router.PeerName
+		for _, view := range views {
+			for _, r := range view.Ranges {
+				if r.Start <= segment.Start && segment.End <= r.End {
+					holders = append(holders, view.Peer)
+					break
+				}
+			}
+			if view.Ring != nil && !view.Ring.Empty() && view.Ring.Start == start && view.Ring.End == end {
+				viewers = append(viewers, view.Peer)
+				owners = append(owners, view.Ring.Owner(segment.Start))
+			}
+		}
+
+		if len(holders) > 1 {
+			report(Inconsistency{Kind: Overlap, Range: segment, Peers: holders})
+		}
+		if len(owners) == 0 {
+			continue
+		}
+		for _, owner := range owners[1:] {
+			if owner != owners[0] {
+				report(Inconsistency{Kind: Divergent, Range: segment, Peers: viewers, Owners: owners})
+				break
+			}
+		}
+		if len(holders) == 0 {
+			// Only a gap if the owner told us what it holds
+			if _, found := responded[owners[0]]; found {
+				report(Inconsistency{Kind: Gap, Range: segment, Peers: owners[:1]})
+			}
+		}
+	}
+	return result
+}
+
+func samePeers(a, b []router.PeerName) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+type addressSlice []address.Address
+
+func (p addressSlice) Len() int           { return len(p) }
+func (p addressSlice) Less(i, j int) bool { return p[i] < p[j] }
+func (p addressSlice) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
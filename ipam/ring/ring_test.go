@@ -476,12 +476,6 @@ func TestOwner(t *testing.T) {
 	})
 }
 
-type addressSlice []address.Address
-
-func (s addressSlice) Len() int           { return len(s) }
-func (s addressSlice) Less(i, j int) bool { return s[i] < s[j] }
-func (s addressSlice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
-
 func TestFuzzRing(t *testing.T) {
 	var (
 		numPeers   = 25
@@ -711,3 +705,44 @@ func (es entries) String() string {
 	fmt.Fprintf(&buffer, "]")
 	return buffer.String()
 }
+
+func TestCheck(t *testing.T) {
+	ring1 := New(start, end, peer1name)
+	ring1.ClaimForPeers([]router.PeerName{peer1name, peer2name})
+	ring2 := New(start, end, peer2name)
+	ring2.Merge(*ring1)
+
+	view1 := View{Peer: peer1name, Ring: ring1, Ranges: ring1.OwnedRanges()}
+	view2 := View{Peer: peer2name, Ring: ring2, Ranges: ring2.OwnedRanges()}
+	wt.AssertEqualInt(t, len(Check(start, end, []View{view1, view2})), 0, "consistent views")
+
+	// peer2 also thinks it is allocating from peer1's range
+	view2.Ranges = []address.Range{{Start: start, End: end}}
+	result := Check(start, end, []View{view1, view2})
+	wt.AssertEqualInt(t, len(result), 1, "overlaps")
+	wt.AssertEqualString(t, result[0].Kind, Overlap, "kind")
+	wt.AssertEquals(t, result[0].Range, address.Range{Start: start, End: middle})
+	wt.AssertEquals(t, result[0].Peers, []router.PeerName{peer1name, peer2name})
+
+	// peer1 isn't allocating from anywhere
+	view1.Ranges = nil
+	view2.Ranges = ring2.OwnedRanges()
+	result = Check(start, end, []View{view1, view2})
+	wt.AssertEqualInt(t, len(result), 1, "gaps")
+	wt.AssertEqualString(t, result[0].Kind, Gap, "kind")
+	wt.AssertEquals(t, result[0].Range, address.Range{Start: start, End: middle})
+
+	// ... which is fine if we didn't hear from peer1
+	wt.AssertEqualInt(t, len(Check(start, end, []View{view2})), 0, "views without peer1")
+
+	// peer3 thinks it owns everything
+	ring3 := New(start, end, peer3name)
+	ring3.ClaimItAll()
+	view1.Ranges = ring1.OwnedRanges()
+	view3 := View{Peer: peer3name, Ring: ring3}
+	result = Check(start, end, []View{view1, view2, view3})
+	wt.AssertEqualInt(t, len(result), 2, "divergences")
+	wt.AssertEqualString(t, result[0].Kind, Divergent, "kind")
+	wt.AssertEquals(t, result[0].Owners, []router.PeerName{peer1name, peer1name, peer3name})
+	wt.AssertEquals(t, result[1].Range, address.Range{Start: middle, End: end})
+}
@@ -145,6 +145,16 @@ func (alloc *Allocator) claimRingForTesting(allocs ...*Allocator) {
 	alloc.space.AddRanges(alloc.ring.OwnedRanges())
 }
 
+// Run f in the allocator's actor, as its own code does, and wait for it
+func (alloc *Allocator) inActor(f func()) {
+	done := make(chan struct{})
+	alloc.actionChan <- func() {
+		f()
+		close(done)
+	}
+	<-done
+}
+
 // Check whether or not something was sent on a channel
 func AssertSent(t *testing.T, ch <-chan bool) {
 	timeout := time.After(10 * time.Second)
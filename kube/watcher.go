@@ -0,0 +1,269 @@
+package kube
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sync"
+	"time"
+
+	. "github.com/weaveworks/weave/common"
+	"github.com/weaveworks/weave/ipam/address"
+)
+
+const (
+	initialInterval = 1 * time.Second
+	maxInterval     = 1 * time.Minute
+
+	// Where Kubernetes puts the credentials of a pod's service account
+	serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+)
+
+// Pod UIDs, which is what we allocate addresses to; we only ever
+// consider idents of this form when resyncing, so as not to disturb
+// containers or things like "weave:expose".
+var podUIDRegexp = regexp.MustCompile("^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$")
+
+// IsPodUID says whether ident looks like a Kubernetes pod UID
+func IsPodUID(ident string) bool {
+	return podUIDRegexp.MatchString(ident)
+}
+
+// Allocator is the part of the IP allocator the watcher uses
+type Allocator interface {
+	Allocate(ident string, cancelChan <-chan bool) (address.Address, error)
+	Free(ident string) error
+	ContainerIdents() []string
+}
+
+// The parts of the Kubernetes API objects we look at
+type pod struct {
+	Metadata struct {
+		Name      string `json:"name"`
+		Namespace string `json:"namespace"`
+		UID       string `json:"uid"`
+	} `json:"metadata"`
+	Spec struct {
+		NodeName    string `json:"nodeName"`
+		HostNetwork bool   `json:"hostNetwork"`
+	} `json:"spec"`
+	Status struct {
+		Phase string `json:"phase"`
+	} `json:"status"`
+}
+
+type podList struct {
+	Metadata struct {
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Items []pod `json:"items"`
+}
+
+type watchEvent struct {
+	Type   string          `json:"type"`
+	Object json.RawMessage `json:"object"`
+}
+
+// Watcher watches the Kubernetes API for pods scheduled to a node,
+// and has the allocator hand each of them an address, owned by the
+// pod's UID, which it releases when the pod is deleted or finishes.
+type Watcher struct {
+	sync.Mutex
+	apiURL string
+	node   string
+	token  string
+	client *http.Client
+	alloc  Allocator
+	pods   map[string]struct{} // UIDs of the pods we have allocated to
+}
+
+// NewWatcher creates a watcher for pods on node, using the API
+// server at apiURL. A blank apiURL means we are running in a pod
+// ourselves, so the API server and our credentials are to be found
+// where Kubernetes puts them.
+func NewWatcher(apiURL, node string, alloc Allocator) (*Watcher, error) {
+	w := &Watcher{apiURL: apiURL, node: node, client: &http.Client{}, alloc: alloc, pods: make(map[string]struct{})}
+	if apiURL != "" {
+		return w, nil
+	}
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, fmt.Errorf("No Kubernetes API server given, and KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT are not set")
+	}
+	w.apiURL = "https://" + net.JoinHostPort(host, port)
+	token, err := ioutil.ReadFile(serviceAccountDir + "/token")
+	if err != nil {
+		return nil, err
+	}
+	w.token = string(token)
+	ca, err := ioutil.ReadFile(serviceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("No certificates found in %s/ca.crt", serviceAccountDir)
+	}
+	w.client.Transport = &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}
+	return w, nil
+}
+
+// Start watches for pods in the background, reconnecting to the API
+// server whenever we lose contact with it.
+func (w *Watcher) Start() {
+	Info.Printf("[kube] Watching pods on node %s using Kubernetes API on %s", w.node, w.apiURL)
+	go w.run()
+}
+
+func (w *Watcher) run() {
+	interval := initialInterval
+	for {
+		resourceVersion, err := w.resync()
+		if err == nil {
+			interval = initialInterval
+			err = w.watch(resourceVersion)
+		}
+		Warning.Printf("[kube] Lost contact with Kubernetes API on %s (retrying in %v): %s", w.apiURL, interval, err)
+		time.Sleep(interval)
+		if interval *= 2; interval > maxInterval {
+			interval = maxInterval
+		}
+	}
+}
+
+func (w *Watcher) podsURL(query url.Values) string {
+	query.Set("fieldSelector", "spec.nodeName="+w.node)
+	return w.apiURL + "/api/v1/pods?" + query.Encode()
+}
+
+func (w *Watcher) get(target string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", target, nil)
+	if err != nil {
+		return nil, err
+	}
+	if w.token != "" {
+		req.Header.Set("Authorization", "Bearer "+w.token)
+	}
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s from %s", resp.Status, target)
+	}
+	return resp, nil
+}
+
+// Bring our idea of which pods are on the node up to date, since we
+// may have missed events, returning the resource version to watch
+// from.
+func (w *Watcher) resync() (string, error) {
+	resp, err := w.get(w.podsURL(url.Values{}))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var list podList
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return "", err
+	}
+	alive := make(map[string]struct{})
+	for i := range list.Items {
+		p := &list.Items[i]
+		if w.podUpdated(p) {
+			alive[p.Metadata.UID] = struct{}{}
+		}
+	}
+	for _, ident := range w.alloc.ContainerIdents() {
+		if _, found := alive[ident]; IsPodUID(ident) && !found {
+			Info.Printf("[kube] Pod %s went away whilst we weren't watching", ident)
+			w.podGone(ident)
+		}
+	}
+	return list.Metadata.ResourceVersion, nil
+}
+
+func (w *Watcher) watch(resourceVersion string) error {
+	resp, err := w.get(w.podsURL(url.Values{"watch": {"true"}, "resourceVersion": {resourceVersion}}))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var event watchEvent
+		if err := decoder.Decode(&event); err != nil {
+			return err
+		}
+		if event.Type == "ERROR" {
+			// typically because resourceVersion is too old, so we
+			// need to list pods afresh
+			return fmt.Errorf("Error from watch: %s", event.Object)
+		}
+		var p pod
+		if err := json.Unmarshal(event.Object, &p); err != nil {
+			return err
+		}
+		Debug.Printf("[kube] %s pod %s/%s (%s) %s", event.Type, p.Metadata.Namespace, p.Metadata.Name, p.Metadata.UID, p.Status.Phase)
+		if event.Type == "DELETED" {
+			w.podGone(p.Metadata.UID)
+		} else {
+			w.podUpdated(&p)
+		}
+	}
+}
+
+// podUpdated makes sure a pod we have been told about has an address
+// if it is live and not sharing the host's network, or has none if
+// it has finished, returning whether it should have one.
+func (w *Watcher) podUpdated(p *pod) bool {
+	if p.Spec.HostNetwork || p.Spec.NodeName != w.node {
+		return false
+	}
+	if p.Status.Phase == "Succeeded" || p.Status.Phase == "Failed" {
+		w.podGone(p.Metadata.UID)
+		return false
+	}
+	w.podAlive(p)
+	return true
+}
+
+func (w *Watcher) podAlive(p *pod) {
+	uid := p.Metadata.UID
+	w.Lock()
+	_, found := w.pods[uid]
+	w.pods[uid] = struct{}{}
+	w.Unlock()
+	if found {
+		return
+	}
+	// Allocation blocks until the allocator has space, so we mustn't
+	// hold up other events while it does; freeing the UID cancels it.
+	go func() {
+		addr, err := w.alloc.Allocate(uid, nil)
+		if err != nil {
+			Warning.Printf("[kube] Unable to allocate address for pod %s/%s (%s): %s", p.Metadata.Namespace, p.Metadata.Name, uid, err)
+			return
+		}
+		Info.Printf("[kube] Allocated %s for pod %s/%s (%s)", addr, p.Metadata.Namespace, p.Metadata.Name, uid)
+	}()
+}
+
+func (w *Watcher) podGone(uid string) {
+	w.Lock()
+	delete(w.pods, uid)
+	w.Unlock()
+	if err := w.alloc.Free(uid); err != nil {
+		Debug.Printf("[kube] Releasing address of pod %s: %s", uid, err)
+	} else {
+		Info.Printf("[kube] Released address of pod %s", uid)
+	}
+}
@@ -0,0 +1,135 @@
+package kube
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/weaveworks/weave/ipam/address"
+	wt "github.com/weaveworks/weave/testing"
+)
+
+const (
+	testNode    = "node1"
+	containerID = "8e5b4c6d7e8f9a0b1c2d3e4f5a6b7c8d9e0f1a2b3c4d5e6f7a8b9c0d1e2f3a4b"
+	uidRunning  = "11111111-1111-1111-1111-111111111111"
+	uidHostNet  = "22222222-2222-2222-2222-222222222222"
+	uidFinished = "33333333-3333-3333-3333-333333333333"
+	uidStale    = "44444444-4444-4444-4444-444444444444"
+	uidNew      = "55555555-5555-5555-5555-555555555555"
+)
+
+type mockAllocator struct {
+	sync.Mutex
+	owned     map[string]address.Address
+	next      address.Address
+	allocated chan string
+}
+
+func newMockAllocator(idents ...string) *mockAllocator {
+	alloc := &mockAllocator{owned: make(map[string]address.Address), next: 1, allocated: make(chan string, 10)}
+	for _, ident := range idents {
+		alloc.Allocate(ident, nil)
+	}
+	return alloc
+}
+
+func (alloc *mockAllocator) Allocate(ident string, cancelChan <-chan bool) (address.Address, error) {
+	alloc.Lock()
+	defer alloc.Unlock()
+	addr, found := alloc.owned[ident]
+	if !found {
+		addr = alloc.next
+		alloc.next++
+		alloc.owned[ident] = addr
+	}
+	alloc.allocated <- ident
+	return addr, nil
+}
+
+func (alloc *mockAllocator) Free(ident string) error {
+	alloc.Lock()
+	defer alloc.Unlock()
+	if _, found := alloc.owned[ident]; !found {
+		return fmt.Errorf("no addresses for %s", ident)
+	}
+	delete(alloc.owned, ident)
+	return nil
+}
+
+func (alloc *mockAllocator) ContainerIdents() []string {
+	alloc.Lock()
+	defer alloc.Unlock()
+	idents := []string{}
+	for ident := range alloc.owned {
+		idents = append(idents, ident)
+	}
+	sort.Strings(idents)
+	return idents
+}
+
+func (alloc *mockAllocator) waitForAllocation(t *testing.T, ident string) {
+	select {
+	case got := <-alloc.allocated:
+		wt.AssertEqualString(t, got, ident, "allocated ident")
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for allocation to %s", ident)
+	}
+}
+
+func podJSON(uid, phase string, hostNetwork bool) string {
+	return fmt.Sprintf(`{"metadata":{"name":"pod-%s","namespace":"default","uid":"%s"},"spec":{"nodeName":"%s","hostNetwork":%t},"status":{"phase":"%s"}}`,
+		uid[:1], uid, testNode, hostNetwork, phase)
+}
+
+func TestWatcher(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		wt.AssertEqualString(t, r.URL.Path, "/api/v1/pods", "path")
+		wt.AssertEqualString(t, r.URL.Query().Get("fieldSelector"), "spec.nodeName="+testNode, "field selector")
+		if r.URL.Query().Get("watch") == "" {
+			fmt.Fprintf(w, `{"metadata":{"resourceVersion":"42"},"items":[%s,%s,%s]}`,
+				podJSON(uidRunning, "Running", false), podJSON(uidHostNet, "Running", true), podJSON(uidFinished, "Succeeded", false))
+			return
+		}
+		wt.AssertEqualString(t, r.URL.Query().Get("resourceVersion"), "42", "resource version")
+		fmt.Fprintf(w, `{"type":"ADDED","object":%s}`+"\n", podJSON(uidNew, "Pending", false))
+		fmt.Fprintf(w, `{"type":"MODIFIED","object":%s}`+"\n", podJSON(uidNew, "Running", false))
+		fmt.Fprintf(w, `{"type":"DELETED","object":%s}`+"\n", podJSON(uidRunning, "Running", false))
+	}))
+	defer server.Close()
+
+	alloc := newMockAllocator(containerID, uidFinished, uidStale)
+	for i := 0; i < 3; i++ {
+		<-alloc.allocated
+	}
+	w, err := NewWatcher(server.URL, testNode, alloc)
+	wt.AssertNoErr(t, err)
+
+	// Running pods get addresses; finished ones, and ones that have
+	// gone, lose them; containers are none of our business
+	resourceVersion, err := w.resync()
+	wt.AssertNoErr(t, err)
+	wt.AssertEqualString(t, resourceVersion, "42", "resource version")
+	alloc.waitForAllocation(t, uidRunning)
+	wt.AssertEquals(t, alloc.ContainerIdents(), []string{uidRunning, containerID})
+
+	// Just one allocation for a pod however many times we hear of it
+	w.watch(resourceVersion)
+	alloc.waitForAllocation(t, uidNew)
+	wt.AssertEquals(t, alloc.ContainerIdents(), []string{uidNew, containerID})
+	select {
+	case ident := <-alloc.allocated:
+		t.Fatalf("Unexpected allocation to %s", ident)
+	default:
+	}
+}
+
+func TestIsPodUID(t *testing.T) {
+	wt.AssertTrue(t, IsPodUID(uidRunning), "pod UID")
+	wt.AssertFalse(t, IsPodUID(containerID), "container ID")
+	wt.AssertFalse(t, IsPodUID("weave:expose"), "weave:expose")
+}
@@ -35,7 +35,7 @@ func TestCacheLength(t *testing.T) {
 		ip := net.ParseIP(fmt.Sprintf("10.0.1.%d", i))
 		records := []ZoneRecord{Record{name, ip, 0, 0, 0}}
 
-		reply := makeAddressReply(questionMsg, question, records)
+		reply := makeAddressReply(questionMsg, question, records, localTTL)
 		reply.Answer[0].Header().Ttl = uint32(i)
 
 		l.Put(questionMsg, reply, 0, 0)
@@ -88,7 +88,7 @@ func TestCacheEntries(t *testing.T) {
 
 	t.Logf("Inserting the reply")
 	records := []ZoneRecord{Record{"some.name", net.ParseIP("10.0.1.1"), 0, 0, 0}}
-	reply1 := makeAddressReply(questionMsg, question, records)
+	reply1 := makeAddressReply(questionMsg, question, records, localTTL)
 	l.Put(questionMsg, reply1, nullTTL, 0)
 
 	t.Logf("Checking we can Get() the reply now")
@@ -120,7 +120,7 @@ func TestCacheEntries(t *testing.T) {
 
 	t.Logf("Checking that an Remove() results in Get() returning nothing")
 	records = []ZoneRecord{Record{"some.name", net.ParseIP("10.0.9.9"), 0, 0, 0}}
-	replyTemp := makeAddressReply(questionMsg, question, records)
+	replyTemp := makeAddressReply(questionMsg, question, records, localTTL)
 	l.Put(questionMsg, replyTemp, nullTTL, 0)
 	lenBefore := l.Len()
 	l.Remove(question)
@@ -134,11 +134,11 @@ func TestCacheEntries(t *testing.T) {
 
 	t.Logf("Inserting a two replies for the same query")
 	records = []ZoneRecord{Record{"some.name", net.ParseIP("10.0.1.2"), 0, 0, 0}}
-	reply2 := makeAddressReply(questionMsg, question, records)
+	reply2 := makeAddressReply(questionMsg, question, records, localTTL)
 	l.Put(questionMsg, reply2, nullTTL, 0)
 	clk.Add(time.Duration(1) * time.Second)
 	records = []ZoneRecord{Record{"some.name", net.ParseIP("10.0.1.3"), 0, 0, 0}}
-	reply3 := makeAddressReply(questionMsg, question, records)
+	reply3 := makeAddressReply(questionMsg, question, records, localTTL)
 	l.Put(questionMsg, reply3, nullTTL, 0)
 
 	t.Logf("Checking we get the last one...")
@@ -182,7 +182,7 @@ func TestCacheEntries(t *testing.T) {
 
 	t.Logf("Checking that an Remove() between Get() and Put() does not break things")
 	records = []ZoneRecord{Record{"some.name", net.ParseIP("10.0.9.9"), 0, 0, 0}}
-	replyTemp2 := makeAddressReply(questionMsg2, question2, records)
+	replyTemp2 := makeAddressReply(questionMsg2, question2, records, localTTL)
 	l.Remove(question2)
 	l.Put(questionMsg2, replyTemp2, nullTTL, 0)
 	resp, err = l.Get(questionMsg2, minUDPSize)
@@ -5,16 +5,17 @@ import (
 )
 
 const (
-	localTTL    uint32 = 30 // somewhat arbitrary; we don't expect anyone downstream to cache results
-	negLocalTTL        = 30 // TTL for negative local resolutions
-	minUDPSize         = 512
-	maxUDPSize         = 65535
+	DefaultLocalTTL        = 30 // somewhat arbitrary; we don't expect anyone downstream to cache results
+	localTTL        uint32 = DefaultLocalTTL
+	negLocalTTL            = 30 // TTL for negative local resolutions
+	minUDPSize             = 512
+	maxUDPSize             = 65535
 )
 
-func makeHeader(r *dns.Msg, q *dns.Question) *dns.RR_Header {
+func makeHeader(r *dns.Msg, q *dns.Question, ttl uint32) *dns.RR_Header {
 	return &dns.RR_Header{
 		Name: q.Name, Rrtype: q.Qtype,
-		Class: dns.ClassINET, Ttl: localTTL}
+		Class: dns.ClassINET, Ttl: ttl}
 }
 
 func makeReply(r *dns.Msg, as []dns.RR) *dns.Msg {
@@ -33,9 +34,9 @@ func makeTruncatedReply(r *dns.Msg) *dns.Msg {
 	return reply
 }
 
-func makeAddressReply(r *dns.Msg, q *dns.Question, addrs []ZoneRecord) *dns.Msg {
+func makeAddressReply(r *dns.Msg, q *dns.Question, addrs []ZoneRecord, ttl uint32) *dns.Msg {
 	answers := make([]dns.RR, len(addrs))
-	header := makeHeader(r, q)
+	header := makeHeader(r, q, ttl)
 	count := 0
 	for _, addr := range addrs {
 		ip := addr.IP()
@@ -54,18 +55,45 @@ func makeAddressReply(r *dns.Msg, q *dns.Question, addrs []ZoneRecord) *dns.Msg
 			}
 		}
 	}
-	return makeReply(r, answers[:count])
+	return makeReply(r, shuffleAnswers(answers[:count]))
 }
 
-func makePTRReply(r *dns.Msg, q *dns.Question, names []ZoneRecord) *dns.Msg {
+func makePTRReply(r *dns.Msg, q *dns.Question, names []ZoneRecord, ttl uint32) *dns.Msg {
 	answers := make([]dns.RR, len(names))
-	header := makeHeader(r, q)
+	header := makeHeader(r, q, ttl)
 	for i, name := range names {
 		answers[i] = &dns.PTR{Hdr: *header, Ptr: name.Name()}
 	}
 	return makeReply(r, answers)
 }
 
+// SRV answers, with the targets' addresses as additional records to
+// save the client asking for them
+func makeSRVReply(r *dns.Msg, q *dns.Question, services []ServiceRecord, ttl uint32) *dns.Msg {
+	answers := make([]dns.RR, len(services))
+	header := makeHeader(r, q, ttl)
+	for i, s := range services {
+		answers[i] = &dns.SRV{Hdr: *header, Priority: 0, Weight: 10, Port: uint16(s.Port), Target: s.Name()}
+	}
+	m := makeReply(r, shuffleAnswers(answers))
+	seen := make(map[string]struct{})
+	for _, s := range services {
+		if _, found := seen[s.IP().String()]; found {
+			continue
+		}
+		seen[s.IP().String()] = struct{}{}
+		hdr := dns.RR_Header{Name: s.Name(), Class: dns.ClassINET, Ttl: ttl}
+		if ip4 := s.IP().To4(); ip4 != nil {
+			hdr.Rrtype = dns.TypeA
+			m.Extra = append(m.Extra, &dns.A{Hdr: hdr, A: ip4})
+		} else {
+			hdr.Rrtype = dns.TypeAAAA
+			m.Extra = append(m.Extra, &dns.AAAA{Hdr: hdr, AAAA: s.IP()})
+		}
+	}
+	return m
+}
+
 func makeDNSFailResponse(r *dns.Msg) *dns.Msg {
 	m := new(dns.Msg)
 	m.SetReply(r)
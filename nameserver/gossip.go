@@ -0,0 +1,209 @@
+package nameserver
+
+import (
+	"bytes"
+	"encoding/gob"
+	"time"
+
+	. "github.com/weaveworks/weave/common"
+	"github.com/weaveworks/weave/router"
+)
+
+const (
+	// How long we keep records for deleted entries, so that the
+	// deletion has a chance to reach every peer
+	tombstoneTimeout = 10 * time.Minute
+	// How often we look for tombstones to throw away
+	tombstoneGCInterval = time.Minute
+)
+
+// Records travel between peers as gossip; each peer merges what it
+// receives into its ZoneDb, so that it can answer queries for
+// containers anywhere on the network without asking anyone else.
+// The sender's domain goes along with them, since records only make
+// sense to peers serving the same domain.
+type zoneGossipData struct {
+	domain string
+	recs   []dbRecord
+}
+
+func (d *zoneGossipData) Merge(other router.GossipData) {
+	for _, r := range other.(*zoneGossipData).recs {
+		d.recs = mergeRecord(d.recs, r)
+	}
+}
+
+func (d *zoneGossipData) Encode() []byte {
+	buf := new(bytes.Buffer)
+	enc := gob.NewEncoder(buf)
+	if err := enc.Encode(d.domain); err != nil {
+		panic(err)
+	}
+	if err := enc.Encode(d.recs); err != nil {
+		panic(err)
+	}
+	return buf.Bytes()
+}
+
+// Add r to recs, unless recs already has an equally recent version
+func mergeRecord(recs []dbRecord, r dbRecord) []dbRecord {
+	for i := range recs {
+		if recs[i].sameAs(&r) {
+			if r.Version > recs[i].Version {
+				recs[i] = r
+			}
+			return recs
+		}
+	}
+	return append(recs, r)
+}
+
+// SetInterfaces gives the zone the name of the peer it's running on,
+// which owns the records added to it, and the gossip channel over
+// which to tell other peers about them.
+func (zone *ZoneDb) SetInterfaces(ourName router.PeerName, gossip router.Gossip) {
+	zone.mx.Lock()
+	defer zone.mx.Unlock()
+	zone.ourName = ourName
+	zone.gossip = gossip
+	for i := range zone.recs {
+		zone.recs[i].Origin = ourName
+	}
+}
+
+// Start periodically clearing out old tombstones
+func (zone *ZoneDb) Start() {
+	go func() {
+		for range time.Tick(tombstoneGCInterval) {
+			zone.removeTombstones(time.Now().Add(-tombstoneTimeout))
+		}
+	}()
+}
+
+func (zone *ZoneDb) removeTombstones(olderThan time.Time) {
+	zone.mx.Lock()
+	defer zone.mx.Unlock()
+	w := 0 // write index
+	for _, r := range zone.recs {
+		if r.isLive() || r.Tombstone > olderThan.Unix() {
+			zone.recs[w] = r
+			w++
+		}
+	}
+	zone.recs = zone.recs[:w]
+}
+
+// DeletePeer forgets all records registered by a peer that has left
+// the network. Unlike a deletion by the peer itself this is not
+// gossiped: everyone does it for themselves when they notice the
+// peer has gone, and if the peer turns out only to have been
+// partitioned away then its records come back when we hear from it
+// again.
+func (zone *ZoneDb) DeletePeer(peer router.PeerName) {
+	zone.mx.Lock()
+	defer zone.mx.Unlock()
+	if peer == zone.ourName {
+		return
+	}
+	w := 0 // write index
+	for _, r := range zone.recs {
+		if r.Origin != peer {
+			zone.recs[w] = r
+			w++
+		}
+	}
+	zone.recs = zone.recs[:w]
+}
+
+func (zone *ZoneDb) broadcast(recs []dbRecord) {
+	if zone.gossip == nil || len(recs) == 0 {
+		return
+	}
+	zone.gossip.GossipBroadcast(zone.gossipData(recs))
+}
+
+func (zone *ZoneDb) gossipData(recs []dbRecord) *zoneGossipData {
+	return &zoneGossipData{domain: zone.domain, recs: recs}
+}
+
+// Merge records received from another peer, returning those that
+// were new to us.
+func (zone *ZoneDb) merge(update []byte) ([]dbRecord, error) {
+	var domain string
+	var recs []dbRecord
+	dec := gob.NewDecoder(bytes.NewReader(update))
+	if err := dec.Decode(&domain); err != nil {
+		return nil, err
+	}
+	if err := dec.Decode(&recs); err != nil {
+		return nil, err
+	}
+	if domain != zone.domain {
+		// Not worth dropping the connection over, as we would for
+		// an error; DNS just won't work between us.
+		Warning.Printf("[zonedb] Ignoring %d records for domain %s; we are serving %s", len(recs), domain, zone.domain)
+		return nil, nil
+	}
+	zone.mx.Lock()
+	var news, corrections []dbRecord
+	for _, r := range recs {
+		index := zone.indexOf(func(existing dbRecord) bool { return existing.sameAs(&r) })
+		switch {
+		case r.Origin == zone.ourName:
+			// Someone has a version of one of our records that is
+			// newer than ours, or one we've forgotten about,
+			// e.g. from before we restarted. Either way our view
+			// is authoritative, so tell everyone it's gone.
+			if index == -1 {
+				r.Version++
+				if r.isLive() {
+					r.Tombstone = time.Now().Unix()
+				}
+				zone.recs = append(zone.recs, r)
+				corrections = append(corrections, r)
+			} else if existing := &zone.recs[index]; r.Version > existing.Version {
+				existing.Version = r.Version + 1
+				corrections = append(corrections, *existing)
+			}
+		case index == -1:
+			zone.recs = append(zone.recs, r)
+			news = append(news, r)
+		case r.Version > zone.recs[index].Version:
+			zone.recs[index] = r
+			news = append(news, r)
+		}
+	}
+	zone.mx.Unlock()
+	if len(corrections) > 0 {
+		Debug.Printf("[zonedb] Correcting %d stale records of ours held by other peers", len(corrections))
+		zone.broadcast(corrections)
+	}
+	return news, nil
+}
+
+func (zone *ZoneDb) OnGossipUnicast(sender router.PeerName, msg []byte) error {
+	return nil
+}
+
+func (zone *ZoneDb) OnGossipBroadcast(update []byte) (router.GossipData, error) {
+	news, err := zone.merge(update)
+	if err != nil || len(news) == 0 {
+		return nil, err
+	}
+	return zone.gossipData(news), nil
+}
+
+func (zone *ZoneDb) Gossip() router.GossipData {
+	zone.mx.RLock()
+	defer zone.mx.RUnlock()
+	if len(zone.recs) == 0 {
+		return nil
+	}
+	recs := make([]dbRecord, len(zone.recs))
+	copy(recs, zone.recs)
+	return zone.gossipData(recs)
+}
+
+func (zone *ZoneDb) OnGossip(update []byte) (router.GossipData, error) {
+	return zone.OnGossipBroadcast(update)
+}
@@ -0,0 +1,171 @@
+package nameserver
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/weaveworks/weave/router"
+	wt "github.com/weaveworks/weave/testing"
+)
+
+func newGossipZone(t *testing.T, name string) *ZoneDb {
+	peerName, err := router.PeerNameFromString(name)
+	wt.AssertNoErr(t, err)
+	zone := NewZoneDb(DefaultLocalDomain)
+	zone.SetInterfaces(peerName, nil)
+	return zone
+}
+
+// Send everything zone1 knows to zone2
+func gossipTo(t *testing.T, zone1, zone2 *ZoneDb) {
+	if data := zone1.Gossip(); data != nil {
+		_, err := zone2.OnGossip(data.Encode())
+		wt.AssertNoErr(t, err)
+	}
+}
+
+func TestGossipReplication(t *testing.T) {
+	zone1 := newGossipZone(t, "01:00:00:01:00:00")
+	zone2 := newGossipZone(t, "02:00:00:02:00:00")
+	ip := net.ParseIP("10.2.2.1")
+
+	wt.AssertNoErr(t, zone1.AddRecord("deadbeef", "test1.weave.", ip))
+	gossipTo(t, zone1, zone2)
+
+	found, err := zone2.LookupName("test1.weave.")
+	wt.AssertNoErr(t, err)
+	wt.AssertTrue(t, found[0].IP().Equal(ip), "replicated address")
+	_, err = zone2.LookupInaddr("1.2.2.10.in-addr.arpa.")
+	wt.AssertNoErr(t, err)
+	wt.AssertEqualInt(t, len(zone2.ContainerIdents()), 0, "remote containers are not ours")
+
+	// Nothing new the second time around
+	data, err := zone2.OnGossip(zone1.Gossip().Encode())
+	wt.AssertNoErr(t, err)
+	wt.AssertTrue(t, data == nil, "no news")
+
+	// Only the origin can delete a record
+	wt.AssertErrorType(t, zone2.DeleteRecord("deadbeef", ip), (*LookupError)(nil), "delete remote record")
+
+	// Deletion propagates as a tombstone, which a stale copy
+	// can't override
+	stale := zone1.Gossip().Encode()
+	wt.AssertNoErr(t, zone1.ContainerDied("deadbeef"))
+	gossipTo(t, zone1, zone2)
+	_, err = zone2.LookupName("test1.weave.")
+	wt.AssertErrorType(t, err, (*LookupError)(nil), "lookup deleted record")
+	_, err = zone2.OnGossip(stale)
+	wt.AssertNoErr(t, err)
+	_, err = zone2.LookupName("test1.weave.")
+	wt.AssertErrorType(t, err, (*LookupError)(nil), "lookup after stale gossip")
+
+	// Re-adding the record revives it everywhere
+	wt.AssertNoErr(t, zone1.AddRecord("deadbeef", "test1.weave.", ip))
+	gossipTo(t, zone1, zone2)
+	_, err = zone2.LookupName("test1.weave.")
+	wt.AssertNoErr(t, err)
+
+	// Old tombstones get cleared out
+	wt.AssertNoErr(t, zone1.DeleteRecordsFor("deadbeef"))
+	zone1.removeTombstones(time.Now().Add(time.Minute))
+	wt.AssertTrue(t, zone1.Gossip() == nil, "tombstones removed")
+}
+
+func TestGossipPartition(t *testing.T) {
+	zone1 := newGossipZone(t, "01:00:00:01:00:00")
+	zone2 := newGossipZone(t, "02:00:00:02:00:00")
+	ip1, ip2 := net.ParseIP("10.2.2.1"), net.ParseIP("10.2.2.2")
+
+	wt.AssertNoErr(t, zone1.AddRecord("deadbeef", "test1.weave.", ip1))
+	wt.AssertNoErr(t, zone2.AddRecord("cowjuice", "test2.weave.", ip2))
+	gossipTo(t, zone1, zone2)
+	gossipTo(t, zone2, zone1)
+
+	// zone2 drops out of sight, taking its records with it, and
+	// whilst it's away zone1's container goes
+	zone1.DeletePeer(zone2.ourName)
+	_, err := zone1.LookupName("test2.weave.")
+	wt.AssertErrorType(t, err, (*LookupError)(nil), "lookup departed peer's record")
+	wt.AssertNoErr(t, zone1.ContainerDied("deadbeef"))
+
+	// When the partition heals everyone catches up
+	gossipTo(t, zone1, zone2)
+	gossipTo(t, zone2, zone1)
+	_, err = zone1.LookupName("test2.weave.")
+	wt.AssertNoErr(t, err)
+	_, err = zone2.LookupName("test1.weave.")
+	wt.AssertErrorType(t, err, (*LookupError)(nil), "lookup record deleted during partition")
+}
+
+func TestGossipForgottenRecord(t *testing.T) {
+	zone1 := newGossipZone(t, "01:00:00:01:00:00")
+	zone2 := newGossipZone(t, "02:00:00:02:00:00")
+	ip := net.ParseIP("10.2.2.1")
+
+	wt.AssertNoErr(t, zone1.AddRecord("deadbeef", "test1.weave.", ip))
+	gossipTo(t, zone1, zone2)
+
+	// zone1 restarts, forgetting everything; when it hears about its
+	// old record it should delete it
+	restarted := newGossipZone(t, "01:00:00:01:00:00")
+	gossipTo(t, zone2, restarted)
+	_, err := restarted.LookupName("test1.weave.")
+	wt.AssertErrorType(t, err, (*LookupError)(nil), "lookup forgotten record")
+	gossipTo(t, restarted, zone2)
+	_, err = zone2.LookupName("test1.weave.")
+	wt.AssertErrorType(t, err, (*LookupError)(nil), "lookup corrected record")
+}
+
+func TestGossipDomain(t *testing.T) {
+	zone1 := newGossipZone(t, "01:00:00:01:00:00")
+	peerName, _ := router.PeerNameFromString("02:00:00:02:00:00")
+	zone2 := NewZoneDb("svc.internal")
+	zone2.SetInterfaces(peerName, nil)
+	wt.AssertEqualString(t, zone2.Domain(), "svc.internal.", "domain")
+
+	wt.AssertNoErr(t, zone1.AddRecord("deadbeef", "test1.weave.local.", net.ParseIP("10.2.2.1")))
+	gossipTo(t, zone1, zone2)
+	_, err := zone2.LookupName("test1.weave.local.")
+	wt.AssertErrorType(t, err, (*LookupError)(nil), "lookup of record from other domain")
+}
+
+// Peers running DNS reach each other through one that isn't
+func TestGossipThroughRelay(t *testing.T) {
+	zone1 := newGossipZone(t, "01:00:00:01:00:00")
+	relay := router.NewRelayGossiper()
+	zone3 := newGossipZone(t, "03:00:00:03:00:00")
+	ip1, ip3 := net.ParseIP("10.2.2.1"), net.ParseIP("10.2.2.3")
+	deliver := func(data router.GossipData, onGossip func([]byte) (router.GossipData, error)) {
+		wt.AssertTrue(t, data != nil, "relayed")
+		for _, msg := range data.(router.MultiGossipData).EncodeEach() {
+			_, err := onGossip(msg)
+			wt.AssertNoErr(t, err)
+		}
+	}
+
+	// what is gossiped each interval
+	wt.AssertNoErr(t, zone1.AddRecord("deadbeef", "test1.weave.", ip1))
+	update := zone1.Gossip().Encode()
+	data, err := relay.OnGossip(update)
+	wt.AssertNoErr(t, err)
+	deliver(data, zone3.OnGossip)
+	found, err := zone3.LookupName("test1.weave.")
+	wt.AssertNoErr(t, err)
+	wt.AssertTrue(t, found[0].IP().Equal(ip1), "address relayed")
+
+	// which comes round again through other relays no further
+	data, err = relay.OnGossip(update)
+	wt.AssertNoErr(t, err)
+	wt.AssertTrue(t, data == nil, "relayed once")
+	wt.AssertTrue(t, relay.Gossip() == nil, "nothing of the relay's own")
+
+	// and broadcasts
+	wt.AssertNoErr(t, zone3.AddRecord("cowjuice", "test3.weave.", ip3))
+	data, err = relay.OnGossipBroadcast(zone3.Gossip().Encode())
+	wt.AssertNoErr(t, err)
+	deliver(data, zone1.OnGossipBroadcast)
+	found, err = zone1.LookupName("test3.weave.")
+	wt.AssertNoErr(t, err)
+	wt.AssertTrue(t, found[0].IP().Equal(ip3), "address broadcast")
+}
@@ -0,0 +1,216 @@
+package nameserver
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	. "github.com/weaveworks/weave/common"
+)
+
+const (
+	DefaultHealthCheckInterval = 5 * time.Second // how often we probe
+	healthCheckTimeout         = 2 * time.Second // how long a probe may take
+	healthCheckFailures        = 2               // consecutive failed probes before we withhold an address
+)
+
+// HealthCheckedZone may be implemented by a Zone that can withhold
+// addresses of containers which fail a health check.
+type HealthCheckedZone interface {
+	SetHealthCheck(ident string, ip net.IP, check *HealthCheck) error
+}
+
+// HealthCheck says how to probe a container to see if it's healthy:
+// by connecting to a TCP port, or by making an HTTP GET request and
+// expecting a 2xx or 3xx response.
+type HealthCheck struct {
+	Kind string // "tcp" or "http"
+	Port int
+	Path string // for "http"
+}
+
+// ParseHealthCheck parses a check of the form "tcp:<port>" or
+// "http:<port>[/<path>]".
+func ParseHealthCheck(spec string) (*HealthCheck, error) {
+	parts := strings.SplitN(spec, ":", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("Invalid health check %q", spec)
+	}
+	check := &HealthCheck{Kind: parts[0]}
+	portStr := parts[1]
+	switch check.Kind {
+	case "tcp":
+	case "http":
+		check.Path = "/"
+		if i := strings.Index(portStr, "/"); i != -1 {
+			portStr, check.Path = portStr[:i], portStr[i:]
+		}
+	default:
+		return nil, fmt.Errorf("Invalid health check %q: unknown kind %q", spec, check.Kind)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port <= 0 || port > 65535 {
+		return nil, fmt.Errorf("Invalid health check %q: bad port %q", spec, portStr)
+	}
+	check.Port = port
+	return check, nil
+}
+
+func (check *HealthCheck) String() string {
+	if check.Kind == "http" {
+		return fmt.Sprintf("http:%d%s", check.Port, check.Path)
+	}
+	return fmt.Sprintf("%s:%d", check.Kind, check.Port)
+}
+
+func (check *HealthCheck) probe(ip net.IP) error {
+	addr := net.JoinHostPort(ip.String(), strconv.Itoa(check.Port))
+	switch check.Kind {
+	case "tcp":
+		conn, err := net.DialTimeout("tcp", addr, healthCheckTimeout)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	case "http":
+		client := &http.Client{Timeout: healthCheckTimeout}
+		resp, err := client.Get("http://" + addr + check.Path)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 400 {
+			return fmt.Errorf("%s", resp.Status)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown kind %q", check.Kind)
+}
+
+// SetHealthCheck attaches a check to the records for ident at ip,
+// or removes any check if check is nil.
+func (zone *ZoneDb) SetHealthCheck(ident string, ip net.IP, check *HealthCheck) error {
+	spec := ""
+	if check != nil {
+		spec = check.String()
+	}
+	zone.mx.Lock()
+	found := false
+	var changed []dbRecord
+	for i := range zone.recs {
+		r := &zone.recs[i]
+		if r.Origin != zone.ourName || !r.isLive() || r.Ident != ident || !r.IP.Equal(ip) {
+			continue
+		}
+		found = true
+		if r.Check != spec {
+			r.Check = spec
+			r.Unhealthy = false // until proven otherwise
+			r.Version++
+			changed = append(changed, *r)
+		}
+	}
+	zone.mx.Unlock()
+	if !found {
+		return LookupError(ident)
+	}
+	zone.broadcast(changed)
+	return nil
+}
+
+type healthTarget struct {
+	ident string
+	ip    string
+	check string
+}
+
+// StartHealthChecks periodically probes the containers with health
+// checks registered on this peer; other peers hear the outcome via
+// gossip.
+func (zone *ZoneDb) StartHealthChecks(interval time.Duration) {
+	go func() {
+		failures := make(map[healthTarget]int)
+		for range time.Tick(interval) {
+			failures = zone.runHealthChecks(failures)
+		}
+	}()
+}
+
+// Probe everything once, returning the new consecutive failure count
+// for each target.
+func (zone *ZoneDb) runHealthChecks(failures map[healthTarget]int) map[healthTarget]int {
+	targets := zone.healthTargets()
+	type result struct {
+		target healthTarget
+		err    error
+	}
+	results := make(chan result, len(targets))
+	for _, target := range targets {
+		go func(target healthTarget) {
+			check, err := ParseHealthCheck(target.check)
+			if err == nil {
+				err = check.probe(net.ParseIP(target.ip))
+			}
+			results <- result{target, err}
+		}(target)
+	}
+	newFailures := make(map[healthTarget]int)
+	for range targets {
+		res := <-results
+		if res.err == nil {
+			zone.setHealthy(res.target, true)
+			continue
+		}
+		count := failures[res.target] + 1
+		newFailures[res.target] = count
+		Debug.Printf("[zonedb] Health check %s of %.12s at %s failed (%d): %s", res.target.check, res.target.ident, res.target.ip, count, res.err)
+		if count >= healthCheckFailures {
+			zone.setHealthy(res.target, false)
+		}
+	}
+	return newFailures
+}
+
+func (zone *ZoneDb) healthTargets() []healthTarget {
+	zone.mx.RLock()
+	defer zone.mx.RUnlock()
+	seen := make(map[healthTarget]struct{})
+	var targets []healthTarget
+	for _, r := range zone.recs {
+		if r.Origin != zone.ourName || !r.isLive() || r.Check == "" {
+			continue
+		}
+		target := healthTarget{r.Ident, r.IP.String(), r.Check}
+		if _, found := seen[target]; !found {
+			seen[target] = struct{}{}
+			targets = append(targets, target)
+		}
+	}
+	return targets
+}
+
+func (zone *ZoneDb) setHealthy(target healthTarget, healthy bool) {
+	zone.mx.Lock()
+	var changed []dbRecord
+	for i := range zone.recs {
+		r := &zone.recs[i]
+		if r.Origin == zone.ourName && r.isLive() && r.Ident == target.ident &&
+			r.IP.String() == target.ip && r.Check == target.check && r.Unhealthy == healthy {
+			r.Unhealthy = !healthy
+			r.Version++
+			changed = append(changed, *r)
+		}
+	}
+	zone.mx.Unlock()
+	if len(changed) > 0 {
+		if healthy {
+			Info.Printf("[zonedb] %.12s at %s has recovered", target.ident, target.ip)
+		} else {
+			Info.Printf("[zonedb] %.12s at %s is unhealthy; withholding it from DNS answers", target.ident, target.ip)
+		}
+		zone.broadcast(changed)
+	}
+}
@@ -0,0 +1,77 @@
+package nameserver
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	wt "github.com/weaveworks/weave/testing"
+)
+
+func TestParseHealthCheck(t *testing.T) {
+	for spec, expected := range map[string]string{
+		"tcp:80":            "tcp:80",
+		"http:8080":         "http:8080/",
+		"http:8080/healthz": "http:8080/healthz",
+	} {
+		check, err := ParseHealthCheck(spec)
+		wt.AssertNoErr(t, err)
+		wt.AssertEqualString(t, check.String(), expected, "health check")
+	}
+	for _, spec := range []string{"", "tcp", "udp:53", "tcp:http", "tcp:0", "http:/healthz"} {
+		_, err := ParseHealthCheck(spec)
+		wt.AssertTrue(t, err != nil, "error for "+spec)
+	}
+}
+
+func TestHealthCheck(t *testing.T) {
+	healthy := true
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !healthy {
+			http.Error(w, "poorly", http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+	_, portStr, _ := net.SplitHostPort(server.Listener.Addr().String())
+	port, _ := strconv.Atoi(portStr)
+
+	const name = "web.weave.local."
+	zone := NewZoneDb(DefaultLocalDomain)
+	local, other := net.ParseIP("127.0.0.1"), net.ParseIP("10.2.2.2")
+	wt.AssertNoErr(t, zone.AddRecord("deadbeef", name, local))
+	wt.AssertNoErr(t, zone.AddRecord("cowjuice", name, other))
+	wt.AssertNoErr(t, zone.SetHealthCheck("deadbeef", local, &HealthCheck{Kind: "http", Port: port, Path: "/"}))
+	wt.AssertErrorType(t, zone.SetHealthCheck("nobody", local, nil), (*LookupError)(nil), "check for unknown record")
+
+	lookup := func() int {
+		found, _ := zone.LookupName(name)
+		return len(found)
+	}
+
+	failures := zone.runHealthChecks(nil)
+	wt.AssertEqualInt(t, lookup(), 2, "answers while healthy")
+
+	// it takes more than one failure for an address to be withheld
+	healthy = false
+	failures = zone.runHealthChecks(failures)
+	wt.AssertEqualInt(t, lookup(), 2, "answers after one failure")
+	failures = zone.runHealthChecks(failures)
+	wt.AssertEqualInt(t, lookup(), 1, "answers after repeated failure")
+	found, err := zone.LookupName(name)
+	wt.AssertNoErr(t, err)
+	wt.AssertTrue(t, found[0].IP().Equal(other), "remaining address")
+
+	// but only one success to bring it back
+	healthy = true
+	failures = zone.runHealthChecks(failures)
+	wt.AssertEqualInt(t, lookup(), 2, "answers after recovery")
+
+	// removing the check makes it healthy regardless
+	healthy = false
+	zone.runHealthChecks(zone.runHealthChecks(failures))
+	wt.AssertEqualInt(t, lookup(), 1, "answers after failing again")
+	wt.AssertNoErr(t, zone.SetHealthCheck("deadbeef", local, nil))
+	wt.AssertEqualInt(t, lookup(), 2, "answers after removing check")
+}
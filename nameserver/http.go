@@ -25,6 +25,19 @@ func ListenHTTP(version string, server *DNSServer, domain string, db Zone, port
 		fmt.Fprintln(w, server.Status())
 	})
 
+	HandleHTTP(muxRouter, domain, db)
+
+	http.Handle("/", muxRouter)
+
+	address := fmt.Sprintf(":%d", port)
+	if err := http.ListenAndServe(address, nil); err != nil {
+		Error.Fatal("[http] Unable to create http listener: ", err)
+	}
+}
+
+// HandleHTTP wires up the name registration endpoints to the
+// provided mux, so they can be served alongside other subsystems.
+func HandleHTTP(muxRouter *mux.Router, domain string, db Zone) {
 	muxRouter.Methods("PUT").Path("/name/{id:.+}/{ip:.+}").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		reqError := func(msg string, logmsg string, logargs ...interface{}) {
 			httpErrorAndLog(Warning, w, msg, http.StatusBadRequest, logmsg, logargs...)
@@ -46,6 +59,37 @@ func ListenHTTP(version string, server *DNSServer, domain string, db Zone, port
 			return
 		}
 
+		// an empty check removes any existing one
+		var check *HealthCheck
+		_, haveCheck := r.Form["check"]
+		if spec := r.FormValue("check"); spec != "" {
+			var err error
+			if check, err = ParseHealthCheck(spec); err != nil {
+				reqError(err.Error(), "Invalid health check in request: %s", spec)
+				return
+			}
+		}
+		hcZone, canCheck := db.(HealthCheckedZone)
+		if check != nil && !canCheck {
+			reqError("Health checks not supported", "Health check requested but not supported: %s", r.URL)
+			return
+		}
+
+		var services []Service
+		for _, spec := range r.Form["srv"] {
+			service, err := ParseService(spec)
+			if err != nil {
+				reqError(err.Error(), "Invalid service in request: %s", spec)
+				return
+			}
+			services = append(services, service)
+		}
+		serviceZone, canServe := db.(ServiceZone)
+		if len(services) > 0 && !canServe {
+			reqError("Services not supported", "Services given but not supported: %s", r.URL)
+			return
+		}
+
 		if dns.IsSubDomain(domain, name) {
 			Info.Printf("[http] Adding %s -> %s", name, ipStr)
 			if err := db.AddRecord(idStr, name, ip); err != nil {
@@ -56,8 +100,30 @@ func ListenHTTP(version string, server *DNSServer, domain string, db Zone, port
 					return
 				} // oh, I already know this. whatever.
 			}
+			if len(services) > 0 {
+				Info.Printf("[http] Services for %s -> %s: %v", name, ipStr, services)
+				if err := serviceZone.SetServices(idStr, ip, services); err != nil {
+					httpErrorAndLog(
+						Error, w, "Internal error", http.StatusInternalServerError,
+						"Unexpected error from DB: %s", err)
+					return
+				}
+			}
+			if haveCheck && canCheck {
+				Info.Printf("[http] Health check for %s -> %s: %s", name, ipStr, r.FormValue("check"))
+				if err := hcZone.SetHealthCheck(idStr, ip, check); err != nil {
+					httpErrorAndLog(
+						Error, w, "Internal error", http.StatusInternalServerError,
+						"Unexpected error from DB: %s", err)
+					return
+				}
+			}
 		} else {
 			Info.Printf("[http] Ignoring name %s, not in %s", name, domain)
+			// but it may have other names that are
+			if reg, ok := db.(ContainerRegistrar); ok {
+				reg.RegisterContainer(idStr, ip)
+			}
 		}
 	})
 
@@ -86,10 +152,13 @@ func ListenHTTP(version string, server *DNSServer, domain string, db Zone, port
 		}
 	})
 
-	http.Handle("/", muxRouter)
-
-	address := fmt.Sprintf(":%d", port)
-	if err := http.ListenAndServe(address, nil); err != nil {
-		Error.Fatal("[http] Unable to create http listener: ", err)
-	}
+	muxRouter.Methods("DELETE").Path("/name/{id:[^/]+}").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		idStr := mux.Vars(r)["id"]
+		Info.Printf("[http] Deleting all records for %s", idStr)
+		if err := db.DeleteRecordsFor(idStr); err != nil {
+			httpErrorAndLog(
+				Error, w, "Internal error", http.StatusInternalServerError,
+				"Unexpected error from DB: %s", err)
+		}
+	})
 }
@@ -85,6 +85,19 @@ func TestHttp(t *testing.T) {
 	t.Logf("Got %s", x)
 	wt.AssertErrorType(t, err, (*LookupError)(nil), "fully-removed address")
 
+	// Add a couple of names and delete them all in one go
+	for _, name := range []string{"test2." + testDomain, "test3." + testDomain} {
+		resp, err = genForm("PUT", addrURL+"?fqdn="+name, nil)
+		wt.AssertNoErr(t, err)
+		wt.AssertStatus(t, resp.StatusCode, http.StatusOK, "http response")
+		_, err = zone.LookupName(name)
+		wt.AssertNoErr(t, err)
+	}
+	resp, err = genForm("DELETE", fmt.Sprintf("http://localhost:%d/name/%s", port, containerID), nil)
+	wt.AssertNoErr(t, err)
+	wt.AssertStatus(t, resp.StatusCode, http.StatusOK, "http response")
+	wt.AssertEqualInt(t, len(zone.ContainerIdents()), 0, "idents after deleting all")
+
 	// Would like to shut down the http server at the end of this test
 	// but it's complicated.
 	// See https://groups.google.com/forum/#!topic/golang-nuts/vLHWa5sHnCE
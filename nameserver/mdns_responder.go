@@ -0,0 +1,208 @@
+package nameserver
+
+import (
+	"net"
+	"os"
+	"syscall"
+
+	"github.com/miekg/dns"
+	. "github.com/weaveworks/weave/common"
+)
+
+const (
+	mdnsUnicastBit   = 1 << 15 // in a question's class: the querier would like a unicast reply (QU)
+	mdnsCacheFlush   = 1 << 15 // in an answer's class: this is the whole set of records for the name
+	mdnsLegacyTTL    = 10      // maximum TTL in replies to legacy unicast queries (RFC 6762, 6.7)
+	mdnsMulticastTTL = 255     // multicast IP TTL required of responses (RFC 6762, 11)
+	mdnsLocalDomain  = "local."
+)
+
+// MDNSResponder answers queries for registered names from ordinary
+// multicast DNS clients - avahi, nss-mdns, Bonjour - on an interface
+// such as the weave bridge, so that containers doing zero-configuration
+// discovery can find each other.
+//
+// Unlike the MDNSServer, which answers other weave peers, it sticks to
+// what RFC 6762 asks of a responder: responses come from port 5353,
+// legacy queries (from any other port) get a unicast reply echoing
+// the query, and everything else gets a multicast reply with the
+// cache-flush bit set. As well as names in the weave domain, it answers
+// for "<name>.local." by looking up "<name>.<domain>", since that is
+// what most mDNS clients ask for.
+type MDNSResponder struct {
+	zone     Zone
+	ttl      uint32
+	sendconn net.PacketConn
+	srv      *dns.Server
+	running  bool
+}
+
+// Create a new mDNS responder
+// Nothing will be done (including port bindings) until you `Start()` it
+func NewMDNSResponder(zone Zone, ttl uint32) *MDNSResponder {
+	return &MDNSResponder{zone: zone, ttl: ttl}
+}
+
+// Start answering queries arriving on ifi (or all interfaces if nil)
+func (r *MDNSResponder) Start(ifi *net.Interface) (err error) {
+	if r.running {
+		return nil
+	}
+	if r.sendconn, err = mdnsSendConn(ifi); err != nil {
+		return err
+	}
+	conn, err := LinkLocalMulticastListener(ifi)
+	if err != nil {
+		r.sendconn.Close()
+		return err
+	}
+	r.srv = &dns.Server{PacketConn: conn, Handler: dns.HandlerFunc(r.handle)}
+	go r.srv.ActivateAndServe()
+	r.running = true
+	return nil
+}
+
+// Stop the mDNS responder
+func (r *MDNSResponder) Stop() error {
+	if !r.running {
+		return nil
+	}
+	r.running = false
+	r.sendconn.Close()
+	return r.srv.Shutdown()
+}
+
+// A UDP socket bound to the mDNS port, sharing it with the multicast
+// listener, for sending responses from.
+func mdnsSendConn(ifi *net.Interface) (net.PacketConn, error) {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, syscall.IPPROTO_UDP)
+	if err != nil {
+		return nil, err
+	}
+	f := os.NewFile(uintptr(fd), "mdns")
+	defer f.Close()
+	if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1); err != nil {
+		return nil, err
+	}
+	if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_IP, syscall.IP_MULTICAST_TTL, mdnsMulticastTTL); err != nil {
+		return nil, err
+	}
+	if ifi != nil {
+		if err := syscall.SetsockoptIPMreqn(fd, syscall.IPPROTO_IP, syscall.IP_MULTICAST_IF, &syscall.IPMreqn{Ifindex: int32(ifi.Index)}); err != nil {
+			return nil, err
+		}
+	}
+	if err := syscall.Bind(fd, &syscall.SockaddrInet4{Port: mdnsPort}); err != nil {
+		return nil, err
+	}
+	return net.FilePacketConn(f)
+}
+
+func (r *MDNSResponder) handle(rw dns.ResponseWriter, q *dns.Msg) {
+	from, ok := rw.RemoteAddr().(*net.UDPAddr)
+	if !ok || len(q.Question) == 0 {
+		return
+	}
+	legacy := from.Port != mdnsPort
+	unicast := legacy
+	var answers []dns.RR
+	for _, question := range q.Question {
+		if question.Qclass&mdnsUnicastBit != 0 {
+			unicast = true
+		}
+		answers = append(answers, r.answer(&question, legacy)...)
+	}
+	if len(answers) == 0 {
+		return
+	}
+	m := r.makeResponse(q, answers, legacy)
+	buf, err := m.Pack()
+	if err != nil {
+		Warning.Printf("[mdns msgid %d] responder: unable to pack response: %s", q.Id, err)
+		return
+	}
+	to := net.Addr(ipv4Addr)
+	if unicast {
+		to = from
+	}
+	if _, err := r.sendconn.WriteTo(buf, to); err != nil {
+		Warning.Printf("[mdns msgid %d] responder: error sending response to %s: %s", q.Id, to, err)
+		return
+	}
+	Debug.Printf("[mdns msgid %d] responder: sent %d answers to %s", q.Id, len(m.Answer), to)
+}
+
+// Responses to legacy queries look like ordinary DNS responses, as
+// that is what their senders expect; others leave out the ID and the
+// questions.
+func (r *MDNSResponder) makeResponse(q *dns.Msg, answers []dns.RR, legacy bool) *dns.Msg {
+	m := new(dns.Msg)
+	m.Response = true
+	m.Authoritative = true
+	m.Answer = answers
+	if legacy {
+		m.Id = q.Id
+		m.Question = q.Question
+	}
+	return m
+}
+
+func (r *MDNSResponder) answer(q *dns.Question, legacy bool) []dns.RR {
+	class := q.Qclass &^ mdnsUnicastBit
+	if class != dns.ClassINET && class != dns.ClassANY {
+		return nil
+	}
+	hdr := dns.RR_Header{Name: q.Name, Class: dns.ClassINET, Ttl: r.ttl}
+	if legacy {
+		if hdr.Ttl > mdnsLegacyTTL {
+			hdr.Ttl = mdnsLegacyTTL
+		}
+	} else {
+		hdr.Class |= mdnsCacheFlush
+	}
+
+	var answers []dns.RR
+	switch {
+	case dns.IsSubDomain(RDNSDomain, q.Name):
+		if q.Qtype != dns.TypePTR && q.Qtype != dns.TypeANY {
+			return nil
+		}
+		names, err := r.zone.LookupInaddr(q.Name)
+		if err != nil {
+			return nil
+		}
+		hdr.Rrtype = dns.TypePTR
+		for _, n := range names {
+			answers = append(answers, &dns.PTR{Hdr: hdr, Ptr: n.Name()})
+		}
+	case q.Qtype == dns.TypeA || q.Qtype == dns.TypeANY:
+		name, ok := r.zoneName(q.Name)
+		if !ok {
+			return nil
+		}
+		ips, err := r.zone.LookupName(name)
+		if err != nil {
+			return nil
+		}
+		hdr.Rrtype = dns.TypeA
+		for _, ip := range ips {
+			if ip4 := ip.IP().To4(); ip4 != nil {
+				answers = append(answers, &dns.A{Hdr: hdr, A: ip4})
+			}
+		}
+	}
+	return answers
+}
+
+// The name to look up in the zone for a query for name, if we are
+// responsible for it
+func (r *MDNSResponder) zoneName(name string) (string, bool) {
+	domain := r.zone.Domain()
+	switch {
+	case dns.IsSubDomain(domain, name):
+		return name, true
+	case dns.IsSubDomain(mdnsLocalDomain, name) && name != mdnsLocalDomain:
+		return name[:len(name)-len(mdnsLocalDomain)] + domain, true
+	}
+	return "", false
+}
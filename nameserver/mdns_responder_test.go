@@ -0,0 +1,84 @@
+package nameserver
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	. "github.com/weaveworks/weave/common"
+	wt "github.com/weaveworks/weave/testing"
+)
+
+func TestMDNSResponder(t *testing.T) {
+	var (
+		testRecord = Record{"test.weave.local.", net.ParseIP("10.20.20.10"), 0, 0, 0}
+		testInAddr = "10.20.20.10.in-addr.arpa."
+	)
+
+	InitDefaultLogging(testing.Verbose())
+	Info.Println("TestMDNSResponder starting")
+
+	responder := NewMDNSResponder(newMockedZoneWithRecords([]ZoneRecord{testRecord}), 30)
+	wt.AssertNoErr(t, responder.Start(nil))
+	defer responder.Stop()
+
+	// Legacy queries, from a port other than 5353, get a unicast reply
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4zero, Port: 0})
+	wt.AssertNoErr(t, err)
+	defer conn.Close()
+	query := func(name string, qtype uint16) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetQuestion(name, qtype)
+		buf, err := m.Pack()
+		wt.AssertNoErr(t, err)
+		_, err = conn.WriteTo(buf, ipv4Addr)
+		wt.AssertNoErr(t, err)
+		conn.SetReadDeadline(time.Now().Add(testSocketTimeout * time.Millisecond))
+		reply := make([]byte, maxUDPSize)
+		for {
+			n, err := conn.Read(reply)
+			if err != nil {
+				return nil
+			}
+			r := new(dns.Msg)
+			if r.Unpack(reply[:n]) == nil && r.Id == m.Id {
+				wt.AssertEqualInt(t, len(r.Question), 1, "question echoed")
+				return r
+			}
+		}
+	}
+
+	for _, name := range []string{"test.weave.local.", "test.local."} {
+		r := query(name, dns.TypeA)
+		wt.AssertTrue(t, r != nil, "reply for "+name)
+		wt.AssertEqualInt(t, len(r.Answer), 1, "answers for "+name)
+		a := r.Answer[0].(*dns.A)
+		wt.AssertEqualString(t, a.Hdr.Name, name, "answer name")
+		wt.AssertTrue(t, a.A.Equal(testRecord.IP()), "answer address")
+		wt.AssertEqualInt(t, int(a.Hdr.Ttl), mdnsLegacyTTL, "legacy TTL")
+		wt.AssertEqualInt(t, int(a.Hdr.Class), dns.ClassINET, "legacy class")
+	}
+
+	r := query(testInAddr, dns.TypePTR)
+	wt.AssertTrue(t, r != nil, "reply for "+testInAddr)
+	wt.AssertEqualString(t, r.Answer[0].(*dns.PTR).Ptr, testRecord.Name(), "reverse answer")
+
+	wt.AssertTrue(t, query("other.local.", dns.TypeA) == nil, "no reply for unknown name")
+	wt.AssertTrue(t, query("test.example.com.", dns.TypeA) == nil, "no reply for other domain")
+
+	// Multicast replies drop the ID and questions, and mark the
+	// answers as complete
+	q := dns.Question{Name: "test.local.", Qtype: dns.TypeA, Qclass: dns.ClassINET | mdnsUnicastBit}
+	answers := responder.answer(&q, false)
+	wt.AssertEqualInt(t, len(answers), 1, "multicast answers")
+	wt.AssertEqualInt(t, int(answers[0].Header().Ttl), 30, "multicast TTL")
+	wt.AssertEqualInt(t, int(answers[0].Header().Class), dns.ClassINET|mdnsCacheFlush, "multicast class")
+	m := new(dns.Msg)
+	m.Question = []dns.Question{q}
+	m.Id = 42
+	reply := responder.makeResponse(m, answers, false)
+	wt.AssertEqualInt(t, int(reply.Id), 0, "multicast reply ID")
+	wt.AssertEqualInt(t, len(reply.Question), 0, "multicast reply questions")
+	wt.AssertTrue(t, reply.Response && reply.Authoritative, "multicast reply flags")
+}
@@ -64,7 +64,7 @@ func (s *MDNSServer) Start(ifi *net.Interface) (err error) {
 	handleLocal := s.makeHandler(dns.TypeA,
 		func(zone ZoneLookup, r *dns.Msg, q *dns.Question) *dns.Msg {
 			if ips, err := zone.LookupName(q.Name); err == nil {
-				return makeAddressReply(r, q, ips)
+				return makeAddressReply(r, q, ips, localTTL)
 			}
 			return nil
 		})
@@ -72,7 +72,7 @@ func (s *MDNSServer) Start(ifi *net.Interface) (err error) {
 	handleReverse := s.makeHandler(dns.TypePTR,
 		func(zone ZoneLookup, r *dns.Msg, q *dns.Question) *dns.Msg {
 			if names, err := zone.LookupInaddr(q.Name); err == nil {
-				return makePTRReply(r, q, names)
+				return makePTRReply(r, q, names, localTTL)
 			}
 			return nil
 		})
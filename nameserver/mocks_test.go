@@ -81,6 +81,10 @@ func (mz *mockedZoneWithRecords) DeleteRecord(ident string, ip net.IP) error {
 }
 func (mz *mockedZoneWithRecords) DeleteRecordsFor(ident string) error { notImplWarn(); return nil }
 func (mz *mockedZoneWithRecords) Status() string                      { notImplWarn(); return "nothing" }
+func (mz *mockedZoneWithRecords) LookupIdent(ident string) ([]ZoneRecord, error) {
+	notImplWarn()
+	return nil, nil
+}
 func (mz *mockedZoneWithRecords) ObserveName(name string, observer ZoneRecordObserver) error {
 	notImplWarn()
 	return nil
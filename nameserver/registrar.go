@@ -0,0 +1,88 @@
+package nameserver
+
+import (
+	"net"
+	"strings"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/miekg/dns"
+	. "github.com/weaveworks/weave/common"
+	"github.com/weaveworks/weave/common/updater"
+)
+
+// The label containers can be given to name them in DNS
+const DefaultNameLabel = "weave.dns.name"
+
+type ContainerInspector interface {
+	InspectContainer(id string) (*docker.Container, error)
+}
+
+// ContainerRegistrar may be implemented by a Zone that can work out
+// for itself what names a container should have.
+type ContainerRegistrar interface {
+	RegisterContainer(ident string, ip net.IP)
+}
+
+// AutoRegistrar is a ZoneDb which, whenever a container is registered
+// at an address, also registers it there under its Docker name, its
+// hostname, and the name in its label, where those are in the
+// domain. They go when the container dies, along with everything
+// else it's registered under.
+type AutoRegistrar struct {
+	*ZoneDb
+	inspector ContainerInspector
+	label     string
+}
+
+func NewAutoRegistrar(zone *ZoneDb, inspector ContainerInspector, label string) *AutoRegistrar {
+	return &AutoRegistrar{ZoneDb: zone, inspector: inspector, label: label}
+}
+
+func (reg *AutoRegistrar) AddRecord(ident string, name string, ip net.IP) error {
+	err := reg.ZoneDb.AddRecord(ident, name, ip)
+	if _, dup := err.(DuplicateError); err == nil || dup {
+		reg.RegisterContainer(ident, ip)
+	}
+	return err
+}
+
+func (reg *AutoRegistrar) RegisterContainer(ident string, ip net.IP) {
+	for _, name := range reg.containerNames(ident) {
+		if err := reg.ZoneDb.AddRecord(ident, name, ip); err == nil {
+			Info.Printf("[registrar] Adding %s -> %s for %.12s", name, ip, ident)
+		}
+	}
+}
+
+func (reg *AutoRegistrar) containerNames(ident string) []string {
+	if !updater.IsContainerID(ident) {
+		return nil
+	}
+	container, err := reg.inspector.InspectContainer(ident)
+	if err != nil {
+		Debug.Printf("[registrar] Unable to inspect container %.12s: %s", ident, err)
+		return nil
+	}
+	var names []string
+	add := func(name string) {
+		if name = dns.Fqdn(name); dns.IsSubDomain(reg.domain, name) {
+			names = append(names, name)
+		}
+	}
+	if name := strings.TrimPrefix(container.Name, "/"); name != "" && !strings.Contains(name, "/") {
+		add(name + "." + reg.domain)
+	}
+	if config := container.Config; config != nil {
+		if config.Hostname != "" && config.Domainname != "" {
+			add(config.Hostname + "." + config.Domainname)
+		}
+		if name := config.Labels[reg.label]; name != "" {
+			// a bare name goes in our domain
+			if !strings.Contains(strings.TrimSuffix(name, "."), ".") {
+				name = name + "." + reg.domain
+			}
+			add(name)
+		}
+	}
+	return names
+}
@@ -0,0 +1,65 @@
+package nameserver
+
+import (
+	"net"
+	"testing"
+
+	"github.com/fsouza/go-dockerclient"
+	wt "github.com/weaveworks/weave/testing"
+)
+
+type mockInspector map[string]*docker.Container
+
+func (m mockInspector) InspectContainer(id string) (*docker.Container, error) {
+	if container, found := m[id]; found {
+		return container, nil
+	}
+	return nil, &docker.NoSuchContainer{ID: id}
+}
+
+func TestAutoRegistrar(t *testing.T) {
+	const (
+		webID   = "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+		plainID = "fedcba9876543210fedcba9876543210fedcba9876543210fedcba9876543210"
+	)
+	inspector := mockInspector{
+		webID: &docker.Container{
+			Name: "/web1",
+			Config: &docker.Config{
+				Hostname:   "frontend",
+				Domainname: "weave.local",
+				Labels:     map[string]string{DefaultNameLabel: "www"},
+			},
+		},
+		plainID: &docker.Container{
+			Name:   "/plain",
+			Config: &docker.Config{Hostname: "plain", Domainname: "example.com"},
+		},
+	}
+	zone := NewZoneDb(DefaultLocalDomain)
+	reg := NewAutoRegistrar(zone, inspector, DefaultNameLabel)
+	ip1, ip2 := net.ParseIP("10.2.2.1"), net.ParseIP("10.2.2.2")
+
+	wt.AssertNoErr(t, reg.AddRecord(webID, "frontend.weave.local.", ip1))
+	for _, name := range []string{"frontend.weave.local.", "web1.weave.local.", "www.weave.local."} {
+		_, err := reg.LookupName(name)
+		wt.AssertNoErr(t, err)
+	}
+
+	// the hostname is outside the domain, so only the name is used
+	reg.RegisterContainer(plainID, ip2)
+	_, err := reg.LookupName("plain.weave.local.")
+	wt.AssertNoErr(t, err)
+	_, err = reg.LookupName("plain.example.com.")
+	wt.AssertErrorType(t, err, (*LookupError)(nil), "name outside domain")
+
+	// things that aren't containers just get the name they're given
+	wt.AssertNoErr(t, reg.AddRecord("weave:expose", "host.weave.local.", ip2))
+
+	// all names go when the container dies
+	wt.AssertNoErr(t, reg.ContainerDied(webID))
+	for _, name := range []string{"frontend.weave.local.", "web1.weave.local.", "www.weave.local."} {
+		_, err := reg.LookupName(name)
+		wt.AssertErrorType(t, err, (*LookupError)(nil), "name after death")
+	}
+}
@@ -28,12 +28,24 @@ type DNSServerConfig struct {
 	Port int
 	// (Optional) local domain (ie, "weave.local.")
 	LocalDomain string
+	// (Optional) TTL, in seconds, of answers for names in the local domain
+	LocalTTL int
+	// (Optional) use LocalTTL even if it is 0
+	LocalTTLSet bool
 	// (Optional) cache size
 	CacheLen int
 	// (Optional) timeout for DNS queries
 	Timeout int
 	// (Optional) UDP buffer length
 	UDPBufLen int
+	// (Optional) subnets we alone answer reverse queries for
+	Subnets []*net.IPNet
+	// (Optional) answer with just one, randomly chosen, address when
+	// several containers share a name
+	SingleAnswer bool
+	// (Optional) also answer queries from ordinary mDNS clients, such
+	// as avahi, on the interface
+	MDNSResponder bool
 }
 
 type dnsProtocol uint8
@@ -72,10 +84,14 @@ type DNSServer struct {
 	tcpSrv      *dns.Server
 	mdnsCli     *MDNSClient
 	mdnsSrv     *MDNSServer
+	mdnsResp    *MDNSResponder
 	cache       *Cache
 	timeout     int
 	udpBuf      int
 	listenersWg *sync.WaitGroup
+	subnets     []*net.IPNet
+	single      bool
+	ttl         uint32
 
 	Domain     string // the local domain
 	ListenAddr string // the address the server is listening at
@@ -87,6 +103,7 @@ func NewDNSServer(config DNSServerConfig, zone Zone, iface *net.Interface) (s *D
 		Zone:        zone,
 		Iface:       iface,
 		listenersWg: new(sync.WaitGroup),
+		ttl:         localTTL,
 
 		Domain:     DefaultLocalDomain,
 		ListenAddr: fmt.Sprintf(":%d", DefaultServerPort),
@@ -97,7 +114,10 @@ func NewDNSServer(config DNSServerConfig, zone Zone, iface *net.Interface) (s *D
 		s.ListenAddr = fmt.Sprintf(":%d", config.Port)
 	}
 	if len(config.LocalDomain) > 0 {
-		s.Domain = config.LocalDomain
+		s.Domain = dns.Fqdn(config.LocalDomain)
+	}
+	if config.LocalTTL > 0 || (config.LocalTTLSet && config.LocalTTL == 0) {
+		s.ttl = uint32(config.LocalTTL)
 	}
 	if config.UpstreamCfg != nil {
 		s.Upstream = config.UpstreamCfg
@@ -116,6 +136,8 @@ func NewDNSServer(config DNSServerConfig, zone Zone, iface *net.Interface) (s *D
 	if config.UDPBufLen > 0 {
 		s.udpBuf = config.UDPBufLen
 	}
+	s.subnets = config.Subnets
+	s.single = config.SingleAnswer
 	s.mdnsCli, err = NewMDNSClient()
 	if err != nil {
 		return
@@ -124,6 +146,9 @@ func NewDNSServer(config DNSServerConfig, zone Zone, iface *net.Interface) (s *D
 	if err != nil {
 		return
 	}
+	if config.MDNSResponder {
+		s.mdnsResp = NewMDNSResponder(s.Zone, s.ttl)
+	}
 	cacheLen := DefaultCacheLen
 	if config.CacheLen > 0 {
 		cacheLen = config.CacheLen
@@ -157,6 +182,10 @@ func (s *DNSServer) Start() error {
 	CheckFatal(err)
 	err = s.mdnsSrv.Start(s.Iface)
 	CheckFatal(err)
+	if s.mdnsResp != nil {
+		err = s.mdnsResp.Start(s.Iface)
+		CheckFatal(err)
+	}
 
 	s.listenersWg.Add(2)
 
@@ -189,9 +218,19 @@ func (s *DNSServer) Start() error {
 func (s *DNSServer) Status() string {
 	var buf bytes.Buffer
 	fmt.Fprintln(&buf, "Local domain", s.Domain)
+	fmt.Fprintln(&buf, "Local TTL", s.ttl)
 	fmt.Fprintln(&buf, "Listen address", s.ListenAddr)
 	fmt.Fprintln(&buf, "mDNS interface", s.Iface)
+	if s.mdnsResp != nil {
+		fmt.Fprintln(&buf, "Answering mDNS clients on", s.Iface)
+	}
 	fmt.Fprintln(&buf, "Fallback DNS config", s.Upstream)
+	for _, subnet := range s.subnets {
+		fmt.Fprintln(&buf, "Reverse lookups for", subnet)
+	}
+	if s.single {
+		fmt.Fprintln(&buf, "Answering with a single address per name")
+	}
 	fmt.Fprintf(&buf, "Zone database:\n%s", s.Zone)
 	return buf.String()
 }
@@ -209,24 +248,42 @@ func (s *DNSServer) Stop() error {
 
 	// shutdown the mDNS server
 	s.mdnsSrv.Stop()
+	if s.mdnsResp != nil {
+		s.mdnsResp.Stop()
+	}
 
 	return nil
 }
 
 func (s *DNSServer) queryHandler(proto dnsProtocol) dns.HandlerFunc {
 	zoneLookup := func(lookup ZoneLookup, q *dns.Question, r *dns.Msg) (*dns.Msg, []ZoneRecord, error) {
+		if q.Qtype == dns.TypeSRV {
+			serviceLookup, ok := lookup.(ServiceLookup)
+			if !ok {
+				return nil, nil, LookupError(q.Name)
+			}
+			services, err := serviceLookup.LookupService(q.Name)
+			if err != nil {
+				return nil, nil, err
+			}
+			records := make([]ZoneRecord, len(services))
+			for i, service := range services {
+				records[i] = service
+			}
+			return makeSRVReply(r, q, services, s.ttl), records, nil
+		}
 		ips, err := lookup.LookupName(q.Name)
 		if err != nil {
 			return nil, nil, err
 		}
-		return makeAddressReply(r, q, ips), ips, nil
+		return makeAddressReply(r, q, ips, s.ttl), ips, nil
 	}
 
 	fallback := func(w dns.ResponseWriter, r *dns.Msg) {
 		w.WriteMsg(makeDNSFailResponse(r))
 	}
 
-	return s.commonQueryHandler(proto, "Query", dns.TypeA, zoneLookup, fallback)
+	return s.commonQueryHandler(proto, "Query", []uint16{dns.TypeA, dns.TypeSRV}, zoneLookup, fallback)
 }
 
 func (s *DNSServer) rdnsHandler(proto dnsProtocol) dns.HandlerFunc {
@@ -235,19 +292,28 @@ func (s *DNSServer) rdnsHandler(proto dnsProtocol) dns.HandlerFunc {
 		if err != nil {
 			return nil, nil, err
 		}
-		return makePTRReply(r, q, names), names, nil
+		return makePTRReply(r, q, names, s.ttl), names, nil
 	}
 
 	notUsHandler := s.notUsHandler(proto)
 	fallback := func(w dns.ResponseWriter, r *dns.Msg) {
+		// Nobody else can know about addresses in our subnets, so
+		// don't ask them
+		if s.inSubnets(r.Question[0].Name) {
+			Debug.Printf("[dns msgid %d] -> no name for address in local subnet", r.MsgHdr.Id)
+			m := makeDNSFailResponse(r)
+			m.Authoritative = true
+			w.WriteMsg(m)
+			return
+		}
 		Info.Printf("[dns msgid %d] -> sending to fallback server", r.MsgHdr.Id)
 		notUsHandler(w, r)
 	}
 
-	return s.commonQueryHandler(proto, "Reverse query", dns.TypePTR, zoneLookup, fallback)
+	return s.commonQueryHandler(proto, "Reverse query", []uint16{dns.TypePTR}, zoneLookup, fallback)
 }
 
-func (s *DNSServer) commonQueryHandler(proto dnsProtocol, kind string, qtype uint16,
+func (s *DNSServer) commonQueryHandler(proto dnsProtocol, kind string, qtypes []uint16,
 	zoneLookup func(ZoneLookup, *dns.Question, *dns.Msg) (*dns.Msg, []ZoneRecord, error), fallback dns.HandlerFunc) dns.HandlerFunc {
 
 	return func(w dns.ResponseWriter, r *dns.Msg) {
@@ -270,12 +336,12 @@ func (s *DNSServer) commonQueryHandler(proto dnsProtocol, kind string, qtype uin
 		if reply != nil {
 			Debug.Printf("[dns msgid %d] Returning reply from cache: %s/%d answers",
 				r.MsgHdr.Id, dns.RcodeToString[reply.MsgHdr.Rcode], len(reply.Answer))
-			w.WriteMsg(reply)
+			s.writeReply(w, reply)
 			return
 		}
 
 		// catch unsupported queries
-		if q.Qtype != qtype {
+		if !supportedType(q.Qtype, qtypes) {
 			Debug.Printf("[dns msgid %d] Unsupported query type %s", r.MsgHdr.Id, dns.TypeToString[q.Qtype])
 			m := makeDNSFailResponse(r)
 			s.cache.Put(r, m, negLocalTTL, 0)
@@ -289,7 +355,7 @@ func (s *DNSServer) commonQueryHandler(proto dnsProtocol, kind string, qtype uin
 				Debug.Printf("[dns msgid %d] Caching response for type %s query for '%s': %s [code:%s]",
 					m.MsgHdr.Id, dns.TypeToString[q.Qtype], q.Name, answers, dns.RcodeToString[m.Rcode])
 				s.cache.Put(r, m, nullTTL, 0)
-				w.WriteMsg(m)
+				s.writeReply(w, m)
 				return
 			}
 		}
@@ -302,6 +368,41 @@ func (s *DNSServer) commonQueryHandler(proto dnsProtocol, kind string, qtype uin
 	}
 }
 
+func supportedType(qtype uint16, qtypes []uint16) bool {
+	for _, t := range qtypes {
+		if t == qtype {
+			return true
+		}
+	}
+	return false
+}
+
+// Answers for shared names come to us in random order, so if we're
+// only giving out one we can just take the first.
+func (s *DNSServer) writeReply(w dns.ResponseWriter, m *dns.Msg) {
+	if s.single && len(m.Answer) > 1 {
+		single := *m
+		single.Answer = m.Answer[:1]
+		m = &single
+	}
+	w.WriteMsg(m)
+}
+
+// Is the reverse address (eg, "1.2.2.10.in-addr.arpa.") in one of
+// our subnets?
+func (s *DNSServer) inSubnets(inaddr string) bool {
+	ip, err := raddrToIP(inaddr)
+	if err != nil {
+		return false
+	}
+	for _, subnet := range s.subnets {
+		if subnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
 // When we receive a request for a name outside of our '.weave.local.'
 // domain, ask the configured DNS server as a fallback.
 func (s *DNSServer) notUsHandler(proto dnsProtocol) dns.HandlerFunc {
@@ -311,13 +412,21 @@ func (s *DNSServer) notUsHandler(proto dnsProtocol) dns.HandlerFunc {
 		maxLen := getMaxReplyLen(r, proto)
 		q := r.Question[0]
 
+		// a 'no local replies' entry just means we need to ask upstream
+		if reply, _ := s.cache.Get(r, maxLen); reply != nil {
+			Debug.Printf("[dns msgid %d] Returning fallback reply from cache: %s/%d answers",
+				r.MsgHdr.Id, dns.RcodeToString[reply.MsgHdr.Rcode], len(reply.Answer))
+			w.WriteMsg(reply)
+			return
+		}
+
 		// create a request where we announce our max payload size
 		rcopy := r
 		rcopy.SetEdns0(uint16(maxLen), false)
 
 		Debug.Printf("[dns msgid %d] Fallback query: %+v [%s, max:%d bytes]", rcopy.MsgHdr.Id, q, proto, maxLen)
 		for _, server := range s.Upstream.Servers {
-			reply, _, err := dnsClient.Exchange(rcopy, fmt.Sprintf("%s:%s", server, s.Upstream.Port))
+			reply, _, err := dnsClient.Exchange(rcopy, upstreamAddr(server, s.Upstream.Port))
 			if err != nil {
 				Debug.Printf("[dns msgid %d] Network error trying %s (%s)",
 					r.MsgHdr.Id, server, err)
@@ -330,6 +439,10 @@ func (s *DNSServer) notUsHandler(proto dnsProtocol) dns.HandlerFunc {
 			}
 			Debug.Printf("[dns msgid %d] Given answer by %s for query %s",
 				r.MsgHdr.Id, server, q.Name)
+			// Only replies with answers tell us how long to keep them
+			if reply != nil && len(reply.Answer) > 0 && !reply.Truncated {
+				s.cache.Put(r, reply, nullTTL, 0)
+			}
 			w.WriteMsg(reply)
 			return
 		}
@@ -337,3 +450,33 @@ func (s *DNSServer) notUsHandler(proto dnsProtocol) dns.HandlerFunc {
 		w.WriteMsg(makeDNSFailResponse(r))
 	}
 }
+
+// Upstream servers may be given with or without a port; if without,
+// we use the port from the config.
+func upstreamAddr(server string, port string) string {
+	if _, _, err := net.SplitHostPort(server); err == nil {
+		return server
+	}
+	return net.JoinHostPort(server, port)
+}
+
+// UpstreamConfig makes a config for asking the given upstream
+// servers, each of the form <host>[:<port>], about names outside the
+// local domain.
+func UpstreamConfig(servers []string) (*dns.ClientConfig, error) {
+	config := &dns.ClientConfig{Port: "53", Ndots: 1, Timeout: DefaultTimeout, Attempts: 2}
+	for _, server := range servers {
+		host := server
+		if h, _, err := net.SplitHostPort(server); err == nil {
+			host = h
+		}
+		if net.ParseIP(host) == nil {
+			return nil, fmt.Errorf("Invalid upstream DNS server %q: not an IP address", server)
+		}
+		config.Servers = append(config.Servers, server)
+	}
+	if len(config.Servers) == 0 {
+		return nil, fmt.Errorf("No upstream DNS servers given")
+	}
+	return config, nil
+}
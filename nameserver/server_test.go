@@ -142,7 +142,7 @@ func TestTCPDNSServer(t *testing.T) {
 
 		t.Logf("Fallback UDP server got asked: returning %d answers", numAnswers)
 		q := req.Question[0]
-		m := makeAddressReply(req, &q, addrs)
+		m := makeAddressReply(req, &q, addrs, localTTL)
 		mLen := m.Len()
 		m.SetEdns0(uint16(maxLen), false)
 
@@ -155,7 +155,7 @@ func TestTCPDNSServer(t *testing.T) {
 	fallbackTCPHandler := func(w dns.ResponseWriter, req *dns.Msg) {
 		t.Logf("Fallback TCP server got asked: returning %d answers", numAnswers)
 		q := req.Question[0]
-		m := makeAddressReply(req, &q, addrs)
+		m := makeAddressReply(req, &q, addrs, localTTL)
 		w.WriteMsg(m)
 	}
 
@@ -299,3 +299,145 @@ func runLocalTCPServer(t *testing.T, laddr string, handler dns.HandlerFunc) (*dn
 	t.Logf("Fallback TCP server listening at %s", l.Addr().String())
 	return server, l.Addr().String(), nil
 }
+
+func TestReverseSubnets(t *testing.T) {
+	setupForTest(t)
+	InitDefaultLogging(true)
+	var zone = NewZoneDb(DefaultLocalDomain)
+	ip, subnet, _ := net.ParseCIDR("10.2.2.1/24")
+	zone.AddRecord("foobar", "test1.weave.local.", ip)
+
+	// the fallback server claims to know every address
+	fallbackHandler := func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		m.Answer = []dns.RR{&dns.PTR{Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: 0}, Ptr: "upstream."}}
+		w.WriteMsg(m)
+	}
+	s, fallbackAddr, err := runLocalUDPServer(t, "127.0.0.1:0", fallbackHandler)
+	wt.AssertNoErr(t, err)
+	defer s.Shutdown()
+	_, fallbackPort, err := net.SplitHostPort(fallbackAddr)
+	wt.AssertNoErr(t, err)
+
+	config := &dns.ClientConfig{Servers: []string{"127.0.0.1"}, Port: fallbackPort}
+	srv, err := NewDNSServer(DNSServerConfig{UpstreamCfg: config, Port: testPort, Subnets: []*net.IPNet{subnet}}, zone, nil)
+	wt.AssertNoErr(t, err)
+	defer srv.Stop()
+	go srv.Start()
+	time.Sleep(100 * time.Millisecond) // Allow sever goroutine to start
+
+	r := assertExchange(t, testRDNSsuccess, dns.TypePTR, 1, 1, 0)
+	wt.AssertEqualString(t, r.Answer[0].(*dns.PTR).Ptr, "test1.weave.local.", "name")
+
+	// unknown address in our subnet: not passed on
+	r = assertExchange(t, "2.2.2.10.in-addr.arpa.", dns.TypePTR, 0, 0, dns.RcodeNameError)
+	wt.AssertTrue(t, r.Authoritative, "authoritative response")
+
+	// unknown address elsewhere: passed on
+	r = assertExchange(t, testRDNSnonlocal, dns.TypePTR, 1, 1, 0)
+	wt.AssertEqualString(t, r.Answer[0].(*dns.PTR).Ptr, "upstream.", "name")
+}
+
+func TestSharedName(t *testing.T) {
+	InitDefaultLogging(true)
+	const sharedName = "shared.weave.local."
+	var zone = NewZoneDb(DefaultLocalDomain)
+	for i, id := range []string{"foo", "bar", "baz"} {
+		zone.AddRecord(id, sharedName, net.IPv4(10, 2, 2, byte(i+1)))
+	}
+	config := &dns.ClientConfig{Servers: []string{"127.0.0.1"}, Port: "53"}
+
+	for _, single := range []bool{false, true} {
+		setupForTest(t)
+		srv, err := NewDNSServer(DNSServerConfig{UpstreamCfg: config, Port: testPort, LocalTTL: 10, SingleAnswer: single}, zone, nil)
+		wt.AssertNoErr(t, err)
+		go srv.Start()
+		time.Sleep(100 * time.Millisecond) // Allow sever goroutine to start
+
+		expected := 3
+		if single {
+			expected = 1
+		}
+		// ask twice, so the second answer comes from the cache
+		for i := 0; i < 2; i++ {
+			r := assertExchange(t, sharedName, dns.TypeA, expected, expected, 0)
+			wt.AssertTrue(t, r.Answer[0].Header().Ttl <= 10, "TTL")
+		}
+		srv.Stop()
+	}
+}
+
+func TestUpstream(t *testing.T) {
+	setupForTest(t)
+	InitDefaultLogging(true)
+	const externalName = "weave.works."
+
+	queries := 0
+	fallbackHandler := func(w dns.ResponseWriter, req *dns.Msg) {
+		queries++
+		m := new(dns.Msg)
+		m.SetReply(req)
+		m.Answer = []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.ParseIP("1.2.3.4")}}
+		w.WriteMsg(m)
+	}
+	s, fallbackAddr, err := runLocalUDPServer(t, "127.0.0.1:0", fallbackHandler)
+	wt.AssertNoErr(t, err)
+	defer s.Shutdown()
+
+	// the port given with the server overrides the default of 53
+	config, err := UpstreamConfig([]string{fallbackAddr})
+	wt.AssertNoErr(t, err)
+	_, err = UpstreamConfig([]string{"dns.example.com"})
+	wt.AssertTrue(t, err != nil, "error for non-IP upstream")
+
+	srv, err := NewDNSServer(DNSServerConfig{UpstreamCfg: config, Port: testPort}, NewZoneDb(DefaultLocalDomain), nil)
+	wt.AssertNoErr(t, err)
+	defer srv.Stop()
+	go srv.Start()
+	time.Sleep(100 * time.Millisecond) // Allow sever goroutine to start
+
+	for i := 0; i < 3; i++ {
+		r := assertExchange(t, externalName, dns.TypeA, 1, 1, 0)
+		wt.AssertEqualString(t, r.Answer[0].(*dns.A).A.String(), "1.2.3.4", "IP address")
+	}
+	wt.AssertEqualInt(t, queries, 1, "queries sent upstream")
+}
+
+func TestSRV(t *testing.T) {
+	setupForTest(t)
+	InitDefaultLogging(true)
+	var zone = NewZoneDb(DefaultLocalDomain)
+	ip := net.ParseIP("10.2.2.1")
+	zone.AddRecord("foobar", "cache.weave.local.", ip)
+	zone.SetServices("foobar", ip, []Service{{"redis", "tcp", 6379}})
+
+	config := &dns.ClientConfig{Servers: []string{"127.0.0.1"}, Port: "53"}
+	srv, err := NewDNSServer(DNSServerConfig{UpstreamCfg: config, Port: testPort}, zone, nil)
+	wt.AssertNoErr(t, err)
+	defer srv.Stop()
+	go srv.Start()
+	time.Sleep(100 * time.Millisecond) // Allow sever goroutine to start
+
+	r := assertExchange(t, "_redis._tcp.cache.weave.local.", dns.TypeSRV, 1, 1, 0)
+	wt.AssertType(t, r.Answer[0], (*dns.SRV)(nil), "DNS record")
+	srvRR := r.Answer[0].(*dns.SRV)
+	wt.AssertEqualInt(t, int(srvRR.Port), 6379, "port")
+	wt.AssertEqualString(t, srvRR.Target, "cache.weave.local.", "target")
+	wt.AssertEqualInt(t, len(r.Extra), 1, "additional records")
+	wt.AssertEqualString(t, r.Extra[0].(*dns.A).A.String(), "10.2.2.1", "additional address")
+	assertExchange(t, "_memcache._tcp.cache.weave.local.", dns.TypeSRV, 0, 0, dns.RcodeNameError)
+}
+
+func TestLocalTTL(t *testing.T) {
+	config := &dns.ClientConfig{Servers: []string{"127.0.0.1"}, Port: "53"}
+	for _, c := range []struct {
+		ttl      int
+		set      bool
+		expected uint32
+	}{{0, false, DefaultLocalTTL}, {0, true, 0}, {10, false, 10}, {10, true, 10}} {
+		srv, err := NewDNSServer(DNSServerConfig{UpstreamCfg: config, LocalTTL: c.ttl, LocalTTLSet: c.set}, NewZoneDb(DefaultLocalDomain), nil)
+		wt.AssertNoErr(t, err)
+		wt.AssertEquals(t, srv.ttl, c.expected)
+	}
+}
@@ -0,0 +1,136 @@
+package nameserver
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// ServiceZone may be implemented by a Zone that can record the ports
+// containers offer services on, for answering SRV queries.
+type ServiceZone interface {
+	SetServices(ident string, ip net.IP, services []Service) error
+}
+
+// ServiceLookup may be implemented by a ZoneLookup that can answer
+// SRV queries, for names like "_redis._tcp.cache.weave.local."
+type ServiceLookup interface {
+	LookupService(name string) ([]ServiceRecord, error)
+}
+
+// A service offered by a container on a port
+type Service struct {
+	Name  string // e.g. "redis"
+	Proto string // "tcp" or "udp"
+	Port  int
+}
+
+// ParseService parses a service of the form
+// <service>[/<proto>]:<port>, where proto defaults to "tcp".
+func ParseService(spec string) (Service, error) {
+	var service Service
+	i := strings.LastIndex(spec, ":")
+	if i == -1 {
+		return service, fmt.Errorf("Invalid service %q: no port", spec)
+	}
+	port, err := strconv.Atoi(spec[i+1:])
+	if err != nil || port <= 0 || port > 65535 {
+		return service, fmt.Errorf("Invalid service %q: bad port", spec)
+	}
+	service.Port = port
+	service.Name, service.Proto = spec[:i], "tcp"
+	if j := strings.Index(service.Name, "/"); j != -1 {
+		service.Name, service.Proto = service.Name[:j], service.Name[j+1:]
+	}
+	if service.Proto != "tcp" && service.Proto != "udp" {
+		return service, fmt.Errorf("Invalid service %q: unknown protocol %q", spec, service.Proto)
+	}
+	if service.Name == "" || strings.ContainsAny(service.Name, ". ") {
+		return service, fmt.Errorf("Invalid service %q: bad name", spec)
+	}
+	return service, nil
+}
+
+func (s Service) String() string {
+	return fmt.Sprintf("%s/%s:%d", s.Name, s.Proto, s.Port)
+}
+
+// An SRV answer: the target name and address, and the port
+type ServiceRecord struct {
+	Record
+	Port int
+}
+
+// Split "_redis._tcp.cache.weave.local." into its parts
+func parseServiceName(name string) (service, proto, target string, ok bool) {
+	labels := dns.SplitDomainName(name)
+	if len(labels) < 3 || !strings.HasPrefix(labels[0], "_") || !strings.HasPrefix(labels[1], "_") {
+		return "", "", "", false
+	}
+	return labels[0][1:], labels[1][1:], dns.Fqdn(strings.Join(labels[2:], ".")), true
+}
+
+// SetServices replaces the services offered by the container ident at
+// ip.
+func (zone *ZoneDb) SetServices(ident string, ip net.IP, services []Service) error {
+	zone.mx.Lock()
+	found := false
+	var changed []dbRecord
+	for i := range zone.recs {
+		r := &zone.recs[i]
+		if r.Origin != zone.ourName || !r.isLive() || r.Ident != ident || !r.IP.Equal(ip) {
+			continue
+		}
+		found = true
+		if !sameServices(r.Services, services) {
+			r.Services = services
+			r.Version++
+			changed = append(changed, *r)
+		}
+	}
+	zone.mx.Unlock()
+	if !found {
+		return LookupError(ident)
+	}
+	zone.broadcast(changed)
+	return nil
+}
+
+func sameServices(a, b []Service) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (zone *ZoneDb) LookupService(name string) ([]ServiceRecord, error) {
+	serviceName, proto, target, ok := parseServiceName(name)
+	if !ok {
+		return nil, LookupError(name)
+	}
+	zone.mx.RLock()
+	defer zone.mx.RUnlock()
+	var res []ServiceRecord
+	for _, r := range zone.recs {
+		if r.Name != target || !r.isLive() || r.Unhealthy {
+			continue
+		}
+		for _, s := range r.Services {
+			if s.Name == serviceName && s.Proto == proto {
+				res = append(res, ServiceRecord{Record{r.Name, r.IP, 0, 0, 0}, s.Port})
+			}
+		}
+	}
+	if len(res) == 0 {
+		return nil, LookupError(name)
+	}
+	return res, nil
+}
@@ -0,0 +1,49 @@
+package nameserver
+
+import (
+	"net"
+	"testing"
+
+	wt "github.com/weaveworks/weave/testing"
+)
+
+func TestParseService(t *testing.T) {
+	for spec, expected := range map[string]Service{
+		"redis:6379":  {"redis", "tcp", 6379},
+		"dns/udp:53":  {"dns", "udp", 53},
+		"http/tcp:80": {"http", "tcp", 80},
+	} {
+		service, err := ParseService(spec)
+		wt.AssertNoErr(t, err)
+		wt.AssertEquals(t, service, expected)
+	}
+	for _, spec := range []string{"", "redis", ":6379", "redis:0", "redis/sctp:6379", "re.dis:6379"} {
+		_, err := ParseService(spec)
+		wt.AssertTrue(t, err != nil, "error for "+spec)
+	}
+}
+
+func TestLookupService(t *testing.T) {
+	zone := NewZoneDb(DefaultLocalDomain)
+	ip1, ip2 := net.ParseIP("10.2.2.1"), net.ParseIP("10.2.2.2")
+	wt.AssertNoErr(t, zone.AddRecord("deadbeef", "cache.weave.local.", ip1))
+	wt.AssertNoErr(t, zone.AddRecord("cowjuice", "cache.weave.local.", ip2))
+	wt.AssertNoErr(t, zone.SetServices("deadbeef", ip1, []Service{{"redis", "tcp", 6379}, {"stats", "udp", 8125}}))
+	wt.AssertNoErr(t, zone.SetServices("cowjuice", ip2, []Service{{"redis", "tcp", 6380}}))
+	wt.AssertErrorType(t, zone.SetServices("nobody", ip1, nil), (*LookupError)(nil), "services for unknown record")
+
+	found, err := zone.LookupService("_redis._tcp.cache.weave.local.")
+	wt.AssertNoErr(t, err)
+	wt.AssertEqualInt(t, len(found), 2, "redis services")
+
+	found, err = zone.LookupService("_stats._udp.cache.weave.local.")
+	wt.AssertNoErr(t, err)
+	wt.AssertEqualInt(t, len(found), 1, "stats services")
+	wt.AssertEqualInt(t, found[0].Port, 8125, "stats port")
+	wt.AssertTrue(t, found[0].IP().Equal(ip1), "stats address")
+
+	for _, name := range []string{"_stats._tcp.cache.weave.local.", "_redis._tcp.other.weave.local.", "cache.weave.local."} {
+		_, err = zone.LookupService(name)
+		wt.AssertErrorType(t, err, (*LookupError)(nil), "lookup "+name)
+	}
+}
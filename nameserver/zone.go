@@ -5,8 +5,10 @@ import (
 	"fmt"
 	"github.com/miekg/dns"
 	. "github.com/weaveworks/weave/common"
+	"github.com/weaveworks/weave/router"
 	"net"
 	"sync"
+	"time"
 )
 
 const (
@@ -20,22 +22,36 @@ type Zone interface {
 	AddRecord(ident string, name string, ip net.IP) error
 	DeleteRecord(ident string, ip net.IP) error
 	DeleteRecordsFor(ident string) error
+	LookupIdent(ident string) ([]ZoneRecord, error)
 	Domain() string
 	ZoneLookup
 }
 
+// A record is owned by the peer that registered it, its Origin; only
+// the origin ever changes it, bumping Version as it does so, which is
+// how other peers decide which of two copies is the more recent.
+// Deleted records are kept as tombstones for a while so that the
+// deletion can propagate.
 type dbRecord struct {
-	Ident string
-	Name  string
-	IP    net.IP
+	Ident     string
+	Name      string
+	IP        net.IP
+	Origin    router.PeerName
+	Version   int
+	Tombstone int64     // timestamp of deletion, or 0 if live
+	Check     string    // health check, if any
+	Unhealthy bool      // failing its health check
+	Services  []Service // for SRV queries
 }
 
 // Very simple data structure for now, with linear searching.
 // TODO: make more sophisticated to improve performance.
 type ZoneDb struct {
-	mx     sync.RWMutex
-	recs   []dbRecord
-	domain string
+	mx      sync.RWMutex
+	recs    []dbRecord
+	domain  string
+	ourName router.PeerName
+	gossip  router.Gossip
 }
 
 type LookupError string
@@ -53,7 +69,7 @@ func (dup DuplicateError) Error() string {
 
 func NewZoneDb(domain string) *ZoneDb {
 	return &ZoneDb{
-		domain: domain,
+		domain: dns.Fqdn(domain),
 	}
 }
 
@@ -61,6 +77,14 @@ func (zone *ZoneDb) Domain() string {
 	return zone.domain
 }
 
+func (r *dbRecord) isLive() bool {
+	return r.Tombstone == 0
+}
+
+func (r *dbRecord) sameAs(other *dbRecord) bool {
+	return r.Origin == other.Origin && r.Ident == other.Ident && r.Name == other.Name && r.IP.Equal(other.IP)
+}
+
 func (zone *ZoneDb) indexOf(match func(dbRecord) bool) int {
 	for i, r := range zone.recs {
 		if match(r) {
@@ -70,25 +94,60 @@ func (zone *ZoneDb) indexOf(match func(dbRecord) bool) int {
 	return -1
 }
 
+// Predicate matching live records registered on this peer
+func (zone *ZoneDb) ours(match func(dbRecord) bool) func(dbRecord) bool {
+	return func(r dbRecord) bool { return r.Origin == zone.ourName && r.isLive() && match(r) }
+}
+
 func (zone *ZoneDb) String() string {
 	zone.mx.RLock()
 	defer zone.mx.RUnlock()
 	var buf bytes.Buffer
 	for _, r := range zone.recs {
-		fmt.Fprintf(&buf, "%.12s %s %v\n", r.Ident, r.IP, r.Name)
+		if !r.isLive() {
+			continue
+		}
+		fmt.Fprintf(&buf, "%.12s %s %v", r.Ident, r.IP, r.Name)
+		if r.Origin != zone.ourName {
+			fmt.Fprintf(&buf, " (from %s)", r.Origin)
+		}
+		for _, s := range r.Services {
+			fmt.Fprintf(&buf, " %s", s)
+		}
+		if r.Check != "" {
+			health := "healthy"
+			if r.Unhealthy {
+				health = "unhealthy"
+			}
+			fmt.Fprintf(&buf, " [%s %s]", r.Check, health)
+		}
+		fmt.Fprintln(&buf)
 	}
 	return buf.String()
 }
 
+// LookupName returns the addresses of all the containers registered
+// under name, which may be more than one.
 func (zone *ZoneDb) LookupName(name string) ([]ZoneRecord, error) {
 	zone.mx.RLock()
 	defer zone.mx.RUnlock()
+	var res []ZoneRecord
+outer:
 	for _, r := range zone.recs {
-		if r.Name == name {
-			return []ZoneRecord{Record{r.Name, r.IP, 0, 0, 0}}, nil
+		if r.Name != name || !r.isLive() || r.Unhealthy {
+			continue
+		}
+		for _, found := range res {
+			if found.IP().Equal(r.IP) {
+				continue outer
+			}
 		}
+		res = append(res, Record{r.Name, r.IP, 0, 0, 0})
+	}
+	if len(res) == 0 {
+		return nil, LookupError(name)
 	}
-	return nil, LookupError(name)
+	return res, nil
 }
 
 func (zone *ZoneDb) LookupInaddr(inaddr string) ([]ZoneRecord, error) {
@@ -99,7 +158,7 @@ func (zone *ZoneDb) LookupInaddr(inaddr string) ([]ZoneRecord, error) {
 		zone.mx.RLock()
 		defer zone.mx.RUnlock()
 		for _, r := range zone.recs {
-			if r.IP.Equal(ip) {
+			if r.IP.Equal(ip) && r.isLive() {
 				return []ZoneRecord{Record{r.Name, r.IP, 0, 0, 0}}, nil
 			}
 		}
@@ -109,42 +168,129 @@ func (zone *ZoneDb) LookupInaddr(inaddr string) ([]ZoneRecord, error) {
 	return nil, LookupError(inaddr)
 }
 
+// Entry describes a live record in the zone
+type Entry struct {
+	Ident  string
+	Name   string
+	IP     net.IP
+	Origin router.PeerName
+	Local  bool // registered on this peer
+}
+
+// Entries describes all the live records in the zone, ours and those
+// we heard of from other peers.
+func (zone *ZoneDb) Entries() []Entry {
+	zone.mx.RLock()
+	defer zone.mx.RUnlock()
+	entries := []Entry{}
+	for _, r := range zone.recs {
+		if r.isLive() {
+			entries = append(entries, Entry{r.Ident, r.Name, r.IP, r.Origin, r.Origin == zone.ourName})
+		}
+	}
+	return entries
+}
+
+// LookupIdent returns the names and addresses ident has registered on
+// this peer.
+func (zone *ZoneDb) LookupIdent(ident string) ([]ZoneRecord, error) {
+	zone.mx.RLock()
+	defer zone.mx.RUnlock()
+	var res []ZoneRecord
+	for _, r := range zone.recs {
+		if r.Ident == ident && r.Origin == zone.ourName && r.isLive() {
+			res = append(res, Record{r.Name, r.IP, 0, 0, 0})
+		}
+	}
+	if len(res) == 0 {
+		return nil, LookupError(ident)
+	}
+	return res, nil
+}
+
 func (zone *ZoneDb) AddRecord(ident string, name string, ip net.IP) error {
 	zone.mx.Lock()
-	defer zone.mx.Unlock()
 	fqdn := dns.Fqdn(name)
-	pred := func(r dbRecord) bool { return r.Name == fqdn && r.IP.Equal(ip) && r.Ident == ident }
-	if index := zone.indexOf(pred); index != -1 {
-		return DuplicateError{}
+	rec := dbRecord{Ident: ident, Name: fqdn, IP: ip, Origin: zone.ourName}
+	var changed []dbRecord
+	if index := zone.indexOf(func(r dbRecord) bool { return r.sameAs(&rec) }); index != -1 {
+		r := &zone.recs[index]
+		if r.isLive() {
+			zone.mx.Unlock()
+			return DuplicateError{}
+		}
+		// bring it back from the dead
+		r.Version++
+		r.Tombstone = 0
+		r.Check, r.Unhealthy, r.Services = "", false, nil
+		changed = append(changed, *r)
+	} else {
+		zone.recs = append(zone.recs, rec)
+		changed = append(changed, rec)
 	}
-	zone.recs = append(zone.recs, dbRecord{ident, fqdn, ip})
+	zone.mx.Unlock()
+	zone.broadcast(changed)
 	return nil
 }
 
+// DeleteRecord deletes all the names ident has at ip
 func (zone *ZoneDb) DeleteRecord(ident string, ip net.IP) error {
 	zone.mx.Lock()
-	defer zone.mx.Unlock()
-	pred := func(r dbRecord) bool { return r.Ident == ident && r.IP.Equal(ip) }
-	if index := zone.indexOf(pred); index != -1 {
-		zone.recs = append(zone.recs[:index], zone.recs[index+1:]...)
-		return nil
+	pred := zone.ours(func(r dbRecord) bool { return r.Ident == ident && r.IP.Equal(ip) })
+	now := time.Now()
+	var changed []dbRecord
+	for i, r := range zone.recs {
+		if pred(r) {
+			changed = append(changed, zone.tombstone(i, now))
+		}
+	}
+	zone.mx.Unlock()
+	if len(changed) == 0 {
+		return LookupError(ident)
 	}
-	return LookupError(ident)
+	zone.broadcast(changed)
+	return nil
 }
 
 func (zone *ZoneDb) DeleteRecordsFor(ident string) error {
 	zone.mx.Lock()
-	defer zone.mx.Unlock()
-	w := 0 // write index
+	now := time.Now()
+	var changed []dbRecord
+	for i, r := range zone.recs {
+		if r.Ident == ident && r.Origin == zone.ourName && r.isLive() {
+			changed = append(changed, zone.tombstone(i, now))
+		}
+	}
+	zone.mx.Unlock()
+	zone.broadcast(changed)
+	return nil
+}
 
+// Mark a record deleted; must be called with the lock held
+func (zone *ZoneDb) tombstone(index int, now time.Time) dbRecord {
+	r := &zone.recs[index]
+	r.Version++
+	r.Tombstone = now.Unix()
+	return *r
+}
+
+// Only reports containers on this peer; records from other peers are
+// for containers we know nothing about.
+func (zone *ZoneDb) ContainerIdents() []string {
+	zone.mx.RLock()
+	defer zone.mx.RUnlock()
+	seen := make(map[string]struct{})
+	idents := []string{}
 	for _, r := range zone.recs {
-		if r.Ident != ident {
-			zone.recs[w] = r
-			w++
+		if r.Origin != zone.ourName || !r.isLive() {
+			continue
+		}
+		if _, found := seen[r.Ident]; !found {
+			seen[r.Ident] = struct{}{}
+			idents = append(idents, r.Ident)
 		}
 	}
-	zone.recs = zone.recs[:w]
-	return nil
+	return idents
 }
 
 func (zone *ZoneDb) ContainerDied(ident string) error {
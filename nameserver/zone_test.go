@@ -86,3 +86,43 @@ func TestDeleteFor(t *testing.T) {
 	_, err = zone.LookupName(name)
 	wt.AssertErrorType(t, err, (*LookupError)(nil), "after deleting records for ident")
 }
+
+func TestContainerIdents(t *testing.T) {
+	zone := NewZoneDb(DefaultLocalDomain)
+	wt.AssertEqualInt(t, len(zone.ContainerIdents()), 0, "idents in empty zone")
+
+	wt.AssertNoErr(t, zone.AddRecord("foo", "foo.weave.", net.ParseIP("10.2.2.1")))
+	wt.AssertNoErr(t, zone.AddRecord("foo", "foo.weave.", net.ParseIP("10.2.2.2")))
+	wt.AssertNoErr(t, zone.AddRecord("bar", "bar.weave.", net.ParseIP("10.2.2.3")))
+	wt.AssertEqualInt(t, len(zone.ContainerIdents()), 2, "idents")
+
+	recs, err := zone.LookupIdent("foo")
+	wt.AssertNoErr(t, err)
+	wt.AssertEqualInt(t, len(recs), 2, "records for ident")
+	wt.AssertEqualString(t, recs[0].Name(), "foo.weave.", "name for ident")
+
+	zone.DeleteRecordsFor("foo")
+	_, err = zone.LookupIdent("foo")
+	wt.AssertErrorType(t, err, (*LookupError)(nil), "records for deleted ident")
+	idents := zone.ContainerIdents()
+	wt.AssertEqualInt(t, len(idents), 1, "idents after delete")
+	wt.AssertEqualString(t, idents[0], "bar", "remaining ident")
+}
+
+func TestSharedNameLookup(t *testing.T) {
+	zone := NewZoneDb(DefaultLocalDomain)
+	ip1, ip2 := net.ParseIP("10.2.2.1"), net.ParseIP("10.2.2.2")
+	wt.AssertNoErr(t, zone.AddRecord("deadbeef", "shared.weave.", ip1))
+	wt.AssertNoErr(t, zone.AddRecord("cowjuice", "shared.weave.", ip2))
+	wt.AssertNoErr(t, zone.AddRecord("cowjuice", "other.weave.", ip2))
+
+	found, err := zone.LookupName("shared.weave.")
+	wt.AssertNoErr(t, err)
+	wt.AssertEqualInt(t, len(found), 2, "addresses for shared name")
+
+	wt.AssertNoErr(t, zone.DeleteRecordsFor("deadbeef"))
+	found, err = zone.LookupName("shared.weave.")
+	wt.AssertNoErr(t, err)
+	wt.AssertEqualInt(t, len(found), 1, "addresses for shared name")
+	wt.AssertTrue(t, found[0].IP().Equal(ip2), "remaining address")
+}
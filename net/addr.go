@@ -0,0 +1,154 @@
+package net
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/vishvananda/netlink"
+)
+
+// The label we give the addresses we add, so that we can tell them
+// from others, if it fits in the kernel's limit on labels; labels
+// must start with the interface's name
+func addressLabel(name string) string {
+	if label := name + ":weave"; len(label) < 16 {
+		return label
+	}
+	return ""
+}
+
+// LabelsAddresses says whether the addresses AddInterfaceAddress adds
+// to the interface called name are labelled, for OwnedAddresses
+func LabelsAddresses(name string) bool {
+	return addressLabel(name) != ""
+}
+
+// AddInterfaceAddress gives the interface called name addr, unless
+// it has it already, returning whether it added it. The address is
+// labelled as ours, for OwnedAddresses, if the name is short enough.
+func AddInterfaceAddress(name string, addr *net.IPNet) (bool, error) {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return false, fmt.Errorf("Unable to find interface %s: %s", name, err)
+	}
+	if has, err := hasAddress(link, addr); err != nil || has {
+		return false, err
+	}
+	if err := netlink.AddrAdd(link, &netlink.Addr{IPNet: addr, Label: addressLabel(name)}); err != nil {
+		return false, fmt.Errorf("Unable to add address %s to %s: %s", addr, name, err)
+	}
+	return true, nil
+}
+
+// DeleteInterfaceAddress removes addr from the interface called
+// name, if it has it, returning whether it removed it.
+func DeleteInterfaceAddress(name string, addr *net.IPNet) (bool, error) {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return false, fmt.Errorf("Unable to find interface %s: %s", name, err)
+	}
+	if has, err := hasAddress(link, addr); err != nil || !has {
+		return false, err
+	}
+	if err := netlink.AddrDel(link, &netlink.Addr{IPNet: addr}); err != nil {
+		return false, fmt.Errorf("Unable to remove address %s from %s: %s", addr, name, err)
+	}
+	return true, nil
+}
+
+func hasAddress(link netlink.Link, addr *net.IPNet) (bool, error) {
+	existing, err := netlink.AddrList(link, netlink.FAMILY_V4)
+	if err != nil {
+		return false, fmt.Errorf("Unable to list addresses of %s: %s", link.Attrs().Name, err)
+	}
+	for _, e := range existing {
+		if e.IPNet.String() == addr.String() {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// InterfaceAddresses lists the IPv4 addresses of the interface called
+// name
+func InterfaceAddresses(name string) ([]*net.IPNet, error) {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to find interface %s: %s", name, err)
+	}
+	existing, err := netlink.AddrList(link, netlink.FAMILY_V4)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to list addresses of %s: %s", name, err)
+	}
+	addrs := make([]*net.IPNet, len(existing))
+	for i, e := range existing {
+		addrs[i] = e.IPNet
+	}
+	return addrs, nil
+}
+
+// OwnedAddresses lists the IPv4 addresses of the interface called
+// name that AddInterfaceAddress added, as told by their labels, which
+// it can't if the name is too long for them to be labelled
+func OwnedAddresses(name string) ([]*net.IPNet, error) {
+	label := addressLabel(name)
+	if label == "" {
+		return nil, fmt.Errorf("Unable to tell which addresses of %s are ours, since its name is too long for them to be labelled", name)
+	}
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to find interface %s: %s", name, err)
+	}
+	existing, err := netlink.AddrList(link, netlink.FAMILY_V4)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to list addresses of %s: %s", name, err)
+	}
+	var addrs []*net.IPNet
+	for _, e := range existing {
+		if e.Label == label {
+			addrs = append(addrs, e.IPNet)
+		}
+	}
+	return addrs, nil
+}
+
+// Address is an address of the interface called Interface
+type Address struct {
+	*net.IPNet
+	Interface string
+}
+
+func (a Address) String() string {
+	return fmt.Sprintf("%s dev %s", a.IPNet, a.Interface)
+}
+
+// OverlappingAddresses lists the host's IPv4 addresses, other than
+// those of the interfaces named in except, that are in ipnet, or
+// whose networks contain it.
+func OverlappingAddresses(ipnet *net.IPNet, except ...string) ([]Address, error) {
+	links, err := netlink.LinkList()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to list interfaces: %s", err)
+	}
+	skip := make(map[string]bool)
+	for _, name := range except {
+		skip[name] = true
+	}
+	var overlapping []Address
+	for _, link := range links {
+		name := link.Attrs().Name
+		if skip[name] {
+			continue
+		}
+		addrs, err := netlink.AddrList(link, netlink.FAMILY_V4)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to list addresses of %s: %s", name, err)
+		}
+		for _, addr := range addrs {
+			if addr.IPNet != nil && (ipnet.Contains(addr.IP) || addr.Contains(ipnet.IP)) {
+				overlapping = append(overlapping, Address{addr.IPNet, name})
+			}
+		}
+	}
+	return overlapping, nil
+}
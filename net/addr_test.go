@@ -0,0 +1,17 @@
+package net
+
+import (
+	"testing"
+
+	wt "github.com/weaveworks/weave/testing"
+)
+
+func TestAddressLabel(t *testing.T) {
+	wt.AssertEqualString(t, addressLabel("weave"), "weave:weave", "label")
+	wt.AssertTrue(t, LabelsAddresses("weave"), "labels the addresses of weave")
+	wt.AssertEqualString(t, addressLabel("weave-bridge0"), "", "label of a long name")
+	wt.AssertTrue(t, !LabelsAddresses("weave-bridge0"), "labels the addresses of a long name")
+
+	_, err := OwnedAddresses("weave-bridge0")
+	wt.AssertTrue(t, err != nil, "error listing the addresses of a long name")
+}
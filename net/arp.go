@@ -0,0 +1,157 @@
+package net
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+)
+
+const (
+	ethPArp      = 0x0806
+	arpFrameSize = 42 // Ethernet header and ARP for IPv4 over Ethernet
+	arpRequest   = 1
+	arpReply     = 2
+)
+
+var broadcastMAC = net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+
+// ProbeAddress checks whether anything reachable through the
+// interface called ifaceName, which for the bridge is anything on the
+// weave network, has ip already, by broadcasting three ARP probes, as
+// RFC 5227 describes, over wait, and listening for answers until
+// wait is up. It returns the MAC address of whatever answered, or nil
+// if nothing did.
+func ProbeAddress(ifaceName string, ip net.IP, wait time.Duration) (net.HardwareAddr, error) {
+	if ip.To4() == nil {
+		return nil, fmt.Errorf("Unable to probe for %s: not an IPv4 address", ip)
+	}
+	ip = ip.To4()
+	iface, err := net.InterfaceByName(ifaceName)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to find interface %s: %s", ifaceName, err)
+	}
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW, int(htons(ethPArp)))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open ARP socket: %s", err)
+	}
+	defer syscall.Close(fd)
+	if err := syscall.Bind(fd, &syscall.SockaddrLinklayer{Protocol: htons(ethPArp), Ifindex: iface.Index}); err != nil {
+		return nil, fmt.Errorf("Unable to bind ARP socket to %s: %s", ifaceName, err)
+	}
+
+	probe := ARPProbe(iface.HardwareAddr, ip)
+	to := &syscall.SockaddrLinklayer{Protocol: htons(ethPArp), Ifindex: iface.Index, Halen: 6}
+	copy(to.Addr[:], broadcastMAC)
+	deadline := time.Now().Add(wait)
+	buf := make([]byte, 1500)
+	for i := 0; i < 3; i++ {
+		if err := syscall.Sendto(fd, probe, 0, to); err != nil {
+			return nil, fmt.Errorf("Unable to send ARP probe on %s: %s", ifaceName, err)
+		}
+		next := time.Now().Add(wait / 3)
+		if i == 2 {
+			next = deadline
+		}
+		for {
+			remaining := next.Sub(time.Now())
+			if remaining <= 0 {
+				break
+			}
+			tv := syscall.NsecToTimeval(remaining.Nanoseconds())
+			if err := syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv); err != nil {
+				return nil, err
+			}
+			n, _, err := syscall.Recvfrom(fd, buf, 0)
+			if err == syscall.EAGAIN || err == syscall.EINTR {
+				continue
+			} else if err != nil {
+				return nil, fmt.Errorf("Unable to receive ARP on %s: %s", ifaceName, err)
+			}
+			if mac := arpConflict(buf[:n], iface.HardwareAddr, ip); mac != nil {
+				return mac, nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+// AddressInUseError is an address that ProbeAddresses found
+// something had already
+type AddressInUseError struct {
+	IP  net.IP
+	MAC net.HardwareAddr // of whatever has it
+}
+
+func (err *AddressInUseError) Error() string {
+	return fmt.Sprintf("Address %s is in use already, by %s", err.IP, err.MAC)
+}
+
+// ProbeAddresses probes for each of addrs in turn, as ProbeAddress,
+// returning an AddressInUseError for the first that anything has
+// already. It doesn't probe if wait is 0.
+func ProbeAddresses(ifaceName string, addrs []*net.IPNet, wait time.Duration) error {
+	if wait == 0 {
+		return nil
+	}
+	for _, addr := range addrs {
+		mac, err := ProbeAddress(ifaceName, addr.IP, wait)
+		if err != nil {
+			return err
+		}
+		if mac != nil {
+			return &AddressInUseError{IP: addr.IP, MAC: mac}
+		}
+	}
+	return nil
+}
+
+// ARPProbe makes an Ethernet frame, from mac, of an ARP request for
+// the IPv4 address ip, with a sender address of 0.0.0.0, so that
+// nothing updates its ARP cache on seeing it (RFC 5227)
+func ARPProbe(mac net.HardwareAddr, ip net.IP) []byte {
+	frame := make([]byte, arpFrameSize)
+	copy(frame[0:6], broadcastMAC)
+	copy(frame[6:12], mac)
+	binary.BigEndian.PutUint16(frame[12:14], ethPArp)
+	arp := frame[14:]
+	binary.BigEndian.PutUint16(arp[0:2], 1)      // Ethernet
+	binary.BigEndian.PutUint16(arp[2:4], 0x0800) // IPv4
+	arp[4], arp[5] = 6, 4
+	binary.BigEndian.PutUint16(arp[6:8], arpRequest)
+	copy(arp[8:14], mac)
+	// sender IP, and target MAC, are left zero
+	copy(arp[24:28], ip)
+	return frame
+}
+
+// If frame is an ARP packet from something other than us that says it
+// has ip, or is probing for it too, return the sender's MAC
+func arpConflict(frame []byte, ours net.HardwareAddr, ip net.IP) net.HardwareAddr {
+	if len(frame) < arpFrameSize || binary.BigEndian.Uint16(frame[12:14]) != ethPArp {
+		return nil
+	}
+	arp := frame[14:]
+	sender := net.HardwareAddr(append([]byte{}, arp[8:14]...))
+	if bytes.Equal(sender, ours) {
+		return nil
+	}
+	senderIP, targetIP := net.IP(arp[14:18]), net.IP(arp[24:28])
+	switch binary.BigEndian.Uint16(arp[6:8]) {
+	case arpReply:
+		if senderIP.Equal(ip) {
+			return sender
+		}
+	case arpRequest:
+		if senderIP.Equal(ip) || senderIP.Equal(net.IPv4zero) && targetIP.Equal(ip) {
+			return sender
+		}
+	}
+	return nil
+}
+
+func htons(n uint16) uint16 {
+	return n<<8 | n>>8
+}
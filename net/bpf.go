@@ -0,0 +1,172 @@
+package net
+
+import (
+	"bytes"
+	"fmt"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// From linux/bpf.h
+const (
+	bpfMapCreate     = 0
+	bpfMapLookupElem = 1
+	bpfMapUpdateElem = 2
+	bpfMapDeleteElem = 3
+	bpfProgLoad      = 5
+	bpfProgTestRun   = 10
+	bpfLinkCreate    = 28
+	bpfAttachXDP     = 37
+	xdpFlagsSKBMode  = 1 << 1
+	bpfLogSize       = 1 << 16
+
+	BPFMapTypeHash  = 1
+	BPFMapTypeArray = 2
+	BPFProgTypeXDP  = 6
+)
+
+func bpf(cmd int, attr unsafe.Pointer, size uintptr) (int, error) {
+	fd, _, errno := syscall.Syscall(unix.SYS_BPF, uintptr(cmd), uintptr(attr), size)
+	if errno != 0 {
+		return -1, errno
+	}
+	return int(fd), nil
+}
+
+// BPFMap is a map that BPF programs and we can both read and write
+type BPFMap struct {
+	fd        int
+	keySize   int
+	valueSize int
+}
+
+// NewBPFMap creates a map of type typ, e.g. BPFMapTypeHash
+func NewBPFMap(typ, keySize, valueSize, maxEntries int) (*BPFMap, error) {
+	attr := struct {
+		mapType, keySize, valueSize, maxEntries uint32
+	}{uint32(typ), uint32(keySize), uint32(valueSize), uint32(maxEntries)}
+	fd, err := bpf(bpfMapCreate, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to create BPF map: %s", err)
+	}
+	return &BPFMap{fd: fd, keySize: keySize, valueSize: valueSize}, nil
+}
+
+// FD is the map's file descriptor, for programs to refer to it by
+func (m *BPFMap) FD() int {
+	return m.fd
+}
+
+type bpfElemAttr struct {
+	mapFD uint32
+	_     uint32
+	key   uint64
+	value uint64
+	flags uint64
+}
+
+func (m *BPFMap) elem(cmd int, key, value []byte) error {
+	if len(key) != m.keySize || value != nil && len(value) != m.valueSize {
+		return fmt.Errorf("BPF map key or value of the wrong size")
+	}
+	attr := bpfElemAttr{mapFD: uint32(m.fd), key: uint64(uintptr(unsafe.Pointer(&key[0])))}
+	if value != nil {
+		attr.value = uint64(uintptr(unsafe.Pointer(&value[0])))
+	}
+	_, err := bpf(cmd, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	return err
+}
+
+// Lookup reads the value of key into value
+func (m *BPFMap) Lookup(key, value []byte) error {
+	return m.elem(bpfMapLookupElem, key, value)
+}
+
+// Update sets the value of key
+func (m *BPFMap) Update(key, value []byte) error {
+	return m.elem(bpfMapUpdateElem, key, value)
+}
+
+// Delete removes key
+func (m *BPFMap) Delete(key []byte) error {
+	return m.elem(bpfMapDeleteElem, key, nil)
+}
+
+func (m *BPFMap) Close() error {
+	return syscall.Close(m.fd)
+}
+
+// LoadBPFProgram loads the program of type typ, e.g. BPFProgTypeXDP,
+// with instructions insns, as encoded for the kernel, returning its
+// file descriptor, or the verifier's complaints
+func LoadBPFProgram(typ int, insns []byte, license string) (int, error) {
+	lic := append([]byte(license), 0)
+	log := make([]byte, bpfLogSize)
+	attr := struct {
+		progType, insnCnt         uint32
+		insns, license            uint64
+		logLevel, logSize         uint32
+		logBuf                    uint64
+		kernVersion, progFlags    uint32
+		progName                  [16]byte
+		progIfindex, expectedType uint32
+	}{
+		progType: uint32(typ),
+		insnCnt:  uint32(len(insns) / 8),
+		insns:    uint64(uintptr(unsafe.Pointer(&insns[0]))),
+		license:  uint64(uintptr(unsafe.Pointer(&lic[0]))),
+		logLevel: 1,
+		logSize:  bpfLogSize,
+		logBuf:   uint64(uintptr(unsafe.Pointer(&log[0])))}
+	if typ == BPFProgTypeXDP {
+		attr.expectedType = bpfAttachXDP
+	}
+	copy(attr.progName[:], "weave")
+	fd, err := bpf(bpfProgLoad, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	if err != nil {
+		if n := bytes.IndexByte(log, 0); n > 0 {
+			return -1, fmt.Errorf("Unable to load BPF program: %s\n%s", err, log[:n])
+		}
+		return -1, fmt.Errorf("Unable to load BPF program: %s", err)
+	}
+	return fd, nil
+}
+
+// RunBPFProgram runs the program once on data, as if it had arrived
+// on an interface, returning what it returned, and the data as it
+// left it
+func RunBPFProgram(progFD int, data []byte) (uint32, []byte, error) {
+	out := make([]byte, len(data)+256)
+	attr := struct {
+		progFD, retval, dataSizeIn, dataSizeOut uint32
+		dataIn, dataOut                         uint64
+		repeat, duration                        uint32
+	}{
+		progFD:      uint32(progFD),
+		dataSizeIn:  uint32(len(data)),
+		dataSizeOut: uint32(len(out)),
+		dataIn:      uint64(uintptr(unsafe.Pointer(&data[0]))),
+		dataOut:     uint64(uintptr(unsafe.Pointer(&out[0]))),
+		repeat:      1}
+	if _, err := bpf(bpfProgTestRun, unsafe.Pointer(&attr), unsafe.Sizeof(attr)); err != nil {
+		return 0, nil, err
+	}
+	return attr.retval, out[:attr.dataSizeOut], nil
+}
+
+// AttachXDP attaches the XDP program to the interface with index
+// ifindex, in generic mode, so that it works with any driver, and
+// sees frames before packet sockets do. It is detached when the
+// returned descriptor is closed, or we exit.
+func AttachXDP(progFD, ifindex int) (int, error) {
+	attr := struct {
+		progFD, targetIfindex, attachType, flags uint32
+	}{uint32(progFD), uint32(ifindex), bpfAttachXDP, xdpFlagsSKBMode}
+	fd, err := bpf(bpfLinkCreate, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	if err != nil {
+		return -1, fmt.Errorf("Unable to attach XDP program to interface %d: %s", ifindex, err)
+	}
+	return fd, nil
+}
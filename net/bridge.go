@@ -0,0 +1,131 @@
+package net
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+)
+
+// EnsureBridge creates a bridge called name, unless there is one,
+// with a random MAC address and the given MTU, turns off its transmit
+// checksum offload, brings it up, and checks that it is a bridge with
+// that MTU, as 'weave launch' does.
+func EnsureBridge(name string, mtu int) (*net.Interface, error) {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		if link, err = createBridge(name, mtu); err != nil {
+			return nil, err
+		}
+	} else if link.Type() != "bridge" {
+		return nil, fmt.Errorf("Interface %s is a %s, not a bridge", name, link.Type())
+	}
+	if err := DisableTxOffload(name); err != nil {
+		return nil, err
+	}
+	if err := netlink.LinkSetUp(link); err != nil {
+		return nil, fmt.Errorf("Unable to bring up bridge %s: %s", name, err)
+	}
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to find bridge %s: %s", name, err)
+	}
+	if iface.Flags&net.FlagUp == 0 {
+		return nil, fmt.Errorf("Bridge %s is not up", name)
+	}
+	if iface.MTU != mtu {
+		return nil, fmt.Errorf("Bridge %s has MTU %d, not %d", name, iface.MTU, mtu)
+	}
+	return iface, nil
+}
+
+func createBridge(name string, mtu int) (netlink.Link, error) {
+	bridge := &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: name}}
+	if err := netlink.LinkAdd(bridge); err != nil {
+		return nil, fmt.Errorf("Unable to create bridge %s: %s", name, err)
+	}
+	// Current Linux kernels give bridges random MACs, but there are
+	// rumours it was not always so.
+	mac, err := RandomMAC()
+	if err == nil {
+		err = netlink.LinkSetHardwareAddr(bridge, mac)
+	}
+	if err != nil {
+		netlink.LinkDel(bridge)
+		return nil, fmt.Errorf("Unable to set the MAC address of bridge %s: %s", name, err)
+	}
+	if err := setBridgeMTU(bridge, mtu); err != nil {
+		netlink.LinkDel(bridge)
+		return nil, fmt.Errorf("Unable to set the MTU of bridge %s: %s", name, err)
+	}
+	return bridge, nil
+}
+
+func setBridgeMTU(bridge *netlink.Bridge, mtu int) error {
+	if netlink.LinkSetMTU(bridge, mtu) == nil {
+		return nil
+	}
+	// Older kernels refuse to set a high MTU on a bridge directly,
+	// since bridges take the lowest MTU of their ports, so we attach
+	// an interface with the MTU we want, and remove it again.
+	dummy := &netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: "v" + bridge.Name + "du", MTU: mtu}}
+	if err := netlink.LinkAdd(dummy); err != nil {
+		return err
+	}
+	defer netlink.LinkDel(dummy)
+	return netlink.LinkSetMaster(dummy, bridge)
+}
+
+// RandomMAC makes a MAC address with the multicast bit clear and the
+// locally administered bit set, and all the other bits random.
+func RandomMAC() (net.HardwareAddr, error) {
+	mac := make(net.HardwareAddr, 6)
+	if _, err := rand.Read(mac); err != nil {
+		return nil, err
+	}
+	mac[0] = mac[0]&^0x01 | 0x02
+	return mac, nil
+}
+
+// ParseMACPrefix parses the first bytes of MAC addresses to make from
+// IP addresses with MACFromIP, in hex, separated by colons: an OUI,
+// of three bytes, or two, to leave room for the whole address. It
+// must be a unicast one.
+func ParseMACPrefix(s string) (net.HardwareAddr, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 2 && len(parts) != 3 {
+		return nil, fmt.Errorf("Invalid MAC prefix %q: expected two or three bytes, e.g. 02:77:65", s)
+	}
+	prefix := make(net.HardwareAddr, len(parts))
+	for i, part := range parts {
+		b, err := hex.DecodeString(part)
+		if err != nil || len(b) != 1 {
+			return nil, fmt.Errorf("Invalid MAC prefix %q: %q is not a byte in hex", s, part)
+		}
+		prefix[i] = b[0]
+	}
+	if prefix[0]&0x01 != 0 {
+		return nil, fmt.Errorf("Invalid MAC prefix %q: it has the multicast bit set", s)
+	}
+	return prefix, nil
+}
+
+// MACFromIP makes a MAC address from prefix, followed by as many of
+// the low bytes of the IPv4 address ip as fit, so that a container's
+// MAC says which address it was given, and the same address always
+// gets the same MAC. With a three-byte prefix, addresses that differ
+// only above their low 24 bits get the same MAC. It returns nil if ip
+// is not an IPv4 address, for the caller to fall back to a random MAC.
+func MACFromIP(prefix net.HardwareAddr, ip net.IP) net.HardwareAddr {
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return nil
+	}
+	mac := make(net.HardwareAddr, 6)
+	copy(mac, prefix)
+	copy(mac[len(prefix):], ip4[len(ip4)-(6-len(prefix)):])
+	return mac
+}
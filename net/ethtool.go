@@ -0,0 +1,92 @@
+package net
+
+import (
+	"fmt"
+	"syscall"
+	"unsafe"
+)
+
+// Offload is one of the offload features ethtool -K toggles
+type Offload struct {
+	Name     string
+	get, set uint32
+}
+
+// The offloads we know how to toggle, by ethtool's names for them
+var (
+	OffloadRxChecksum = Offload{"rx", 0x14, 0x15}
+	OffloadTxChecksum = Offload{"tx", 0x16, 0x17}
+	OffloadSG         = Offload{"sg", 0x18, 0x19}
+	OffloadTSO        = Offload{"tso", 0x1e, 0x1f}
+	OffloadUFO        = Offload{"ufo", 0x21, 0x22}
+	OffloadGSO        = Offload{"gso", 0x23, 0x24}
+	OffloadGRO        = Offload{"gro", 0x2b, 0x2c}
+)
+
+const siocEthtool = 0x8946
+
+// struct ethtool_value
+type ethtoolValue struct {
+	cmd  uint32
+	data uint32
+}
+
+// struct ifreq, with ifr_data
+type ethtoolRequest struct {
+	name [syscall.IFNAMSIZ]byte
+	data uintptr
+	_    [24 - unsafe.Sizeof(uintptr(0))]byte
+}
+
+func ethtool(ifaceName string, cmd, data uint32) (uint32, error) {
+	if len(ifaceName) >= syscall.IFNAMSIZ {
+		return 0, fmt.Errorf("Interface name %s is too long", ifaceName)
+	}
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer syscall.Close(fd)
+	value := ethtoolValue{cmd: cmd, data: data}
+	var req ethtoolRequest
+	copy(req.name[:], ifaceName)
+	req.data = uintptr(unsafe.Pointer(&value))
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), siocEthtool, uintptr(unsafe.Pointer(&req))); errno != 0 {
+		return 0, errno
+	}
+	return value.data, nil
+}
+
+// OffloadEnabled says whether feature is on for the named interface
+func OffloadEnabled(ifaceName string, feature Offload) (bool, error) {
+	data, err := ethtool(ifaceName, feature.get, 0)
+	if err != nil {
+		return false, fmt.Errorf("Unable to get %s offload of %s: %s", feature.Name, ifaceName, err)
+	}
+	return data != 0, nil
+}
+
+// SetOffload turns feature on or off for the named interface, as
+// ethtool -K does
+func SetOffload(ifaceName string, feature Offload, on bool) error {
+	var data uint32
+	if on {
+		data = 1
+	}
+	if _, err := ethtool(ifaceName, feature.set, data); err != nil {
+		return fmt.Errorf("Unable to set %s offload of %s: %s", feature.Name, ifaceName, err)
+	}
+	return nil
+}
+
+// DisableTxOffload turns off transmit checksum offload for the named
+// interface, as 'ethtool -K <iface> tx off' does. Frames sent with
+// it on can reach pcap, and so the router, without valid checksums.
+// Turning it off also turns off the offloads that depend on it, such
+// as TSO.
+func DisableTxOffload(ifaceName string) error {
+	if on, err := OffloadEnabled(ifaceName, OffloadTxChecksum); err != nil || !on {
+		return err
+	}
+	return SetOffload(ifaceName, OffloadTxChecksum, false)
+}
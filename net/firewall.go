@@ -0,0 +1,96 @@
+package net
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// Firewall is how we add and remove the rules that expose the host
+// and publish ports: iptables, or native nftables. Rules, tables and
+// chains are given as to iptables; the nftables backend translates
+// those we use.
+type Firewall interface {
+	String() string
+	// NewChain creates chain in table, unless it exists already
+	NewChain(table, chain string) error
+	FlushChain(table, chain string) error
+	RuleExists(table, chain string, rule ...string) bool
+	// AddRule appends rule to chain, whether it is there already or not
+	AddRule(table, chain string, rule ...string) error
+	DeleteRule(table, chain string, rule ...string) error
+	// Comments lists the comments of the rules in chain
+	Comments(table, chain string) ([]string, error)
+	// DeleteCommented deletes the rules in chain with comment
+	DeleteCommented(table, chain, comment string) error
+}
+
+var (
+	firewallLock sync.Mutex
+	firewall     Firewall
+)
+
+// SetFirewall chooses the firewall backend: "iptables", "nftables",
+// or "auto" to detect which the host uses, as we do if not told,
+// looking in the host's network namespace at nsPath, ours if blank.
+func SetFirewall(name, nsPath string) error {
+	firewallLock.Lock()
+	defer firewallLock.Unlock()
+	switch name {
+	case "auto":
+		firewall = detectFirewall(nsPath)
+	case "iptables":
+		firewall = iptables{}
+	case "nftables":
+		firewall = nftables{}
+	default:
+		return fmt.Errorf("Unknown firewall %q; expected \"auto\", \"iptables\" or \"nftables\"", name)
+	}
+	return nil
+}
+
+// CurrentFirewall is the firewall backend in use
+func CurrentFirewall() Firewall {
+	firewallLock.Lock()
+	defer firewallLock.Unlock()
+	if firewall == nil {
+		firewall = detectFirewall("")
+	}
+	return firewall
+}
+
+// We use nftables, if nft is there, when iptables is missing, or is
+// the shim that translates to nftables, or the network namespace at
+// nsPath has nftables tables other than ours, as it does when the
+// host's own iptables is that shim, or its firewall is native
+// nftables; otherwise iptables
+func detectFirewall(nsPath string) Firewall {
+	if _, err := exec.LookPath("nft"); err != nil {
+		return iptables{}
+	}
+	if _, err := exec.LookPath("iptables"); err != nil {
+		return nftables{}
+	}
+	if out, err := exec.Command("iptables", "-V").Output(); err == nil && strings.Contains(string(out), "nf_tables") {
+		return nftables{}
+	}
+	var fw Firewall = iptables{}
+	WithNetNSPath(nsPath, func() error {
+		if out, err := runNFT("list", "tables"); err == nil && hasOtherNFTables(out) {
+			fw = nftables{}
+		}
+		return nil
+	})
+	return fw
+}
+
+// Whether the tables nft lists include any that aren't ours
+func hasOtherNFTables(listed string) bool {
+	for _, line := range strings.Split(listed, "\n") {
+		if fields := strings.Fields(line); len(fields) == 3 && fields[0] == "table" && !strings.HasPrefix(fields[2], nftTable("")) {
+			return true
+		}
+	}
+	return false
+}
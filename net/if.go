@@ -6,15 +6,38 @@ import (
 	"time"
 )
 
+// EnsureInterface returns the interface called ifaceName, once it
+// exists and is up, waiting up to wait seconds for it to appear or
+// come up.
 func EnsureInterface(ifaceName string, wait int) (iface *net.Interface, err error) {
 	if iface, err = findInterface(ifaceName); err == nil || wait == 0 {
 		return
 	}
-	for ; err != nil && wait > 0; wait-- {
-		time.Sleep(1 * time.Second)
-		iface, err = findInterface(ifaceName)
+	done := make(chan struct{})
+	defer close(done)
+	// subscribe before looking again, so that we can't miss it
+	events, err := MonitorInterface(ifaceName, done)
+	if err != nil {
+		return nil, err
+	}
+	if iface, err = findInterface(ifaceName); err == nil {
+		return
+	}
+	timeout := time.After(time.Duration(wait) * time.Second)
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				// netlink failed, so we can only look
+				return findInterface(ifaceName)
+			}
+			if event.Kind == InterfaceUp {
+				return event.Iface, nil
+			}
+		case <-timeout:
+			return findInterface(ifaceName)
+		}
 	}
-	return
 }
 
 func findInterface(ifaceName string) (iface *net.Interface, err error) {
@@ -0,0 +1,187 @@
+package net
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// We run the iptables command, as the weave script does, rather than
+// talking to the kernel ourselves, since its interface for that is
+// iptables' own business.
+type iptables struct{}
+
+func (iptables) String() string {
+	return "iptables"
+}
+
+var (
+	checkWaitOnce sync.Once
+	waitArgs      []string
+)
+
+// Recent versions of iptables can be told to wait for the lock other
+// invocations hold, rather than failing
+func iptablesCommand(args ...string) *exec.Cmd {
+	checkWaitOnce.Do(func() {
+		if exec.Command("iptables", "-w", "-S").Run() == nil {
+			waitArgs = []string{"-w"}
+		}
+	})
+	return exec.Command("iptables", append(waitArgs, args...)...)
+}
+
+func runIPTables(args ...string) error {
+	out, err := iptablesCommand(args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("iptables %s: %s: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func (iptables) NewChain(table, chain string) error {
+	if runIPTables("-t", table, "-S", chain) == nil {
+		return nil
+	}
+	return runIPTables("-t", table, "-N", chain)
+}
+
+func (iptables) FlushChain(table, chain string) error {
+	return runIPTables("-t", table, "-F", chain)
+}
+
+func (iptables) RuleExists(table, chain string, rule ...string) bool {
+	return runIPTables(append([]string{"-t", table, "-C", chain}, rule...)...) == nil
+}
+
+func (iptables) AddRule(table, chain string, rule ...string) error {
+	return runIPTables(append([]string{"-t", table, "-A", chain}, rule...)...)
+}
+
+func (iptables) DeleteRule(table, chain string, rule ...string) error {
+	return runIPTables(append([]string{"-t", table, "-D", chain}, rule...)...)
+}
+
+func (iptables) Comments(table, chain string) ([]string, error) {
+	rules, err := listIPTablesRules(table, chain)
+	if err != nil {
+		return nil, err
+	}
+	var comments []string
+	for _, rule := range rules {
+		if comment := ruleComment(rule); comment != "" {
+			comments = append(comments, comment)
+		}
+	}
+	return comments, nil
+}
+
+func (iptables) DeleteCommented(table, chain, comment string) error {
+	rules, err := listIPTablesRules(table, chain)
+	if err != nil {
+		return err
+	}
+	for _, rule := range rules {
+		if ruleComment(rule) == comment {
+			if err := runIPTables(append([]string{"-t", table, "-D", chain}, rule...)...); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// The rules in chain, as the arguments that follow -A <chain>
+func listIPTablesRules(table, chain string) ([][]string, error) {
+	out, err := iptablesCommand("-t", table, "-S", chain).Output()
+	if err != nil {
+		return nil, fmt.Errorf("iptables -t %s -S %s: %s", table, chain, err)
+	}
+	var rules [][]string
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := splitQuoted(line)
+		if len(fields) > 2 && fields[0] == "-A" && fields[1] == chain {
+			rules = append(rules, fields[2:])
+		}
+	}
+	return rules, nil
+}
+
+// Split a line of iptables -S output into arguments, as the shell
+// would, taking double-quoted strings, in which iptables puts
+// comments, as one
+func splitQuoted(line string) []string {
+	var fields []string
+	var field []byte
+	inField, quoted, escaped := false, false, false
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case escaped:
+			field = append(field, c)
+			escaped = false
+		case c == '\\' && quoted:
+			escaped = true
+		case c == '"':
+			quoted = !quoted
+			inField = true
+		case (c == ' ' || c == '\t') && !quoted:
+			if inField {
+				fields = append(fields, string(field))
+				field, inField = field[:0], false
+			}
+		default:
+			field = append(field, c)
+			inField = true
+		}
+	}
+	if inField {
+		fields = append(fields, string(field))
+	}
+	return fields
+}
+
+// The comment of a rule, or "" if it has none
+func ruleComment(rule []string) string {
+	for i := 0; i+1 < len(rule); i++ {
+		if rule[i] == "--comment" {
+			return rule[i+1]
+		}
+	}
+	return ""
+}
+
+// AddIPTablesRule appends rule to chain in table, unless it is there
+// already, with the firewall in use.
+func AddIPTablesRule(table, chain string, rule ...string) error {
+	fw := CurrentFirewall()
+	if fw.RuleExists(table, chain, rule...) {
+		return nil
+	}
+	return fw.AddRule(table, chain, rule...)
+}
+
+// DeleteIPTablesRule deletes rule from chain in table, if it is there.
+func DeleteIPTablesRule(table, chain string, rule ...string) error {
+	fw := CurrentFirewall()
+	if !fw.RuleExists(table, chain, rule...) {
+		return nil
+	}
+	return fw.DeleteRule(table, chain, rule...)
+}
+
+// EnsureIPTablesChain creates chain in table, unless it exists
+// already, and makes sure that parent jumps to it, for packets
+// matching match, if given.
+func EnsureIPTablesChain(table, chain, parent string, match ...string) error {
+	if err := CurrentFirewall().NewChain(table, chain); err != nil {
+		return err
+	}
+	return AddIPTablesRule(table, parent, append(match, "-j", chain)...)
+}
+
+// FlushIPTablesChain deletes all the rules in chain in table.
+func FlushIPTablesChain(table, chain string) error {
+	return CurrentFirewall().FlushChain(table, chain)
+}
@@ -0,0 +1,211 @@
+package net
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// IPTablesRule is a rule, as given to iptables -A, in chain of table
+type IPTablesRule struct {
+	Table string
+	Chain string
+	Spec  []string
+}
+
+func (r IPTablesRule) String() string {
+	return fmt.Sprintf("-t %s -A %s %s", r.Table, r.Chain, strings.Join(r.Spec, " "))
+}
+
+// Our rules carry a comment saying who they are for, and a hash of
+// the rule, so that we can tell ours, and which of ours are stale,
+// however iptables rewrites the rest of the rule when listing it
+const ruleTagPrefix = "weave:"
+
+func (r IPTablesRule) tag(owner string) string {
+	h := fnv.New32a()
+	fmt.Fprint(h, r.String())
+	return fmt.Sprintf("%s%s#%08x", ruleTagPrefix, owner, h.Sum32())
+}
+
+func (r IPTablesRule) tagged(owner string) []string {
+	return append([]string{"-m", "comment", "--comment", r.tag(owner)}, r.Spec...)
+}
+
+type ipTablesChain struct {
+	table, chain, parent string
+	match                []string
+}
+
+// What we say owns the rules jumping to our chains
+const chainOwner = "chain"
+
+func (c ipTablesChain) jump() IPTablesRule {
+	return IPTablesRule{c.table, c.parent, append(append([]string{}, c.match...), "-j", c.chain)}
+}
+
+// IPTablesRules keeps a set of rules, by owner, e.g. "expose:<cidr>",
+// in the network namespace at nsPath, ours if blank, putting back any
+// that other tooling deletes, and deleting rules of ours, in the
+// chains it manages, that it no longer wants, e.g. those left behind
+// by a previous run. Rules we didn't add are left alone. It works with
+// whichever Firewall is in use.
+type IPTablesRules struct {
+	sync.Mutex
+	nsPath string
+	chains []ipTablesChain
+	rules  map[string][]IPTablesRule // by owner
+	scan   map[[2]string]bool        // table and chain of those we manage
+}
+
+func NewIPTablesRules(nsPath string) *IPTablesRules {
+	return &IPTablesRules{nsPath: nsPath, rules: make(map[string][]IPTablesRule), scan: make(map[[2]string]bool)}
+}
+
+// Chain has us keep chain in table, with parent jumping to it for
+// packets matching match, if given; stale rules of ours in it are
+// deleted
+func (rules *IPTablesRules) Chain(table, chain, parent string, match ...string) error {
+	rules.Lock()
+	defer rules.Unlock()
+	c := ipTablesChain{table, chain, parent, match}
+	if !rules.scan[[2]string{table, chain}] {
+		rules.chains = append(rules.chains, c)
+		rules.scan[[2]string{table, chain}] = true
+	}
+	return WithNetNSPath(rules.nsPath, func() error {
+		return ensureIPTablesChain(c)
+	})
+}
+
+// Set makes the rules of owner be these, adding those that are
+// missing and deleting any it had before that it no longer has
+func (rules *IPTablesRules) Set(owner string, wanted ...IPTablesRule) error {
+	rules.Lock()
+	defer rules.Unlock()
+	old := rules.rules[owner]
+	if len(wanted) == 0 {
+		delete(rules.rules, owner)
+	} else {
+		rules.rules[owner] = wanted
+	}
+	return WithNetNSPath(rules.nsPath, func() error {
+		keep := make(map[string]bool)
+		for _, r := range wanted {
+			rules.scan[[2]string{r.Table, r.Chain}] = true
+			keep[r.tag(owner)] = true
+			if err := AddIPTablesRule(r.Table, r.Chain, r.tagged(owner)...); err != nil {
+				return err
+			}
+		}
+		for _, r := range old {
+			if !keep[r.tag(owner)] {
+				if err := DeleteIPTablesRule(r.Table, r.Chain, r.tagged(owner)...); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// Owners lists those whose rules we have
+func (rules *IPTablesRules) Owners() []string {
+	rules.Lock()
+	defer rules.Unlock()
+	owners := make([]string, 0, len(rules.rules))
+	for owner := range rules.rules {
+		owners = append(owners, owner)
+	}
+	sort.Strings(owners)
+	return owners
+}
+
+// Remove deletes the rules of owner
+func (rules *IPTablesRules) Remove(owner string) error {
+	return rules.Set(owner)
+}
+
+// Reconcile puts back the chains and rules we want that are missing,
+// and deletes rules of ours we don't want, returning what it did
+func (rules *IPTablesRules) Reconcile() ([]string, error) {
+	rules.Lock()
+	defer rules.Unlock()
+	var repairs []string
+	fw := CurrentFirewall()
+	err := WithNetNSPath(rules.nsPath, func() error {
+		for _, c := range rules.chains {
+			if err := ensureIPTablesChain(c); err != nil {
+				return err
+			}
+		}
+		owners := make([]string, 0, len(rules.rules))
+		for owner := range rules.rules {
+			owners = append(owners, owner)
+		}
+		sort.Strings(owners) // so that repairs are reported in order
+		wanted := make(map[string]bool)
+		for _, c := range rules.chains {
+			wanted[c.jump().tag(chainOwner)] = true
+		}
+		for _, owner := range owners {
+			for _, r := range rules.rules[owner] {
+				wanted[r.tag(owner)] = true
+				if fw.RuleExists(r.Table, r.Chain, r.tagged(owner)...) {
+					continue
+				}
+				if err := fw.AddRule(r.Table, r.Chain, r.tagged(owner)...); err != nil {
+					return err
+				}
+				repairs = append(repairs, "restored "+r.String())
+			}
+		}
+		for tc := range rules.scan {
+			comments, err := fw.Comments(tc[0], tc[1])
+			if err != nil {
+				return err
+			}
+			for _, tag := range comments {
+				if !strings.HasPrefix(tag, ruleTagPrefix) || wanted[tag] {
+					continue
+				}
+				if err := fw.DeleteCommented(tc[0], tc[1], tag); err != nil {
+					return err
+				}
+				repairs = append(repairs, fmt.Sprintf("deleted stale %s from -t %s %s", tag, tc[0], tc[1]))
+			}
+		}
+		return nil
+	})
+	return repairs, err
+}
+
+// Start reconciling every interval, telling report what was done, or
+// went wrong, if anything
+func (rules *IPTablesRules) Start(interval time.Duration, report func([]string, error)) {
+	go func() {
+		for range time.Tick(interval) {
+			if repairs, err := rules.Reconcile(); err != nil || len(repairs) > 0 {
+				report(repairs, err)
+			}
+		}
+	}()
+}
+
+// Create the chain unless it exists, and have the parent jump to it,
+// unless it does already, as the weave script may have had it do,
+// without our tag
+func ensureIPTablesChain(c ipTablesChain) error {
+	fw := CurrentFirewall()
+	if err := fw.NewChain(c.table, c.chain); err != nil {
+		return err
+	}
+	jump := c.jump()
+	if fw.RuleExists(c.table, c.parent, jump.Spec...) {
+		return nil
+	}
+	return AddIPTablesRule(c.table, c.parent, jump.tagged(chainOwner)...)
+}
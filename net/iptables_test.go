@@ -0,0 +1,35 @@
+package net
+
+import (
+	"strings"
+	"testing"
+
+	wt "github.com/weaveworks/weave/testing"
+)
+
+func TestSplitQuoted(t *testing.T) {
+	wt.AssertEquals(t, splitQuoted(""), []string(nil))
+	wt.AssertEquals(t, splitQuoted(`-A WEAVE  -d 10.2.0.0/16 -j MASQUERADE`),
+		[]string{"-A", "WEAVE", "-d", "10.2.0.0/16", "-j", "MASQUERADE"})
+	wt.AssertEquals(t, splitQuoted(`-A WEAVE -m comment --comment "weave:expose:10.2.0.0/16#0a1b2c3d" -j MASQUERADE`),
+		[]string{"-A", "WEAVE", "-m", "comment", "--comment", "weave:expose:10.2.0.0/16#0a1b2c3d", "-j", "MASQUERADE"})
+	wt.AssertEquals(t, splitQuoted(`--comment "a \"quoted\" comment" -j ACCEPT`),
+		[]string{"--comment", `a "quoted" comment`, "-j", "ACCEPT"})
+	wt.AssertEquals(t, splitQuoted(`--comment "" -j ACCEPT`), []string{"--comment", "", "-j", "ACCEPT"})
+}
+
+func TestRuleTag(t *testing.T) {
+	rule := IPTablesRule{Table: "nat", Chain: "WEAVE", Spec: strings.Fields("-d 10.2.0.0/16 ! -s 10.2.0.0/16 -j MASQUERADE")}
+	tag := rule.tag("expose:10.2.0.0/16")
+	wt.AssertTrue(t, strings.HasPrefix(tag, ruleTagPrefix+"expose:10.2.0.0/16#"), "tag names the owner: "+tag)
+	wt.AssertEqualString(t, rule.tag("expose:10.2.0.0/16"), tag, "tag of the same rule")
+	other := IPTablesRule{Table: "nat", Chain: "WEAVE", Spec: strings.Fields("-s 10.2.0.0/16 ! -d 10.2.0.0/16 -j MASQUERADE")}
+	wt.AssertTrue(t, other.tag("expose:10.2.0.0/16") != tag, "tags of different rules differ")
+
+	// the tag survives a round trip through iptables -S
+	tagged := rule.tagged("expose:10.2.0.0/16")
+	wt.AssertEqualString(t, ruleComment(tagged), tag, "comment of the tagged rule")
+	listed := splitQuoted(`-A WEAVE -d 10.2.0.0/16 ! -s 10.2.0.0/16 -m comment --comment "` + tag + `" -j MASQUERADE`)
+	wt.AssertEqualString(t, ruleComment(listed[2:]), tag, "comment of the listed rule")
+	wt.AssertEqualString(t, ruleComment(rule.Spec), "", "comment of an untagged rule")
+}
@@ -0,0 +1,106 @@
+package net
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+)
+
+type InterfaceEventKind int
+
+const (
+	InterfaceUp   InterfaceEventKind = iota // appeared, or came up
+	InterfaceDown                           // appeared down, or went down
+	InterfaceGone                           // deleted, renamed, or moved to another namespace
+)
+
+var interfaceEventKinds = []string{"up", "down", "gone"}
+
+func (k InterfaceEventKind) String() string {
+	return interfaceEventKinds[k]
+}
+
+// InterfaceEvent is a change to an interface we are monitoring
+type InterfaceEvent struct {
+	Kind  InterfaceEventKind
+	Iface *net.Interface // as it is now; as it was when Gone
+}
+
+func (e InterfaceEvent) String() string {
+	return fmt.Sprintf("%s %s", e.Iface.Name, e.Kind)
+}
+
+// MonitorInterface subscribes to netlink notifications of changes to
+// the interface called name, which need not exist yet, and sends them
+// as events on the channel it returns, until done is closed, or
+// netlink fails, when it closes the channel.
+func MonitorInterface(name string, done <-chan struct{}) (<-chan InterfaceEvent, error) {
+	links := make(chan netlink.LinkUpdate)
+	if err := netlink.LinkSubscribe(links, done); err != nil {
+		return nil, fmt.Errorf("Unable to monitor interface %s: %s", name, err)
+	}
+
+	// What we know about the interface; nil if it doesn't exist
+	current, _ := net.InterfaceByName(name)
+	events := make(chan InterfaceEvent)
+	go func() {
+		defer close(events)
+		for {
+			var event *InterfaceEvent
+			select {
+			case <-done:
+				go drain(links)
+				return
+			case update, ok := <-links:
+				if !ok {
+					return
+				}
+				event, current = linkEvent(name, current, update)
+			}
+			if event == nil {
+				continue
+			}
+			select {
+			case events <- *event:
+			case <-done:
+				go drain(links)
+				return
+			}
+		}
+	}()
+	return events, nil
+}
+
+// Discard what the subscription sends, since it blocks until it is
+// read, until it closes its channel, which it does once done.
+func drain(links chan netlink.LinkUpdate) {
+	for range links {
+	}
+}
+
+// Work out what, if anything, a link update means for the interface
+// called name, which was current, returning what it is now
+func linkEvent(name string, current *net.Interface, update netlink.LinkUpdate) (*InterfaceEvent, *net.Interface) {
+	attrs := update.Attrs()
+	ours := current != nil && attrs.Index == current.Index
+	if !ours && attrs.Name != name {
+		return nil, current
+	}
+	if update.Header.Type == syscall.RTM_DELLINK || attrs.Name != name {
+		if !ours {
+			return nil, current
+		}
+		return &InterfaceEvent{Kind: InterfaceGone, Iface: current}, nil
+	}
+	now := &net.Interface{Index: attrs.Index, MTU: attrs.MTU, Name: attrs.Name, HardwareAddr: attrs.HardwareAddr, Flags: attrs.Flags}
+	up := now.Flags&net.FlagUp != 0
+	if ours && up == (current.Flags&net.FlagUp != 0) {
+		return nil, now
+	}
+	if up {
+		return &InterfaceEvent{Kind: InterfaceUp, Iface: now}, now
+	}
+	return &InterfaceEvent{Kind: InterfaceDown, Iface: now}, now
+}
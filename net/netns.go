@@ -0,0 +1,49 @@
+package net
+
+import (
+	"fmt"
+	"runtime"
+
+	"github.com/vishvananda/netns"
+)
+
+// NetNSPath is the path of the network namespace of the process with
+// pid, given where the /proc it is in is mounted, e.g. "/proc"
+func NetNSPath(procfs string, pid int) string {
+	return fmt.Sprintf("%s/%d/ns/net", procfs, pid)
+}
+
+// WithNetNSPath runs fn in the network namespace at nsPath, e.g.
+// "/proc/1/ns/net" for the host's when our /proc is the host's, or in
+// our own if nsPath is blank. Since namespaces belong to OS threads,
+// fn must not hand work to other goroutines.
+func WithNetNSPath(nsPath string, fn func() error) error {
+	if nsPath == "" {
+		return fn()
+	}
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	ourNS, err := netns.Get()
+	if err != nil {
+		return err
+	}
+	defer ourNS.Close()
+	ns, err := netns.GetFromPath(nsPath)
+	if err != nil {
+		return err
+	}
+	defer ns.Close()
+
+	if err := netns.Set(ns); err != nil {
+		return err
+	}
+	defer netns.Set(ourNS)
+	return fn()
+}
+
+// WithNetNSPid runs fn in the network namespace of the process with
+// pid, as WithNetNSPath
+func WithNetNSPid(procfs string, pid int, fn func() error) error {
+	return WithNetNSPath(NetNSPath(procfs, pid), fn)
+}
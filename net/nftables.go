@@ -0,0 +1,234 @@
+package net
+
+import (
+	"fmt"
+	"hash/fnv"
+	"os/exec"
+	"regexp"
+	"strings"
+)
+
+// nftables keeps our rules in tables of its own, "weave-nat" for the
+// iptables nat table and so on, in the ip family, with base chains
+// named, and hooked in, as iptables' built-in ones. It needs the nft
+// command.
+type nftables struct{}
+
+func (nftables) String() string {
+	return "nftables"
+}
+
+// The hooks and priorities of iptables' built-in chains, by table
+var nftBaseChains = map[string]map[string]string{
+	"nat": {
+		"PREROUTING":  "type nat hook prerouting priority -100;",
+		"INPUT":       "type nat hook input priority 100;",
+		"OUTPUT":      "type nat hook output priority -100;",
+		"POSTROUTING": "type nat hook postrouting priority 100;",
+	},
+	"filter": {
+		"INPUT":   "type filter hook input priority 0;",
+		"FORWARD": "type filter hook forward priority 0;",
+		"OUTPUT":  "type filter hook output priority 0;",
+	},
+}
+
+func nftTable(table string) string {
+	return "weave-" + table
+}
+
+func runNFT(args ...string) (string, error) {
+	out, err := exec.Command("nft", args...).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("nft %s: %s: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return string(out), nil
+}
+
+// Make the table, and the chain in it, unless they exist; adding them
+// does nothing if they do
+func (nftables) NewChain(table, chain string) error {
+	if _, err := runNFT("add", "table", "ip", nftTable(table)); err != nil {
+		return err
+	}
+	args := []string{"add", "chain", "ip", nftTable(table), chain}
+	if base, found := nftBaseChains[table][chain]; found {
+		args = append(args, "{", base, "}")
+	}
+	_, err := runNFT(args...)
+	return err
+}
+
+func (nftables) FlushChain(table, chain string) error {
+	_, err := runNFT("flush", "chain", "ip", nftTable(table), chain)
+	return err
+}
+
+// Since nft lists rules much rewritten, we find them by their
+// comments: our own tag if they have one, or else one we give them,
+// made from a hash of the rule as given
+func nftComment(table, chain string, rule []string) string {
+	if comment := ruleComment(rule); comment != "" {
+		return comment
+	}
+	h := fnv.New32a()
+	fmt.Fprint(h, table, chain, strings.Join(rule, " "))
+	return fmt.Sprintf("weave#%08x", h.Sum32())
+}
+
+func (nft nftables) RuleExists(table, chain string, rule ...string) bool {
+	listed, err := nft.list(table, chain)
+	if err != nil {
+		return false
+	}
+	_, found := listed[nftComment(table, chain, rule)]
+	return found
+}
+
+func (nft nftables) AddRule(table, chain string, rule ...string) error {
+	nf, err := nftRule(rule)
+	if err != nil {
+		return err
+	}
+	if ruleComment(rule) == "" {
+		nf = append(nf, "comment", `"`+nftComment(table, chain, rule)+`"`)
+	}
+	// make the chain, as iptables has the built-in ones already
+	if err := nft.NewChain(table, chain); err != nil {
+		return err
+	}
+	_, err = runNFT(append([]string{"add", "rule", "ip", nftTable(table), chain}, nf...)...)
+	return err
+}
+
+func (nft nftables) DeleteRule(table, chain string, rule ...string) error {
+	return nft.DeleteCommented(table, chain, nftComment(table, chain, rule))
+}
+
+func (nft nftables) Comments(table, chain string) ([]string, error) {
+	listed, err := nft.list(table, chain)
+	if err != nil {
+		return nil, err
+	}
+	var comments []string
+	for comment := range listed {
+		comments = append(comments, comment)
+	}
+	return comments, nil
+}
+
+func (nft nftables) DeleteCommented(table, chain, comment string) error {
+	listed, err := nft.list(table, chain)
+	if err != nil {
+		return err
+	}
+	for _, handle := range listed[comment] {
+		if _, err := runNFT("delete", "rule", "ip", nftTable(table), chain, "handle", handle); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var nftListedRule = regexp.MustCompile(`comment "([^"]*)".*# handle ([0-9]+)`)
+
+// The handles of the rules in chain, by comment
+func (nftables) list(table, chain string) (map[string][]string, error) {
+	out, err := runNFT("-a", "list", "chain", "ip", nftTable(table), chain)
+	if err != nil {
+		return nil, err
+	}
+	listed := make(map[string][]string)
+	for _, line := range strings.Split(out, "\n") {
+		if m := nftListedRule.FindStringSubmatch(line); m != nil {
+			listed[m[1]] = append(listed[m[1]], m[2])
+		}
+	}
+	return listed, nil
+}
+
+// Translate the iptables rules we use to nftables
+func nftRule(rule []string) ([]string, error) {
+	var nf, target []string
+	var proto, comment string
+	negate := false
+	not := func() []string {
+		if negate {
+			negate = false
+			return []string{"!="}
+		}
+		return nil
+	}
+	for i := 0; i < len(rule); i++ {
+		arg := func() (string, error) {
+			if i+1 >= len(rule) {
+				return "", fmt.Errorf("Missing value for %s in %s", rule[i], strings.Join(rule, " "))
+			}
+			i++
+			return rule[i], nil
+		}
+		opt := rule[i]
+		var value string
+		var err error
+		if opt != "!" {
+			switch opt {
+			case "-m", "-s", "-d", "-i", "-o", "-p", "--dport", "--sport", "--dst-type", "--ctstate", "--comment", "-j", "--to-destination", "--to-source":
+				if value, err = arg(); err != nil {
+					return nil, err
+				}
+			}
+		}
+		switch opt {
+		case "!":
+			negate = true
+		case "-m": // the options give the match
+		case "-s":
+			nf = append(append(append(nf, "ip", "saddr"), not()...), value)
+		case "-d":
+			nf = append(append(append(nf, "ip", "daddr"), not()...), value)
+		case "-i":
+			nf = append(append(append(nf, "iifname"), not()...), value)
+		case "-o":
+			nf = append(append(append(nf, "oifname"), not()...), value)
+		case "-p":
+			proto = value
+		case "--dport", "--sport":
+			if proto == "" {
+				return nil, fmt.Errorf("%s without -p in %s", opt, strings.Join(rule, " "))
+			}
+			nf = append(append(append(nf, proto, strings.TrimPrefix(opt, "--")), not()...), value)
+			proto = ""
+		case "--dst-type":
+			nf = append(append(append(nf, "fib", "daddr", "type"), not()...), strings.ToLower(value))
+		case "--ctstate":
+			if value == "DNAT" || value == "SNAT" {
+				nf = append(append(append(nf, "ct", "status"), not()...), strings.ToLower(value))
+			} else {
+				nf = append(append(append(nf, "ct", "state"), not()...), strings.ToLower(value))
+			}
+		case "--comment":
+			comment = value
+		case "-j":
+			switch value {
+			case "ACCEPT", "DROP", "RETURN", "MASQUERADE":
+				target = []string{strings.ToLower(value)}
+			case "DNAT", "SNAT":
+				target = []string{strings.ToLower(value), "to"}
+			default:
+				target = []string{"jump", value}
+			}
+		case "--to-destination", "--to-source":
+			target = append(target, value)
+		default:
+			return nil, fmt.Errorf("Unable to translate %s in %s to nftables", opt, strings.Join(rule, " "))
+		}
+	}
+	if proto != "" {
+		nf = append(nf, "meta", "l4proto", proto)
+	}
+	nf = append(nf, target...)
+	if comment != "" {
+		nf = append(nf, "comment", `"`+comment+`"`)
+	}
+	return nf, nil
+}
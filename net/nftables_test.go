@@ -0,0 +1,41 @@
+package net
+
+import (
+	"strings"
+	"testing"
+
+	wt "github.com/weaveworks/weave/testing"
+)
+
+func TestNFTRule(t *testing.T) {
+	for _, c := range []struct{ rule, nft string }{
+		{"-d 10.2.0.0/16 ! -s 10.2.0.0/16 -j MASQUERADE",
+			"ip daddr 10.2.0.0/16 ip saddr != 10.2.0.0/16 masquerade"},
+		{"-p tcp --dport 8080 -j DNAT --to-destination 10.2.0.1:80",
+			"tcp dport 8080 dnat to 10.2.0.1:80"},
+		{"-o weave -p udp -d 10.2.0.1 --dport 53 -m conntrack --ctstate DNAT -j MASQUERADE",
+			`oifname weave ip daddr 10.2.0.1 udp dport 53 ct status dnat masquerade`},
+		{"-m addrtype --dst-type LOCAL -j WEAVE_PUBLISH",
+			"fib daddr type local jump WEAVE_PUBLISH"},
+		{"! -i weave -m conntrack --ctstate RELATED,ESTABLISHED -j ACCEPT",
+			"iifname != weave ct state related,established accept"},
+		{"-p icmp -m comment --comment weave:expose#1 -j RETURN",
+			`meta l4proto icmp return comment "weave:expose#1"`},
+	} {
+		nf, err := nftRule(strings.Fields(c.rule))
+		wt.AssertNoErr(t, err)
+		wt.AssertEqualString(t, strings.Join(nf, " "), c.nft, c.rule)
+	}
+
+	for _, rule := range []string{"--dport 80 -j ACCEPT", "-j DNAT --to-destination", "-m mark --mark 1 -j DROP"} {
+		_, err := nftRule(strings.Fields(rule))
+		wt.AssertTrue(t, err != nil, "error translating "+rule)
+	}
+}
+
+func TestHasOtherNFTables(t *testing.T) {
+	wt.AssertTrue(t, !hasOtherNFTables(""), "no tables")
+	wt.AssertTrue(t, !hasOtherNFTables("table ip weave-nat\ntable ip weave-filter\n"), "only ours")
+	wt.AssertTrue(t, hasOtherNFTables("table ip weave-nat\ntable ip nat\n"), "the host's too")
+	wt.AssertTrue(t, hasOtherNFTables("table inet firewalld\n"), "a firewall manager's")
+}
@@ -0,0 +1,159 @@
+package net
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	ethPAll              = 0x0003
+	packetAddMembership  = 1
+	packetMrPromisc      = 1
+	packetFanout         = 18
+	packetFanoutHash     = 0
+	packetFanoutDefrag   = 0x8000
+	packetOutgoing       = 4
+	maxFanoutGroupChoice = 16
+)
+
+// struct packet_mreq
+type packetMreq struct {
+	ifindex int32
+	typ     uint16
+	alen    uint16
+	address [8]byte
+}
+
+// PacketSocket is an AF_PACKET socket on an interface, through which
+// we read the frames arriving on it, promiscuously, and write frames
+// to send from it
+type PacketSocket struct {
+	file *os.File
+	conn syscall.RawConn
+}
+
+// OpenPacketSockets opens n packet sockets on the interface called
+// ifaceName, each with a receive buffer of bufSz bytes. If n > 1 they
+// form a fanout group, in which each frame goes to just one of them,
+// chosen by a hash of its flow, so that frames of a flow always go to
+// the same one, in order.
+func OpenPacketSockets(ifaceName string, n, bufSz int) ([]*PacketSocket, error) {
+	iface, err := net.InterfaceByName(ifaceName)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to find interface %s: %s", ifaceName, err)
+	}
+	// the fanout group ID must be unique on the host; we try a few,
+	// starting with one from our PID, in case another is using it
+	for i := 0; i < maxFanoutGroupChoice; i++ {
+		group := uint16(os.Getpid() + i)
+		sockets, err := openPacketSockets(iface, n, bufSz, group)
+		if err == nil || err != syscall.EINVAL || n == 1 {
+			return sockets, err
+		}
+	}
+	return nil, fmt.Errorf("Unable to find a free fanout group for %s", ifaceName)
+}
+
+func openPacketSockets(iface *net.Interface, n, bufSz int, group uint16) ([]*PacketSocket, error) {
+	var sockets []*PacketSocket
+	closeAll := func() {
+		for _, s := range sockets {
+			s.Close()
+		}
+	}
+	for i := 0; i < n; i++ {
+		s, err := openPacketSocket(iface, bufSz)
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+		sockets = append(sockets, s)
+		if n == 1 {
+			break
+		}
+		if err := s.control(func(fd int) error {
+			return syscall.SetsockoptInt(fd, syscall.SOL_PACKET, packetFanout, int(group)|(packetFanoutHash|packetFanoutDefrag)<<16)
+		}); err != nil {
+			closeAll()
+			if err == syscall.EINVAL {
+				return nil, err // the group is someone else's
+			}
+			return nil, fmt.Errorf("Unable to join fanout group on %s: %s", iface.Name, err)
+		}
+	}
+	return sockets, nil
+}
+
+func openPacketSocket(iface *net.Interface, bufSz int) (*PacketSocket, error) {
+	// protocol 0 so that we see nothing until bound to the interface
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW|syscall.SOCK_NONBLOCK|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open packet socket: %s", err)
+	}
+	if bufSz > 0 {
+		if syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_RCVBUFFORCE, bufSz) != nil {
+			syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_RCVBUF, bufSz)
+		}
+	}
+	mreq := packetMreq{ifindex: int32(iface.Index), typ: packetMrPromisc}
+	if _, _, errno := syscall.Syscall6(syscall.SYS_SETSOCKOPT, uintptr(fd), syscall.SOL_PACKET, packetAddMembership, uintptr(unsafe.Pointer(&mreq)), unsafe.Sizeof(mreq), 0); errno != 0 {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("Unable to make %s promiscuous: %s", iface.Name, errno)
+	}
+	if err := syscall.Bind(fd, &syscall.SockaddrLinklayer{Protocol: htons(ethPAll), Ifindex: iface.Index}); err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("Unable to bind packet socket to %s: %s", iface.Name, err)
+	}
+	file := os.NewFile(uintptr(fd), "packet:"+iface.Name)
+	conn, err := file.SyscallConn()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &PacketSocket{file: file, conn: conn}, nil
+}
+
+func (s *PacketSocket) control(f func(fd int) error) error {
+	var err error
+	if cerr := s.conn.Control(func(fd uintptr) { err = f(int(fd)) }); cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+// ReadFrame reads the next frame arriving on the interface into buf,
+// returning its length; frames sent from the interface, by us or
+// anything else, are skipped
+func (s *PacketSocket) ReadFrame(buf []byte) (int, error) {
+	for {
+		var n int
+		var from syscall.Sockaddr
+		var err error
+		if rerr := s.conn.Read(func(fd uintptr) bool {
+			n, from, err = syscall.Recvfrom(int(fd), buf, 0)
+			return err != syscall.EAGAIN
+		}); rerr != nil {
+			return 0, rerr
+		}
+		if err != nil {
+			return 0, err
+		}
+		if ll, ok := from.(*syscall.SockaddrLinklayer); ok && ll.Pkttype == packetOutgoing {
+			continue
+		}
+		return n, nil
+	}
+}
+
+// WriteFrame sends frame from the interface
+func (s *PacketSocket) WriteFrame(frame []byte) error {
+	_, err := s.file.Write(frame)
+	return err
+}
+
+func (s *PacketSocket) Close() error {
+	return s.file.Close()
+}
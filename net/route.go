@@ -0,0 +1,169 @@
+package net
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/vishvananda/netlink"
+)
+
+// RouteProtocol marks the routes we add, as the routing protocol
+// that added them, so that we can tell them from others
+const RouteProtocol = 87
+
+// Route is a host route, to Dst via the interface called Interface,
+// and Gateway, unless that is nil
+type Route struct {
+	Dst       *net.IPNet
+	Interface string
+	Gateway   net.IP
+}
+
+func (r Route) String() string {
+	if r.Gateway != nil {
+		return fmt.Sprintf("%s via %s dev %s", r.Dst, r.Gateway, r.Interface)
+	}
+	return fmt.Sprintf("%s dev %s", r.Dst, r.Interface)
+}
+
+func (r Route) link() (netlink.Link, error) {
+	link, err := netlink.LinkByName(r.Interface)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to find interface %s: %s", r.Interface, err)
+	}
+	return link, nil
+}
+
+// Find the route to r.Dst via r.Interface, if there is one
+func (r Route) find(link netlink.Link) (*netlink.Route, error) {
+	routes, err := netlink.RouteList(link, netlink.FAMILY_V4)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to list routes via %s: %s", r.Interface, err)
+	}
+	for _, route := range routes {
+		if route.Dst != nil && route.Dst.String() == r.Dst.String() {
+			return &route, nil
+		}
+	}
+	return nil, nil
+}
+
+// EnsureRoute adds r, marked as ours, unless there is a route to
+// r.Dst via r.Interface already, returning whether it added it.
+func EnsureRoute(r Route) (bool, error) {
+	link, err := r.link()
+	if err != nil {
+		return false, err
+	}
+	if existing, err := r.find(link); err != nil || existing != nil {
+		return false, err
+	}
+	route := &netlink.Route{LinkIndex: link.Attrs().Index, Dst: r.Dst, Gw: r.Gateway, Protocol: RouteProtocol}
+	if r.Gateway == nil {
+		route.Scope = netlink.SCOPE_LINK
+	}
+	if err := netlink.RouteAdd(route); err != nil {
+		return false, fmt.Errorf("Unable to add route to %s: %s", r, err)
+	}
+	return true, nil
+}
+
+// RemoveRoute removes the route to r.Dst via r.Interface, if there is
+// one and we added it, returning whether it removed it.
+func RemoveRoute(r Route) (bool, error) {
+	link, err := r.link()
+	if err != nil {
+		return false, err
+	}
+	existing, err := r.find(link)
+	if err != nil || existing == nil || existing.Protocol != RouteProtocol {
+		return false, err
+	}
+	if err := netlink.RouteDel(existing); err != nil {
+		return false, fmt.Errorf("Unable to remove route to %s: %s", r, err)
+	}
+	return true, nil
+}
+
+// OwnedRoutes lists the IPv4 routes we added, via any interface
+func OwnedRoutes() ([]Route, error) {
+	routes, err := netlink.RouteList(nil, netlink.FAMILY_V4)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to list routes: %s", err)
+	}
+	var owned []Route
+	for _, route := range routes {
+		if route.Protocol != RouteProtocol || route.Dst == nil {
+			continue
+		}
+		owned = append(owned, Route{Dst: route.Dst, Interface: linkName(route.LinkIndex), Gateway: route.Gw})
+	}
+	return owned, nil
+}
+
+func linkName(index int) string {
+	if link, err := netlink.LinkByIndex(index); err == nil {
+		return link.Attrs().Name
+	}
+	return fmt.Sprint(index)
+}
+
+// OverlappingRoutes lists the host's IPv4 routes, other than the
+// default route and those via the interfaces named in except, to
+// destinations that overlap ipnet.
+func OverlappingRoutes(ipnet *net.IPNet, except ...string) ([]Route, error) {
+	routes, err := netlink.RouteList(nil, netlink.FAMILY_V4)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to list routes: %s", err)
+	}
+	skip := make(map[string]bool)
+	for _, name := range except {
+		skip[name] = true
+	}
+	var overlapping []Route
+	for _, route := range routes {
+		if route.Dst == nil || !(route.Dst.Contains(ipnet.IP) || ipnet.Contains(route.Dst.IP)) {
+			continue
+		}
+		if name := linkName(route.LinkIndex); !skip[name] {
+			overlapping = append(overlapping, Route{Dst: route.Dst, Interface: name})
+		}
+	}
+	return overlapping, nil
+}
+
+// NextHop finds how packets to ip leave the host: through which
+// interface, from which address, and from and to which MACs, as long
+// as the kernel knows the MAC of the next hop already
+func NextHop(ip net.IP) (ifindex int, src net.IP, srcMAC, dstMAC net.HardwareAddr, err error) {
+	routes, err := netlink.RouteGet(ip)
+	if err != nil {
+		return 0, nil, nil, nil, err
+	}
+	if len(routes) == 0 {
+		return 0, nil, nil, nil, fmt.Errorf("no route to %s", ip)
+	}
+	route := routes[0]
+	link, err := netlink.LinkByIndex(route.LinkIndex)
+	if err != nil {
+		return 0, nil, nil, nil, err
+	}
+	if len(link.Attrs().HardwareAddr) != 6 {
+		return 0, nil, nil, nil, fmt.Errorf("%s is not an ethernet interface", link.Attrs().Name)
+	}
+	via := ip
+	if route.Gw != nil {
+		via = route.Gw
+	}
+	neighs, err := netlink.NeighList(route.LinkIndex, netlink.FAMILY_V4)
+	if err != nil {
+		return 0, nil, nil, nil, err
+	}
+	for _, neigh := range neighs {
+		if neigh.IP.Equal(via) && len(neigh.HardwareAddr) == 6 &&
+			neigh.State&(netlink.NUD_REACHABLE|netlink.NUD_STALE|netlink.NUD_DELAY|netlink.NUD_PROBE|netlink.NUD_PERMANENT) != 0 {
+			return route.LinkIndex, route.Src, link.Attrs().HardwareAddr, neigh.HardwareAddr, nil
+		}
+	}
+	return 0, nil, nil, nil, fmt.Errorf("no neighbour entry for %s", via)
+}
@@ -0,0 +1,132 @@
+package net
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Sysctl is a kernel parameter, named as sysctl(8) names it, e.g.
+// net.ipv4.ip_forward, or as its path under /proc/sys, e.g.
+// net/ipv4/conf/weave/proxy_arp, and a value for it
+type Sysctl struct {
+	Name  string
+	Value string
+}
+
+func (s Sysctl) String() string {
+	return s.Name + "=" + s.Value
+}
+
+// ParseSysctls parses settings of the form name=value
+func ParseSysctls(settings []string) ([]Sysctl, error) {
+	var sysctls []Sysctl
+	for _, setting := range settings {
+		parts := strings.SplitN(setting, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, fmt.Errorf("Invalid sysctl %q: expected name=value", setting)
+		}
+		sysctls = append(sysctls, Sysctl{strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])})
+	}
+	return sysctls, nil
+}
+
+// Names with slashes in are paths already, as for sysctl(8), so that
+// interfaces with dots in their names can be named
+func sysctlPath(name string) string {
+	if !strings.Contains(name, "/") {
+		name = strings.Replace(name, ".", "/", -1)
+	}
+	return filepath.Join("/proc/sys", name)
+}
+
+// ReadSysctl reads the value of the kernel parameter called name,
+// with runs of whitespace, as in multi-valued parameters, made single
+// spaces
+func ReadSysctl(name string) (string, error) {
+	contents, err := ioutil.ReadFile(sysctlPath(name))
+	if err != nil {
+		return "", fmt.Errorf("Unable to read sysctl %s: %s", name, err)
+	}
+	return strings.Join(strings.Fields(string(contents)), " "), nil
+}
+
+// WriteSysctl sets the kernel parameter called name to value
+func WriteSysctl(name, value string) error {
+	if err := ioutil.WriteFile(sysctlPath(name), []byte(value), 0644); err != nil {
+		return fmt.Errorf("Unable to set sysctl %s to %s: %s", name, value, err)
+	}
+	return nil
+}
+
+// Sysctls sets kernel parameters in the network namespace at nsPath,
+// ours if blank, remembering the values it changed so that it can put
+// them back
+type Sysctls struct {
+	sync.Mutex
+	nsPath string
+	prior  []Sysctl // the values of those we changed, in the order we changed them
+}
+
+func NewSysctls(nsPath string) *Sysctls {
+	return &Sysctls{nsPath: nsPath}
+}
+
+// Set sets s, unless it has that value already, returning whether it
+// changed it
+func (sysctls *Sysctls) Set(s Sysctl) (bool, error) {
+	sysctls.Lock()
+	defer sysctls.Unlock()
+	changed := false
+	err := WithNetNSPath(sysctls.nsPath, func() error {
+		prior, err := ReadSysctl(s.Name)
+		if err != nil || prior == strings.Join(strings.Fields(s.Value), " ") {
+			return err
+		}
+		if err := WriteSysctl(s.Name, s.Value); err != nil {
+			return err
+		}
+		changed = true
+		for _, p := range sysctls.prior {
+			if p.Name == s.Name {
+				return nil // we have its original value already
+			}
+		}
+		sysctls.prior = append(sysctls.prior, Sysctl{s.Name, prior})
+		return nil
+	})
+	return changed, err
+}
+
+// Restore puts back the values of the parameters we changed, in the
+// reverse order, returning the first error, if any, having tried them
+// all
+func (sysctls *Sysctls) Restore() error {
+	sysctls.Lock()
+	defer sysctls.Unlock()
+	var firstErr error
+	err := WithNetNSPath(sysctls.nsPath, func() error {
+		for i := len(sysctls.prior) - 1; i >= 0; i-- {
+			p := sysctls.prior[i]
+			if err := WriteSysctl(p.Name, p.Value); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+		return nil
+	})
+	sysctls.prior = nil
+	if err != nil {
+		return err
+	}
+	return firstErr
+}
+
+// Changed lists the parameters we changed, with the values they had
+// before
+func (sysctls *Sysctls) Changed() []Sysctl {
+	sysctls.Lock()
+	defer sysctls.Unlock()
+	return append([]Sysctl{}, sysctls.prior...)
+}
@@ -0,0 +1,74 @@
+package net
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+
+	"github.com/vishvananda/netlink"
+)
+
+// struct ifreq, with ifr_flags
+type tapRequest struct {
+	name  [syscall.IFNAMSIZ]byte
+	flags uint16
+	_     [22]byte
+}
+
+// OpenTap creates a TAP device called name, plugs it into the bridge
+// called bridgeName and brings it up, returning the file through which
+// frames, without any header of the kernel's, are read from and
+// written to it. The device goes away when the file is closed.
+func OpenTap(name, bridgeName string) (*os.File, error) {
+	if len(name) >= syscall.IFNAMSIZ {
+		return nil, fmt.Errorf("Interface name %s is too long", name)
+	}
+	file, err := os.OpenFile("/dev/net/tun", os.O_RDWR, 0)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to create TAP device %s: %s", name, err)
+	}
+	req := tapRequest{flags: syscall.IFF_TAP | syscall.IFF_NO_PI}
+	copy(req.name[:], name)
+	conn, err := file.SyscallConn()
+	if err == nil {
+		conn.Control(func(fd uintptr) {
+			if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, syscall.TUNSETIFF, uintptr(unsafe.Pointer(&req))); errno != 0 {
+				err = errno
+			}
+		})
+	}
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("Unable to create TAP device %s: %s", name, err)
+	}
+	if err := PlugTap(name, bridgeName); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+// PlugTap attaches the TAP device called name to the bridge called
+// bridgeName, giving it the bridge's MTU, and brings it up, e.g. when
+// the bridge has been created again.
+func PlugTap(name, bridgeName string) error {
+	bridge, err := netlink.LinkByName(bridgeName)
+	if err != nil {
+		return fmt.Errorf("Unable to find bridge %s: %s", bridgeName, err)
+	}
+	tap, err := netlink.LinkByName(name)
+	if err != nil {
+		return fmt.Errorf("Unable to find TAP device %s: %s", name, err)
+	}
+	if err := netlink.LinkSetMTU(tap, bridge.Attrs().MTU); err != nil {
+		return fmt.Errorf("Unable to set the MTU of %s: %s", name, err)
+	}
+	if err := netlink.LinkSetMasterByIndex(tap, bridge.Attrs().Index); err != nil {
+		return fmt.Errorf("Unable to attach %s to bridge %s: %s", name, bridgeName, err)
+	}
+	if err := netlink.LinkSetUp(tap); err != nil {
+		return fmt.Errorf("Unable to bring up %s: %s", name, err)
+	}
+	return nil
+}
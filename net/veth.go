@@ -0,0 +1,324 @@
+package net
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+)
+
+var multicastRoute = &net.IPNet{IP: net.IPv4(224, 0, 0, 0), Mask: net.CIDRMask(4, 32)}
+
+// CreateAndAttachVeth creates a veth pair, attaches the end called
+// name to the bridge and brings it up, leaving the end called
+// peerName, with transmit checksum offload off, for the caller to
+// hand to a container. The pair gets the bridge's MTU if mtu is 0.
+func CreateAndAttachVeth(name, peerName, bridgeName string, mtu int) (*netlink.Veth, error) {
+	bridge, err := netlink.LinkByName(bridgeName)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to find bridge %s: %s", bridgeName, err)
+	}
+	if mtu == 0 {
+		mtu = bridge.Attrs().MTU
+	}
+	veth := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: name, MTU: mtu}, PeerName: peerName}
+	if err := netlink.LinkAdd(veth); err != nil {
+		return nil, fmt.Errorf("Unable to create veth pair %s/%s: %s", name, peerName, err)
+	}
+	if err := DisableTxOffload(peerName); err != nil {
+		netlink.LinkDel(veth)
+		return nil, err
+	}
+	if err := netlink.LinkSetMasterByIndex(veth, bridge.Attrs().Index); err != nil {
+		netlink.LinkDel(veth)
+		return nil, fmt.Errorf("Unable to attach %s to bridge %s: %s", name, bridgeName, err)
+	}
+	if err := netlink.LinkSetUp(veth); err != nil {
+		netlink.LinkDel(veth)
+		return nil, fmt.Errorf("Unable to bring up %s: %s", name, err)
+	}
+	return veth, nil
+}
+
+// DeleteLink deletes the named interface; deleting either end of a
+// veth pair deletes both.
+func DeleteLink(name string) error {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return fmt.Errorf("Unable to find interface %s: %s", name, err)
+	}
+	return netlink.LinkDel(link)
+}
+
+// DeleteLinkIfPresent deletes the named interface, if there is one,
+// saying whether there was.
+func DeleteLinkIfPresent(name string) (bool, error) {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return false, nil
+	}
+	if err := netlink.LinkDel(link); err != nil {
+		return false, fmt.Errorf("Unable to delete %s: %s", name, err)
+	}
+	return true, nil
+}
+
+// SetLinkMAC gives the interface called name the MAC address mac.
+func SetLinkMAC(name string, mac net.HardwareAddr) error {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return fmt.Errorf("Unable to find interface %s: %s", name, err)
+	}
+	if err := netlink.LinkSetHardwareAddr(link, mac); err != nil {
+		return fmt.Errorf("Unable to set the MAC address of %s to %s: %s", name, mac, err)
+	}
+	return nil
+}
+
+// ConfigureContainerInterface moves the interface called name into
+// the network namespace at nsPath, and there renames it ifName, gives
+// it addrs, brings it up and routes multicast through it, much as
+// 'weave attach' does.
+func ConfigureContainerInterface(name, nsPath, ifName string, addrs ...*net.IPNet) error {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return fmt.Errorf("Unable to find interface %s: %s", name, err)
+	}
+	ns, err := netns.GetFromPath(nsPath)
+	if err != nil {
+		return fmt.Errorf("Unable to open network namespace %s: %s", nsPath, err)
+	}
+	defer ns.Close()
+	if err := netlink.LinkSetNsFd(link, int(ns)); err != nil {
+		return fmt.Errorf("Unable to move %s to network namespace %s: %s", name, nsPath, err)
+	}
+	return WithNetNSPath(nsPath, func() error {
+		link, err := netlink.LinkByName(name)
+		if err != nil {
+			return fmt.Errorf("Unable to find interface %s in network namespace %s: %s", name, nsPath, err)
+		}
+		if err := netlink.LinkSetName(link, ifName); err != nil {
+			return fmt.Errorf("Unable to rename %s to %s: %s", name, ifName, err)
+		}
+		for _, addr := range addrs {
+			if err := netlink.AddrAdd(link, &netlink.Addr{IPNet: addr}); err != nil {
+				return fmt.Errorf("Unable to add address %s to %s: %s", addr, ifName, err)
+			}
+		}
+		if err := netlink.LinkSetUp(link); err != nil {
+			return fmt.Errorf("Unable to bring up %s: %s", ifName, err)
+		}
+		route := &netlink.Route{LinkIndex: link.Attrs().Index, Scope: netlink.SCOPE_LINK, Dst: multicastRoute}
+		if err := netlink.RouteAdd(route); err != nil {
+			return fmt.Errorf("Unable to add multicast route to %s: %s", ifName, err)
+		}
+		return nil
+	})
+}
+
+// AddContainerAddresses gives the interface ifName in the network
+// namespace at nsPath whichever of addrs it does not have already, as
+// 'weave attach' does for a container it has attached before. It
+// returns false, and does nothing, if there is no such interface.
+func AddContainerAddresses(nsPath, ifName string, addrs ...*net.IPNet) (bool, error) {
+	found := false
+	err := WithNetNSPath(nsPath, func() error {
+		link, err := netlink.LinkByName(ifName)
+		if _, notFound := err.(netlink.LinkNotFoundError); notFound {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("Unable to find interface %s in network namespace %s: %s", ifName, nsPath, err)
+		}
+		found = true
+		existing, err := netlink.AddrList(link, netlink.FAMILY_V4)
+		if err != nil {
+			return fmt.Errorf("Unable to list addresses of %s: %s", ifName, err)
+		}
+		have := make([]*net.IPNet, len(existing))
+		for i, e := range existing {
+			have[i] = e.IPNet
+		}
+		for _, addr := range addrs {
+			if containsAddr(have, addr) {
+				continue
+			}
+			if err := netlink.AddrAdd(link, &netlink.Addr{IPNet: addr}); err != nil {
+				return fmt.Errorf("Unable to add address %s to %s: %s", addr, ifName, err)
+			}
+		}
+		return nil
+	})
+	return found, err
+}
+
+// ContainerVethNames gives the names of the two ends of the veth pair
+// for a container whose process has pid and whose interface is
+// called ifName, as 'weave attach' names them.
+func ContainerVethNames(ifName string, pid int) (local, guest string) {
+	return fmt.Sprintf("v%spl%d", ifName, pid), fmt.Sprintf("v%spg%d", ifName, pid)
+}
+
+// ContainerRoute is a route in a container's network namespace
+// through its weave interface, via Gateway unless that is nil
+type ContainerRoute struct {
+	Dst     *net.IPNet
+	Gateway net.IP
+}
+
+func (r ContainerRoute) String() string {
+	if r.Gateway == nil {
+		return r.Dst.String()
+	}
+	return fmt.Sprintf("%s via %s", r.Dst, r.Gateway)
+}
+
+// AddContainerRoutes adds routes through the interface ifName in the
+// network namespace at nsPath, removing those it added again if it
+// can't add them all.
+func AddContainerRoutes(nsPath, ifName string, routes ...ContainerRoute) error {
+	return WithNetNSPath(nsPath, func() error {
+		link, err := netlink.LinkByName(ifName)
+		if err != nil {
+			return fmt.Errorf("Unable to find interface %s in network namespace %s: %s", ifName, nsPath, err)
+		}
+		var added []*netlink.Route
+		for _, r := range routes {
+			route := &netlink.Route{LinkIndex: link.Attrs().Index, Dst: r.Dst, Gw: r.Gateway}
+			if r.Gateway == nil {
+				route.Scope = netlink.SCOPE_LINK
+			}
+			if err := netlink.RouteAdd(route); err != nil {
+				for _, a := range added {
+					netlink.RouteDel(a)
+				}
+				return fmt.Errorf("Unable to add route to %s on %s: %s", r, ifName, err)
+			}
+			added = append(added, route)
+		}
+		return nil
+	})
+}
+
+// AttachContainer connects the container whose network namespace is
+// at nsPath to bridge, which is in the network namespace at
+// hostNSPath (ours if blank), through a veth pair called localName
+// and guestName whose container end becomes ifName, with addrs and
+// routes, and the MAC address mac unless that is nil, as 'weave
+// attach' does, removing the pair again if it can't finish. If the
+// container has an ifName already it just gets whichever of addrs it
+// lacks, keeping its MAC.
+func AttachContainer(hostNSPath, nsPath, bridge, localName, guestName, ifName string, mac net.HardwareAddr, addrs []*net.IPNet, routes ...ContainerRoute) error {
+	found, err := AddContainerAddresses(nsPath, ifName, addrs...)
+	if err != nil || found {
+		return err
+	}
+	return WithNetNSPath(hostNSPath, func() error {
+		if _, err := CreateAndAttachVeth(localName, guestName, bridge, 0); err != nil {
+			return err
+		}
+		var err error
+		if mac != nil {
+			err = SetLinkMAC(guestName, mac)
+		}
+		if err == nil {
+			err = ConfigureContainerInterface(guestName, nsPath, ifName, addrs...)
+		}
+		if err == nil {
+			err = AddContainerRoutes(nsPath, ifName, routes...)
+		}
+		if err != nil {
+			// deleting our end deletes the container's, wherever it is
+			DeleteLink(localName)
+			return err
+		}
+		return nil
+	})
+}
+
+// DetachContainer removes addrs, or all its addresses if addrs is
+// empty, from the interface ifName in the network namespace at
+// nsPath, and deletes the interface, and so its veth peer, if that
+// leaves it with none, as 'weave detach' does. It returns the
+// addresses it removed.
+func DetachContainer(nsPath, ifName string, addrs []*net.IPNet) ([]*net.IPNet, error) {
+	var removed []*net.IPNet
+	err := WithNetNSPath(nsPath, func() error {
+		link, err := netlink.LinkByName(ifName)
+		if _, notFound := err.(netlink.LinkNotFoundError); notFound {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("Unable to find interface %s in network namespace %s: %s", ifName, nsPath, err)
+		}
+		existing, err := netlink.AddrList(link, netlink.FAMILY_V4)
+		if err != nil {
+			return fmt.Errorf("Unable to list addresses of %s: %s", ifName, err)
+		}
+		remaining := 0
+		for _, e := range existing {
+			if len(addrs) > 0 && !containsAddr(addrs, e.IPNet) {
+				remaining++
+				continue
+			}
+			if err := netlink.AddrDel(link, &e); err != nil {
+				return fmt.Errorf("Unable to remove address %s from %s: %s", e.IPNet, ifName, err)
+			}
+			removed = append(removed, e.IPNet)
+		}
+		if remaining > 0 {
+			return nil
+		}
+		// deleting the interface deletes the multicast route too
+		if err := netlink.LinkDel(link); err != nil {
+			return fmt.Errorf("Unable to delete %s: %s", ifName, err)
+		}
+		return nil
+	})
+	return removed, err
+}
+
+func containsAddr(addrs []*net.IPNet, addr *net.IPNet) bool {
+	for _, a := range addrs {
+		if a.String() == addr.String() {
+			return true
+		}
+	}
+	return false
+}
+
+// ContainerInterface describes one of a container's interfaces
+type ContainerInterface struct {
+	Name  string
+	MAC   net.HardwareAddr
+	Addrs []*net.IPNet
+}
+
+// ContainerInterfaces lists the interfaces in the network namespace
+// at nsPath whose names start with prefix, with their IPv4 addresses.
+func ContainerInterfaces(nsPath, prefix string) ([]ContainerInterface, error) {
+	var ifaces []ContainerInterface
+	err := WithNetNSPath(nsPath, func() error {
+		links, err := netlink.LinkList()
+		if err != nil {
+			return fmt.Errorf("Unable to list interfaces in network namespace %s: %s", nsPath, err)
+		}
+		for _, link := range links {
+			attrs := link.Attrs()
+			if !strings.HasPrefix(attrs.Name, prefix) {
+				continue
+			}
+			addrs, err := netlink.AddrList(link, netlink.FAMILY_V4)
+			if err != nil {
+				return fmt.Errorf("Unable to list addresses of %s: %s", attrs.Name, err)
+			}
+			iface := ContainerInterface{Name: attrs.Name, MAC: attrs.HardwareAddr}
+			for _, addr := range addrs {
+				iface.Addrs = append(iface.Addrs, addr.IPNet)
+			}
+			ifaces = append(ifaces, iface)
+		}
+		return nil
+	})
+	return ifaces, err
+}
@@ -0,0 +1,499 @@
+// Package networks keeps the virtual networks defined on a weave
+// network, each a name for a subnet, and which containers are members
+// of them, replicated on every peer by gossip. It keeps track of them
+// only: a container is isolated by the addresses it is given, not by
+// being a member of a network.
+package networks
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/weaveworks/weave/common"
+	"github.com/weaveworks/weave/router"
+)
+
+const (
+	// How long we keep records for deleted networks and members, so
+	// that the deletion has a chance to reach every peer
+	tombstoneTimeout = 10 * time.Minute
+	// How often we look for tombstones to throw away
+	tombstoneGCInterval = time.Minute
+)
+
+// Network is a virtual network, and its members
+type Network struct {
+	Name    string
+	Subnet  string // in CIDR notation
+	Members []Member
+}
+
+// Member is a container in a network
+type Member struct {
+	Container string
+	Peer      string // the name of the peer it was joined on
+}
+
+// Networks and memberships are both records, distinguished by whether
+// they name a container. Any peer may change any record, bumping
+// Version as it does so, and becoming its Origin; of two copies, the
+// one with the higher Version wins, or, should two peers change one at
+// once, the one with the greater Origin. Deleted records are kept as
+// tombstones for a while so that the deletion can propagate.
+type record struct {
+	Network   string
+	Container string          // the member, or blank for the network itself
+	Subnet    string          // of the network
+	Peer      router.PeerName // that the member was joined on
+	Origin    router.PeerName
+	Version   int
+	Tombstone int64 // timestamp of deletion, or 0 if live
+}
+
+func (r *record) isLive() bool {
+	return r.Tombstone == 0
+}
+
+func (r *record) sameAs(other *record) bool {
+	return r.Network == other.Network && r.Container == other.Container
+}
+
+func (r *record) newerThan(other *record) bool {
+	return r.Version > other.Version || (r.Version == other.Version && r.Origin > other.Origin)
+}
+
+// Registry holds the networks and their members
+type Registry struct {
+	sync.RWMutex
+	ourName router.PeerName
+	recs    []record
+	gossip  router.Gossip
+	running func() ([]string, error)
+}
+
+// NotFoundError is a network, or member of one, not being there
+type NotFoundError string
+
+func (err NotFoundError) Error() string {
+	return "Unable to find " + string(err)
+}
+
+// ConflictError is a network conflicting with another, which has the
+// same name, or an overlapping subnet
+type ConflictError string
+
+func (err ConflictError) Error() string {
+	return string(err)
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// SetInterfaces gives the registry the name of the peer it's running
+// on, and the gossip channel over which to tell other peers of changes
+func (reg *Registry) SetInterfaces(ourName router.PeerName, gossip router.Gossip) {
+	reg.Lock()
+	defer reg.Unlock()
+	reg.ourName = ourName
+	reg.gossip = gossip
+}
+
+// SetRunning gives the registry a way to list the IDs of the
+// containers running on this peer, so that only those can join a
+// network here, and we hear of them being destroyed
+func (reg *Registry) SetRunning(running func() ([]string, error)) {
+	reg.Lock()
+	defer reg.Unlock()
+	reg.running = running
+}
+
+// Start periodically clearing out old tombstones
+func (reg *Registry) Start() {
+	go func() {
+		for range time.Tick(tombstoneGCInterval) {
+			reg.removeTombstones(time.Now().Add(-tombstoneTimeout))
+		}
+	}()
+}
+
+func (reg *Registry) removeTombstones(olderThan time.Time) {
+	reg.Lock()
+	defer reg.Unlock()
+	w := 0 // write index
+	for _, r := range reg.recs {
+		if r.isLive() || r.Tombstone > olderThan.Unix() {
+			reg.recs[w] = r
+			w++
+		}
+	}
+	reg.recs = reg.recs[:w]
+}
+
+func (reg *Registry) indexOf(network, container string) int {
+	for i, r := range reg.recs {
+		if r.Network == network && r.Container == container {
+			return i
+		}
+	}
+	return -1
+}
+
+func (reg *Registry) live(network, container string) *record {
+	if i := reg.indexOf(network, container); i >= 0 && reg.recs[i].isLive() {
+		return &reg.recs[i]
+	}
+	return nil
+}
+
+// The ID of the running container that ident is, or is a prefix of
+func (reg *Registry) containerID(ident string) (string, error) {
+	reg.RLock()
+	running := reg.running
+	reg.RUnlock()
+	if running == nil {
+		return ident, nil
+	}
+	ids, err := running()
+	if err != nil {
+		return "", err
+	}
+	found := ""
+	for _, id := range ids {
+		if id == ident {
+			return id, nil
+		}
+		if strings.HasPrefix(id, ident) {
+			if found != "" {
+				return "", fmt.Errorf("Container %s is ambiguous", ident)
+			}
+			found = id
+		}
+	}
+	if found == "" {
+		return "", NotFoundError("container " + ident + " running on this peer")
+	}
+	return found, nil
+}
+
+// Set r, live or deleted, as a change of ours, returning it as changed
+func (reg *Registry) set(r record) record {
+	r.Origin = reg.ourName
+	if i := reg.indexOf(r.Network, r.Container); i >= 0 {
+		r.Version = reg.recs[i].Version + 1
+		reg.recs[i] = r
+	} else {
+		reg.recs = append(reg.recs, r)
+	}
+	return r
+}
+
+// Create a network of subnet, given in CIDR notation, which mustn't
+// overlap that of any other
+func (reg *Registry) Create(name, subnet string) (Network, error) {
+	if name == "" || strings.Contains(name, "/") {
+		return Network{}, fmt.Errorf("Invalid network name %q", name)
+	}
+	_, cidr, err := net.ParseCIDR(subnet)
+	if err != nil {
+		return Network{}, fmt.Errorf("Invalid subnet %q: %s", subnet, err)
+	}
+	reg.Lock()
+	for _, r := range reg.recs {
+		if r.Container != "" || !r.isLive() {
+			continue
+		}
+		if r.Network == name {
+			reg.Unlock()
+			return Network{}, ConflictError(fmt.Sprintf("Network %s already exists", name))
+		}
+		if _, other, err := net.ParseCIDR(r.Subnet); err == nil && (other.Contains(cidr.IP) || cidr.Contains(other.IP)) {
+			reg.Unlock()
+			return Network{}, ConflictError(fmt.Sprintf("Subnet %s overlaps %s, of network %s", cidr, other, r.Network))
+		}
+	}
+	r := reg.set(record{Network: name, Subnet: cidr.String()})
+	reg.Unlock()
+	reg.broadcast([]record{r})
+	return Network{Name: name, Subnet: r.Subnet, Members: []Member{}}, nil
+}
+
+// Delete a network, and its memberships
+func (reg *Registry) Delete(name string) error {
+	reg.Lock()
+	if reg.live(name, "") == nil {
+		reg.Unlock()
+		return NotFoundError("network " + name)
+	}
+	var changed []record
+	now := time.Now().Unix()
+	for _, r := range reg.recs {
+		if r.Network == name && r.isLive() {
+			r.Tombstone = now
+			changed = append(changed, r)
+		}
+	}
+	for i, r := range changed {
+		changed[i] = reg.set(r)
+	}
+	reg.Unlock()
+	reg.broadcast(changed)
+	return nil
+}
+
+// Join a container running on this peer to a network
+func (reg *Registry) Join(name, container string) error {
+	if container == "" {
+		return fmt.Errorf("Invalid container %q", container)
+	}
+	container, err := reg.containerID(container)
+	if err != nil {
+		return err
+	}
+	reg.Lock()
+	if reg.live(name, "") == nil {
+		reg.Unlock()
+		return NotFoundError("network " + name)
+	}
+	if r := reg.live(name, container); r != nil && r.Peer == reg.ourName {
+		reg.Unlock()
+		return nil
+	}
+	r := reg.set(record{Network: name, Container: container, Peer: reg.ourName})
+	reg.Unlock()
+	reg.broadcast([]record{r})
+	return nil
+}
+
+// Leave has a container leave a network
+func (reg *Registry) Leave(name, container string) error {
+	reg.Lock()
+	existing := reg.live(name, container)
+	if existing == nil || container == "" {
+		reg.Unlock()
+		return NotFoundError(fmt.Sprintf("%s in network %s", container, name))
+	}
+	r := *existing
+	r.Tombstone = time.Now().Unix()
+	r = reg.set(r)
+	reg.Unlock()
+	reg.broadcast([]record{r})
+	return nil
+}
+
+// ContainerDied does nothing: a container stays in its networks should
+// it restart
+func (reg *Registry) ContainerDied(ident string) error {
+	return nil
+}
+
+// ContainerDestroyed has a container joined on this peer leave all its
+// networks
+func (reg *Registry) ContainerDestroyed(ident string) error {
+	reg.Lock()
+	var changed []record
+	now := time.Now().Unix()
+	for _, r := range reg.recs {
+		if r.Container == ident && r.Peer == reg.ourName && r.isLive() {
+			r.Tombstone = now
+			changed = append(changed, r)
+		}
+	}
+	for i, r := range changed {
+		changed[i] = reg.set(r)
+	}
+	reg.Unlock()
+	reg.broadcast(changed)
+	return nil
+}
+
+// Networks lists the networks, and their members, in order of name
+func (reg *Registry) Networks() []Network {
+	reg.RLock()
+	defer reg.RUnlock()
+	named := make(map[string]*Network)
+	for _, r := range reg.recs {
+		if r.Container == "" && r.isLive() {
+			named[r.Network] = &Network{Name: r.Network, Subnet: r.Subnet, Members: []Member{}}
+		}
+	}
+	for _, r := range reg.recs {
+		if network, found := named[r.Network]; found && r.Container != "" && r.isLive() {
+			network.Members = append(network.Members, Member{r.Container, r.Peer.String()})
+		}
+	}
+	networks := []Network{}
+	for _, network := range named {
+		sort.Sort(byContainer(network.Members))
+		networks = append(networks, *network)
+	}
+	sort.Sort(byName(networks))
+	return networks
+}
+
+// Lookup gives the network called name
+func (reg *Registry) Lookup(name string) (Network, error) {
+	for _, network := range reg.Networks() {
+		if network.Name == name {
+			return network, nil
+		}
+	}
+	return Network{}, NotFoundError("network " + name)
+}
+
+type byName []Network
+
+func (ns byName) Len() int           { return len(ns) }
+func (ns byName) Swap(i, j int)      { ns[i], ns[j] = ns[j], ns[i] }
+func (ns byName) Less(i, j int) bool { return ns[i].Name < ns[j].Name }
+
+type byContainer []Member
+
+func (ms byContainer) Len() int           { return len(ms) }
+func (ms byContainer) Swap(i, j int)      { ms[i], ms[j] = ms[j], ms[i] }
+func (ms byContainer) Less(i, j int) bool { return ms[i].Container < ms[j].Container }
+
+// Gossip
+
+type gossipData struct {
+	recs []record
+}
+
+func (d *gossipData) Merge(other router.GossipData) {
+	for _, r := range other.(*gossipData).recs {
+		d.recs = mergeRecord(d.recs, r)
+	}
+}
+
+func (d *gossipData) Encode() []byte {
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(d.recs); err != nil {
+		panic(err)
+	}
+	return buf.Bytes()
+}
+
+// Add r to recs, unless recs already has a copy at least as new
+func mergeRecord(recs []record, r record) []record {
+	for i := range recs {
+		if recs[i].sameAs(&r) {
+			if r.newerThan(&recs[i]) {
+				recs[i] = r
+			}
+			return recs
+		}
+	}
+	return append(recs, r)
+}
+
+func (reg *Registry) broadcast(recs []record) {
+	if reg.gossip == nil || len(recs) == 0 {
+		return
+	}
+	reg.gossip.GossipBroadcast(&gossipData{recs})
+}
+
+// Merge records received from another peer, returning those that
+// were new to us
+func (reg *Registry) merge(update []byte) ([]record, error) {
+	var recs []record
+	if err := gob.NewDecoder(bytes.NewReader(update)).Decode(&recs); err != nil {
+		return nil, err
+	}
+	reg.Lock()
+	defer reg.Unlock()
+	var news []record
+	for _, r := range recs {
+		switch i := reg.indexOf(r.Network, r.Container); {
+		case i == -1:
+			reg.recs = append(reg.recs, r)
+			news = append(news, r)
+		case r.newerThan(&reg.recs[i]):
+			reg.recs[i] = r
+			news = append(news, r)
+		}
+	}
+	if len(news) > 0 {
+		Debug.Printf("[networks] Merged %d changes", len(news))
+		news = append(news, reg.removeOverlaps()...)
+	}
+	return news, nil
+}
+
+// Two peers may each create a network at once, of subnets that
+// overlap; as for two changes to one record, that created by the
+// greater peer, or else with the greater name, wins, and every peer
+// deletes the other, so they agree on which is left.
+func (reg *Registry) removeOverlaps() []record {
+	var losers []string
+	for _, a := range reg.recs {
+		if a.Container != "" || !a.isLive() {
+			continue
+		}
+		_, cidrA, err := net.ParseCIDR(a.Subnet)
+		if err != nil {
+			continue
+		}
+		for _, b := range reg.recs {
+			if b.Container != "" || !b.isLive() || b.Network == a.Network {
+				continue
+			}
+			_, cidrB, err := net.ParseCIDR(b.Subnet)
+			if err != nil || !(cidrA.Contains(cidrB.IP) || cidrB.Contains(cidrA.IP)) {
+				continue
+			}
+			if a.Origin < b.Origin || (a.Origin == b.Origin && a.Network < b.Network) {
+				Warning.Printf("[networks] Deleting network %s, whose subnet %s overlaps %s, of network %s", a.Network, a.Subnet, b.Subnet, b.Network)
+				losers = append(losers, a.Network)
+				break
+			}
+		}
+	}
+	var changed []record
+	now := time.Now().Unix()
+	for _, r := range reg.recs {
+		for _, loser := range losers {
+			if r.Network == loser && r.isLive() {
+				r.Tombstone = now
+				changed = append(changed, r)
+			}
+		}
+	}
+	for i, r := range changed {
+		changed[i] = reg.set(r)
+	}
+	return changed
+}
+
+func (reg *Registry) OnGossipUnicast(sender router.PeerName, msg []byte) error {
+	return nil
+}
+
+func (reg *Registry) OnGossipBroadcast(update []byte) (router.GossipData, error) {
+	news, err := reg.merge(update)
+	if err != nil || len(news) == 0 {
+		return nil, err
+	}
+	return &gossipData{news}, nil
+}
+
+func (reg *Registry) Gossip() router.GossipData {
+	reg.RLock()
+	defer reg.RUnlock()
+	if len(reg.recs) == 0 {
+		return nil
+	}
+	recs := make([]record, len(reg.recs))
+	copy(recs, reg.recs)
+	return &gossipData{recs}
+}
+
+func (reg *Registry) OnGossip(update []byte) (router.GossipData, error) {
+	return reg.OnGossipBroadcast(update)
+}
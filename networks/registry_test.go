@@ -0,0 +1,171 @@
+package networks
+
+import (
+	"testing"
+	"time"
+
+	"github.com/weaveworks/weave/router"
+	wt "github.com/weaveworks/weave/testing"
+)
+
+func newTestRegistry(t *testing.T, name string) *Registry {
+	peerName, err := router.PeerNameFromString(name)
+	wt.AssertNoErr(t, err)
+	reg := NewRegistry()
+	reg.SetInterfaces(peerName, nil)
+	return reg
+}
+
+// Send everything reg1 knows to reg2
+func gossipTo(t *testing.T, reg1, reg2 *Registry) {
+	if data := reg1.Gossip(); data != nil {
+		_, err := reg2.OnGossip(data.Encode())
+		wt.AssertNoErr(t, err)
+	}
+}
+
+func TestNetworks(t *testing.T) {
+	reg := newTestRegistry(t, "01:00:00:01:00:00")
+
+	_, err := reg.Create("a/b", "10.2.0.0/16")
+	wt.AssertTrue(t, err != nil, "error for an invalid name")
+	_, err = reg.Create("blue", "10.2.0.0/33")
+	wt.AssertTrue(t, err != nil, "error for an invalid subnet")
+	network, err := reg.Create("blue", "10.2.3.4/16")
+	wt.AssertNoErr(t, err)
+	wt.AssertEqualString(t, network.Subnet, "10.2.0.0/16", "subnet")
+	_, err = reg.Create("blue", "10.3.0.0/16")
+	wt.AssertErrorType(t, err, (*ConflictError)(nil), "creating an existing network")
+	_, err = reg.Create("red", "10.2.128.0/17")
+	wt.AssertErrorType(t, err, (*ConflictError)(nil), "creating an overlapping network")
+	_, err = reg.Create("red", "10.3.0.0/16")
+	wt.AssertNoErr(t, err)
+
+	wt.AssertErrorType(t, reg.Join("green", "c1"), (*NotFoundError)(nil), "joining a missing network")
+	wt.AssertNoErr(t, reg.Join("blue", "c2"))
+	wt.AssertNoErr(t, reg.Join("blue", "c1"))
+	wt.AssertNoErr(t, reg.Join("red", "c1"))
+	network, err = reg.Lookup("blue")
+	wt.AssertNoErr(t, err)
+	wt.AssertEquals(t, network.Members, []Member{{"c1", "01:00:00:01:00:00"}, {"c2", "01:00:00:01:00:00"}})
+
+	wt.AssertNoErr(t, reg.Leave("blue", "c2"))
+	wt.AssertErrorType(t, reg.Leave("blue", "c2"), (*NotFoundError)(nil), "leaving twice")
+	wt.AssertNoErr(t, reg.ContainerDestroyed("c1"))
+	networks := reg.Networks()
+	wt.AssertEqualInt(t, len(networks), 2, "networks")
+	wt.AssertEqualString(t, networks[0].Name, "blue", "order")
+	wt.AssertEqualInt(t, len(networks[0].Members)+len(networks[1].Members), 0, "members once destroyed")
+
+	wt.AssertNoErr(t, reg.Delete("red"))
+	wt.AssertErrorType(t, reg.Delete("red"), (*NotFoundError)(nil), "deleting twice")
+	_, err = reg.Lookup("red")
+	wt.AssertErrorType(t, err, (*NotFoundError)(nil), "looking up a deleted network")
+	_, err = reg.Create("red", "10.3.0.0/16")
+	wt.AssertNoErr(t, err)
+}
+
+func TestNetworksGossip(t *testing.T) {
+	reg1 := newTestRegistry(t, "01:00:00:01:00:00")
+	reg2 := newTestRegistry(t, "02:00:00:02:00:00")
+
+	_, err := reg1.Create("blue", "10.2.0.0/16")
+	wt.AssertNoErr(t, err)
+	wt.AssertNoErr(t, reg1.Join("blue", "c1"))
+	gossipTo(t, reg1, reg2)
+	network, err := reg2.Lookup("blue")
+	wt.AssertNoErr(t, err)
+	wt.AssertEquals(t, network.Members, []Member{{"c1", "01:00:00:01:00:00"}})
+
+	// Nothing new the second time around
+	data, err := reg2.OnGossip(reg1.Gossip().Encode())
+	wt.AssertNoErr(t, err)
+	wt.AssertTrue(t, data == nil, "no news")
+
+	// Any peer can change anything; deletions propagate as
+	// tombstones, which a stale copy can't override
+	stale := reg1.Gossip().Encode()
+	wt.AssertNoErr(t, reg2.Join("blue", "c2"))
+	wt.AssertNoErr(t, reg2.Leave("blue", "c1"))
+	gossipTo(t, reg2, reg1)
+	_, err = reg1.OnGossip(stale)
+	wt.AssertNoErr(t, err)
+	network, err = reg1.Lookup("blue")
+	wt.AssertNoErr(t, err)
+	wt.AssertEquals(t, network.Members, []Member{{"c2", "02:00:00:02:00:00"}})
+
+	// Of two changes at once, the greater peer's wins
+	wt.AssertNoErr(t, reg1.Delete("blue"))
+	_, err = reg2.Create("green", "10.4.0.0/16")
+	wt.AssertNoErr(t, err)
+	wt.AssertNoErr(t, reg2.Delete("blue"))
+	_, err = reg2.Create("blue", "10.5.0.0/16")
+	wt.AssertNoErr(t, err)
+	_, err = reg1.Create("blue", "10.6.0.0/16")
+	wt.AssertNoErr(t, err)
+	gossipTo(t, reg1, reg2)
+	gossipTo(t, reg2, reg1)
+	wt.AssertEquals(t, reg1.Networks(), reg2.Networks())
+	network, err = reg1.Lookup("blue")
+	wt.AssertNoErr(t, err)
+	wt.AssertEqualString(t, network.Subnet, "10.5.0.0/16", "subnet of the winning network")
+
+	reg1.removeTombstones(time.Now().Add(time.Minute))
+	wt.AssertEqualInt(t, len(reg1.Networks()), 2, "networks after removing tombstones")
+}
+
+func TestNetworksJoinRunning(t *testing.T) {
+	reg1 := newTestRegistry(t, "01:00:00:01:00:00")
+	reg2 := newTestRegistry(t, "02:00:00:02:00:00")
+	reg1.SetRunning(func() ([]string, error) { return []string{"c1abc", "c1def", "c2abc"}, nil })
+	_, err := reg1.Create("blue", "10.2.0.0/16")
+	wt.AssertNoErr(t, err)
+
+	wt.AssertErrorType(t, reg1.Join("blue", "c3"), (*NotFoundError)(nil), "joining a container not running here")
+	wt.AssertTrue(t, reg1.Join("blue", "c1") != nil, "error for an ambiguous container")
+	wt.AssertNoErr(t, reg1.Join("blue", "c2"))
+	wt.AssertNoErr(t, reg1.Join("blue", "c1abc"))
+	network, err := reg1.Lookup("blue")
+	wt.AssertNoErr(t, err)
+	wt.AssertEquals(t, network.Members, []Member{{"c1abc", "01:00:00:01:00:00"}, {"c2abc", "01:00:00:01:00:00"}})
+
+	// Only the peer a container was joined on removes it, even once
+	// another has changed its membership
+	gossipTo(t, reg1, reg2)
+	wt.AssertNoErr(t, reg2.Leave("blue", "c1abc"))
+	gossipTo(t, reg2, reg1)
+	wt.AssertNoErr(t, reg1.Join("blue", "c1abc"))
+	gossipTo(t, reg1, reg2)
+	wt.AssertNoErr(t, reg2.ContainerDestroyed("c1abc"))
+	network, err = reg2.Lookup("blue")
+	wt.AssertNoErr(t, err)
+	wt.AssertEqualInt(t, len(network.Members), 2, "members once destroyed on another peer")
+	wt.AssertNoErr(t, reg1.ContainerDestroyed("c1abc"))
+	gossipTo(t, reg1, reg2)
+	network, err = reg2.Lookup("blue")
+	wt.AssertNoErr(t, err)
+	wt.AssertEquals(t, network.Members, []Member{{"c2abc", "01:00:00:01:00:00"}})
+}
+
+func TestNetworksOverlap(t *testing.T) {
+	reg1 := newTestRegistry(t, "01:00:00:01:00:00")
+	reg2 := newTestRegistry(t, "02:00:00:02:00:00")
+
+	// Created at once, so neither peer knows of the other's
+	_, err := reg1.Create("blue", "10.2.0.0/16")
+	wt.AssertNoErr(t, err)
+	wt.AssertNoErr(t, reg1.Join("blue", "c1"))
+	_, err = reg2.Create("red", "10.2.128.0/17")
+	wt.AssertNoErr(t, err)
+	gossipTo(t, reg1, reg2)
+	gossipTo(t, reg2, reg1)
+	wt.AssertEquals(t, reg1.Networks(), reg2.Networks())
+	networks := reg1.Networks()
+	wt.AssertEqualInt(t, len(networks), 1, "networks once overlaps are removed")
+	wt.AssertEqualString(t, networks[0].Name, "red", "the greater peer's network")
+	_, err = reg1.Create("blue", "10.3.0.0/16")
+	wt.AssertNoErr(t, err)
+	network, err := reg1.Lookup("blue")
+	wt.AssertNoErr(t, err)
+	wt.AssertEqualInt(t, len(network.Members), 0, "members of the deleted network")
+}
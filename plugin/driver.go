@@ -0,0 +1,210 @@
+package plugin
+
+import (
+	"fmt"
+	"net"
+
+	. "github.com/weaveworks/weave/common"
+	"github.com/weaveworks/weave/common/events"
+	weavenet "github.com/weaveworks/weave/net"
+)
+
+const (
+	containerIfPrefix = "ethwe" // Docker adds a number
+	multicastRoute    = "224.0.0.0/4"
+	routeConnected    = 1 // libnetwork's route type for a directly connected destination
+)
+
+type capabilitiesResponse struct {
+	Scope string
+}
+
+// The networks are "local" as far as Docker is concerned - it needn't
+// coordinate them between hosts, since weave does that - so a network
+// should be created with the same name on each host.
+func (p *Plugin) getCapabilities(body []byte) (interface{}, error) {
+	return &capabilitiesResponse{Scope: "local"}, nil
+}
+
+type ipamData struct {
+	AddressSpace string
+	Pool         string
+	Gateway      string
+	AuxAddresses map[string]string
+}
+
+type createNetworkRequest struct {
+	NetworkID string
+	Options   map[string]interface{}
+	IPv4Data  []ipamData
+	IPv6Data  []ipamData
+}
+
+type networkRequest struct {
+	NetworkID string
+}
+
+func (p *Plugin) createNetwork(body []byte) (interface{}, error) {
+	var req createNetworkRequest
+	if err := decode(body, &req); err != nil {
+		return nil, err
+	}
+	if len(req.IPv6Data) > 0 {
+		return nil, fmt.Errorf("IPv6 is not supported")
+	}
+	Info.Printf("[plugin] Create network %.12s", req.NetworkID)
+	return struct{}{}, nil
+}
+
+func (p *Plugin) deleteNetwork(body []byte) (interface{}, error) {
+	var req networkRequest
+	if err := decode(body, &req); err != nil {
+		return nil, err
+	}
+	Info.Printf("[plugin] Delete network %.12s", req.NetworkID)
+	return struct{}{}, nil
+}
+
+type endpointInterface struct {
+	Address     string
+	AddressIPv6 string
+	MacAddress  string
+}
+
+type createEndpointRequest struct {
+	NetworkID  string
+	EndpointID string
+	Interface  *endpointInterface
+	Options    map[string]interface{}
+}
+
+type endpointRequest struct {
+	NetworkID  string
+	EndpointID string
+}
+
+// Docker has already chosen the address, from its IPAM driver, so
+// there is nothing for us to fill in; we only check that nothing on
+// the weave network has it already.
+func (p *Plugin) createEndpoint(body []byte) (interface{}, error) {
+	var req createEndpointRequest
+	if err := decode(body, &req); err != nil {
+		return nil, err
+	}
+	if req.Interface == nil || req.Interface.Address == "" {
+		return nil, fmt.Errorf("Endpoint %.12s has no address", req.EndpointID)
+	}
+	ip, cidr, err := net.ParseCIDR(req.Interface.Address)
+	if err != nil {
+		return nil, fmt.Errorf("Endpoint %.12s has invalid address %s: %s", req.EndpointID, req.Interface.Address, err)
+	}
+	err = weavenet.WithNetNSPath(p.netNSPath, func() error {
+		return weavenet.ProbeAddresses(p.bridge, []*net.IPNet{{IP: ip, Mask: cidr.Mask}}, p.probeWait)
+	})
+	if inUse, ok := err.(*weavenet.AddressInUseError); ok {
+		events.Publish(events.AddressConflict, map[string]string{"ident": "weave:plugin:" + req.EndpointID, "address": inUse.IP.String(), "mac": inUse.MAC.String()})
+	}
+	if err != nil {
+		return nil, err
+	}
+	Debug.Printf("[plugin] Create endpoint %.12s with address %s", req.EndpointID, req.Interface.Address)
+	return struct{}{}, nil
+}
+
+func (p *Plugin) deleteEndpoint(body []byte) (interface{}, error) {
+	var req endpointRequest
+	if err := decode(body, &req); err != nil {
+		return nil, err
+	}
+	Debug.Printf("[plugin] Delete endpoint %.12s", req.EndpointID)
+	return struct{}{}, nil
+}
+
+type endpointInfoResponse struct {
+	Value map[string]interface{}
+}
+
+func (p *Plugin) endpointInfo(body []byte) (interface{}, error) {
+	return &endpointInfoResponse{Value: map[string]interface{}{}}, nil
+}
+
+type joinRequest struct {
+	NetworkID  string
+	EndpointID string
+	SandboxKey string
+	Options    map[string]interface{}
+}
+
+type interfaceName struct {
+	SrcName   string
+	DstPrefix string
+}
+
+type staticRoute struct {
+	Destination string
+	RouteType   int
+	NextHop     string `json:",omitempty"`
+}
+
+type joinResponse struct {
+	InterfaceName interfaceName
+	StaticRoutes  []staticRoute
+}
+
+// The names of the two ends of the veth pair for an endpoint, in the
+// style of those 'weave attach' makes
+func vethNames(endpointID string) (local, guest string) {
+	suffix := endpointID
+	if len(suffix) > 7 {
+		suffix = suffix[:7]
+	}
+	return "vethwepl" + suffix, "vethwepg" + suffix
+}
+
+// We create a veth pair with one end on the bridge, and Docker moves
+// the other into the container and names it.
+func (p *Plugin) join(body []byte) (interface{}, error) {
+	var req joinRequest
+	if err := decode(body, &req); err != nil {
+		return nil, err
+	}
+	local, guest := vethNames(req.EndpointID)
+	err := weavenet.WithNetNSPath(p.netNSPath, func() error {
+		_, err := weavenet.CreateAndAttachVeth(local, guest, p.bridge, 0)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	Info.Printf("[plugin] Attached endpoint %.12s to %s", req.EndpointID, p.bridge)
+	return &joinResponse{
+		InterfaceName: interfaceName{SrcName: guest, DstPrefix: containerIfPrefix},
+		// Route multicast packets across the weave network, as
+		// 'weave attach' does
+		StaticRoutes: []staticRoute{{Destination: multicastRoute, RouteType: routeConnected}},
+	}, nil
+}
+
+func (p *Plugin) leave(body []byte) (interface{}, error) {
+	var req endpointRequest
+	if err := decode(body, &req); err != nil {
+		return nil, err
+	}
+	local, _ := vethNames(req.EndpointID)
+	err := weavenet.WithNetNSPath(p.netNSPath, func() error {
+		return weavenet.DeleteLink(local)
+	})
+	if err != nil {
+		// It goes when the container's namespace does, so this is
+		// no great loss
+		Warning.Printf("[plugin] Unable to remove interface for endpoint %.12s: %s", req.EndpointID, err)
+	}
+	Info.Printf("[plugin] Detached endpoint %.12s", req.EndpointID)
+	return struct{}{}, nil
+}
+
+// We have no use for Docker's discovery notifications: weave finds
+// out about peers for itself.
+func (p *Plugin) discover(body []byte) (interface{}, error) {
+	return struct{}{}, nil
+}
@@ -0,0 +1,149 @@
+package plugin
+
+import (
+	"fmt"
+	"net"
+
+	. "github.com/weaveworks/weave/common"
+	"github.com/weaveworks/weave/ipam/address"
+	"github.com/weaveworks/weave/router"
+)
+
+const (
+	localAddressSpace  = "weavelocal"
+	globalAddressSpace = "weaveglobal"
+)
+
+type ipamCapabilitiesResponse struct {
+	RequiresMACAddress bool
+}
+
+func (p *Plugin) getIPAMCapabilities(body []byte) (interface{}, error) {
+	return &ipamCapabilitiesResponse{}, nil
+}
+
+type addressSpacesResponse struct {
+	LocalDefaultAddressSpace  string
+	GlobalDefaultAddressSpace string
+}
+
+func (p *Plugin) getDefaultAddressSpaces(body []byte) (interface{}, error) {
+	return &addressSpacesResponse{localAddressSpace, globalAddressSpace}, nil
+}
+
+type requestPoolRequest struct {
+	AddressSpace string
+	Pool         string
+	SubPool      string
+	Options      map[string]string
+	V6           bool
+}
+
+type requestPoolResponse struct {
+	PoolID string
+	Pool   string
+	Data   map[string]string
+}
+
+type poolRequest struct {
+	PoolID string
+}
+
+// The allocator's range, waiting, if it was picked automatically, for
+// the peers to agree on it, since Docker holds on to the pool
+func (p *Plugin) settledSubnet() *net.IPNet {
+	if _, from := p.alloc.Range(); from != router.UnknownPeerName {
+		<-p.alloc.Ready()
+	}
+	subnet, _ := p.alloc.Range()
+	return subnet
+}
+
+// There is just the one pool: the whole range the allocator
+// allocates in
+func (p *Plugin) requestPool(body []byte) (interface{}, error) {
+	var req requestPoolRequest
+	if err := decode(body, &req); err != nil {
+		return nil, err
+	}
+	pool := p.settledSubnet().String()
+	switch {
+	case req.V6:
+		return nil, fmt.Errorf("IPv6 is not supported")
+	case req.Pool != "" && req.Pool != pool:
+		return nil, fmt.Errorf("Unable to allocate from %s; weave allocates from %s", req.Pool, pool)
+	case req.SubPool != "" && req.SubPool != pool:
+		return nil, fmt.Errorf("Unable to allocate from %s; weave allocates from the whole of %s", req.SubPool, pool)
+	}
+	return &requestPoolResponse{PoolID: pool, Pool: pool, Data: map[string]string{}}, nil
+}
+
+func (p *Plugin) releasePool(body []byte) (interface{}, error) {
+	return struct{}{}, nil
+}
+
+type requestAddressRequest struct {
+	PoolID  string
+	Address string
+	Options map[string]string
+}
+
+type requestAddressResponse struct {
+	Address string
+	Data    map[string]string
+}
+
+type releaseAddressRequest struct {
+	PoolID  string
+	Address string
+}
+
+func (p *Plugin) requestAddress(body []byte) (interface{}, error) {
+	var req requestAddressRequest
+	if err := decode(body, &req); err != nil {
+		return nil, err
+	}
+	ident := newIdent()
+	var addr address.Address
+	if req.Address != "" {
+		var err error
+		if addr, err = p.parseAddress(req.Address); err != nil {
+			return nil, err
+		}
+		if err := p.alloc.Claim(ident, addr, nil); err != nil {
+			return nil, err
+		}
+	} else {
+		var err error
+		if addr, err = p.alloc.Allocate(ident, nil); err != nil {
+			return nil, err
+		}
+	}
+	subnet, _ := p.alloc.Range()
+	ones, _ := subnet.Mask.Size()
+	Debug.Printf("[plugin] Allocated %s as %s", addr, ident)
+	return &requestAddressResponse{Address: fmt.Sprintf("%s/%d", addr, ones), Data: map[string]string{}}, nil
+}
+
+func (p *Plugin) releaseAddress(body []byte) (interface{}, error) {
+	var req releaseAddressRequest
+	if err := decode(body, &req); err != nil {
+		return nil, err
+	}
+	addr, err := p.parseAddress(req.Address)
+	if err != nil {
+		return nil, err
+	}
+	return struct{}{}, p.alloc.FreeAddress(addr)
+}
+
+func (p *Plugin) parseAddress(s string) (address.Address, error) {
+	ip := net.ParseIP(s)
+	if ip == nil || ip.To4() == nil {
+		return 0, fmt.Errorf("Invalid address %q", s)
+	}
+	if subnet, _ := p.alloc.Range(); !subnet.Contains(ip) {
+		return 0, fmt.Errorf("Address %s is not in %s", ip, subnet)
+	}
+	return address.FromIP4(ip), nil
+}
@@ -0,0 +1,142 @@
+package plugin
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	. "github.com/weaveworks/weave/common"
+	"github.com/weaveworks/weave/ipam"
+)
+
+const (
+	DefaultSocket = "/run/docker/plugins/weave.sock" // where Docker looks for a plugin called "weave"
+	DefaultBridge = "weave"
+	contentType   = "application/vnd.docker.plugins.v1+json"
+)
+
+// Plugin implements Docker's remote network driver API, so that
+// containers on a network created with "docker network create -d
+// weave" are attached to the weave bridge by Docker itself. Given an
+// allocator it implements the remote IPAM driver API too, so that
+// they can get their addresses from it with "--ipam-driver weave".
+type Plugin struct {
+	bridge    string
+	netNSPath string // of the network namespace the bridge is in
+	alloc     *ipam.Allocator
+	probeWait time.Duration // for duplicate address detection
+}
+
+// NewPlugin creates a plugin attaching containers to bridge, which
+// is in the network namespace at netNSPath (our own if blank), and
+// handing out addresses from alloc if that is not nil.
+func NewPlugin(bridge, netNSPath string, alloc *ipam.Allocator) *Plugin {
+	return &Plugin{bridge: bridge, netNSPath: netNSPath, alloc: alloc}
+}
+
+// SetProbeWait has us probe for each endpoint's address with ARP, for
+// wait, before creating the endpoint, and refuse to if anything
+// answers; we don't probe if wait is 0
+func (p *Plugin) SetProbeWait(wait time.Duration) {
+	p.probeWait = wait
+}
+
+// Listen serves the plugin API on a unix socket at socketPath
+func (p *Plugin) Listen(socketPath string) error {
+	os.Remove(socketPath) // in case it's there from last time
+	l, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return err
+	}
+	Info.Printf("[plugin] Listening on %s", socketPath)
+	return http.Serve(l, p)
+}
+
+type handlerFunc func(p *Plugin, body []byte) (interface{}, error)
+
+var handlers = map[string]handlerFunc{
+	"/Plugin.Activate": (*Plugin).activate,
+
+	"/NetworkDriver.GetCapabilities":  (*Plugin).getCapabilities,
+	"/NetworkDriver.CreateNetwork":    (*Plugin).createNetwork,
+	"/NetworkDriver.DeleteNetwork":    (*Plugin).deleteNetwork,
+	"/NetworkDriver.CreateEndpoint":   (*Plugin).createEndpoint,
+	"/NetworkDriver.DeleteEndpoint":   (*Plugin).deleteEndpoint,
+	"/NetworkDriver.EndpointOperInfo": (*Plugin).endpointInfo,
+	"/NetworkDriver.Join":             (*Plugin).join,
+	"/NetworkDriver.Leave":            (*Plugin).leave,
+	"/NetworkDriver.DiscoverNew":      (*Plugin).discover,
+	"/NetworkDriver.DiscoverDelete":   (*Plugin).discover,
+
+	"/IpamDriver.GetCapabilities":         (*Plugin).getIPAMCapabilities,
+	"/IpamDriver.GetDefaultAddressSpaces": (*Plugin).getDefaultAddressSpaces,
+	"/IpamDriver.RequestPool":             (*Plugin).requestPool,
+	"/IpamDriver.ReleasePool":             (*Plugin).releasePool,
+	"/IpamDriver.RequestAddress":          (*Plugin).requestAddress,
+	"/IpamDriver.ReleaseAddress":          (*Plugin).releaseAddress,
+}
+
+type errorResponse struct {
+	Err string
+}
+
+func (p *Plugin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", contentType)
+	handler, found := handlers[r.URL.Path]
+	if !found || r.Method != "POST" || (p.alloc == nil && strings.HasPrefix(r.URL.Path, "/IpamDriver.")) {
+		http.NotFound(w, r)
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	Debug.Printf("[plugin] %s %s", r.URL.Path, body)
+	res, err := handler(p, body)
+	if err != nil {
+		Warning.Printf("[plugin] %s: %s", r.URL.Path, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		res = &errorResponse{Err: err.Error()}
+	}
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		Warning.Printf("[plugin] Unable to send response to %s: %s", r.URL.Path, err)
+	}
+}
+
+func decode(body []byte, req interface{}) error {
+	if err := json.Unmarshal(body, req); err != nil {
+		return fmt.Errorf("Unable to decode request: %s", err)
+	}
+	return nil
+}
+
+type activateResponse struct {
+	Implements []string
+}
+
+func (p *Plugin) activate(body []byte) (interface{}, error) {
+	res := &activateResponse{Implements: []string{"NetworkDriver"}}
+	if p.alloc != nil {
+		res.Implements = append(res.Implements, "IpamDriver")
+	}
+	return res, nil
+}
+
+// Allocations made for Docker aren't for anything we can name, so
+// each gets an ident of its own, much as 'weave expose' has
+// "weave:expose".
+func newIdent() string {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+	return "weave:plugin:" + hex.EncodeToString(buf)
+}
@@ -0,0 +1,94 @@
+package plugin
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/weaveworks/weave/ipam"
+	"github.com/weaveworks/weave/router"
+	wt "github.com/weaveworks/weave/testing"
+)
+
+const testRange = "10.2.3.0/29"
+
+type nullGossip struct{}
+
+func (nullGossip) GossipUnicast(dstPeerName router.PeerName, msg []byte) error { return nil }
+func (nullGossip) GossipBroadcast(update router.GossipData) error              { return nil }
+
+func makeAllocator(t *testing.T) *ipam.Allocator {
+	peerName, err := router.PeerNameFromString("01:00:00:01:00:00")
+	wt.AssertNoErr(t, err)
+	alloc, err := ipam.NewAllocator(peerName, 1, "nick", testRange, 1)
+	wt.AssertNoErr(t, err)
+	alloc.SetInterfaces(nullGossip{})
+	alloc.Start()
+	return alloc
+}
+
+// Make a call to the plugin, decoding the response into res
+func call(t *testing.T, p *Plugin, method string, req interface{}, res interface{}) int {
+	body, err := json.Marshal(req)
+	wt.AssertNoErr(t, err)
+	httpReq, err := http.NewRequest("POST", "/"+method, bytes.NewReader(body))
+	wt.AssertNoErr(t, err)
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, httpReq)
+	if res != nil && rec.Code != http.StatusNotFound {
+		wt.AssertNoErr(t, json.Unmarshal(rec.Body.Bytes(), res))
+	}
+	return rec.Code
+}
+
+func TestActivate(t *testing.T) {
+	var res activateResponse
+	p := NewPlugin(DefaultBridge, "", nil)
+	wt.AssertStatus(t, call(t, p, "Plugin.Activate", struct{}{}, &res), http.StatusOK, "activate")
+	wt.AssertEquals(t, res.Implements, []string{"NetworkDriver"})
+	wt.AssertStatus(t, call(t, p, "IpamDriver.RequestPool", &requestPoolRequest{}, nil), http.StatusNotFound, "IPAM without allocator")
+
+	alloc := makeAllocator(t)
+	defer alloc.Stop()
+	p = NewPlugin(DefaultBridge, "", alloc)
+	wt.AssertStatus(t, call(t, p, "Plugin.Activate", struct{}{}, &res), http.StatusOK, "activate")
+	wt.AssertEquals(t, res.Implements, []string{"NetworkDriver", "IpamDriver"})
+
+	var caps capabilitiesResponse
+	wt.AssertStatus(t, call(t, p, "NetworkDriver.GetCapabilities", struct{}{}, &caps), http.StatusOK, "capabilities")
+	wt.AssertEqualString(t, caps.Scope, "local", "scope")
+}
+
+func TestIPAM(t *testing.T) {
+	alloc := makeAllocator(t)
+	defer alloc.Stop()
+	p := NewPlugin(DefaultBridge, "", alloc)
+
+	var pool requestPoolResponse
+	wt.AssertStatus(t, call(t, p, "IpamDriver.RequestPool", &requestPoolRequest{}, &pool), http.StatusOK, "request pool")
+	wt.AssertEqualString(t, pool.Pool, testRange, "pool")
+	var errRes errorResponse
+	wt.AssertStatus(t, call(t, p, "IpamDriver.RequestPool", &requestPoolRequest{Pool: "10.9.0.0/16"}, &errRes), http.StatusInternalServerError, "request other pool")
+	wt.AssertTrue(t, errRes.Err != "", "error message")
+
+	var addr1, addr2 requestAddressResponse
+	wt.AssertStatus(t, call(t, p, "IpamDriver.RequestAddress", &requestAddressRequest{PoolID: pool.PoolID}, &addr1), http.StatusOK, "request address")
+	wt.AssertEqualString(t, addr1.Address, "10.2.3.1/29", "address")
+	wt.AssertStatus(t, call(t, p, "IpamDriver.RequestAddress", &requestAddressRequest{PoolID: pool.PoolID, Address: "10.2.3.5"}, &addr2), http.StatusOK, "request specific address")
+	wt.AssertEqualString(t, addr2.Address, "10.2.3.5/29", "specific address")
+	wt.AssertStatus(t, call(t, p, "IpamDriver.RequestAddress", &requestAddressRequest{PoolID: pool.PoolID, Address: "10.9.0.1"}, &errRes), http.StatusInternalServerError, "request address outside pool")
+
+	// Released addresses can be handed out again
+	wt.AssertStatus(t, call(t, p, "IpamDriver.ReleaseAddress", &releaseAddressRequest{PoolID: pool.PoolID, Address: "10.2.3.1"}, nil), http.StatusOK, "release address")
+	wt.AssertStatus(t, call(t, p, "IpamDriver.ReleaseAddress", &releaseAddressRequest{PoolID: pool.PoolID, Address: "10.2.3.1"}, nil), http.StatusInternalServerError, "release unallocated address")
+	wt.AssertStatus(t, call(t, p, "IpamDriver.RequestAddress", &requestAddressRequest{PoolID: pool.PoolID}, &addr1), http.StatusOK, "request address")
+	wt.AssertEqualString(t, addr1.Address, "10.2.3.1/29", "reused address")
+}
+
+func TestVethNames(t *testing.T) {
+	local, guest := vethNames("8e5b4c6d7e8f9a0b1c2d")
+	wt.AssertEqualString(t, local, "vethwepl8e5b4c6", "local name")
+	wt.AssertEqualString(t, guest, "vethwepg8e5b4c6", "guest name")
+}
@@ -0,0 +1,190 @@
+package proxy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+	. "github.com/weaveworks/weave/common"
+	weavenet "github.com/weaveworks/weave/net"
+)
+
+const (
+	weaveContainerName    = "weave"
+	weaveDNSContainerName = "weavedns"
+	weaveHTTPPort         = 6784
+	weaveDNSHTTPPort      = 6785
+	bridgeName            = "weave"
+	containerIfName       = "ethwe"
+	httpTimeout           = 30 * time.Second
+)
+
+// attachContainer attaches a running container to the weave network
+// with the addresses in cidrs, or one from the router's allocator if
+// there are none, and tells weaveDNS about it, as 'weave attach'
+// does, but without calling out to the script.
+func attachContainer(client *docker.Client, container *docker.Container, cidrs []string) (err error) {
+	if len(cidrs) == 0 {
+		cidr, err := allocateAddress(client, container.ID)
+		if err != nil {
+			return err
+		}
+		cidrs = []string{cidr}
+		// otherwise the address would be held until the container
+		// is destroyed
+		defer func() {
+			if err != nil {
+				releaseAddress(client, container.ID)
+			}
+		}()
+	}
+	addrs, err := parseCIDRs(cidrs)
+	if err != nil {
+		return err
+	}
+
+	nsPath := weavenet.NetNSPath(procPath(), container.State.Pid)
+	local, guest := weavenet.ContainerVethNames(containerIfName, container.State.Pid)
+	if err := weavenet.AttachContainer("", nsPath, bridgeName, local, guest, containerIfName, nil, addrs); err != nil {
+		return err
+	}
+
+	registerDNS(client, container, addrs)
+	return nil
+}
+
+// We run with the host's /proc mounted somewhere of our own, and
+// told where in PROCFS, so that we can find containers' namespaces
+func procPath() string {
+	if procfs := os.Getenv("PROCFS"); procfs != "" {
+		return procfs
+	}
+	return "/proc"
+}
+
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	addrs := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		ip, subnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid CIDR %q: %s", cidr, err)
+		}
+		addrs = append(addrs, &net.IPNet{IP: ip, Mask: subnet.Mask})
+	}
+	return addrs, nil
+}
+
+func allocateAddress(client *docker.Client, containerID string) (string, error) {
+	routerURL, err := containerURL(client, weaveContainerName, weaveHTTPPort)
+	if err != nil {
+		return "", err
+	}
+	cidr, err := httpCall("POST", routerURL+"/ip/"+containerID, nil)
+	if err != nil {
+		if statusErr, ok := err.(*httpStatusError); ok && statusErr.code == http.StatusNotFound {
+			return "", fmt.Errorf("No IP address supplied (use the -iprange option on 'weave launch' to enable IP address allocation)")
+		}
+		return "", fmt.Errorf("Unable to allocate address: %s", err)
+	}
+	return strings.TrimSpace(cidr), nil
+}
+
+func releaseAddress(client *docker.Client, containerID string) {
+	routerURL, err := containerURL(client, weaveContainerName, weaveHTTPPort)
+	if err == nil {
+		_, err = httpCall("DELETE", routerURL+"/ip/"+containerID, nil)
+	}
+	if err != nil {
+		Warning.Printf("Unable to release the address allocated to container %s: %s", containerID, err)
+	}
+}
+
+// registerDNS tells whichever of weaveDNS and the router is holding
+// the local DNS database about the container's addresses, under the
+// name made from its hostname and domain. Containers without a domain
+// have no such name. It's not an error for there to be neither
+// weaveDNS nor the router.
+func registerDNS(client *docker.Client, container *docker.Container, addrs []*net.IPNet) {
+	domain := strings.TrimSuffix(container.Config.Domainname, ".")
+	if container.Config.Hostname == "" || domain == "" {
+		return
+	}
+	dnsURL, found := dnsTargetURL(client)
+	if !found {
+		return
+	}
+	fqdn := url.Values{"fqdn": {container.Config.Hostname + "." + domain + "."}}
+	for _, addr := range addrs {
+		if _, err := httpCall("PUT", dnsURL+"/name/"+container.ID+"/"+addr.IP.String(), fqdn); err != nil {
+			Warning.Printf("Unable to register %s in DNS for container %s: %s", addr.IP, container.ID, err)
+		}
+	}
+}
+
+// The URL of the weaveDNS container if that is running, otherwise of
+// the router if it was launched with -dns
+func dnsTargetURL(client *docker.Client) (string, bool) {
+	if dnsURL, err := containerURL(client, weaveDNSContainerName, weaveDNSHTTPPort); err == nil {
+		return dnsURL, true
+	}
+	router, err := client.InspectContainer(weaveContainerName)
+	if err != nil || !router.State.Running {
+		return "", false
+	}
+	for _, arg := range router.Args {
+		if arg == "-dns" {
+			return fmt.Sprintf("http://%s:%d", router.NetworkSettings.IPAddress, weaveHTTPPort), true
+		}
+	}
+	return "", false
+}
+
+func containerURL(client *docker.Client, name string, port int) (string, error) {
+	container, err := client.InspectContainer(name)
+	if err != nil {
+		return "", fmt.Errorf("%s container is not present. Have you launched it?", name)
+	}
+	if !container.State.Running {
+		return "", fmt.Errorf("%s container is not running.", name)
+	}
+	return fmt.Sprintf("http://%s:%d", container.NetworkSettings.IPAddress, port), nil
+}
+
+type httpStatusError struct {
+	code int
+	msg  string
+}
+
+func (err *httpStatusError) Error() string {
+	return fmt.Sprintf("%d %s: %s", err.code, http.StatusText(err.code), err.msg)
+}
+
+func httpCall(method, target string, data url.Values) (string, error) {
+	req, err := http.NewRequest(method, target, strings.NewReader(data.Encode()))
+	if err != nil {
+		return "", err
+	}
+	if data != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	client := &http.Client{Timeout: httpTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode >= 300 {
+		return "", &httpStatusError{resp.StatusCode, strings.TrimSpace(string(body))}
+	}
+	return string(body), nil
+}
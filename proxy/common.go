@@ -11,6 +11,7 @@ import (
 	"strings"
 
 	"github.com/fsouza/go-dockerclient"
+	"github.com/weaveworks/weave/attach"
 	. "github.com/weaveworks/weave/common"
 )
 
@@ -37,6 +38,25 @@ func weaveCIDRsFromConfig(config *docker.Config) ([]string, bool) {
 	return nil, false
 }
 
+// weaveCIDRs says whether a container with config and hostConfig
+// should be attached to the weave network, and with which addresses:
+// those in its WEAVE_CIDR, or, with none, one from the allocator.
+// Containers without a WEAVE_CIDR are attached as policy says, if we
+// have one, or with withIPAM; containers sharing the host's or
+// another container's network never are.
+func weaveCIDRs(config *docker.Config, hostConfig *docker.HostConfig, withIPAM bool, policy *attach.Policy) ([]string, bool) {
+	if hostConfig != nil && (hostConfig.NetworkMode == "host" || strings.HasPrefix(hostConfig.NetworkMode, "container:")) {
+		return nil, false
+	}
+	if cidrs, ok := weaveCIDRsFromConfig(config); ok {
+		return cidrs, true
+	}
+	if policy != nil {
+		return policy.CIDRs(config.Labels)
+	}
+	return nil, withIPAM
+}
+
 func marshalRequestBody(r *http.Request, body interface{}) error {
 	newBody, err := json.Marshal(body)
 	if err != nil {
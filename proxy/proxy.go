@@ -8,6 +8,7 @@ import (
 	"strings"
 
 	"github.com/fsouza/go-dockerclient"
+	"github.com/weaveworks/weave/attach"
 	. "github.com/weaveworks/weave/common"
 )
 
@@ -23,9 +24,14 @@ type Proxy struct {
 	withDNS        bool
 	dockerBridgeIP string
 	withIPAM       bool
+	policy         *attach.Policy
 }
 
-func NewProxy(targetURL string, withDNS, withIPAM bool) (*Proxy, error) {
+// NewProxy creates a proxy for the Docker API at targetURL. Containers
+// without a WEAVE_CIDR are attached as policy says, unless it is nil,
+// in which case they are attached with an allocated address if
+// withIPAM is set.
+func NewProxy(targetURL string, withDNS, withIPAM bool, policy *attach.Policy) (*Proxy, error) {
 	u, err := url.Parse(targetURL)
 	if err != nil {
 		return nil, err
@@ -60,6 +66,7 @@ func NewProxy(targetURL string, withDNS, withIPAM bool) (*Proxy, error) {
 		withDNS:        withDNS,
 		dockerBridgeIP: string(dockerBridgeIP),
 		withIPAM:       withIPAM,
+		policy:         policy,
 	}, nil
 }
 
@@ -68,9 +75,9 @@ func (proxy *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	path := r.URL.Path
 	switch {
 	case containerCreateRegexp.MatchString(path):
-		proxy.serveWithInterceptor(&createContainerInterceptor{proxy.client, proxy.withDNS, proxy.dockerBridgeIP}, w, r)
+		proxy.serveWithInterceptor(&createContainerInterceptor{proxy.client, proxy.withDNS, proxy.dockerBridgeIP, proxy.withIPAM, proxy.policy}, w, r)
 	case containerStartRegexp.MatchString(path):
-		proxy.serveWithInterceptor(&startContainerInterceptor{proxy.client, proxy.withDNS, proxy.withIPAM}, w, r)
+		proxy.serveWithInterceptor(&startContainerInterceptor{proxy.client, proxy.withDNS, proxy.withIPAM, proxy.policy}, w, r)
 	case execCreateRegexp.MatchString(path):
 		proxy.serveWithInterceptor(&createExecInterceptor{proxy.client}, w, r)
 	case strings.HasPrefix(path, "/weave"):
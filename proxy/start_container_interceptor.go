@@ -5,6 +5,7 @@ import (
 	"strings"
 
 	"github.com/fsouza/go-dockerclient"
+	"github.com/weaveworks/weave/attach"
 	. "github.com/weaveworks/weave/common"
 )
 
@@ -12,6 +13,7 @@ type startContainerInterceptor struct {
 	client   *docker.Client
 	withDNS  bool
 	withIPAM bool
+	policy   *attach.Policy
 }
 
 func (i *startContainerInterceptor) InterceptRequest(r *http.Request) error {
@@ -24,16 +26,13 @@ func (i *startContainerInterceptor) InterceptResponse(r *http.Response) error {
 		return err
 	}
 
-	cidrs, ok := weaveCIDRsFromConfig(container.Config)
-	if !ok && !i.withIPAM {
+	cidrs, ok := weaveCIDRs(container.Config, container.HostConfig, i.withIPAM, i.policy)
+	if !ok {
 		Debug.Print("No Weave CIDR, ignoring")
 		return nil
 	}
 	Info.Printf("Attaching container %s with WEAVE_CIDR \"%s\" to weave network", container.ID, strings.Join(cidrs, " "))
-	args := []string{"attach"}
-	args = append(args, cidrs...)
-	args = append(args, container.ID)
-	if _, err := callWeave(args...); err != nil {
+	if err := attachContainer(i.client, container, cidrs); err != nil {
 		Warning.Printf("Attaching container %s to weave network failed: %v", container.ID, err)
 	}
 	return nil
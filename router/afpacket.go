@@ -0,0 +1,70 @@
+package router
+
+import (
+	weavenet "github.com/weaveworks/weave/net"
+)
+
+// FanoutSource is a PacketSource that several goroutines can read
+// from at once, each from a source of its own, with frames of the
+// same flow always coming from the same one, in order
+type FanoutSource interface {
+	Sources() []PacketSource
+}
+
+// AFPacketIO reads frames from, and writes them to, an interface
+// through packet sockets, each read by a capture worker of its own
+type AFPacketIO struct {
+	sockets []*weavenet.PacketSocket
+	sources []PacketSource
+}
+
+type packetSocketSource struct {
+	socket *weavenet.PacketSocket
+	buf    []byte
+}
+
+// ReadPacket returns the next frame, which is only valid until the
+// next call, as with pcap
+func (src *packetSocketSource) ReadPacket() ([]byte, error) {
+	n, err := src.socket.ReadFrame(src.buf)
+	if err != nil {
+		return nil, err
+	}
+	return src.buf[:n], nil
+}
+
+// NewAFPacketIO opens workers packet sockets on the interface called
+// ifName, in a fanout group if there is more than one, each with a
+// receive buffer of bufSz bytes
+func NewAFPacketIO(ifName string, workers, bufSz int) (*AFPacketIO, error) {
+	sockets, err := weavenet.OpenPacketSockets(ifName, workers, bufSz)
+	if err != nil {
+		return nil, err
+	}
+	aio := &AFPacketIO{sockets: sockets}
+	for _, socket := range sockets {
+		aio.sources = append(aio.sources, &packetSocketSource{socket: socket, buf: make([]byte, MaxUDPPacketSize)})
+	}
+	return aio, nil
+}
+
+func (aio *AFPacketIO) Sources() []PacketSource {
+	return aio.sources
+}
+
+// ReadPacket reads from the first socket, for when there is only one
+// reader
+func (aio *AFPacketIO) ReadPacket() ([]byte, error) {
+	return aio.sources[0].ReadPacket()
+}
+
+func (aio *AFPacketIO) WritePacket(data []byte) error {
+	return aio.sockets[0].WriteFrame(data)
+}
+
+func (aio *AFPacketIO) Close() error {
+	for _, socket := range aio.sockets {
+		socket.Close()
+	}
+	return nil
+}
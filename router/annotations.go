@@ -0,0 +1,151 @@
+package router
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Annotation is what an operator has told us about a connection, for
+// whoever looks into it later, e.g. that it is the link to the backup
+// DC, or only temporary
+type Annotation struct {
+	Labels map[string]string `json:",omitempty"`
+	Note   string            `json:",omitempty"`
+	Time   time.Time         // when it was last set
+}
+
+// Annotations keeps the annotations of connections, by the peer's
+// name or nickname, or the address we connect to, as the operator
+// gave it, in a file, if we have one, so that they outlive us
+type Annotations struct {
+	sync.Mutex
+	path        string
+	annotations map[string]Annotation
+}
+
+// NewAnnotations makes annotations kept in the file at path, reading
+// those it has already, if it exists; they are kept only in memory if
+// path is blank
+func NewAnnotations(path string) (*Annotations, error) {
+	as := &Annotations{path: path, annotations: make(map[string]Annotation)}
+	if path == "" {
+		return as, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return as, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &as.annotations); err != nil {
+		return nil, fmt.Errorf("Unable to read annotations from %s: %s", path, err)
+	}
+	return as, nil
+}
+
+// Set annotates the connection to the peer with name or nickname, or
+// at address, key
+func (as *Annotations) Set(key string, labels map[string]string, note string) error {
+	as.Lock()
+	defer as.Unlock()
+	as.annotations[key] = Annotation{Labels: labels, Note: note, Time: time.Now()}
+	return as.save()
+}
+
+// Delete removes the annotation for key
+func (as *Annotations) Delete(key string) error {
+	as.Lock()
+	defer as.Unlock()
+	if _, found := as.annotations[key]; !found {
+		return nil
+	}
+	delete(as.annotations, key)
+	return as.save()
+}
+
+// Write the file anew, and move it into place, so that it is never
+// left half written
+func (as *Annotations) save() error {
+	if as.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(as.annotations, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(as.path), filepath.Base(as.path)+".")
+	if err != nil {
+		return fmt.Errorf("Unable to save annotations: %s", err)
+	}
+	_, err = tmp.Write(data)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), as.path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("Unable to save annotations: %s", err)
+	}
+	return nil
+}
+
+// All returns the annotations, by key
+func (as *Annotations) All() map[string]Annotation {
+	as.Lock()
+	defer as.Unlock()
+	all := make(map[string]Annotation, len(as.annotations))
+	for key, a := range as.annotations {
+		all[key] = a
+	}
+	return all
+}
+
+// Lookup finds the annotation of a connection, by the first of keys,
+// e.g. the peer's name, nickname and address, that has one
+func (as *Annotations) Lookup(keys ...string) (Annotation, bool) {
+	as.Lock()
+	defer as.Unlock()
+	for _, key := range keys {
+		if a, found := as.annotations[key]; found && key != "" {
+			return a, true
+		}
+	}
+	return Annotation{}, false
+}
+
+func (as *Annotations) String() string {
+	all := as.All()
+	keys := make([]string, 0, len(all))
+	for key := range all {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var buf bytes.Buffer
+	for _, key := range keys {
+		a := all[key]
+		fmt.Fprintf(&buf, "%s: %s", key, a.Note)
+		if len(a.Labels) > 0 {
+			fmt.Fprintf(&buf, " [%s]", FormatLabels(a.Labels))
+		}
+		fmt.Fprintln(&buf)
+	}
+	return buf.String()
+}
+
+// The annotation of a connection, by the peer's name or nickname, or
+// the address
+func (conn *RemoteConnection) annotation(as *Annotations) (Annotation, bool) {
+	if conn.remote == nil {
+		return as.Lookup(conn.remoteTCPAddr)
+	}
+	return as.Lookup(conn.remote.Name.String(), conn.remote.NickName, conn.remoteTCPAddr)
+}
@@ -0,0 +1,43 @@
+package router
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	wt "github.com/weaveworks/weave/testing"
+)
+
+func TestAnnotations(t *testing.T) {
+	dir, err := ioutil.TempDir("", "annotations")
+	wt.AssertNoErr(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "annotations.json")
+
+	as, err := NewAnnotations(path)
+	wt.AssertNoErr(t, err)
+	wt.AssertNoErr(t, as.Set("dc2", map[string]string{"link": "backup"}, "backup DC link"))
+	wt.AssertNoErr(t, as.Set("10.0.0.7:6783", nil, "temporary"))
+	wt.AssertNoErr(t, as.Delete("nothing"))
+
+	// they outlive us
+	as, err = NewAnnotations(path)
+	wt.AssertNoErr(t, err)
+	wt.AssertEqualInt(t, len(as.All()), 2, "annotations")
+	a, found := as.Lookup("01:00:00:00:00:02", "dc2", "10.0.0.2:6783")
+	wt.AssertTrue(t, found, "found by nickname")
+	wt.AssertEqualString(t, a.Note, "backup DC link", "note")
+	wt.AssertEqualString(t, a.Labels["link"], "backup", "label")
+	_, found = as.Lookup("", "", "10.0.0.2:6783")
+	wt.AssertFalse(t, found, "not annotated")
+
+	wt.AssertNoErr(t, as.Delete("dc2"))
+	as, err = NewAnnotations(path)
+	wt.AssertNoErr(t, err)
+	wt.AssertEqualInt(t, len(as.All()), 1, "annotations once deleted")
+
+	ioutil.WriteFile(path, []byte("{"), 0644)
+	_, err = NewAnnotations(path)
+	wt.AssertTrue(t, err != nil, "bad file")
+}
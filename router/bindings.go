@@ -0,0 +1,284 @@
+package router
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/weaveworks/weave/common/events"
+)
+
+const (
+	// How long after it was last seen we forget a binding
+	bindingMaxAge = 10 * time.Minute
+	// How many duplicate addresses we remember
+	maxDuplicates = 32
+)
+
+// AddressBinding is an IP address that a peer has seen a local
+// container, or the host, using, in ARP, with its MAC, and when it
+// first and last did
+type AddressBinding struct {
+	Address string
+	MAC     string
+	Peer    PeerName
+	First   time.Time
+	Last    time.Time
+}
+
+// Whether the address was in use with both bindings' MACs at once. A
+// container that has gone, and been replaced by another with its
+// address, on the same host or elsewhere, was last seen before the
+// new one was first seen.
+func (b *AddressBinding) overlaps(other *AddressBinding) bool {
+	return !b.First.After(other.Last) && !other.First.After(b.Last)
+}
+
+// DuplicateAddress is an address seen with two different MACs at the
+// same time, usually because it was given to containers by hand
+type DuplicateAddress struct {
+	Time      time.Time
+	Address   string
+	MAC       string
+	Peer      PeerName
+	OtherMAC  string
+	OtherPeer PeerName
+}
+
+func (d DuplicateAddress) key() string {
+	if d.MAC > d.OtherMAC {
+		return d.Address + " " + d.OtherMAC + " " + d.MAC
+	}
+	return d.Address + " " + d.MAC + " " + d.OtherMAC
+}
+
+// Bindings tracks which MAC each address on the weave network is used
+// with, from the ARP packets of local containers, gossiping what we
+// see to other peers, and what they see to us, so as to catch
+// addresses in use by two containers at once
+type Bindings struct {
+	sync.Mutex
+	ourself    PeerName
+	bindings   map[string]map[string]*AddressBinding // by address, then MAC
+	reported   map[string]DuplicateAddress           // by address and MACs
+	duplicates []DuplicateAddress
+	now        func() time.Time
+}
+
+func NewBindings(ourself PeerName) *Bindings {
+	return &Bindings{
+		ourself:  ourself,
+		bindings: make(map[string]map[string]*AddressBinding),
+		reported: make(map[string]DuplicateAddress),
+		now:      time.Now}
+}
+
+// ObserveARP notes the binding of the sender of the ARP packet
+// arp, captured locally, if it is one for IPv4 over ethernet with a
+// sender address, which probes don't have
+func (bs *Bindings) ObserveARP(arp []byte) {
+	if len(arp) < 28 || binary.BigEndian.Uint16(arp[0:2]) != 1 || binary.BigEndian.Uint16(arp[2:4]) != 0x0800 || arp[4] != 6 || arp[5] != 4 {
+		return
+	}
+	ip := net.IP(arp[14:18])
+	if ip.Equal(net.IPv4zero) {
+		return
+	}
+	bs.Observe(ip, net.HardwareAddr(arp[8:14]))
+}
+
+// Observe notes that a local container, or the host, is using ip with
+// mac
+func (bs *Bindings) Observe(ip net.IP, mac net.HardwareAddr) {
+	now := bs.now()
+	b := AddressBinding{Address: ip.String(), MAC: mac.String(), Peer: bs.ourself, First: now, Last: now}
+	bs.Lock()
+	bs.merge(b)
+	duplicates := bs.findDuplicates(b.Address)
+	bs.Unlock()
+	bs.report(duplicates)
+}
+
+// Merge a binding into ours, returning whether it told us anything
+// new
+func (bs *Bindings) merge(b AddressBinding) bool {
+	macs, found := bs.bindings[b.Address]
+	if !found {
+		macs = make(map[string]*AddressBinding)
+		bs.bindings[b.Address] = macs
+	}
+	existing, found := macs[b.MAC]
+	if !found {
+		macs[b.MAC] = &b
+		return true
+	}
+	news := false
+	if b.First.Before(existing.First) {
+		existing.First = b.First
+		news = true
+	}
+	if b.Last.After(existing.Last) {
+		existing.Last = b.Last
+		existing.Peer = b.Peer
+		news = true
+	}
+	return news
+}
+
+// Note, and return, duplicates of address we have not reported yet
+func (bs *Bindings) findDuplicates(address string) []DuplicateAddress {
+	var same []*AddressBinding
+	for _, b := range bs.bindings[address] {
+		same = append(same, b)
+	}
+	var duplicates []DuplicateAddress
+	for i, b := range same {
+		for _, other := range same[i+1:] {
+			if !b.overlaps(other) {
+				continue
+			}
+			d := DuplicateAddress{Time: bs.now(), Address: address, MAC: b.MAC, Peer: b.Peer, OtherMAC: other.MAC, OtherPeer: other.Peer}
+			if _, found := bs.reported[d.key()]; found {
+				continue
+			}
+			bs.reported[d.key()] = d
+			bs.duplicates = append(bs.duplicates, d)
+			if len(bs.duplicates) > maxDuplicates {
+				bs.duplicates = bs.duplicates[1:]
+			}
+			duplicates = append(duplicates, d)
+		}
+	}
+	return duplicates
+}
+
+func (bs *Bindings) report(duplicates []DuplicateAddress) {
+	for _, d := range duplicates {
+		log.Printf("Duplicate address %s: in use by %s at %s and by %s at %s", d.Address, d.MAC, d.Peer, d.OtherMAC, d.OtherPeer)
+		events.Publish(events.AddressDuplicate, map[string]string{
+			"address": d.Address, "mac": d.MAC, "peer": d.Peer.String(), "other_mac": d.OtherMAC, "other_peer": d.OtherPeer.String()})
+	}
+}
+
+// Forget bindings not seen for bindingMaxAge, and so that we report
+// them again, should they recur, duplicates involving them
+func (bs *Bindings) expire() {
+	cutoff := bs.now().Add(-bindingMaxAge)
+	for address, macs := range bs.bindings {
+		for mac, b := range macs {
+			if b.Last.Before(cutoff) {
+				delete(macs, mac)
+			}
+		}
+		if len(macs) == 0 {
+			delete(bs.bindings, address)
+		}
+	}
+	for key, d := range bs.reported {
+		_, found := bs.bindings[d.Address][d.MAC]
+		_, otherFound := bs.bindings[d.Address][d.OtherMAC]
+		if !found || !otherFound {
+			delete(bs.reported, key)
+		}
+	}
+}
+
+// Duplicates lists the last few duplicate addresses found, oldest
+// first
+func (bs *Bindings) Duplicates() []DuplicateAddress {
+	bs.Lock()
+	defer bs.Unlock()
+	return append([]DuplicateAddress{}, bs.duplicates...)
+}
+
+func (bs *Bindings) String() string {
+	var buf bytes.Buffer
+	for _, d := range bs.Duplicates() {
+		fmt.Fprintf(&buf, "%s %s: %s at %s, %s at %s\n", d.Time.Format(time.RFC3339), d.Address, d.MAC, d.Peer, d.OtherMAC, d.OtherPeer)
+	}
+	return buf.String()
+}
+
+// Gossip
+
+type bindingsGossipData struct {
+	bindings []AddressBinding
+}
+
+func (d *bindingsGossipData) Merge(other GossipData) {
+	d.bindings = append(d.bindings, other.(*bindingsGossipData).bindings...)
+}
+
+func (d *bindingsGossipData) Encode() []byte {
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(d.bindings); err != nil {
+		panic(err)
+	}
+	return buf.Bytes()
+}
+
+func (bs *Bindings) OnGossipUnicast(sender PeerName, msg []byte) error {
+	return nil
+}
+
+func (bs *Bindings) OnGossipBroadcast(update []byte) (GossipData, error) {
+	var received []AddressBinding
+	if err := gob.NewDecoder(bytes.NewReader(update)).Decode(&received); err != nil {
+		return nil, err
+	}
+	bs.Lock()
+	var news []AddressBinding
+	addresses := make(map[string]struct{})
+	for _, b := range received {
+		if !bs.merge(b) {
+			continue
+		}
+		news = append(news, b)
+		addresses[b.Address] = struct{}{}
+	}
+	var duplicates []DuplicateAddress
+	for address := range addresses {
+		duplicates = append(duplicates, bs.findDuplicates(address)...)
+	}
+	bs.Unlock()
+	bs.report(duplicates)
+	if len(news) == 0 {
+		return nil, nil
+	}
+	return &bindingsGossipData{news}, nil
+}
+
+func (bs *Bindings) Gossip() GossipData {
+	bs.Lock()
+	defer bs.Unlock()
+	bs.expire()
+	if len(bs.bindings) == 0 {
+		return nil
+	}
+	var bindings []AddressBinding
+	for _, macs := range bs.bindings {
+		for _, b := range macs {
+			bindings = append(bindings, *b)
+		}
+	}
+	sort.Sort(bindingsByAddress(bindings))
+	return &bindingsGossipData{bindings}
+}
+
+func (bs *Bindings) OnGossip(update []byte) (GossipData, error) {
+	return bs.OnGossipBroadcast(update)
+}
+
+type bindingsByAddress []AddressBinding
+
+func (bs bindingsByAddress) Len() int      { return len(bs) }
+func (bs bindingsByAddress) Swap(i, j int) { bs[i], bs[j] = bs[j], bs[i] }
+func (bs bindingsByAddress) Less(i, j int) bool {
+	return bs[i].Address < bs[j].Address || bs[i].Address == bs[j].Address && bs[i].MAC < bs[j].MAC
+}
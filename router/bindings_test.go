@@ -0,0 +1,123 @@
+package router
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	wt "github.com/weaveworks/weave/testing"
+)
+
+func arpPacket(mac, ip string) []byte {
+	arp := []byte{0, 1, 8, 0, 6, 4, 0, 1}
+	hw, _ := net.ParseMAC(mac)
+	arp = append(arp, hw...)
+	arp = append(arp, net.ParseIP(ip).To4()...)
+	return append(arp, make([]byte, 10)...)
+}
+
+func TestBindings(t *testing.T) {
+	peer1, _ := PeerNameFromString("01:00:00:00:00:01")
+	peer2, _ := PeerNameFromString("01:00:00:00:00:02")
+	now := time.Unix(1000, 0)
+	clock := func() time.Time { return now }
+	bs1, bs2 := NewBindings(peer1), NewBindings(peer2)
+	bs1.now, bs2.now = clock, clock
+	exchange := func() {
+		if data := bs1.Gossip(); data != nil {
+			_, err := bs2.OnGossip(data.Encode())
+			wt.AssertNoErr(t, err)
+		}
+		if data := bs2.Gossip(); data != nil {
+			_, err := bs1.OnGossip(data.Encode())
+			wt.AssertNoErr(t, err)
+		}
+	}
+
+	// a container restarted with a new MAC is not a duplicate
+	bs1.ObserveARP(arpPacket("02:00:00:00:00:01", "10.32.0.1"))
+	now = now.Add(time.Second)
+	bs1.ObserveARP(arpPacket("02:00:00:00:00:02", "10.32.0.1"))
+	bs1.ObserveARP(arpPacket("02:00:00:00:00:09", "0.0.0.0"))
+	exchange()
+	wt.AssertEqualInt(t, len(bs1.Duplicates()), 0, "replaced binding")
+
+	// nor is one moved to another host
+	now = now.Add(time.Second)
+	bs2.ObserveARP(arpPacket("02:00:00:00:00:03", "10.32.0.1"))
+	exchange()
+	wt.AssertEqualInt(t, len(bs2.Duplicates()), 0, "moved binding")
+
+	// but the old one still using the address is, on both peers
+	now = now.Add(time.Second)
+	bs1.ObserveARP(arpPacket("02:00:00:00:00:02", "10.32.0.1"))
+	wt.AssertEqualInt(t, len(bs1.Duplicates()), 1, "duplicate")
+	exchange()
+	dups := bs2.Duplicates()
+	wt.AssertEqualInt(t, len(dups), 1, "duplicate, gossiped")
+	wt.AssertEqualString(t, dups[0].Address, "10.32.0.1", "duplicate address")
+	wt.AssertTrue(t, dups[0].Peer == peer1 && dups[0].OtherPeer == peer2 || dups[0].Peer == peer2 && dups[0].OtherPeer == peer1, "duplicate peers")
+
+	// reported once, until one of them has gone
+	bs1.ObserveARP(arpPacket("02:00:00:00:00:02", "10.32.0.1"))
+	exchange()
+	wt.AssertEqualInt(t, len(bs2.Duplicates()), 1, "reported once")
+	now = now.Add(bindingMaxAge / 2)
+	bs2.ObserveARP(arpPacket("02:00:00:00:00:03", "10.32.0.1"))
+	exchange()
+	now = now.Add(bindingMaxAge/2 + time.Second)
+	exchange()
+	bs2.ObserveARP(arpPacket("02:00:00:00:00:03", "10.32.0.1"))
+	bs1.ObserveARP(arpPacket("02:00:00:00:00:02", "10.32.0.1"))
+	exchange()
+	wt.AssertEqualInt(t, len(bs2.Duplicates()), 2, "reported again")
+}
+
+func TestBindingsGossipToPeerNotDetecting(t *testing.T) {
+	peer1, _ := PeerNameFromString("01:00:00:00:00:01")
+	peer2, _ := PeerNameFromString("01:00:00:00:00:02")
+	bs := NewBindings(peer1)
+	bs.ObserveARP(arpPacket("02:00:00:00:00:01", "10.32.0.1"))
+	router := NewRouter(RouterConfig{}, peer2, "")
+	// it relays what it is sent, so needs routes to send it along
+	router.Routes.Start()
+	wt.AssertTrue(t, router.Bindings == nil, "not detecting duplicates")
+	for _, tag := range []ProtocolTag{ProtocolGossip, ProtocolGossipBroadcast} {
+		msg := GobEncode(hash("bindings"), peer1, bs.Gossip().Encode())
+		wt.AssertNoErr(t, router.handleGossip(tag, msg))
+	}
+}
+
+// Peers detecting duplicates hear of each other's bindings through one
+// that isn't
+func TestBindingsGossipThroughRelay(t *testing.T) {
+	peer1Name, _ := PeerNameFromString("01:00:00:01:00:00")
+	peer2Name, _ := PeerNameFromString("02:00:00:02:00:00")
+	peer3Name, _ := PeerNameFromString("03:00:00:03:00:00")
+	newRouter := func(name PeerName, duplicates bool) *Router {
+		router := NewRouter(RouterConfig{Duplicates: duplicates}, name, "")
+		router.ConnectionMaker.actionChan = make(chan ConnectionMakerAction, ChannelSize)
+		router.Routes.Start()
+		return router
+	}
+	r1, r2, r3 := newRouter(peer1Name, true), newRouter(peer2Name, false), newRouter(peer3Name, true)
+	r1.AddTestChannelConnection(r2)
+	r2.AddTestChannelConnection(r1)
+	r2.AddTestChannelConnection(r3)
+	r3.AddTestChannelConnection(r2)
+
+	r1.Bindings.ObserveARP(arpPacket("02:00:00:00:00:01", "10.32.0.1"))
+	r3.Bindings.ObserveARP(arpPacket("02:00:00:00:00:03", "10.32.0.1"))
+	// still in use on peer 1, so in use twice at once
+	r1.Bindings.ObserveARP(arpPacket("02:00:00:00:00:01", "10.32.0.1"))
+	r1.SendAllGossip()
+	// the senders may be sending in the background as well
+	for deadline := time.Now().Add(time.Second); len(r3.Bindings.Duplicates()) == 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for bindings relayed from peer 1")
+		}
+		r1.sendPendingGossip()
+	}
+	wt.AssertEqualInt(t, len(r3.Bindings.Duplicates()), 1, "duplicate, relayed")
+	wt.AssertEqualString(t, r3.Bindings.Duplicates()[0].Address, "10.32.0.1", "duplicate address")
+}
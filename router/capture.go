@@ -0,0 +1,134 @@
+package router
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"code.google.com/p/gopacket"
+	"code.google.com/p/gopacket/layers"
+)
+
+// How many frames a capture buffers before dropping them
+const captureBufferSize = 1024
+
+// CapturedFrame is a copy of a frame passing through the router
+type CapturedFrame struct {
+	Time time.Time
+	Peer PeerName // where it came from or is going to; unknown for broadcasts
+	Data []byte   // an Ethernet frame, or an IPv4 packet when encapsulated
+}
+
+// Capture receives copies of the frames passing through the router,
+// either as the Ethernet frames we capture and inject, or as the UDP
+// packets, encapsulating them, that we send to and receive from other
+// peers, until stopped
+type Capture struct {
+	Frames       <-chan CapturedFrame
+	frames       chan CapturedFrame
+	encapsulated bool
+	peer         PeerName          // to or from which frames are wanted; all if unknown
+	match        func([]byte) bool // which frames are wanted; all if nil
+	dropped      uint64
+}
+
+type captures struct {
+	sync.RWMutex
+	count int32 // so that we can skip locking when not capturing
+	set   map[*Capture]struct{}
+}
+
+// StartCapture starts copying frames to a Capture
+func (router *Router) StartCapture(encapsulated bool, peer PeerName, match func([]byte) bool) *Capture {
+	frames := make(chan CapturedFrame, captureBufferSize)
+	c := &Capture{Frames: frames, frames: frames, encapsulated: encapsulated, peer: peer, match: match}
+	router.captures.Lock()
+	if router.captures.set == nil {
+		router.captures.set = make(map[*Capture]struct{})
+	}
+	router.captures.set[c] = struct{}{}
+	atomic.StoreInt32(&router.captures.count, int32(len(router.captures.set)))
+	router.captures.Unlock()
+	return c
+}
+
+// StopCapture stops copying frames to c, and closes its Frames
+func (router *Router) StopCapture(c *Capture) {
+	router.captures.Lock()
+	if _, found := router.captures.set[c]; found {
+		delete(router.captures.set, c)
+		close(c.frames)
+	}
+	atomic.StoreInt32(&router.captures.count, int32(len(router.captures.set)))
+	router.captures.Unlock()
+}
+
+// Dropped says how many frames weren't copied because Frames was full
+func (c *Capture) Dropped() uint64 {
+	return atomic.LoadUint64(&c.dropped)
+}
+
+func (router *Router) copyingFrames() bool {
+	return atomic.LoadInt32(&router.captures.count) > 0
+}
+
+func (router *Router) captureFrame(encapsulated bool, peer PeerName, data []byte) {
+	router.captures.RLock()
+	defer router.captures.RUnlock()
+	var frame *CapturedFrame
+	for c := range router.captures.set {
+		if c.encapsulated != encapsulated ||
+			(c.peer != UnknownPeerName && peer != UnknownPeerName && c.peer != peer) ||
+			(c.match != nil && !c.match(data)) {
+			continue
+		}
+		if frame == nil {
+			frame = &CapturedFrame{Time: time.Now(), Peer: peer, Data: make([]byte, len(data))}
+			copy(frame.Data, data)
+		}
+		select {
+		case c.frames <- *frame:
+		default:
+			atomic.AddUint64(&c.dropped, 1)
+		}
+	}
+}
+
+// Copy an Ethernet frame we captured, or are injecting
+func (router *Router) captureEthernet(peer *Peer, frame []byte) {
+	if !router.copyingFrames() {
+		return
+	}
+	name := UnknownPeerName
+	if peer != nil {
+		name = peer.Name
+	}
+	router.captureFrame(false, name, frame)
+}
+
+// Copy a UDP packet's payload that we are sending to, or received
+// from, a peer, as an IPv4 packet
+func (router *Router) captureUDP(peer PeerName, src, dst *net.UDPAddr, payload []byte) {
+	if !router.copyingFrames() || src == nil || dst == nil {
+		return
+	}
+	ip := &layers.IPv4{Version: 4, IHL: 5, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: src.IP.To4(), DstIP: dst.IP.To4()}
+	udp := &layers.UDP{SrcPort: layers.UDPPort(src.Port), DstPort: layers.UDPPort(dst.Port)}
+	buf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true}, ip, udp, gopacket.Payload(payload)); err != nil {
+		return
+	}
+	router.captureFrame(true, peer, buf.Bytes())
+}
+
+// Our end of a connection's UDP traffic
+func (conn *LocalConnection) localUDPAddr() *net.UDPAddr {
+	if conn.TCPConn == nil {
+		return nil
+	}
+	if addr, ok := conn.TCPConn.LocalAddr().(*net.TCPAddr); ok {
+		return &net.UDPAddr{IP: addr.IP, Port: conn.Router.Port}
+	}
+	return nil
+}
@@ -0,0 +1,39 @@
+package router
+
+import (
+	"testing"
+
+	wt "github.com/weaveworks/weave/testing"
+)
+
+func TestCapture(t *testing.T) {
+	name, _ := PeerNameFromString("01:00:00:01:00:00")
+	other, _ := PeerNameFromString("02:00:00:02:00:00")
+	router := NewRouter(RouterConfig{}, name, "nick")
+	frame := []byte{1, 2, 3}
+
+	router.captureEthernet(nil, frame)
+	all := router.StartCapture(false, UnknownPeerName, nil)
+	toOther := router.StartCapture(false, other, func(data []byte) bool { return data[0] == 1 })
+	encapsulated := router.StartCapture(true, UnknownPeerName, nil)
+
+	router.captureEthernet(nil, frame)
+	router.captureEthernet(&Peer{Name: name}, frame)
+	router.captureEthernet(&Peer{Name: other}, []byte{4, 5, 6})
+	router.StopCapture(all)
+	router.StopCapture(toOther)
+	router.StopCapture(encapsulated)
+	router.captureEthernet(nil, frame)
+
+	count := func(c *Capture) int {
+		n := 0
+		for range c.Frames {
+			n++
+		}
+		return n
+	}
+	wt.AssertEqualInt(t, count(all), 3, "all frames")
+	wt.AssertEqualInt(t, count(toOther), 1, "broadcast frames matching the filter")
+	wt.AssertEqualInt(t, count(encapsulated), 0, "encapsulated frames")
+	wt.AssertTrue(t, !router.copyingFrames(), "stopped capturing")
+}
@@ -6,8 +6,11 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"strconv"
 	"sync"
 	"time"
+
+	"github.com/weaveworks/weave/common/tracing"
 )
 
 type Connection interface {
@@ -59,6 +62,14 @@ type LocalConnection struct {
 	uid               uint64
 	actionChan        chan<- ConnectionAction
 	finished          <-chan struct{} // closed to signal that actorLoop has finished
+	span              *tracing.Span   // of establishing the connection
+	topologySent      *topologySent   // if the remote peer takes topology deltas
+	compressGossip    bool            // if the remote peer takes gossip compressed
+	sleeveFrag        bool            // if the remote peer reassembles fragments
+	unknownGossip     bool            // if the remote peer ignores gossip on channels it doesn't know
+	fragmentID        uint32          // of the last frame we fragmented
+	reassembler       *reassembler
+	gossipQueue       *gossipQueue
 }
 
 type ConnectionAction func() error
@@ -107,7 +118,9 @@ func NewLocalConnection(connRemote *RemoteConnection, tcpConn *net.TCPConn, udpA
 		Router:           router,
 		TCPConn:          tcpConn,
 		remoteUDPAddr:    udpAddr,
-		effectivePMTU:    DefaultPMTU}
+		effectivePMTU:    DefaultPMTU,
+		reassembler:      newReassembler(router.Fragmentation),
+		gossipQueue:      newGossipQueue()}
 }
 
 // Async. Does not return anything. If the connection is successful,
@@ -247,6 +260,8 @@ func (conn *LocalConnection) SetEstablished() {
 		if old {
 			return nil
 		}
+		conn.span.End(nil)
+		conn.recordEvent(ConnectionEstablishedEvent, nil)
 		conn.Router.Ourself.ConnectionEstablished(conn)
 		if err := conn.ensureForwarders(); err != nil {
 			return err
@@ -292,13 +307,19 @@ func (conn *LocalConnection) run(actionChan <-chan ConnectionAction, finished ch
 	enc := gob.NewEncoder(tcpConn)
 	dec := gob.NewDecoder(tcpConn)
 
-	if err = conn.handshake(enc, dec, acceptNewPeer); err != nil {
+	conn.span = tracing.Start("connection.establish", "address", conn.remoteTCPAddr, "outbound", strconv.FormatBool(conn.outbound))
+	handshakeSpan := conn.span.Child("connection.handshake")
+	err = conn.handshake(enc, dec, acceptNewPeer)
+	handshakeSpan.End(err)
+	if err != nil {
 		return
 	}
 	conn.Log("completed handshake")
+	conn.span.SetAttribute("peer", conn.remote.String())
 
 	// The ordering of the following is very important. [1]
 
+	go conn.sendQueuedGossip()
 	if conn.remoteUDPAddr != nil {
 		if err = conn.ensureForwarders(); err != nil {
 			return
@@ -375,10 +396,15 @@ func (conn *LocalConnection) initHeartbeats() error {
 }
 
 func (conn *LocalConnection) actorLoop(actionChan <-chan ConnectionAction) (err error) {
+	// this is what would drop the connection, so it can't be restarted
+	progress := conn.Router.Watchdog.Watch(fmt.Sprintf("connection to %s", conn.remote), nil)
+	defer conn.Router.Watchdog.Unwatch(progress)
 	for err == nil {
 		select {
 		case action := <-actionChan:
+			progress.Begin()
 			err = action()
+			progress.End()
 		case <-conn.heartbeatTCP.C:
 			err = conn.sendSimpleProtocolMsg(ProtocolHeartbeat)
 		case <-conn.heartbeatTimeout.C:
@@ -396,9 +422,20 @@ func (conn *LocalConnection) actorLoop(actionChan <-chan ConnectionAction) (err
 func (conn *LocalConnection) shutdown(err error) {
 	if conn.remote == nil {
 		log.Printf("->[%s] connection shutting down due to error during handshake: %v\n", conn.remoteTCPAddr, err)
+		conn.recordEvent(HandshakeFailedEvent, err)
 	} else {
-		conn.Log("connection shutting down due to error:", err)
+		if a, found := conn.annotation(conn.Router.Annotations); found && a.Note != "" {
+			conn.Log("connection shutting down due to error:", err, "- note:", a.Note)
+		} else {
+			conn.Log("connection shutting down due to error:", err)
+		}
+		if conn.established {
+			conn.recordEvent(ConnectionDroppedEvent, err)
+		} else {
+			conn.recordEvent(ConnectionFailedEvent, err)
+		}
 	}
+	conn.span.End(err)
 
 	if conn.TCPConn != nil {
 		checkWarn(conn.TCPConn.Close())
@@ -413,6 +450,7 @@ func (conn *LocalConnection) shutdown(err error) {
 		conn.heartbeatTimeout.Stop()
 	}
 
+	conn.gossipQueue.Stop()
 	stopTicker(conn.heartbeatTCP)
 	stopTicker(conn.heartbeat)
 	stopTicker(conn.fragTest)
@@ -431,6 +469,9 @@ func (conn *LocalConnection) sendSimpleProtocolMsg(tag ProtocolTag) error {
 }
 
 func (conn *LocalConnection) sendProtocolMsg(m ProtocolMsg) error {
+	if conn.compressGossip {
+		m = compressProtocolMsg(m)
+	}
 	return conn.tcpSender.Send(Concat([]byte{byte(m.tag)}, m.msg))
 }
 
@@ -442,6 +483,11 @@ func (conn *LocalConnection) receiveTCP(decoder *gob.Decoder) {
 	} else {
 		receiver = NewSimpleTCPReceiver()
 	}
+	// stuck handing a message to a gossiper, most likely
+	progress := conn.Router.Watchdog.Watch(fmt.Sprintf("receiver from %s", conn.remote), func() {
+		conn.Shutdown(fmt.Errorf("receiver stalled"))
+	})
+	defer conn.Router.Watchdog.Unwatch(progress)
 	var err error
 	for {
 		var msg []byte
@@ -457,7 +503,10 @@ func (conn *LocalConnection) receiveTCP(decoder *gob.Decoder) {
 			conn.Log("ignoring blank msg")
 			continue
 		}
-		if err = conn.handleProtocolMsg(ProtocolTag(msg[0]), msg[1:]); err != nil {
+		progress.Begin()
+		err = conn.handleProtocolMsg(ProtocolTag(msg[0]), msg[1:])
+		progress.End()
+		if err != nil {
 			break
 		}
 	}
@@ -485,6 +534,14 @@ func (conn *LocalConnection) handleProtocolMsg(tag ProtocolTag, payload []byte)
 		conn.pmtuVerified(int(binary.BigEndian.Uint16(payload)))
 	case ProtocolGossipUnicast, ProtocolGossipBroadcast, ProtocolGossip:
 		return conn.Router.handleGossip(tag, payload)
+	case ProtocolTopologyRequest:
+		conn.Router.sendFullTopology(conn)
+	case ProtocolCompressed:
+		tag, msg, err := decompressProtocolMsg(payload)
+		if err != nil {
+			return err
+		}
+		return conn.handleProtocolMsg(tag, msg)
 	default:
 		conn.Log("ignoring unknown protocol tag:", tag)
 	}
@@ -0,0 +1,91 @@
+package router
+
+import (
+	"sync"
+	"time"
+)
+
+// DefaultConnHistory is how many connection events we keep for each
+// peer, unless configured otherwise
+const DefaultConnHistory = 32
+
+// Types of connection event
+const (
+	ConnectionEstablishedEvent = "established"
+	ConnectionDroppedEvent     = "dropped" // after being established
+	ConnectionFailedEvent      = "failed"  // after the handshake, before being established
+	HandshakeFailedEvent       = "handshake failed"
+	DialFailedEvent            = "dial failed"
+)
+
+// ConnectionEvent is something that happened to a connection
+type ConnectionEvent struct {
+	Time     time.Time
+	Type     string
+	Address  string
+	Outbound bool
+	Reason   string // for all but ConnectionEstablishedEvent
+}
+
+// ConnectionHistory keeps the last few connection events for each
+// peer, by name, and for each address we failed to complete a
+// handshake with, so that flapping connections can be looked into
+// after the event
+type ConnectionHistory struct {
+	sync.Mutex
+	size   int
+	events map[string]*eventRing
+}
+
+type eventRing struct {
+	events []ConnectionEvent
+	next   int // where the next event goes, once full
+}
+
+func NewConnectionHistory(size int) *ConnectionHistory {
+	return &ConnectionHistory{size: size, events: make(map[string]*eventRing)}
+}
+
+// Record an event for a peer, or an address
+func (h *ConnectionHistory) Record(key string, event ConnectionEvent) {
+	h.Lock()
+	defer h.Unlock()
+	ring, found := h.events[key]
+	if !found {
+		ring = &eventRing{}
+		h.events[key] = ring
+	}
+	if len(ring.events) < h.size {
+		ring.events = append(ring.events, event)
+		return
+	}
+	ring.events[ring.next] = event
+	ring.next = (ring.next + 1) % h.size
+}
+
+// Events returns the events we have, oldest first, by peer or
+// address
+func (h *ConnectionHistory) Events() map[string][]ConnectionEvent {
+	h.Lock()
+	defer h.Unlock()
+	result := make(map[string][]ConnectionEvent, len(h.events))
+	for key, ring := range h.events {
+		events := make([]ConnectionEvent, 0, len(ring.events))
+		events = append(events, ring.events[ring.next:]...)
+		events = append(events, ring.events[:ring.next]...)
+		result[key] = events
+	}
+	return result
+}
+
+func (conn *LocalConnection) recordEvent(eventType string, err error) {
+	event := ConnectionEvent{Time: time.Now(), Type: eventType, Address: conn.remoteTCPAddr, Outbound: conn.outbound}
+	if err != nil {
+		event.Reason = err.Error()
+	}
+	key := conn.remoteTCPAddr
+	if conn.remote != nil {
+		key = conn.remote.Name.String()
+	}
+	conn.Router.ConnectionHistory.Record(key, event)
+}
@@ -0,0 +1,25 @@
+package router
+
+import (
+	"fmt"
+	"testing"
+
+	wt "github.com/weaveworks/weave/testing"
+)
+
+func TestConnectionHistory(t *testing.T) {
+	h := NewConnectionHistory(3)
+	for i := 0; i < 5; i++ {
+		h.Record("peer", ConnectionEvent{Type: ConnectionDroppedEvent, Reason: fmt.Sprint(i)})
+	}
+	h.Record("10.0.0.1:6783", ConnectionEvent{Type: HandshakeFailedEvent})
+
+	events := h.Events()
+	wt.AssertEqualInt(t, len(events), 2, "keys")
+	wt.AssertEqualInt(t, len(events["10.0.0.1:6783"]), 1, "address events")
+	var reasons []string
+	for _, event := range events["peer"] {
+		reasons = append(reasons, event.Reason)
+	}
+	wt.AssertEquals(t, reasons, []string{"2", "3", "4"})
+}
@@ -7,6 +7,8 @@ import (
 	"math/rand"
 	"net"
 	"time"
+
+	"github.com/weaveworks/weave/common/tracing"
 )
 
 const (
@@ -19,7 +21,8 @@ type ConnectionMaker struct {
 	peers        *Peers
 	port         int
 	targets      map[string]*Target
-	cmdLinePeers map[string]*net.TCPAddr
+	cmdLinePeers map[string][]*net.TCPAddr // the addresses each resolved to
+	lastAttempt  map[string]time.Time      // when we last tried each target, or connection we made
 	actionChan   chan<- ConnectionMakerAction
 }
 
@@ -27,6 +30,7 @@ type ConnectionMaker struct {
 type Target struct {
 	attempting  bool          // are we currently attempting to connect there?
 	lastError   error         // reason for disconnection last time
+	failures    int           // attempts that have failed in a row
 	tryAfter    time.Time     // next time to try this address
 	tryInterval time.Duration // backoff time on next failure
 }
@@ -38,7 +42,8 @@ func NewConnectionMaker(ourself *LocalPeer, peers *Peers, port int) *ConnectionM
 		ourself:      ourself,
 		peers:        peers,
 		port:         port,
-		cmdLinePeers: make(map[string]*net.TCPAddr),
+		cmdLinePeers: make(map[string][]*net.TCPAddr),
+		lastAttempt:  make(map[string]time.Time),
 		targets:      make(map[string]*Target)}
 }
 
@@ -49,24 +54,87 @@ func (cm *ConnectionMaker) Start() {
 }
 
 func (cm *ConnectionMaker) InitiateConnection(peer string) error {
+	addrs, err := resolvePeer(peer)
+	if err != nil {
+		return err
+	}
+	cm.actionChan <- func() bool {
+		cm.cmdLinePeers[peer] = addrs
+		// curtail any existing reconnect interval
+		for _, addr := range addrs {
+			if target, found := cm.targets[cm.completeAddr(addr).String()]; found {
+				target.tryAfter, target.tryInterval = tryImmediately()
+			}
+		}
+		return true
+	}
+	return nil
+}
+
+// So that tests can resolve names as they like
+var lookupIP = net.LookupIP
+
+// The IPv4 addresses a peer given as <host>[:<port>] resolves to, with
+// port 0 if none was given
+func resolvePeer(peer string) ([]*net.TCPAddr, error) {
 	host, port, err := net.SplitHostPort(peer)
 	if err != nil {
 		host = peer
 		port = "0" // we use that as an indication that "no port was supplied"
 	}
-	addr, err := net.ResolveTCPAddr("tcp4", fmt.Sprintf("%s:%s", host, port))
+	portNum, err := net.LookupPort("tcp", port)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	ips, err := lookupIP(host)
+	if err != nil {
+		return nil, err
+	}
+	var addrs []*net.TCPAddr
+	for _, ip := range ips {
+		if ip4 := ip.To4(); ip4 != nil {
+			addrs = append(addrs, &net.TCPAddr{IP: ip4, Port: portNum})
+		}
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no IPv4 address for %s", host)
+	}
+	return addrs, nil
+}
+
+// The address to connect to at addr, with our port if it has none
+func (cm *ConnectionMaker) completeAddr(addr *net.TCPAddr) *net.TCPAddr {
+	completeAddr := *addr
+	if completeAddr.Port == 0 {
+		completeAddr.Port = cm.port
+	}
+	return &completeAddr
+}
+
+// Resolve peer, given on the command line, again, since its address
+// may have changed since we last tried it, replacing the addresses
+// we try to connect to with those it resolves to now, and return
+// whether address is still one of them. If it doesn't resolve, we
+// keep trying the addresses it did.
+func (cm *ConnectionMaker) resolveAgain(peer, address string) bool {
+	addrs, err := resolvePeer(peer)
+	if err != nil {
+		log.Printf("->[%s] unable to resolve %s again: %v\n", address, peer, err)
+		return true
+	}
+	resolved := false
+	for _, addr := range addrs {
+		if cm.completeAddr(addr).String() == address {
+			resolved = true
+		}
 	}
 	cm.actionChan <- func() bool {
-		cm.cmdLinePeers[peer] = addr
-		// curtail any existing reconnect interval
-		if target, found := cm.targets[addr.String()]; found {
-			target.tryAfter, target.tryInterval = tryImmediately()
+		if _, found := cm.cmdLinePeers[peer]; found {
+			cm.cmdLinePeers[peer] = addrs
 		}
 		return true
 	}
-	return nil
+	return resolved
 }
 
 func (cm *ConnectionMaker) ForgetConnection(peer string) {
@@ -81,6 +149,7 @@ func (cm *ConnectionMaker) ConnectionTerminated(address string, err error) {
 		if target, found := cm.targets[address]; found {
 			target.attempting = false
 			target.lastError = err
+			target.failures++
 			target.tryAfter, target.tryInterval = tryAfter(target.tryInterval)
 		}
 		return true
@@ -121,14 +190,19 @@ func (cm *ConnectionMaker) String() string {
 func (cm *ConnectionMaker) queryLoop(actionChan <-chan ConnectionMakerAction) {
 	timer := time.NewTimer(MaxDuration)
 	run := func() { timer.Reset(cm.checkStateAndAttemptConnections()) }
+	progress := cm.ourself.router.Watchdog.Watch("connection maker", nil)
 	for {
 		select {
 		case action := <-actionChan:
+			progress.Begin()
 			if action() {
 				run()
 			}
+			progress.End()
 		case <-timer.C:
+			progress.Begin()
 			run()
+			progress.End()
 		}
 	}
 }
@@ -136,7 +210,7 @@ func (cm *ConnectionMaker) queryLoop(actionChan <-chan ConnectionMakerAction) {
 func (cm *ConnectionMaker) checkStateAndAttemptConnections() time.Duration {
 	var (
 		validTarget   = make(map[string]struct{})
-		cmdLineTarget = make(map[string]struct{})
+		cmdLineTarget = make(map[string]string) // to the peer as given
 	)
 	// Copy the set of things we are connected to, so we can access
 	// them without locking.  Also clear out any entries in cm.targets
@@ -157,30 +231,43 @@ func (cm *ConnectionMaker) checkStateAndAttemptConnections() time.Duration {
 	}
 
 	// Add command-line targets that are not connected
-	for _, addr := range cm.cmdLinePeers {
-		completeAddr := *addr
-		attempt := true
-		if completeAddr.Port == 0 {
-			completeAddr.Port = cm.port
-			// If a peer was specified w/o a port, then we do not
-			// attempt to connect to it if we have any inbound
-			// connections from that IP.
-			if _, connected := ourInboundIPs[completeAddr.IP.String()]; connected {
-				attempt = false
+	for peer, addrs := range cm.cmdLinePeers {
+		for _, addr := range addrs {
+			attempt := true
+			if addr.Port == 0 {
+				// If a peer was specified w/o a port, then we do not
+				// attempt to connect to it if we have any inbound
+				// connections from that IP.
+				if _, connected := ourInboundIPs[addr.IP.String()]; connected {
+					attempt = false
+				}
+			}
+			address := cm.completeAddr(addr).String()
+			cmdLineTarget[address] = peer
+			if attempt {
+				addTarget(address)
 			}
-		}
-		address := completeAddr.String()
-		cmdLineTarget[address] = void
-		if attempt {
-			addTarget(address)
 		}
 	}
 
 	// Add targets for peers that someone else is connected to, but we
-	// aren't
-	cm.addPeerTargets(ourConnectedPeers, addTarget)
+	// aren't, and, in a partial mesh, that we want as neighbours
+	var wanted PeerNameSet
+	if cm.ourself.router.Neighbours > 0 {
+		var wantsUs func(PeerName) bool
+		wanted, wantsUs = cm.neighbours()
+		cm.pruneConnections(wanted, wantsUs, cmdLineTarget)
+	}
+	cm.addPeerTargets(ourConnectedPeers, wanted, addTarget)
 
-	return cm.connectToTargets(validTarget, cmdLineTarget)
+	after := cm.connectToTargets(validTarget, cmdLineTarget)
+	for address := range cm.lastAttempt {
+		_, connected := ourConnectedTargets[address]
+		if _, found := cm.targets[address]; !found && !connected {
+			delete(cm.lastAttempt, address)
+		}
+	}
+	return after
 }
 
 func (cm *ConnectionMaker) ourConnections() (PeerNameSet, map[string]struct{}, map[string]struct{}) {
@@ -204,7 +291,8 @@ func (cm *ConnectionMaker) ourConnections() (PeerNameSet, map[string]struct{}, m
 	return ourConnectedPeers, ourConnectedTargets, ourInboundIPs
 }
 
-func (cm *ConnectionMaker) addPeerTargets(ourConnectedPeers PeerNameSet, addTarget func(string)) {
+// Add targets for the peers in wanted, or all peers if it is nil
+func (cm *ConnectionMaker) addPeerTargets(ourConnectedPeers, wanted PeerNameSet, addTarget func(string)) {
 	cm.peers.ForEach(func(peer *Peer) {
 		if peer == cm.ourself.Peer {
 			return
@@ -219,6 +307,9 @@ func (cm *ConnectionMaker) addPeerTargets(ourConnectedPeers PeerNameSet, addTarg
 			if _, connected := ourConnectedPeers[otherPeer]; connected {
 				continue
 			}
+			if _, found := wanted[otherPeer]; wanted != nil && !found {
+				continue
+			}
 			address := conn.RemoteTCPAddr()
 			if conn.Outbound() {
 				addTarget(address)
@@ -233,7 +324,7 @@ func (cm *ConnectionMaker) addPeerTargets(ourConnectedPeers PeerNameSet, addTarg
 	})
 }
 
-func (cm *ConnectionMaker) connectToTargets(validTarget map[string]struct{}, cmdLineTarget map[string]struct{}) time.Duration {
+func (cm *ConnectionMaker) connectToTargets(validTarget map[string]struct{}, cmdLineTarget map[string]string) time.Duration {
 	now := time.Now() // make sure we catch items just added
 	after := MaxDuration
 	for address, target := range cm.targets {
@@ -247,8 +338,11 @@ func (cm *ConnectionMaker) connectToTargets(validTarget map[string]struct{}, cmd
 		switch duration := target.tryAfter.Sub(now); {
 		case duration <= 0:
 			target.attempting = true
-			_, isCmdLineTarget := cmdLineTarget[address]
-			go cm.attemptConnection(address, isCmdLineTarget)
+			cm.lastAttempt[address] = now
+			peer, isCmdLineTarget := cmdLineTarget[address]
+			// on retries, look up peers given by name again first
+			retry := isCmdLineTarget && target.lastError != nil
+			go cm.attemptConnection(address, peer, retry, isCmdLineTarget)
 		case duration < after:
 			after = duration
 		}
@@ -256,10 +350,19 @@ func (cm *ConnectionMaker) connectToTargets(validTarget map[string]struct{}, cmd
 	return after
 }
 
-func (cm *ConnectionMaker) attemptConnection(address string, acceptNewPeer bool) {
+func (cm *ConnectionMaker) attemptConnection(address, peer string, resolve, acceptNewPeer bool) {
+	if resolve && !cm.resolveAgain(peer, address) {
+		log.Printf("->[%s] %s no longer resolves to this address\n", address, peer)
+		cm.ConnectionTerminated(address, fmt.Errorf("%s no longer resolves to this address", peer))
+		return
+	}
 	log.Printf("->[%s] attempting connection\n", address)
-	if err := cm.ourself.CreateConnection(address, acceptNewPeer); err != nil {
+	span := tracing.Start("connection.dial", "address", address)
+	err := cm.ourself.CreateConnection(address, acceptNewPeer)
+	span.End(err)
+	if err != nil {
 		log.Printf("->[%s] error during connection attempt: %v\n", address, err)
+		cm.ourself.router.ConnectionHistory.Record(address, ConnectionEvent{Time: time.Now(), Type: DialFailedEvent, Address: address, Outbound: true, Reason: err.Error()})
 		cm.ConnectionTerminated(address, err)
 	}
 }
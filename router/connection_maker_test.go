@@ -0,0 +1,131 @@
+package router
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	wt "github.com/weaveworks/weave/testing"
+)
+
+func stubLookupIP(hosts map[string][]string) func() {
+	saved := lookupIP
+	lookupIP = func(host string) ([]net.IP, error) {
+		addrs, found := hosts[host]
+		if !found {
+			return nil, fmt.Errorf("no such host %s", host)
+		}
+		var ips []net.IP
+		for _, addr := range addrs {
+			ips = append(ips, net.ParseIP(addr))
+		}
+		return ips, nil
+	}
+	return func() { lookupIP = saved }
+}
+
+func TestResolvePeer(t *testing.T) {
+	defer stubLookupIP(map[string][]string{"host1": {"10.0.0.1", "fe80::1", "10.0.0.2"}})()
+
+	addrs, err := resolvePeer("host1")
+	wt.AssertNoErr(t, err)
+	wt.AssertEqualInt(t, len(addrs), 2, "IPv4 addresses")
+	wt.AssertEqualString(t, addrs[1].String(), "10.0.0.2:0", "address without a port")
+
+	addrs, err = resolvePeer("host1:7000")
+	wt.AssertNoErr(t, err)
+	wt.AssertEqualString(t, addrs[0].String(), "10.0.0.1:7000", "address with a port")
+
+	_, err = resolvePeer("host2")
+	wt.AssertTrue(t, err != nil, "error for an unknown host")
+}
+
+func TestResolveAgain(t *testing.T) {
+	hosts := map[string][]string{"host1": {"10.0.0.1"}}
+	defer stubLookupIP(hosts)()
+
+	cm := NewConnectionMaker(nil, nil, Port)
+	actions := make(chan ConnectionMakerAction, 1)
+	cm.actionChan = actions
+	addrs, err := resolvePeer("host1")
+	wt.AssertNoErr(t, err)
+	cm.cmdLinePeers["host1"] = addrs
+
+	hosts["host1"] = []string{"10.0.0.3"}
+	wt.AssertTrue(t, !cm.resolveAgain("host1", fmt.Sprintf("10.0.0.1:%d", Port)), "old address no longer resolved")
+	(<-actions)()
+	wt.AssertEqualInt(t, len(cm.cmdLinePeers["host1"]), 1, "addresses")
+	wt.AssertEqualString(t, cm.cmdLinePeers["host1"][0].String(), "10.0.0.3:0", "new address")
+
+	// we keep the addresses we have when a name stops resolving
+	delete(hosts, "host1")
+	wt.AssertTrue(t, cm.resolveAgain("host1", fmt.Sprintf("10.0.0.3:%d", Port)), "unresolved address kept")
+	wt.AssertEqualInt(t, len(actions), 0, "no update")
+}
+
+func TestNeighbours(t *testing.T) {
+	const n = 64
+	var names []PeerName
+	for i := 0; i < n; i++ {
+		name, _ := PeerNameFromString(fmt.Sprintf("00:00:00:00:00:%02x", i))
+		names = append(names, name)
+	}
+	wt.AssertEqualInt(t, len(Neighbours(names, names[0], 0)), n-1, "neighbours in a full mesh")
+	wt.AssertEqualInt(t, len(Neighbours(names[:4], names[0], 6)), 3, "neighbours when there are fewer peers")
+	other, _ := PeerNameFromString("00:00:00:00:01:00")
+	wt.AssertEqualInt(t, len(Neighbours(names, other, 6)), 0, "neighbours of a peer we don't know")
+
+	// every peer reaches every other over the connections either
+	// wants, in no more hops than the base 2 logarithm of their number
+	neighbours := make(map[PeerName]PeerNameSet)
+	for _, name := range names {
+		neighbours[name] = Neighbours(names, name, 6)
+		wt.AssertEqualInt(t, len(neighbours[name]), 6, "neighbours of "+name.String())
+		_, found := neighbours[name][name]
+		wt.AssertFalse(t, found, "a peer isn't its own neighbour")
+	}
+	for _, from := range names {
+		hops := map[PeerName]int{from: 0}
+		for queue := []PeerName{from}; len(queue) > 0; queue = queue[1:] {
+			for to := range neighbours[queue[0]] {
+				if _, seen := hops[to]; !seen {
+					hops[to] = hops[queue[0]] + 1
+					queue = append(queue, to)
+				}
+			}
+		}
+		wt.AssertEqualInt(t, len(hops), n, "peers reached from "+from.String())
+		for _, h := range hops {
+			wt.AssertTrue(t, h <= 6, "hops from "+from.String())
+		}
+	}
+}
+
+func TestTargetStatus(t *testing.T) {
+	cm := NewConnectionMaker(nil, nil, Port)
+	attempted := time.Now()
+	cm.lastAttempt["10.0.0.1:6783"] = attempted
+
+	status := cm.targetStatus("10.0.0.1:6783", &Target{attempting: true})
+	wt.AssertEqualString(t, status.State, TargetConnecting, "state while attempting")
+	wt.AssertTrue(t, status.LastAttempt.Equal(attempted), "last attempt")
+	status = cm.targetStatus("10.0.0.2:6783", &Target{})
+	wt.AssertEqualString(t, status.State, TargetConnecting, "state before the first attempt")
+	wt.AssertTrue(t, status.LastAttempt.IsZero(), "no last attempt")
+
+	target := &Target{attempting: true}
+	for i := 0; i < 20; i++ {
+		target.attempting = false
+		target.lastError = fmt.Errorf("connection refused")
+		target.failures++
+		target.tryAfter, target.tryInterval = tryAfter(target.tryInterval + InitialInterval)
+		status = cm.targetStatus("10.0.0.1:6783", target)
+		if i == 0 {
+			wt.AssertEqualString(t, status.State, TargetRetrying, "state after failing")
+			wt.AssertEqualString(t, status.LastError, "connection refused", "last error")
+		}
+	}
+	wt.AssertEqualString(t, status.State, TargetFailed, "state after failing repeatedly")
+	wt.AssertEqualInt(t, status.Failures, 20, "failures")
+}
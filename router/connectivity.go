@@ -0,0 +1,224 @@
+package router
+
+import (
+	"bytes"
+	"encoding/gob"
+	"log"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// A connectivity check asks every peer, over gossip, to ping every
+// other over the data path, as with DiagPing, and to send back what
+// it found, so that we can tell which pairs of peers can reach each
+// other, however the topology looks from here.
+
+const (
+	DefaultConnectivityProbes = 3
+	// How long we wait for peers' rows, beyond the time their probes
+	// take
+	connectivitySlack = 5 * time.Second
+)
+
+// The kinds of connectivity message
+const (
+	connectivityRequest byte = iota
+	connectivityRow
+)
+
+// ConnectivityCell is what a peer found probing another
+type ConnectivityCell struct {
+	To       PeerName
+	Sent     int
+	Received int
+	RTT      time.Duration // average, of the probes answered
+	Error    string        // why the peer couldn't probe; blank if it did
+}
+
+// ConnectivityMatrix is what each peer that answered found probing the
+// others, by the peer that probed
+type ConnectivityMatrix struct {
+	Peers []PeerName // that we knew of, including us, in order
+	Rows  map[PeerName][]ConnectivityCell
+}
+
+type connectivityMessage struct {
+	ID     uint32
+	Probes int
+	Cells  []ConnectivityCell
+}
+
+type connectivity struct {
+	sync.Mutex
+	router  *Router
+	gossip  Gossip
+	pending map[uint32]chan connectivityAnswer // of checks we are running, by ID
+}
+
+type connectivityAnswer struct {
+	from  PeerName
+	cells []ConnectivityCell
+}
+
+func newConnectivity(router *Router) *connectivity {
+	return &connectivity{router: router, pending: make(map[uint32]chan connectivityAnswer)}
+}
+
+// CheckConnectivity asks every peer we know of, including us, to
+// ping every other with probes probes, and waits for their rows
+func (router *Router) CheckConnectivity(probes int) (*ConnectivityMatrix, error) {
+	if err := checkDiagProbes(probes); err != nil {
+		return nil, err
+	}
+	c := router.connectivity
+	matrix := &ConnectivityMatrix{Rows: make(map[PeerName][]ConnectivityCell)}
+	router.Peers.ForEach(func(peer *Peer) {
+		matrix.Peers = append(matrix.Peers, peer.Name)
+	})
+	sortPeerNames(matrix.Peers)
+	answers := make(chan connectivityAnswer, len(matrix.Peers))
+	c.Lock()
+	id := rand.Uint32()
+	for _, found := c.pending[id]; found; _, found = c.pending[id] {
+		id = rand.Uint32()
+	}
+	c.pending[id] = answers
+	c.Unlock()
+	defer func() {
+		c.Lock()
+		delete(c.pending, id)
+		c.Unlock()
+	}()
+	msg, err := encodeConnectivityMessage(connectivityRequest, connectivityMessage{ID: id, Probes: probes})
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range matrix.Peers {
+		if name == router.Ourself.Name {
+			go func() { answers <- connectivityAnswer{router.Ourself.Name, router.probeAll(probes)} }()
+		} else if err := c.gossip.GossipUnicast(name, msg); err != nil {
+			log.Println("Unable to ask", name, "to check connectivity:", err)
+		}
+	}
+	timeout := time.After(time.Duration(probes)*diagReplyTimeout + connectivitySlack)
+	for len(matrix.Rows) < len(matrix.Peers) {
+		select {
+		case answer := <-answers:
+			matrix.Rows[answer.from] = answer.cells
+		case <-timeout:
+			return matrix, nil
+		}
+	}
+	return matrix, nil
+}
+
+// Ping every other peer we know of at once
+func (router *Router) probeAll(probes int) []ConnectivityCell {
+	var peers []PeerName
+	router.Peers.ForEach(func(peer *Peer) {
+		if peer != router.Ourself.Peer {
+			peers = append(peers, peer.Name)
+		}
+	})
+	sortPeerNames(peers)
+	cells := make([]ConnectivityCell, len(peers))
+	var wg sync.WaitGroup
+	for i, name := range peers {
+		wg.Add(1)
+		go func(cell *ConnectivityCell, name PeerName) {
+			defer wg.Done()
+			cell.To, cell.Sent = name, probes
+			results, err := router.DiagPing(name, probes)
+			if err != nil {
+				cell.Error = err.Error()
+				return
+			}
+			var total time.Duration
+			for _, result := range results {
+				if !result.Lost() {
+					cell.Received++
+					total += result.RTT
+				}
+			}
+			if cell.Received > 0 {
+				cell.RTT = total / time.Duration(cell.Received)
+			}
+		}(&cells[i], name)
+	}
+	wg.Wait()
+	return cells
+}
+
+func encodeConnectivityMessage(kind byte, m connectivityMessage) ([]byte, error) {
+	buf := bytes.NewBuffer([]byte{kind})
+	if err := gob.NewEncoder(buf).Encode(m); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// OnGossipUnicast answers another peer's request to check
+// connectivity, or passes on a peer's row to the check it is for.
+// Failures are only logged, since the connection it came over is fine.
+func (c *connectivity) OnGossipUnicast(sender PeerName, msg []byte) error {
+	var m connectivityMessage
+	if len(msg) < 1 {
+		log.Println("Empty connectivity message from", sender)
+		return nil
+	} else if err := gob.NewDecoder(bytes.NewReader(msg[1:])).Decode(&m); err != nil {
+		log.Println("Unable to decode connectivity message from", sender, err)
+		return nil
+	}
+	switch msg[0] {
+	case connectivityRequest:
+		if err := checkDiagProbes(m.Probes); err != nil {
+			log.Println("Unable to check connectivity for", sender, err)
+			return nil
+		}
+		// probing takes a while, and mustn't hold up gossip
+		go func() {
+			reply, err := encodeConnectivityMessage(connectivityRow, connectivityMessage{ID: m.ID, Cells: c.router.probeAll(m.Probes)})
+			if err == nil {
+				err = c.gossip.GossipUnicast(sender, reply)
+			}
+			if err != nil {
+				log.Println("Unable to tell", sender, "of our connectivity:", err)
+			}
+		}()
+	case connectivityRow:
+		c.Lock()
+		answers, found := c.pending[m.ID]
+		c.Unlock()
+		if found {
+			select {
+			case answers <- connectivityAnswer{sender, m.Cells}:
+			default:
+			}
+		}
+	}
+	return nil
+}
+
+func (c *connectivity) OnGossipBroadcast(update []byte) (GossipData, error) {
+	return nil, nil
+}
+
+func (c *connectivity) Gossip() GossipData {
+	return nil
+}
+
+func (c *connectivity) OnGossip(update []byte) (GossipData, error) {
+	return nil, nil
+}
+
+type peerNames []PeerName
+
+func (ns peerNames) Len() int           { return len(ns) }
+func (ns peerNames) Swap(i, j int)      { ns[i], ns[j] = ns[j], ns[i] }
+func (ns peerNames) Less(i, j int) bool { return ns[i] < ns[j] }
+
+func sortPeerNames(names []PeerName) {
+	sort.Sort(peerNames(names))
+}
@@ -0,0 +1,76 @@
+package router
+
+import (
+	"testing"
+
+	wt "github.com/weaveworks/weave/testing"
+)
+
+// Delivers unicasts straight to other peers' connectivity checks
+type mockConnectivityGossip struct {
+	sender PeerName
+	to     map[PeerName]*connectivity
+}
+
+func (g *mockConnectivityGossip) GossipUnicast(dst PeerName, msg []byte) error {
+	if c, found := g.to[dst]; found {
+		return c.OnGossipUnicast(g.sender, msg)
+	}
+	return nil
+}
+
+func (g *mockConnectivityGossip) GossipBroadcast(update GossipData) error {
+	return nil
+}
+
+func TestConnectivity(t *testing.T) {
+	name1, _ := PeerNameFromString("01:00:00:00:00:01")
+	name2, _ := PeerNameFromString("01:00:00:00:00:02")
+	name3, _ := PeerNameFromString("01:00:00:00:00:03")
+	names := []PeerName{name1, name2, name3}
+	routers := map[PeerName]*Router{}
+	checks := map[PeerName]*connectivity{}
+	for _, name := range names {
+		routers[name] = NewTestRouter(name)
+		checks[name] = routers[name].connectivity
+	}
+	// every peer knows, and has a route to, every other; router3 answers
+	// no probes, and never answers requests to check connectivity
+	for _, name := range names {
+		router := routers[name]
+		for _, other := range names {
+			if other != name {
+				router.Peers.FetchWithDefault(NewPeer(other, "", 0, 0))
+				router.Routes.unicast[other] = other
+			}
+		}
+		router.connectivity.gossip = &mockConnectivityGossip{name, checks}
+		src := NewPeer(name, "", 0, 0)
+		router.diags.send = func(dst *Peer, frame []byte) error {
+			if dst.Name != name3 {
+				routers[dst.Name].handleSelfTestFrame(src, frame)
+			}
+			return nil
+		}
+	}
+	delete(checks, name3)
+
+	_, err := routers[name1].CheckConnectivity(0)
+	wt.AssertTrue(t, err != nil, "no probes")
+	matrix, err := routers[name1].CheckConnectivity(1)
+	wt.AssertNoErr(t, err)
+	wt.AssertEqualInt(t, len(matrix.Peers), 3, "peers")
+	wt.AssertEqualInt(t, len(matrix.Rows), 2, "rows")
+	for _, name := range []PeerName{name1, name2} {
+		row := matrix.Rows[name]
+		wt.AssertEqualInt(t, len(row), 2, "cells")
+		for _, cell := range row {
+			wt.AssertEqualInt(t, cell.Sent, 1, "sent")
+			if cell.To == name3 {
+				wt.AssertEqualInt(t, cell.Received, 0, "received from router3")
+			} else {
+				wt.AssertTrue(t, cell.Received == 1 && cell.RTT > 0 && cell.Error == "", "received")
+			}
+		}
+	}
+}
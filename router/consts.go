@@ -26,6 +26,20 @@ const (
 	HeartbeatTimeout    = MaxMissedHeartbeats * SlowHeartbeat
 )
 
+// The ways the router can exchange frames with its interface
+const (
+	// DatapathPcap captures on the interface, promiscuously, and
+	// injects into it, with libpcap
+	DatapathPcap = "pcap"
+	// DatapathTap plugs a TAP device of our own into the interface,
+	// which must be a bridge, and reads and writes frames through it
+	DatapathTap = "tap"
+	// DatapathAFPacket reads frames from, and writes them to, the
+	// interface through packet sockets, one for each capture worker,
+	// in a fanout group
+	DatapathAFPacket = "afpacket"
+)
+
 var (
 	FragTest      = make([]byte, FragTestSize)
 	PMTUDiscovery = make([]byte, PMTUDiscoverySize)
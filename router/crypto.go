@@ -36,6 +36,17 @@ type Encryptor interface {
 	TotalLen() int
 }
 
+// ParallelEncryptor is an Encryptor whose packets can be encrypted
+// concurrently, by a CryptoPool, once they have been put together,
+// and numbered, in order
+type ParallelEncryptor interface {
+	Encryptor
+	// Take takes the frames appended so far, as the next packet, and
+	// returns a function that encrypts it, which may be called
+	// concurrently with those returned for other packets
+	Take() func() ([]byte, error)
+}
+
 type NonEncryptor struct {
 	buf       []byte
 	bufTail   []byte
@@ -114,11 +125,8 @@ func NewNaClEncryptor(prefix []byte, sessionKey *[32]byte, outbound bool, df boo
 	return ne
 }
 
-func (ne *NaClEncryptor) Bytes() ([]byte, error) {
-	plaintext, err := ne.NonEncryptor.Bytes()
-	if err != nil {
-		return nil, err
-	}
+// Number the next packet
+func (ne *NaClEncryptor) nextSeqNoAndDF() uint64 {
 	// We carry the DF flag in the (unencrypted portion of the)
 	// payload, rather than just extracting it from the packet headers
 	// at the receiving end, since we do not trust routers not to mess
@@ -129,15 +137,42 @@ func (ne *NaClEncryptor) Bytes() ([]byte, error) {
 	if ne.df {
 		seqNoAndDF |= (1 << 63)
 	}
+	ne.seqNo++
+	return seqNoAndDF
+}
+
+func (ne *NaClEncryptor) Bytes() ([]byte, error) {
+	plaintext, err := ne.NonEncryptor.Bytes()
+	if err != nil {
+		return nil, err
+	}
+	seqNoAndDF := ne.nextSeqNoAndDF()
 	ciphertext := ne.buf
 	binary.BigEndian.PutUint64(ciphertext[ne.prefixLen:], seqNoAndDF)
 	binary.BigEndian.PutUint64(ne.nonce[16:24], seqNoAndDF)
 	// Seal *appends* to ciphertext
 	ciphertext = secretbox.Seal(ciphertext[:ne.prefixLen+8], plaintext, &ne.nonce, ne.sessionKey)
-	ne.seqNo++
 	return ciphertext, nil
 }
 
+// Take copies the frames, since the buffer is reused for the next
+// packet, and encrypts them into a buffer of their own, leaving ours
+// alone but for reading the prefix, which doesn't change
+func (ne *NaClEncryptor) Take() func() ([]byte, error) {
+	plaintext, _ := ne.NonEncryptor.Bytes()
+	plaintext = append([]byte(nil), plaintext...)
+	seqNoAndDF := ne.nextSeqNoAndDF()
+	nonce := ne.nonce
+	binary.BigEndian.PutUint64(nonce[16:24], seqNoAndDF)
+	prefix := ne.buf[:ne.prefixLen]
+	return func() ([]byte, error) {
+		ciphertext := make([]byte, len(prefix)+8, len(prefix)+8+len(plaintext)+secretbox.Overhead)
+		copy(ciphertext, prefix)
+		binary.BigEndian.PutUint64(ciphertext[len(prefix):], seqNoAndDF)
+		return secretbox.Seal(ciphertext, plaintext, &nonce, ne.sessionKey), nil
+	}
+}
+
 func (ne *NaClEncryptor) PacketOverhead() int {
 	return ne.prefixLen + 8 + secretbox.Overhead + ne.NonEncryptor.PacketOverhead()
 }
@@ -154,6 +189,26 @@ type Decryptor interface {
 	IterateFrames([]byte, FrameConsumer) error
 }
 
+// ParallelDecryptor is a Decryptor whose packets can be decrypted
+// concurrently, by a CryptoPool, leaving only the checking of their
+// sequence numbers, and handing over of their frames, to be done in
+// the order they were received
+type ParallelDecryptor interface {
+	Decryptor
+	// Open decrypts packet, and may be called concurrently
+	Open(packet []byte) OpenedPacket
+	// IterateOpened passes the frames of packet to consumer, unless
+	// it is a duplicate
+	IterateOpened(packet OpenedPacket, consumer FrameConsumer) error
+}
+
+// OpenedPacket is a packet decrypted by a ParallelDecryptor
+type OpenedPacket struct {
+	seqNoAndDF uint64
+	frames     []byte
+	err        error
+}
+
 type NonDecryptor struct {
 }
 
@@ -217,46 +272,52 @@ func NewNaClDecryptor(sessionKey *[32]byte, outbound bool) *NaClDecryptor {
 }
 
 func (nd *NaClDecryptor) IterateFrames(packet []byte, consumer FrameConsumer) error {
+	return nd.IterateOpened(nd.Open(packet), consumer)
+}
+
+func (nd *NaClDecryptor) instanceFor(seqNoAndDF uint64) *NaClDecryptorInstance {
+	if (seqNoAndDF & (1 << 63)) != 0 {
+		return nd.instanceDF
+	}
+	return nd.instance
+}
+
+// Open only reads the decryptor's state, leaving the nonce in it as
+// it was made, so that it can decrypt many packets at once
+func (nd *NaClDecryptor) Open(packet []byte) OpenedPacket {
 	if len(packet) < 8 {
-		return PacketDecodingError{Desc: fmt.Sprintf("encrypted UDP packet too short; expected length >= 8, got %d", len(packet))}
+		return OpenedPacket{err: PacketDecodingError{Desc: fmt.Sprintf("encrypted UDP packet too short; expected length >= 8, got %d", len(packet))}}
 	}
-	buf, success := nd.decrypt(packet)
+	seqNoAndDF := binary.BigEndian.Uint64(packet[:8])
+	nonce := nd.instanceFor(seqNoAndDF).nonce
+	binary.BigEndian.PutUint64(nonce[16:24], seqNoAndDF)
+	result, success := secretbox.Open(nil, packet[8:], &nonce, nd.sessionKey)
 	if !success {
-		return PacketDecodingError{Desc: fmt.Sprint("UDP packet decryption failed")}
+		return OpenedPacket{err: PacketDecodingError{Desc: fmt.Sprint("UDP packet decryption failed")}}
 	}
-	return nd.NonDecryptor.IterateFrames(buf, consumer)
-}
-
-func (nd *NaClDecryptor) decrypt(buf []byte) ([]byte, bool) {
-	seqNoAndDF := binary.BigEndian.Uint64(buf[:8])
-	df := (seqNoAndDF & (1 << 63)) != 0
-	seqNo := seqNoAndDF & ((1 << 63) - 1)
-	var di *NaClDecryptorInstance
-	if df {
-		di = nd.instanceDF
-	} else {
-		di = nd.instance
-	}
-	binary.BigEndian.PutUint64(di.nonce[16:24], seqNoAndDF)
-	result, success := secretbox.Open(nil, buf[8:], &di.nonce, nd.sessionKey)
-	if !success {
-		return nil, false
+	return OpenedPacket{seqNoAndDF: seqNoAndDF, frames: result}
+}
+
+func (nd *NaClDecryptor) IterateOpened(packet OpenedPacket, consumer FrameConsumer) error {
+	if packet.err != nil {
+		return packet.err
 	}
 	// Drop duplicates. We do this *after* decryption since we must
 	// not advance our state unless decryption succeeded. Doing so
 	// would open an easy attack vector where an adversary could
 	// inject a packet with a sequence number of (1 << 63) - 1,
 	// causing all subsequent genuine packets to get dropped.
-	offset, usedOffsets := di.advanceState(seqNo)
+	di := nd.instanceFor(packet.seqNoAndDF)
+	offset, usedOffsets := di.advanceState(packet.seqNoAndDF & ((1 << 63) - 1))
 	if usedOffsets == nil || usedOffsets.Contains(offset) {
 		// We have detected a possible replay attack, but it is
 		// possible we may have just received a very old packet, or
 		// duplication may have occurred in the network. So let's just
 		// drop the packet silently.
-		return nil, true
+		return nil
 	}
 	usedOffsets.Add(offset)
-	return result, success
+	return nd.NonDecryptor.IterateFrames(packet.frames, consumer)
 }
 
 // We record seen message sequence numbers in a sliding window of
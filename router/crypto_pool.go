@@ -0,0 +1,50 @@
+package router
+
+// CryptoPool encrypts and decrypts the UDP packets of all connections
+// with a fixed number of workers, so that the packets of a busy
+// connection are worked on in parallel rather than one after another.
+// Those using it wait for the results in the order they want them,
+// which is the order the packets are to be sent or were received.
+type CryptoPool struct {
+	jobs    chan func()
+	workers int
+}
+
+func NewCryptoPool(workers int) *CryptoPool {
+	pool := &CryptoPool{jobs: make(chan func(), workers*ChannelSize), workers: workers}
+	for i := 0; i < workers; i++ {
+		go func() {
+			for job := range pool.jobs {
+				job()
+			}
+		}()
+	}
+	return pool
+}
+
+// Go has a worker run job, which must not block
+func (pool *CryptoPool) Go(job func()) {
+	pool.jobs <- job
+}
+
+// Depth is how many packets each user should have in the pool at
+// once: enough to keep every worker busy
+func (pool *CryptoPool) Depth() int {
+	return 2 * pool.workers
+}
+
+type sealedPacket struct {
+	msg []byte
+	err error
+}
+
+// Encrypt the packet the encryptor has taken, with the result to
+// come on the channel returned
+func (pool *CryptoPool) seal(seal func() ([]byte, error)) <-chan sealedPacket {
+	done := make(chan sealedPacket, 1)
+	pool.Go(func() {
+		msg, err := seal()
+		done <- sealedPacket{msg, err}
+	})
+	return done
+}
@@ -0,0 +1,57 @@
+package router
+
+import (
+	"fmt"
+	"testing"
+
+	wt "github.com/weaveworks/weave/testing"
+)
+
+func TestParallelCrypto(t *testing.T) {
+	var key [32]byte
+	copy(key[:], "a session key of thirty-two bytes")
+	prefix := make([]byte, NameSize)
+	src, dst := make([]byte, NameSize), make([]byte, NameSize)
+	enc := NewNaClEncryptor(prefix, &key, true, false)
+	dec := NewNaClDecryptor(&key, false)
+	pool := NewCryptoPool(4)
+
+	const n = 100
+	var sealed []<-chan sealedPacket
+	for i := 0; i < n; i++ {
+		enc.AppendFrame(src, dst, []byte(fmt.Sprint("frame ", i)))
+		sealed = append(sealed, pool.seal(enc.Take()))
+	}
+	// what Bytes encrypts follows on from what Take did
+	enc.AppendFrame(src, dst, []byte(fmt.Sprint("frame ", n)))
+	last, err := enc.Bytes()
+	wt.AssertNoErr(t, err)
+
+	var opened []chan OpenedPacket
+	open := func(msg []byte) {
+		ch := make(chan OpenedPacket, 1)
+		packet := append([]byte(nil), msg[NameSize:]...)
+		pool.Go(func() { ch <- dec.Open(packet) })
+		opened = append(opened, ch)
+	}
+	for _, ch := range sealed {
+		s := <-ch
+		wt.AssertNoErr(t, s.err)
+		open(s.msg)
+	}
+	open(last)
+
+	var frames []string
+	consumer := func(_, _, frame []byte) { frames = append(frames, string(frame)) }
+	for i, ch := range opened {
+		wt.AssertNoErr(t, dec.IterateOpened(<-ch, consumer))
+		wt.AssertEqualInt(t, len(frames), i+1, "frames")
+		wt.AssertEqualString(t, frames[i], fmt.Sprint("frame ", i), "frame")
+	}
+	// a replayed packet is dropped
+	wt.AssertNoErr(t, dec.IterateFrames(last[NameSize:], consumer))
+	wt.AssertEqualInt(t, len(frames), n+1, "frames after replay")
+	// and a corrupted one is an error
+	last[len(last)-1] ^= 1
+	wt.AssertTrue(t, dec.IterateFrames(last[NameSize:], consumer) != nil, "corrupted packet")
+}
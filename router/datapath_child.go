@@ -0,0 +1,301 @@
+package router
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"runtime/debug"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// The router can exchange frames with its interface through a child
+// process, running the same executable, so that should the packet
+// I/O crash, e.g. in libpcap, only that process dies, and is started
+// again, while gossip, IPAM and DNS carry on undisturbed. Frames go
+// between them, one per message, over a socket pair.
+
+const (
+	// Set in the environment of the child, to its configuration
+	datapathChildEnv = "WEAVE_DATAPATH_CHILD"
+	// The child's end of the socket pair, after stdin, stdout and
+	// stderr
+	datapathChildFD = 3
+	// How long the child has to tell us it is capturing
+	datapathChildTimeout = 10 * time.Second
+	// Limits of how long we wait to start the child again after it
+	// dies, doubling each time it dies soon after starting
+	minDatapathChildDelay = time.Second
+	maxDatapathChildDelay = 30 * time.Second
+	// Bigger than any frame
+	maxDatapathFrame = 1 << 17
+	// How often at most we log the frames we drop because handling
+	// them panicked
+	droppedFrameLogInterval = time.Minute
+)
+
+type datapathChildConfig struct {
+	Iface    string
+	Datapath string
+	Tap      string
+	BufSz    int
+	Workers  int
+}
+
+// DatapathChildIO reads frames from, and writes them to, the
+// interface through a child process
+type DatapathChildIO struct {
+	conn      *net.UnixConn
+	cmd       *exec.Cmd
+	buf       []byte
+	closeOnce sync.Once
+}
+
+// NewDatapathChildIO starts a child process capturing on, and
+// injecting into, iface, as config has it
+func NewDatapathChildIO(config RouterConfig, iface *net.Interface) (*DatapathChildIO, error) {
+	spec, err := json.Marshal(datapathChildConfig{
+		Iface: iface.Name, Datapath: config.Datapath, Tap: config.Tap, BufSz: config.BufSz, Workers: config.Workers})
+	if err != nil {
+		return nil, err
+	}
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, err
+	}
+	ours, theirs := os.NewFile(uintptr(fds[0]), "datapath"), os.NewFile(uintptr(fds[1]), "datapath-child")
+	defer theirs.Close()
+	conn, err := net.FileConn(ours)
+	ours.Close()
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.Command("/proc/self/exe")
+	cmd.Env = append(os.Environ(), datapathChildEnv+"="+string(spec))
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	cmd.ExtraFiles = []*os.File{theirs}
+	cmd.SysProcAttr = &syscall.SysProcAttr{Pdeathsig: syscall.SIGKILL}
+	if err := cmd.Start(); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("Unable to start datapath process: %s", err)
+	}
+	cio := &DatapathChildIO{conn: conn.(*net.UnixConn), cmd: cmd, buf: make([]byte, maxDatapathFrame)}
+	go cio.wait()
+	// the first message says whether the child could open the
+	// interface
+	cio.conn.SetReadDeadline(time.Now().Add(datapathChildTimeout))
+	msg, err := cio.ReadPacket()
+	cio.conn.SetReadDeadline(time.Time{})
+	switch {
+	case err != nil:
+		err = fmt.Errorf("Datapath process failed to start: %s", err)
+	case len(msg) == 0:
+		err = fmt.Errorf("Datapath process failed to start")
+	case msg[0] != 0:
+		err = fmt.Errorf("Datapath process failed to start: %s", msg[1:])
+	}
+	if err != nil {
+		cio.Close()
+		return nil, err
+	}
+	log.Println("Started datapath process", cmd.Process.Pid)
+	return cio, nil
+}
+
+func (cio *DatapathChildIO) wait() {
+	err := cio.cmd.Wait()
+	if err == nil {
+		err = fmt.Errorf("exit status 0")
+	}
+	log.Printf("Datapath process %d exited: %s", cio.cmd.Process.Pid, err)
+}
+
+// Pid is the process ID of the child
+func (cio *DatapathChildIO) Pid() int {
+	return cio.cmd.Process.Pid
+}
+
+func (cio *DatapathChildIO) ReadPacket() ([]byte, error) {
+	n, err := cio.conn.Read(cio.buf)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{}, cio.buf[:n]...), nil
+}
+
+func (cio *DatapathChildIO) WritePacket(data []byte) error {
+	_, err := cio.conn.Write(data)
+	return err
+}
+
+// Close stops the child, if it is still running
+func (cio *DatapathChildIO) Close() error {
+	cio.closeOnce.Do(func() {
+		cio.conn.Close()
+		if cio.cmd != nil {
+			cio.cmd.Process.Kill()
+		}
+	})
+	return nil
+}
+
+// Note when the child capturing through pio, if it is one, started
+func (router *Router) noteDatapathChild(pio PacketSourceSink) {
+	if cio, ok := pio.(*DatapathChildIO); ok {
+		router.childPid, router.childStarted = cio.Pid(), time.Now()
+	}
+}
+
+// Called with captureLock held, once the child has died, to start
+// another
+func (router *Router) restartDatapathChild() {
+	if router.childDelay == 0 || time.Since(router.childStarted) > maxDatapathChildDelay {
+		router.childDelay = minDatapathChildDelay
+	} else if router.childDelay *= 2; router.childDelay > maxDatapathChildDelay {
+		router.childDelay = maxDatapathChildDelay
+	}
+	router.childRestarts++
+	log.Println("Starting datapath process again in", router.childDelay)
+	time.AfterFunc(router.childDelay, func() {
+		router.captureLock.Lock()
+		defer router.captureLock.Unlock()
+		if router.Capturing() || router.Iface == nil {
+			return
+		}
+		if err := router.startCapture(router.Iface); err != nil {
+			log.Println("Unable to sniff traffic on", router.Iface.Name, err)
+			router.restartDatapathChild()
+		}
+	})
+}
+
+// DatapathRestarts is how many times the datapath process has been
+// started again, having died
+func (router *Router) DatapathRestarts() int {
+	router.captureLock.Lock()
+	defer router.captureLock.Unlock()
+	return router.childRestarts
+}
+
+type droppedFrames struct {
+	sync.Mutex
+	logged time.Time
+	count  int // since we last logged
+}
+
+// A frame from the child could make us panic in handling it, e.g. in
+// decoding it, taking down gossip, IPAM and DNS with us, when it is
+// the child that is there to crash; so we drop the frame instead.
+// Bad frames tend to keep coming, so we log where the first panicked,
+// and after that only how many more there have been, at most every
+// droppedFrameLogInterval.
+func (router *Router) recoverCapturedFrame(frame []byte) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	df := &router.droppedFrames
+	df.Lock()
+	defer df.Unlock()
+	df.count++
+	now := time.Now()
+	switch {
+	case df.logged.IsZero():
+		log.Printf("Dropped captured frame of %d bytes: %v\n%s", len(frame), r, debug.Stack())
+	case now.Sub(df.logged) >= droppedFrameLogInterval:
+		log.Printf("Dropped %d captured frames since %s, the last of %d bytes: %v", df.count, df.logged.Format(time.RFC3339), len(frame), r)
+	default:
+		return
+	}
+	df.logged, df.count = now, 0
+}
+
+// IsDatapathChild says whether we were started by a router to
+// exchange frames with its interface for it
+func IsDatapathChild() bool {
+	return os.Getenv(datapathChildEnv) != ""
+}
+
+// RunDatapathChild exchanges frames between the interface and the
+// router that started us, until it goes away, returning the status
+// to exit with
+func RunDatapathChild() int {
+	log.SetPrefix("datapath: ")
+	c, err := net.FileConn(os.NewFile(datapathChildFD, "datapath"))
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+	conn := c.(*net.UnixConn)
+	var (
+		spec  datapathChildConfig
+		iface *net.Interface
+		pio   PacketSourceSink
+		po    PacketSink
+	)
+	err = json.Unmarshal([]byte(os.Getenv(datapathChildEnv)), &spec)
+	if err == nil {
+		iface, err = net.InterfaceByName(spec.Iface)
+	}
+	if err == nil {
+		router := &Router{RouterConfig: RouterConfig{Datapath: spec.Datapath, Tap: spec.Tap, BufSz: spec.BufSz, Workers: spec.Workers}}
+		pio, po, err = router.openCapture(iface)
+	}
+	if err != nil {
+		conn.Write(append([]byte{1}, err.Error()...))
+		return 1
+	}
+	conn.Write([]byte{0})
+	err = relayFrames(conn, pio, po)
+	closePacketIO(pio)
+	if po != pio {
+		closePacketIO(po)
+	}
+	if err == io.EOF {
+		// the router has gone
+		return 0
+	}
+	log.Println(err)
+	return 1
+}
+
+// Pass the frames read from pio to the router at the other end of
+// conn, and inject those it sends into po, until either fails
+func relayFrames(conn *net.UnixConn, pio PacketSourceSink, po PacketSink) error {
+	sources := []PacketSource{pio}
+	if fanout, ok := pio.(FanoutSource); ok {
+		sources = fanout.Sources()
+	}
+	errs := make(chan error, len(sources)+1)
+	for _, source := range sources {
+		go func(source PacketSource) {
+			for {
+				pkt, err := source.ReadPacket()
+				if err == nil {
+					_, err = conn.Write(pkt)
+				}
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(source)
+	}
+	go func() {
+		buf := make([]byte, maxDatapathFrame)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				errs <- err
+				return
+			}
+			checkWarn(po.WritePacket(buf[:n]))
+		}
+	}()
+	return <-errs
+}
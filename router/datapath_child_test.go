@@ -0,0 +1,77 @@
+package router
+
+import (
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+
+	wt "github.com/weaveworks/weave/testing"
+)
+
+type chanIO struct {
+	in  chan []byte
+	out chan []byte
+}
+
+func (c *chanIO) ReadPacket() ([]byte, error) {
+	pkt, ok := <-c.in
+	if !ok {
+		return nil, io.EOF
+	}
+	return pkt, nil
+}
+
+func (c *chanIO) WritePacket(data []byte) error {
+	c.out <- append([]byte{}, data...)
+	return nil
+}
+
+func socketPair(t *testing.T) (*net.UnixConn, *net.UnixConn) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET, 0)
+	wt.AssertNoErr(t, err)
+	conns := make([]*net.UnixConn, 2)
+	for i, fd := range fds {
+		file := os.NewFile(uintptr(fd), "test")
+		conn, err := net.FileConn(file)
+		wt.AssertNoErr(t, err)
+		file.Close()
+		conns[i] = conn.(*net.UnixConn)
+	}
+	return conns[0], conns[1]
+}
+
+func TestDatapathChildRelay(t *testing.T) {
+	ours, theirs := socketPair(t)
+	cio := &DatapathChildIO{conn: ours, buf: make([]byte, maxDatapathFrame)}
+	iface := &chanIO{in: make(chan []byte, 4), out: make(chan []byte, 4)}
+	relayed := make(chan error, 1)
+	go func() { relayed <- relayFrames(theirs, iface, iface) }()
+
+	// frames keep their boundaries, big or small
+	big := make([]byte, 65535)
+	big[len(big)-1] = 1
+	iface.in <- []byte{1, 2, 3}
+	iface.in <- big
+	pkt, err := cio.ReadPacket()
+	wt.AssertNoErr(t, err)
+	wt.AssertEquals(t, pkt, []byte{1, 2, 3})
+	pkt, err = cio.ReadPacket()
+	wt.AssertNoErr(t, err)
+	wt.AssertEquals(t, pkt, big)
+
+	wt.AssertNoErr(t, cio.WritePacket([]byte{4, 5}))
+	wt.AssertEquals(t, <-iface.out, []byte{4, 5})
+
+	// the child stops when we go away
+	cio.Close()
+	wt.AssertEquals(t, <-relayed, io.EOF)
+
+	// and we see it if the child does
+	ours, theirs = socketPair(t)
+	cio = &DatapathChildIO{conn: ours, buf: make([]byte, maxDatapathFrame)}
+	theirs.Close()
+	_, err = cio.ReadPacket()
+	wt.AssertEquals(t, err, io.EOF)
+}
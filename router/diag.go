@@ -0,0 +1,299 @@
+package router
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"code.google.com/p/gopacket/layers"
+	weavenet "github.com/weaveworks/weave/net"
+)
+
+// Diagnostics of the data path, as ping and traceroute. Probes to a
+// peer are self-test frames, which it answers; with a hop limit, as
+// for traceroute, the peer relaying a probe when the limit runs out
+// answers instead. Probes of a container's address are ARP requests,
+// broadcast over the overlay, and injected locally, which only the
+// container answers, proving the whole path to it, and telling us
+// which peer it is on.
+
+const (
+	DefaultDiagProbes = 5
+	MaxDiagProbes     = 20
+	MaxDiagHops       = 16
+	diagPingHops      = 255
+	diagReplyTimeout  = time.Second
+	diagLocateTries   = 3
+)
+
+// A probe's a is its hop limit, in the top byte, and its sequence
+// number
+func diagProbeA(hops int, seq uint64) uint64 {
+	return uint64(hops)<<56 | seq
+}
+
+// DiagProbe is the outcome of a probe
+type DiagProbe struct {
+	Peer    *Peer  // which answered; nil if none did
+	Address net.IP // of the container that answered, to an ARP probe
+	RTT     time.Duration
+}
+
+func (p DiagProbe) Lost() bool {
+	return p.Peer == nil
+}
+
+type diagResponse struct {
+	from *Peer
+	seq  uint64
+	at   time.Time
+}
+
+type diags struct {
+	sync.Mutex
+	replies map[uint32]chan diagResponse // to probes, by ID
+	arps    map[string]chan diagResponse // to ARP probes, by the address asked for
+	arping  int32                        // how many ARP probes are waiting, so that frames needn't lock
+	send    func(dst *Peer, frame []byte) error
+}
+
+func newDiags(router *Router) *diags {
+	return &diags{
+		replies: make(map[uint32]chan diagResponse),
+		arps:    make(map[string]chan diagResponse),
+		send: func(dst *Peer, frame []byte) error {
+			return router.Ourself.Forward(dst, false, frame, nil)
+		}}
+}
+
+func (ds *diags) register() (uint32, chan diagResponse) {
+	replies := make(chan diagResponse, MaxDiagHops)
+	ds.Lock()
+	defer ds.Unlock()
+	id := rand.Uint32()
+	for _, found := ds.replies[id]; found; _, found = ds.replies[id] {
+		id = rand.Uint32()
+	}
+	ds.replies[id] = replies
+	return id, replies
+}
+
+func (ds *diags) unregister(id uint32) {
+	ds.Lock()
+	defer ds.Unlock()
+	delete(ds.replies, id)
+}
+
+// Pass on an answer to a probe of ours, from peer
+func (ds *diags) deliver(peer *Peer, f selfTestFrame) {
+	ds.Lock()
+	replies, found := ds.replies[f.id]
+	ds.Unlock()
+	if found {
+		select {
+		case replies <- diagResponse{peer, f.a &^ (0xff << 56), time.Now()}:
+		default:
+		}
+	}
+}
+
+// Wait for the reply to the probe with sequence number seq
+func awaitDiagReply(replies <-chan diagResponse, seq uint64, sent time.Time) DiagProbe {
+	timeout := time.After(diagReplyTimeout)
+	for {
+		select {
+		case reply := <-replies:
+			if reply.seq == seq {
+				return DiagProbe{Peer: reply.from, RTT: reply.at.Sub(sent)}
+			}
+		case <-timeout:
+			return DiagProbe{}
+		}
+	}
+}
+
+func (router *Router) diagTarget(name PeerName) (*Peer, error) {
+	peer, found := router.Peers.Fetch(name)
+	if !found {
+		return nil, fmt.Errorf("Unknown peer %s", name)
+	}
+	if peer == router.Ourself.Peer {
+		return nil, fmt.Errorf("Unable to probe ourself")
+	}
+	if _, found := router.Routes.Unicast(name); !found {
+		return nil, fmt.Errorf("No route to peer %s", peer)
+	}
+	return peer, nil
+}
+
+func checkDiagProbes(count int) error {
+	if count <= 0 || count > MaxDiagProbes {
+		return fmt.Errorf("Invalid number of probes %d: expected up to %d", count, MaxDiagProbes)
+	}
+	return nil
+}
+
+// DiagPing sends count probes to the named peer over the overlay, one
+// after the other
+func (router *Router) DiagPing(name PeerName, count int) ([]DiagProbe, error) {
+	if err := checkDiagProbes(count); err != nil {
+		return nil, err
+	}
+	peer, err := router.diagTarget(name)
+	if err != nil {
+		return nil, err
+	}
+	ds := router.diags
+	id, replies := ds.register()
+	defer ds.unregister(id)
+	probes := make([]DiagProbe, count)
+	for seq := range probes {
+		sent := time.Now()
+		if err := ds.send(peer, selfTestFrame{diagProbe, id, diagProbeA(diagPingHops, uint64(seq)), 0}.encode(selfTestHeaderSize)); err != nil {
+			return nil, err
+		}
+		probes[seq] = awaitDiagReply(replies, uint64(seq), sent)
+	}
+	return probes, nil
+}
+
+// DiagTraceroute sends probes to the named peer with hop limits of 1
+// and up, until it answers, returning the probe for each hop
+func (router *Router) DiagTraceroute(name PeerName) ([]DiagProbe, error) {
+	peer, err := router.diagTarget(name)
+	if err != nil {
+		return nil, err
+	}
+	ds := router.diags
+	id, replies := ds.register()
+	defer ds.unregister(id)
+	var hops []DiagProbe
+	for hop := 1; hop <= MaxDiagHops; hop++ {
+		sent := time.Now()
+		if err := ds.send(peer, selfTestFrame{diagProbe, id, diagProbeA(hop, uint64(hop)), 0}.encode(selfTestHeaderSize)); err != nil {
+			return nil, err
+		}
+		probe := awaitDiagReply(replies, uint64(hop), sent)
+		hops = append(hops, probe)
+		if probe.Peer == peer {
+			break
+		}
+	}
+	return hops, nil
+}
+
+// Answer a probe that has run out of hops, rather than relaying it,
+// returning whether we did, or take one off its hop limit
+func (router *Router) expireDiagProbe(srcPeer *Peer, frame []byte) bool {
+	f, ok := decodeSelfTestFrame(frame)
+	if !ok || f.kind != diagProbe {
+		return false
+	}
+	if f.a>>56 <= 1 {
+		checkWarn(router.diags.send(srcPeer, selfTestFrame{diagExpired, f.id, f.a, 0}.encode(selfTestHeaderSize)))
+		return true
+	}
+	binary.BigEndian.PutUint64(frame[EthernetOverhead+5:], f.a-1<<56)
+	return false
+}
+
+// DiagPingIP sends count ARP probes for the container with address
+// ip, wherever it is, one after the other
+func (router *Router) DiagPingIP(ip net.IP, count int) ([]DiagProbe, error) {
+	if err := checkDiagProbes(count); err != nil {
+		return nil, err
+	}
+	if ip = ip.To4(); ip == nil {
+		return nil, fmt.Errorf("Unable to probe an address that isn't IPv4")
+	}
+	iface := router.capturedIface()
+	if iface == nil {
+		return nil, fmt.Errorf("Unable to probe containers without an interface")
+	}
+	ds := router.diags
+	replies := make(chan diagResponse, 1)
+	ds.Lock()
+	if _, found := ds.arps[string(ip)]; found {
+		ds.Unlock()
+		return nil, fmt.Errorf("Already probing %s", ip)
+	}
+	ds.arps[string(ip)] = replies
+	atomic.AddInt32(&ds.arping, 1)
+	ds.Unlock()
+	defer func() {
+		ds.Lock()
+		delete(ds.arps, string(ip))
+		atomic.AddInt32(&ds.arping, -1)
+		ds.Unlock()
+	}()
+	// the container answering doesn't learn of us from the probe
+	frame := weavenet.ARPProbe(iface.HardwareAddr, ip)
+	probes := make([]DiagProbe, count)
+	for seq := range probes {
+		// ARP replies have no sequence number, so drop any late
+		// reply to the last probe
+		select {
+		case <-replies:
+		default:
+		}
+		sent := time.Now()
+		checkWarn(router.injector.WritePacket(frame))
+		router.Ourself.Broadcast(false, frame, nil)
+		probes[seq] = awaitDiagReply(replies, 0, sent)
+		probes[seq].Address = ip
+	}
+	return probes, nil
+}
+
+// DiagTracerouteIP finds the peer the container with address ip is
+// on, with ARP probes, and traces the route to it, returning the probe
+// for each hop, the last being the container's answer
+func (router *Router) DiagTracerouteIP(ip net.IP) ([]DiagProbe, error) {
+	var located DiagProbe
+	for i := 0; i < diagLocateTries && located.Lost(); i++ {
+		probes, err := router.DiagPingIP(ip, 1)
+		if err != nil {
+			return nil, err
+		}
+		located = probes[0]
+	}
+	if located.Lost() || located.Peer == router.Ourself.Peer {
+		return []DiagProbe{located}, nil
+	}
+	hops, err := router.DiagTraceroute(located.Peer.Name)
+	if err != nil {
+		return nil, err
+	}
+	return append(hops, located), nil
+}
+
+// Note an ARP reply, from a container on peer, to one of our ARP
+// probes
+func (router *Router) noteARPReply(peer *Peer, dec *EthernetDecoder) {
+	if atomic.LoadInt32(&router.diags.arping) == 0 || dec.eth.EthernetType != layers.EthernetTypeARP {
+		return
+	}
+	iface := router.capturedIface()
+	if iface == nil {
+		return
+	}
+	arp := dec.eth.Payload
+	if len(arp) < 28 || binary.BigEndian.Uint16(arp[6:]) != 2 || !bytes.Equal(arp[18:24], iface.HardwareAddr) {
+		return
+	}
+	ds := router.diags
+	ds.Lock()
+	replies, found := ds.arps[string(arp[14:18])]
+	ds.Unlock()
+	if found {
+		select {
+		case replies <- diagResponse{peer, 0, time.Now()}:
+		default:
+		}
+	}
+}
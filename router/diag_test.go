@@ -0,0 +1,108 @@
+package router
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+
+	wt "github.com/weaveworks/weave/testing"
+)
+
+// Answers the ARP probes injected into it, as a container would
+type arpResponder struct {
+	router *Router
+	peer   *Peer // the container is on
+	mac    net.HardwareAddr
+	ip     net.IP
+}
+
+func (a *arpResponder) WritePacket(frame []byte) error {
+	reply := make([]byte, len(frame))
+	copy(reply, frame)
+	copy(reply[0:6], frame[6:12])
+	copy(reply[6:12], a.mac)
+	arp := reply[EthernetOverhead:]
+	binary.BigEndian.PutUint16(arp[6:], 2)
+	copy(arp[8:14], a.mac)
+	copy(arp[14:18], a.ip.To4())
+	copy(arp[18:24], frame[6:12])
+	copy(arp[24:28], net.IPv4zero.To4())
+	dec := NewEthernetDecoder()
+	dec.DecodeLayers(reply)
+	a.router.noteARPReply(a.peer, dec)
+	return nil
+}
+
+func TestDiagProbes(t *testing.T) {
+	name1, _ := PeerNameFromString("01:00:00:00:00:01")
+	name2, _ := PeerNameFromString("01:00:00:00:00:02")
+	name3, _ := PeerNameFromString("01:00:00:00:00:03")
+	router1, router2, router3 := NewTestRouter(name1), NewTestRouter(name2), NewTestRouter(name3)
+	// router1 reaches router3 through router2
+	peer2 := router1.Peers.FetchWithDefault(NewPeer(name2, "", 0, 0))
+	peer3 := router1.Peers.FetchWithDefault(NewPeer(name3, "", 0, 0))
+	router1.Routes.unicast[name2] = name2
+	router1.Routes.unicast[name3] = name2
+	peer1 := NewPeer(name1, "", 0, 0)
+	router1.diags.send = func(dst *Peer, frame []byte) error {
+		if dst.Name == name2 {
+			router2.handleSelfTestFrame(peer1, frame)
+		} else if !router2.expireDiagProbe(peer1, frame) {
+			router3.handleSelfTestFrame(peer1, frame)
+		}
+		return nil
+	}
+	router2.diags.send = func(dst *Peer, frame []byte) error {
+		router1.handleSelfTestFrame(peer2, frame)
+		return nil
+	}
+	router3.diags.send = func(dst *Peer, frame []byte) error {
+		router1.handleSelfTestFrame(peer3, frame)
+		return nil
+	}
+
+	probes, err := router1.DiagPing(name3, 3)
+	wt.AssertNoErr(t, err)
+	wt.AssertEqualInt(t, len(probes), 3, "probes")
+	for _, probe := range probes {
+		wt.AssertTrue(t, probe.Peer == peer3 && probe.RTT > 0, "answered by the peer probed")
+	}
+	hops, err := router1.DiagTraceroute(name3)
+	wt.AssertNoErr(t, err)
+	wt.AssertEqualInt(t, len(hops), 2, "hops")
+	wt.AssertTrue(t, hops[0].Peer == peer2 && hops[1].Peer == peer3, "hops")
+
+	_, err = router1.DiagPing(name1, 1)
+	wt.AssertTrue(t, err != nil, "probing ourself")
+	_, err = router1.DiagPing(name2, 0)
+	wt.AssertTrue(t, err != nil, "no probes")
+
+	// probes nobody answers are lost
+	router3.diags.send = func(dst *Peer, frame []byte) error { return nil }
+	probes, err = router1.DiagPing(name3, 1)
+	wt.AssertNoErr(t, err)
+	wt.AssertTrue(t, probes[0].Lost(), "lost")
+
+	// a container on router3, which answers ARP probes
+	ip := net.ParseIP("10.2.1.7")
+	_, err = router1.DiagPingIP(ip, 1)
+	wt.AssertTrue(t, err != nil, "probing a container without an interface")
+	router3.diags.send = func(dst *Peer, frame []byte) error {
+		router1.handleSelfTestFrame(peer3, frame)
+		return nil
+	}
+	mac, _ := net.ParseMAC("02:00:00:00:00:01")
+	router1.Iface = &net.Interface{Name: "vethwe-pcap", HardwareAddr: mac}
+	containerMAC, _ := net.ParseMAC("02:00:00:00:00:07")
+	router1.injector.set(&arpResponder{router1, peer3, containerMAC, ip})
+	probes, err = router1.DiagPingIP(ip, 2)
+	wt.AssertNoErr(t, err)
+	for _, probe := range probes {
+		wt.AssertTrue(t, probe.Peer == peer3 && probe.Address.Equal(ip), "answered by the container")
+	}
+	hops, err = router1.DiagTracerouteIP(ip)
+	wt.AssertNoErr(t, err)
+	wt.AssertEqualInt(t, len(hops), 3, "hops to the container")
+	wt.AssertTrue(t, hops[1].Peer == peer3 && hops[1].Address == nil, "the container's peer")
+	wt.AssertTrue(t, hops[2].Peer == peer3 && hops[2].Address.Equal(ip), "the container")
+}
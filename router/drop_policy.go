@@ -0,0 +1,84 @@
+package router
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// What a connection does with frames to send when its queue is full,
+// because it can't send, or encrypt, them as fast as they come
+const (
+	// DropPolicyBlock has whoever is forwarding the frame, usually
+	// the capture, wait for room in the queue, so that frames back
+	// up into the capture buffer, and are lost there, if at all
+	DropPolicyBlock = "block-capture"
+	// DropPolicyNewest drops the frame, keeping those queued
+	DropPolicyNewest = "drop-newest"
+	// DropPolicyOldest drops the frame that has been queued longest,
+	// to make room for the new one
+	DropPolicyOldest = "drop-oldest"
+)
+
+// DropCounters count the frames that found a connection's queue full,
+// and those dropped on that account
+type DropCounters struct {
+	QueueFull     uint64
+	FramesDropped uint64
+}
+
+// Totals reads the counters
+func (c *DropCounters) Totals() DropCounters {
+	return DropCounters{
+		QueueFull:     atomic.LoadUint64(&c.QueueFull),
+		FramesDropped: atomic.LoadUint64(&c.FramesDropped)}
+}
+
+func (c DropCounters) String() string {
+	return fmt.Sprintf("%d frames found a connection's queue full, %d frames dropped\n", c.QueueFull, c.FramesDropped)
+}
+
+// Queue the frame, to be sent, as the drop policy has it when the
+// queue is full
+func (fwd *Forwarder) Forward(frame *ForwardedFrame) {
+	select {
+	case fwd.ch <- frame:
+		return
+	case <-fwd.finished:
+		return
+	default:
+	}
+	atomic.AddUint64(&fwd.drops.QueueFull, 1)
+	switch fwd.dropPolicy {
+	case DropPolicyNewest:
+		atomic.AddUint64(&fwd.drops.FramesDropped, 1)
+		return
+	case DropPolicyOldest:
+		for {
+			select {
+			case fwd.ch <- frame:
+				return
+			case <-fwd.finished:
+				return
+			default:
+			}
+			select {
+			case oldest := <-fwd.ch:
+				if oldest == nil {
+					// we are shutting down, so put that back
+					// for the forwarder, and forget this one
+					select {
+					case fwd.ch <- nil:
+					case <-fwd.finished:
+					}
+					return
+				}
+				atomic.AddUint64(&fwd.drops.FramesDropped, 1)
+			default:
+			}
+		}
+	}
+	select {
+	case fwd.ch <- frame:
+	case <-fwd.finished:
+	}
+}
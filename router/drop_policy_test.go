@@ -0,0 +1,60 @@
+package router
+
+import (
+	"testing"
+	"time"
+
+	wt "github.com/weaveworks/weave/testing"
+)
+
+func TestDropPolicies(t *testing.T) {
+	frames := []*ForwardedFrame{{frame: []byte{1}}, {frame: []byte{2}}, {frame: []byte{3}}}
+	queued := func(fwd *Forwarder) []byte {
+		var got []byte
+		for len(fwd.ch) > 0 {
+			got = append(got, (<-fwd.ch).frame[0])
+		}
+		return got
+	}
+	newForwarder := func(policy string) *Forwarder {
+		return &Forwarder{ch: make(chan *ForwardedFrame, 2), finished: make(chan struct{}), dropPolicy: policy, drops: &DropCounters{}}
+	}
+
+	fwd := newForwarder(DropPolicyNewest)
+	for _, frame := range frames {
+		fwd.Forward(frame)
+	}
+	wt.AssertEquals(t, queued(fwd), []byte{1, 2})
+	wt.AssertEquals(t, fwd.drops.Totals(), DropCounters{QueueFull: 1, FramesDropped: 1})
+
+	fwd = newForwarder(DropPolicyOldest)
+	for _, frame := range frames {
+		fwd.Forward(frame)
+	}
+	wt.AssertEquals(t, queued(fwd), []byte{2, 3})
+	wt.AssertEquals(t, fwd.drops.Totals(), DropCounters{QueueFull: 1, FramesDropped: 1})
+
+	// the forwarder shutting down is not dropped
+	fwd.ch <- nil
+	fwd.ch <- frames[0]
+	fwd.Forward(frames[2])
+	wt.AssertTrue(t, <-fwd.ch == frames[0] && <-fwd.ch == nil && len(fwd.ch) == 0, "shutdown kept")
+
+	fwd = newForwarder(DropPolicyBlock)
+	fwd.Forward(frames[0])
+	fwd.Forward(frames[1])
+	done := make(chan struct{})
+	go func() {
+		fwd.Forward(frames[2])
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("should have waited for room in the queue")
+	case <-time.After(10 * time.Millisecond):
+	}
+	wt.AssertEquals(t, (<-fwd.ch).frame, []byte{1})
+	<-done
+	wt.AssertEquals(t, queued(fwd), []byte{2, 3})
+	wt.AssertEquals(t, fwd.drops.Totals(), DropCounters{QueueFull: 1})
+}
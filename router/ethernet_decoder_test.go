@@ -0,0 +1,137 @@
+package router
+
+import (
+	"code.google.com/p/gopacket"
+	"code.google.com/p/gopacket/layers"
+	wt "github.com/weaveworks/weave/testing"
+	"testing"
+)
+
+var (
+	srcMAC = []byte{0x02, 0, 0, 0, 0, 0x01}
+	dstMAC = []byte{0x02, 0, 0, 0, 0, 0x02}
+)
+
+func serialize(t testing.TB, ls ...gopacket.SerializableLayer) []byte {
+	buf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}, ls...); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// A TCP segment from 10.0.0.1 to 10.0.0.2, with DF set
+func tcpFrame(t testing.TB) []byte {
+	ip := &layers.IPv4{Version: 4, IHL: 5, TTL: 64, TOS: 0x10, Id: 7, Flags: layers.IPv4DontFragment,
+		Protocol: layers.IPProtocolTCP, SrcIP: []byte{10, 0, 0, 1}, DstIP: []byte{10, 0, 0, 2}}
+	tcp := &layers.TCP{SrcPort: 1234, DstPort: 80, Seq: 1, Window: 1024}
+	tcp.SetNetworkLayerForChecksum(ip)
+	return serialize(t, &layers.Ethernet{SrcMAC: srcMAC, DstMAC: dstMAC, EthernetType: layers.EthernetTypeIPv4},
+		ip, tcp, gopacket.Payload(make([]byte, 1400)))
+}
+
+func arpFrame(t testing.TB) []byte {
+	return serialize(t, &layers.Ethernet{SrcMAC: srcMAC, DstMAC: layers.EthernetBroadcast, EthernetType: layers.EthernetTypeARP},
+		&layers.ARP{AddrType: layers.LinkTypeEthernet, Protocol: layers.EthernetTypeIPv4, HwAddressSize: 6, ProtAddressSize: 4,
+			Operation: layers.ARPRequest, SourceHwAddress: srcMAC, SourceProtAddress: []byte{10, 0, 0, 1},
+			DstHwAddress: make([]byte, 6), DstProtAddress: []byte{10, 0, 0, 2}})
+}
+
+func BenchmarkDecodeIPv4(b *testing.B) {
+	frame := tcpFrame(b)
+	dec := NewEthernetDecoder()
+	b.ReportAllocs()
+	b.SetBytes(int64(len(frame)))
+	for i := 0; i < b.N; i++ {
+		dec.DecodeLayers(frame)
+	}
+}
+
+func BenchmarkDecodeARP(b *testing.B) {
+	frame := arpFrame(b)
+	dec := NewEthernetDecoder()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		dec.DecodeLayers(frame)
+	}
+}
+
+func BenchmarkFlowCount(b *testing.B) {
+	frame := tcpFrame(b)
+	dec := NewEthernetDecoder()
+	dec.DecodeLayers(frame)
+	fc := NewFlowCounters()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		fc.Count(dec, nil, true, len(frame))
+	}
+}
+
+// Decoding a frame, and handling it, once we have seen its like, must
+// not allocate, other than for the copy of a captured frame we hand
+// to the forwarders
+func TestDecodeAllocations(t *testing.T) {
+	name, _ := PeerNameFromString("01:00:00:01:00:00")
+	router := NewTestRouter(name)
+	router.LogFrame = func(string, []byte, *layers.Ethernet) {}
+	srcName, _ := PeerNameFromString("02:00:00:01:00:00")
+	router.Peers.FetchWithDefault(NewPeer(srcName, "", 0, 0))
+	dec := NewEthernetDecoder()
+	consume := router.handleUDPPacketFunc(nil, NewEthernetDecoder(), nil, nil)
+	src, dst := srcName.Bin(), name.Bin()
+	for _, frame := range [][]byte{tcpFrame(t), arpFrame(t)} {
+		wt.AssertTrue(t, testing.AllocsPerRun(100, func() { dec.DecodeLayers(frame) }) == 0, "decoding allocates")
+		wt.AssertTrue(t, testing.AllocsPerRun(100, func() { router.Flows.Count(dec, nil, true, len(frame)) }) == 0, "counting flows allocates")
+		wt.AssertTrue(t, testing.AllocsPerRun(100, func() { router.handleCapturedPacket(frame, dec, nil) }) <= 1, "forwarding allocates")
+		wt.AssertTrue(t, testing.AllocsPerRun(100, func() { consume(src, dst, frame) }) == 0, "injecting allocates")
+	}
+}
+
+func TestCapturedFramePanic(t *testing.T) {
+	name, _ := PeerNameFromString("01:00:00:01:00:00")
+	router := NewTestRouter(name)
+	handled := 0
+	router.LogFrame = func(string, []byte, *layers.Ethernet) {
+		handled++
+		panic("bad frame")
+	}
+	frame := tcpFrame(t)
+	// without a datapath process, it is the router that crashes
+	func() {
+		defer func() { wt.AssertTrue(t, recover() != nil, "panic passed on") }()
+		router.handleCapturedPacket(frame, NewEthernetDecoder(), nil)
+	}()
+	// with one, we drop the frame, logging the first of a run
+	router.DatapathChild = true
+	router.handleCapturedPacket(frame, NewEthernetDecoder(), nil)
+	router.handleCapturedPacket(frame, NewEthernetDecoder(), nil)
+	wt.AssertEquals(t, handled, 3)
+	wt.AssertEqualInt(t, router.droppedFrames.count, 1, "dropped frames not logged yet")
+}
+
+func BenchmarkHandleCaptured(b *testing.B) {
+	name, _ := PeerNameFromString("01:00:00:01:00:00")
+	router := NewTestRouter(name)
+	router.LogFrame = func(string, []byte, *layers.Ethernet) {}
+	frame := tcpFrame(b)
+	dec := NewEthernetDecoder()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		router.handleCapturedPacket(frame, dec, nil)
+	}
+}
+
+func BenchmarkHandleReceived(b *testing.B) {
+	name, _ := PeerNameFromString("01:00:00:01:00:00")
+	router := NewTestRouter(name)
+	router.LogFrame = func(string, []byte, *layers.Ethernet) {}
+	srcName, _ := PeerNameFromString("02:00:00:01:00:00")
+	router.Peers.FetchWithDefault(NewPeer(srcName, "", 0, 0))
+	frame := tcpFrame(b)
+	consume := router.handleUDPPacketFunc(nil, NewEthernetDecoder(), nil, nil)
+	src, dst := srcName.Bin(), name.Bin()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		consume(src, dst, frame)
+	}
+}
@@ -0,0 +1,148 @@
+package router
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	maxFlows        = 8192            // beyond which we don't count new flows
+	flowIdleTimeout = 5 * time.Minute // after which we forget a flow, once full
+)
+
+// FlowKey identifies a flow: the addresses at either end, which are
+// the IP addresses of IPv4 packets and the MAC addresses of anything
+// else
+type FlowKey struct {
+	Src, Dst string
+}
+
+// The addresses at either end of a flow as they appear in frames, so
+// that we can look up the flow of each frame without allocating: IPv4
+// addresses, in the first four bytes, or MAC addresses
+type flowID struct {
+	ip       bool
+	src, dst [6]byte
+}
+
+func (id flowID) key() FlowKey {
+	if id.ip {
+		return FlowKey{net.IP(id.src[:4]).String(), net.IP(id.dst[:4]).String()}
+	}
+	return FlowKey{net.HardwareAddr(id.src[:]).String(), net.HardwareAddr(id.dst[:]).String()}
+}
+
+// Flow counts the frames of a flow between a local container and a
+// remote one, or a broadcast
+type Flow struct {
+	FlowKey
+	Peer      PeerName // at the remote end; unknown for broadcasts
+	Outbound  bool     // from a local container
+	Packets   uint64
+	Bytes     uint64
+	FirstSeen time.Time
+	LastSeen  time.Time
+}
+
+// FlowCounters counts the frames we forward from, and inject into,
+// local containers by flow, so that the busiest can be found
+type FlowCounters struct {
+	sync.Mutex
+	flows     map[flowID]*Flow
+	untracked uint64 // frames not counted because we had too many flows
+	totals    FlowTotals
+}
+
+// FlowTotals counts all the frames we have forwarded from, and
+// injected into, local containers, whether counted by flow or not
+type FlowTotals struct {
+	OutPackets, OutBytes uint64
+	InPackets, InBytes   uint64
+}
+
+func NewFlowCounters() *FlowCounters {
+	return &FlowCounters{flows: make(map[flowID]*Flow)}
+}
+
+// Count a frame, as decoded by dec
+func (fc *FlowCounters) Count(dec *EthernetDecoder, peer *Peer, outbound bool, length int) {
+	var id flowID
+	if len(dec.decoded) == 2 {
+		id.ip = true
+		copy(id.src[:], dec.ip.SrcIP.To4())
+		copy(id.dst[:], dec.ip.DstIP.To4())
+	} else {
+		copy(id.src[:], dec.eth.SrcMAC)
+		copy(id.dst[:], dec.eth.DstMAC)
+	}
+	now := time.Now()
+	fc.Lock()
+	defer fc.Unlock()
+	if outbound {
+		fc.totals.OutPackets++
+		fc.totals.OutBytes += uint64(length)
+	} else {
+		fc.totals.InPackets++
+		fc.totals.InBytes += uint64(length)
+	}
+	flow, found := fc.flows[id]
+	if !found {
+		if len(fc.flows) >= maxFlows {
+			fc.forgetIdle(now)
+		}
+		if len(fc.flows) >= maxFlows {
+			fc.untracked++
+			return
+		}
+		flow = &Flow{FlowKey: id.key(), Peer: UnknownPeerName, Outbound: outbound, FirstSeen: now}
+		fc.flows[id] = flow
+	}
+	if peer != nil {
+		flow.Peer = peer.Name
+	}
+	flow.Packets++
+	flow.Bytes += uint64(length)
+	flow.LastSeen = now
+}
+
+func (fc *FlowCounters) forgetIdle(now time.Time) {
+	for id, flow := range fc.flows {
+		if now.Sub(flow.LastSeen) > flowIdleTimeout {
+			delete(fc.flows, id)
+		}
+	}
+}
+
+// Top returns the n flows that have carried the most bytes, busiest
+// first, and how many frames went uncounted because there were too
+// many flows
+func (fc *FlowCounters) Top(n int) ([]Flow, uint64) {
+	fc.Lock()
+	flows := make([]Flow, 0, len(fc.flows))
+	for _, flow := range fc.flows {
+		flows = append(flows, *flow)
+	}
+	untracked := fc.untracked
+	fc.Unlock()
+	sort.Sort(byBytes(flows))
+	if n >= 0 && len(flows) > n {
+		flows = flows[:n]
+	}
+	return flows, untracked
+}
+
+// Totals returns the counts of all frames, and of how many flows there
+// are
+func (fc *FlowCounters) Totals() (FlowTotals, int) {
+	fc.Lock()
+	defer fc.Unlock()
+	return fc.totals, len(fc.flows)
+}
+
+type byBytes []Flow
+
+func (f byBytes) Len() int           { return len(f) }
+func (f byBytes) Swap(i, j int)      { f[i], f[j] = f[j], f[i] }
+func (f byBytes) Less(i, j int) bool { return f[i].Bytes > f[j].Bytes }
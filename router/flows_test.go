@@ -0,0 +1,53 @@
+package router
+
+import (
+	"net"
+	"testing"
+
+	"code.google.com/p/gopacket"
+	"code.google.com/p/gopacket/layers"
+	wt "github.com/weaveworks/weave/testing"
+)
+
+func ipFrame(t *testing.T, src, dst string, size int) []byte {
+	eth := &layers.Ethernet{
+		SrcMAC:       net.HardwareAddr{2, 0, 0, 0, 0, 1},
+		DstMAC:       net.HardwareAddr{2, 0, 0, 0, 0, 2},
+		EthernetType: layers.EthernetTypeIPv4}
+	ip := &layers.IPv4{Version: 4, IHL: 5, TTL: 64, Protocol: layers.IPProtocolUDP,
+		SrcIP: net.ParseIP(src).To4(), DstIP: net.ParseIP(dst).To4()}
+	buf := gopacket.NewSerializeBuffer()
+	wt.AssertNoErr(t, gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true}, eth, ip, gopacket.Payload(make([]byte, size))))
+	return buf.Bytes()
+}
+
+func TestFlowCounters(t *testing.T) {
+	name, _ := PeerNameFromString("01:00:00:01:00:00")
+	peer := NewPeer(name, "other", 0, 0)
+	fc := NewFlowCounters()
+	dec := NewEthernetDecoder()
+	count := func(frame []byte, peer *Peer, outbound bool) {
+		dec.DecodeLayers(frame)
+		fc.Count(dec, peer, outbound, len(frame))
+	}
+
+	small := ipFrame(t, "10.0.0.1", "10.0.0.2", 10)
+	big := ipFrame(t, "10.0.0.3", "10.0.0.4", 1000)
+	count(small, peer, true)
+	count(small, peer, true)
+	count(big, nil, false)
+
+	flows, untracked := fc.Top(10)
+	wt.AssertEqualInt(t, len(flows), 2, "flows")
+	wt.AssertEqualuint64(t, untracked, 0, "untracked")
+	wt.AssertEqualString(t, flows[0].Src, "10.0.0.3", "busiest flow")
+	wt.AssertEqualuint64(t, flows[0].Packets, 1, "packets")
+	wt.AssertTrue(t, flows[0].Peer == UnknownPeerName && !flows[0].Outbound, "inbound broadcast")
+	wt.AssertEqualString(t, flows[1].Dst, "10.0.0.2", "quieter flow")
+	wt.AssertEqualuint64(t, flows[1].Packets, 2, "packets")
+	wt.AssertEqualuint64(t, flows[1].Bytes, uint64(2*len(small)), "bytes")
+	wt.AssertTrue(t, flows[1].Peer == name && flows[1].Outbound, "outbound to peer")
+
+	flows, _ = fc.Top(1)
+	wt.AssertEqualInt(t, len(flows), 1, "top flow")
+}
@@ -3,6 +3,7 @@ package router
 import (
 	"code.google.com/p/gopacket"
 	"code.google.com/p/gopacket/layers"
+	"fmt"
 	"syscall"
 	"time"
 )
@@ -73,6 +74,7 @@ func (conn *LocalConnection) Forward(df bool, frame *ForwardedFrame, dec *Ethern
 		forwarderDF   = conn.forwarderDF
 		effectivePMTU = conn.effectivePMTU
 		stackFrag     = conn.stackFrag
+		sleeveFrag    = conn.sleeveFrag
 	)
 	conn.RUnlock()
 
@@ -89,7 +91,9 @@ func (conn *LocalConnection) Forward(df bool, frame *ForwardedFrame, dec *Ethern
 	// already been done by the time we get here. Since any packet we
 	// drop will likely get re-transmitted we end up paying that cost
 	// multiple times. So it's better to drop things at the beginning
-	// of our pipeline.
+	// of our pipeline. That is the default, DropPolicyBlock; the
+	// other drop policies are for those who would rather lose frames
+	// than have them wait.
 	if df {
 		if !frameTooBig(frame, effectivePMTU) {
 			forwarderDF.Forward(frame)
@@ -98,6 +102,19 @@ func (conn *LocalConnection) Forward(df bool, frame *ForwardedFrame, dec *Ethern
 		return FrameTooBigError{EPMTU: effectivePMTU}
 	}
 
+	// Rather than have the stack fragment the UDP packets a frame
+	// too big for the PMTU goes in, which many networks drop, or
+	// fragment the frame's IP packet ourselves, we send it in pieces
+	// for the remote peer to put back together
+	if sleeveFrag {
+		if !frameTooBig(frame, effectivePMTU) {
+			forwarderDF.Forward(frame)
+			return nil
+		}
+		conn.Router.LogFrame("Fragmenting in sleeve", frame.frame, nil)
+		return conn.fragmentFrame(frame, effectivePMTU, forwarderDF.Forward)
+	}
+
 	if stackFrag || dec == nil || len(dec.decoded) < 2 {
 		forwarder.Forward(frame)
 		return nil
@@ -185,12 +202,16 @@ func fragment(eth layers.Ethernet, ip layers.IPv4, pmtu int, frame *ForwardedFra
 
 type Forwarder struct {
 	conn             *LocalConnection
-	ch               chan<- *ForwardedFrame
+	ch               chan *ForwardedFrame
 	finished         <-chan struct{}
+	dropPolicy       string
+	drops            *DropCounters
 	enc              Encryptor
 	udpSender        UDPSender
 	maxPayload       int
 	processSendError func(error) error
+	pool             *CryptoPool           // to encrypt packets in, if enc is a ParallelEncryptor
+	pending          []<-chan sealedPacket // packets being encrypted, in the order they are to be sent
 }
 
 func NewForwarder(conn *LocalConnection, enc Encryptor, udpSender UDPSender, pmtu int) *Forwarder {
@@ -199,7 +220,10 @@ func NewForwarder(conn *LocalConnection, enc Encryptor, udpSender UDPSender, pmt
 		enc:              enc,
 		udpSender:        udpSender,
 		maxPayload:       pmtu - UDPOverhead,
-		processSendError: func(err error) error { return err }}
+		processSendError: func(err error) error { return err },
+		pool:             conn.Router.cryptoPool,
+		dropPolicy:       conn.Router.DropPolicy,
+		drops:            conn.Router.Drops}
 }
 
 func (fwd *Forwarder) Start() {
@@ -214,23 +238,31 @@ func (fwd *Forwarder) Shutdown() {
 	fwd.ch <- nil
 }
 
-func (fwd *Forwarder) Forward(frame *ForwardedFrame) {
-	select {
-	case fwd.ch <- frame:
-	case <-fwd.finished:
-	}
-}
-
 func (fwd *Forwarder) run(ch <-chan *ForwardedFrame, finished chan<- struct{}) {
 	defer fwd.udpSender.Shutdown()
+	progress := fwd.watch("forwarder")
+	defer fwd.conn.Router.Watchdog.Unwatch(progress)
 	for {
-		if !fwd.accumulateAndSendFrames(ch, <-ch) {
+		frame := <-ch
+		progress.Begin()
+		more := fwd.accumulateAndSendFrames(ch, frame)
+		progress.End()
+		if !more {
 			close(finished)
 			return
 		}
 	}
 }
 
+// Have the watchdog watch the forwarder, called what, restarting it,
+// should it stall, by dropping the connection, for the connection
+// maker to make again
+func (fwd *Forwarder) watch(what string) *Progress {
+	return fwd.conn.Router.Watchdog.Watch(fmt.Sprintf("%s to %s", what, fwd.conn.remote), func() {
+		fwd.conn.Shutdown(fmt.Errorf("%s stalled", what))
+	})
+}
+
 func (fwd *Forwarder) effectiveOverhead() int {
 	return UDPOverhead + fwd.enc.PacketOverhead() + fwd.enc.FrameOverhead() + EthernetOverhead
 }
@@ -260,7 +292,7 @@ func (fwd *Forwarder) accumulateAndSendFrames(ch <-chan *ForwardedFrame, frame *
 				return false
 			}
 			if !fwd.appendFrame(frame) {
-				fwd.flush()
+				fwd.flushLater()
 				if !fwd.appendFrame(frame) {
 					fwd.logDrop(frame)
 					return true // see [1]
@@ -286,11 +318,42 @@ func (fwd *Forwarder) appendFrame(frame *ForwardedFrame) bool {
 	return true
 }
 
+// Send what we have, and any packets still being encrypted
 func (fwd *Forwarder) flush() {
-	msg, err := fwd.enc.Bytes()
+	fwd.flushLater()
+	for len(fwd.pending) > 0 {
+		fwd.sendPending()
+	}
+}
+
+// Send what we have, but if we can encrypt it in the pool, only once
+// the pool has as many of our packets as it should, and then only
+// the oldest, so that we can go on putting together the next packet
+// while this one is encrypted
+func (fwd *Forwarder) flushLater() {
+	penc, ok := fwd.enc.(ParallelEncryptor)
+	if !ok || fwd.pool == nil {
+		msg, err := fwd.enc.Bytes()
+		fwd.send(msg, err)
+		return
+	}
+	fwd.pending = append(fwd.pending, fwd.pool.seal(penc.Take()))
+	for len(fwd.pending) >= fwd.pool.Depth() {
+		fwd.sendPending()
+	}
+}
+
+func (fwd *Forwarder) sendPending() {
+	sealed := <-fwd.pending[0]
+	fwd.pending = fwd.pending[1:]
+	fwd.send(sealed.msg, sealed.err)
+}
+
+func (fwd *Forwarder) send(msg []byte, err error) {
 	if err != nil {
 		fwd.conn.Shutdown(err)
 	}
+	fwd.conn.Router.captureUDP(fwd.conn.remote.Name, fwd.conn.localUDPAddr(), fwd.conn.RemoteUDPAddr(), msg)
 	err = fwd.processSendError(fwd.udpSender.Send(msg))
 	if err != nil && PosixError(err) != syscall.ENOBUFS {
 		fwd.conn.Shutdown(err)
@@ -314,7 +377,10 @@ func NewForwarderDF(conn *LocalConnection, enc Encryptor, udpSender UDPSender, p
 			conn:       conn,
 			enc:        enc,
 			udpSender:  udpSender,
-			maxPayload: pmtu - UDPOverhead}}
+			maxPayload: pmtu - UDPOverhead,
+			pool:       conn.Router.cryptoPool,
+			dropPolicy: conn.Router.DropPolicy,
+			drops:      conn.Router.Drops}}
 	fwd.Forwarder.processSendError = fwd.processSendError
 	fwd.unverifiedPMTU = pmtu - fwd.effectiveOverhead()
 	return fwd
@@ -339,6 +405,8 @@ func (fwd *ForwarderDF) PMTUVerified(pmtu int) {
 
 func (fwd *ForwarderDF) run(ch <-chan *ForwardedFrame, finished chan<- struct{}, verifyPMTU <-chan int) {
 	defer fwd.udpSender.Shutdown()
+	progress := fwd.watch("DF forwarder")
+	defer fwd.conn.Router.Watchdog.Unwatch(progress)
 	for {
 		select {
 		case <-fwd.verifyPMTUTick:
@@ -372,7 +440,10 @@ func (fwd *ForwarderDF) run(ch <-chan *ForwardedFrame, finished chan<- struct{},
 				fwd.conn.Log("Effective PMTU verified at", epmtu)
 			}
 		case frame := <-ch:
-			if !fwd.accumulateAndSendFrames(ch, frame) {
+			progress.Begin()
+			more := fwd.accumulateAndSendFrames(ch, frame)
+			progress.End()
+			if !more {
 				close(finished)
 				return
 			}
@@ -0,0 +1,176 @@
+package router
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// Handshake field saying that a peer reassembles frames we split
+	// into fragments
+	SleeveFragmentationField = "SleeveFragmentation"
+	// How long we wait for the rest of a frame's fragments
+	reassemblyTimeout = time.Second
+	// How many frames we reassemble at once, for each connection
+	maxReassemblies = 64
+)
+
+// A fragment is a special frame, from one end of a connection to the
+// other, carrying a piece of a frame too big for the connection's
+// PMTU: after the zeroed ethernet header come fragmentMagic, the
+// names of the frame's source and destination peers, the frame's ID,
+// the piece's offset in it and the frame's length, and then the piece
+var fragmentMagic = []byte{'w', 'f', 'r', 'g'}
+
+const fragmentHeaderSize = 4 + NameSize + NameSize + 4 + 2 + 2
+
+func isFragment(frame []byte) bool {
+	return len(frame) > EthernetOverhead+fragmentHeaderSize &&
+		bytes.Equal(frame[EthernetOverhead:EthernetOverhead+len(fragmentMagic)], fragmentMagic)
+}
+
+// FragmentationCounters count the frames we split into fragments, so
+// that they fit the PMTU of the connection they go over, and those we
+// put back together
+type FragmentationCounters struct {
+	FramesFragmented   uint64
+	FragmentsSent      uint64
+	FragmentsReceived  uint64
+	FramesReassembled  uint64
+	ReassemblyTimeouts uint64 // frames whose fragments didn't all arrive in time
+	ReassemblyDrops    uint64 // frames we had no room to reassemble, or whose fragments were bad
+}
+
+// Totals reads the counters
+func (c *FragmentationCounters) Totals() FragmentationCounters {
+	return FragmentationCounters{
+		FramesFragmented:   atomic.LoadUint64(&c.FramesFragmented),
+		FragmentsSent:      atomic.LoadUint64(&c.FragmentsSent),
+		FragmentsReceived:  atomic.LoadUint64(&c.FragmentsReceived),
+		FramesReassembled:  atomic.LoadUint64(&c.FramesReassembled),
+		ReassemblyTimeouts: atomic.LoadUint64(&c.ReassemblyTimeouts),
+		ReassemblyDrops:    atomic.LoadUint64(&c.ReassemblyDrops)}
+}
+
+func (c FragmentationCounters) String() string {
+	return fmt.Sprintf("%d frames fragmented into %d fragments; %d fragments received, %d frames reassembled, %d timed out, %d dropped\n",
+		c.FramesFragmented, c.FragmentsSent, c.FragmentsReceived, c.FramesReassembled, c.ReassemblyTimeouts, c.ReassemblyDrops)
+}
+
+// Split frame into fragments that fit effectivePMTU, for the remote
+// peer to reassemble, handing each to forward
+func (conn *LocalConnection) fragmentFrame(frame *ForwardedFrame, effectivePMTU int, forward func(*ForwardedFrame)) error {
+	pieceSize := effectivePMTU - fragmentHeaderSize
+	if pieceSize < 8 {
+		return fmt.Errorf("Dropping frame of length %d: PMTU %d is too small to fragment it", len(frame.frame), effectivePMTU)
+	}
+	id := atomic.AddUint32(&conn.fragmentID, 1)
+	total := len(frame.frame)
+	counters := conn.Router.Fragmentation
+	atomic.AddUint64(&counters.FramesFragmented, 1)
+	for offset := 0; offset < total; offset += pieceSize {
+		end := offset + pieceSize
+		if end > total {
+			end = total
+		}
+		fragment := make([]byte, EthernetOverhead+fragmentHeaderSize+end-offset)
+		header := fragment[EthernetOverhead:]
+		copy(header, fragmentMagic)
+		copy(header[4:], frame.srcPeer.NameByte)
+		copy(header[4+NameSize:], frame.dstPeer.NameByte)
+		binary.BigEndian.PutUint32(header[4+2*NameSize:], id)
+		binary.BigEndian.PutUint16(header[8+2*NameSize:], uint16(offset))
+		binary.BigEndian.PutUint16(header[10+2*NameSize:], uint16(total))
+		copy(header[fragmentHeaderSize:], frame.frame[offset:end])
+		forward(&ForwardedFrame{srcPeer: conn.local, dstPeer: conn.remote, frame: fragment})
+		atomic.AddUint64(&counters.FragmentsSent, 1)
+	}
+	return nil
+}
+
+// A reassembler puts frames back together from their fragments, as
+// they arrive on a connection
+type reassembler struct {
+	sync.Mutex
+	counters *FragmentationCounters
+	pending  map[uint32]*reassembly
+	now      func() time.Time
+}
+
+type reassembly struct {
+	srcNameByte []byte
+	dstNameByte []byte
+	frame       []byte
+	offsets     map[uint16]struct{} // of the pieces we have
+	received    int
+	started     time.Time
+}
+
+func newReassembler(counters *FragmentationCounters) *reassembler {
+	return &reassembler{counters: counters, pending: make(map[uint32]*reassembly), now: time.Now}
+}
+
+// Add the fragment to the frame it is a piece of, returning the
+// frame, and the names of its source and destination peers, once we
+// have all its pieces
+func (r *reassembler) add(fragment []byte) (srcNameByte, dstNameByte, frame []byte) {
+	atomic.AddUint64(&r.counters.FragmentsReceived, 1)
+	header := fragment[EthernetOverhead:]
+	id := binary.BigEndian.Uint32(header[4+2*NameSize:])
+	offset := binary.BigEndian.Uint16(header[8+2*NameSize:])
+	total := int(binary.BigEndian.Uint16(header[10+2*NameSize:]))
+	piece := header[fragmentHeaderSize:]
+	if int(offset)+len(piece) > total {
+		atomic.AddUint64(&r.counters.ReassemblyDrops, 1)
+		return nil, nil, nil
+	}
+	r.Lock()
+	defer r.Unlock()
+	re, found := r.pending[id]
+	if !found {
+		r.expire()
+		if len(r.pending) >= maxReassemblies {
+			atomic.AddUint64(&r.counters.ReassemblyDrops, 1)
+			return nil, nil, nil
+		}
+		re = &reassembly{
+			srcNameByte: append([]byte{}, header[4:4+NameSize]...),
+			dstNameByte: append([]byte{}, header[4+NameSize:4+2*NameSize]...),
+			frame:       make([]byte, total),
+			offsets:     make(map[uint16]struct{}),
+			started:     r.now()}
+		r.pending[id] = re
+	}
+	if len(re.frame) != total {
+		delete(r.pending, id)
+		atomic.AddUint64(&r.counters.ReassemblyDrops, 1)
+		return nil, nil, nil
+	}
+	if _, dup := re.offsets[offset]; dup {
+		return nil, nil, nil
+	}
+	re.offsets[offset] = struct{}{}
+	copy(re.frame[offset:], piece)
+	re.received += len(piece)
+	if re.received < total {
+		return nil, nil, nil
+	}
+	delete(r.pending, id)
+	atomic.AddUint64(&r.counters.FramesReassembled, 1)
+	return re.srcNameByte, re.dstNameByte, re.frame
+}
+
+// Give up on frames whose fragments have been too long coming
+func (r *reassembler) expire() {
+	cutoff := r.now().Add(-reassemblyTimeout)
+	for id, re := range r.pending {
+		if re.started.Before(cutoff) {
+			delete(r.pending, id)
+			atomic.AddUint64(&r.counters.ReassemblyTimeouts, 1)
+		}
+	}
+}
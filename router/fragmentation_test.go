@@ -0,0 +1,62 @@
+package router
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	wt "github.com/weaveworks/weave/testing"
+)
+
+func TestSleeveFragmentation(t *testing.T) {
+	name1, _ := PeerNameFromString("01:00:00:00:00:01")
+	name2, _ := PeerNameFromString("01:00:00:00:00:02")
+	name3, _ := PeerNameFromString("01:00:00:00:00:03")
+	router := NewTestRouter(name1)
+	peer2, peer3 := NewPeer(name2, "", 0, 0), NewPeer(name3, "", 0, 0)
+	conn := NewLocalConnection(NewRemoteConnection(router.Ourself.Peer, peer2, "", true, true), nil, nil, router)
+
+	frame := make([]byte, 3000)
+	for i := range frame {
+		frame[i] = byte(i)
+	}
+	const pmtu = 1400
+	var fragments [][]byte
+	forward := func(f *ForwardedFrame) {
+		wt.AssertTrue(t, f.srcPeer == router.Ourself.Peer && f.dstPeer == peer2, "fragment goes to the connection's peer")
+		wt.AssertFalse(t, frameTooBig(f, pmtu), "fragment fits")
+		wt.AssertTrue(t, isFragment(f.frame), "is a fragment")
+		fragments = append(fragments, f.frame)
+	}
+	wt.AssertNoErr(t, conn.fragmentFrame(&ForwardedFrame{srcPeer: peer3, dstPeer: peer2, frame: frame}, pmtu, forward))
+	wt.AssertEqualInt(t, len(fragments), 3, "fragments")
+	wt.AssertFalse(t, isFragment(PMTUDiscovery), "PMTU discovery frame")
+	wt.AssertFalse(t, isFragment(FragTest), "fragmentation test frame")
+
+	// out of order, and with a duplicate
+	r := newReassembler(router.Fragmentation)
+	for _, i := range []int{2, 0, 2} {
+		src, _, whole := r.add(fragments[i])
+		wt.AssertTrue(t, src == nil && whole == nil, "incomplete")
+	}
+	src, dst, whole := r.add(fragments[1])
+	wt.AssertTrue(t, bytes.Equal(whole, frame), "reassembled frame")
+	wt.AssertEquals(t, PeerNameFromBin(src), name3)
+	wt.AssertEquals(t, PeerNameFromBin(dst), name2)
+
+	// missing fragments time out, and there is only so much room
+	now := time.Now()
+	r.now = func() time.Time { return now }
+	r.add(fragments[0])
+	now = now.Add(2 * reassemblyTimeout)
+	for i := 0; i < maxReassemblies+1; i++ {
+		fragments = nil
+		conn.fragmentFrame(&ForwardedFrame{srcPeer: peer3, dstPeer: peer2, frame: frame}, pmtu, forward)
+		r.add(fragments[0])
+	}
+	totals := router.Fragmentation.Totals()
+	wt.AssertEqualInt(t, int(totals.FramesFragmented), maxReassemblies+2, "frames fragmented")
+	wt.AssertEqualInt(t, int(totals.FramesReassembled), 1, "frames reassembled")
+	wt.AssertEqualInt(t, int(totals.ReassemblyTimeouts), 1, "timeouts")
+	wt.AssertEqualInt(t, int(totals.ReassemblyDrops), 1, "drops")
+}
@@ -3,19 +3,53 @@ package router
 import (
 	"bytes"
 	"encoding/gob"
-	"fmt"
 	"log"
 	"sync"
 	"time"
+
+	"github.com/weaveworks/weave/common/tracing"
 )
 
 const GossipInterval = 30 * time.Second
 
+// Peers that say so in the handshake log and ignore gossip on
+// channels they don't know, rather than dropping the connection it
+// came down, so that channels can be added without upsetting peers
+// that lack them. Older peers don't, so we send gossip on channels
+// other than those every peer has always known only down connections
+// to peers that do, whether it is ours or we are relaying it.
+const UnknownGossipField = "UnknownGossip"
+
+var legacyGossipChannels = map[string]bool{"topology": true, "IPallocation": true}
+
+// A connection whose other end may not know every gossip channel
+type unknownGossipConnection interface {
+	ignoresUnknownGossip() bool
+}
+
+func (conn *LocalConnection) ignoresUnknownGossip() bool {
+	return conn.unknownGossip
+}
+
+// The unknown channels we have logged gossip on, so that we log each
+// once
+type unknownChannels struct {
+	sync.Mutex
+	logged map[uint32]struct{}
+}
+
 type GossipData interface {
 	Encode() []byte
 	Merge(GossipData)
 }
 
+// MultiGossipData is GossipData that is sent as several messages,
+// because it can't merge what it has accumulated into one
+type MultiGossipData interface {
+	GossipData
+	EncodeEach() [][]byte
+}
+
 type Gossip interface {
 	// specific message from one peer to another
 	// intermediate peers relay it using unicast topology.
@@ -24,6 +58,13 @@ type Gossip interface {
 	GossipBroadcast(update GossipData) error
 }
 
+// NeighbourGossiper is a Gossiper that wants to know which neighbour
+// gossip came from, e.g. to ask it for more
+type NeighbourGossiper interface {
+	Gossiper
+	OnGossipFrom(sender PeerName, update []byte) (GossipData, error)
+}
+
 type Gossiper interface {
 	OnGossipUnicast(sender PeerName, msg []byte) error
 	// merge received data into state and return a representation of
@@ -40,6 +81,7 @@ type Gossiper interface {
 // and sends it when possible.
 type GossipSender struct {
 	send func(GossipData)
+	wait func() bool // until we may send, returning whether we had to; nil if we needn't
 	cell chan GossipData
 }
 
@@ -57,6 +99,16 @@ func (sender *GossipSender) run() {
 		if pending := <-sender.cell; pending == nil { // receive zero value when chan is closed
 			break
 		} else {
+			if sender.wait != nil && sender.wait() {
+				// take in what has accumulated while we waited
+				select {
+				case more := <-sender.cell:
+					if more != nil {
+						pending.Merge(more)
+					}
+				default:
+				}
+			}
 			sender.send(pending)
 		}
 	}
@@ -89,6 +141,10 @@ type GossipChannel struct {
 	gossiper     Gossiper
 	senders      connectionSenders
 	broadcasters peerSenders
+	stats        gossipStats
+	priority     GossipPriority
+	limiter      *gossipLimiter // nil if we send as fast as we can
+	legacy       bool           // if every peer knows the channel
 }
 
 func (router *Router) NewGossip(channelName string, g Gossiper) Gossip {
@@ -100,17 +156,26 @@ func (router *Router) NewGossip(channelName string, g Gossiper) Gossip {
 		hash:         channelHash,
 		gossiper:     g,
 		senders:      make(connectionSenders),
-		broadcasters: make(peerSenders)}
+		broadcasters: make(peerSenders),
+		priority:     gossipPriority(channelName),
+		legacy:       legacyGossipChannels[channelName]}
+	if rate, found := router.GossipRates[channelName]; found {
+		channel.limiter = newGossipLimiter(rate)
+	}
 	router.GossipChannels[channelHash] = channel
 	return channel
 }
 
 func (router *Router) SendAllGossip() {
+	span := tracing.Start("gossip.round", "peer", router.Ourself.Name.String())
 	for _, channel := range router.GossipChannels {
+		channelSpan := span.Child("gossip.channel", "channel", channel.name)
 		if gossip := channel.gossiper.Gossip(); gossip != nil {
 			channel.Send(router.Ourself.Name, gossip)
 		}
+		channelSpan.End(nil)
 	}
+	span.End(nil)
 }
 
 func (router *Router) SendAllGossipDown(conn Connection) {
@@ -129,21 +194,45 @@ func (router *Router) handleGossip(tag ProtocolTag, payload []byte) error {
 	}
 	channel, found := router.GossipChannels[channelHash]
 	if !found {
-		return fmt.Errorf("[gossip] received unknown channel with hash %v", channelHash)
+		router.unknownChannel(channelHash)
+		return nil
 	}
 	var srcName PeerName
 	if err := decoder.Decode(&srcName); err != nil {
 		return err
 	}
+	channel.stats.received(srcName, payload)
+	span := tracing.Start("gossip.receive", "channel", channel.name, "source", srcName.String())
+	var err error
 	switch tag {
 	case ProtocolGossipUnicast:
-		return channel.deliverUnicast(srcName, payload, decoder)
+		span.SetAttribute("kind", "unicast")
+		err = channel.deliverUnicast(srcName, payload, decoder)
 	case ProtocolGossipBroadcast:
-		return channel.deliverBroadcast(srcName, payload, decoder)
+		span.SetAttribute("kind", "broadcast")
+		err = channel.deliverBroadcast(srcName, payload, decoder)
 	case ProtocolGossip:
-		return channel.deliver(srcName, payload, decoder)
+		span.SetAttribute("kind", "gossip")
+		err = channel.deliver(srcName, payload, decoder)
 	}
-	return nil
+	span.End(err)
+	return err
+}
+
+// Gossip on a channel we don't know is from a newer peer, which knows
+// that we ignore it
+func (router *Router) unknownChannel(channelHash uint32) {
+	uc := &router.unknownChannels
+	uc.Lock()
+	defer uc.Unlock()
+	if _, found := uc.logged[channelHash]; found {
+		return
+	}
+	if uc.logged == nil {
+		uc.logged = make(map[uint32]struct{})
+	}
+	uc.logged[channelHash] = struct{}{}
+	log.Println("[gossip] ignoring unknown channel with hash", channelHash)
 }
 
 func (c *GossipChannel) deliverUnicast(srcName PeerName, origPayload []byte, dec *gob.Decoder) error {
@@ -178,7 +267,11 @@ func (c *GossipChannel) deliver(srcName PeerName, _ []byte, dec *gob.Decoder) er
 	if err := dec.Decode(&payload); err != nil {
 		return err
 	}
-	if data, err := c.gossiper.OnGossip(payload); err != nil {
+	onGossip := c.gossiper.OnGossip
+	if ng, ok := c.gossiper.(NeighbourGossiper); ok {
+		onGossip = func(update []byte) (GossipData, error) { return ng.OnGossipFrom(srcName, update) }
+	}
+	if data, err := onGossip(payload); err != nil {
 		return err
 	} else if data != nil {
 		c.Send(srcName, data)
@@ -234,9 +327,25 @@ func (c *GossipChannel) SendDown(conn Connection, data GossipData) {
 func (c *GossipChannel) sendDown(conn Connection, data GossipData) {
 	sender, found := c.senders[conn]
 	if !found {
-		sender = NewGossipSender(func(pending GossipData) {
-			protocolMsg := ProtocolMsg{ProtocolGossip, GobEncode(c.hash, c.ourself.Name, pending.Encode())}
-			conn.(ProtocolSender).SendProtocolMsg(protocolMsg)
+		sender = c.newSender(conn.Remote().Name, func(pending GossipData) {
+			if multi, ok := pending.(MultiGossipData); ok {
+				for _, payload := range multi.EncodeEach() {
+					c.send(conn, ProtocolMsg{ProtocolGossip, GobEncode(c.hash, c.ourself.Name, payload)}, false)
+				}
+				return
+			}
+			var payload []byte
+			cgd, tailored := pending.(ConnectionGossipData)
+			if tailored {
+				if payload = cgd.EncodeFor(conn); len(payload) == 0 {
+					return // nothing it doesn't know already
+				}
+			} else {
+				payload = pending.Encode()
+			}
+			// what is tailored is taken as sent once encoded, so it
+			// must not be dropped
+			c.send(conn, ProtocolMsg{ProtocolGossip, GobEncode(c.hash, c.ourself.Name, payload)}, tailored)
 		})
 		c.senders[conn] = sender
 		sender.Start()
@@ -258,7 +367,7 @@ func (c *GossipChannel) relayUnicast(dstPeerName PeerName, buf []byte) error {
 	} else if conn, found := c.ourself.ConnectionTo(relayPeerName); !found {
 		c.log("unable to find connection to relay peer", relayPeerName)
 	} else {
-		conn.(ProtocolSender).SendProtocolMsg(ProtocolMsg{ProtocolGossipUnicast, buf})
+		c.send(conn, ProtocolMsg{ProtocolGossipUnicast, buf}, true)
 	}
 	return nil
 }
@@ -288,7 +397,7 @@ func (c *GossipChannel) relayBroadcast(srcName PeerName, update GossipData) erro
 	}
 	broadcaster, found := c.broadcasters[srcName]
 	if !found {
-		broadcaster = NewGossipSender(func(pending GossipData) { c.sendBroadcast(srcName, pending) })
+		broadcaster = c.newSender(srcName, func(pending GossipData) { c.sendBroadcast(srcName, pending) })
 		c.broadcasters[srcName] = broadcaster
 		broadcaster.Start()
 	}
@@ -302,11 +411,53 @@ func (c *GossipChannel) sendBroadcast(srcName PeerName, update GossipData) {
 	if len(nextHops) == 0 {
 		return
 	}
-	protocolMsg := ProtocolMsg{ProtocolGossipBroadcast, GobEncode(c.hash, srcName, update.Encode())}
-	// FIXME a single blocked connection can stall us
-	for _, conn := range c.ourself.ConnectionsTo(nextHops) {
-		conn.(ProtocolSender).SendProtocolMsg(protocolMsg)
+	var payloads [][]byte
+	if multi, ok := update.(MultiGossipData); ok {
+		payloads = multi.EncodeEach()
+	} else {
+		payloads = [][]byte{update.Encode()}
+	}
+	connections := c.ourself.ConnectionsTo(nextHops)
+	for _, payload := range payloads {
+		protocolMsg := ProtocolMsg{ProtocolGossipBroadcast, GobEncode(c.hash, srcName, payload)}
+		for _, conn := range connections {
+			c.send(conn, protocolMsg, false)
+		}
+	}
+}
+
+// A sender of what we gossip to, or broadcast on behalf of, the named
+// peer, at no more than the channel's rate
+func (c *GossipChannel) newSender(name PeerName, send func(GossipData)) *GossipSender {
+	sender := NewGossipSender(send)
+	if c.limiter != nil {
+		sender.wait = func() bool {
+			if !c.limiter.wait() {
+				return false
+			}
+			c.stats.throttled(name)
+			return true
+		}
+	}
+	return sender
+}
+
+// Connections that can queue gossip, by priority, do so, waiting for
+// room if keep, since nothing would make up for dropping it; we send
+// down others directly
+func (c *GossipChannel) send(conn Connection, m ProtocolMsg, keep bool) {
+	if uc, ok := conn.(unknownGossipConnection); ok && !c.legacy && !uc.ignoresUnknownGossip() {
+		return // the other end would drop the connection
+	}
+	if c.limiter != nil {
+		c.limiter.take(len(m.msg))
 	}
+	if q, ok := conn.(gossipQueuer); ok {
+		q.queueGossip(c, m, keep)
+		return
+	}
+	c.stats.sent(conn.Remote().Name, m.msg)
+	conn.(ProtocolSender).SendProtocolMsg(m)
 }
 
 func (c *GossipChannel) log(args ...interface{}) {
@@ -320,10 +471,17 @@ func (c *GossipChannel) log(args ...interface{}) {
 // no easy way for us to know when that has completed.
 func (router *Router) sendPendingGossip() {
 	for _, channel := range router.GossipChannels {
+		// flushing may relay, which adds senders under the lock
+		channel.Lock()
+		var senders []*GossipSender
 		for _, sender := range channel.senders {
-			sender.flush()
+			senders = append(senders, sender)
 		}
 		for _, sender := range channel.broadcasters {
+			senders = append(senders, sender)
+		}
+		channel.Unlock()
+		for _, sender := range senders {
 			sender.flush()
 		}
 	}
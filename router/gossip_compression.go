@@ -0,0 +1,57 @@
+package router
+
+import (
+	"fmt"
+
+	"github.com/golang/snappy"
+)
+
+// Gossip messages of more than CompressGossipAbove bytes are sent
+// compressed, with snappy, down connections whose other end says in
+// the handshake that it can take that. We compress per connection,
+// rather than per gossip channel, since what is relayed is passed on
+// as received, and the next connection may lead to an older peer.
+const (
+	GossipCompressionField  = "GossipCompression"
+	GossipCompressionSnappy = "snappy"
+	CompressGossipAbove     = 1024
+	// We refuse to decompress a message into more than this, which
+	// the snappy header states up front, so that a corrupt or hostile
+	// one cannot make us allocate without bound.
+	MaxDecompressedGossip = 64 * 1024 * 1024
+)
+
+func isGossip(tag ProtocolTag) bool {
+	return tag == ProtocolGossip || tag == ProtocolGossipUnicast || tag == ProtocolGossipBroadcast
+}
+
+// A compressed message carries the tag of the original, followed by
+// its compressed payload
+func compressProtocolMsg(m ProtocolMsg) ProtocolMsg {
+	if !isGossip(m.tag) || len(m.msg) <= CompressGossipAbove {
+		return m
+	}
+	compressed := snappy.Encode(make([]byte, 1+snappy.MaxEncodedLen(len(m.msg)))[1:], m.msg)
+	if len(compressed) >= len(m.msg) {
+		return m
+	}
+	return ProtocolMsg{ProtocolCompressed, Concat([]byte{byte(m.tag)}, compressed)}
+}
+
+func decompressProtocolMsg(payload []byte) (ProtocolTag, []byte, error) {
+	if len(payload) < 1 || !isGossip(ProtocolTag(payload[0])) {
+		return 0, nil, fmt.Errorf("compressed message of unexpected kind")
+	}
+	n, err := snappy.DecodedLen(payload[1:])
+	if err != nil {
+		return 0, nil, fmt.Errorf("unable to decompress message: %s", err)
+	}
+	if n > MaxDecompressedGossip {
+		return 0, nil, fmt.Errorf("compressed message too large: %d bytes when decompressed", n)
+	}
+	msg, err := snappy.Decode(nil, payload[1:])
+	if err != nil {
+		return 0, nil, fmt.Errorf("unable to decompress message: %s", err)
+	}
+	return ProtocolTag(payload[0]), msg, nil
+}
@@ -0,0 +1,36 @@
+package router
+
+import (
+	"bytes"
+	"encoding/binary"
+	wt "github.com/weaveworks/weave/testing"
+	"testing"
+)
+
+func TestGossipCompression(t *testing.T) {
+	small := ProtocolMsg{ProtocolGossip, []byte("small")}
+	wt.AssertEquals(t, compressProtocolMsg(small), small)
+
+	large := ProtocolMsg{ProtocolGossipBroadcast, bytes.Repeat([]byte("ring state "), 1000)}
+	heartbeat := ProtocolMsg{ProtocolHeartbeat, large.msg}
+	wt.AssertEquals(t, compressProtocolMsg(heartbeat), heartbeat)
+
+	compressed := compressProtocolMsg(large)
+	wt.AssertTrue(t, compressed.tag == ProtocolCompressed, "compressed tag")
+	wt.AssertTrue(t, len(compressed.msg) < len(large.msg), "compressed size")
+	tag, msg, err := decompressProtocolMsg(compressed.msg)
+	wt.AssertNoErr(t, err)
+	wt.AssertTrue(t, tag == large.tag, "decompressed tag")
+	wt.AssertTrue(t, bytes.Equal(msg, large.msg), "decompressed payload")
+
+	_, _, err = decompressProtocolMsg(Concat([]byte{byte(ProtocolHeartbeat)}, compressed.msg[1:]))
+	wt.AssertTrue(t, err != nil, "error on unexpected kind")
+	_, _, err = decompressProtocolMsg(Concat([]byte{byte(ProtocolGossip)}, large.msg))
+	wt.AssertTrue(t, err != nil, "error on corrupt payload")
+
+	// a snappy header claiming more than we are prepared to allocate
+	var header [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(header[:], MaxDecompressedGossip+1)
+	_, _, err = decompressProtocolMsg(Concat([]byte{byte(ProtocolGossip)}, header[:n], compressed.msg[2:]))
+	wt.AssertTrue(t, err != nil, "error on oversized payload")
+}
@@ -0,0 +1,218 @@
+package router
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// GossipPriority orders the gossip queued to be sent down a
+// connection: what is queued with a higher priority is sent first,
+// so that a storm of gossip on one channel cannot hold up another
+// more important one. Messages other than gossip, e.g. heartbeats,
+// are not queued.
+type GossipPriority int
+
+const (
+	GossipPriorityHigh   GossipPriority = iota // the topology
+	GossipPriorityNormal                       // address allocation
+	GossipPriorityLow                          // everything else, e.g. DNS
+	numGossipPriorities
+)
+
+// Gossip queued on a connection, by priority, beyond which we drop
+// it, other than unicast, and topology deltas, which wait, since the
+// periodic gossip will make up for what we drop, but nothing makes up
+// for unicast, and a delta is taken as sent once it is encoded
+const GossipQueueSize = 64
+
+var gossipPriorities = map[string]GossipPriority{
+	"topology":     GossipPriorityHigh,
+	"IPallocation": GossipPriorityNormal,
+}
+
+func gossipPriority(channelName string) GossipPriority {
+	if priority, found := gossipPriorities[channelName]; found {
+		return priority
+	}
+	return GossipPriorityLow
+}
+
+// ParseGossipRates parses comma-separated <channel>=<bytes per
+// second> pairs, limiting the rate at which we send gossip on the
+// channels named
+func ParseGossipRates(s string) (map[string]int, error) {
+	rates := make(map[string]int)
+	if s == "" {
+		return rates, nil
+	}
+	for _, pair := range strings.Split(s, ",") {
+		kv := strings.SplitN(pair, "=", 2)
+		name := strings.TrimSpace(kv[0])
+		if len(kv) != 2 || name == "" {
+			return nil, fmt.Errorf("Invalid gossip rate %q: expected <channel>=<bytes per second>", pair)
+		}
+		rate, err := strconv.Atoi(strings.TrimSpace(kv[1]))
+		if err != nil || rate <= 0 {
+			return nil, fmt.Errorf("Invalid gossip rate %q: expected a positive number of bytes per second", pair)
+		}
+		if _, found := rates[name]; found {
+			return nil, fmt.Errorf("Gossip rate for channel %q given more than once", name)
+		}
+		rates[name] = rate
+	}
+	return rates, nil
+}
+
+// A token bucket, of bytes, holding up to a second's worth. A message
+// larger than what is in it is sent anyway, leaving it in debt, which
+// what follows must wait out.
+type gossipLimiter struct {
+	sync.Mutex
+	rate   float64 // bytes per second
+	tokens float64
+	last   time.Time
+}
+
+func newGossipLimiter(rate int) *gossipLimiter {
+	return &gossipLimiter{rate: float64(rate), tokens: float64(rate), last: time.Now()}
+}
+
+func (l *gossipLimiter) refill(now time.Time) {
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+}
+
+// How long until we are out of debt
+func (l *gossipLimiter) delay() time.Duration {
+	l.Lock()
+	defer l.Unlock()
+	l.refill(time.Now())
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// wait blocks until we may send, returning whether it had to wait
+func (l *gossipLimiter) wait() bool {
+	d := l.delay()
+	if d <= 0 {
+		return false
+	}
+	time.Sleep(d)
+	return true
+}
+
+// take accounts for n bytes sent
+func (l *gossipLimiter) take(n int) {
+	l.Lock()
+	l.refill(time.Now())
+	l.tokens -= float64(n)
+	l.Unlock()
+}
+
+type queuedGossip struct {
+	channel *GossipChannel
+	msg     ProtocolMsg
+	keep    bool // wait for room rather than drop it
+}
+
+// The gossip waiting to be sent down a connection, by priority
+type gossipQueue struct {
+	lanes [numGossipPriorities]chan queuedGossip
+	stop  chan struct{}
+}
+
+func newGossipQueue() *gossipQueue {
+	q := &gossipQueue{stop: make(chan struct{})}
+	for i := range q.lanes {
+		q.lanes[i] = make(chan queuedGossip, GossipQueueSize)
+	}
+	return q
+}
+
+// put queues g, unless the queue has been stopped or, unless g is to
+// be kept, the lane for its priority is full, returning whether it
+// did
+func (q *gossipQueue) put(g queuedGossip) bool {
+	select {
+	case <-q.stop:
+		return false
+	default:
+	}
+	lane := q.lanes[g.channel.priority]
+	if g.keep {
+		select {
+		case lane <- g:
+			return true
+		case <-q.stop:
+			return false
+		}
+	}
+	select {
+	case lane <- g:
+		return true
+	default:
+		return false
+	}
+}
+
+// next waits for the queued gossip of the highest priority, returning
+// false once the queue has been stopped
+func (q *gossipQueue) next() (queuedGossip, bool) {
+	for _, lane := range q.lanes {
+		select {
+		case g := <-lane:
+			return g, true
+		default:
+		}
+	}
+	select {
+	case g := <-q.lanes[GossipPriorityHigh]:
+		return g, true
+	case g := <-q.lanes[GossipPriorityNormal]:
+		return g, true
+	case g := <-q.lanes[GossipPriorityLow]:
+		return g, true
+	case <-q.stop:
+		return queuedGossip{}, false
+	}
+}
+
+func (q *gossipQueue) Stop() {
+	close(q.stop)
+}
+
+// A connection that queues the gossip sent down it
+type gossipQueuer interface {
+	queueGossip(c *GossipChannel, m ProtocolMsg, keep bool)
+}
+
+func (conn *LocalConnection) queueGossip(c *GossipChannel, m ProtocolMsg, keep bool) {
+	if conn.gossipQueue.put(queuedGossip{c, m, keep}) {
+		c.stats.queued(conn.remote.Name)
+	} else {
+		c.stats.dropped(conn.remote.Name)
+	}
+}
+
+func (conn *LocalConnection) sendQueuedGossip() {
+	for {
+		g, ok := conn.gossipQueue.next()
+		if !ok {
+			return
+		}
+		g.channel.stats.dequeued(conn.remote.Name)
+		if err := conn.sendProtocolMsg(g.msg); err != nil {
+			conn.Shutdown(err)
+			return
+		}
+		g.channel.stats.sent(conn.remote.Name, g.msg.msg)
+	}
+}
@@ -0,0 +1,64 @@
+package router
+
+import (
+	wt "github.com/weaveworks/weave/testing"
+	"testing"
+	"time"
+)
+
+func TestParseGossipRates(t *testing.T) {
+	rates, err := ParseGossipRates("")
+	wt.AssertNoErr(t, err)
+	wt.AssertEqualInt(t, len(rates), 0, "rates")
+	rates, err = ParseGossipRates("DNS=65536, IPallocation = 1024")
+	wt.AssertNoErr(t, err)
+	wt.AssertEquals(t, rates, map[string]int{"DNS": 65536, "IPallocation": 1024})
+	for _, s := range []string{"DNS", "=10", "DNS=fast", "DNS=0", "DNS=1,DNS=2"} {
+		_, err := ParseGossipRates(s)
+		wt.AssertTrue(t, err != nil, "error parsing "+s)
+	}
+}
+
+func TestGossipLimiter(t *testing.T) {
+	l := newGossipLimiter(1000)
+	wt.AssertFalse(t, l.wait(), "wait with a full bucket")
+	l.take(1500)
+	d := l.delay()
+	wt.AssertTrue(t, d > 400*time.Millisecond && d <= 500*time.Millisecond, "delay in debt")
+	l.last = l.last.Add(-time.Second)
+	wt.AssertFalse(t, l.wait(), "wait after paying off debt")
+}
+
+func TestGossipQueuePriority(t *testing.T) {
+	q := newGossipQueue()
+	channels := make(map[GossipPriority]*GossipChannel)
+	for _, name := range []string{"DNS", "IPallocation", "topology"} {
+		channel := &GossipChannel{name: name, priority: gossipPriority(name)}
+		channels[channel.priority] = channel
+		wt.AssertTrue(t, q.put(queuedGossip{channel, ProtocolMsg{ProtocolGossip, nil}, false}), "put")
+	}
+	for priority := GossipPriorityHigh; priority < numGossipPriorities; priority++ {
+		g, ok := q.next()
+		wt.AssertTrue(t, ok, "next")
+		wt.AssertEqualString(t, g.channel.name, channels[priority].name, "channel")
+	}
+
+	dns := channels[GossipPriorityLow]
+	for i := 0; i < GossipQueueSize; i++ {
+		q.put(queuedGossip{dns, ProtocolMsg{ProtocolGossipBroadcast, nil}, false})
+	}
+	wt.AssertFalse(t, q.put(queuedGossip{dns, ProtocolMsg{ProtocolGossipBroadcast, nil}, false}), "put in a full lane")
+	wt.AssertTrue(t, q.put(queuedGossip{channels[GossipPriorityHigh], ProtocolMsg{ProtocolGossip, nil}, false}), "put in another lane")
+
+	// what is to be kept waits for room in a full lane
+	kept := make(chan bool)
+	go func() { kept <- q.put(queuedGossip{dns, ProtocolMsg{ProtocolGossip, nil}, true}) }()
+	for i := 0; i < 2; i++ {
+		_, ok := q.next()
+		wt.AssertTrue(t, ok, "next")
+	}
+	wt.AssertTrue(t, <-kept, "put kept gossip in a full lane")
+
+	q.Stop()
+	wt.AssertFalse(t, q.put(queuedGossip{dns, ProtocolMsg{ProtocolGossipUnicast, nil}, true}), "put once stopped")
+}
@@ -0,0 +1,111 @@
+package router
+
+import (
+	"sync"
+)
+
+// GossipCounts counts the gossip messages of a channel, and their
+// bytes, that we sent to a neighbour, or received from a peer that
+// originated them, along with the messages queued for, or dropped as
+// the queue was full, on the connection to a neighbour, and how often
+// we held back gossip to a neighbour, or broadcast on behalf of a
+// peer, to keep to the channel's rate
+type GossipCounts struct {
+	SentMessages      uint64
+	SentBytes         uint64
+	ReceivedMessages  uint64
+	ReceivedBytes     uint64
+	QueuedMessages    uint64
+	DroppedMessages   uint64
+	ThrottledMessages uint64
+}
+
+func (counts *GossipCounts) add(other GossipCounts) {
+	counts.SentMessages += other.SentMessages
+	counts.SentBytes += other.SentBytes
+	counts.ReceivedMessages += other.ReceivedMessages
+	counts.ReceivedBytes += other.ReceivedBytes
+	counts.QueuedMessages += other.QueuedMessages
+	counts.DroppedMessages += other.DroppedMessages
+	counts.ThrottledMessages += other.ThrottledMessages
+}
+
+// GossipChannelStats describes the traffic of a gossip channel, in
+// all and by peer
+type GossipChannelStats struct {
+	Totals GossipCounts
+	Peers  map[PeerName]GossipCounts
+}
+
+type gossipStats struct {
+	sync.Mutex
+	peers map[PeerName]*GossipCounts
+}
+
+func (stats *gossipStats) counts(name PeerName) *GossipCounts {
+	if stats.peers == nil {
+		stats.peers = make(map[PeerName]*GossipCounts)
+	}
+	counts, found := stats.peers[name]
+	if !found {
+		counts = &GossipCounts{}
+		stats.peers[name] = counts
+	}
+	return counts
+}
+
+func (stats *gossipStats) sent(to PeerName, msg []byte) {
+	stats.Lock()
+	counts := stats.counts(to)
+	counts.SentMessages++
+	counts.SentBytes += uint64(len(msg))
+	stats.Unlock()
+}
+
+func (stats *gossipStats) received(from PeerName, msg []byte) {
+	stats.Lock()
+	counts := stats.counts(from)
+	counts.ReceivedMessages++
+	counts.ReceivedBytes += uint64(len(msg))
+	stats.Unlock()
+}
+
+func (stats *gossipStats) queued(to PeerName) {
+	stats.Lock()
+	stats.counts(to).QueuedMessages++
+	stats.Unlock()
+}
+
+func (stats *gossipStats) dequeued(to PeerName) {
+	stats.Lock()
+	stats.counts(to).QueuedMessages--
+	stats.Unlock()
+}
+
+func (stats *gossipStats) dropped(to PeerName) {
+	stats.Lock()
+	stats.counts(to).DroppedMessages++
+	stats.Unlock()
+}
+
+func (stats *gossipStats) throttled(name PeerName) {
+	stats.Lock()
+	stats.counts(name).ThrottledMessages++
+	stats.Unlock()
+}
+
+// GossipStats describes the traffic of each gossip channel, by name
+func (router *Router) GossipStats() map[string]GossipChannelStats {
+	result := make(map[string]GossipChannelStats, len(router.GossipChannels))
+	for _, channel := range router.GossipChannels {
+		channel.stats.Lock()
+		stats := GossipChannelStats{Peers: make(map[PeerName]GossipCounts, len(channel.stats.peers))}
+		for name, counts := range channel.stats.peers {
+			stats.Peers[name] = *counts
+			stats.Totals.add(*counts)
+		}
+		channel.stats.Unlock()
+		result[channel.name] = stats
+	}
+	return result
+}
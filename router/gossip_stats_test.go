@@ -0,0 +1,23 @@
+package router
+
+import (
+	"testing"
+
+	wt "github.com/weaveworks/weave/testing"
+)
+
+func TestGossipStats(t *testing.T) {
+	peer1Name, _ := PeerNameFromString("01:00:00:01:00:00")
+	peer2Name, _ := PeerNameFromString("02:00:00:02:00:00")
+	r1 := NewTestRouter(peer1Name)
+	r2 := NewTestRouter(peer2Name)
+	r1.AddTestChannelConnection(r2)
+
+	sent := r1.GossipStats()["topology"]
+	wt.AssertTrue(t, sent.Totals.SentMessages > 0, "messages sent")
+	wt.AssertEqualuint64(t, sent.Peers[peer2Name].SentBytes, sent.Totals.SentBytes, "bytes sent to neighbour")
+	received := r2.GossipStats()["topology"]
+	wt.AssertEqualuint64(t, received.Totals.ReceivedMessages, sent.Totals.SentMessages, "messages received")
+	wt.AssertEqualuint64(t, received.Peers[peer1Name].ReceivedBytes, sent.Totals.SentBytes, "bytes received from originator")
+	wt.AssertEqualuint64(t, received.Totals.SentMessages, 0, "nothing sent back")
+}
@@ -148,3 +148,49 @@ func implTestGossipTopology(t *testing.T) {
 	r3.SendAllGossip()
 	checkTopology(t, r1, r1.tp(r2), r2.tp(r1), r3.tp(r1))
 }
+
+type mockVersionedConnection struct {
+	RemoteConnection
+	ignoresUnknown bool
+	sent           int
+}
+
+func (conn *mockVersionedConnection) SendProtocolMsg(protocolMsg ProtocolMsg) {
+	conn.sent++
+}
+
+func (conn *mockVersionedConnection) ignoresUnknownGossip() bool {
+	return conn.ignoresUnknown
+}
+
+func TestGossipUnknownChannels(t *testing.T) {
+	name, _ := PeerNameFromString("01:00:00:01:00:00")
+	otherName, _ := PeerNameFromString("02:00:00:02:00:00")
+	router := NewTestRouter(name)
+	other := NewPeer(otherName, "", 0, 0)
+	older := &mockVersionedConnection{RemoteConnection: RemoteConnection{router.Ourself.Peer, other, "", false, true}}
+	newer := &mockVersionedConnection{RemoteConnection: RemoteConnection{router.Ourself.Peer, other, "", false, true}, ignoresUnknown: true}
+	msg := ProtocolMsg{ProtocolGossip, []byte{}}
+	for _, channel := range []string{"topology", "connectivity", "mirror"} {
+		router.GossipChannels[hash(channel)].send(older, msg, false)
+		router.GossipChannels[hash(channel)].send(newer, msg, false)
+	}
+	wt.AssertEqualInt(t, older.sent, 1, "gossip to an older peer")
+	wt.AssertEqualInt(t, newer.sent, 3, "gossip to a newer peer")
+
+	wt.AssertNoErr(t, router.handleGossip(ProtocolGossip, GobEncode(hash("newer"), otherName, []byte{})))
+}
+
+func TestRouterPeerGC(t *testing.T) {
+	peer1Name, _ := PeerNameFromString("01:00:00:01:00:00")
+	peer2Name, _ := PeerNameFromString("02:00:00:02:00:00")
+	r1 := NewTestRouter(peer1Name)
+	r2 := NewTestRouter(peer2Name)
+	removed := []PeerName{}
+	r1.OnPeerGC(func(peer *Peer) { removed = append(removed, peer.Name) })
+
+	r1.AddTestChannelConnection(r2)
+	wt.AssertEquals(t, removed, []PeerName{})
+	r1.DeleteTestChannelConnection(r2)
+	wt.AssertEquals(t, removed, []PeerName{peer2Name})
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/hex"
 	"fmt"
 	"strconv"
+	"strings"
 )
 
 type FieldValidator struct {
@@ -87,6 +88,12 @@ func (conn *LocalConnection) handshake(enc *gob.Encoder, dec *gob.Decoder, accep
 		return err
 	}
 	conn.uid = localConnID ^ remoteConnID
+	if fv.fields[TopologyDeltasField] == "1" {
+		conn.topologySent = newTopologySent()
+	}
+	conn.compressGossip = fv.fields[GossipCompressionField] == GossipCompressionSnappy
+	conn.sleeveFrag = fv.fields[SleeveFragmentationField] == "1"
+	conn.unknownGossip = fv.fields[UnknownGossipField] == "1"
 
 	remotePublicStr, rpErr := fv.Value("PublicKey")
 	if usingPassword {
@@ -112,19 +119,30 @@ func (conn *LocalConnection) handshake(enc *gob.Encoder, dec *gob.Decoder, accep
 		conn.Decryptor = NewNonDecryptor()
 	}
 
-	return conn.setRemote(NewPeer(name, nickNameStr, uid, 0))
+	remote := NewPeer(name, nickNameStr, uid, 0)
+	// older peers don't send these
+	if remote.WeaveVersion = fv.fields[WeaveVersionField]; remote.WeaveVersion != "" && fv.fields[FeaturesField] != "" {
+		remote.Features = strings.Split(fv.fields[FeaturesField], ",")
+	}
+	return conn.setRemote(remote)
 }
 
 func (conn *LocalConnection) handshakeSendRecv(localConnID uint64, usingPassword bool, enc *gob.Encoder, dec *gob.Decoder) (*FieldValidator, *[32]byte, error) {
 	versionStr := fmt.Sprint(ProtocolVersion)
 	handshakeSend := map[string]string{
-		"Protocol":        Protocol,
-		"ProtocolVersion": versionStr,
-		"PeerNameFlavour": PeerNameFlavour,
-		"Name":            conn.local.Name.String(),
-		"NickName":        conn.local.NickName,
-		"UID":             fmt.Sprint(conn.local.UID),
-		"ConnID":          fmt.Sprint(localConnID)}
+		"Protocol":               Protocol,
+		"ProtocolVersion":        versionStr,
+		"PeerNameFlavour":        PeerNameFlavour,
+		"Name":                   conn.local.Name.String(),
+		"NickName":               conn.local.NickName,
+		"UID":                    fmt.Sprint(conn.local.UID),
+		"ConnID":                 fmt.Sprint(localConnID),
+		TopologyDeltasField:      "1",
+		GossipCompressionField:   GossipCompressionSnappy,
+		SleeveFragmentationField: "1",
+		UnknownGossipField:       "1",
+		WeaveVersionField:        conn.Router.WeaveVersion,
+		FeaturesField:            strings.Join(conn.local.Features, ",")}
 	handshakeRecv := map[string]string{}
 
 	var public, private *[32]byte
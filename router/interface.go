@@ -0,0 +1,184 @@
+package router
+
+import (
+	"io"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	weavenet "github.com/weaveworks/weave/net"
+)
+
+// Injects frames into whichever interface we are capturing on, and
+// drops them while we aren't
+type injector struct {
+	sync.RWMutex
+	sink PacketSink
+}
+
+func (inj *injector) WritePacket(data []byte) error {
+	inj.RLock()
+	defer inj.RUnlock()
+	if inj.sink == nil {
+		return nil
+	}
+	return inj.sink.WritePacket(data)
+}
+
+// Replace the sink, closing the old one
+func (inj *injector) set(sink PacketSink) {
+	inj.Lock()
+	old := inj.sink
+	inj.sink = sink
+	inj.Unlock()
+	closePacketIO(old)
+}
+
+func closePacketIO(x interface{}) {
+	if c, ok := x.(io.Closer); ok {
+		c.Close()
+	}
+}
+
+func (router *Router) openCapture(iface *net.Interface) (PacketSourceSink, PacketSink, error) {
+	if router.DatapathChild {
+		cio, err := NewDatapathChildIO(router.RouterConfig, iface)
+		if err != nil {
+			return nil, nil, err
+		}
+		return cio, cio, nil
+	}
+	switch router.Datapath {
+	case DatapathTap:
+		tio, err := NewTapIO(router.Tap, iface.Name)
+		if err != nil {
+			return nil, nil, err
+		}
+		return tio, tio, nil
+	case DatapathAFPacket:
+		aio, err := NewAFPacketIO(iface.Name, router.Workers, router.BufSz)
+		if err != nil {
+			return nil, nil, err
+		}
+		return aio, aio, nil
+	}
+	// We need two pcap handles since they aren't thread-safe
+	pio, err := NewPcapIO(iface.Name, router.BufSz)
+	if err != nil {
+		return nil, nil, err
+	}
+	po, err := NewPcapO(iface.Name)
+	if err != nil {
+		closePacketIO(pio)
+		return nil, nil, err
+	}
+	return pio, po, nil
+}
+
+// Capture on, and inject into, iface; called with captureLock held
+func (router *Router) startCapture(iface *net.Interface) error {
+	pio, po, err := router.openCapture(iface)
+	if err != nil {
+		return err
+	}
+	router.Iface = iface
+	router.noteDatapathChild(pio)
+	router.injector.set(po)
+	router.sniff(iface, pio)
+	return nil
+}
+
+// The interface we capture on, or nil
+func (router *Router) capturedIface() *net.Interface {
+	router.captureLock.Lock()
+	defer router.captureLock.Unlock()
+	return router.Iface
+}
+
+// InterfaceUp tells the router that its interface is up, perhaps
+// having been deleted and created again, so that it captures on it
+// again if it stopped when the interface went away.
+func (router *Router) InterfaceUp(iface *net.Interface) error {
+	router.captureLock.Lock()
+	defer router.captureLock.Unlock()
+	if router.Iface == nil || !router.Started() {
+		return nil
+	}
+	if router.Capturing() {
+		// if it is a new interface, capture on the old one will
+		// fail, and we will move to this one then; a TAP device
+		// outlives its bridge, so we plug it into the new one
+		if router.Datapath == DatapathTap && iface.Index != router.Iface.Index {
+			log.Println("Bridge", iface.Name, "is back; plugging", router.Tap, "into it")
+			if err := weavenet.PlugTap(router.Tap, iface.Name); err != nil {
+				return err
+			}
+		}
+		router.Iface = iface
+		return nil
+	}
+	log.Println("Interface", iface.Name, "is up again")
+	return router.startCapture(iface)
+}
+
+// The capture loop on iface has stopped with err; if that is because
+// the interface went away, we wait for it to come back, and if it is
+// back already we capture on it again
+func (router *Router) captureStopped(iface *net.Interface, pio PacketSourceSink, err error) {
+	router.captureLock.Lock()
+	defer router.captureLock.Unlock()
+	if pio != router.capture {
+		// the watchdog has had us capture afresh already
+		closePacketIO(pio)
+		return
+	}
+	router.capture = nil
+	atomic.StoreInt32(&router.capturing, 0)
+	closePacketIO(pio)
+	router.injector.set(nil)
+	if router.Iface.Index == iface.Index {
+		now, findErr := net.InterfaceByName(iface.Name)
+		up := findErr == nil && now.Flags&net.FlagUp != 0
+		if up && now.Index == iface.Index && router.Datapath != DatapathTap && !router.DatapathChild {
+			// the interface is fine, so capture isn't
+			checkFatal(err)
+		}
+		log.Printf("Stopped sniffing traffic on %s: %s", iface.Name, err)
+		if !up {
+			log.Println("Waiting for", iface.Name, "to come back")
+			return
+		}
+		router.Iface = now
+	}
+	if router.DatapathChild {
+		router.restartDatapathChild()
+		return
+	}
+	// if the TAP device was deleted, this makes another
+	if err := router.startCapture(router.Iface); err != nil {
+		log.Println("Unable to sniff traffic on", router.Iface.Name, err)
+	}
+}
+
+// Capture afresh on the interface, the capture loop reading from pio
+// having stalled. Should the stalled worker get going again, it finds
+// pio closed, and stops, leaving the new capture loop be.
+func (router *Router) restartCapture(pio PacketSourceSink) {
+	router.captureLock.Lock()
+	defer router.captureLock.Unlock()
+	if pio != router.capture {
+		return
+	}
+	router.capture = nil
+	atomic.StoreInt32(&router.capturing, 0)
+	closePacketIO(pio)
+	router.injector.set(nil)
+	log.Println("Capturing afresh on", router.Iface.Name)
+	if err := router.startCapture(router.Iface); err != nil {
+		log.Println("Unable to sniff traffic on", router.Iface.Name, err)
+		if router.DatapathChild {
+			router.restartDatapathChild()
+		}
+	}
+}
@@ -16,7 +16,8 @@ func (router *Router) StatusJSON(version, encryption string) ([]byte, error) {
 		Macs       *MacCache
 		Peers      *Peers
 		Routes     *Routes
-	}{version, encryption, router.Ourself.Name.String(), router.Ourself.NickName, fmt.Sprintf("%v", router.Iface), router.Macs, router.Peers, router.Routes})
+		Versions   VersionSpread
+	}{version, encryption, router.Ourself.Name.String(), router.Ourself.NickName, fmt.Sprintf("%v", router.capturedIface()), router.Macs, router.Peers, router.Routes, router.Peers.VersionSpread()})
 	// leaving out ConectionMaker due to async complexities
 }
 
@@ -28,19 +29,23 @@ func (cache *MacCache) MarshalJSON() ([]byte, error) {
 		LastSeen time.Time
 	}
 	var entries []*cacheEntry
-	for key, entry := range cache.table {
+	cache.forEach(func(key uint64, entry *MacCacheEntry) {
 		entries = append(entries, &cacheEntry{intmac(key).String(), entry.peer.Name.String(), entry.peer.NickName, entry.lastSeen})
-	}
+	})
 	return json.Marshal(entries)
 }
 
 func (peers *Peers) MarshalJSON() ([]byte, error) {
 	type p struct {
-		Name        string
-		NickName    string
-		UID         PeerUID
-		Version     uint64
-		Connections []Connection
+		Name     string
+		NickName string
+		UID      PeerUID
+		Labels   map[string]string `json:",omitempty"`
+		Version  uint64
+		// of weave the peer runs, and the features it has enabled
+		WeaveVersion string   `json:",omitempty"`
+		Features     []string `json:",omitempty"`
+		Connections  []Connection
 	}
 	var ps []*p
 	peers.ForEach(func(peer *Peer) {
@@ -57,7 +62,7 @@ func (peers *Peers) MarshalJSON() ([]byte, error) {
 				connections = append(connections, conn)
 			}
 		}
-		ps = append(ps, &p{peer.Name.String(), peer.NickName, peer.UID, peer.version, connections})
+		ps = append(ps, &p{peer.Name.String(), peer.NickName, peer.UID, peer.Labels, peer.version, peer.WeaveVersion, peer.Features, connections})
 	})
 	return json.Marshal(ps)
 }
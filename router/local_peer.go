@@ -6,6 +6,8 @@ import (
 	"net"
 	"sync"
 	"time"
+
+	"github.com/weaveworks/weave/common/events"
 )
 
 type LocalPeer struct {
@@ -169,12 +171,17 @@ func (peer *LocalPeer) DeleteConnection(conn *LocalConnection) {
 
 func (peer *LocalPeer) actorLoop(actionChan <-chan LocalPeerAction) {
 	gossipTimer := time.Tick(GossipInterval)
+	progress := peer.router.Watchdog.Watch("local peer", nil)
 	for {
 		select {
 		case action := <-actionChan:
+			progress.Begin()
 			action()
+			progress.End()
 		case <-gossipTimer:
+			progress.Begin()
 			peer.router.SendAllGossip()
+			progress.End()
 		}
 	}
 }
@@ -231,6 +238,7 @@ func (peer *LocalPeer) handleConnectionEstablished(conn Connection) {
 	}
 	peer.connectionEstablished(conn)
 	conn.Log("connection fully established")
+	events.Publish(events.ConnectionEstablished, connectionEventFields(conn, peer.router.Annotations))
 	peer.broadcastPeerUpdate()
 }
 
@@ -247,6 +255,9 @@ func (peer *LocalPeer) handleDeleteConnection(conn Connection) {
 	}
 	peer.deleteConnection(conn)
 	conn.Log("connection deleted")
+	if conn.Established() {
+		events.Publish(events.ConnectionLost, connectionEventFields(conn, peer.router.Annotations))
+	}
 	// Must do garbage collection first to ensure we don't send out an
 	// update with unreachable peers (can cause looping)
 	peer.router.Peers.GarbageCollect()
@@ -260,6 +271,17 @@ func (peer *LocalPeer) broadcastPeerUpdate(peers ...*Peer) {
 	peer.router.TopologyGossip.GossipBroadcast(NewTopologyGossipData(peer.router.Peers, append(peers, peer.Peer)...))
 }
 
+func connectionEventFields(conn Connection, annotations *Annotations) map[string]string {
+	fields := map[string]string{
+		"peer":     conn.Remote().Name.String(),
+		"nickname": conn.Remote().NickName,
+		"address":  conn.RemoteTCPAddr()}
+	if a, found := annotations.Lookup(conn.Remote().Name.String(), conn.Remote().NickName, conn.RemoteTCPAddr()); found && a.Note != "" {
+		fields["note"] = a.Note
+	}
+	return fields
+}
+
 func (peer *LocalPeer) checkConnectionLimit() error {
 	limit := peer.router.ConnLimit
 	if 0 != limit && peer.connectionCount() >= limit {
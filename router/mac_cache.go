@@ -13,19 +13,39 @@ type MacCacheEntry struct {
 	peer     *Peer
 }
 
-type MacCache struct {
+// The cache is consulted for every frame we forward, by the capture
+// loop and by every connection, so rather than having one lock that
+// they all contend for, it is split into shards, by a hash of the
+// MAC, each with its own lock
+const macCacheShards = 64 // a power of 2
+
+type macCacheShard struct {
 	sync.RWMutex
-	table       map[uint64]*MacCacheEntry
+	table map[uint64]*MacCacheEntry
+	_     [32]byte // to 64 bytes, so that shards' locks are on different cache lines
+}
+
+type MacCache struct {
+	shards      [macCacheShards]macCacheShard
 	maxAge      time.Duration
 	expiryTimer *time.Timer
 	onExpiry    func(net.HardwareAddr, *Peer)
 }
 
 func NewMacCache(maxAge time.Duration, onExpiry func(net.HardwareAddr, *Peer)) *MacCache {
-	return &MacCache{
-		table:    make(map[uint64]*MacCacheEntry),
+	cache := &MacCache{
 		maxAge:   maxAge,
 		onExpiry: onExpiry}
+	for i := range cache.shards {
+		cache.shards[i].table = make(map[uint64]*MacCacheEntry)
+	}
+	return cache
+}
+
+// MACs on a network mostly differ in their last few bytes, so we mix
+// all of them into the top bits, and pick the shard by those
+func (cache *MacCache) shard(key uint64) *macCacheShard {
+	return &cache.shards[(key*0x9e3779b97f4a7c15)>>58]
 }
 
 func (cache *MacCache) Start() {
@@ -34,19 +54,20 @@ func (cache *MacCache) Start() {
 
 func (cache *MacCache) Enter(mac net.HardwareAddr, peer *Peer) bool {
 	key := macint(mac)
+	shard := cache.shard(key)
 	now := time.Now()
-	cache.RLock()
-	entry, found := cache.table[key]
+	shard.RLock()
+	entry, found := shard.table[key]
 	if found && entry.peer == peer && now.Before(entry.lastSeen.Add(cache.maxAge/10)) {
-		cache.RUnlock()
+		shard.RUnlock()
 		return false
 	}
-	cache.RUnlock()
-	cache.Lock()
-	defer cache.Unlock()
-	entry, found = cache.table[key]
+	shard.RUnlock()
+	shard.Lock()
+	defer shard.Unlock()
+	entry, found = shard.table[key]
 	if !found {
-		cache.table[key] = &MacCacheEntry{lastSeen: now, peer: peer}
+		shard.table[key] = &MacCacheEntry{lastSeen: now, peer: peer}
 		return true
 	}
 	if entry.peer != peer {
@@ -62,9 +83,10 @@ func (cache *MacCache) Enter(mac net.HardwareAddr, peer *Peer) bool {
 
 func (cache *MacCache) Lookup(mac net.HardwareAddr) (*Peer, bool) {
 	key := macint(mac)
-	cache.RLock()
-	defer cache.RUnlock()
-	entry, found := cache.table[key]
+	shard := cache.shard(key)
+	shard.RLock()
+	defer shard.RUnlock()
+	entry, found := shard.table[key]
 	if !found {
 		return nil, false
 	}
@@ -73,24 +95,37 @@ func (cache *MacCache) Lookup(mac net.HardwareAddr) (*Peer, bool) {
 
 func (cache *MacCache) Delete(peer *Peer) bool {
 	found := false
-	cache.Lock()
-	defer cache.Unlock()
-	for key, entry := range cache.table {
-		if entry.peer == peer {
-			delete(cache.table, key)
-			found = true
+	for i := range cache.shards {
+		shard := &cache.shards[i]
+		shard.Lock()
+		for key, entry := range shard.table {
+			if entry.peer == peer {
+				delete(shard.table, key)
+				found = true
+			}
 		}
+		shard.Unlock()
 	}
 	return found
 }
 
+// Call f with each entry, one shard at a time, holding its lock
+func (cache *MacCache) forEach(f func(uint64, *MacCacheEntry)) {
+	for i := range cache.shards {
+		shard := &cache.shards[i]
+		shard.RLock()
+		for key, entry := range shard.table {
+			f(key, entry)
+		}
+		shard.RUnlock()
+	}
+}
+
 func (cache *MacCache) String() string {
 	var buf bytes.Buffer
-	cache.RLock()
-	defer cache.RUnlock()
-	for key, entry := range cache.table {
+	cache.forEach(func(key uint64, entry *MacCacheEntry) {
 		fmt.Fprintf(&buf, "%v -> %s (%v)\n", intmac(key), entry.peer, entry.lastSeen)
-	}
+	})
 	return buf.String()
 }
 
@@ -100,13 +135,16 @@ func (cache *MacCache) setExpiryTimer() {
 
 func (cache *MacCache) expire() {
 	now := time.Now()
-	cache.Lock()
-	defer cache.Unlock()
-	for key, entry := range cache.table {
-		if now.After(entry.lastSeen.Add(cache.maxAge)) {
-			delete(cache.table, key)
-			cache.onExpiry(intmac(key), entry.peer)
+	for i := range cache.shards {
+		shard := &cache.shards[i]
+		shard.Lock()
+		for key, entry := range shard.table {
+			if now.After(entry.lastSeen.Add(cache.maxAge)) {
+				delete(shard.table, key)
+				cache.onExpiry(intmac(key), entry.peer)
+			}
 		}
+		shard.Unlock()
 	}
 	cache.setExpiryTimer()
 }
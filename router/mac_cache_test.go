@@ -0,0 +1,86 @@
+package router
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	wt "github.com/weaveworks/weave/testing"
+)
+
+func testMAC(i int) net.HardwareAddr {
+	return intmac(0x020000000000 | uint64(i))
+}
+
+func TestMacCache(t *testing.T) {
+	name1, _ := PeerNameFromString("01:00:00:01:00:00")
+	name2, _ := PeerNameFromString("02:00:00:02:00:00")
+	peer1, peer2 := NewPeer(name1, "one", 0, 0), NewPeer(name2, "two", 0, 0)
+	var expired []string
+	cache := NewMacCache(time.Hour, func(mac net.HardwareAddr, peer *Peer) {
+		expired = append(expired, mac.String())
+	})
+
+	const n = 1000
+	for i := 0; i < n; i++ {
+		wt.AssertTrue(t, cache.Enter(testMAC(i), peer1), "new MAC entered")
+	}
+	wt.AssertFalse(t, cache.Enter(testMAC(0), peer1), "MAC seen again")
+	wt.AssertTrue(t, cache.Enter(testMAC(1), peer2), "MAC moved to another peer")
+	peer, found := cache.Lookup(testMAC(1))
+	wt.AssertTrue(t, found && peer == peer2, "lookup of moved MAC")
+	_, found = cache.Lookup(testMAC(n))
+	wt.AssertFalse(t, found, "lookup of unknown MAC")
+
+	used := 0
+	for i := range cache.shards {
+		if len(cache.shards[i].table) > 0 {
+			used++
+		}
+	}
+	wt.AssertEqualInt(t, used, macCacheShards, "shards used by consecutive MACs")
+
+	wt.AssertTrue(t, cache.Delete(peer2), "deleted peer's MACs")
+	_, found = cache.Lookup(testMAC(1))
+	wt.AssertFalse(t, found, "lookup of deleted peer's MAC")
+	entries := 0
+	cache.forEach(func(uint64, *MacCacheEntry) { entries++ })
+	wt.AssertEqualInt(t, entries, n-1, "entries left")
+
+	cache.shard(macint(testMAC(2))).table[macint(testMAC(2))].lastSeen = time.Now().Add(-2 * time.Hour)
+	cache.expire()
+	cache.expiryTimer.Stop()
+	wt.AssertEquals(t, expired, []string{testMAC(2).String()})
+}
+
+// What the forwarding path does for each frame: learn the source
+// MAC, and look up the destination. Run with e.g. -cpu 1,4,16 to see
+// how it scales.
+func benchmarkMacCache(b *testing.B, macs int) {
+	name, _ := PeerNameFromString("01:00:00:01:00:00")
+	peer := NewPeer(name, "", 0, 0)
+	cache := NewMacCache(time.Hour, nil)
+	for i := 0; i < macs; i++ {
+		cache.Enter(testMAC(i), peer)
+	}
+	var goroutines int64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := int(atomic.AddInt64(&goroutines, 1)) * 7919
+		for pb.Next() {
+			cache.Enter(testMAC(i%macs), peer)
+			cache.Lookup(testMAC((i + 1) % macs))
+			i++
+		}
+	})
+}
+
+func BenchmarkMacCacheForwarding(b *testing.B) {
+	benchmarkMacCache(b, 4096)
+}
+
+// The worst case, where every frame is between the same two MACs
+func BenchmarkMacCacheForwardingTwoMACs(b *testing.B) {
+	benchmarkMacCache(b, 2)
+}
@@ -0,0 +1,302 @@
+package router
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	weavenet "github.com/weaveworks/weave/net"
+)
+
+// The router can mirror the frames matching a filter, like a SPAN
+// port: copies of them are sent from an interface, e.g. the host's
+// end of a monitoring container's veth, here or on another peer, until
+// the session expires or is stopped. Copies for another peer go to it
+// over gossip, with the session's expiry, which then sends them from
+// its interface until the session is stopped or, should it not hear
+// of that, expires.
+
+const (
+	DefaultMirrorDuration = 10 * time.Minute
+	MaxMirrorDuration     = 24 * time.Hour
+	maxIfaceName          = 15 // IFNAMSIZ, less the terminating NUL
+)
+
+// MirrorSession describes a stream of copies of frames
+type MirrorSession struct {
+	ID      string
+	Filter  string   // which frames are copied; all if blank
+	Peer    PeerName // which sends the copies
+	Iface   string   // which they are sent from
+	Expires time.Time
+	Frames  uint64 // copied
+	Dropped uint64 // not copied, because we couldn't keep up, or couldn't send them
+}
+
+type mirror struct {
+	MirrorSession   // less the counts, which are these
+	frames, dropped uint64
+	seq             int
+	capture         *Capture
+	sink            mirrorSink // nil if the copies go to another peer
+	timer           *time.Timer
+}
+
+// Where copies of frames go, on an interface
+type mirrorSink interface {
+	WriteFrame([]byte) error
+	Close() error
+}
+
+// Where copies of frames from other peers' sessions go
+type remoteSink struct {
+	sink    mirrorSink // nil if we can't send from the interface
+	expires time.Time  // the latest of the sessions'
+	timer   *time.Timer
+}
+
+type mirrors struct {
+	sync.Mutex
+	router   *Router
+	gossip   Gossip
+	nextSeq  int
+	sessions map[string]*mirror
+	sinks    map[string]*remoteSink // by interface, for other peers' sessions
+	open     func(iface string) (mirrorSink, error)
+}
+
+func newMirrors(router *Router) *mirrors {
+	return &mirrors{
+		router:   router,
+		sessions: make(map[string]*mirror),
+		sinks:    make(map[string]*remoteSink),
+		open: func(iface string) (mirrorSink, error) {
+			sockets, err := weavenet.OpenPacketSockets(iface, 1, 0)
+			if err != nil {
+				return nil, err
+			}
+			return sockets[0], nil
+		}}
+}
+
+// StartMirror starts copying the frames we capture and inject that
+// match, or all of them if match is nil, to iface on peer, for
+// duration, or DefaultMirrorDuration if it is 0. filter describes
+// match.
+func (router *Router) StartMirror(filter string, match func([]byte) bool, peer PeerName, iface string, duration time.Duration) (MirrorSession, error) {
+	ms := router.mirrors
+	if iface == "" || len(iface) > maxIfaceName {
+		return MirrorSession{}, fmt.Errorf("Invalid interface %q to mirror frames to", iface)
+	}
+	if duration <= 0 {
+		duration = DefaultMirrorDuration
+	} else if duration > MaxMirrorDuration {
+		duration = MaxMirrorDuration
+	}
+	var sink mirrorSink
+	if peer == router.Ourself.Name {
+		if err := router.checkMirrorIface(iface); err != nil {
+			return MirrorSession{}, err
+		}
+		var err error
+		if sink, err = ms.open(iface); err != nil {
+			return MirrorSession{}, err
+		}
+	} else if _, found := router.Peers.Fetch(peer); !found {
+		return MirrorSession{}, fmt.Errorf("Unknown peer %s", peer)
+	}
+	ms.Lock()
+	defer ms.Unlock()
+	ms.nextSeq++
+	m := &mirror{
+		MirrorSession: MirrorSession{ID: strconv.Itoa(ms.nextSeq), Filter: filter, Peer: peer, Iface: iface, Expires: time.Now().Add(duration)},
+		seq:           ms.nextSeq,
+		capture:       router.StartCapture(false, UnknownPeerName, match),
+		sink:          sink}
+	ms.sessions[m.ID] = m
+	m.timer = time.AfterFunc(duration, func() { router.StopMirror(m.ID) })
+	go ms.run(m)
+	log.Printf("Mirroring frames matching %q to %s on %s, until %s", filter, iface, peer, m.Expires.Format(time.RFC3339))
+	return m.session(), nil
+}
+
+// StopMirror stops the session with the ID given, returning whether
+// there was one
+func (router *Router) StopMirror(id string) bool {
+	ms := router.mirrors
+	ms.Lock()
+	m, found := ms.sessions[id]
+	delete(ms.sessions, id)
+	ms.Unlock()
+	if !found {
+		return false
+	}
+	m.timer.Stop()
+	router.StopCapture(m.capture)
+	log.Printf("Stopped mirroring frames to %s on %s", m.Iface, m.Peer)
+	return true
+}
+
+// Mirrors returns the sessions, oldest first
+func (router *Router) Mirrors() []MirrorSession {
+	ms := router.mirrors
+	ms.Lock()
+	all := make([]*mirror, 0, len(ms.sessions))
+	for _, m := range ms.sessions {
+		all = append(all, m)
+	}
+	ms.Unlock()
+	sort.Sort(mirrorsBySeq(all))
+	sessions := make([]MirrorSession, len(all))
+	for i, m := range all {
+		sessions[i] = m.session()
+	}
+	return sessions
+}
+
+func (m *mirror) session() MirrorSession {
+	s := m.MirrorSession
+	s.Frames = atomic.LoadUint64(&m.frames)
+	s.Dropped = atomic.LoadUint64(&m.dropped) + m.capture.Dropped()
+	return s
+}
+
+// Send copies until the session stops
+func (ms *mirrors) run(m *mirror) {
+	for frame := range m.capture.Frames {
+		var err error
+		if m.sink != nil {
+			err = m.sink.WriteFrame(frame.Data)
+		} else {
+			err = ms.gossip.GossipUnicast(m.Peer, encodeMirrorFrame(m.Iface, m.Expires, frame.Data))
+		}
+		if err != nil {
+			atomic.AddUint64(&m.dropped, 1)
+		} else {
+			atomic.AddUint64(&m.frames, 1)
+		}
+	}
+	if m.sink != nil {
+		m.sink.Close()
+	} else {
+		// tell the peer it can stop sending from the interface
+		ms.gossip.GossipUnicast(m.Peer, encodeMirrorFrame(m.Iface, m.Expires, nil))
+	}
+}
+
+// Sending copies from the interface the router captures on would
+// deliver them, as well as the frames, to their destinations
+func (router *Router) checkMirrorIface(iface string) error {
+	if captured := router.capturedIface(); captured != nil && iface == captured.Name {
+		return fmt.Errorf("Unable to mirror frames to %s, which the router captures on", iface)
+	}
+	return nil
+}
+
+// A copy of a frame, for another peer to send from iface, until
+// expires; a nil frame ends the session
+func encodeMirrorFrame(iface string, expires time.Time, frame []byte) []byte {
+	expiry := make([]byte, 8)
+	binary.BigEndian.PutUint64(expiry, uint64(expires.UnixNano()))
+	return Concat([]byte{byte(len(iface))}, []byte(iface), expiry, frame)
+}
+
+func decodeMirrorFrame(msg []byte) (string, time.Time, []byte, error) {
+	if len(msg) < 1 || len(msg) < 1+int(msg[0])+8 {
+		return "", time.Time{}, nil, fmt.Errorf("Mirrored frame too short")
+	}
+	n := 1 + int(msg[0])
+	expires := time.Unix(0, int64(binary.BigEndian.Uint64(msg[n:])))
+	return string(msg[1:n]), expires, msg[n+8:], nil
+}
+
+// OnGossipUnicast sends a copy of a frame from another peer's session
+// from the interface it asks for. Failures are only logged, since the
+// connection it came over is fine.
+func (ms *mirrors) OnGossipUnicast(sender PeerName, msg []byte) error {
+	iface, expires, frame, err := decodeMirrorFrame(msg)
+	if err != nil {
+		log.Println("Unable to mirror frame from", sender, err)
+		return nil
+	}
+	// the other peer's clock may be off
+	if latest := time.Now().Add(MaxMirrorDuration); expires.After(latest) {
+		expires = latest
+	}
+	ms.Lock()
+	defer ms.Unlock()
+	rs, found := ms.sinks[iface]
+	if len(frame) == 0 {
+		if found {
+			ms.closeSink(iface, rs)
+		}
+		return nil
+	}
+	if !found {
+		rs = &remoteSink{expires: expires}
+		if err = ms.router.checkMirrorIface(iface); err == nil {
+			rs.sink, err = ms.open(iface)
+		}
+		if err != nil {
+			log.Println("Unable to mirror frames from", sender, err)
+		}
+		rs.timer = time.AfterFunc(expires.Sub(time.Now()), func() { ms.expireSink(iface, rs) })
+		ms.sinks[iface] = rs
+	} else if expires.After(rs.expires) {
+		rs.expires = expires
+		rs.timer.Reset(expires.Sub(time.Now()))
+	}
+	if rs.sink != nil {
+		if err := rs.sink.WriteFrame(frame); err != nil {
+			log.Println("Unable to mirror frame from", sender, "to", iface, err)
+			rs.sink.Close()
+			rs.sink = nil
+		}
+	}
+	return nil
+}
+
+// Stop sending copies from iface for other peers; called with the lock
+// held
+func (ms *mirrors) closeSink(iface string, rs *remoteSink) {
+	rs.timer.Stop()
+	if rs.sink != nil {
+		rs.sink.Close()
+	}
+	delete(ms.sinks, iface)
+}
+
+// The sessions of other peers sending copies to iface have expired,
+// without our hearing that they stopped, e.g. because the peer died
+func (ms *mirrors) expireSink(iface string, rs *remoteSink) {
+	ms.Lock()
+	defer ms.Unlock()
+	if ms.sinks[iface] != rs || time.Now().Before(rs.expires) {
+		return
+	}
+	ms.closeSink(iface, rs)
+	log.Println("Stopped mirroring frames from other peers to", iface+": their sessions have expired")
+}
+
+func (ms *mirrors) OnGossipBroadcast(update []byte) (GossipData, error) {
+	return nil, nil
+}
+
+func (ms *mirrors) Gossip() GossipData {
+	return nil
+}
+
+func (ms *mirrors) OnGossip(update []byte) (GossipData, error) {
+	return nil, nil
+}
+
+type mirrorsBySeq []*mirror
+
+func (m mirrorsBySeq) Len() int           { return len(m) }
+func (m mirrorsBySeq) Swap(i, j int)      { m[i], m[j] = m[j], m[i] }
+func (m mirrorsBySeq) Less(i, j int) bool { return m[i].seq < m[j].seq }
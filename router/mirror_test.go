@@ -0,0 +1,131 @@
+package router
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	wt "github.com/weaveworks/weave/testing"
+)
+
+type mockMirrorSink struct {
+	sync.Mutex
+	frames [][]byte
+	closed bool
+}
+
+func (s *mockMirrorSink) WriteFrame(frame []byte) error {
+	s.Lock()
+	defer s.Unlock()
+	s.frames = append(s.frames, append([]byte{}, frame...))
+	return nil
+}
+
+func (s *mockMirrorSink) Close() error {
+	s.Lock()
+	defer s.Unlock()
+	s.closed = true
+	return nil
+}
+
+func (s *mockMirrorSink) received() ([][]byte, bool) {
+	s.Lock()
+	defer s.Unlock()
+	return s.frames, s.closed
+}
+
+// Delivers unicasts straight to another peer's mirrors
+type mockMirrorGossip struct {
+	sender PeerName
+	to     *mirrors
+}
+
+func (g *mockMirrorGossip) GossipUnicast(dst PeerName, msg []byte) error {
+	return g.to.OnGossipUnicast(g.sender, msg)
+}
+
+func (g *mockMirrorGossip) GossipBroadcast(update GossipData) error {
+	return nil
+}
+
+func waitFor(t *testing.T, desc string, cond func() bool) {
+	for deadline := time.Now().Add(5 * time.Second); !cond(); {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", desc)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestMirror(t *testing.T) {
+	name1, _ := PeerNameFromString("01:00:00:00:00:01")
+	name2, _ := PeerNameFromString("01:00:00:00:00:02")
+	router1, router2 := NewTestRouter(name1), NewTestRouter(name2)
+	router1.Peers.FetchWithDefault(NewPeer(name2, "", 0, 0))
+	router1.mirrors.gossip = &mockMirrorGossip{name1, router2.mirrors}
+	var lock sync.Mutex
+	sinks := map[string]*mockMirrorSink{}
+	open := func(iface string) (mirrorSink, error) {
+		if iface == "nonesuch" {
+			return nil, fmt.Errorf("Unable to find interface %s", iface)
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		sinks[iface] = &mockMirrorSink{}
+		return sinks[iface], nil
+	}
+	// what was sent from iface, as the peers open it
+	received := func(iface string) ([][]byte, bool) {
+		lock.Lock()
+		sink, found := sinks[iface]
+		lock.Unlock()
+		if !found {
+			return nil, false
+		}
+		return sink.received()
+	}
+	router1.mirrors.open, router2.mirrors.open = open, open
+	wanted, unwanted := []byte("wanted frame"), []byte("unwanted frame")
+	match := func(frame []byte) bool { return bytes.HasPrefix(frame, []byte("wanted")) }
+
+	_, err := router1.StartMirror("", nil, name1, "nonesuch", 0)
+	wt.AssertTrue(t, err != nil, "no such interface")
+	_, err = router1.StartMirror("", nil, name1, "", 0)
+	wt.AssertTrue(t, err != nil, "no interface")
+
+	local, err := router1.StartMirror("wanted", match, name1, "vethmon1", 0)
+	wt.AssertNoErr(t, err)
+	remote, err := router1.StartMirror("wanted", match, name2, "vethmon2", time.Hour)
+	wt.AssertNoErr(t, err)
+	wt.AssertTrue(t, local.Expires.Before(remote.Expires), "durations")
+	router1.captureEthernet(nil, wanted)
+	router1.captureEthernet(nil, unwanted)
+	waitFor(t, "mirrored frames", func() bool {
+		local, _ := received("vethmon1")
+		remote, _ := received("vethmon2")
+		return len(local) == 1 && len(remote) == 1
+	})
+	frames, _ := received("vethmon2")
+	wt.AssertTrue(t, bytes.Equal(frames[0], wanted), "frame mirrored to another peer")
+	sessions := router1.Mirrors()
+	wt.AssertEqualInt(t, len(sessions), 2, "sessions")
+	wt.AssertEqualString(t, sessions[0].ID, local.ID, "oldest first")
+	wt.AssertEqualInt(t, int(sessions[1].Frames), 1, "frames mirrored")
+
+	// stopping, or expiring, closes the interfaces, here and on the
+	// other peer
+	wt.AssertTrue(t, router1.StopMirror(remote.ID), "stopped")
+	wt.AssertFalse(t, router1.StopMirror(remote.ID), "stopped twice")
+	waitFor(t, "remote interface closed", func() bool { _, closed := received("vethmon2"); return closed })
+	_, err = router1.StartMirror("", nil, name1, "vethmon3", time.Millisecond)
+	wt.AssertNoErr(t, err)
+	waitFor(t, "expiry", func() bool { _, closed := received("vethmon3"); return closed })
+	wt.AssertEqualInt(t, len(router1.Mirrors()), 1, "sessions left")
+
+	// the other peer stops sending copies once the session expires,
+	// even if it doesn't hear that it has stopped
+	wt.AssertNoErr(t, router2.mirrors.OnGossipUnicast(name1, encodeMirrorFrame("vethmon4", time.Now().Add(time.Millisecond), wanted)))
+	waitFor(t, "remote expiry", func() bool { _, closed := received("vethmon4"); return closed })
+}
@@ -0,0 +1,98 @@
+package router
+
+import (
+	"fmt"
+	"sort"
+)
+
+// In a partial mesh each peer connects to just a few others, its
+// neighbours, rather than to every peer it knows of, relying on
+// routing over several hops to reach the rest. To cover the topology,
+// every peer places all the peers it knows of on a ring, in order of
+// name, and takes as its neighbours those a power of two places on
+// from it, 1, 2, 4 and so on, then, if it wants more, those in
+// between, nearest first. Since every peer has the next on the ring as
+// a neighbour, the peers are all connected, and since the distances
+// double, any peer is at most a logarithmic number of hops from any
+// other.
+
+// Neighbours returns those of names that the peer called name has as
+// its neighbours when it has n; all but name itself if n is 0
+func Neighbours(names []PeerName, name PeerName, n int) PeerNameSet {
+	ring := make([]PeerName, len(names))
+	copy(ring, names)
+	sort.Sort(byName(ring))
+	neighbours := make(PeerNameSet)
+	i := sort.Search(len(ring), func(i int) bool { return ring[i].String() >= name.String() })
+	if i == len(ring) || ring[i] != name {
+		return neighbours // the peer isn't on the ring
+	}
+	if n <= 0 || n >= len(ring)-1 {
+		n = len(ring) - 1
+	}
+	add := func(distance int) {
+		if len(neighbours) < n {
+			neighbours[ring[(i+distance)%len(ring)]] = void
+		}
+	}
+	for distance := 1; distance < len(ring); distance *= 2 {
+		add(distance)
+	}
+	for distance := 3; distance < len(ring); distance++ {
+		if distance&(distance-1) != 0 { // not a power of two
+			add(distance)
+		}
+	}
+	return neighbours
+}
+
+type byName []PeerName
+
+func (names byName) Len() int           { return len(names) }
+func (names byName) Swap(i, j int)      { names[i], names[j] = names[j], names[i] }
+func (names byName) Less(i, j int) bool { return names[i].String() < names[j].String() }
+
+// The peers we want to connect to in a partial mesh, and a test of
+// whether a peer has us as a neighbour
+func (cm *ConnectionMaker) neighbours() (PeerNameSet, func(PeerName) bool) {
+	var names []PeerName
+	cm.peers.ForEach(func(peer *Peer) { names = append(names, peer.Name) })
+	ourName := cm.ourself.Name
+	wanted := Neighbours(names, ourName, cm.ourself.router.Neighbours)
+	wantsUs := func(name PeerName) bool {
+		_, found := Neighbours(names, name, cm.ourself.router.Neighbours)[ourName]
+		return found
+	}
+	return wanted, wantsUs
+}
+
+// Once we are connected to all the peers we want to be in a partial
+// mesh, close the connections we made to others, which are left over
+// from before peers came and went, unless we were asked to make them,
+// or the peer at the other end wants them
+func (cm *ConnectionMaker) pruneConnections(wanted PeerNameSet, wantsUs func(PeerName) bool, cmdLineTarget map[string]string) {
+	connections := cm.ourself.Connections()
+	connected := make(PeerNameSet)
+	for conn := range connections {
+		if conn.Established() {
+			connected[conn.Remote().Name] = void
+		}
+	}
+	for name := range wanted {
+		if _, found := connected[name]; !found {
+			return
+		}
+	}
+	for conn := range connections {
+		name := conn.Remote().Name
+		if _, found := wanted[name]; found || !conn.Outbound() || !conn.Established() {
+			continue
+		}
+		if _, found := cmdLineTarget[conn.RemoteTCPAddr()]; found || wantsUs(name) {
+			continue
+		}
+		if local, ok := conn.(*LocalConnection); ok {
+			local.Shutdown(fmt.Errorf("no longer a neighbour in the partial mesh"))
+		}
+	}
+}
@@ -83,3 +83,8 @@ func (pi *PcapIO) ReadPacket() (data []byte, err error) {
 func (po *PcapIO) WritePacket(data []byte) error {
 	return po.handle.WritePacketData(data)
 }
+
+func (pi *PcapIO) Close() error {
+	pi.handle.Close()
+	return nil
+}
@@ -18,6 +18,9 @@ type Peer struct {
 	NameByte      []byte
 	NickName      string
 	UID           PeerUID
+	Labels        map[string]string // which the peer was started with, e.g. its location or role
+	WeaveVersion  string            // of weave the peer runs; blank if it is too old to tell us
+	Features      []string          // the peer has enabled, in order
 	version       uint64
 	localRefCount uint64 // maintained by Peers
 	connections   map[PeerName]Connection
@@ -43,7 +46,11 @@ func (peer *Peer) String() string {
 }
 
 func (peer *Peer) Info() string {
-	return fmt.Sprint(peer.String(), " (v", peer.version, ") (UID ", peer.UID, ")")
+	info := fmt.Sprint(peer.String(), " (v", peer.version, ") (UID ", peer.UID, ")")
+	if len(peer.Labels) > 0 {
+		info += " (" + FormatLabels(peer.Labels) + ")"
+	}
+	return info
 }
 
 // Calculate the routing table from this peer to all peers reachable
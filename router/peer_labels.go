@@ -0,0 +1,43 @@
+package router
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ParseLabels parses peer labels given as comma-separated key=value
+// pairs, e.g. "dc=eu-west,rack=12"
+func ParseLabels(s string) (map[string]string, error) {
+	labels := make(map[string]string)
+	if s == "" {
+		return labels, nil
+	}
+	for _, pair := range strings.Split(s, ",") {
+		kv := strings.SplitN(pair, "=", 2)
+		key := strings.TrimSpace(kv[0])
+		if len(kv) != 2 || key == "" {
+			return nil, fmt.Errorf("Invalid label %q: expected <key>=<value>", pair)
+		}
+		if _, found := labels[key]; found {
+			return nil, fmt.Errorf("Label %q given more than once", key)
+		}
+		labels[key] = strings.TrimSpace(kv[1])
+	}
+	return labels, nil
+}
+
+// FormatLabels formats labels as ParseLabels parses them, in order of
+// key
+func FormatLabels(labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for key := range labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, len(keys))
+	for i, key := range keys {
+		pairs[i] = key + "=" + labels[key]
+	}
+	return strings.Join(pairs, ",")
+}
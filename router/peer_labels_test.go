@@ -0,0 +1,40 @@
+package router
+
+import (
+	"testing"
+
+	wt "github.com/weaveworks/weave/testing"
+)
+
+func TestParseLabels(t *testing.T) {
+	labels, err := ParseLabels("rack=12, dc=eu-west")
+	wt.AssertNoErr(t, err)
+	wt.AssertEqualInt(t, len(labels), 2, "labels")
+	wt.AssertEqualString(t, labels["dc"], "eu-west", "dc")
+	wt.AssertEqualString(t, FormatLabels(labels), "dc=eu-west,rack=12", "formatted")
+
+	labels, err = ParseLabels("")
+	wt.AssertNoErr(t, err)
+	wt.AssertEqualInt(t, len(labels), 0, "no labels")
+
+	for _, s := range []string{"dc", "=eu-west", "dc=eu-west,dc=us-east", "dc=eu-west,"} {
+		_, err := ParseLabels(s)
+		wt.AssertTrue(t, err != nil, s)
+	}
+}
+
+func TestLabelsGossip(t *testing.T) {
+	name, _ := PeerNameFromString("01:00:00:01:00:00")
+	peer, peers := newNode(name)
+	peer.Labels = map[string]string{"dc": "eu-west"}
+	peer.version = 1 // newer than what the handshake told the other peer
+
+	otherName, _ := PeerNameFromString("02:00:00:02:00:00")
+	_, otherPeers := newNode(otherName)
+	otherPeers.AddTestConnection(peer)
+	_, _, err := otherPeers.ApplyUpdate(peers.EncodePeers(peers.Names()))
+	wt.AssertNoErr(t, err)
+	gossiped, found := otherPeers.Fetch(name)
+	wt.AssertTrue(t, found, "peer found")
+	wt.AssertEqualString(t, gossiped.Labels["dc"], "eu-west", "gossiped label")
+}
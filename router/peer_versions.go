@@ -0,0 +1,234 @@
+package router
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Peers tell each other, in the handshake and the topology gossip,
+// which version of weave they run, and which features they have
+// enabled, so that we can report the spread of versions across the
+// network, and warn of peers that shouldn't be mixed, as during a
+// rolling upgrade.
+
+// Handshake fields giving the version of weave a peer runs, and the
+// features it has enabled, separated by commas
+const (
+	WeaveVersionField = "WeaveVersion"
+	FeaturesField     = "Features"
+)
+
+// OldestSupportedVersion is the oldest release of weave still
+// supported; peers running older releases are reported as end-of-life
+const OldestSupportedVersion = "0.11.0"
+
+// Features every peer must have enabled, if any has, to work
+var clusterFeatures = []string{FeatureDuplicates}
+
+// The features a peer may have enabled
+const (
+	FeatureEncryption      = "encryption"
+	FeatureDuplicates      = "detect-duplicates"
+	FeatureXDP             = "xdp"
+	FeatureDatapathProcess = "datapath-process"
+	FeaturePartialMesh     = "partial-mesh"
+)
+
+// Features returns the features the config enables, in order
+func (config *RouterConfig) Features() []string {
+	var features []string
+	if config.Password != nil {
+		features = append(features, FeatureEncryption)
+	}
+	if config.Duplicates {
+		features = append(features, FeatureDuplicates)
+	}
+	if config.XDP {
+		features = append(features, FeatureXDP)
+	}
+	if config.DatapathChild {
+		features = append(features, FeatureDatapathProcess)
+	}
+	if config.Neighbours > 0 {
+		features = append(features, FeaturePartialMesh)
+	}
+	sort.Strings(features)
+	return features
+}
+
+// VersionCount is how many peers run a version of weave
+type VersionCount struct {
+	Version string   // blank for peers too old to tell us
+	Peers   []string // their names, in order
+}
+
+// VersionSpread describes the versions of weave the peers run
+type VersionSpread struct {
+	Versions []VersionCount // in order of version
+	Warnings []string       // of peers that shouldn't be mixed with the others
+}
+
+// VersionSpread describes the versions of weave the peers we know of
+// run, and warns of any that are end-of-life, or incompatible with
+// the others
+func (peers *Peers) VersionSpread() VersionSpread {
+	byVersion := make(map[string][]string)
+	enabled := make(map[string][]string) // peers, by cluster feature they have enabled
+	var reporting []string               // peers that told us their features
+	peers.ForEach(func(peer *Peer) {
+		name := peer.Name.String()
+		byVersion[peer.WeaveVersion] = append(byVersion[peer.WeaveVersion], name)
+		if peer.WeaveVersion == "" {
+			return
+		}
+		reporting = append(reporting, name)
+		for _, feature := range peer.Features {
+			enabled[feature] = append(enabled[feature], name)
+		}
+	})
+	var spread VersionSpread
+	for version, names := range byVersion {
+		sort.Strings(names)
+		spread.Versions = append(spread.Versions, VersionCount{version, names})
+	}
+	sort.Sort(byWeaveVersion(spread.Versions))
+	for _, count := range spread.Versions {
+		if count.Version == "" {
+			spread.Warnings = append(spread.Warnings, fmt.Sprintf("a version of weave too old to report it is run by %s", peerList(count.Peers)))
+		} else if versionLess(count.Version, OldestSupportedVersion) {
+			spread.Warnings = append(spread.Warnings, fmt.Sprintf("weave %s, which is end-of-life, the oldest supported being %s, is run by %s", count.Version, OldestSupportedVersion, peerList(count.Peers)))
+		}
+	}
+	for _, feature := range clusterFeatures {
+		if names := enabled[feature]; len(names) > 0 && len(names) < len(reporting) {
+			spread.Warnings = append(spread.Warnings, fmt.Sprintf("%s not enabled on %s, though it is on %s", feature, peerList(missing(reporting, names)), peerList(names)))
+		}
+	}
+	return spread
+}
+
+func (spread VersionSpread) String() string {
+	var buf bytes.Buffer
+	for _, count := range spread.Versions {
+		version := count.Version
+		if version == "" {
+			version = "unknown"
+		}
+		if len(count.Peers) == 1 {
+			fmt.Fprintf(&buf, "%s: 1 peer\n", version)
+		} else {
+			fmt.Fprintf(&buf, "%s: %d peers\n", version, len(count.Peers))
+		}
+	}
+	for _, warning := range spread.Warnings {
+		fmt.Fprintf(&buf, "Warning: %s\n", warning)
+	}
+	return buf.String()
+}
+
+// The warnings of the version spread we have logged, so that we log
+// each once, until it no longer holds
+type versionWarnings struct {
+	sync.Mutex
+	logged map[string]struct{}
+}
+
+func (router *Router) warnOfVersions() {
+	warnings := router.Peers.VersionSpread().Warnings
+	vw := &router.versionWarnings
+	vw.Lock()
+	defer vw.Unlock()
+	logged := make(map[string]struct{}, len(warnings))
+	for _, warning := range warnings {
+		if _, found := vw.logged[warning]; !found {
+			log.Println("Warning:", warning)
+		}
+		logged[warning] = struct{}{}
+	}
+	vw.logged = logged
+}
+
+// The names in all but not in some, both in order
+func missing(all, some []string) []string {
+	sort.Strings(all)
+	sort.Strings(some)
+	var names []string
+	for _, name := range all {
+		if i := sort.SearchStrings(some, name); i == len(some) || some[i] != name {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func peerList(names []string) string {
+	if len(names) == 1 {
+		return "peer " + names[0]
+	}
+	return "peers " + strings.Join(names, ", ")
+}
+
+// Parse a release's version, e.g. "0.11.0" or "v1.2.3-rc1", into its
+// major, minor and patch numbers; builds of other commits, e.g.
+// "git-5cf4bd0bd9a6", aren't releases
+func parseRelease(version string) ([3]int, bool) {
+	var release [3]int
+	version = strings.TrimPrefix(version, "v")
+	if i := strings.IndexAny(version, "-+"); i >= 0 {
+		version = version[:i]
+	}
+	parts := strings.Split(version, ".")
+	if len(parts) != 3 {
+		return release, false
+	}
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return release, false
+		}
+		release[i] = n
+	}
+	return release, true
+}
+
+// Whether a is an older release than b; versions that aren't releases
+// are older than none, and newer than none
+func versionLess(a, b string) bool {
+	ra, okA := parseRelease(a)
+	rb, okB := parseRelease(b)
+	if !okA || !okB {
+		return false
+	}
+	for i := range ra {
+		if ra[i] != rb[i] {
+			return ra[i] < rb[i]
+		}
+	}
+	return false
+}
+
+// Releases in order, then other versions, by name, and blank last
+type byWeaveVersion []VersionCount
+
+func (vs byWeaveVersion) Len() int      { return len(vs) }
+func (vs byWeaveVersion) Swap(i, j int) { vs[i], vs[j] = vs[j], vs[i] }
+func (vs byWeaveVersion) Less(i, j int) bool {
+	a, b := vs[i].Version, vs[j].Version
+	if (a == "") != (b == "") {
+		return b == ""
+	}
+	ra, okA := parseRelease(a)
+	rb, okB := parseRelease(b)
+	switch {
+	case okA && okB && ra != rb:
+		return versionLess(a, b)
+	case okA != okB:
+		return okA
+	}
+	return a < b
+}
@@ -0,0 +1,63 @@
+package router
+
+import (
+	"fmt"
+	"testing"
+
+	wt "github.com/weaveworks/weave/testing"
+)
+
+func TestVersionsGossip(t *testing.T) {
+	name, _ := PeerNameFromString("01:00:00:01:00:00")
+	peer, peers := newNode(name)
+	peer.WeaveVersion, peer.Features = "0.12.0", []string{FeatureDuplicates}
+	peer.version = 1
+
+	otherName, _ := PeerNameFromString("02:00:00:02:00:00")
+	other, otherPeers := newNode(otherName)
+	other.WeaveVersion = "0.12.0"
+	otherPeers.AddTestConnection(peer)
+	_, _, err := otherPeers.ApplyUpdate(peers.EncodePeers(peers.Names()))
+	wt.AssertNoErr(t, err)
+	gossiped, _ := otherPeers.Fetch(name)
+	wt.AssertEqualString(t, gossiped.WeaveVersion, "0.12.0", "gossiped version")
+	wt.AssertEqualInt(t, len(gossiped.Features), 1, "gossiped features")
+
+	// relayed by an older peer, the version is gone, but we keep what
+	// we knew
+	peer.WeaveVersion, peer.Features = "", nil
+	peer.version = 2
+	_, _, err = otherPeers.ApplyUpdate(peers.EncodePeers(peers.Names()))
+	wt.AssertNoErr(t, err)
+	wt.AssertEqualString(t, gossiped.WeaveVersion, "0.12.0", "version kept")
+
+	spread := otherPeers.VersionSpread()
+	wt.AssertEqualInt(t, len(spread.Versions), 1, "versions")
+	wt.AssertEqualInt(t, len(spread.Versions[0].Peers), 2, "peers running 0.12.0")
+	wt.AssertEqualInt(t, len(spread.Warnings), 1, "warnings")
+	wt.AssertEqualString(t, spread.Warnings[0], "detect-duplicates not enabled on peer "+otherName.String()+", though it is on peer "+name.String(), "warning")
+}
+
+func TestVersionSpread(t *testing.T) {
+	name, _ := PeerNameFromString("01:00:00:01:00:00")
+	ourself, peers := newNode(name)
+	ourself.WeaveVersion = "git-5cf4bd0bd9a6"
+	for i, version := range []string{"0.12.0", "0.9.1", "", "0.12.0", "v0.11.2-rc1"} {
+		name, _ := PeerNameFromString(fmt.Sprintf("02:00:00:00:00:%02x", i))
+		peer := NewPeer(name, "", 0, 0)
+		peer.WeaveVersion = version
+		peers.FetchWithDefault(peer)
+	}
+	spread := peers.VersionSpread()
+	var versions []string
+	for _, count := range spread.Versions {
+		versions = append(versions, count.Version)
+	}
+	wt.AssertEqualString(t, fmt.Sprint(versions), "[0.9.1 v0.11.2-rc1 0.12.0 git-5cf4bd0bd9a6 ]", "in order")
+	wt.AssertEqualInt(t, len(spread.Versions[2].Peers), 2, "peers running 0.12.0")
+	wt.AssertEqualInt(t, len(spread.Warnings), 2, "end-of-life, and too old to tell us")
+
+	wt.AssertTrue(t, versionLess("0.9.1", "0.11.0"), "older")
+	wt.AssertFalse(t, versionLess("1.0.0", "0.11.0"), "newer")
+	wt.AssertFalse(t, versionLess("git-5cf4bd0bd9a6", "0.11.0"), "not a release")
+}
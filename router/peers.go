@@ -6,6 +6,8 @@ import (
 	"fmt"
 	"io"
 	"sync"
+
+	"github.com/weaveworks/weave/common/events"
 )
 
 type Peers struct {
@@ -30,6 +32,11 @@ type PeerSummary struct {
 	NickName string
 	UID      PeerUID
 	Version  uint64
+	Labels   map[string]string // absent from the gossip of older peers
+	// These are absent from the gossip of older peers, including of
+	// newer peers, as they relay it
+	WeaveVersion string
+	Features     []string
 }
 
 type ConnectionSummary struct {
@@ -102,6 +109,7 @@ func (peers *Peers) ApplyUpdate(update []byte) (PeerNameSet, PeerNameSet, error)
 	// adding in any new peers into the cache.
 	for name, newPeer := range newPeers {
 		peers.table[name] = newPeer
+		events.Publish(events.PeerJoined, peerEventFields(newPeer))
 	}
 
 	// Now apply the updates
@@ -189,12 +197,17 @@ func (peers *Peers) garbageCollect() []*Peer {
 		if _, found := reached[peer.Name]; !found && peer.localRefCount == 0 {
 			delete(peers.table, name)
 			peers.onGC(peer)
+			events.Publish(events.PeerLeft, peerEventFields(peer))
 			removed = append(removed, peer)
 		}
 	}
 	return removed
 }
 
+func peerEventFields(peer *Peer) map[string]string {
+	return map[string]string{"name": peer.Name.String(), "nickname": peer.NickName}
+}
+
 func setFromPeersMap(peers map[PeerName]*Peer) PeerNameSet {
 	names := make(PeerNameSet)
 	for name := range peers {
@@ -222,6 +235,8 @@ func (peers *Peers) decodeUpdate(update []byte) (newPeers map[PeerName]*Peer, de
 		}
 		name := PeerNameFromBin(peerSummary.NameByte)
 		newPeer := NewPeer(name, peerSummary.NickName, peerSummary.UID, peerSummary.Version)
+		newPeer.Labels = peerSummary.Labels
+		newPeer.WeaveVersion, newPeer.Features = peerSummary.WeaveVersion, peerSummary.Features
 		decodedUpdate = append(decodedUpdate, newPeer)
 		decodedConns = append(decodedConns, connSummaries)
 		existingPeer, found := peers.table[name]
@@ -276,6 +291,14 @@ func (peers *Peers) applyUpdate(decodedUpdate []*Peer, decodedConns [][]Connecti
 		// router.Peers.ApplyUpdate. But ApplyUpdate takes the Lock on
 		// the router.Peers, so there can be no race here.
 		peer.version = newPeer.version
+		// Peers we first heard of in a handshake don't have their
+		// labels until now
+		peer.Labels = newPeer.Labels
+		// An older peer relaying the update would have dropped the
+		// version we may have had from the handshake
+		if newPeer.WeaveVersion != "" {
+			peer.WeaveVersion, peer.Features = newPeer.WeaveVersion, newPeer.Features
+		}
 		peer.connections = makeConnsMap(peer, connSummaries, peers.table)
 		newUpdate[name] = peer
 	}
@@ -287,7 +310,10 @@ func (peer *Peer) Encode(enc *gob.Encoder) {
 		peer.NameByte,
 		peer.NickName,
 		peer.UID,
-		peer.version}))
+		peer.version,
+		peer.Labels,
+		peer.WeaveVersion,
+		peer.Features}))
 
 	connSummaries := []ConnectionSummary{}
 	for _, conn := range peer.connections {
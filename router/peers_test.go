@@ -111,3 +111,35 @@ func TestPeersGarbageCollection(t *testing.T) {
 	ps1.DeleteTestConnection(p3)
 	checkPeerArray(t, ps1.GarbageCollect(), p3)
 }
+
+func TestPeersEncodingChanged(t *testing.T) {
+	name1, _ := PeerNameFromString("01:00:00:01:00:00")
+	name2, _ := PeerNameFromString("02:00:00:01:00:00")
+	name3, _ := PeerNameFromString("03:00:00:01:00:00")
+	dummyName, _ := PeerNameFromString("99:00:00:01:00:00")
+	peer1, ps1 := newNode(name1)
+	peer2, _ := newNode(name2)
+	peer3, _ := newNode(name3)
+	ps1.AddTestConnection(peer2)
+	sent := newTopologySent()
+
+	// the first time, we send everything
+	_, testBedPeers := newNode(dummyName)
+	testBedPeers.AddTestConnection(peer1)
+	_, _, err := testBedPeers.ApplyUpdate(ps1.EncodePeersChanged(ps1.Names(), sent, false))
+	wt.AssertNoErr(t, err)
+	checkTopologyPeers(t, true, testBedPeers.allPeersExcept(dummyName), ps1.allPeers()...)
+
+	// then nothing, until something changes, when we send just that:
+	// us, with our new connection, and the peer at the other end
+	wt.AssertEqualInt(t, len(ps1.EncodePeersChanged(ps1.Names(), sent, false)), 0, "update size")
+	ps1.AddTestConnection(peer3)
+	update := ps1.EncodePeersChanged(ps1.Names(), sent, false)
+	wt.AssertEqualInt(t, len(update), len(ps1.EncodePeers(PeerNameSet{name1: void, name3: void})), "update size")
+	_, _, err = testBedPeers.ApplyUpdate(update)
+	wt.AssertNoErr(t, err)
+	checkTopologyPeers(t, true, testBedPeers.allPeersExcept(dummyName), ps1.allPeers()...)
+
+	// unless we ask for everything
+	wt.AssertEqualInt(t, len(ps1.EncodePeersChanged(ps1.Names(), sent, true)), len(ps1.EncodePeers(ps1.Names())), "update size")
+}
@@ -16,6 +16,8 @@ const (
 	ProtocolGossip
 	ProtocolGossipUnicast
 	ProtocolGossipBroadcast
+	ProtocolTopologyRequest // for everything, by a peer that takes topology deltas
+	ProtocolCompressed      // gossip, to a peer that takes it compressed
 )
 
 type ProtocolMsg struct {
@@ -0,0 +1,90 @@
+package router
+
+import (
+	"crypto/sha256"
+	"sync"
+	"time"
+)
+
+const (
+	// How long we remember gossip we have relayed, so as not to pass
+	// it round a loop of peers relaying it; less than GossipInterval,
+	// so that what a peer gossips each interval is relayed each time
+	relayMemory = GossipInterval / 2
+	// How many messages we hold for a connection we can't send down
+	// as fast as they arrive; the periodic gossip makes up for any
+	// we drop
+	maxRelayedMessages = 64
+)
+
+// RelayGossiper stands in for the gossiper of a channel on peers not
+// taking part in it, e.g. the DNS channel on peers not running DNS.
+// It passes what comes in on the channel on unchanged, without
+// understanding it, so that peers that do take part can reach each
+// other through those that don't.
+type RelayGossiper struct {
+	sync.Mutex
+	seen map[[sha256.Size]byte]time.Time
+	now  func() time.Time
+}
+
+func NewRelayGossiper() *RelayGossiper {
+	return &RelayGossiper{seen: make(map[[sha256.Size]byte]time.Time), now: time.Now}
+}
+
+// Unicasts not for us are relayed by the channel itself
+func (relay *RelayGossiper) OnGossipUnicast(sender PeerName, msg []byte) error {
+	return nil
+}
+
+// Broadcasts follow the broadcast routes, which have no loops, so we
+// can pass each on as it comes
+func (relay *RelayGossiper) OnGossipBroadcast(update []byte) (GossipData, error) {
+	return &relayedGossipData{[][]byte{update}}, nil
+}
+
+// We have nothing of our own to gossip: what other peers gossip each
+// interval we pass on as it arrives
+func (relay *RelayGossiper) Gossip() GossipData {
+	return nil
+}
+
+func (relay *RelayGossiper) OnGossip(update []byte) (GossipData, error) {
+	digest := sha256.Sum256(update)
+	now := relay.now()
+	relay.Lock()
+	defer relay.Unlock()
+	for d, t := range relay.seen {
+		if now.Sub(t) >= relayMemory {
+			delete(relay.seen, d)
+		}
+	}
+	if _, found := relay.seen[digest]; found {
+		return nil, nil
+	}
+	relay.seen[digest] = now
+	return &relayedGossipData{[][]byte{update}}, nil
+}
+
+// relayedGossipData is messages we relay, which, not knowing what is
+// in them, we can't merge into one
+type relayedGossipData struct {
+	msgs [][]byte
+}
+
+// Encode gives the latest message alone; channels send each of
+// EncodeEach
+func (d *relayedGossipData) Encode() []byte {
+	return d.msgs[len(d.msgs)-1]
+}
+
+func (d *relayedGossipData) EncodeEach() [][]byte {
+	return d.msgs
+}
+
+func (d *relayedGossipData) Merge(other GossipData) {
+	d.msgs = append(d.msgs, other.(*relayedGossipData).msgs...)
+	if len(d.msgs) > maxRelayedMessages {
+		d.msgs = d.msgs[len(d.msgs)-maxRelayedMessages:]
+	}
+}
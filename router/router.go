@@ -8,6 +8,9 @@ import (
 	"io"
 	"log"
 	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
@@ -20,24 +23,67 @@ const macMaxAge = 10 * time.Minute // [1]
 type LogFrameFunc func(string, []byte, *layers.Ethernet)
 
 type RouterConfig struct {
-	Port      int
-	Iface     *net.Interface
-	Password  []byte
-	ConnLimit int
-	BufSz     int
-	LogFrame  LogFrameFunc
+	Port          int
+	Iface         *net.Interface
+	Password      []byte
+	ConnLimit     int
+	BufSz         int
+	LogFrame      LogFrameFunc
+	ConnHistory   int               // connection events kept per peer; DefaultConnHistory if 0
+	Labels        map[string]string // gossiped with the topology
+	Datapath      string            // DatapathPcap, the default, DatapathTap or DatapathAFPacket
+	Tap           string            // name of the TAP device, for DatapathTap; DefaultTap if blank
+	Workers       int               // capture workers, for DatapathAFPacket; 1 if 0
+	DatapathChild bool              // whether to exchange frames with Iface through a child process, started again should it die
+	CryptoProcs   int               // workers encrypting and decrypting packets, with a password; none if 0 or 1
+	GossipRates   map[string]int    // bytes per second we may send on the gossip channels named; no limit if absent
+	Neighbours    int               // peers we connect to, in a partial mesh; all we know of if 0
+	Duplicates    bool              // whether to gossip the addresses we see in ARP, to find duplicates
+	DropPolicy    string            // what to do with frames when a connection's queue is full; DropPolicyBlock if blank
+	XDP           bool              // whether to forward frames to MACs on other peers in the kernel, without a password
+	WeaveVersion  string            // of weave we run, told to other peers
+	StallTimeout  time.Duration     // how long parts of the router may make no progress before the watchdog reports them; no watchdog if 0
+	StallRestart  bool              // whether the watchdog restarts parts that stall, where they can be
 }
 
 type Router struct {
 	RouterConfig
-	Ourself         *LocalPeer
-	Macs            *MacCache
-	Peers           *Peers
-	Routes          *Routes
-	ConnectionMaker *ConnectionMaker
-	GossipChannels  map[uint32]*GossipChannel
-	TopologyGossip  Gossip
-	UDPListener     *net.UDPConn
+	Ourself           *LocalPeer
+	Macs              *MacCache
+	Peers             *Peers
+	Routes            *Routes
+	ConnectionMaker   *ConnectionMaker
+	ConnectionHistory *ConnectionHistory
+	Flows             *FlowCounters
+	Fragmentation     *FragmentationCounters
+	Drops             *DropCounters
+	Annotations       *Annotations
+	GossipChannels    map[uint32]*GossipChannel
+	TopologyGossip    Gossip
+	UDPListener       *net.UDPConn
+	captures          captures
+	capture           PacketSourceSink
+	captureLock       sync.Mutex // protects Iface, and capture, what the capture loop reads, once started
+	injector          injector
+	cryptoPool        *CryptoPool // nil if packets are encrypted and decrypted as they are sent and received
+	started           int32       // 1 once Start has returned
+	capturing         int32       // 1 while the capture loop is running
+	topologyRounds    uint64      // of periodic topology gossip
+	selfTests         *selfTests
+	diags             *diags
+	childPid          int           // of the datapath process; these are protected by captureLock
+	childStarted      time.Time     // when it last started
+	childDelay        time.Duration // how long we last waited to start it again
+	childRestarts     int
+	mirrors           *mirrors
+	connectivity      *connectivity
+	versionWarnings   versionWarnings
+	unknownChannels   unknownChannels
+	Bindings          *Bindings   // nil unless finding duplicate addresses
+	xdp               *XDPOffload // nil unless XDP
+	Watchdog          *Watchdog   // nil unless StallTimeout
+	peerGCHandlers    []func(*Peer)
+	droppedFrames     droppedFrames
 }
 
 type PacketSource interface {
@@ -55,43 +101,141 @@ type PacketSourceSink interface {
 
 func NewRouter(config RouterConfig, name PeerName, nickName string) *Router {
 	router := &Router{RouterConfig: config, GossipChannels: make(map[uint32]*GossipChannel)}
+	if config.StallTimeout > 0 {
+		router.Watchdog = NewWatchdog(config.StallTimeout, config.StallRestart)
+	}
 	onMacExpiry := func(mac net.HardwareAddr, peer *Peer) {
 		log.Println("Expired MAC", mac, "at", peer)
 	}
 	onPeerGC := func(peer *Peer) {
 		router.Macs.Delete(peer)
+		for _, f := range router.peerGCHandlers {
+			f(peer)
+		}
 		log.Println("Removed unreachable peer", peer)
 	}
 	router.Ourself = NewLocalPeer(name, nickName, router)
+	router.Ourself.Labels = config.Labels
+	router.Ourself.WeaveVersion, router.Ourself.Features = config.WeaveVersion, config.Features()
 	router.Macs = NewMacCache(macMaxAge, onMacExpiry)
 	router.Peers = NewPeers(router.Ourself, onPeerGC)
 	router.Peers.FetchWithDefault(router.Ourself.Peer)
 	router.Routes = NewRoutes(router.Ourself, router.Peers)
 	router.ConnectionMaker = NewConnectionMaker(router.Ourself, router.Peers, router.Port)
+	if router.ConnHistory == 0 {
+		router.ConnHistory = DefaultConnHistory
+	}
+	router.ConnectionHistory = NewConnectionHistory(router.ConnHistory)
+	if router.Datapath == "" {
+		router.Datapath = DatapathPcap
+	}
+	if router.Tap == "" {
+		router.Tap = DefaultTap
+	}
+	if router.DropPolicy == "" {
+		router.DropPolicy = DropPolicyBlock
+	}
+	if router.Workers == 0 {
+		router.Workers = 1
+	}
+	if router.Password != nil && router.CryptoProcs > 1 {
+		router.cryptoPool = NewCryptoPool(router.CryptoProcs)
+	}
+	router.Flows = NewFlowCounters()
+	router.Fragmentation = &FragmentationCounters{}
+	router.Drops = &DropCounters{}
+	router.Annotations, _ = NewAnnotations("")
+	router.selfTests = newSelfTests()
+	router.diags = newDiags(router)
 	router.TopologyGossip = router.NewGossip("topology", router)
+	router.mirrors = newMirrors(router)
+	router.mirrors.gossip = router.NewGossip("mirror", router.mirrors)
+	router.connectivity = newConnectivity(router)
+	router.connectivity.gossip = router.NewGossip("connectivity", router.connectivity)
+	if config.Duplicates {
+		router.Bindings = NewBindings(name)
+		router.NewGossip("bindings", router.Bindings)
+	} else {
+		// peers detecting duplicates gossip to us regardless, and
+		// reach each other through us
+		router.NewGossip("bindings", NewRelayGossiper())
+	}
 	return router
 }
 
-func (router *Router) Start() {
-	// we need two pcap handles since they aren't thread-safe
+// OnPeerGC has f called with each peer we remove for being
+// unreachable, unlike the events hub, which may drop events; it must
+// be called before the router starts.
+func (router *Router) OnPeerGC(f func(*Peer)) {
+	router.peerGCHandlers = append(router.peerGCHandlers, f)
+}
+
+// ListenError is the router being unable to listen on its port
+type ListenError struct {
+	Port int
+	Err  error
+}
+
+func (e ListenError) Error() string {
+	return fmt.Sprintf("Unable to listen on port %d: %s", e.Port, e.Err)
+}
+
+// Start the router, returning a ListenError if it can't listen on its
+// port, or another error if it can't capture on its interface
+func (router *Router) Start() error {
 	var pio PacketSourceSink
 	var po PacketSink
 	var err error
 	if router.Iface != nil {
-		pio, err = NewPcapIO(router.Iface.Name, router.BufSz)
-		checkFatal(err)
-		po, err = NewPcapO(router.Iface.Name)
-		checkFatal(err)
+		var sink PacketSink
+		if pio, sink, err = router.openCapture(router.Iface); err != nil {
+			return err
+		}
+		router.noteDatapathChild(pio)
+		router.injector.set(sink)
+		po = &router.injector
+	}
+	if router.XDP {
+		// the program doesn't encrypt
+		if router.Password != nil {
+			return fmt.Errorf("Unable to forward frames with XDP with a password")
+		}
+		if router.xdp, err = NewXDPOffload(router); err != nil {
+			return err
+		}
+	}
+	if router.Watchdog != nil {
+		router.Watchdog.Start()
 	}
 	router.Ourself.Start()
 	router.Macs.Start()
 	router.Routes.Start()
 	router.ConnectionMaker.Start()
-	router.UDPListener = router.listenUDP(router.Port, po)
-	router.listenTCP(router.Port)
+	if router.UDPListener, err = router.listenUDP(router.Port, po); err != nil {
+		return ListenError{router.Port, err}
+	}
+	if err := router.listenTCP(router.Port); err != nil {
+		return ListenError{router.Port, err}
+	}
 	if pio != nil {
-		router.sniff(pio)
+		router.sniff(router.Iface, pio)
 	}
+	if router.xdp != nil {
+		router.xdp.Start()
+	}
+	atomic.StoreInt32(&router.started, 1)
+	return nil
+}
+
+// Started says whether the router has started listening for peers,
+// and capturing, if it has an interface
+func (router *Router) Started() bool {
+	return atomic.LoadInt32(&router.started) == 1
+}
+
+// Capturing says whether the router's capture loop is running
+func (router *Router) Capturing() bool {
+	return atomic.LoadInt32(&router.capturing) == 1
 }
 
 func (router *Router) Stop() error {
@@ -106,33 +250,99 @@ func (router *Router) UsingPassword() bool {
 func (router *Router) Status() string {
 	var buf bytes.Buffer
 	fmt.Fprintln(&buf, "Our name is", router.Ourself)
-	fmt.Fprintln(&buf, "Sniffing traffic on", router.Iface)
+	if len(router.Ourself.Labels) > 0 {
+		fmt.Fprintln(&buf, "Our labels are", FormatLabels(router.Ourself.Labels))
+	}
+	fmt.Fprintln(&buf, "Sniffing traffic on", router.capturedIface())
+	if router.DatapathChild {
+		router.captureLock.Lock()
+		fmt.Fprintf(&buf, "Datapath process %d, started again %d times\n", router.childPid, router.childRestarts)
+		router.captureLock.Unlock()
+	}
 	fmt.Fprintf(&buf, "MACs:\n%s", router.Macs)
 	fmt.Fprintf(&buf, "Peers:\n%s", router.Peers)
+	fmt.Fprintf(&buf, "Versions:\n%s", router.Peers.VersionSpread())
 	fmt.Fprintf(&buf, "Routes:\n%s", router.Routes)
 	fmt.Fprintf(&buf, "Reconnects:\n%s", router.ConnectionMaker)
+	fmt.Fprintf(&buf, "Annotations:\n%s", router.Annotations)
+	fmt.Fprintf(&buf, "Fragmentation:\n%s", router.Fragmentation.Totals())
+	fmt.Fprintf(&buf, "Queues (%s):\n%s", router.DropPolicy, router.Drops.Totals())
+	if router.xdp != nil {
+		fmt.Fprintf(&buf, "XDP:\n%s", router.xdp)
+	}
+	if router.Bindings != nil {
+		fmt.Fprintf(&buf, "Duplicate addresses:\n%s", router.Bindings)
+	}
+	if mirrors := router.Mirrors(); len(mirrors) > 0 {
+		fmt.Fprintln(&buf, "Mirrors:")
+		for _, m := range mirrors {
+			fmt.Fprintf(&buf, "%s: %q to %s on %s, until %s: %d frames, %d dropped\n",
+				m.ID, m.Filter, m.Iface, m.Peer, m.Expires.Format(time.RFC3339), m.Frames, m.Dropped)
+		}
+	}
+	fmt.Fprintln(&buf, "Gossip:")
+	stats := router.GossipStats()
+	names := make([]string, 0, len(stats))
+	for name := range stats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		totals := stats[name].Totals
+		fmt.Fprintf(&buf, "%s: sent %d messages (%d bytes), received %d messages (%d bytes)",
+			name, totals.SentMessages, totals.SentBytes, totals.ReceivedMessages, totals.ReceivedBytes)
+		if totals.QueuedMessages > 0 || totals.DroppedMessages > 0 || totals.ThrottledMessages > 0 {
+			fmt.Fprintf(&buf, ", %d queued, %d dropped, %d throttled",
+				totals.QueuedMessages, totals.DroppedMessages, totals.ThrottledMessages)
+		}
+		fmt.Fprintln(&buf)
+	}
 	return buf.String()
 }
 
-func (router *Router) sniff(pio PacketSourceSink) {
-	log.Println("Sniffing traffic on", router.Iface)
+func (router *Router) sniff(iface *net.Interface, pio PacketSourceSink) {
+	log.Println("Sniffing traffic on", iface)
 
-	dec := NewEthernetDecoder()
-	mac := router.Iface.HardwareAddr
+	mac := iface.HardwareAddr
 	if router.Macs.Enter(mac, router.Ourself.Peer) {
 		log.Println("Discovered our MAC", mac)
 	}
-	go func() {
-		for {
-			pkt, err := pio.ReadPacket()
-			checkFatal(err)
-			router.LogFrame("Sniffed", pkt, nil)
-			router.handleCapturedPacket(pkt, dec, pio)
+	sources := []PacketSource{pio}
+	if fanout, ok := pio.(FanoutSource); ok {
+		sources = fanout.Sources()
+	}
+	// when one worker stops, closing pio stops the others
+	var stopOnce sync.Once
+	router.capture = pio
+	atomic.StoreInt32(&router.capturing, 1)
+	for i, source := range sources {
+		name := "capture on " + iface.Name
+		if len(sources) > 1 {
+			name = fmt.Sprintf("capture worker %d on %s", i+1, iface.Name)
 		}
-	}()
+		progress := router.Watchdog.Watch(name, func() { router.restartCapture(pio) })
+		go func(source PacketSource) {
+			defer router.Watchdog.Unwatch(progress)
+			dec := NewEthernetDecoder()
+			for {
+				pkt, err := source.ReadPacket()
+				if err != nil {
+					stopOnce.Do(func() { router.captureStopped(iface, pio, err) })
+					return
+				}
+				progress.Begin()
+				router.LogFrame("Sniffed", pkt, nil)
+				router.handleCapturedPacket(pkt, dec, pio)
+				progress.End()
+			}
+		}(source)
+	}
 }
 
 func (router *Router) handleCapturedPacket(frameData []byte, dec *EthernetDecoder, po PacketSink) {
+	if router.DatapathChild {
+		defer router.recoverCapturedFrame(frameData)
+	}
 	dec.DecodeLayers(frameData)
 	decodedLen := len(dec.decoded)
 	if decodedLen == 0 {
@@ -149,6 +359,10 @@ func (router *Router) handleCapturedPacket(frameData []byte, dec *EthernetDecode
 	if router.Macs.Enter(srcMac, router.Ourself.Peer) {
 		log.Println("Discovered local MAC", srcMac)
 	}
+	if router.Bindings != nil && dec.eth.EthernetType == layers.EthernetTypeARP {
+		router.Bindings.ObserveARP(dec.eth.Payload)
+	}
+	router.noteARPReply(router.Ourself.Peer, dec)
 	if dec.DropFrame() {
 		return
 	}
@@ -157,6 +371,8 @@ func (router *Router) handleCapturedPacket(frameData []byte, dec *EthernetDecode
 	if found && dstPeer == router.Ourself.Peer {
 		return
 	}
+	router.captureEthernet(dstPeer, frameData)
+	router.Flows.Count(dec, dstPeer, true, len(frameData))
 	df := decodedLen == 2 && (dec.ip.Flags&layers.IPv4DontFragment != 0)
 	if df {
 		router.LogFrame("Forwarding DF", frameData, &dec.eth)
@@ -184,11 +400,15 @@ func (router *Router) handleCapturedPacket(frameData []byte, dec *EthernetDecode
 	checkWarn(err)
 }
 
-func (router *Router) listenTCP(localPort int) {
+func (router *Router) listenTCP(localPort int) error {
 	localAddr, err := net.ResolveTCPAddr("tcp4", fmt.Sprint(":", localPort))
-	checkFatal(err)
+	if err != nil {
+		return err
+	}
 	ln, err := net.ListenTCP("tcp4", localAddr)
-	checkFatal(err)
+	if err != nil {
+		return err
+	}
 	go func() {
 		defer ln.Close()
 		for {
@@ -200,6 +420,7 @@ func (router *Router) listenTCP(localPort int) {
 			router.acceptTCP(tcpConn)
 		}
 	}()
+	return nil
 }
 
 func (router *Router) acceptTCP(tcpConn *net.TCPConn) {
@@ -213,28 +434,88 @@ func (router *Router) acceptTCP(tcpConn *net.TCPConn) {
 	connLocal.Start(true)
 }
 
-func (router *Router) listenUDP(localPort int, po PacketSink) *net.UDPConn {
+func (router *Router) listenUDP(localPort int, po PacketSink) (*net.UDPConn, error) {
 	localAddr, err := net.ResolveUDPAddr("udp4", fmt.Sprint(":", localPort))
-	checkFatal(err)
+	if err != nil {
+		return nil, err
+	}
 	conn, err := net.ListenUDP("udp4", localAddr)
-	checkFatal(err)
+	if err != nil {
+		return nil, err
+	}
 	f, err := conn.File()
+	if err != nil {
+		return nil, err
+	}
 	defer f.Close()
-	checkFatal(err)
 	fd := int(f.Fd())
 	// This one makes sure all packets we send out do not have DF set on them.
-	err = syscall.SetsockoptInt(fd, syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER, syscall.IP_PMTUDISC_DONT)
-	checkFatal(err)
+	if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER, syscall.IP_PMTUDISC_DONT); err != nil {
+		return nil, err
+	}
 	go router.udpReader(conn, po)
-	return conn
+	return conn, nil
 }
 
+// A packet received from a connection, whose frames are ready to be
+// handled once ready is closed, which, if it is being decrypted in the
+// pool, may be after we have received others
+type receivedPacket struct {
+	conn    *LocalConnection
+	sender  *net.UDPAddr
+	iterate func(FrameConsumer) error
+	ready   chan struct{}
+}
+
+var readyNow = func() chan struct{} {
+	ready := make(chan struct{})
+	close(ready)
+	return ready
+}()
+
 func (router *Router) udpReader(conn *net.UDPConn, po PacketSink) {
 	defer conn.Close()
 	dec := NewEthernetDecoder()
+	// Errors during UDP packet decoding / processing are non-fatal.
+	// One common cause is that we receive and attempt to decrypt a
+	// "stray" packet. This can actually happen quite easily if there
+	// is some connection churn between two peers. After all, UDP
+	// isn't a connection-oriented protocol, yet we pretend it is.
+	//
+	// If anything really is seriously, unrecoverably amiss with a
+	// connection, that will typically result in missed heartbeats and
+	// the connection getting shut down because of that.
+	process := func(rp *receivedPacket) {
+		<-rp.ready
+		if err := rp.iterate(router.handleUDPPacketFunc(rp.conn, dec, rp.sender, po)); err != nil {
+			rp.conn.Log(err)
+		}
+	}
+	// the connection and sender of the packet we are handling, when
+	// we handle it here, as it arrives, so that its frames' consumer
+	// needn't be made anew for each one
+	var relayConn *LocalConnection
+	var sender *net.UDPAddr
+	consume := func(srcNameByte, dstNameByte []byte, frame []byte) {
+		router.handleUDPFrame(relayConn, dec, sender, po, srcNameByte, dstNameByte, frame)
+	}
+	var received chan *receivedPacket
+	if router.cryptoPool != nil {
+		// handle packets in the order they came, in a goroutine of
+		// their own, while the pool decrypts those that follow
+		received = make(chan *receivedPacket, router.cryptoPool.Depth())
+		defer close(received)
+		go func() {
+			for rp := range received {
+				process(rp)
+			}
+		}()
+	}
 	buf := make([]byte, MaxUDPPacketSize)
 	for {
-		n, sender, err := conn.ReadFromUDP(buf)
+		var n int
+		var err error
+		n, sender, err = conn.ReadFromUDP(buf)
 		if err == io.EOF {
 			return
 		} else if err != nil {
@@ -251,95 +532,127 @@ func (router *Router) udpReader(conn *net.UDPConn, po PacketSink) {
 		if !found {
 			continue
 		}
-		relayConn, ok := peerConn.(*LocalConnection)
-		if !ok {
+		var ok bool
+		if relayConn, ok = peerConn.(*LocalConnection); !ok {
+			continue
+		}
+		router.captureUDP(name, sender, relayConn.localUDPAddr(), buf[:n])
+		decryptor := relayConn.Decryptor
+		if router.cryptoPool == nil {
+			if err := decryptor.IterateFrames(packet, consume); err != nil {
+				relayConn.Log(err)
+			}
 			continue
 		}
-		if err := relayConn.Decryptor.IterateFrames(packet, router.handleUDPPacketFunc(relayConn, dec, sender, po)); err != nil {
-			// Errors during UDP packet decoding / processing are
-			// non-fatal. One common cause is that we receive and
-			// attempt to decrypt a "stray" packet. This can actually
-			// happen quite easily if there is some connection churn
-			// between two peers. After all, UDP isn't a
-			// connection-oriented protocol, yet we pretend it is.
-			//
-			// If anything really is seriously, unrecoverably amiss
-			// with a connection, that will typically result in missed
-			// heartbeats and the connection getting shut down because
-			// of that.
-			relayConn.Log(err)
+		rp := &receivedPacket{conn: relayConn, sender: sender, ready: readyNow}
+		if pdec, ok := decryptor.(ParallelDecryptor); ok {
+			rp.ready = make(chan struct{})
+			router.cryptoPool.Go(func() {
+				opened := pdec.Open(packet)
+				rp.iterate = func(consumer FrameConsumer) error {
+					return pdec.IterateOpened(opened, consumer)
+				}
+				close(rp.ready)
+			})
+		} else {
+			rp.iterate = func(consumer FrameConsumer) error {
+				return decryptor.IterateFrames(packet, consumer)
+			}
 		}
+		received <- rp
 	}
 }
 
 func (router *Router) handleUDPPacketFunc(relayConn *LocalConnection, dec *EthernetDecoder, sender *net.UDPAddr, po PacketSink) FrameConsumer {
 	return func(srcNameByte, dstNameByte []byte, frame []byte) {
-		srcPeer, found := router.Peers.Fetch(PeerNameFromBin(srcNameByte))
-		if !found {
-			return
-		}
-		dstPeer, found := router.Peers.Fetch(PeerNameFromBin(dstNameByte))
-		if !found {
-			return
-		}
+		router.handleUDPFrame(relayConn, dec, sender, po, srcNameByte, dstNameByte, frame)
+	}
+}
 
-		dec.DecodeLayers(frame)
-		decodedLen := len(dec.decoded)
-		if decodedLen == 0 {
+func (router *Router) handleUDPFrame(relayConn *LocalConnection, dec *EthernetDecoder, sender *net.UDPAddr, po PacketSink, srcNameByte, dstNameByte []byte, frame []byte) {
+	srcPeer, found := router.Peers.Fetch(PeerNameFromBin(srcNameByte))
+	if !found {
+		return
+	}
+	dstPeer, found := router.Peers.Fetch(PeerNameFromBin(dstNameByte))
+	if !found {
+		return
+	}
+
+	dec.DecodeLayers(frame)
+	decodedLen := len(dec.decoded)
+	if decodedLen == 0 {
+		return
+	}
+	// Handle special frames produced internally (rather than
+	// captured/forwarded) by the remote router.
+	//
+	// We really shouldn't be decoding these above, since they are
+	// not genuine Ethernet frames. However, it is actually more
+	// efficient to do so, as we want to optimise for the common
+	// (i.e. non-special) frames. These always need decoding, and
+	// detecting special frames is cheaper post decoding than pre.
+	if decodedLen == 1 && dec.IsSpecial() {
+		if srcPeer != relayConn.Remote() || dstPeer != router.Ourself.Peer {
 			return
 		}
-		// Handle special frames produced internally (rather than
-		// captured/forwarded) by the remote router.
-		//
-		// We really shouldn't be decoding these above, since they are
-		// not genuine Ethernet frames. However, it is actually more
-		// efficient to do so, as we want to optimise for the common
-		// (i.e. non-special) frames. These always need decoding, and
-		// detecting special frames is cheaper post decoding than pre.
-		if decodedLen == 1 && dec.IsSpecial() {
-			if srcPeer == relayConn.Remote() && dstPeer == router.Ourself.Peer {
-				handleSpecialFrame(relayConn, sender, frame)
+		if isFragment(frame) {
+			if srcNameByte, dstNameByte, whole := relayConn.reassembler.add(frame); whole != nil {
+				router.handleUDPFrame(relayConn, dec, sender, po, srcNameByte, dstNameByte, whole)
 			}
 			return
 		}
+		handleSpecialFrame(relayConn, sender, frame)
+		return
+	}
 
-		df := decodedLen == 2 && (dec.ip.Flags&layers.IPv4DontFragment != 0)
+	if dstPeer == router.Ourself.Peer && dec.isSelfTest() {
+		router.handleSelfTestFrame(srcPeer, frame)
+		return
+	}
+	if dstPeer != router.Ourself.Peer && dec.isSelfTest() && router.expireDiagProbe(srcPeer, frame) {
+		return
+	}
 
-		if dstPeer != router.Ourself.Peer {
-			// it's not for us, we're just relaying it
-			if df {
-				router.LogFrame("Relaying DF", frame, &dec.eth)
-			} else {
-				router.LogFrame("Relaying", frame, &dec.eth)
-			}
+	df := decodedLen == 2 && (dec.ip.Flags&layers.IPv4DontFragment != 0)
 
-			err := router.Ourself.Relay(srcPeer, dstPeer, df, frame, dec)
-			if ftbe, ok := err.(FrameTooBigError); ok {
-				err = dec.sendICMPFragNeeded(ftbe.EPMTU, func(icmpFrame []byte) error {
-					return router.Ourself.Forward(srcPeer, false, icmpFrame, nil)
-				})
-			}
+	if dstPeer != router.Ourself.Peer {
+		// it's not for us, we're just relaying it
+		if df {
+			router.LogFrame("Relaying DF", frame, &dec.eth)
+		} else {
+			router.LogFrame("Relaying", frame, &dec.eth)
+		}
 
-			checkWarn(err)
-			return
+		err := router.Ourself.Relay(srcPeer, dstPeer, df, frame, dec)
+		if ftbe, ok := err.(FrameTooBigError); ok {
+			err = dec.sendICMPFragNeeded(ftbe.EPMTU, func(icmpFrame []byte) error {
+				return router.Ourself.Forward(srcPeer, false, icmpFrame, nil)
+			})
 		}
 
-		srcMac := dec.eth.SrcMAC
-		dstMac := dec.eth.DstMAC
+		checkWarn(err)
+		return
+	}
 
-		if router.Macs.Enter(srcMac, srcPeer) {
-			log.Println("Discovered remote MAC", srcMac, "at", srcPeer)
-		}
-		if po != nil {
-			router.LogFrame("Injecting", frame, &dec.eth)
-			checkWarn(po.WritePacket(frame))
-		}
+	srcMac := dec.eth.SrcMAC
+	dstMac := dec.eth.DstMAC
 
-		dstPeer, found = router.Macs.Lookup(dstMac)
-		if !found || dstPeer != router.Ourself.Peer {
-			router.LogFrame("Relaying broadcast", frame, &dec.eth)
-			router.Ourself.RelayBroadcast(srcPeer, df, frame, dec)
-		}
+	if router.Macs.Enter(srcMac, srcPeer) {
+		log.Println("Discovered remote MAC", srcMac, "at", srcPeer)
+	}
+	router.noteARPReply(srcPeer, dec)
+	router.captureEthernet(srcPeer, frame)
+	router.Flows.Count(dec, srcPeer, false, len(frame))
+	if po != nil {
+		router.LogFrame("Injecting", frame, &dec.eth)
+		checkWarn(po.WritePacket(frame))
+	}
+
+	dstPeer, found = router.Macs.Lookup(dstMac)
+	if !found || dstPeer != router.Ourself.Peer {
+		router.LogFrame("Relaying broadcast", frame, &dec.eth)
+		router.Ourself.RelayBroadcast(srcPeer, df, frame, dec)
 	}
 }
 
@@ -363,6 +676,7 @@ func handleSpecialFrame(relayConn *LocalConnection, sender *net.UDPAddr, frame [
 type TopologyGossipData struct {
 	peers  *Peers
 	update PeerNameSet
+	full   bool // to be sent in full even to peers taking deltas
 }
 
 func NewTopologyGossipData(peers *Peers, update ...*Peer) *TopologyGossipData {
@@ -377,6 +691,7 @@ func (d *TopologyGossipData) Merge(other GossipData) {
 	for name := range other.(*TopologyGossipData).update {
 		d.update[name] = void
 	}
+	d.full = d.full || other.(*TopologyGossipData).full
 }
 
 func (d *TopologyGossipData) Encode() []byte {
@@ -388,7 +703,7 @@ func (router *Router) OnGossipUnicast(sender PeerName, msg []byte) error {
 }
 
 func (router *Router) OnGossipBroadcast(update []byte) (GossipData, error) {
-	origUpdate, _, err := router.applyTopologyUpdate(update)
+	origUpdate, _, err := router.applyTopologyUpdate(UnknownPeerName, update)
 	if err != nil || len(origUpdate) == 0 {
 		return nil, err
 	}
@@ -396,25 +711,36 @@ func (router *Router) OnGossipBroadcast(update []byte) (GossipData, error) {
 }
 
 func (router *Router) Gossip() GossipData {
-	return &TopologyGossipData{peers: router.Peers, update: router.Peers.Names()}
+	round := atomic.AddUint64(&router.topologyRounds, 1)
+	return &TopologyGossipData{peers: router.Peers, update: router.Peers.Names(), full: round%FullTopologyEvery == 0}
 }
 
 func (router *Router) OnGossip(update []byte) (GossipData, error) {
-	_, newUpdate, err := router.applyTopologyUpdate(update)
+	return router.OnGossipFrom(UnknownPeerName, update)
+}
+
+func (router *Router) OnGossipFrom(sender PeerName, update []byte) (GossipData, error) {
+	_, newUpdate, err := router.applyTopologyUpdate(sender, update)
 	if err != nil || len(newUpdate) == 0 {
 		return nil, err
 	}
 	return &TopologyGossipData{peers: router.Peers, update: newUpdate}, nil
 }
 
-func (router *Router) applyTopologyUpdate(update []byte) (PeerNameSet, PeerNameSet, error) {
+// sender is the neighbour the update came from, if it came from one
+// on its own account, rather than being broadcast
+func (router *Router) applyTopologyUpdate(sender PeerName, update []byte) (PeerNameSet, PeerNameSet, error) {
 	origUpdate, newUpdate, err := router.Peers.ApplyUpdate(update)
 	if _, ok := err.(UnknownPeerError); err != nil && ok {
 		// That update contained a reference to a peer which wasn't
 		// itself included in the update, and we didn't know about
 		// already. We ignore this; eventually we should receive an
-		// update containing a complete topology.
+		// update containing a complete topology, sooner if we ask
+		// for it.
 		log.Println("Topology gossip:", err)
+		if sender != UnknownPeerName {
+			router.requestFullTopology(sender)
+		}
 		return nil, nil, nil
 	}
 	if err != nil {
@@ -423,6 +749,7 @@ func (router *Router) applyTopologyUpdate(update []byte) (PeerNameSet, PeerNameS
 	if len(newUpdate) > 0 {
 		router.ConnectionMaker.Refresh()
 		router.Routes.Recalculate()
+		router.warnOfVersions()
 	}
 	return origUpdate, newUpdate, nil
 }
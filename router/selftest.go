@@ -0,0 +1,323 @@
+package router
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"code.google.com/p/gopacket/layers"
+)
+
+// A self-test sends frames of its own, over the overlay, to a peer,
+// which counts them, and answers pings among them, so that we can
+// tell what the overlay itself achieves between the two, apart from
+// any application. The frames take the data path, being forwarded,
+// relayed and encrypted like any other, but are not injected at the
+// peer, being addressed from and to the zero MAC with an EtherType
+// for local experiments.
+const (
+	SelfTestEthernetType    = layers.EthernetType(0x88B5)
+	DefaultSelfTestDuration = 5 * time.Second
+	MaxSelfTestDuration     = time.Minute
+	SelfTestFrameSize       = 1400
+	SelfTestPings           = 20
+	selfTestReplyTimeout    = time.Second
+	selfTestReportAttempts  = 3
+	selfTestExpiry          = 2 * MaxSelfTestDuration // of the counts of a test we received
+)
+
+// The kinds of self-test frame
+const (
+	selfTestData byte = iota
+	selfTestPing
+	selfTestPong
+	selfTestReportRequest
+	selfTestReport
+	diagProbe   // as in diag.go
+	diagReply   // from the peer probed
+	diagExpired // from the peer relaying a probe when its hop limit ran out
+)
+
+// After the Ethernet header: the kind, the test's ID and two numbers,
+// a sequence number and a timestamp in pings and pongs, and the
+// frames and bytes received in reports
+const selfTestHeaderSize = EthernetOverhead + 1 + 4 + 8 + 8
+
+type selfTestFrame struct {
+	kind byte
+	id   uint32
+	a, b uint64
+}
+
+func (f selfTestFrame) encode(size int) []byte {
+	if size < selfTestHeaderSize {
+		size = selfTestHeaderSize
+	}
+	frame := make([]byte, size)
+	binary.BigEndian.PutUint16(frame[12:], uint16(SelfTestEthernetType))
+	frame[EthernetOverhead] = f.kind
+	binary.BigEndian.PutUint32(frame[EthernetOverhead+1:], f.id)
+	binary.BigEndian.PutUint64(frame[EthernetOverhead+5:], f.a)
+	binary.BigEndian.PutUint64(frame[EthernetOverhead+13:], f.b)
+	return frame
+}
+
+func decodeSelfTestFrame(frame []byte) (selfTestFrame, bool) {
+	if len(frame) < selfTestHeaderSize {
+		return selfTestFrame{}, false
+	}
+	return selfTestFrame{
+		kind: frame[EthernetOverhead],
+		id:   binary.BigEndian.Uint32(frame[EthernetOverhead+1:]),
+		a:    binary.BigEndian.Uint64(frame[EthernetOverhead+5:]),
+		b:    binary.BigEndian.Uint64(frame[EthernetOverhead+13:])}, true
+}
+
+func (dec *EthernetDecoder) isSelfTest() bool {
+	return len(dec.decoded) == 1 && dec.eth.EthernetType == SelfTestEthernetType
+}
+
+// SelfTestResult reports a self-test to a peer
+type SelfTestResult struct {
+	Peer           *Peer
+	Duration       time.Duration // that we sent for
+	SentFrames     uint64
+	SentBytes      uint64
+	ReceivedFrames uint64 // as the peer counted them
+	ReceivedBytes  uint64
+	PingsSent      int
+	PingsLost      int
+	RTTMin         time.Duration
+	RTTAvg         time.Duration
+	RTTMax         time.Duration
+	CPUTime        time.Duration // used by this process while sending
+}
+
+// Throughput is the bits per second the peer received
+func (result *SelfTestResult) Throughput() uint64 {
+	if result.Duration <= 0 {
+		return 0
+	}
+	return uint64(float64(result.ReceivedBytes*8) / result.Duration.Seconds())
+}
+
+// Loss is the percentage of the frames we sent that the peer did not
+// receive
+func (result *SelfTestResult) Loss() float64 {
+	if result.SentFrames == 0 || result.ReceivedFrames >= result.SentFrames {
+		return 0
+	}
+	return 100 * float64(result.SentFrames-result.ReceivedFrames) / float64(result.SentFrames)
+}
+
+// CPU is the percentage of one CPU this process used while sending
+func (result *SelfTestResult) CPU() float64 {
+	if result.Duration <= 0 {
+		return 0
+	}
+	return 100 * result.CPUTime.Seconds() / result.Duration.Seconds()
+}
+
+type selfTestKey struct {
+	peer PeerName
+	id   uint32
+}
+
+type selfTestCounts struct {
+	frames, bytes uint64
+	lastSeen      time.Time
+}
+
+type selfTests struct {
+	sync.Mutex
+	running  int32 // 1 while we are running one
+	received map[selfTestKey]*selfTestCounts
+	replies  map[uint32]chan selfTestFrame // of the tests we are running
+}
+
+func newSelfTests() *selfTests {
+	return &selfTests{
+		received: make(map[selfTestKey]*selfTestCounts),
+		replies:  make(map[uint32]chan selfTestFrame)}
+}
+
+// Handle a self-test frame from srcPeer, addressed to us
+func (router *Router) handleSelfTestFrame(srcPeer *Peer, frame []byte) {
+	f, ok := decodeSelfTestFrame(frame)
+	if !ok {
+		return
+	}
+	tests := router.selfTests
+	reply := func(f selfTestFrame) {
+		checkWarn(router.Ourself.Forward(srcPeer, false, f.encode(selfTestHeaderSize), nil))
+	}
+	switch f.kind {
+	case selfTestData:
+		tests.Lock()
+		counts := tests.countsFor(selfTestKey{srcPeer.Name, f.id})
+		counts.frames++
+		counts.bytes += uint64(len(frame))
+		tests.Unlock()
+	case selfTestPing:
+		reply(selfTestFrame{selfTestPong, f.id, f.a, f.b})
+	case selfTestReportRequest:
+		tests.Lock()
+		counts := tests.countsFor(selfTestKey{srcPeer.Name, f.id})
+		report := selfTestFrame{selfTestReport, f.id, counts.frames, counts.bytes}
+		tests.Unlock()
+		reply(report)
+	case diagProbe:
+		checkWarn(router.diags.send(srcPeer, selfTestFrame{diagReply, f.id, f.a, 0}.encode(selfTestHeaderSize)))
+	case diagReply, diagExpired:
+		router.diags.deliver(srcPeer, f)
+	case selfTestPong, selfTestReport:
+		tests.Lock()
+		replies, found := tests.replies[f.id]
+		tests.Unlock()
+		if found {
+			select {
+			case replies <- f:
+			default:
+			}
+		}
+	}
+}
+
+// Call with the lock held
+func (tests *selfTests) countsFor(key selfTestKey) *selfTestCounts {
+	now := time.Now()
+	counts, found := tests.received[key]
+	if !found {
+		for k, c := range tests.received {
+			if now.Sub(c.lastSeen) > selfTestExpiry {
+				delete(tests.received, k)
+			}
+		}
+		counts = &selfTestCounts{}
+		tests.received[key] = counts
+	}
+	counts.lastSeen = now
+	return counts
+}
+
+// SelfTest pings the named peer over the overlay, then sends it
+// frames for duration, at rate bits per second, or as fast as it can
+// if rate is 0, and asks it how many it received. Only one self-test
+// runs at a time.
+func (router *Router) SelfTest(name PeerName, duration time.Duration, rate uint64) (*SelfTestResult, error) {
+	peer, found := router.Peers.Fetch(name)
+	if !found {
+		return nil, fmt.Errorf("Unknown peer %s", name)
+	}
+	if peer == router.Ourself.Peer {
+		return nil, fmt.Errorf("Unable to self-test to ourself")
+	}
+	if _, found := router.Routes.Unicast(name); !found {
+		return nil, fmt.Errorf("No route to peer %s", peer)
+	}
+	if duration <= 0 || duration > MaxSelfTestDuration {
+		return nil, fmt.Errorf("Invalid self-test duration %s: expected up to %s", duration, MaxSelfTestDuration)
+	}
+	tests := router.selfTests
+	if !atomic.CompareAndSwapInt32(&tests.running, 0, 1) {
+		return nil, fmt.Errorf("A self-test is already running")
+	}
+	defer atomic.StoreInt32(&tests.running, 0)
+
+	id := rand.Uint32()
+	replies := make(chan selfTestFrame, SelfTestPings)
+	tests.Lock()
+	tests.replies[id] = replies
+	tests.Unlock()
+	defer func() {
+		tests.Lock()
+		delete(tests.replies, id)
+		tests.Unlock()
+	}()
+	send := func(f selfTestFrame, size int) error {
+		return router.Ourself.Forward(peer, false, f.encode(size), nil)
+	}
+	// wait for a reply of the kind given, matching a, if a pong
+	await := func(kind byte, a uint64) (selfTestFrame, bool) {
+		timeout := time.After(selfTestReplyTimeout)
+		for {
+			select {
+			case f := <-replies:
+				if f.kind == kind && (kind != selfTestPong || f.a == a) {
+					return f, true
+				}
+			case <-timeout:
+				return selfTestFrame{}, false
+			}
+		}
+	}
+
+	result := &SelfTestResult{Peer: peer, PingsSent: SelfTestPings}
+	var rttTotal time.Duration
+	for seq := uint64(0); seq < SelfTestPings; seq++ {
+		sent := time.Now()
+		if err := send(selfTestFrame{selfTestPing, id, seq, uint64(sent.UnixNano())}, selfTestHeaderSize); err != nil {
+			return nil, err
+		}
+		if _, ok := await(selfTestPong, seq); !ok {
+			result.PingsLost++
+			continue
+		}
+		rtt := time.Since(sent)
+		rttTotal += rtt
+		if result.RTTMin == 0 || rtt < result.RTTMin {
+			result.RTTMin = rtt
+		}
+		if rtt > result.RTTMax {
+			result.RTTMax = rtt
+		}
+	}
+	if result.PingsLost == result.PingsSent {
+		return nil, fmt.Errorf("No reply from peer %s to self-test pings; it may be unreachable, or not support self-tests", peer)
+	}
+	result.RTTAvg = rttTotal / time.Duration(result.PingsSent-result.PingsLost)
+
+	cpuBefore := cpuTime()
+	start := time.Now()
+	for seq := uint64(0); time.Since(start) < duration; seq++ {
+		if err := send(selfTestFrame{selfTestData, id, seq, 0}, SelfTestFrameSize); err != nil {
+			return nil, err
+		}
+		result.SentFrames++
+		result.SentBytes += SelfTestFrameSize
+		if rate > 0 {
+			due := start.Add(time.Duration(float64(result.SentBytes*8) / float64(rate) * float64(time.Second)))
+			if ahead := due.Sub(time.Now()); ahead > time.Millisecond {
+				time.Sleep(ahead)
+			}
+		}
+	}
+	result.Duration = time.Since(start)
+	result.CPUTime = cpuTime() - cpuBefore
+
+	// let the last frames arrive before asking how many did
+	time.Sleep(100*time.Millisecond + 2*result.RTTMax)
+	for i := 0; i < selfTestReportAttempts; i++ {
+		if err := send(selfTestFrame{selfTestReportRequest, id, 0, 0}, selfTestHeaderSize); err != nil {
+			return nil, err
+		}
+		if report, ok := await(selfTestReport, 0); ok {
+			result.ReceivedFrames, result.ReceivedBytes = report.a, report.b
+			return result, nil
+		}
+	}
+	return nil, fmt.Errorf("No self-test report from peer %s", peer)
+}
+
+// The user and system CPU time this process has used
+func cpuTime() time.Duration {
+	var usage syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &usage); err != nil {
+		return 0
+	}
+	return time.Duration(usage.Utime.Nano() + usage.Stime.Nano())
+}
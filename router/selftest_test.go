@@ -0,0 +1,43 @@
+package router
+
+import (
+	wt "github.com/weaveworks/weave/testing"
+	"testing"
+	"time"
+)
+
+func TestSelfTestFrames(t *testing.T) {
+	f := selfTestFrame{selfTestPing, 42, 7, 123456789}
+	frame := f.encode(SelfTestFrameSize)
+	wt.AssertEqualInt(t, len(frame), SelfTestFrameSize, "frame size")
+	decoded, ok := decodeSelfTestFrame(frame)
+	wt.AssertTrue(t, ok, "decoded")
+	wt.AssertEquals(t, decoded, f)
+	_, ok = decodeSelfTestFrame(frame[:selfTestHeaderSize-1])
+	wt.AssertFalse(t, ok, "decoded a short frame")
+
+	dec := NewEthernetDecoder()
+	dec.DecodeLayers(frame)
+	wt.AssertTrue(t, dec.isSelfTest(), "is a self-test frame")
+	wt.AssertFalse(t, dec.IsSpecial(), "is special")
+
+	name, _ := PeerNameFromString("01:00:00:01:00:00")
+	router := NewTestRouter(name)
+	srcName, _ := PeerNameFromString("02:00:00:01:00:00")
+	src := NewPeer(srcName, "", 0, 0)
+	for i := 0; i < 3; i++ {
+		router.handleSelfTestFrame(src, selfTestFrame{selfTestData, 42, uint64(i), 0}.encode(SelfTestFrameSize))
+	}
+	counts := router.selfTests.received[selfTestKey{srcName, 42}]
+	wt.AssertEqualuint64(t, counts.frames, 3, "frames received")
+	wt.AssertEqualuint64(t, counts.bytes, 3*SelfTestFrameSize, "bytes received")
+}
+
+func TestSelfTestResult(t *testing.T) {
+	result := SelfTestResult{Duration: 2 * time.Second, SentFrames: 100, ReceivedFrames: 90,
+		ReceivedBytes: 1000000, CPUTime: time.Second}
+	wt.AssertEqualuint64(t, result.Throughput(), 4000000, "throughput")
+	wt.AssertTrue(t, result.Loss() == 10, "loss")
+	wt.AssertTrue(t, result.CPU() == 50, "CPU")
+	wt.AssertTrue(t, (&SelfTestResult{}).Loss() == 0, "loss of nothing")
+}
@@ -0,0 +1,157 @@
+package router
+
+import (
+	"sort"
+	"time"
+)
+
+// PeerStatus describes a peer we know of, and its connections, as it
+// last told us of them
+type PeerStatus struct {
+	Name     string
+	NickName string
+	UID      PeerUID
+	Labels   map[string]string
+	Version  uint64
+	// of weave the peer runs, blank if it is too old to tell us, and
+	// the features it has enabled
+	WeaveVersion string
+	Features     []string
+	Connections  []ConnectionStatus
+}
+
+// ConnectionStatus describes a connection from a peer to another
+type ConnectionStatus struct {
+	Name        string
+	NickName    string
+	TCPAddr     string
+	Outbound    bool
+	Established bool
+}
+
+func connectionStatus(conn Connection) ConnectionStatus {
+	return ConnectionStatus{conn.Remote().Name.String(), conn.Remote().NickName, conn.RemoteTCPAddr(), conn.Outbound(), conn.Established()}
+}
+
+// Status describes all the peers, in order of name
+func (peers *Peers) Status() []PeerStatus {
+	var statuses []PeerStatus
+	peers.ForEach(func(peer *Peer) {
+		status := PeerStatus{peer.Name.String(), peer.NickName, peer.UID, peer.Labels, peer.version, peer.WeaveVersion, peer.Features, []ConnectionStatus{}}
+		if peer == peers.ourself.Peer {
+			for conn := range peers.ourself.Connections() {
+				status.Connections = append(status.Connections, connectionStatus(conn))
+			}
+		} else {
+			// as in MarshalJSON, holding the read lock is enough
+			for _, conn := range peer.connections {
+				status.Connections = append(status.Connections, connectionStatus(conn))
+			}
+		}
+		statuses = append(statuses, status)
+	})
+	sort.Sort(byPeerName(statuses))
+	return statuses
+}
+
+type byPeerName []PeerStatus
+
+func (ps byPeerName) Len() int           { return len(ps) }
+func (ps byPeerName) Swap(i, j int)      { ps[i], ps[j] = ps[j], ps[i] }
+func (ps byPeerName) Less(i, j int) bool { return ps[i].Name < ps[j].Name }
+
+// TargetStatus describes an address the connection maker is
+// connecting to, or will try again, or, in AllTargets, has connected
+// to
+type TargetStatus struct {
+	Address     string
+	State       string // TargetConnecting etc.
+	Attempting  bool
+	LastAttempt time.Time // zero if we haven't tried it yet
+	LastError   string
+	Failures    int // attempts that have failed in a row
+	TryAfter    time.Time
+	Name        string // of the peer, once connected
+}
+
+// What the connection maker is doing about a target
+const (
+	TargetConnecting  = "connecting"  // trying it, or about to for the first time
+	TargetRetrying    = "retrying"    // waiting to try again, after failing
+	TargetFailed      = "failed"      // waiting to try again, after failing so often we try it only every MaxInterval
+	TargetEstablished = "established" // connected
+)
+
+func (cm *ConnectionMaker) targetStatus(address string, target *Target) TargetStatus {
+	status := TargetStatus{Address: address, State: TargetConnecting, Attempting: target.attempting,
+		LastAttempt: cm.lastAttempt[address], Failures: target.failures, TryAfter: target.tryAfter}
+	if target.lastError != nil {
+		status.LastError = target.lastError.Error()
+	}
+	switch {
+	case target.attempting || target.failures == 0:
+	case target.tryInterval >= MaxInterval:
+		status.State = TargetFailed
+	default:
+		status.State = TargetRetrying
+	}
+	return status
+}
+
+// Targets describes the addresses we are not connected to but would
+// like to be, in order of address
+func (cm *ConnectionMaker) Targets() []TargetStatus {
+	// as in String
+	cm.Refresh()
+	resultChan := make(chan []TargetStatus, 0)
+	cm.actionChan <- func() bool {
+		targets := []TargetStatus{}
+		for address, target := range cm.targets {
+			targets = append(targets, cm.targetStatus(address, target))
+		}
+		resultChan <- targets
+		return false
+	}
+	targets := <-resultChan
+	sort.Sort(byAddress(targets))
+	return targets
+}
+
+// AllTargets describes the addresses we would like to be connected to,
+// along with those we have connected to, in order of address
+func (cm *ConnectionMaker) AllTargets() []TargetStatus {
+	cm.Refresh()
+	resultChan := make(chan []TargetStatus, 0)
+	cm.actionChan <- func() bool {
+		targets := []TargetStatus{}
+		connected := make(map[string]struct{})
+		for conn := range cm.ourself.Connections() {
+			if !conn.Outbound() {
+				continue
+			}
+			connected[conn.RemoteTCPAddr()] = void
+			status := TargetStatus{Address: conn.RemoteTCPAddr(), State: TargetConnecting, Attempting: true,
+				LastAttempt: cm.lastAttempt[conn.RemoteTCPAddr()], Name: conn.Remote().Name.String()}
+			if conn.Established() {
+				status.State, status.Attempting = TargetEstablished, false
+			}
+			targets = append(targets, status)
+		}
+		for address, target := range cm.targets {
+			if _, found := connected[address]; !found {
+				targets = append(targets, cm.targetStatus(address, target))
+			}
+		}
+		resultChan <- targets
+		return false
+	}
+	targets := <-resultChan
+	sort.Sort(byAddress(targets))
+	return targets
+}
+
+type byAddress []TargetStatus
+
+func (ts byAddress) Len() int           { return len(ts) }
+func (ts byAddress) Swap(i, j int)      { ts[i], ts[j] = ts[j], ts[i] }
+func (ts byAddress) Less(i, j int) bool { return ts[i].Address < ts[j].Address }
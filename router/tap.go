@@ -0,0 +1,48 @@
+package router
+
+import (
+	"os"
+
+	weavenet "github.com/weaveworks/weave/net"
+)
+
+// DefaultTap is the name of the TAP device, for DatapathTap
+const DefaultTap = "vethwe-tap"
+
+// TapIO reads frames from, and writes them to, a TAP device; unlike
+// pcap, it only sees the frames the bridge sends to the device, and
+// never those we write
+type TapIO struct {
+	file *os.File
+	buf  []byte
+}
+
+// NewTapIO creates the TAP device called name and plugs it into the
+// bridge called bridgeName
+func NewTapIO(name, bridgeName string) (*TapIO, error) {
+	file, err := weavenet.OpenTap(name, bridgeName)
+	if err != nil {
+		return nil, err
+	}
+	return &TapIO{file: file, buf: make([]byte, MaxUDPPacketSize)}, nil
+}
+
+// ReadPacket returns the next frame, which is only valid until the
+// next call, as with pcap
+func (tio *TapIO) ReadPacket() ([]byte, error) {
+	n, err := tio.file.Read(tio.buf)
+	if err != nil {
+		return nil, err
+	}
+	return tio.buf[:n], nil
+}
+
+func (tio *TapIO) WritePacket(data []byte) error {
+	_, err := tio.file.Write(data)
+	return err
+}
+
+// Close closes the device, which deletes it
+func (tio *TapIO) Close() error {
+	return tio.file.Close()
+}
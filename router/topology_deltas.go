@@ -0,0 +1,125 @@
+package router
+
+import (
+	"bytes"
+	"encoding/gob"
+	"sync"
+)
+
+// Topology gossip that we send down a connection on our own account,
+// rather than broadcast, i.e. the periodic gossip and what we pass on
+// of what we hear, need only carry the peers that have changed since
+// we last told the other end about them, so long as the other end
+// says in the handshake that it can take that, and will ask us for
+// everything when it can't make sense of what we send. Every
+// FullTopologyEvery rounds of periodic gossip we send everything
+// anyway, in case the other end has lost track.
+const (
+	TopologyDeltasField = "TopologyDeltas"
+	FullTopologyEvery   = 10
+)
+
+type peerVersion struct {
+	uid     PeerUID
+	version uint64
+}
+
+// What we have told the peer at the other end of a connection of the
+// topology
+type topologySent struct {
+	sync.Mutex
+	versions map[PeerName]peerVersion
+}
+
+func newTopologySent() *topologySent {
+	return &topologySent{versions: make(map[PeerName]peerVersion)}
+}
+
+// A connection whose other end can take topology deltas
+type topologyDeltaConnection interface {
+	topologyDeltas() *topologySent // nil if it can't
+}
+
+func (conn *LocalConnection) topologyDeltas() *topologySent {
+	return conn.topologySent
+}
+
+// ConnectionGossipData is GossipData that can tailor what it sends
+// down a connection, e.g. to leave out what it has sent before
+type ConnectionGossipData interface {
+	GossipData
+	// EncodeFor encodes what to send down conn, if anything
+	EncodeFor(conn Connection) []byte
+}
+
+func (d *TopologyGossipData) EncodeFor(conn Connection) []byte {
+	if dc, ok := conn.(topologyDeltaConnection); ok {
+		if sent := dc.topologyDeltas(); sent != nil {
+			return d.peers.EncodePeersChanged(d.update, sent, d.full)
+		}
+	}
+	return d.Encode()
+}
+
+// EncodePeersChanged encodes those of the named peers whose version
+// differs from what sent says we last sent, or all of them if full,
+// noting what it encodes in sent.
+func (peers *Peers) EncodePeersChanged(names PeerNameSet, sent *topologySent, full bool) []byte {
+	buf := new(bytes.Buffer)
+	enc := gob.NewEncoder(buf)
+	sent.Lock()
+	defer sent.Unlock()
+	if full {
+		sent.versions = make(map[PeerName]peerVersion)
+	}
+	peers.RLock()
+	defer peers.RUnlock()
+	for name := range names {
+		peer, found := peers.table[name]
+		if !found {
+			continue
+		}
+		var version peerVersion
+		if peer == peers.ourself.Peer {
+			// read before encoding, so that if it changes in
+			// between we send it again next time
+			peers.ourself.RLock()
+			version = peerVersion{peer.UID, peer.version}
+			peers.ourself.RUnlock()
+		} else {
+			version = peerVersion{peer.UID, peer.version}
+		}
+		if !full && sent.versions[name] == version {
+			continue
+		}
+		if peer == peers.ourself.Peer {
+			peers.ourself.Encode(enc)
+		} else {
+			peer.Encode(enc)
+		}
+		sent.versions[name] = version
+	}
+	return buf.Bytes()
+}
+
+// Send everything we know of the topology down conn, e.g. when it has
+// asked for it, having been unable to make sense of a delta
+func (router *Router) sendFullTopology(conn Connection) {
+	if channel, ok := router.TopologyGossip.(*GossipChannel); ok {
+		channel.SendDown(conn, &TopologyGossipData{peers: router.Peers, update: router.Peers.Names(), full: true})
+	}
+}
+
+// The gossip we got from sender refers to a peer we don't know, which
+// may be because it was a delta and we have forgotten the peer since
+// we last heard of it; if so, we ask for everything
+func (router *Router) requestFullTopology(sender PeerName) {
+	conn, found := router.Ourself.ConnectionTo(sender)
+	if !found {
+		return
+	}
+	if dc, ok := conn.(topologyDeltaConnection); ok && dc.topologyDeltas() != nil {
+		conn.Log("asking for full topology, being unable to apply its update")
+		conn.(ProtocolSender).SendProtocolMsg(ProtocolMsg{ProtocolTopologyRequest, nil})
+	}
+}
@@ -0,0 +1,169 @@
+package router
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/weaveworks/weave/common"
+)
+
+// The watchdog notices parts of the router that have stopped making
+// progress: a capture worker stuck on a frame, a forwarder stuck
+// sending one, or an actor, such as the local peer, which gossips,
+// stuck on an action. Each part notes on its Progress when it begins
+// and ends a piece of work, which is cheap enough to do for every
+// frame; parts waiting for work are idle, not stuck. When one has been
+// on the same piece of work for the timeout, the watchdog logs the
+// goroutines, which show where it is stuck, and, if asked to, restarts
+// it, where that can be done.
+
+const DefaultWatchdogTimeout = 60 * time.Second
+
+// Progress is what a part of the router notes its work on, for the
+// watchdog. Its methods do nothing on a nil Progress, as parts get
+// when there is no watchdog.
+type Progress struct {
+	name    string
+	restart func() // gets the part going again; nil if it can't be
+	work    uint64 // pieces of work begun and ended, so odd while busy
+	// only touched by the watchdog
+	seen    uint64
+	since   time.Time // when work was last seen to change
+	stalled bool
+}
+
+// Begin notes that the part has begun a piece of work
+func (p *Progress) Begin() {
+	if p != nil {
+		atomic.AddUint64(&p.work, 1)
+	}
+}
+
+// End notes that the part has ended the piece of work it began
+func (p *Progress) End() {
+	if p != nil {
+		atomic.AddUint64(&p.work, 1)
+	}
+}
+
+// Watchdog watches the progress of parts of the router
+type Watchdog struct {
+	sync.Mutex
+	timeout time.Duration
+	restart bool // whether to restart parts that stall, where they can be
+	watched map[*Progress]struct{}
+	stalls  int // how many times parts have stalled
+}
+
+// NewWatchdog makes a watchdog that reports parts stuck for timeout,
+// restarting them if restart
+func NewWatchdog(timeout time.Duration, restart bool) *Watchdog {
+	return &Watchdog{timeout: timeout, restart: restart, watched: make(map[*Progress]struct{})}
+}
+
+// Watch starts watching the part called name, which restart, if not
+// nil, gets going again, returning the Progress it is to note its work
+// on. It returns nil if w is nil, i.e. there is no watchdog.
+func (w *Watchdog) Watch(name string, restart func()) *Progress {
+	if w == nil {
+		return nil
+	}
+	p := &Progress{name: name, restart: restart, since: time.Now()}
+	w.Lock()
+	w.watched[p] = struct{}{}
+	w.Unlock()
+	return p
+}
+
+// Unwatch stops watching the part, which has finished
+func (w *Watchdog) Unwatch(p *Progress) {
+	if w == nil || p == nil {
+		return
+	}
+	w.Lock()
+	delete(w.watched, p)
+	w.Unlock()
+}
+
+// Start checks on the parts watched every quarter of the timeout
+func (w *Watchdog) Start() {
+	go func() {
+		for now := range time.Tick(w.timeout / 4) {
+			w.report(w.check(now))
+		}
+	}()
+}
+
+// Stalls is how many times parts of the router have stalled
+func (w *Watchdog) Stalls() int {
+	if w == nil {
+		return 0
+	}
+	w.Lock()
+	defer w.Unlock()
+	return w.stalls
+}
+
+// Stalled lists the parts of the router that are stuck, in order
+func (w *Watchdog) Stalled() []string {
+	if w == nil {
+		return nil
+	}
+	w.Lock()
+	defer w.Unlock()
+	var names []string
+	for p := range w.watched {
+		if p.stalled {
+			names = append(names, p.name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Find the parts that have been on the same piece of work for the
+// timeout, as of now, and hadn't been already
+func (w *Watchdog) check(now time.Time) []*Progress {
+	w.Lock()
+	defer w.Unlock()
+	var stalled []*Progress
+	for p := range w.watched {
+		work := atomic.LoadUint64(&p.work)
+		switch {
+		case work != p.seen || work%2 == 0:
+			if p.stalled {
+				log.Println("Watchdog:", p.name, "is making progress again")
+			}
+			p.seen, p.since, p.stalled = work, now, false
+		case !p.stalled && now.Sub(p.since) >= w.timeout:
+			p.stalled = true
+			w.stalls++
+			stalled = append(stalled, p)
+		}
+	}
+	return stalled
+}
+
+func (w *Watchdog) report(stalled []*Progress) {
+	if len(stalled) == 0 {
+		return
+	}
+	for _, p := range stalled {
+		log.Println("Watchdog:", p.name, "has made no progress for", w.timeout)
+	}
+	log.Printf("Watchdog: goroutine dump...\n%s\n*** end", common.Goroutines())
+	if !w.restart {
+		return
+	}
+	for _, p := range stalled {
+		if p.restart == nil {
+			log.Println("Watchdog: unable to restart", p.name)
+			continue
+		}
+		log.Println("Watchdog: restarting", p.name)
+		go p.restart()
+	}
+}
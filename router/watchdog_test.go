@@ -0,0 +1,46 @@
+package router
+
+import (
+	"testing"
+	"time"
+
+	wt "github.com/weaveworks/weave/testing"
+)
+
+func TestWatchdog(t *testing.T) {
+	var none *Watchdog
+	p := none.Watch("nothing", nil)
+	p.Begin()
+	p.End()
+	none.Unwatch(p)
+	wt.AssertEqualInt(t, none.Stalls(), 0, "stalls without a watchdog")
+
+	w := NewWatchdog(time.Minute, true)
+	start := time.Now()
+	idle := w.Watch("idle", nil)
+	busy := w.Watch("busy", nil)
+	stuck := w.Watch("stuck", nil)
+	for i := 0; i < 2; i++ {
+		busy.Begin()
+		if i == 0 {
+			stuck.Begin()
+		}
+		wt.AssertEqualInt(t, len(w.check(start.Add(time.Duration(i)*30*time.Second))), 0, "stalled at first")
+		busy.End()
+	}
+	busy.Begin()
+	stalled := w.check(start.Add(time.Minute))
+	busy.End()
+	wt.AssertEqualInt(t, len(stalled), 1, "stalled")
+	wt.AssertEqualString(t, stalled[0].name, "stuck", "stalled part")
+	wt.AssertEqualInt(t, len(w.check(start.Add(2*time.Minute))), 0, "stalled again")
+	wt.AssertEquals(t, w.Stalled(), []string{"stuck"})
+	wt.AssertEqualInt(t, w.Stalls(), 1, "stalls")
+
+	stuck.End()
+	w.check(start.Add(3 * time.Minute))
+	wt.AssertEqualInt(t, len(w.Stalled()), 0, "stalled once unstuck")
+	w.Unwatch(idle)
+	w.Unwatch(stuck)
+	wt.AssertEqualInt(t, len(w.watched), 1, "watched")
+}
@@ -0,0 +1,506 @@
+package router
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	weavenet "github.com/weaveworks/weave/net"
+)
+
+// Without a password, a frame we forward to a MAC on another peer
+// goes out in a UDP packet as no more than a header, the same for
+// every frame to that MAC but for a few lengths, and the frame. So
+// for those MACs we have an XDP program on the interface we capture
+// on do that in the kernel, taking frames before they are captured,
+// and leave only frames to other MACs, broadcasts, and those too big
+// for the connection's PMTU, to us. We tell the program the header
+// for each MAC in a map, which we keep up to date with the MAC cache,
+// routes and connections.
+
+const (
+	// How often we bring the program's map up to date
+	xdpRefreshInterval = time.Second
+	// How many MACs the program can forward frames to
+	xdpMaxMACs = 16384
+	// The header: ethernet, IPv4 and UDP, our name, and the frame's
+	// source and destination peers' names and length
+	xdpHeaderSize = EthernetOverhead + 20 + 8 + NameSize + NameSize + NameSize + 2
+	// The map's values: interface index, biggest frame, IP header
+	// checksum but for the length, padding, and then the header,
+	// padded to a whole number of 8-byte words
+	xdpValueIfindex  = 0
+	xdpValueMaxFrame = 4
+	xdpValueChecksum = 8
+	xdpValueHeader   = 16
+	xdpValueSize     = xdpValueHeader + (xdpHeaderSize+7)/8*8
+)
+
+// XDPCounters count the frames forwarded in the kernel
+type XDPCounters struct {
+	Frames uint64
+	Bytes  uint64
+}
+
+// XDPOffload forwards frames to MACs on other peers in the kernel
+type XDPOffload struct {
+	sync.Mutex
+	router    *Router
+	progFD    int
+	macs      *weavenet.BPFMap
+	counters  *weavenet.BPFMap
+	linkFD    int // of the program's attachment, or -1
+	ifindex   int // of the interface it is attached to
+	installed map[uint64][]byte
+}
+
+// NewXDPOffload loads the program, ready to be attached
+func NewXDPOffload(router *Router) (*XDPOffload, error) {
+	macs, err := weavenet.NewBPFMap(weavenet.BPFMapTypeHash, 8, xdpValueSize, xdpMaxMACs)
+	if err != nil {
+		return nil, err
+	}
+	counters, err := weavenet.NewBPFMap(weavenet.BPFMapTypeArray, 4, 16, 1)
+	if err != nil {
+		macs.Close()
+		return nil, err
+	}
+	progFD, err := weavenet.LoadBPFProgram(weavenet.BPFProgTypeXDP, xdpProgram(macs.FD(), counters.FD()), "GPL")
+	if err != nil {
+		macs.Close()
+		counters.Close()
+		return nil, err
+	}
+	return &XDPOffload{
+		router:    router,
+		progFD:    progFD,
+		macs:      macs,
+		counters:  counters,
+		linkFD:    -1,
+		installed: make(map[uint64][]byte)}, nil
+}
+
+func (x *XDPOffload) Start() {
+	go func() {
+		for range time.Tick(xdpRefreshInterval) {
+			x.refresh()
+		}
+	}()
+}
+
+// Attach the program to the interface we capture on, and tell it
+// which MACs to forward frames to, and how
+func (x *XDPOffload) refresh() {
+	x.Lock()
+	defer x.Unlock()
+	iface := x.router.capturedIface()
+	if iface == nil || !x.router.Capturing() {
+		x.detach()
+		return
+	}
+	if x.linkFD < 0 || iface.Index != x.ifindex {
+		x.detach()
+		linkFD, err := weavenet.AttachXDP(x.progFD, iface.Index)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		log.Println("Forwarding frames to known MACs of other peers in the kernel, with XDP on", iface.Name)
+		x.linkFD, x.ifindex = linkFD, iface.Index
+	}
+	wanted := make(map[uint64][]byte)
+	// we leave all frames to userspace while they are being captured
+	if !x.router.copyingFrames() {
+		peers := make(map[uint64]*Peer)
+		x.router.Macs.forEach(func(key uint64, entry *MacCacheEntry) {
+			peers[key] = entry.peer
+		})
+		values := make(map[*Peer][]byte)
+		for key, peer := range peers {
+			value, found := values[peer]
+			if !found {
+				value = x.valueFor(peer)
+				values[peer] = value
+			}
+			if value != nil {
+				wanted[key] = value
+			}
+		}
+	}
+	for key := range x.installed {
+		if _, found := wanted[key]; !found {
+			x.macs.Delete(xdpKey(key))
+			delete(x.installed, key)
+		}
+	}
+	for key, value := range wanted {
+		if installed, found := x.installed[key]; found && string(installed) == string(value) {
+			continue
+		}
+		if err := x.macs.Update(xdpKey(key), value); err != nil {
+			log.Println("Unable to tell XDP program of", intmac(key), err)
+			continue
+		}
+		x.installed[key] = value
+	}
+}
+
+func (x *XDPOffload) detach() {
+	if x.linkFD < 0 {
+		return
+	}
+	syscall.Close(x.linkFD)
+	x.linkFD = -1
+	for key := range x.installed {
+		x.macs.Delete(xdpKey(key))
+	}
+	x.installed = make(map[uint64][]byte)
+}
+
+func xdpKey(mac uint64) []byte {
+	key := make([]byte, 8)
+	copy(key, intmac(mac))
+	return key
+}
+
+// What the program needs to forward frames to peer itself, or nil if
+// it can't: if the frames are for us, or there's no established
+// connection to send them on, over IPv4, or the kernel doesn't know
+// the MAC of the next hop yet, which it will once we have sent it
+// something
+func (x *XDPOffload) valueFor(peer *Peer) []byte {
+	router := x.router
+	if peer == router.Ourself.Peer {
+		return nil
+	}
+	hop, found := router.Routes.Unicast(peer.Name)
+	if !found {
+		return nil
+	}
+	c, found := router.Ourself.ConnectionTo(hop)
+	if !found {
+		return nil
+	}
+	conn, ok := c.(*LocalConnection)
+	if !ok || !conn.Established() {
+		return nil
+	}
+	conn.RLock()
+	remote, effectivePMTU := conn.remoteUDPAddr, conn.effectivePMTU
+	conn.RUnlock()
+	if remote == nil || remote.IP.To4() == nil {
+		return nil
+	}
+	ifindex, src, srcMAC, dstMAC, err := weavenet.NextHop(remote.IP)
+	if err != nil {
+		return nil
+	}
+	if src == nil {
+		if local := conn.localUDPAddr(); local != nil {
+			src = local.IP
+		}
+	}
+	if src.To4() == nil {
+		return nil
+	}
+	return xdpValue(ifindex, effectivePMTU, srcMAC, dstMAC, &net.UDPAddr{IP: src, Port: router.Port}, remote, router.Ourself.NameByte, peer.NameByte)
+}
+
+// The value telling the program to forward frames, no bigger than
+// maxFrame, to the peer called dstName, from src to dst, out of the
+// interface with index ifindex
+func xdpValue(ifindex, maxFrame int, srcMAC, dstMAC net.HardwareAddr, src, dst *net.UDPAddr, ourName, dstName []byte) []byte {
+	value := make([]byte, xdpValueSize)
+	binary.LittleEndian.PutUint32(value[xdpValueIfindex:], uint32(ifindex))
+	binary.LittleEndian.PutUint32(value[xdpValueMaxFrame:], uint32(maxFrame))
+	header := value[xdpValueHeader:]
+	copy(header[0:], dstMAC)
+	copy(header[6:], srcMAC)
+	binary.BigEndian.PutUint16(header[12:], 0x0800)
+	ip := header[EthernetOverhead:]
+	ip[0] = 0x45
+	binary.BigEndian.PutUint16(ip[6:], 0x4000) // DF; the frame fits the PMTU
+	ip[8] = 64
+	ip[9] = syscall.IPPROTO_UDP
+	copy(ip[12:], src.IP.To4())
+	copy(ip[16:], dst.IP.To4())
+	binary.LittleEndian.PutUint32(value[xdpValueChecksum:], ipChecksumSum(ip[:20]))
+	udp := ip[20:]
+	binary.BigEndian.PutUint16(udp[0:], uint16(src.Port))
+	binary.BigEndian.PutUint16(udp[2:], uint16(dst.Port))
+	names := udp[8:]
+	copy(names[0:], ourName)
+	copy(names[NameSize:], ourName)
+	copy(names[2*NameSize:], dstName)
+	return value
+}
+
+// The one's complement sum of the 16-bit words of an IP header,
+// folded, but not complemented, so that the program need only add
+// the total length and complement it
+func ipChecksumSum(header []byte) uint32 {
+	var sum uint32
+	for i := 0; i < len(header); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(header[i:]))
+	}
+	for sum > 0xffff {
+		sum = sum&0xffff + sum>>16
+	}
+	return sum
+}
+
+// XDPTotals counts the frames forwarded in the kernel, if we are
+func (router *Router) XDPTotals() (XDPCounters, bool) {
+	if router.xdp == nil {
+		return XDPCounters{}, false
+	}
+	return router.xdp.Totals(), true
+}
+
+// Totals reads the counters
+func (x *XDPOffload) Totals() XDPCounters {
+	value := make([]byte, 16)
+	if err := x.counters.Lookup(make([]byte, 4), value); err != nil {
+		return XDPCounters{}
+	}
+	return XDPCounters{Frames: binary.LittleEndian.Uint64(value[0:]), Bytes: binary.LittleEndian.Uint64(value[8:])}
+}
+
+func (x *XDPOffload) String() string {
+	x.Lock()
+	defer x.Unlock()
+	totals := x.Totals()
+	if x.linkFD < 0 {
+		return fmt.Sprintf("not attached; %d frames, %d bytes forwarded\n", totals.Frames, totals.Bytes)
+	}
+	return fmt.Sprintf("%d MACs; %d frames, %d bytes forwarded\n", len(x.installed), totals.Frames, totals.Bytes)
+}
+
+// The program, in the kernel's encoding, given the file descriptors
+// of the maps of MACs and counters
+func xdpProgram(macsFD, countersFD int) []byte {
+	const (
+		xdpAborted  = 0
+		xdpPass     = 2
+		lookupElem  = 1  // bpf_map_lookup_elem
+		redirect    = 23 // bpf_redirect
+		adjustHead  = 44 // bpf_xdp_adjust_head
+		ipOffset    = EthernetOverhead
+		udpOffset   = ipOffset + 20
+		lenOffset   = xdpHeaderSize - 2
+		ipOverhead  = xdpHeaderSize - EthernetOverhead
+		udpOverhead = ipOverhead - 20
+	)
+	a := newBPFAsm()
+	// r6 = ctx; r2 = data; r3 = data_end
+	a.mov(r6, r1)
+	a.ldx(bpfW, r2, r6, 0)
+	a.ldx(bpfW, r3, r6, 4)
+	a.mov(r4, r2)
+	a.addImm(r4, EthernetOverhead)
+	a.jmp(bpfJGT, r4, r3, "pass")
+	// the key, on the stack: the destination MAC, padded
+	a.ldx(bpfW, r5, r2, 0)
+	a.stx(bpfW, r10, r5, -8)
+	a.ldx(bpfH, r5, r2, 4)
+	a.stx(bpfH, r10, r5, -4)
+	a.stImm(bpfH, r10, -2, 0)
+	// r7 = frame length
+	a.mov(r7, r3)
+	a.sub(r7, r2)
+	a.ldMapFD(r1, macsFD)
+	a.mov(r2, r10)
+	a.addImm(r2, -8)
+	a.call(lookupElem)
+	a.jmpImm(bpfJEQ, r0, 0, "pass")
+	// r8 = what we know of the MAC
+	a.mov(r8, r0)
+	a.ldx(bpfW, r1, r8, xdpValueMaxFrame)
+	a.jmp(bpfJGT, r7, r1, "pass")
+	a.mov(r1, r6)
+	a.movImm(r2, -xdpHeaderSize)
+	a.call(adjustHead)
+	a.jmpImm(bpfJNE, r0, 0, "pass")
+	a.ldx(bpfW, r2, r6, 0)
+	a.ldx(bpfW, r3, r6, 4)
+	a.mov(r4, r2)
+	a.addImm(r4, xdpHeaderSize)
+	a.jmp(bpfJGT, r4, r3, "abort")
+	// copy the header in, in words as big as what is left of it
+	off := 0
+	for _, word := range []struct {
+		size  uint8
+		bytes int
+	}{{bpfDW, 8}, {bpfW, 4}, {bpfH, 2}, {bpfB, 1}} {
+		for ; off+word.bytes <= xdpHeaderSize; off += word.bytes {
+			a.ldx(word.size, r1, r8, int16(xdpValueHeader+off))
+			a.stx(word.size, r2, r1, int16(off))
+		}
+	}
+	// and fill in the lengths, and the IP header checksum
+	a.mov(r9, r7)
+	a.addImm(r9, ipOverhead)
+	a.mov(r1, r9)
+	a.toBE16(r1)
+	a.stx(bpfH, r2, r1, ipOffset+2)
+	a.ldx(bpfW, r1, r8, xdpValueChecksum)
+	a.add(r1, r9)
+	for i := 0; i < 2; i++ {
+		a.mov(r3, r1)
+		a.rshImm(r3, 16)
+		a.andImm(r1, 0xffff)
+		a.add(r1, r3)
+	}
+	a.xorImm(r1, 0xffff)
+	a.toBE16(r1)
+	a.stx(bpfH, r2, r1, ipOffset+10)
+	a.mov(r1, r7)
+	a.addImm(r1, udpOverhead)
+	a.toBE16(r1)
+	a.stx(bpfH, r2, r1, udpOffset+4)
+	a.mov(r1, r7)
+	a.toBE16(r1)
+	a.stx(bpfH, r2, r1, lenOffset)
+	// count it
+	a.stImm(bpfW, r10, -12, 0)
+	a.ldMapFD(r1, countersFD)
+	a.mov(r2, r10)
+	a.addImm(r2, -12)
+	a.call(lookupElem)
+	a.jmpImm(bpfJEQ, r0, 0, "redirect")
+	a.movImm(r1, 1)
+	a.atomicAdd(r0, r1, 0)
+	a.atomicAdd(r0, r7, 8)
+	a.label("redirect")
+	a.ldx(bpfW, r1, r8, xdpValueIfindex)
+	a.movImm(r2, 0)
+	a.call(redirect)
+	a.exit()
+	a.label("pass")
+	a.movImm(r0, xdpPass)
+	a.exit()
+	a.label("abort")
+	a.movImm(r0, xdpAborted)
+	a.exit()
+	return a.bytes()
+}
+
+// An assembler of just what the program needs of eBPF
+
+const (
+	r0 = iota
+	r1
+	r2
+	r3
+	r4
+	r5
+	r6
+	r7
+	r8
+	r9
+	r10
+)
+
+const (
+	bpfW  = 0x00
+	bpfH  = 0x08
+	bpfB  = 0x10
+	bpfDW = 0x18
+
+	bpfJEQ = 0x10
+	bpfJGT = 0x20
+	bpfJNE = 0x50
+)
+
+type bpfInsn struct {
+	code     uint8
+	dst, src uint8
+	off      int16
+	imm      int32
+	target   string // label jumped to
+}
+
+type bpfAsm struct {
+	insns  []bpfInsn
+	labels map[string]int
+}
+
+func newBPFAsm() *bpfAsm {
+	return &bpfAsm{labels: make(map[string]int)}
+}
+
+func (a *bpfAsm) emit(insn bpfInsn) { a.insns = append(a.insns, insn) }
+
+func (a *bpfAsm) alu64(op uint8, dst, src int, imm int32, x bool) {
+	code := 0x07 | op
+	if x {
+		code |= 0x08
+	}
+	a.emit(bpfInsn{code: code, dst: uint8(dst), src: uint8(src), imm: imm})
+}
+
+func (a *bpfAsm) mov(dst, src int)          { a.alu64(0xb0, dst, src, 0, true) }
+func (a *bpfAsm) movImm(dst int, imm int32) { a.alu64(0xb0, dst, 0, imm, false) }
+func (a *bpfAsm) add(dst, src int)          { a.alu64(0x00, dst, src, 0, true) }
+func (a *bpfAsm) addImm(dst int, imm int32) { a.alu64(0x00, dst, 0, imm, false) }
+func (a *bpfAsm) sub(dst, src int)          { a.alu64(0x10, dst, src, 0, true) }
+func (a *bpfAsm) andImm(dst int, imm int32) { a.alu64(0x50, dst, 0, imm, false) }
+func (a *bpfAsm) rshImm(dst int, imm int32) { a.alu64(0x70, dst, 0, imm, false) }
+func (a *bpfAsm) xorImm(dst int, imm int32) { a.alu64(0xa0, dst, 0, imm, false) }
+
+// Convert the bottom 16 bits of dst to network byte order
+func (a *bpfAsm) toBE16(dst int) { a.emit(bpfInsn{code: 0xdc, dst: uint8(dst), imm: 16}) }
+
+func (a *bpfAsm) ldx(size uint8, dst, src int, off int16) {
+	a.emit(bpfInsn{code: 0x61 | size, dst: uint8(dst), src: uint8(src), off: off})
+}
+
+func (a *bpfAsm) stx(size uint8, dst, src int, off int16) {
+	a.emit(bpfInsn{code: 0x63 | size, dst: uint8(dst), src: uint8(src), off: off})
+}
+
+func (a *bpfAsm) stImm(size uint8, dst int, off int16, imm int32) {
+	a.emit(bpfInsn{code: 0x62 | size, dst: uint8(dst), off: off, imm: imm})
+}
+
+func (a *bpfAsm) atomicAdd(dst, src int, off int16) {
+	a.emit(bpfInsn{code: 0xdb, dst: uint8(dst), src: uint8(src), off: off})
+}
+
+// Load the map's file descriptor, for the kernel to turn into the map
+func (a *bpfAsm) ldMapFD(dst int, fd int) {
+	a.emit(bpfInsn{code: 0x18, dst: uint8(dst), src: 1, imm: int32(fd)})
+	a.emit(bpfInsn{})
+}
+
+func (a *bpfAsm) jmp(op uint8, dst, src int, label string) {
+	a.emit(bpfInsn{code: 0x05 | op | 0x08, dst: uint8(dst), src: uint8(src), target: label})
+}
+
+func (a *bpfAsm) jmpImm(op uint8, dst int, imm int32, label string) {
+	a.emit(bpfInsn{code: 0x05 | op, dst: uint8(dst), imm: imm, target: label})
+}
+
+func (a *bpfAsm) call(helper int32) { a.emit(bpfInsn{code: 0x85, imm: helper}) }
+func (a *bpfAsm) exit()             { a.emit(bpfInsn{code: 0x95}) }
+
+func (a *bpfAsm) label(name string) { a.labels[name] = len(a.insns) }
+
+func (a *bpfAsm) bytes() []byte {
+	buf := make([]byte, 8*len(a.insns))
+	for i, insn := range a.insns {
+		if insn.target != "" {
+			insn.off = int16(a.labels[insn.target] - i - 1)
+		}
+		b := buf[8*i:]
+		b[0] = insn.code
+		b[1] = insn.src<<4 | insn.dst
+		binary.LittleEndian.PutUint16(b[2:], uint16(insn.off))
+		binary.LittleEndian.PutUint32(b[4:], uint32(insn.imm))
+	}
+	return buf
+}
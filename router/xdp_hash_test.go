@@ -0,0 +1,50 @@
+// +build peer_name_hash
+
+package router
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	weavenet "github.com/weaveworks/weave/net"
+	wt "github.com/weaveworks/weave/testing"
+)
+
+// Names longer than MACs make for a longer header, all of which the
+// program must copy
+func TestXDPHashNames(t *testing.T) {
+	ourName, _ := PeerNameFromUserInput("peer1")
+	dstName, _ := PeerNameFromUserInput("peer2")
+	mac, _ := net.ParseMAC("02:00:00:00:00:02")
+	srcMAC, _ := net.ParseMAC("0a:00:00:00:00:01")
+	dstMAC, _ := net.ParseMAC("0a:00:00:00:00:02")
+	src := &net.UDPAddr{IP: net.ParseIP("192.168.0.1"), Port: Port}
+	dst := &net.UDPAddr{IP: net.ParseIP("192.168.0.2"), Port: 7000}
+	value := xdpValue(7, 1000, srcMAC, dstMAC, src, dst, ourName.Bin(), dstName.Bin())
+	wt.AssertEqualInt(t, len(value), xdpValueSize, "value size")
+	names := value[xdpValueHeader+EthernetOverhead+20+8 : xdpValueHeader+xdpHeaderSize-2]
+	wt.AssertTrue(t, bytes.Equal(names, append(append(ourName.Bin(), ourName.Bin()...), dstName.Bin()...)), "names in header")
+
+	x, err := NewXDPOffload(nil)
+	if err != nil {
+		t.Skip("unable to load XDP program:", err)
+	}
+	wt.AssertNoErr(t, x.macs.Update(xdpKey(macint(mac)), value))
+	frame := make([]byte, 100)
+	copy(frame, mac)
+	ret, out, err := weavenet.RunBPFProgram(x.progFD, frame)
+	wt.AssertNoErr(t, err)
+	wt.AssertEqualInt(t, int(ret), 4, "XDP_REDIRECT")
+	wt.AssertEqualInt(t, len(out), xdpHeaderSize+len(frame), "length")
+	packet := out[EthernetOverhead+20+8:]
+	wt.AssertEquals(t, PeerNameFromBin(packet[:NameSize]), ourName)
+	var frames int
+	NewNonDecryptor().IterateFrames(packet[NameSize:], func(srcNameByte, dstNameByte []byte, f []byte) {
+		frames++
+		wt.AssertEquals(t, PeerNameFromBin(srcNameByte), ourName)
+		wt.AssertEquals(t, PeerNameFromBin(dstNameByte), dstName)
+		wt.AssertTrue(t, bytes.Equal(f, frame), "frame")
+	})
+	wt.AssertEqualInt(t, frames, 1, "frames")
+}
@@ -0,0 +1,70 @@
+package router
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+
+	weavenet "github.com/weaveworks/weave/net"
+	wt "github.com/weaveworks/weave/testing"
+)
+
+func TestXDPProgram(t *testing.T) {
+	x, err := NewXDPOffload(nil)
+	if err != nil {
+		t.Skip("unable to load XDP program:", err)
+	}
+	ourName, _ := PeerNameFromString("01:00:00:00:00:01")
+	dstName, _ := PeerNameFromString("01:00:00:00:00:02")
+	mac, _ := net.ParseMAC("02:00:00:00:00:02")
+	srcMAC, _ := net.ParseMAC("0a:00:00:00:00:01")
+	dstMAC, _ := net.ParseMAC("0a:00:00:00:00:02")
+	src := &net.UDPAddr{IP: net.ParseIP("192.168.0.1"), Port: Port}
+	dst := &net.UDPAddr{IP: net.ParseIP("192.168.0.2"), Port: 7000}
+	value := xdpValue(7, 1000, srcMAC, dstMAC, src, dst, ourName.Bin(), dstName.Bin())
+	wt.AssertNoErr(t, x.macs.Update(xdpKey(macint(mac)), value))
+
+	frame := make([]byte, 100)
+	copy(frame, mac)
+	frame[99] = 1
+	ret, out, err := weavenet.RunBPFProgram(x.progFD, frame)
+	wt.AssertNoErr(t, err)
+	wt.AssertEqualInt(t, int(ret), 4, "XDP_REDIRECT")
+	wt.AssertEqualInt(t, len(out), xdpHeaderSize+len(frame), "length")
+	wt.AssertTrue(t, bytes.Equal(out[:12], append(dstMAC, srcMAC...)), "MACs")
+	ip := out[EthernetOverhead:]
+	wt.AssertEqualInt(t, int(binary.BigEndian.Uint16(ip[2:])), 20+8+NameSize*3+2+len(frame), "IP total length")
+	var sum uint32
+	for i := 0; i < 20; i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(ip[i:]))
+	}
+	wt.AssertEqualInt(t, int(sum&0xffff+sum>>16), 0xffff, "IP header checksum")
+	wt.AssertTrue(t, net.IP(ip[12:16]).Equal(src.IP) && net.IP(ip[16:20]).Equal(dst.IP), "addresses")
+	udp := ip[20:]
+	wt.AssertEqualInt(t, int(binary.BigEndian.Uint16(udp[2:])), dst.Port, "UDP port")
+	wt.AssertEqualInt(t, int(binary.BigEndian.Uint16(udp[4:])), 8+NameSize*3+2+len(frame), "UDP length")
+	// which a peer reads as a packet from us of one frame
+	packet := udp[8:]
+	wt.AssertEquals(t, PeerNameFromBin(packet[:NameSize]), ourName)
+	var frames int
+	NewNonDecryptor().IterateFrames(packet[NameSize:], func(srcNameByte, dstNameByte []byte, f []byte) {
+		frames++
+		wt.AssertEquals(t, PeerNameFromBin(srcNameByte), ourName)
+		wt.AssertEquals(t, PeerNameFromBin(dstNameByte), dstName)
+		wt.AssertTrue(t, bytes.Equal(f, frame), "frame")
+	})
+	wt.AssertEqualInt(t, frames, 1, "frames")
+	wt.AssertEquals(t, x.Totals(), XDPCounters{Frames: 1, Bytes: uint64(len(frame))})
+
+	// too big for the connection's PMTU
+	ret, out, err = weavenet.RunBPFProgram(x.progFD, append(frame, make([]byte, 1000)...))
+	wt.AssertNoErr(t, err)
+	wt.AssertEqualInt(t, int(ret), 2, "XDP_PASS")
+	// to a MAC we don't know
+	frame[5] = 3
+	ret, out, err = weavenet.RunBPFProgram(x.progFD, frame)
+	wt.AssertNoErr(t, err)
+	wt.AssertEqualInt(t, int(ret), 2, "XDP_PASS")
+	wt.AssertTrue(t, bytes.Equal(out, frame), "frame untouched")
+}
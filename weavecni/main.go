@@ -0,0 +1,250 @@
+// weavecni is a CNI (Container Network Interface) network plugin,
+// for attaching containers run by Kubernetes, rkt and the like to the
+// weave network. The container runtime runs it with the network
+// configuration on stdin and the details of the container in CNI_*
+// environment variables; it gets an address from the weave router's
+// allocator, attaches the container to the weave bridge, and writes
+// the result to stdout.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	weavenet "github.com/weaveworks/weave/net"
+)
+
+const (
+	cniVersion     = "0.1.0"
+	defaultURL     = "http://127.0.0.1:6784"
+	defaultBridge  = "weave"
+	httpTimeout    = 30 * time.Second
+	errCodeGeneric = 100
+)
+
+var version = "(unreleased version)"
+
+// The network configuration, from stdin
+type netConf struct {
+	Name   string `json:"name"`
+	Type   string `json:"type"`
+	URL    string `json:"url"`    // of the weave router's HTTP API
+	Bridge string `json:"bridge"` // the weave bridge
+	MTU    int    `json:"mtu"`    // of the container's interface; the bridge's if 0
+	// to make the container's MAC from its address with; random if blank
+	MACPrefix string `json:"macPrefix"`
+	macPrefix net.HardwareAddr
+}
+
+type route struct {
+	Dst string `json:"dst"`
+}
+
+type ipConfig struct {
+	IP     string  `json:"ip"`
+	Routes []route `json:"routes,omitempty"`
+}
+
+type result struct {
+	CNIVersion string    `json:"cniVersion"`
+	IP4        *ipConfig `json:"ip4,omitempty"`
+}
+
+type cniError struct {
+	CNIVersion string `json:"cniVersion"`
+	Code       int    `json:"code"`
+	Msg        string `json:"msg"`
+}
+
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "--version" {
+		fmt.Printf("weave CNI plugin %s\n", version)
+		os.Exit(0)
+	}
+
+	conf, err := loadConf()
+	if err == nil {
+		switch command := os.Getenv("CNI_COMMAND"); command {
+		case "ADD":
+			var res *result
+			if res, err = cmdAdd(conf); err == nil {
+				err = json.NewEncoder(os.Stdout).Encode(res)
+			}
+		case "DEL":
+			err = cmdDel(conf)
+		default:
+			err = fmt.Errorf("Unknown CNI_COMMAND %q", command)
+		}
+	}
+	if err != nil {
+		json.NewEncoder(os.Stdout).Encode(&cniError{CNIVersion: cniVersion, Code: errCodeGeneric, Msg: err.Error()})
+		os.Exit(1)
+	}
+}
+
+func loadConf() (*netConf, error) {
+	conf := &netConf{URL: defaultURL, Bridge: defaultBridge}
+	if err := json.NewDecoder(os.Stdin).Decode(conf); err != nil {
+		return nil, fmt.Errorf("Unable to read network configuration: %s", err)
+	}
+	if conf.MACPrefix != "" {
+		prefix, err := weavenet.ParseMACPrefix(conf.MACPrefix)
+		if err != nil {
+			return nil, err
+		}
+		conf.macPrefix = prefix
+	}
+	return conf, nil
+}
+
+func getenv(name string) (string, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return "", fmt.Errorf("%s not set", name)
+	}
+	return value, nil
+}
+
+// The names of the two ends of the veth pair for a container, in the
+// style of those 'weave attach' makes
+func vethNames(containerID string) (local, guest string) {
+	suffix := containerID
+	if len(suffix) > 7 {
+		suffix = suffix[:7]
+	}
+	return "vethwepl" + suffix, "vethwepg" + suffix
+}
+
+// The ident to allocate the container's address to: the pod's UID,
+// if the runtime is Kubernetes and says which pod the container is
+// for, since that is what the router allocates to with -kube, so that
+// the pod has the one address; otherwise the container's ID.
+func allocIdent(containerID, cniArgs string) string {
+	for _, arg := range strings.Split(cniArgs, ";") {
+		if kv := strings.SplitN(arg, "=", 2); len(kv) == 2 && kv[0] == "K8S_POD_UID" && kv[1] != "" {
+			return kv[1]
+		}
+	}
+	return containerID
+}
+
+func cmdAdd(conf *netConf) (*result, error) {
+	containerID, err := getenv("CNI_CONTAINERID")
+	if err != nil {
+		return nil, err
+	}
+	ident := allocIdent(containerID, os.Getenv("CNI_ARGS"))
+	nsPath, err := getenv("CNI_NETNS")
+	if err != nil {
+		return nil, err
+	}
+	ifName, err := getenv("CNI_IFNAME")
+	if err != nil {
+		return nil, err
+	}
+
+	cidr, err := allocate(conf.URL, ident)
+	if err != nil {
+		return nil, err
+	}
+	ip, subnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, fmt.Errorf("Unexpected address %q from weave router", cidr)
+	}
+	addr := &net.IPNet{IP: ip, Mask: subnet.Mask}
+
+	local, guest := vethNames(containerID)
+	if _, err := weavenet.CreateAndAttachVeth(local, guest, conf.Bridge, conf.MTU); err != nil {
+		release(conf.URL, ident)
+		return nil, err
+	}
+	err = nil
+	if conf.macPrefix != nil {
+		if mac := weavenet.MACFromIP(conf.macPrefix, ip); mac != nil {
+			err = weavenet.SetLinkMAC(guest, mac)
+		}
+	}
+	if err == nil {
+		err = weavenet.ConfigureContainerInterface(guest, nsPath, ifName, addr)
+	}
+	if err != nil {
+		// deleting our end deletes the container's, wherever it is
+		weavenet.DeleteLink(local)
+		release(conf.URL, ident)
+		return nil, err
+	}
+	return &result{
+		CNIVersion: cniVersion,
+		IP4:        &ipConfig{IP: addr.String(), Routes: []route{{Dst: "224.0.0.0/4"}}},
+	}, nil
+}
+
+func cmdDel(conf *netConf) error {
+	containerID, err := getenv("CNI_CONTAINERID")
+	if err != nil {
+		return err
+	}
+	// The container's end goes with its network namespace, if that
+	// has gone already, and takes ours with it; if not, deleting ours
+	// deletes both.
+	local, _ := vethNames(containerID)
+	weavenet.DeleteLink(local)
+	err = release(conf.URL, allocIdent(containerID, os.Getenv("CNI_ARGS")))
+	if statusErr, ok := err.(*httpStatusError); ok && statusErr.code == http.StatusBadRequest {
+		// the router has no address for it: we must have deleted it already
+		return nil
+	}
+	return err
+}
+
+// Ask the weave router for an address for ident, which it gives us
+// in CIDR notation
+func allocate(routerURL, ident string) (string, error) {
+	body, err := httpCall(routerURL, "POST", "/ip/"+url.QueryEscape(ident))
+	if err != nil {
+		return "", fmt.Errorf("Unable to allocate address: %s", err)
+	}
+	return strings.TrimSpace(body), nil
+}
+
+func release(routerURL, ident string) error {
+	_, err := httpCall(routerURL, "DELETE", "/ip/"+url.QueryEscape(ident))
+	return err
+}
+
+type httpStatusError struct {
+	code int
+	msg  string
+}
+
+func (err *httpStatusError) Error() string {
+	return fmt.Sprintf("%d %s: %s", err.code, http.StatusText(err.code), err.msg)
+}
+
+func httpCall(routerURL, method, path string) (string, error) {
+	req, err := http.NewRequest(method, strings.TrimSuffix(routerURL, "/")+path, nil)
+	if err != nil {
+		return "", err
+	}
+	client := &http.Client{Timeout: httpTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode >= 300 {
+		return "", &httpStatusError{resp.StatusCode, strings.TrimSpace(string(body))}
+	}
+	return string(body), nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/weaveworks/weave/ipam/address"
+	"github.com/weaveworks/weave/kube"
+	wt "github.com/weaveworks/weave/testing"
+)
+
+const (
+	testNode    = "node1"
+	containerID = "8e5b4c6d7e8f9a0b1c2d3e4f5a6b7c8d9e0f1a2b3c4d5e6f7a8b9c0d1e2f3a4b"
+	podUID      = "11111111-1111-1111-1111-111111111111"
+)
+
+// The router's allocator, as far as the kube watcher and its HTTP API
+// are concerned
+type mockAllocator struct {
+	sync.Mutex
+	owned map[string]address.Address
+	next  address.Address
+}
+
+func (alloc *mockAllocator) Allocate(ident string, cancelChan <-chan bool) (address.Address, error) {
+	alloc.Lock()
+	defer alloc.Unlock()
+	addr, found := alloc.owned[ident]
+	if !found {
+		addr = alloc.next
+		alloc.next++
+		alloc.owned[ident] = addr
+	}
+	return addr, nil
+}
+
+func (alloc *mockAllocator) Free(ident string) error {
+	alloc.Lock()
+	defer alloc.Unlock()
+	if _, found := alloc.owned[ident]; !found {
+		return fmt.Errorf("no addresses for %s", ident)
+	}
+	delete(alloc.owned, ident)
+	return nil
+}
+
+func (alloc *mockAllocator) ContainerIdents() []string {
+	alloc.Lock()
+	defer alloc.Unlock()
+	idents := []string{}
+	for ident := range alloc.owned {
+		idents = append(idents, ident)
+	}
+	sort.Strings(idents)
+	return idents
+}
+
+func (alloc *mockAllocator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ident := strings.TrimPrefix(r.URL.Path, "/ip/")
+	switch r.Method {
+	case "POST":
+		addr, _ := alloc.Allocate(ident, nil)
+		fmt.Fprintf(w, "%s/12", addr)
+	case "DELETE":
+		if err := alloc.Free(ident); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+	}
+}
+
+func TestAllocIdent(t *testing.T) {
+	wt.AssertEqualString(t, allocIdent(containerID, ""), containerID, "ident with no CNI_ARGS")
+	wt.AssertEqualString(t, allocIdent(containerID, "IgnoreUnknown=1;K8S_POD_NAMESPACE=default;K8S_POD_NAME=web"), containerID, "ident with no pod UID")
+	wt.AssertEqualString(t, allocIdent(containerID, "IgnoreUnknown=1;K8S_POD_NAME=web;K8S_POD_UID="+podUID), podUID, "ident with pod UID")
+}
+
+// A pod the router allocates to with -kube gets the same address from
+// the plugin, rather than a second one
+func TestAllocateWithKube(t *testing.T) {
+	stop := make(chan struct{})
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("watch") == "" {
+			fmt.Fprintf(w, `{"metadata":{"resourceVersion":"1"},"items":[{"metadata":{"name":"web","namespace":"default","uid":"%s"},"spec":{"nodeName":"%s"},"status":{"phase":"Running"}}]}`, podUID, testNode)
+			return
+		}
+		<-stop
+	}))
+	defer api.Close()
+	defer close(stop)
+
+	alloc := &mockAllocator{owned: make(map[string]address.Address), next: address.Address(0x0a200001)}
+	router := httptest.NewServer(alloc)
+	defer router.Close()
+
+	watcher, err := kube.NewWatcher(api.URL, testNode, alloc)
+	wt.AssertNoErr(t, err)
+	watcher.Start()
+	for deadline := time.Now().Add(5 * time.Second); len(alloc.ContainerIdents()) == 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for the watcher to allocate to pod %s", podUID)
+		}
+	}
+	podAddr, _ := alloc.Allocate(podUID, nil)
+
+	cidr, err := allocate(router.URL, allocIdent(containerID, "K8S_POD_NAMESPACE=default;K8S_POD_NAME=web;K8S_POD_UID="+podUID))
+	wt.AssertNoErr(t, err)
+	wt.AssertEqualString(t, cidr, podAddr.String()+"/12", "address")
+	wt.AssertEquals(t, alloc.ContainerIdents(), []string{podUID})
+
+	wt.AssertNoErr(t, release(router.URL, allocIdent(containerID, "K8S_POD_UID="+podUID)))
+	wt.AssertEquals(t, alloc.ContainerIdents(), []string{})
+}
@@ -9,6 +9,7 @@ import (
 	weavenet "github.com/weaveworks/weave/net"
 	"net"
 	"os"
+	"strings"
 )
 
 var version = "(unreleased version)"
@@ -25,14 +26,20 @@ func main() {
 		timeout     int
 		udpbuf      int
 		cacheLen    int
+		ttl         int
+		upstream    string
+		autoNames   bool
+		label       string
 		watch       bool
+		single      bool
+		mdns        bool
 		debug       bool
 		err         error
 	)
 
 	flag.BoolVar(&justVersion, "version", false, "print version and exit")
 	flag.StringVar(&ifaceName, "iface", "", "name of interface to use for multicast")
-	flag.StringVar(&apiPath, "api", "unix:///var/run/docker.sock", "path to Docker API socket")
+	flag.StringVar(&apiPath, "api", "unix:///var/run/docker.sock", "container runtime endpoint: Docker API, as unix:// or tcp:// (TLS is configured from DOCKER_CERT_PATH and DOCKER_TLS_VERIFY), or podman API, as podman+unix:// or podman+tcp://, or CRI runtime, as cri+unix://")
 	flag.StringVar(&domain, "domain", weavedns.DefaultLocalDomain, "local domain (ie, 'weave.local.')")
 	flag.IntVar(&wait, "wait", 0, "number of seconds to wait for interface to be created and come up")
 	flag.IntVar(&dnsPort, "dnsport", weavedns.DefaultServerPort, "port to listen to DNS requests")
@@ -40,7 +47,13 @@ func main() {
 	flag.IntVar(&timeout, "timeout", weavedns.DefaultTimeout, "timeout for resolutions")
 	flag.IntVar(&udpbuf, "udpbuf", weavedns.DefaultUDPBuflen, "UDP buffer length")
 	flag.IntVar(&cacheLen, "cache", weavedns.DefaultCacheLen, "cache length")
+	flag.StringVar(&upstream, "upstream", "", "comma-separated list of DNS servers, as <ip>[:<port>], to forward queries for other domains to (default: from /etc/resolv.conf)")
+	flag.BoolVar(&autoNames, "auto", false, "register containers under their Docker names, hostnames and -label, when their addresses are registered")
+	flag.StringVar(&label, "label", weavedns.DefaultNameLabel, "label giving a container's name, for -auto")
+	flag.IntVar(&ttl, "ttl", weavedns.DefaultLocalTTL, "TTL, in seconds, of answers for names in the local domain")
 	flag.BoolVar(&watch, "watch", true, "watch the docker socket for container events")
+	flag.BoolVar(&single, "single-answer", false, "answer queries for names shared by several containers with just one, randomly chosen, address")
+	flag.BoolVar(&mdns, "mdns", false, "also answer multicast DNS queries from containers' mDNS clients (e.g. avahi) for names in the local domain, and <name>.local")
 	flag.BoolVar(&debug, "debug", false, "output debugging info to stderr")
 	flag.Parse()
 
@@ -52,15 +65,28 @@ func main() {
 	InitDefaultLogging(debug)
 	Info.Printf("WeaveDNS version %s\n", version) // first thing in log: the version
 
-	var zone = weavedns.NewZoneDb(domain)
+	if ttl < 0 {
+		Error.Fatal("-ttl must not be negative")
+	}
+
+	var zoneDb = weavedns.NewZoneDb(domain)
+	zoneDb.StartHealthChecks(weavedns.DefaultHealthCheckInterval)
 
 	if watch {
-		err := updater.Start(apiPath, zone)
-		if err != nil {
+		if _, err := updater.Start(apiPath, zoneDb); err != nil {
 			Error.Fatal("Unable to start watcher", err)
 		}
 	}
 
+	var zone weavedns.Zone = zoneDb
+	if autoNames {
+		client, err := updater.NewClient(apiPath)
+		if err != nil {
+			Error.Fatal("Unable to connect to Docker API", err)
+		}
+		zone = weavedns.NewAutoRegistrar(zoneDb, client, label)
+	}
+
 	var iface *net.Interface
 	if ifaceName != "" {
 		var err error
@@ -74,11 +100,21 @@ func main() {
 	}
 
 	srvConfig := weavedns.DNSServerConfig{
-		Port:        dnsPort,
-		CacheLen:    cacheLen,
-		LocalDomain: domain,
-		Timeout:     timeout,
-		UDPBufLen:   udpbuf,
+		Port:          dnsPort,
+		CacheLen:      cacheLen,
+		LocalDomain:   domain,
+		LocalTTL:      ttl,
+		LocalTTLSet:   true,
+		Timeout:       timeout,
+		UDPBufLen:     udpbuf,
+		SingleAnswer:  single,
+		MDNSResponder: mdns,
+	}
+
+	if upstream != "" {
+		if srvConfig.UpstreamCfg, err = weavedns.UpstreamConfig(strings.Split(upstream, ",")); err != nil {
+			Error.Fatal(err)
+		}
 	}
 
 	srv, err := weavedns.NewDNSServer(srvConfig, zone, iface)
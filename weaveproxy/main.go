@@ -5,6 +5,7 @@ import (
 	"net/http"
 
 	"code.google.com/p/getopt"
+	"github.com/weaveworks/weave/attach"
 	. "github.com/weaveworks/weave/common"
 	"github.com/weaveworks/weave/proxy"
 )
@@ -15,7 +16,7 @@ var (
 )
 
 func main() {
-	var target, listen string
+	var target, listen, policyName, policyLabel string
 	var withDNS, withIPAM, debug bool
 
 	getopt.BoolVarLong(&debug, "debug", 'd', "log debugging information")
@@ -23,6 +24,8 @@ func main() {
 	getopt.StringVar(&listen, 'L', fmt.Sprintf("address on which to listen (default %s)", defaultListen))
 	getopt.BoolVarLong(&withDNS, "with-dns", 'w', "instruct created containers to use weaveDNS as their nameserver")
 	getopt.BoolVarLong(&withIPAM, "with-ipam", 'i', "automatically allocate addresses for containers without a WEAVE_CIDR")
+	getopt.StringVarLong(&policyName, "attach-policy", 0, "attach containers without a WEAVE_CIDR by their label: \"labelled\" ones only, or \"all\" unless labelled off")
+	getopt.StringVarLong(&policyLabel, "attach-label", 0, fmt.Sprintf("label for --attach-policy (default %s)", attach.DefaultPolicyLabel))
 	getopt.Parse()
 
 	if target == "" {
@@ -33,11 +36,24 @@ func main() {
 		listen = defaultListen
 	}
 
+	if policyLabel == "" {
+		policyLabel = attach.DefaultPolicyLabel
+	}
+
 	if debug {
 		InitDefaultLogging(true)
 	}
 
-	p, err := proxy.NewProxy(target, withDNS, withIPAM)
+	var policy *attach.Policy
+	if policyName != "" {
+		var err error
+		if policy, err = attach.ParsePolicy(policyName, policyLabel); err != nil {
+			Error.Fatal(err)
+		}
+		Info.Printf("Attaching %s", policy)
+	}
+
+	p, err := proxy.NewProxy(target, withDNS, withIPAM, policy)
 	if err != nil {
 		Error.Fatalf("Could not start proxy: %s", err)
 	}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/weaveworks/weave/bgp"
+	"github.com/weaveworks/weave/ipam"
+	weavenet "github.com/weaveworks/weave/net"
+)
+
+// What -bgp-advertise may ask for
+const (
+	bgpAdvertiseOwned = "owned"
+	bgpAdvertiseRange = "range"
+)
+
+// How often we tell the BGP speaker of the prefixes to advertise,
+// which change as peers come and go, and ranges change hands
+const bgpInterval = 10 * time.Second
+
+// bgpAdvertiser keeps the BGP speaker told of the prefixes to
+// advertise
+type bgpAdvertiser struct {
+	speaker  *bgp.Speaker
+	prefixes func() []*net.IPNet
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// Start advertising, from as, to the routers in neighbours, who are in
+// peerAS, or as if 0, the ranges this peer owns, or the whole range,
+// connecting to them from the host's network namespace with procfs,
+// returning the advertiser, to stop on exit
+func startBGP(as, peerAS uint64, neighbours, advertise, procfs string, alloc *ipam.Allocator) (*bgpAdvertiser, error) {
+	if as == 0 || as > 0xffffffff || peerAS > 0xffffffff {
+		return nil, fmt.Errorf("Invalid BGP AS number: expected 1 to %d", uint32(0xffffffff))
+	}
+	if peerAS == 0 {
+		peerAS = as
+	}
+	if advertise != bgpAdvertiseOwned && advertise != bgpAdvertiseRange {
+		return nil, fmt.Errorf("Invalid -bgp-advertise %q: expected %q or %q", advertise, bgpAdvertiseOwned, bgpAdvertiseRange)
+	}
+	ns, err := bgp.ParseNeighbours(strings.Split(neighbours, ","), uint32(peerAS))
+	if err != nil {
+		return nil, err
+	}
+	nsPath := ""
+	if procfs != "" {
+		nsPath = weavenet.NetNSPath(procfs, 1)
+	}
+	speaker := bgp.NewSpeaker(uint32(as), ns, nsPath)
+	prefixes := func() []*net.IPNet {
+		if advertise == bgpAdvertiseRange {
+			if subnet, _ := alloc.Range(); subnet != nil {
+				return []*net.IPNet{subnet}
+			}
+			return nil
+		}
+		var cidrs []*net.IPNet
+		for _, r := range alloc.OwnedRanges() {
+			cidrs = append(cidrs, r.CIDRs()...)
+		}
+		return cidrs
+	}
+	advertiser := &bgpAdvertiser{
+		speaker:  speaker,
+		prefixes: prefixes,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	speaker.Advertise(prefixes())
+	speaker.Start()
+	log.Println("Advertising", advertise, "prefixes over BGP, from AS", as, "to", ns)
+	go advertiser.run()
+	return advertiser, nil
+}
+
+func (advertiser *bgpAdvertiser) run() {
+	defer close(advertiser.done)
+	ticker := time.NewTicker(bgpInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			advertiser.speaker.Advertise(advertiser.prefixes())
+		case <-advertiser.stop:
+			return
+		}
+	}
+}
+
+// Stop stops advertising, closing the sessions, so that the
+// neighbours withdraw the routes
+func (advertiser *bgpAdvertiser) Stop() {
+	close(advertiser.stop)
+	<-advertiser.done
+	advertiser.speaker.Stop()
+}
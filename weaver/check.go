@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"github.com/weaveworks/weave/common/updater"
+	weavedns "github.com/weaveworks/weave/nameserver"
+	weavenet "github.com/weaveworks/weave/net"
+	weave "github.com/weaveworks/weave/router"
+	"net"
+	"strings"
+)
+
+// What -check-config looks at
+type checkedConfig struct {
+	ifaceName   string
+	routerName  string
+	labels      string
+	iprangeCIDR string
+	peerCount   int
+	kube        bool
+	bridgeName  string
+	procfs      string
+	apiPath     string
+	needRuntime bool // whether anything enabled watches containers
+	dnsUpstream string
+	peers       []string
+}
+
+// Check what the router would need to start, printing a line for
+// each thing checked, and return how many problems there were
+func checkConfig(c checkedConfig) int {
+	problems := 0
+	result := func(what string, err error, format string, args ...interface{}) {
+		if err != nil {
+			problems++
+			fmt.Printf("FAIL  %-20s %s\n", what, err)
+		} else {
+			fmt.Printf("ok    %-20s %s\n", what, fmt.Sprintf(format, args...))
+		}
+	}
+
+	var iface *net.Interface
+	if c.ifaceName == "" {
+		result("interface", nil, "none")
+	} else if found, err := weavenet.EnsureInterface(c.ifaceName, 0); err != nil {
+		result("interface", err, "")
+	} else {
+		iface = found
+		result("interface", nil, "%s, MAC %s, MTU %d", iface.Name, iface.HardwareAddr, iface.MTU)
+	}
+
+	routerName := c.routerName
+	if routerName == "" && iface != nil {
+		routerName = iface.HardwareAddr.String()
+	}
+	if routerName == "" {
+		result("name", fmt.Errorf("Either an interface must be specified with -iface or a name with -name"), "")
+	} else {
+		name, err := weave.PeerNameFromUserInput(routerName)
+		result("name", err, "%s", name)
+	}
+
+	if labels, err := weave.ParseLabels(c.labels); len(labels) == 0 {
+		result("labels", err, "none")
+	} else {
+		result("labels", err, "%s", weave.FormatLabels(labels))
+	}
+
+	switch {
+	case pickingIPRange(c.iprangeCIDR, c.peerCount, c.kube):
+		cidr, err := findFreeIPRange(c.procfs, c.ifaceName, c.bridgeName)
+		result("iprange", err, "%s, picked", cidr)
+	case c.iprangeCIDR != "":
+		result("iprange", checkIPRange(c.iprangeCIDR, c.procfs, c.ifaceName, c.bridgeName), "%s", c.iprangeCIDR)
+	default:
+		result("iprange", nil, "none")
+	}
+
+	if c.needRuntime {
+		var description string
+		runtime, err := updater.NewRuntime(c.apiPath)
+		if err == nil {
+			_, description, err = runtime.Connect()
+		}
+		result("container runtime", err, "%s", description)
+	} else {
+		result("container runtime", nil, "not used")
+	}
+
+	if c.dnsUpstream != "" {
+		_, err := weavedns.UpstreamConfig(strings.Split(c.dnsUpstream, ","))
+		result("dns-upstream", err, "%s", c.dnsUpstream)
+	}
+
+	for _, peer := range c.peers {
+		host, port, err := net.SplitHostPort(peer)
+		if err != nil {
+			host, port = peer, fmt.Sprint(weave.Port)
+		}
+		addr, err := net.ResolveTCPAddr("tcp4", net.JoinHostPort(host, port))
+		result("peer "+peer, err, "%s", addr)
+	}
+
+	if problems == 0 {
+		fmt.Println("Configuration OK")
+	} else {
+		fmt.Printf("%d problem(s) found\n", problems)
+	}
+	return problems
+}
+
+// An -iprange must be a CIDR that doesn't overlap the host's routes,
+// or addresses, other than those of our own interface and bridge. With
+// procfs, the host's are those of the network namespace of its
+// process 1, as for the bridge, rather than of ours.
+func checkIPRange(cidr, procfs, ifaceName, bridgeName string) error {
+	_, ipnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return err
+	}
+	if procfs != "" {
+		return weavenet.WithNetNSPid(procfs, 1, func() error {
+			return checkOverlaps(ipnet, ifaceName, bridgeName)
+		})
+	}
+	return checkOverlaps(ipnet, ifaceName, bridgeName)
+}
+
+func checkOverlaps(ipnet *net.IPNet, ifaceName, bridgeName string) error {
+	routes, err := weavenet.OverlappingRoutes(ipnet, ifaceName, bridgeName)
+	if err != nil {
+		return err
+	}
+	if len(routes) > 0 {
+		described := make([]string, len(routes))
+		for i, route := range routes {
+			described[i] = route.String()
+		}
+		return fmt.Errorf("%s overlaps routes %s", ipnet, strings.Join(described, ", "))
+	}
+	addrs, err := weavenet.OverlappingAddresses(ipnet, ifaceName, bridgeName)
+	if err != nil {
+		return err
+	}
+	if len(addrs) > 0 {
+		described := make([]string, len(addrs))
+		for i, addr := range addrs {
+			described[i] = addr.String()
+		}
+		return fmt.Errorf("%s overlaps addresses %s", ipnet, strings.Join(described, ", "))
+	}
+	return nil
+}
+
+// -iprange auto picks the first of these the host doesn't use: the
+// /12s of 10.0.0.0/8, from 10.32.0.0/12, then 172.16.0.0/12 and
+// 192.168.0.0/16, so that peers on hosts alike pick the same one
+const autoIPRange = "auto"
+
+// Whether to pick the IP range: when asked to, or when IP address
+// allocation is wanted, as it is with -initpeercount or -kube, but no
+// -iprange given
+func pickingIPRange(iprangeCIDR string, peerCount int, kube bool) bool {
+	return iprangeCIDR == autoIPRange || (iprangeCIDR == "" && (peerCount > 0 || kube))
+}
+
+func autoIPRanges() []string {
+	var cidrs []string
+	for i := 0; i < 16; i++ {
+		cidrs = append(cidrs, fmt.Sprintf("10.%d.0.0/12", (32+16*i)%256))
+	}
+	return append(cidrs, "172.16.0.0/12", "192.168.0.0/16")
+}
+
+func findFreeIPRange(procfs, ifaceName, bridgeName string) (string, error) {
+	for _, cidr := range autoIPRanges() {
+		if checkIPRange(cidr, procfs, ifaceName, bridgeName) == nil {
+			return cidr, nil
+		}
+	}
+	return "", fmt.Errorf("Unable to find a private IP range the host doesn't use; give one with -iprange")
+}
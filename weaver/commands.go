@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/weaveworks/weave/api"
+	weave "github.com/weaveworks/weave/router"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// The subcommands other than launch, which are clients of the HTTP
+// interface of a router that is already running
+type command struct {
+	args string // as in the usage message
+	run  func(c *client, args []string) error
+}
+
+var commands = map[string]command{
+	"status":  {"[peers | connections | targets | ipam | dns | gossip]", status},
+	"connect": {"<peer>", connect},
+	"forget":  {"<peer>", forget},
+	"report":  {"> <file>.tar.gz", report},
+}
+
+var errUsage = errors.New("usage")
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "Usage: weaver [launch] [<flag> ...] [<peer> ...]")
+	for _, name := range []string{"status", "connect", "forget", "report"} {
+		fmt.Fprintf(os.Stderr, "       weaver %-7s [-httpaddr <address>] %s\n", name, commands[name].args)
+	}
+	fmt.Fprintln(os.Stderr, "\nFlags of launch, which runs the router:")
+	flag.PrintDefaults()
+}
+
+// Run the command name, and exit
+func runCommand(name string, args []string) {
+	cmd := commands[name]
+	fs := flag.NewFlagSet("weaver "+name, flag.ExitOnError)
+	defaultAddr := os.Getenv("WEAVE_HTTPADDR")
+	if defaultAddr == "" {
+		defaultAddr = fmt.Sprintf("127.0.0.1:%d", weave.HTTPPort)
+	}
+	httpAddr := fs.String("httpaddr", defaultAddr, "address of the router's HTTP interface (absolute path indicates unix domain socket)")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: weaver %s [-httpaddr <address>] %s\n", name, cmd.args)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	switch err := cmd.run(newClient(*httpAddr), fs.Args()); err {
+	case nil:
+	case errUsage:
+		fs.Usage()
+		os.Exit(2)
+	default:
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+func status(c *client, args []string) error {
+	switch {
+	case len(args) == 0:
+		return c.call("GET", "/status", nil, os.Stdout)
+	case len(args) > 1:
+		return errUsage
+	}
+	switch args[0] {
+	case "peers", "connections", "targets", "ipam", "dns", "gossip":
+		return c.call("GET", "/status/"+args[0], nil, os.Stdout)
+	}
+	return errUsage
+}
+
+func connect(c *client, args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	return c.call("POST", "/api/v1/connections", api.ConnectRequest{Peer: args[0]}, os.Stdout)
+}
+
+func forget(c *client, args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	return c.call("DELETE", "/api/v1/connections/"+url.QueryEscape(args[0]), nil, os.Stdout)
+}
+
+func report(c *client, args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+	return c.call("GET", "/report", nil, os.Stdout)
+}
+
+type client struct {
+	baseURL string
+	http    *http.Client
+}
+
+func newClient(addr string) *client {
+	if strings.HasPrefix(addr, "/") {
+		return &client{baseURL: "http://weave", http: &http.Client{Transport: &http.Transport{
+			Dial: func(network, _ string) (net.Conn, error) {
+				return net.Dial("unix", addr)
+			},
+		}}}
+	}
+	return &client{baseURL: "http://" + addr, http: &http.Client{}}
+}
+
+// Make a request, with body encoded as JSON unless nil, and copy the
+// reply to out, or return it as an error if it has an error status
+func (c *client) call(method, path string, body interface{}, out io.Writer) error {
+	var reader io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(encoded)
+	}
+	req, err := http.NewRequest(method, c.baseURL+path, reader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("Unable to reach the router: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		reply, _ := ioutil.ReadAll(resp.Body)
+		var errorReply api.ErrorReply
+		if json.Unmarshal(reply, &errorReply) == nil && errorReply.Message != "" {
+			return errors.New(errorReply.Message)
+		}
+		return fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, strings.TrimSpace(string(reply)))
+	}
+	_, err = io.Copy(out, resp.Body)
+	return err
+}
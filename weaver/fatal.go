@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+// Exit statuses, by what kept the router from starting, so that
+// supervisors and installers can tell what went wrong
+const (
+	exitOther     = 1
+	exitConfig    = 2 // invalid flags or configuration, as for flag parsing errors
+	exitInterface = 3 // -iface missing or down, or unable to capture on it
+	exitPort      = 4 // unable to listen on a port or socket, usually because it is in use
+	exitRuntime   = 5 // the container runtime is unreachable
+	exitRunning   = 6 // another router holds -pidfile
+)
+
+var exitCategories = map[int]string{
+	exitOther:     "other",
+	exitConfig:    "config",
+	exitInterface: "interface",
+	exitPort:      "port",
+	exitRuntime:   "runtime",
+	exitRunning:   "running",
+}
+
+// The last thing we write on stderr before exiting with a status
+// other than 0
+type fatalRecord struct {
+	Time     string `json:"time"`
+	Level    string `json:"level"`
+	Category string `json:"category"`
+	Status   int    `json:"status"`
+	Message  string `json:"msg"`
+}
+
+// Log the message, as log.Fatal, then write it as a JSON record on
+// stderr, and exit with status
+func fatal(status int, v ...interface{}) {
+	exit(status, fmt.Sprint(v...))
+}
+
+func fatalf(status int, format string, v ...interface{}) {
+	exit(status, fmt.Sprintf(format, v...))
+}
+
+func exit(status int, msg string) {
+	log.Print(msg)
+	json.NewEncoder(os.Stderr).Encode(fatalRecord{
+		Time:     time.Now().UTC().Format(time.RFC3339Nano),
+		Level:    "fatal",
+		Category: exitCategories[status],
+		Status:   status,
+		Message:  msg,
+	})
+	os.Exit(status)
+}
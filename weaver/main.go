@@ -7,23 +7,61 @@ import (
 	"fmt"
 	"github.com/davecheney/profile"
 	"github.com/gorilla/mux"
+	"github.com/weaveworks/weave/api"
+	"github.com/weaveworks/weave/attach"
 	. "github.com/weaveworks/weave/common"
+	"github.com/weaveworks/weave/common/events"
+	"github.com/weaveworks/weave/common/flagfile"
+	"github.com/weaveworks/weave/common/systemd"
+	"github.com/weaveworks/weave/common/tracing"
 	"github.com/weaveworks/weave/common/updater"
+	"github.com/weaveworks/weave/discovery"
 	"github.com/weaveworks/weave/ipam"
+	"github.com/weaveworks/weave/kube"
+	weavedns "github.com/weaveworks/weave/nameserver"
 	weavenet "github.com/weaveworks/weave/net"
+	"github.com/weaveworks/weave/networks"
+	"github.com/weaveworks/weave/plugin"
 	weave "github.com/weaveworks/weave/router"
+	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
+	"net/http/pprof"
 	"os"
 	"runtime"
 	"strings"
+	"time"
 )
 
 var version = "(unreleased version)"
 
+// How often we check that published ports still lead where they should
+const publishInterval = 30 * time.Second
+
+// Where Docker mounts a secret called weave-password, in which we look
+// for the password if not given one
+const defaultPasswordFile = "/run/secrets/weave-password"
+
+// How often we register ourselves with -discovery, and look for peers
+// there and with -peer-discovery
+const discoveryInterval = 30 * time.Second
+
 func main() {
 
+	if weave.IsDatapathChild() {
+		os.Exit(weave.RunDatapathChild())
+	}
+
+	args := os.Args[1:]
+	if len(args) > 0 {
+		if _, found := commands[args[0]]; found {
+			runCommand(args[0], args[1:])
+		} else if args[0] == "launch" {
+			args = args[1:]
+		}
+	}
+
 	log.SetPrefix(weave.Protocol + " ")
 	log.SetFlags(log.Ldate | log.Ltime | log.Lmicroseconds)
 
@@ -38,87 +76,357 @@ func main() {
 	var (
 		config      weave.RouterConfig
 		justVersion bool
+		justCheck   bool
+		noIPAM      bool
+		noDNS       bool
+		noCapture   bool
+		configFile  string
 		ifaceName   string
 		routerName  string
 		nickName    string
+		labels      string
 		password    string
+		passwdFile  string
 		wait        int
 		debug       bool
 		pktdebug    bool
+		logFormat   string
+		logPath     string
+		logMaxMB    int
+		logMaxAge   time.Duration
+		logKeep     int
+		pidPath     string
 		prof        string
+		pprofOn     bool
+		traceTo     string
 		peers       []string
 		bufSzMB     int
+		datapath    string
+		workers     int
+		cryptoProcs int
+		gossipRates string
 		httpAddr    string
+		grpcAddr    string
+		metricsTo   string
+		metricsPfx  string
+		metricsIntv time.Duration
+		flowsTo     string
+		flowsIntv   time.Duration
+		httpRate    float64
+		httpBurst   int
+		httpTimeout time.Duration
 		iprangeCIDR string
+		overlapOK   bool
 		peerCount   int
 		apiPath     string
+		dnsEnabled  bool
+		dnsPort     int
+		dnsSingle   bool
+		dnsDomain   string
+		dnsTTL      int
+		dnsUpstream string
+		dnsAuto     bool
+		dnsLabel    string
+		dnsMDNS     bool
+		pluginPath  string
+		pluginNetNS string
+		bridgeName  string
+		kubeEnabled bool
+		kubeAPI     string
+		kubeNode    string
+		procfs      string
+		attachTo    string
+		makeBridge  bool
+		bridgeMTU   int
+		noSysctls   bool
+		hostRouting string
+		bgpAS       uint64
+		bgpPeerAS   uint64
+		bgpPeers    string
+		bgpAdvert   string
+		sysctls     string
+		firewall    string
+		policyName  string
+		policyLabel string
+		probeWait   time.Duration
+		macPrefix   string
+		discoverIn  string
+		discoverAs  string
+		peerFinder  string
+		token       string
+		discoverLAN bool
+		annotations string
+		dropPolicy  string
 	)
 
 	flag.BoolVar(&justVersion, "version", false, "print version and exit")
+	flag.BoolVar(&justCheck, "check-config", false, "check the flags, the interface, -iprange against the host's routes, the container runtime and the peers' addresses, report on them and exit, with status 1 if there are problems")
+	flag.StringVar(&configFile, "config", "", "file to read flags and peers from, in YAML, or TOML if named *.toml; flags given on the command line override it")
 	flag.IntVar(&config.Port, "port", weave.Port, "router port")
 	flag.StringVar(&ifaceName, "iface", "", "name of interface to capture/inject from (disabled if blank)")
 	flag.StringVar(&routerName, "name", "", "name of router (defaults to MAC of interface)")
 	flag.StringVar(&nickName, "nickname", "", "nickname of peer (defaults to hostname)")
+	flag.StringVar(&labels, "labels", "", "labels to tell other peers about, as comma-separated <key>=<value> pairs, e.g. dc=eu-west,rack=12")
 	flag.StringVar(&password, "password", "", "network password")
+	flag.StringVar(&passwdFile, "password-file", "", "file to read the network password from, instead of -password (default: "+defaultPasswordFile+", if it exists and -password is not given)")
 	flag.IntVar(&wait, "wait", 0, "number of seconds to wait for interface to be created and come up (0 = don't wait)")
 	flag.BoolVar(&debug, "debug", false, "enable debug logging")
 	flag.BoolVar(&pktdebug, "pktdebug", false, "enable per-packet debug logging")
+	flag.StringVar(&logFormat, "log-format", TextLogFormat, "format of log lines: \""+TextLogFormat+"\" or \""+JSONLogFormat+"\", for one JSON record per line")
+	flag.StringVar(&logPath, "log-file", "", "file to write logs to, rather than stdout and stderr, which is reopened on SIGUSR1 (disabled if blank)")
+	flag.IntVar(&logMaxMB, "log-max-size", 100, "size in MB at which to rotate -log-file (0 for no limit)")
+	flag.DurationVar(&logMaxAge, "log-max-age", 0, "how long to write to -log-file before rotating it (0 for no limit)")
+	flag.IntVar(&logKeep, "log-max-files", 5, "number of rotated log files to keep, as <log-file>.1 and so on")
+	flag.StringVar(&pidPath, "pidfile", "/var/lib/weave/weaver.pid", "file to hold our process ID, locked while we run")
 	flag.StringVar(&prof, "profile", "", "enable profiling and write profiles to given path")
+	flag.BoolVar(&pprofOn, "pprof", false, "serve profiles on the HTTP interface, under /debug/pprof/, as for 'go tool pprof'")
+	flag.StringVar(&traceTo, "trace-endpoint", "", "OpenTelemetry collector to export traces of connections, gossip and IP allocation consensus to, over OTLP/HTTP, e.g. http://collector:4318 (disabled if blank)")
 	flag.IntVar(&config.ConnLimit, "connlimit", 30, "connection limit (0 for unlimited)")
+	flag.IntVar(&config.Neighbours, "neighbours", 0, "in a partial mesh, for very large clusters, the number of peers to connect to, chosen so that every peer is reachable over a few hops, rather than all of them (0 for a full mesh)")
+	flag.BoolVar(&config.Duplicates, "detect-duplicates", false, "gossip the addresses local containers use, and their MACs, as seen in ARP, with other peers, and report any address in use with two MACs at once (all peers must be of a version that knows of this)")
+	flag.StringVar(&annotations, "annotations-file", "", "file to keep the annotations of connections, set through the HTTP API, in, so that they survive restarts, e.g. /var/lib/weave/annotations.json (kept only in memory if blank)")
+	flag.IntVar(&config.ConnHistory, "conn-history", weave.DefaultConnHistory, "number of connection events to keep for each peer, for /connections/history")
 	flag.IntVar(&bufSzMB, "bufsz", 8, "capture buffer size in MB")
+	flag.StringVar(&datapath, "datapath", weave.DatapathPcap, "how to exchange frames with -iface: \""+weave.DatapathPcap+"\", capturing on it and injecting into it, \""+weave.DatapathTap+"\", plugging a TAP device, "+weave.DefaultTap+", into it, which must be a bridge, and reading and writing frames through that, or \""+weave.DatapathAFPacket+"\", reading and writing them through packet sockets, one for each of -capture-workers")
+	flag.BoolVar(&config.DatapathChild, "datapath-process", false, "exchange frames with -iface through a child process, so that a crash there, e.g. in libpcap, doesn't take down gossip, IPAM and DNS, and is recovered from by starting another")
+	flag.BoolVar(&config.XDP, "xdp", false, "forward frames to other peers in the kernel, with XDP")
+	flag.IntVar(&workers, "capture-workers", 0, "goroutines reading and forwarding frames from -iface in parallel, for -datapath "+weave.DatapathAFPacket+", each given the frames of a share of the flows by the kernel (0 for one for each CPU)")
+	flag.IntVar(&cryptoProcs, "crypto-workers", 0, "goroutines encrypting and decrypting packets (0 for GOMAXPROCS, 1 for none)")
+	flag.StringVar(&dropPolicy, "drop-policy", weave.DropPolicyBlock, "what to do with frames when a connection's queue is full: \""+weave.DropPolicyBlock+"\", \""+weave.DropPolicyNewest+"\" or \""+weave.DropPolicyOldest+"\"")
+	flag.DurationVar(&config.StallTimeout, "watchdog", weave.DefaultWatchdogTimeout, "how long a capture worker, forwarder or actor, e.g. the one gossiping, may be stuck on one frame or action before the router logs its goroutines, and fails /healthz (0 for no watchdog)")
+	flag.BoolVar(&config.StallRestart, "watchdog-restart", false, "restart parts of the router that the watchdog finds stuck, where that can be done: capture, by capturing afresh, and forwarders and connections' receivers, by dropping the connection")
+	flag.StringVar(&gossipRates, "gossip-rates", "", "bytes per second we may send on gossip channels, as comma-separated <channel>=<rate> pairs, e.g. DNS=65536; gossip held back meanwhile is merged with what follows (no limits if blank)")
 	flag.StringVar(&httpAddr, "httpaddr", fmt.Sprintf(":%d", weave.HTTPPort), "address to bind HTTP interface to (disabled if blank, absolute path indicates unix domain socket)")
-	flag.StringVar(&iprangeCIDR, "iprange", "", "IP address range to allocate within, in CIDR notation")
+	flag.StringVar(&grpcAddr, "grpcaddr", "", "address to bind the gRPC control API to, e.g. :6786 (disabled if blank, absolute path indicates unix domain socket)")
+	flag.StringVar(&metricsTo, "metrics-push", "", "where to push metrics of the router and allocator to: statsd://<host>:<port> or graphite://<host>:<port> (disabled if blank)")
+	flag.StringVar(&metricsPfx, "metrics-prefix", "weave", "prefix of the names of metrics pushed, for -metrics-push")
+	flag.DurationVar(&metricsIntv, "metrics-interval", 10*time.Second, "how often to push metrics, for -metrics-push")
+	flag.StringVar(&flowsTo, "flow-export", "", "IPFIX collector to export records of flows to and from local containers to: ipfix://<host>:<port> (disabled if blank)")
+	flag.DurationVar(&flowsIntv, "flow-export-interval", 10*time.Second, "how often to export flow records, for -flow-export")
+	flag.Float64Var(&httpRate, "http-rate", 50, "requests per second each client may make of the HTTP interface, on average (0 for unlimited)")
+	flag.IntVar(&httpBurst, "http-burst", 100, "requests each client may make of the HTTP interface in a burst, for -http-rate")
+	flag.DurationVar(&httpTimeout, "http-timeout", 30*time.Second, "time to wait for a request to the HTTP interface to be read, and for most GET requests to be answered (0 for no limit)")
+	flag.StringVar(&iprangeCIDR, "iprange", "", "IP address range to allocate within, in CIDR notation, or \""+autoIPRange+"\" to pick one")
+	flag.BoolVar(&overlapOK, "iprange-overlap-warn", false, "only warn, rather than refusing to start, when -iprange overlaps the host's routes or addresses, other than those of -iface and -bridge")
 	flag.IntVar(&peerCount, "initpeercount", 0, "number of peers in network (for IP address allocation)")
-	flag.StringVar(&apiPath, "api", "unix:///var/run/docker.sock", "Path to Docker API socket")
-	flag.Parse()
-	peers = flag.Args()
+	flag.StringVar(&apiPath, "api", "unix:///var/run/docker.sock", "container runtime endpoint: Docker API, as unix:// or tcp:// (TLS is configured from DOCKER_CERT_PATH and DOCKER_TLS_VERIFY), or podman API, as podman+unix:// or podman+tcp://, or CRI runtime, as cri+unix://")
+	flag.StringVar(&pluginPath, "plugin", "", "path of socket to serve Docker's network plugin API on, e.g. "+plugin.DefaultSocket+" (disabled if blank)")
+	flag.StringVar(&pluginNetNS, "plugin-netns", "", "path of the network namespace the bridge is in, for -plugin (default: ours)")
+	flag.StringVar(&bridgeName, "plugin-bridge", plugin.DefaultBridge, "bridge to attach containers to, for -plugin")
+	flag.StringVar(&procfs, "procfs", "", "where the host's /proc is mounted, for finding the network namespaces of containers and the host, e.g. /hostproc (attach API disabled if blank)")
+	flag.StringVar(&attachTo, "bridge", attach.DefaultBridge, "bridge to attach containers to, for the attach API")
+	flag.BoolVar(&makeBridge, "create-bridge", false, "create -bridge, unless it exists, with -bridge-mtu, bring it up and check it, before starting, e.g. to capture on it with -iface when running outside the weave container")
+	flag.IntVar(&bridgeMTU, "bridge-mtu", 65535, "MTU of the bridge, for -create-bridge")
+	flag.BoolVar(&noSysctls, "no-sysctls", false, "leave the sysctls the router needs, for forwarding and, with -procfs or -create-bridge, on -bridge, as they are, rather than setting them in the host's network namespace, and putting them back on exit")
+	flag.StringVar(&hostRouting, "host-routes", "", "route from the host to containers through -bridge, in the host's network namespace with -procfs, withdrawing the routes on exit: \""+hostRoutesRange+"\", for a route to the IP range, or \""+hostRoutesSubnets+"\", for one to the subnet of each virtual network as well (disabled if blank)")
+	flag.Uint64Var(&bgpAS, "bgp-as", 0, "AS number to advertise the IP range, or the ranges of it this peer owns, from, over BGP, to -bgp-neighbours, so that hosts off the weave network can route to containers (disabled if 0)")
+	flag.Uint64Var(&bgpPeerAS, "bgp-peer-as", 0, "AS number of -bgp-neighbours (default: -bgp-as)")
+	flag.StringVar(&bgpPeers, "bgp-neighbours", "", "comma-separated routers, as <host>[:<port>], to advertise to, for -bgp-as, connecting from the host's network namespace with -procfs, so that the next hop is the host's address")
+	flag.StringVar(&bgpAdvert, "bgp-advertise", bgpAdvertiseOwned, "what to advertise, for -bgp-as: \""+bgpAdvertiseOwned+"\", the ranges of the IP range this peer owns, so that traffic for containers comes straight to their host, or \""+bgpAdvertiseRange+"\", the whole IP range")
+	flag.StringVar(&sysctls, "sysctls", "", "comma-separated sysctls, as name=value, to set as well, in the host's network namespace with -procfs, putting them back on exit")
+	flag.StringVar(&firewall, "firewall", "auto", "how to manage the firewall rules for exposing the host and publishing ports, with -procfs: \"iptables\", \"nftables\", or \"auto\" to use nftables where iptables is missing or translates to nftables, or the host has nftables tables of its own")
+	flag.StringVar(&policyName, "attach-policy", "", "attach containers as they start according to their label: \"labelled\" ones only, or \"all\" unless labelled off (requires -procfs; disabled if blank)")
+	flag.StringVar(&policyLabel, "attach-label", attach.DefaultPolicyLabel, "label for -attach-policy, giving \"on\", \"off\" or the container's addresses")
+	flag.DurationVar(&probeWait, "probe-wait", 300*time.Millisecond, "how long to probe with ARP for an address before giving it to a container or the host, refusing if anything on the network has it already (0 not to probe)")
+	flag.StringVar(&macPrefix, "mac-prefix", "", "give the interfaces of containers the router attaches, with -procfs, MACs made from their first IP address, after this prefix: an OUI, e.g. 02:77:65, followed by the low three bytes of the address, or two bytes, e.g. 0a:58, followed by all four (random MACs if blank)")
+	flag.BoolVar(&kubeEnabled, "kube", false, "allocate addresses to the Kubernetes pods on this node, by pod UID, watching the Kubernetes API for them (picking the IP range if -iprange is not given)")
+	flag.StringVar(&kubeAPI, "kube-api", "", "Kubernetes API server URL, for -kube (default: that of the cluster we are running in)")
+	flag.StringVar(&kubeNode, "kube-node", "", "name of this node in Kubernetes, for -kube (default: hostname)")
+	flag.StringVar(&discoverIn, "discovery", "", "store to register in and discover peers from: \"docker\" for Docker's cluster store, consul://<host>:<port>[/<path>], etcd://<host>:<port>[,...][/<path>], or token://<token>[@<host>[:<port>]] for a rendezvous service (disabled if blank)")
+	flag.StringVar(&peerFinder, "peer-discovery", "", "where to look for peers to connect to, forgetting those no longer found there, every 30 seconds: dns:<name> for the targets of name's SRV records, e.g. dns:_weave._tcp.example.com, ec2:tag:<key>=<value> or ec2:asg:<group> for running EC2 instances, or gce:label:<key>=<value> or gce:group:[<zone>/]<name> for running GCE ones (disabled if blank)")
+	flag.StringVar(&token, "token", "", "token shared by the peers to find each other with, through a rendezvous service, as with -discovery token://<token>")
+	flag.BoolVar(&discoverLAN, "discover-lan", false, "announce ourselves to peers on the local network, and find theirs, with multicast DNS, as instances of the DNS-SD service "+discovery.LANService)
+	flag.StringVar(&discoverAs, "discovery-addr", "", "address, as <host>[:<port>], at which peers can reach us, for -discovery (default: the host of Docker's cluster advertise address, with -port)")
+	flag.BoolVar(&dnsEnabled, "dns", false, "answer DNS queries for containers on the weave network")
+	flag.IntVar(&dnsPort, "dns-port", weavedns.DefaultServerPort, "port to listen to DNS requests on")
+	flag.StringVar(&dnsDomain, "dns-domain", weavedns.DefaultLocalDomain, "local domain to answer DNS queries for")
+	flag.IntVar(&dnsTTL, "dns-ttl", weavedns.DefaultLocalTTL, "TTL, in seconds, of DNS answers for names in the local domain")
+	flag.StringVar(&dnsUpstream, "dns-upstream", "", "comma-separated list of DNS servers, as <ip>[:<port>], to forward queries for other domains to (default: from /etc/resolv.conf)")
+	flag.BoolVar(&dnsAuto, "dns-auto", false, "register containers in DNS under their Docker names, hostnames and -dns-label, when their addresses are registered")
+	flag.StringVar(&dnsLabel, "dns-label", weavedns.DefaultNameLabel, "label giving a container's name in DNS, for -dns-auto")
+	flag.BoolVar(&dnsMDNS, "dns-mdns", false, "also answer multicast DNS queries from containers' mDNS clients (e.g. avahi) for names in DNS, and <name>.local")
+	flag.BoolVar(&noIPAM, "no-ipam", false, "don't allocate IP addresses, even if -iprange is given, e.g. in a -config file")
+	flag.BoolVar(&noDNS, "no-dns", false, "don't answer DNS queries, even if -dns is given, e.g. in a -config file")
+	flag.BoolVar(&noCapture, "no-capture", false, "don't capture traffic from, or inject it into, -iface, which only names the router, so that it only relays traffic between peers and runs IPAM and DNS")
+	flag.BoolVar(&dnsSingle, "dns-single-answer", false, "answer DNS queries for names shared by several containers with just one, randomly chosen, address")
+	flag.Usage = usage
+	flag.CommandLine.Parse(args)
+	var err error
+	peers, err = flagfile.ApplyEnv(flag.CommandLine, "WEAVE_", flag.Args(), "version")
+	if err != nil {
+		fatal(exitConfig, err)
+	}
+	if configFile != "" {
+		values, err := flagfile.Load(configFile)
+		if err != nil {
+			fatal(exitConfig, err)
+		}
+		if peers, err = flagfile.Apply(flag.CommandLine, values, peers); err != nil {
+			fatalf(exitConfig, "%s: %s", configFile, err)
+		}
+	}
 
 	InitDefaultLogging(debug)
+	if logPath != "" {
+		f, err := OpenLogFile(logPath, int64(logMaxMB)*1024*1024, logMaxAge, logKeep)
+		if err != nil {
+			fatal(exitOther, err)
+		}
+		LogToFile(f)
+	}
+	if err := SetLogFormat(logFormat, "router"); err != nil {
+		fatal(exitConfig, err)
+	}
 	if justVersion {
 		fmt.Printf("weave router %s\n", version)
 		os.Exit(0)
 	}
+	if noIPAM {
+		if kubeEnabled {
+			fatal(exitConfig, "-kube and -no-ipam flags both specified")
+		}
+		iprangeCIDR, peerCount = "", 0
+	}
+	if noDNS {
+		dnsEnabled = false
+	}
+	if dnsTTL < 0 {
+		fatal(exitConfig, "-dns-ttl must not be negative")
+	}
+	if token != "" {
+		if discoverIn != "" {
+			fatal(exitConfig, "-token and -discovery flags both specified")
+		}
+		discoverIn = "token://" + token
+	}
+	if justCheck {
+		if checkConfig(checkedConfig{
+			ifaceName:   ifaceName,
+			routerName:  routerName,
+			labels:      labels,
+			iprangeCIDR: iprangeCIDR,
+			peerCount:   peerCount,
+			kube:        kubeEnabled,
+			bridgeName:  attachTo,
+			procfs:      procfs,
+			apiPath:     apiPath,
+			needRuntime: iprangeCIDR != "" || pickingIPRange(iprangeCIDR, peerCount, kubeEnabled) || dnsEnabled || procfs != "" || discoverIn == "docker" || (discoverIn != "" && discoverAs == ""),
+			dnsUpstream: dnsUpstream,
+			peers:       peers,
+		}) > 0 {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	// a second router on the same host would fight this one over the
+	// bridge, the interface and its identity in IP address allocation
+	if pidPath != "" {
+		pidFile, err := WritePidFile(pidPath)
+		if err != nil {
+			fatal(exitRunning, err)
+		}
+		defer pidFile.Remove()
+	}
 
 	log.Println("Command line options:", options())
 	log.Println("Command line peers:", peers)
 
-	var err error
+	firewallNS := ""
+	if procfs != "" {
+		firewallNS = weavenet.NetNSPath(procfs, 1)
+	}
+	if err := weavenet.SetFirewall(firewall, firewallNS); err != nil {
+		fatal(exitConfig, err)
+	}
+	if procfs != "" {
+		log.Println("Managing firewall rules with", weavenet.CurrentFirewall())
+	}
+
+	if makeBridge {
+		if _, err := weavenet.EnsureBridge(attachTo, bridgeMTU); err != nil {
+			fatal(exitInterface, err)
+		}
+	}
+
+	if !noSysctls || sysctls != "" {
+		var settings []weavenet.Sysctl
+		if !noSysctls {
+			bridge := ""
+			if procfs != "" || makeBridge {
+				bridge = attachTo
+			}
+			settings = requiredSysctls(bridge)
+		}
+		if sysctls != "" {
+			extra, err := weavenet.ParseSysctls(strings.Split(sysctls, ","))
+			if err != nil {
+				fatal(exitConfig, err)
+			}
+			settings = append(settings, extra...)
+		}
+		managed := setSysctls(procfs, settings)
+		defer func() {
+			if err := managed.Restore(); err != nil {
+				log.Println(err)
+			}
+		}()
+	}
 
+	var iface *net.Interface
 	if ifaceName != "" {
-		config.Iface, err = weavenet.EnsureInterface(ifaceName, wait)
+		iface, err = weavenet.EnsureInterface(ifaceName, wait)
 		if err != nil {
-			log.Fatal(err)
+			fatal(exitInterface, err)
 		}
 	}
 
 	if routerName == "" {
-		if config.Iface == nil {
-			log.Fatal("Either an interface must be specified with -iface or a name with -name")
+		if iface == nil {
+			fatal(exitConfig, "Either an interface must be specified with -iface or a name with -name")
 		}
-		routerName = config.Iface.HardwareAddr.String()
+		routerName = iface.HardwareAddr.String()
 	}
 	name, err := weave.PeerNameFromUserInput(routerName)
 	if err != nil {
-		log.Fatal(err)
+		fatal(exitConfig, err)
 	}
 
 	if nickName == "" {
 		nickName, err = os.Hostname()
 		if err != nil {
-			log.Fatal(err)
+			fatal(exitOther, err)
 		}
 	}
 
-	if password == "" {
-		password = os.Getenv("WEAVE_PASSWORD")
+	if config.Labels, err = weave.ParseLabels(labels); err != nil {
+		fatal(exitConfig, err)
 	}
 
+	if passwdFile == "" && password == "" {
+		if _, err := os.Stat(defaultPasswordFile); err == nil {
+			passwdFile = defaultPasswordFile
+		}
+	}
+	if passwdFile != "" {
+		if password != "" {
+			fatal(exitConfig, "-password and -password-file flags both specified")
+		}
+		if password, err = readPassword(passwdFile); err != nil {
+			fatal(exitConfig, err)
+		}
+	}
+	// so that the programs we run, such as the datapath process, don't see it
+	os.Unsetenv("WEAVE_PASSWORD")
 	if password == "" {
 		log.Println("Communication between peers is unencrypted.")
 	} else {
 		config.Password = []byte(password)
 		log.Println("Communication between peers is encrypted.")
 	}
+	if config.XDP && (config.Password != nil || datapath == weave.DatapathTap) {
+		fatal(exitConfig, "-xdp can't forward frames with a password, nor with -datapath "+weave.DatapathTap)
+	}
 
 	if prof != "" {
 		p := *profile.CPUProfile
@@ -127,29 +435,259 @@ func main() {
 		defer profile.Start(&p).Stop()
 	}
 
+	if noCapture {
+		log.Println("Not capturing or injecting traffic (-no-capture)")
+	} else {
+		config.Iface = iface
+	}
+	if config.Iface != nil {
+		// otherwise frames we capture may lack valid checksums
+		if err := weavenet.DisableTxOffload(config.Iface.Name); err != nil {
+			log.Println("Unable to disable transmit checksum offload:", err)
+		}
+	}
 	config.BufSz = bufSzMB * 1024 * 1024
+	switch datapath {
+	case weave.DatapathPcap, weave.DatapathTap, weave.DatapathAFPacket:
+		config.Datapath = datapath
+	default:
+		fatalf(exitConfig, "Unknown datapath %q; expected \"%s\", \"%s\" or \"%s\"", datapath, weave.DatapathPcap, weave.DatapathTap, weave.DatapathAFPacket)
+	}
+	switch dropPolicy {
+	case weave.DropPolicyBlock, weave.DropPolicyNewest, weave.DropPolicyOldest:
+		config.DropPolicy = dropPolicy
+	default:
+		fatalf(exitConfig, "Unknown drop policy %q; expected \"%s\", \"%s\" or \"%s\"", dropPolicy, weave.DropPolicyBlock, weave.DropPolicyNewest, weave.DropPolicyOldest)
+	}
+	if workers < 0 {
+		fatal(exitConfig, "-capture-workers must not be negative")
+	} else if workers == 0 {
+		workers = runtime.NumCPU()
+	}
+	config.Workers = workers
+	if cryptoProcs < 0 {
+		fatal(exitConfig, "-crypto-workers must not be negative")
+	} else if cryptoProcs == 0 {
+		cryptoProcs = runtime.GOMAXPROCS(0)
+	}
+	config.CryptoProcs = cryptoProcs
+	if config.StallTimeout < 0 {
+		fatal(exitConfig, "-watchdog must not be negative")
+	}
+	if config.GossipRates, err = weave.ParseGossipRates(gossipRates); err != nil {
+		fatal(exitConfig, err)
+	}
 	config.LogFrame = logFrameFunc(pktdebug)
+	config.WeaveVersion = version
+
+	if traceTo != "" {
+		if err := tracing.Init(traceTo, "service.name", "weave", "service.version", version, "weave.peer", name.String(), "weave.nickname", nickName); err != nil {
+			fatal(exitConfig, err)
+		}
+	}
 
 	router := weave.NewRouter(config, name, nickName)
 	log.Println("Our name is", router.Ourself)
+	if annotations != "" {
+		if router.Annotations, err = weave.NewAnnotations(annotations); err != nil {
+			fatal(exitConfig, err)
+		}
+	}
 
 	var allocator *ipam.Allocator
+	pickIPRange := pickingIPRange(iprangeCIDR, peerCount, kubeEnabled)
+	if pickIPRange {
+		if iprangeCIDR, err = findFreeIPRange(procfs, ifaceName, attachTo); err != nil {
+			fatal(exitConfig, err)
+		}
+		log.Println("Picked IP range", iprangeCIDR)
+	} else if iprangeCIDR != "" {
+		// containers given addresses that the host reaches some other
+		// way would be cut off from those, or from each other
+		if err := checkIPRange(iprangeCIDR, procfs, ifaceName, attachTo); err != nil {
+			if !overlapOK {
+				fatal(exitConfig, err)
+			}
+			log.Println("Warning:", err)
+		}
+	}
 	if iprangeCIDR != "" {
-		allocator = createAllocator(router, apiPath, iprangeCIDR, determineQuorum(peerCount, peers))
-	} else if peerCount > 0 {
-		log.Fatal("-initpeercount flag specified without -iprange")
+		if discoverIn != "" && peerCount == 0 {
+			// we can't guess the quorum from the peers we are given
+			fatal(exitConfig, "-discovery and -iprange flags specified without -initpeercount")
+		}
+		if peerFinder != "" && peerCount == 0 {
+			fatal(exitConfig, "-peer-discovery and -iprange flags specified without -initpeercount")
+		}
+		if discoverLAN && peerCount == 0 {
+			fatal(exitConfig, "-discover-lan and -iprange flags specified without -initpeercount")
+		}
+		allocator = createAllocator(router, apiPath, iprangeCIDR, determineQuorum(peerCount, peers), pickIPRange, func(subnet *net.IPNet) error {
+			// in the host's network namespace, with -procfs, as above
+			return checkIPRange(subnet.String(), procfs, ifaceName, attachTo)
+		})
 	} else {
 		router.NewGossip("IPallocation", &ipam.DummyAllocator{})
 	}
 
-	router.Start()
+	// Told of containers starting and dying, in this order
+	var observers []updater.ContainerObserver
+
+	var (
+		dnsServer *weavedns.DNSServer
+		zoneDb    *weavedns.ZoneDb
+	)
+	if dnsEnabled {
+		dnsConfig := weavedns.DNSServerConfig{
+			Port:          dnsPort,
+			LocalDomain:   dnsDomain,
+			LocalTTL:      dnsTTL,
+			LocalTTLSet:   true,
+			SingleAnswer:  dnsSingle,
+			MDNSResponder: dnsMDNS,
+		}
+		if dnsUpstream != "" {
+			upstream, err := weavedns.UpstreamConfig(strings.Split(dnsUpstream, ","))
+			if err != nil {
+				fatal(exitConfig, err)
+			}
+			dnsConfig.UpstreamCfg = upstream
+		}
+		dnsRange := iprangeCIDR
+		if pickIPRange {
+			// which may yet give way to another peer's
+			dnsRange = ""
+		}
+		dnsServer, zoneDb = createDNSServer(router, apiPath, dnsConfig, dnsAuto, dnsLabel, iface, dnsRange)
+		observers = append(observers, zoneDb)
+	} else {
+		// so that peers running DNS can reach each other through us
+		router.NewGossip("DNS", weave.NewRelayGossiper())
+	}
+
+	netRegistry := networks.NewRegistry()
+	netRegistry.SetInterfaces(router.Ourself.Name, router.NewGossip("networks", netRegistry))
+	netRegistry.Start()
+
+	if hostRouting != "" {
+		subnets, err := parseHostRoutes(hostRouting)
+		if err != nil {
+			fatal(exitConfig, err)
+		}
+		if allocator == nil && !subnets {
+			fatal(exitConfig, "-host-routes "+hostRoutesRange+" specified without -iprange")
+		}
+		routes := startHostRoutes(procfs, attachTo, subnets, allocator, netRegistry)
+		defer routes.Stop()
+	}
+
+	if bgpAS != 0 {
+		if allocator == nil {
+			fatal(exitConfig, "-bgp-as flag specified without -iprange")
+		}
+		advertiser, err := startBGP(bgpAS, bgpPeerAS, bgpPeers, bgpAdvert, procfs, allocator)
+		if err != nil {
+			fatal(exitConfig, err)
+		}
+		defer advertiser.Stop()
+	}
+
+	if err := router.Start(); err != nil {
+		if _, listening := err.(weave.ListenError); listening {
+			fatal(exitPort, err)
+		}
+		fatal(exitInterface, err)
+	}
+	if config.Iface != nil {
+		monitorInterface(router, config.Iface.Name)
+	}
 	initiateConnections(router, peers)
+	if discoverIn != "" {
+		startDiscovery(router, apiPath, discoverIn, discoverAs, procfs, config.Port)
+	}
+	if peerFinder != "" {
+		startPeerFinder(router, peerFinder)
+	}
+	if discoverLAN {
+		lan := discovery.NewLAN(router.Ourself.Peer.Name.String(), config.Port)
+		if err := lan.Start(); err != nil {
+			fatal(exitRuntime, err)
+		}
+		log.Println("Looking for peers on", lan)
+		discovery.NewFinder(lan, router.ConnectionMaker).Start(discoveryInterval)
+	}
+
+	if kubeEnabled {
+		watchPods(kubeAPI, kubeNode, allocator)
+	}
+
+	if pluginPath != "" {
+		go servePlugin(pluginPath, bridgeName, pluginNetNS, allocator, probeWait)
+	}
+
+	var attacher *attach.Attacher
+	if procfs != "" {
+		var attachObserver updater.ContainerObserver
+		attacher, attachObserver = createAttacher(apiPath, procfs, attachTo, allocator, policyName, policyLabel, probeWait, macPrefix)
+		// a dead container's interface goes before its names
+		observers = append([]updater.ContainerObserver{attachObserver}, observers...)
+		if dnsServer != nil {
+			attacher.SetNames(dnsServer.Zone)
+		}
+	} else if policyName != "" {
+		fatal(exitConfig, "-attach-policy flag specified without -procfs")
+	}
+	if len(observers) > 0 {
+		// since we are watching containers anyway, those removed
+		// leave their networks
+		observers = append(observers, netRegistry)
+	}
+	if allocator != nil {
+		// and its addresses go last, only once nothing refers to them
+		observers = append(observers, allocator)
+	}
+	var upd *updater.Updater
+	if len(observers) > 0 {
+		if upd, err = updater.Start(apiPath, observers...); err != nil {
+			fatal(exitRuntime, "Unable to start watcher: ", err)
+		}
+		netRegistry.SetRunning(upd.Running)
+	}
+
+	sources := &api.Sources{Version: version, Router: router, Allocator: allocator, Options: options(), Updater: upd, Peers: peers, Networks: netRegistry}
+	if dnsServer != nil {
+		sources.Zone, sources.ZoneDb = dnsServer.Zone, zoneDb
+	}
 
 	// The weave script always waits for a status call to succeed,
 	// so there is no point in doing "weave launch -httpaddr ''".
 	// This is here to support stand-alone use of weaver.
-	if httpAddr != "" {
-		go handleHTTP(router, httpAddr, allocator)
+	if listener := httpListener(httpAddr); listener != nil {
+		server := &http.Server{ReadTimeout: httpTimeout}
+		go handleHTTP(router, listener, server, allocator, dnsServer, attacher, sources, pprofOn, httpRate, httpBurst)
+	}
+
+	if metricsTo != "" {
+		if err := api.PushMetrics(metricsTo, metricsPfx, metricsIntv, sources); err != nil {
+			fatal(exitConfig, err)
+		}
+	}
+
+	if flowsTo != "" {
+		if err := api.ExportFlows(flowsTo, flowsIntv, sources); err != nil {
+			fatal(exitConfig, err)
+		}
+	}
+
+	if grpcAddr != "" {
+		listener := listen(grpcAddr, "gRPC")
+		go func() {
+			fatal(exitOther, "gRPC server failed: ", api.ServeGRPC(listener, sources))
+		}()
+	}
+
+	if systemd.Notifying() {
+		go notifyReady(allocator)
 	}
 
 	SignalHandlerLoop(router)
@@ -167,6 +705,20 @@ func options() map[string]string {
 	return options
 }
 
+// The password in path, ignoring a trailing line break, as editors
+// and secret stores are apt to add one
+func readPassword(path string) (string, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("Unable to read password: %s", err)
+	}
+	password := strings.TrimRight(string(contents), "\r\n")
+	if password == "" {
+		return "", fmt.Errorf("Password file %s is empty", path)
+	}
+	return password, nil
+}
+
 func logFrameFunc(debug bool) weave.LogFrameFunc {
 	if !debug {
 		return func(prefix string, frame []byte, eth *layers.Ethernet) {}
@@ -184,23 +736,220 @@ func logFrameFunc(debug bool) weave.LogFrameFunc {
 func initiateConnections(router *weave.Router, peers []string) {
 	for _, peer := range peers {
 		if err := router.ConnectionMaker.InitiateConnection(peer); err != nil {
-			log.Fatal(err)
+			fatal(exitConfig, err)
+		}
+	}
+}
+
+// The sysctls the router needs: forwarding, for exposed hosts to
+// reach containers, iptables seeing bridged traffic, for the rules
+// we add, and proxy ARP on the bridge, unless that is blank
+func requiredSysctls(bridge string) []weavenet.Sysctl {
+	required := []weavenet.Sysctl{
+		{Name: "net.ipv4.ip_forward", Value: "1"},
+		{Name: "net.bridge.bridge-nf-call-iptables", Value: "1"},
+	}
+	if bridge != "" {
+		required = append(required, weavenet.Sysctl{Name: "net/ipv4/conf/" + bridge + "/proxy_arp", Value: "1"})
+	}
+	return required
+}
+
+// Set the sysctls, in the host's network namespace if we can find it,
+// returning what remembers their values before, to put them back
+func setSysctls(procfs string, settings []weavenet.Sysctl) *weavenet.Sysctls {
+	nsPath := ""
+	if procfs != "" {
+		nsPath = weavenet.NetNSPath(procfs, 1)
+	}
+	managed := weavenet.NewSysctls(nsPath)
+	for _, s := range settings {
+		if changed, err := managed.Set(s); err != nil {
+			log.Println(err)
+		} else if changed {
+			log.Println("Set sysctl", s)
+		}
+	}
+	return managed
+}
+
+// Follow changes to the interface we capture on, so that the router
+// captures on it again when it comes back after going down or being
+// deleted
+func monitorInterface(router *weave.Router, ifaceName string) {
+	events, err := weavenet.MonitorInterface(ifaceName, nil)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	go func() {
+		for event := range events {
+			log.Println("Interface", event)
+			if event.Kind != weavenet.InterfaceUp {
+				continue
+			}
+			if err := weavenet.DisableTxOffload(ifaceName); err != nil {
+				log.Println("Unable to disable transmit checksum offload:", err)
+			}
+			if err := router.InterfaceUp(event.Iface); err != nil {
+				log.Println("Unable to sniff traffic on", ifaceName+":", err)
+			}
+		}
+	}()
+}
+
+func startDiscovery(router *weave.Router, apiPath, storeURL, addr, procfs string, port int) {
+	if storeURL == "docker" || addr == "" {
+		client, err := updater.NewClient(apiPath)
+		if err != nil {
+			fatal(exitRuntime, err)
 		}
+		info, err := client.Info()
+		if err != nil {
+			fatal(exitRuntime, "Unable to get Docker's configuration: ", err)
+		}
+		if storeURL == "docker" {
+			if storeURL = info.ClusterStore; storeURL == "" {
+				fatal(exitConfig, "-discovery docker specified, but Docker has no cluster store")
+			}
+		}
+		if addr == "" {
+			advertise := info.ClusterAdvertise
+			if advertise == "" {
+				fatal(exitConfig, "-discovery specified without -discovery-addr, and Docker has no cluster advertise address")
+			}
+			// an interface named there is one of the host's
+			var host string
+			lookup := func() (err error) {
+				host, err = discovery.AdvertiseHost(advertise)
+				return
+			}
+			if procfs != "" {
+				err = weavenet.WithNetNSPid(procfs, 1, lookup)
+			} else {
+				err = lookup()
+			}
+			if err != nil {
+				fatal(exitConfig, err)
+			}
+			addr = net.JoinHostPort(host, fmt.Sprint(port))
+		}
+	}
+	store, err := discovery.NewStore(storeURL)
+	if err != nil {
+		fatal(exitConfig, err)
+	}
+	log.Println("Discovering peers in", storeURL, "as", addr)
+	discovery.NewDiscoverer(store, router.Ourself.Peer.Name.String(), addr, router.ConnectionMaker).Start(discoveryInterval)
+}
+
+func startPeerFinder(router *weave.Router, desc string) {
+	source, err := discovery.NewSource(desc)
+	if err != nil {
+		fatal(exitConfig, err)
 	}
+	log.Println("Looking for peers in", source)
+	discovery.NewFinder(source, router.ConnectionMaker).Start(discoveryInterval)
 }
 
-func createAllocator(router *weave.Router, apiPath string, iprangeCIDR string, quorum uint) *ipam.Allocator {
+func createAllocator(router *weave.Router, apiPath string, iprangeCIDR string, quorum uint, picked bool, checkRange func(*net.IPNet) error) *ipam.Allocator {
 	allocator, err := ipam.NewAllocator(router.Ourself.Peer.Name, router.Ourself.Peer.UID, router.Ourself.Peer.NickName, iprangeCIDR, quorum)
 	if err != nil {
-		log.Fatal(err)
+		fatal(exitConfig, err)
+	}
+	if picked {
+		allocator.AutoRange()
 	}
+	allocator.CheckRange(checkRange)
+	allocator.Watch(router.Watchdog)
 	allocator.SetInterfaces(router.NewGossip("IPallocation", allocator))
 	allocator.Start()
-	err = updater.Start(apiPath, allocator)
+	return allocator
+}
+
+func createDNSServer(router *weave.Router, apiPath string, config weavedns.DNSServerConfig, autoNames bool, label string, iface *net.Interface, iprangeCIDR string) (*weavedns.DNSServer, *weavedns.ZoneDb) {
+	zoneDb := weavedns.NewZoneDb(config.LocalDomain)
+	zoneDb.SetInterfaces(router.Ourself.Name, router.NewGossip("DNS", zoneDb))
+	zoneDb.Start()
+	zoneDb.StartHealthChecks(weavedns.DefaultHealthCheckInterval)
+	// Records registered by peers that have left the network can't be
+	// deleted by them, so we drop them ourselves.
+	router.OnPeerGC(func(peer *weave.Peer) { zoneDb.DeletePeer(peer.Name) })
+	var zone weavedns.Zone = zoneDb
+	if autoNames {
+		client, err := updater.NewClient(apiPath)
+		if err != nil {
+			fatal(exitRuntime, err)
+		}
+		zone = weavedns.NewAutoRegistrar(zoneDb, client, label)
+	}
+	if iprangeCIDR != "" {
+		// we are the only ones who can name addresses we allocate
+		_, subnet, err := net.ParseCIDR(iprangeCIDR)
+		if err != nil {
+			fatal(exitConfig, err)
+		}
+		config.Subnets = []*net.IPNet{subnet}
+	}
+	dnsServer, err := weavedns.NewDNSServer(config, zone, iface)
 	if err != nil {
-		log.Fatal("Unable to start watcher", err)
+		fatal(exitPort, "Unable to create DNS server: ", err)
+	}
+	go func() {
+		if err := dnsServer.Start(); err != nil {
+			fatal(exitPort, "Unable to start DNS server: ", err)
+		}
+	}()
+	return dnsServer, zoneDb
+}
+
+func createAttacher(apiPath, procfs, bridge string, allocator *ipam.Allocator, policyName, policyLabel string, probeWait time.Duration, macPrefix string) (*attach.Attacher, updater.ContainerObserver) {
+	client, err := updater.NewClient(apiPath)
+	if err != nil {
+		fatal(exitRuntime, err)
+	}
+	attacher := attach.NewAttacher(client, procfs, bridge, allocator)
+	attacher.SetProbeWait(probeWait)
+	if macPrefix != "" {
+		prefix, err := weavenet.ParseMACPrefix(macPrefix)
+		if err != nil {
+			fatal(exitConfig, err)
+		}
+		attacher.SetMACPrefix(prefix)
+	}
+	var observer updater.ContainerObserver = attacher
+	if policyName != "" {
+		policy, err := attach.ParsePolicy(policyName, policyLabel)
+		if err != nil {
+			fatal(exitConfig, err)
+		}
+		log.Println("Attaching", policy)
+		observer = attach.NewAutoAttacher(attacher, policy)
+	}
+	attacher.StartPublishing(publishInterval)
+	return attacher, observer
+}
+
+func watchPods(apiURL, node string, allocator *ipam.Allocator) {
+	if node == "" {
+		var err error
+		if node, err = os.Hostname(); err != nil {
+			fatal(exitOther, err)
+		}
+	}
+	watcher, err := kube.NewWatcher(apiURL, node, allocator)
+	if err != nil {
+		fatal(exitOther, "Unable to watch Kubernetes pods: ", err)
+	}
+	watcher.Start()
+}
+
+func servePlugin(socketPath, bridge, netNSPath string, allocator *ipam.Allocator, probeWait time.Duration) {
+	p := plugin.NewPlugin(bridge, netNSPath, allocator)
+	p.SetProbeWait(probeWait)
+	if err := p.Listen(socketPath); err != nil {
+		fatal(exitPort, "Unable to serve plugin: ", err)
 	}
-	return allocator
 }
 
 // Pick a quorum size heuristically based on the number of peer
@@ -223,7 +972,53 @@ func determineQuorum(initPeerCountFlag int, peers []string) uint {
 	return quorum
 }
 
-func handleHTTP(router *weave.Router, httpAddr string, allocator *ipam.Allocator) {
+// The HTTP listener systemd passed to us, if we were socket
+// activated, otherwise one on httpAddr, unless that is blank
+func httpListener(httpAddr string) net.Listener {
+	listeners, err := systemd.Listeners()
+	if err != nil {
+		fatal(exitOther, "Unable to use sockets passed by systemd: ", err)
+	}
+	if len(listeners) > 0 {
+		log.Println("Using HTTP listener passed by systemd on", listeners[0].Addr())
+		return listeners[0]
+	}
+	if httpAddr == "" {
+		return nil
+	}
+	return listen(httpAddr, "http")
+}
+
+// Listen on addr, or on the unix domain socket it names if an
+// absolute path
+func listen(addr, what string) net.Listener {
+	protocol := "tcp"
+	if strings.HasPrefix(addr, "/") {
+		os.Remove(addr) // in case it's there from last time
+		protocol = "unix"
+	}
+	l, err := net.Listen(protocol, addr)
+	if err != nil {
+		fatalf(exitPort, "Unable to create %s listener socket: %s", what, err)
+	}
+	return l
+}
+
+// Tell systemd we are ready, so that units depending on us can start,
+// once the router is running and, if we are allocating addresses, the
+// peers have agreed how to divide up the range.
+func notifyReady(allocator *ipam.Allocator) {
+	if allocator != nil {
+		<-allocator.Ready()
+	}
+	if _, err := systemd.Notify("READY=1"); err != nil {
+		log.Println("Unable to notify systemd:", err)
+		return
+	}
+	log.Println("Notified systemd that we are ready")
+}
+
+func handleHTTP(router *weave.Router, l net.Listener, server *http.Server, allocator *ipam.Allocator, dnsServer *weavedns.DNSServer, attacher *attach.Attacher, sources *api.Sources, pprofOn bool, rate float64, burst int) {
 	encryption := "off"
 	if router.UsingPassword() {
 		encryption = "on"
@@ -231,10 +1026,22 @@ func handleHTTP(router *weave.Router, httpAddr string, allocator *ipam.Allocator
 
 	muxRouter := mux.NewRouter()
 
+	api.HandleHTTP(muxRouter, sources)
+
 	if allocator != nil {
 		allocator.HandleHTTP(muxRouter)
 	}
 
+	if dnsServer != nil {
+		weavedns.HandleHTTP(muxRouter, dnsServer.Domain, dnsServer.Zone)
+	}
+
+	if attacher != nil {
+		attacher.HandleHTTP(muxRouter)
+	}
+
+	events.HandleHTTP(muxRouter)
+
 	muxRouter.Methods("GET").Path("/status").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprintln(w, "weave router", version)
 		fmt.Fprintln(w, "Encryption", encryption)
@@ -242,6 +1049,9 @@ func handleHTTP(router *weave.Router, httpAddr string, allocator *ipam.Allocator
 		if allocator != nil {
 			fmt.Fprintln(w, allocator.String())
 		}
+		if dnsServer != nil {
+			fmt.Fprintln(w, dnsServer.Status())
+		}
 	})
 
 	muxRouter.Methods("GET").Path("/status-json").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -259,20 +1069,39 @@ func handleHTTP(router *weave.Router, httpAddr string, allocator *ipam.Allocator
 		router.ConnectionMaker.ForgetConnection(r.FormValue("peer"))
 	})
 
-	http.Handle("/", muxRouter)
+	muxRouter.Methods("GET").Path("/loglevel").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, LogLevelsString())
+	})
 
-	protocol := "tcp"
-	if strings.HasPrefix(httpAddr, "/") {
-		os.Remove(httpAddr) // in case it's there from last time
-		protocol = "unix"
-	}
-	l, err := net.Listen(protocol, httpAddr)
-	if err != nil {
-		log.Fatal("Unable to create http listener socket: ", err)
+	muxRouter.Methods("POST").Path("/loglevel").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch level := r.FormValue("level"); level {
+		case "debug", "info":
+			subsystem := r.FormValue("subsystem")
+			SetDebugLogging(subsystem, level == "debug")
+			log.Printf("Log level of %q set to %s", subsystem, level)
+		default:
+			http.Error(w, fmt.Sprintf("invalid log level %q: expected \"debug\" or \"info\"", level), http.StatusBadRequest)
+		}
+	})
+
+	if pprofOn {
+		muxRouter.Path("/debug/pprof/cmdline").HandlerFunc(pprof.Cmdline)
+		muxRouter.Path("/debug/pprof/profile").HandlerFunc(pprof.Profile)
+		muxRouter.Path("/debug/pprof/symbol").HandlerFunc(pprof.Symbol)
+		muxRouter.PathPrefix("/debug/pprof/").HandlerFunc(pprof.Index)
 	}
 
-	err = http.Serve(l, nil)
+	// Not http.DefaultServeMux, where importing net/http/pprof
+	// registers its handlers regardless of -pprof
+	server.Handler = api.Deprecated(muxRouter)
+	if server.ReadTimeout > 0 {
+		server.Handler = api.Timeout(server.Handler, server.ReadTimeout)
+	}
+	if rate > 0 {
+		server.Handler = api.Limit(server.Handler, rate, burst)
+	}
+	err := server.Serve(l)
 	if err != nil {
-		log.Fatal("Unable to create http server", err)
+		fatal(exitOther, "Unable to create http server: ", err)
 	}
 }
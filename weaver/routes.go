@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/weaveworks/weave/ipam"
+	weavenet "github.com/weaveworks/weave/net"
+	"github.com/weaveworks/weave/networks"
+)
+
+// What -host-routes may ask for
+const (
+	hostRoutesRange   = "range"
+	hostRoutesSubnets = "subnets"
+)
+
+// How often we bring the host's routes to containers into line with
+// the IP range and the networks' subnets, which may change
+const hostRoutesInterval = 10 * time.Second
+
+// hostRoutes keeps routes, in the host's network namespace, via the
+// bridge, to the IP range and, with subnets, to the subnet of each
+// virtual network, so that processes on the host reach containers
+// without anyone running 'ip route'. The routes are marked as ours, so
+// those left by a router that died are tidied up by the next.
+type hostRoutes struct {
+	nsPath   string
+	bridge   string
+	subnets  bool
+	alloc    *ipam.Allocator
+	networks *networks.Registry
+	lastErr  string
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+func parseHostRoutes(desc string) (bool, error) {
+	switch desc {
+	case hostRoutesRange:
+		return false, nil
+	case hostRoutesSubnets:
+		return true, nil
+	}
+	return false, fmt.Errorf("Invalid -host-routes %q: expected %q or %q", desc, hostRoutesRange, hostRoutesSubnets)
+}
+
+func startHostRoutes(procfs, bridge string, subnets bool, alloc *ipam.Allocator, netRegistry *networks.Registry) *hostRoutes {
+	routes := &hostRoutes{
+		bridge:   bridge,
+		subnets:  subnets,
+		alloc:    alloc,
+		networks: netRegistry,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	if procfs != "" {
+		routes.nsPath = weavenet.NetNSPath(procfs, 1)
+	}
+	go routes.run()
+	return routes
+}
+
+func (routes *hostRoutes) run() {
+	defer close(routes.done)
+	ticker := time.NewTicker(hostRoutesInterval)
+	defer ticker.Stop()
+	for {
+		routes.reconcile(routes.wanted())
+		select {
+		case <-ticker.C:
+		case <-routes.stop:
+			// withdraw them all
+			routes.reconcile(nil)
+			return
+		}
+	}
+}
+
+// Stop withdraws the routes, and stops keeping them
+func (routes *hostRoutes) Stop() {
+	close(routes.stop)
+	<-routes.done
+}
+
+// The destinations we want routes to, in order
+func (routes *hostRoutes) wanted() []*net.IPNet {
+	dsts := make(map[string]*net.IPNet)
+	if routes.alloc != nil {
+		if subnet, _ := routes.alloc.Range(); subnet != nil {
+			dsts[subnet.String()] = subnet
+		}
+	}
+	if routes.subnets {
+		for _, network := range routes.networks.Networks() {
+			if _, subnet, err := net.ParseCIDR(network.Subnet); err == nil {
+				dsts[subnet.String()] = subnet
+			}
+		}
+	}
+	var cidrs []string
+	for cidr := range dsts {
+		cidrs = append(cidrs, cidr)
+	}
+	sort.Strings(cidrs)
+	wanted := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		wanted[i] = dsts[cidr]
+	}
+	return wanted
+}
+
+// Add the routes to wanted we don't have, and remove those we added
+// to anything else. A failure, e.g. while the bridge isn't there, is
+// logged only the first time in a row, since we try again shortly.
+func (routes *hostRoutes) reconcile(wanted []*net.IPNet) {
+	err := weavenet.WithNetNSPath(routes.nsPath, func() error {
+		keep := make(map[string]bool)
+		for _, dst := range wanted {
+			keep[dst.String()] = true
+			route := weavenet.Route{Dst: dst, Interface: routes.bridge}
+			added, err := weavenet.EnsureRoute(route)
+			if err != nil {
+				return err
+			}
+			if added {
+				log.Println("Added host route", route)
+			}
+		}
+		owned, err := weavenet.OwnedRoutes()
+		if err != nil {
+			return err
+		}
+		for _, route := range owned {
+			if route.Interface != routes.bridge || route.Gateway != nil || keep[route.Dst.String()] {
+				continue
+			}
+			removed, err := weavenet.RemoveRoute(route)
+			if err != nil {
+				return err
+			}
+			if removed {
+				log.Println("Withdrew host route", route)
+			}
+		}
+		return nil
+	})
+	if err == nil {
+		routes.lastErr = ""
+	} else if err.Error() != routes.lastErr {
+		routes.lastErr = err.Error()
+		log.Println("Unable to update host routes:", err)
+	}
+}